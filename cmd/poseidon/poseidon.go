@@ -17,16 +17,24 @@ limitations under the License.
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/kubernetes-sigs/poseidon/pkg/config"
 	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
 	k8sclient "github.com/kubernetes-sigs/poseidon/pkg/k8sclient"
-	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	"github.com/kubernetes-sigs/poseidon/pkg/leaderelection"
+	"github.com/kubernetes-sigs/poseidon/pkg/logging"
 	"github.com/kubernetes-sigs/poseidon/pkg/poseidonhttp"
 	"github.com/kubernetes-sigs/poseidon/pkg/stats"
 
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/golang/glog"
 )
@@ -36,95 +44,338 @@ const (
 	FirmamentHealthCheckTimeout  = 10 * time.Minute
 )
 
-func schedule(fc firmament.FirmamentSchedulerClient) {
+const (
+	// serviceAccountNamespaceFile holds the namespace of the pod running poseidon.
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	defaultLeaderElectNamespace = "kube-system"
+)
 
-	stopCh := make(chan struct{})
-	// start the bond od wokers
-	go k8sclient.BindPodWorkers(stopCh, config.GetBurst())
-	for {
-		deltas := firmament.Schedule(fc)
-
-		glog.Infof("Scheduler returned %d deltas", len(deltas.GetDeltas()))
-		if (len(deltas.GetUnscheduledTasks()) > 0) || (len(deltas.GetDeltas()) > 0) {
-			if k8sclient.ClientSet != nil {
-				go k8sclient.NewPoseidonEvents(k8sclient.ClientSet).ProcessEvents(deltas)
-			}
+// schedule runs the scheduling rounds and binds the placed pods until stopCh is closed, it returns once the pods
+// queued to be bound are bound.
+func schedule(fc firmament.Client, stopCh <-chan struct{}) {
+	go k8sclient.RunSchedulingLoop(fc, stopCh)
+	k8sclient.BindPodWorkers(fc, stopCh, config.GetBindConcurrency())
+}
+
+// collectStats sends the usage of the nodes and the pods read from the stats source to firmament, until stopCh is
+// closed.
+func collectStats(fc *firmament.FailoverClient, stopCh <-chan struct{}) {
+	interval := time.Duration(config.GetStatsInterval()) * time.Second
+	switch config.GetStatsSource() {
+	case stats.SourceMetricsServer:
+		stats.StartMetricsServerSource(config.GetKubeConfig(), firmament.NewClient(fc), interval, stopCh)
+	case stats.SourceKubeletSummary:
+		stats.StartKubeletSummarySource(config.GetKubeConfig(), firmament.NewClient(fc), interval,
+			config.GetStatsKubeletWorkers(), time.Duration(config.GetStatsKubeletTimeout())*time.Second, stopCh)
+	case stats.SourcePrometheus:
+		queries := stats.PrometheusQueries{
+			NodeCPU:       config.GetPrometheusNodeCPUQuery(),
+			NodeMemory:    config.GetPrometheusNodeMemoryQuery(),
+			NodeNetworkRx: config.GetPrometheusNodeNetworkRxQuery(),
+			NodeNetworkTx: config.GetPrometheusNodeNetworkTxQuery(),
+			PodCPU:        config.GetPrometheusPodCPUQuery(),
+			PodMemory:     config.GetPrometheusPodMemoryQuery(),
+			PodNetworkRx:  config.GetPrometheusPodNetworkRxQuery(),
+			PodNetworkTx:  config.GetPrometheusPodNetworkTxQuery(),
+		}
+		stats.StartPrometheusSource(config.GetKubeConfig(), config.GetPrometheusAddress(), queries, config.GetPrometheusNodeLabel(),
+			firmament.NewClient(fc), interval, stopCh)
+	case stats.SourceHeapster:
+		stats.StartgRPCStatsServer(config.GetStatsServerAddress(), fc, stopCh)
+	}
+}
+
+// run starts watching the cluster, sending the stats and scheduling, until stopCh is closed. The watchers list all
+// the nodes and the pods when they start, a replica acquiring the leadership sends the whole cluster to firmament.
+// It returns once the queued nodes, pods and bindings are processed.
+func run(fc *firmament.FailoverClient, stopCh <-chan struct{}) {
+	scheduled := make(chan struct{})
+	go func() {
+		schedule(firmament.NewClient(fc), stopCh)
+		close(scheduled)
+	}()
+	if config.GetDisableStats() {
+		glog.Info("Stats are disabled, firmament schedules without the usage of the nodes and the pods")
+	} else {
+		go collectStats(fc, stopCh)
+	}
+	var opts []k8sclient.NodeWatcherOption
+	if !config.GetDisableEvents() {
+		opts = append(opts, k8sclient.WithNodeEventRecorder(newEventRecorder()))
+	}
+	kubeMajorVer, kubeMinorVer := config.GetKubeVersion()
+	k8sclient.New(config.GetSchedulerNames(), config.GetKubeConfig(), kubeMajorVer, kubeMinorVer, fc, stopCh, opts...)
+	<-scheduled
+}
+
+// newEventRecorder returns the recorder of the node lifecycle events, sent to the API server.
+func newEventRecorder() record.EventRecorder {
+	restConfig, err := k8sclient.GetClientConfig(config.GetKubeConfig())
+	if err != nil {
+		glog.Fatalf("Failed to load client config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		glog.Fatalf("Failed to create the event recorder client: %v", err)
+	}
+	return k8sclient.NewEventRecorder(clientset)
+}
+
+// leaderElectionConfig returns the leader election lock of the replica, in the namespace of its pod unless set.
+func leaderElectionConfig() leaderelection.Config {
+	namespace := config.GetLeaderElectNamespace()
+	if namespace == "" {
+		namespace = defaultLeaderElectNamespace
+		if data, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+			namespace = strings.TrimSpace(string(data))
 		}
-		for _, delta := range deltas.GetDeltas() {
-			switch delta.GetType() {
-			case firmament.SchedulingDelta_PLACE:
-				k8sclient.PodMux.RLock()
-				podIdentifier, ok := k8sclient.TaskIDToPod[delta.GetTaskId()]
-				k8sclient.PodMux.RUnlock()
-				if !ok {
-					glog.Fatalf("Placed task %d without pod pairing", delta.GetTaskId())
-				}
-				k8sclient.NodeMux.RLock()
-				nodeName, ok := k8sclient.ResIDToNode[delta.GetResourceId()]
-				k8sclient.NodeMux.RUnlock()
-				if !ok {
-					glog.Fatalf("Placed task %d on resource %s without node pairing", delta.GetTaskId(), delta.GetResourceId())
-				}
-				// TODO(jiaxuanzhou): Metric the latency of binding one node when client provided to get the desc of the task(pod)
-				// metrics.BindingLatency.Observe(metrics.SinceInMicroseconds(time.Time(task.SubmitTime)))
-				k8sclient.BindChannel <- k8sclient.BindInfo{Name: podIdentifier.Name, Namespace: podIdentifier.Namespace, Nodename: nodeName}
-			case firmament.SchedulingDelta_PREEMPT, firmament.SchedulingDelta_MIGRATE:
-				k8sclient.PodMux.RLock()
-				preemptionStartTime := time.Now()
-				podIdentifier, ok := k8sclient.TaskIDToPod[delta.GetTaskId()]
-				k8sclient.PodMux.RUnlock()
-				if !ok {
-					glog.Fatalf("Preempted task %d without pod pairing", delta.GetTaskId())
-				}
-				metrics.PreemptionAttempts.Inc()
-				// XXX(ionel): HACK! Kubernetes does not yet have support for preemption.
-				// However, preemption can be achieved by deleting the preempted pod
-				// and relying on the controller mechanism (e.g., job, replica set)
-				// to submit another instance of this pod.
-				k8sclient.DeletePod(podIdentifier.Name, podIdentifier.Namespace)
-				metrics.SchedulingPremptionEvaluationDuration.Observe(metrics.SinceInMicroseconds(preemptionStartTime))
-			case firmament.SchedulingDelta_NOOP:
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		glog.Fatalf("Unable to get the hostname of the leader election identity: %v", err)
+	}
+	return leaderelection.Config{
+		Namespace:     namespace,
+		Name:          config.GetLeaderElectName(),
+		Identity:      identity,
+		LeaseDuration: time.Duration(config.GetLeaderElectLeaseDuration()) * time.Second,
+		RenewDeadline: time.Duration(config.GetLeaderElectRenewDeadline()) * time.Second,
+		RetryPeriod:   time.Duration(config.GetLeaderElectRetryPeriod()) * time.Second,
+	}
+}
+
+// runLeaderElection stands by until the replica acquires the leadership and runs poseidon, until stopCh is closed.
+// The replica exits once the leadership is lost, its watchers and the state sent to firmament are not shared with
+// the new leader. A leader stopped by stopCh releases the lock once its work is drained, so that a standby replica
+// takes over right away.
+func runLeaderElection(fc *firmament.FailoverClient, electionConfig leaderelection.Config, stopCh <-chan struct{}) {
+	restConfig, err := k8sclient.GetClientConfig(config.GetKubeConfig())
+	if err != nil {
+		glog.Fatalf("Failed to load client config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		glog.Fatalf("Failed to create the leader election client: %v", err)
+	}
+	ran := make(chan struct{})
+	stopped := false
+	le, err := leaderelection.NewLeaderElector(clientset, electionConfig, leaderelection.Callbacks{
+		OnStartedLeading: func(leaderCh <-chan struct{}) {
+			defer close(ran)
+			run(fc, leaderCh)
+		},
+		OnStoppedLeading: func() {
+			select {
+			case <-stopCh:
+				stopped = true
 			default:
-				glog.Fatalf("Unexpected SchedulingDelta type %v", delta.GetType())
+				glog.Fatalf("Lost the leader lock %s/%s, exiting", electionConfig.Namespace, electionConfig.Name)
 			}
-		}
-		// TODO(ionel): Temporary sleep statement because we currently call the scheduler even if there's no work do to.
-		time.Sleep(time.Duration(config.GetSchedulingInterval()) * time.Second)
+		},
+	})
+	if err != nil {
+		glog.Fatalf("Invalid leader election: %v", err)
 	}
+	le.Run(stopCh)
+	if !stopped {
+		// The replica stood by until it was stopped.
+		return
+	}
+	<-ran
+	if err := le.Release(); err != nil {
+		glog.Errorf("Unable to release the leader lock %s/%s: %v", electionConfig.Namespace, electionConfig.Name, err)
+	}
+}
+
+// terminationSignals returns the channel receiving SIGTERM and SIGINT.
+func terminationSignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	return signals
 }
 
-// WaitForFirmamentService blocks till the Firmament service is available
-func WaitForFirmamentService(fc firmament.FirmamentSchedulerClient) {
+// waitForTermination closes stopCh once a termination signal is received, and waits up to timeout for drained to
+// be closed once the queued nodes, pods and bindings are processed. It returns false if the timeout expired first.
+func waitForTermination(signals <-chan os.Signal, stopCh chan struct{}, drained <-chan struct{}, timeout time.Duration) bool {
+	sig := <-signals
+	glog.Infof("Received %v, draining the work queues for up to %v", sig, timeout)
+	close(stopCh)
+	select {
+	case <-drained:
+		glog.Info("Drained the work queues, shutting down")
+		return true
+	case <-time.After(timeout):
+		glog.Warningf("The work queues were not drained within %v, shutting down", timeout)
+		return false
+	}
+}
+
+// WaitForFirmamentService blocks till the Firmament service is available. It returns false if stopCh is closed first.
+func WaitForFirmamentService(fc firmament.FirmamentSchedulerClient, stopCh <-chan struct{}) bool {
 	// TODO(jiaxuanzhou): Need to metric the wait latency of firmament service?
 	serviceReq := new(firmament.HealthCheckRequest)
-	err := wait.PollImmediate(FirmamentHealthCheckInterval, FirmamentHealthCheckTimeout, func() (bool, error) {
+	// done is closed once the wait times out or stopCh is closed.
+	done, returned := make(chan struct{}), make(chan struct{})
+	defer close(returned)
+	go func() {
+		defer close(done)
+		select {
+		case <-stopCh:
+		case <-time.After(FirmamentHealthCheckTimeout):
+		case <-returned:
+		}
+	}()
+	err := wait.PollImmediateUntil(FirmamentHealthCheckInterval, func() (bool, error) {
 		ok, err := firmament.Check(fc, serviceReq)
 		if err != nil {
-			panic(err)
+			// The check waits for the connection to be ready, firmament may still be starting.
+			glog.Infof("Firmament service is not available yet: %v", err)
+			return false, nil
 		}
 		if !ok {
 			return false, nil
 		}
 		return true, nil
-	})
-	if err != nil {
-		glog.Fatalf("Timed-out waiting for firmament service %v", err)
+	}, done)
+	if err == nil {
+		return true
+	}
+	select {
+	case <-stopCh:
+		return false
+	default:
 	}
+	glog.Fatalf("Timed-out waiting for firmament service %v", err)
+	return false
 }
 
 func main() {
+	if config.GetWriteConfigTemplate() {
+		if err := config.WriteConfigTemplate(os.Stdout); err != nil {
+			glog.Fatalf("Unable to write the config template: %v", err)
+		}
+		return
+	}
+	if err := logging.SetFormat(logging.Format(config.GetLogFormat())); err != nil {
+		glog.Fatalf("Invalid log format: %v", err)
+	}
 
-	glog.Infof("Starting Poseidon with firmament address %s.", config.GetFirmamentAddress())
-	fc, conn, err := firmament.New(config.GetFirmamentAddress())
+	glog.Infof("Starting Poseidon with firmament addresses %v.", config.GetFirmamentAddresses())
+	firmamentTLS := firmament.TLSConfig{
+		Enabled:    config.GetFirmamentTLS(),
+		CAFile:     config.GetFirmamentCAFile(),
+		CertFile:   config.GetFirmamentCertFile(),
+		KeyFile:    config.GetFirmamentKeyFile(),
+		ServerName: config.GetFirmamentServerName(),
+	}
+	if config.GetFirmamentRPCTimeout() <= 0 || config.GetFirmamentScheduleTimeout() <= 0 {
+		glog.Fatalf("Invalid firmament timeouts %ds and %ds, they must be positive", config.GetFirmamentRPCTimeout(), config.GetFirmamentScheduleTimeout())
+	}
+	firmament.SetTimeouts(time.Duration(config.GetFirmamentRPCTimeout())*time.Second, time.Duration(config.GetFirmamentScheduleTimeout())*time.Second)
+	retryInterval := time.Duration(config.GetFirmamentRetryInitialInterval()) * time.Millisecond
+	retryPolicy := firmament.RetryPolicy{
+		InitialInterval: retryInterval,
+		Multiplier:      config.GetFirmamentRetryMultiplier(),
+		MaxElapsedTime:  time.Duration(config.GetFirmamentRetryMaxElapsedTime()) * time.Millisecond,
+	}
+	scheduleRetryPolicy := firmament.RetryPolicy{
+		InitialInterval: retryInterval,
+		Multiplier:      config.GetFirmamentRetryMultiplier(),
+		MaxElapsedTime:  time.Duration(config.GetFirmamentScheduleRetryMaxElapsedTime()) * time.Millisecond,
+	}
+	for _, policy := range []firmament.RetryPolicy{retryPolicy, scheduleRetryPolicy} {
+		if err := policy.Validate(); err != nil {
+			glog.Fatalf("Invalid firmament retry policy: %v", err)
+		}
+	}
+	firmament.SetRetryPolicies(retryPolicy, scheduleRetryPolicy)
+	if config.GetScheduleBreakerThreshold() < 0 || config.GetScheduleBreakerCoolDown() <= 0 {
+		glog.Fatalf("Invalid scheduling circuit breaker, threshold %d must not be negative and cool-down %ds must be positive",
+			config.GetScheduleBreakerThreshold(), config.GetScheduleBreakerCoolDown())
+	}
+	firmament.SetScheduleBreaker(config.GetScheduleBreakerThreshold(), time.Duration(config.GetScheduleBreakerCoolDown())*time.Second)
+	if config.GetFailureLogInterval() < 0 {
+		glog.Fatalf("Invalid failure log interval %ds, it must not be negative", config.GetFailureLogInterval())
+	}
+	firmament.SetRequestFailureLogInterval(time.Duration(config.GetFailureLogInterval()) * time.Second)
+	switch source := config.GetStatsSource(); source {
+	case stats.SourceMetricsServer, stats.SourceKubeletSummary, stats.SourcePrometheus, stats.SourceHeapster:
+	default:
+		glog.Fatalf("Invalid stats source %q, it must be %s, %s, %s or %s", source, stats.SourceMetricsServer, stats.SourceKubeletSummary, stats.SourcePrometheus, stats.SourceHeapster)
+	}
+	if config.GetAdvertiseNodeUsage() && config.GetStatsSource() != stats.SourceMetricsServer {
+		glog.Fatalf("Invalid stats source %q, the node usage is only advertised with the %s stats source", config.GetStatsSource(), stats.SourceMetricsServer)
+	}
+	if time.Duration(config.GetStatsInterval())*time.Second < stats.MinStatsInterval {
+		glog.Fatalf("Invalid stats interval %ds, it must be at least %v", config.GetStatsInterval(), stats.MinStatsInterval)
+	}
+	if config.GetStatsKubeletWorkers() <= 0 || config.GetStatsKubeletTimeout() <= 0 {
+		glog.Fatalf("Invalid stats kubelet workers %d and kubelet timeout %ds, they must be positive",
+			config.GetStatsKubeletWorkers(), config.GetStatsKubeletTimeout())
+	}
+	if config.GetFirmamentFailoverThreshold() <= 0 {
+		glog.Fatalf("Invalid firmament failover threshold %ds, it must be positive", config.GetFirmamentFailoverThreshold())
+	}
+	if config.GetHealthPort() < 0 || config.GetHealthPort() > 65535 {
+		glog.Fatalf("Invalid health port %d, it must be between 0 and 65535", config.GetHealthPort())
+	}
+	if config.GetShutdownTimeout() <= 0 {
+		glog.Fatalf("Invalid shutdown timeout %ds, it must be positive", config.GetShutdownTimeout())
+	}
+	if config.GetCacheSyncTimeout() < 0 {
+		glog.Fatalf("Invalid cache sync timeout %ds, it must not be negative", config.GetCacheSyncTimeout())
+	}
+	if config.GetWorkerStallTimeout() <= 0 {
+		glog.Fatalf("Invalid worker stall timeout %ds, it must be positive", config.GetWorkerStallTimeout())
+	}
+	if config.GetBindConcurrency() <= 0 {
+		glog.Fatalf("Invalid bind concurrency %d, it must be greater than 0", config.GetBindConcurrency())
+	}
+	schedulingPolicy := firmament.SchedulingPolicy{
+		CostModel: config.GetFirmamentCostModel(),
+		Solver:    config.GetFirmamentSolver(),
+	}
+	if err := schedulingPolicy.Validate(); err != nil {
+		glog.Fatalf("Invalid firmament scheduling policy: %v", err)
+	}
+	var electionConfig leaderelection.Config
+	if config.GetLeaderElect() {
+		electionConfig = leaderElectionConfig()
+		if err := electionConfig.Validate(); err != nil {
+			glog.Fatalf("Invalid leader election: %v", err)
+		}
+	}
+	fc, err := firmament.NewFailover(config.GetFirmamentAddresses(), firmamentTLS, time.Duration(config.GetFirmamentFailoverThreshold())*time.Second)
 	if err != nil {
 		panic(err)
 	}
-	defer conn.Close()
-	// Check if firmament grpc service is available and then proceed
-	WaitForFirmamentService(fc)
-	go schedule(fc)
-	go stats.StartgRPCStatsServer(config.GetStatsServerAddress(), config.GetFirmamentAddress())
-	go poseidonhttp.Serve(fc)
-	kubeMajorVer, kubeMinorVer := config.GetKubeVersion()
-	k8sclient.New(config.GetSchedulerName(), config.GetKubeConfig(), kubeMajorVer, kubeMinorVer, config.GetFirmamentAddress())
+	signals := terminationSignals()
+	stopCh := make(chan struct{})
+	httpStopped := make(chan struct{})
+	// The health endpoints are served while waiting for firmament, poseidon is live but not ready meanwhile.
+	go func() {
+		poseidonhttp.Serve(fc, stopCh)
+		close(httpStopped)
+	}()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		// Check if firmament grpc service is available and then proceed
+		if !WaitForFirmamentService(fc, stopCh) {
+			return
+		}
+		firmament.ConfigureSchedulingPolicy(fc.ActiveAddress(), schedulingPolicy)
+		if !config.GetLeaderElect() {
+			run(fc, stopCh)
+			return
+		}
+		runLeaderElection(fc, electionConfig, stopCh)
+	}()
+	// The pods placed by firmament are bound and the node and pod changes are sent to firmament before the
+	// connection to firmament is closed, the last scrape of the metrics and the probes in flight are served.
+	waitForTermination(signals, stopCh, drained, time.Duration(config.GetShutdownTimeout())*time.Second)
+	<-httpStopped
+	fc.Close()
+	glog.Flush()
+	os.Exit(0)
 }
@@ -0,0 +1,78 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestWaitForTermination checks that the items queued when SIGTERM is received are processed before
+// waitForTermination returns.
+func TestWaitForTermination(t *testing.T) {
+	signals := terminationSignals()
+	stopCh := make(chan struct{})
+	drained := make(chan struct{})
+	queue := make(chan int, 10)
+	for i := 0; i < cap(queue); i++ {
+		queue <- i
+	}
+	processed := 0
+	go func() {
+		defer close(drained)
+		<-stopCh
+		// Like the watchers, the worker processes the queued items once stopped and returns once they are processed.
+		for {
+			select {
+			case <-queue:
+				time.Sleep(10 * time.Millisecond)
+				processed++
+			default:
+				return
+			}
+		}
+	}()
+
+	go syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	if !waitForTermination(signals, stopCh, drained, 10*time.Second) {
+		t.Fatal("expected the queue to be drained within the timeout")
+	}
+	if processed != cap(queue) {
+		t.Errorf("expected the %d queued items to be processed before exit, got %d", cap(queue), processed)
+	}
+}
+
+// TestWaitForTerminationTimeout checks that waitForTermination gives up once the timeout expired.
+func TestWaitForTerminationTimeout(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGINT
+	stopCh := make(chan struct{})
+	start := time.Now()
+	if waitForTermination(signals, stopCh, make(chan struct{}), 50*time.Millisecond) {
+		t.Fatal("expected the shutdown to time out")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected to wait for the timeout, returned after %v", elapsed)
+	}
+	select {
+	case <-stopCh:
+	default:
+		t.Error("expected stopCh to be closed")
+	}
+}
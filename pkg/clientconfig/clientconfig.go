@@ -0,0 +1,70 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package clientconfig resolves the config of the API server clients of poseidon and of the e2e tests. It does not
+// depend on the poseidon flags so that the e2e framework, which parses flags of its own, can use it.
+package clientconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// inClusterConfig returns the config of the service account of the pod, it is replaced by the tests.
+var inClusterConfig = rest.InClusterConfig
+
+// Load returns the config of the API server client. The service account of the pod is used when running in a
+// cluster, the kubeconfig file at kubeconfig otherwise, or at $KUBECONFIG or $HOME/.kube/config when kubeconfig is
+// empty. The source of the config is logged.
+func Load(kubeconfig string) (*rest.Config, error) {
+	config, source, err := load(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("Using the API server client config of %s", source)
+	return config, nil
+}
+
+// load returns the config of the API server client along with its source.
+func load(kubeconfig string) (*rest.Config, string, error) {
+	config, inClusterErr := inClusterConfig()
+	if inClusterErr == nil {
+		return config, "the in-cluster service account", nil
+	}
+	path, source := kubeconfig, "--kubeConfig"
+	if path == "" {
+		// KUBECONFIG may hold a list of files, the first one is used.
+		if paths := filepath.SplitList(os.Getenv(clientcmd.RecommendedConfigPathEnvVar)); len(paths) > 0 {
+			path, source = paths[0], "$"+clientcmd.RecommendedConfigPathEnvVar
+		}
+	}
+	if path == "" {
+		path, source = filepath.Join(os.Getenv("HOME"), clientcmd.RecommendedHomeDir, clientcmd.RecommendedFileName), "$HOME"
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, "", fmt.Errorf("not running in a cluster (%v) and no kubeconfig file found at %s: %v", inClusterErr, path, err)
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", path)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid kubeconfig file %s: %v", path, err)
+	}
+	return config, fmt.Sprintf("the kubeconfig file %s from %s", path, source), nil
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clientconfig
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+const kubeconfigTemplate = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+current-context: test
+users:
+- name: test
+  user:
+    token: test
+`
+
+var errNotInCluster = errors.New("not running in a cluster")
+
+// writeKubeconfig writes a kubeconfig file of the API server at server in dir.
+func writeKubeconfig(t *testing.T, dir, name, server string) string {
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("unable to create the kubeconfig directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf(kubeconfigTemplate, server)), 0600); err != nil {
+		t.Fatalf("unable to write the kubeconfig file: %v", err)
+	}
+	return path
+}
+
+// setEnv sets the environment variable key to value and returns the function restoring it.
+func setEnv(key, value string) func() {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// TestLoad checks the order the sources of the config are tried in: the in-cluster service account, the kubeconfig
+// flag, $KUBECONFIG and $HOME/.kube/config.
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poseidon-clientconfig")
+	if err != nil {
+		t.Fatalf("unable to create the kubeconfig directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	flagPath := writeKubeconfig(t, dir, "flag", "https://flag:6443")
+	envPath := writeKubeconfig(t, dir, "env", "https://env:6443")
+	writeKubeconfig(t, dir, filepath.Join("home", ".kube", "config"), "https://home:6443")
+	defer setEnv("HOME", filepath.Join(dir, "home"))()
+	defer func(f func() (*rest.Config, error)) { inClusterConfig = f }(inClusterConfig)
+	notInCluster := func() (*rest.Config, error) { return nil, errNotInCluster }
+
+	var testData = []struct {
+		name       string
+		inCluster  func() (*rest.Config, error)
+		kubeconfig string
+		env        string
+		expected   string
+	}{
+		{
+			name:       "in-cluster",
+			inCluster:  func() (*rest.Config, error) { return &rest.Config{Host: "https://in-cluster:443"}, nil },
+			kubeconfig: flagPath,
+			env:        envPath,
+			expected:   "https://in-cluster:443",
+		},
+		{
+			name:       "flag",
+			inCluster:  notInCluster,
+			kubeconfig: flagPath,
+			env:        envPath,
+			expected:   "https://flag:6443",
+		},
+		{
+			name:      "env",
+			inCluster: notInCluster,
+			env:       envPath + string(filepath.ListSeparator) + flagPath,
+			expected:  "https://env:6443",
+		},
+		{
+			name:      "home",
+			inCluster: notInCluster,
+			expected:  "https://home:6443",
+		},
+	}
+
+	for _, data := range testData {
+		inClusterConfig = data.inCluster
+		restore := setEnv("KUBECONFIG", data.env)
+		config, err := Load(data.kubeconfig)
+		restore()
+		if err != nil {
+			t.Errorf("%s: Load() failed: %v", data.name, err)
+			continue
+		}
+		if config.Host != data.expected {
+			t.Errorf("%s: expected the API server %s, got %s", data.name, data.expected, config.Host)
+		}
+	}
+}
+
+// TestLoadErrors checks that a missing or invalid kubeconfig file outside a cluster is reported by path.
+func TestLoadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poseidon-clientconfig")
+	if err != nil {
+		t.Fatalf("unable to create the kubeconfig directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	invalidPath := filepath.Join(dir, "invalid")
+	if err := ioutil.WriteFile(invalidPath, []byte("clusters: ["), 0600); err != nil {
+		t.Fatalf("unable to write the kubeconfig file: %v", err)
+	}
+	defer setEnv("HOME", dir)()
+	defer setEnv("KUBECONFIG", "")()
+	defer func(f func() (*rest.Config, error)) { inClusterConfig = f }(inClusterConfig)
+	inClusterConfig = func() (*rest.Config, error) { return nil, errNotInCluster }
+
+	for _, path := range []string{"", filepath.Join(dir, "missing"), invalidPath} {
+		_, err := Load(path)
+		expected := path
+		if path == "" {
+			expected = filepath.Join(dir, ".kube", "config")
+		}
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected an error mentioning %s, got %v", path, expected, err)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package config
 
 import (
 	"flag"
+	"net"
 	"strconv"
 	"strings"
 
@@ -26,25 +27,121 @@ import (
 	"github.com/spf13/viper"
 )
 
-var config poseidonConfig
+var config Config
 
-type poseidonConfig struct {
+// Config holds the options of poseidon, read from the command line flags and the config files. The json names of
+// the fields are the names of the flags.
+type Config struct {
 	SchedulerName      string  `json:"schedulerName,omitempty"`
+	SchedulerNames     string  `json:"schedulerNames,omitempty"`
 	FirmamentAddress   string  `json:"firmamentAddress,omitempty"`
 	KubeConfig         string  `json:"kubeConfig,omitempty"`
 	KubeVersion        string  `json:"kubeVersion,omitempty"`
 	StatsServerAddress string  `json:"statsServerAddress,omitempty"`
 	SchedulingInterval int     `json:"schedulingInterval,omitempty"`
+	IdleInterval       int     `json:"idleSchedulingInterval,omitempty"`
+	ScheduleStream     bool    `json:"firmamentScheduleStream,omitempty"`
 	FirmamentPort      string  `json:"firmamentPort,omitempty"`
 	ConfigPath         string  `json:"configPath,omitempty"`
 	EnablePprof        bool    `json:"enablePprof,omitempty"`
 	PprofAddress       string  `json:"pprofAddress,omitempty"`
+	EnableAdmin        bool    `json:"enableAdminEndpoints,omitempty"`
 	MetricsBindAddress string  `json:"metricsBindAddress,omitempty"`
 	HealthCheckAddress string  `json:"healthCheckAddress,omitempty"`
 	K8sBurst           int     `json:"k8sBurst,omitempty"`
 	K8sQPS             float32 `json:"k8sQPS,omitempty"`
 	DefaultBehaviour   bool    `json:"defaultBehaviour,omitempty"`
 	DisableEvents      bool    `json:"disableEvents,omitempty"`
+	EnablePreemption   bool    `json:"enablePreemption,omitempty"`
+	CPUOvercommitRatio float64 `json:"cpuOvercommitRatio,omitempty"`
+	MemOvercommitRatio float64 `json:"memOvercommitRatio,omitempty"`
+	DefaultCPURequest  string  `json:"defaultCPURequest,omitempty"`
+	DefaultMemRequest  string  `json:"defaultMemRequest,omitempty"`
+	WatchErrThreshold  int     `json:"watchErrorThreshold,omitempty"`
+	ExcludeCtrlPlane   bool    `json:"excludeControlPlane,omitempty"`
+	UnschedTimeout     int     `json:"unschedulableTimeout,omitempty"`
+	Workers            int     `json:"workers,omitempty"`
+	MaxWorkers         int     `json:"maxWorkers,omitempty"`
+	GangTimeout        int     `json:"gangSchedulingTimeout,omitempty"`
+	BatchWindow        int     `json:"batchWindow,omitempty"`
+	MaxBatchSize       int     `json:"maxBatchSize,omitempty"`
+	RestartPeriod      int     `json:"workerRestartPeriod,omitempty"`
+	RestartJitter      float64 `json:"workerRestartJitter,omitempty"`
+	BindAttempts       int     `json:"bindRetryAttempts,omitempty"`
+	BindBackoff        int     `json:"bindRetryBackoff,omitempty"`
+	NodeTopology       bool    `json:"nodeResourceTopology,omitempty"`
+	NamespaceAllow     string  `json:"namespaceAllowlist,omitempty"`
+	NamespaceDeny      string  `json:"namespaceDenylist,omitempty"`
+	ScheduleOnDrain    bool    `json:"scheduleOnQueueDrain,omitempty"`
+	NotReadyGrace      int     `json:"nodeNotReadyGracePeriod,omitempty"`
+	QoSGuaranteed      int     `json:"qosPriorityGuaranteed,omitempty"`
+	QoSBurstable       int     `json:"qosPriorityBurstable,omitempty"`
+	QoSBestEffort      int     `json:"qosPriorityBestEffort,omitempty"`
+	CapacityDebounce   int     `json:"capacityChangeDebounce,omitempty"`
+	NamespaceQueues    bool    `json:"namespaceQueues,omitempty"`
+	NodeResync         int     `json:"nodeResyncPeriod,omitempty"`
+	NodeSelector       string  `json:"nodeLabelSelector,omitempty"`
+	UseNodeCapacity    bool    `json:"useNodeCapacity,omitempty"`
+	MemoryUnit         string  `json:"memoryUnit,omitempty"`
+	FirmamentTLS       bool    `json:"firmamentTLS,omitempty"`
+	FirmamentCAFile    string  `json:"firmamentCAFile,omitempty"`
+	FirmamentCertFile  string  `json:"firmamentCertFile,omitempty"`
+	FirmamentKeyFile   string  `json:"firmamentKeyFile,omitempty"`
+	FirmamentSrvName   string  `json:"firmamentServerName,omitempty"`
+	FirmamentTimeout   int     `json:"firmamentRPCTimeout,omitempty"`
+	ScheduleTimeout    int     `json:"firmamentScheduleTimeout,omitempty"`
+	RetryInterval      int     `json:"firmamentRetryInitialInterval,omitempty"`
+	RetryMultiplier    float64 `json:"firmamentRetryMultiplier,omitempty"`
+	RetryMaxElapsed    int     `json:"firmamentRetryMaxElapsedTime,omitempty"`
+	ScheduleRetryMax   int     `json:"firmamentScheduleRetryMaxElapsedTime,omitempty"`
+	FailoverThreshold  int     `json:"firmamentFailoverThreshold,omitempty"`
+	BreakerThreshold   int     `json:"firmamentScheduleBreakerThreshold,omitempty"`
+	BreakerCoolDown    int     `json:"firmamentScheduleBreakerCoolDown,omitempty"`
+	FailureLogInterval int     `json:"failureLogInterval,omitempty"`
+	DisableStats       bool    `json:"disableStats,omitempty"`
+	StatsSource        string  `json:"statsSource,omitempty"`
+	StatsInterval      int     `json:"statsInterval,omitempty"`
+	StatsWorkers       int     `json:"statsKubeletWorkers,omitempty"`
+	StatsTimeout       int     `json:"statsKubeletTimeout,omitempty"`
+	PromAddress        string  `json:"prometheusAddress,omitempty"`
+	PromNodeLabel      string  `json:"prometheusNodeLabel,omitempty"`
+	PromNodeCPU        string  `json:"prometheusNodeCPUQuery,omitempty"`
+	PromNodeMemory     string  `json:"prometheusNodeMemoryQuery,omitempty"`
+	PromNodeNetRx      string  `json:"prometheusNodeNetworkRxQuery,omitempty"`
+	PromNodeNetTx      string  `json:"prometheusNodeNetworkTxQuery,omitempty"`
+	PromPodCPU         string  `json:"prometheusPodCPUQuery,omitempty"`
+	PromPodMemory      string  `json:"prometheusPodMemoryQuery,omitempty"`
+	PromPodNetRx       string  `json:"prometheusPodNetworkRxQuery,omitempty"`
+	PromPodNetTx       string  `json:"prometheusPodNetworkTxQuery,omitempty"`
+	LeaderElect        bool    `json:"leaderElect,omitempty"`
+	LeaderNamespace    string  `json:"leaderElectNamespace,omitempty"`
+	LeaderName         string  `json:"leaderElectName,omitempty"`
+	LeaseDuration      int     `json:"leaderElectLeaseDuration,omitempty"`
+	RenewDeadline      int     `json:"leaderElectRenewDeadline,omitempty"`
+	RetryPeriod        int     `json:"leaderElectRetryPeriod,omitempty"`
+	HealthPort         int     `json:"healthPort,omitempty"`
+	StallTimeout       int     `json:"workerStallTimeout,omitempty"`
+	AnnotateTaskID     bool    `json:"annotateTaskID,omitempty"`
+	MaxNodeEvents      int     `json:"maxInFlightNodeEvents,omitempty"`
+	AdvertiseUsage     bool    `json:"advertiseNodeUsage,omitempty"`
+	ShutdownTimeout    int     `json:"shutdownTimeout,omitempty"`
+	CacheSyncTimeout   int     `json:"cacheSyncTimeout,omitempty"`
+	FirmamentCostModel string  `json:"firmamentCostModel,omitempty"`
+	FirmamentSolver    string  `json:"firmamentSolver,omitempty"`
+	NodeWatchStaleness int     `json:"nodeWatchStaleness,omitempty"`
+	PodWatchStaleness  int     `json:"podWatchStaleness,omitempty"`
+	EnableDebug        bool    `json:"enableDebugEndpoints,omitempty"`
+	RedactDebug        bool    `json:"redactDebugEndpoints,omitempty"`
+	LogFormat          string  `json:"logFormat,omitempty"`
+	NodeWorkers        int     `json:"nodeWorkers,omitempty"`
+	PodWorkers         int     `json:"podWorkers,omitempty"`
+	BindConcurrency    int     `json:"bindConcurrency,omitempty"`
+	PUsPerMachine      int     `json:"pusPerMachine,omitempty"`
+	RetryBaseDelay     int     `json:"queueRetryBaseDelay,omitempty"`
+	RetryMaxDelay      int     `json:"queueRetryMaxDelay,omitempty"`
+	QueueMaxRetries    int     `json:"queueMaxRetries,omitempty"`
+	ConfigFile         string  `json:"-"`
+	WriteTemplate      bool    `json:"-"`
 }
 
 // GetSchedulerName returns the SchedulerName from config
@@ -52,13 +149,190 @@ func GetSchedulerName() string {
 	return config.SchedulerName
 }
 
-// GetFirmamentAddress returns the FirmamentAddress from config
+// GetSchedulerNames returns the list of scheduler names serviced by poseidon from config,
+// it defaults to the SchedulerName when the list is empty
+func GetSchedulerNames() []string {
+	schedulerNames := SplitList(config.SchedulerNames)
+	if len(schedulerNames) == 0 {
+		return []string{config.SchedulerName}
+	}
+	return schedulerNames
+}
+
+// GetCapacityChangeDebounce returns the time in milliseconds the capacity changes are merged before a scheduling round is triggered
+func GetCapacityChangeDebounce() int {
+	return config.CapacityDebounce
+}
+
+// GetQoSPriorityGuaranteed returns the base priority added to the task priority of Guaranteed pods
+func GetQoSPriorityGuaranteed() int {
+	return config.QoSGuaranteed
+}
+
+// GetQoSPriorityBurstable returns the base priority added to the task priority of Burstable pods
+func GetQoSPriorityBurstable() int {
+	return config.QoSBurstable
+}
+
+// GetQoSPriorityBestEffort returns the base priority added to the task priority of BestEffort pods
+func GetQoSPriorityBestEffort() int {
+	return config.QoSBestEffort
+}
+
+// GetNodeNotReadyGracePeriod returns the time in seconds a node stays not ready before it is failed in firmament
+func GetNodeNotReadyGracePeriod() int {
+	return config.NotReadyGrace
+}
+
+// GetNodeResyncPeriod returns the time in seconds between two resyncs of the node informer
+func GetNodeResyncPeriod() int {
+	return config.NodeResync
+}
+
+// GetNodeLabelSelector returns the label selector of the nodes watched by poseidon
+func GetNodeLabelSelector() string {
+	return config.NodeSelector
+}
+
+// GetUseNodeCapacity returns if the node capacity is advertised to firmament instead of the allocatable resources
+func GetUseNodeCapacity() bool {
+	return config.UseNodeCapacity
+}
+
+// GetMemoryUnit returns the unit of the memory capacities and requests sent to firmament, KB, MB or MiB
+func GetMemoryUnit() string {
+	return config.MemoryUnit
+}
+
+// GetFirmamentTLS returns if the connection to firmament is secured with TLS
+func GetFirmamentTLS() bool {
+	return config.FirmamentTLS
+}
+
+// GetFirmamentCAFile returns the path to the CA certificate verifying the firmament certificate
+func GetFirmamentCAFile() string {
+	return config.FirmamentCAFile
+}
+
+// GetFirmamentCertFile returns the path to the client certificate presented to firmament
+func GetFirmamentCertFile() string {
+	return config.FirmamentCertFile
+}
+
+// GetFirmamentKeyFile returns the path to the key of the client certificate presented to firmament
+func GetFirmamentKeyFile() string {
+	return config.FirmamentKeyFile
+}
+
+// GetFirmamentServerName returns the name verified in the firmament certificate
+func GetFirmamentServerName() string {
+	return config.FirmamentSrvName
+}
+
+// GetFirmamentRPCTimeout returns the deadline in seconds of the requests to firmament, besides the scheduling rounds
+func GetFirmamentRPCTimeout() int {
+	return config.FirmamentTimeout
+}
+
+// GetFirmamentScheduleTimeout returns the deadline in seconds of the scheduling rounds of firmament
+func GetFirmamentScheduleTimeout() int {
+	return config.ScheduleTimeout
+}
+
+// GetFirmamentRetryInitialInterval returns the time in milliseconds before the first retry of a firmament request failing with a transient error
+func GetFirmamentRetryInitialInterval() int {
+	return config.RetryInterval
+}
+
+// GetFirmamentRetryMultiplier returns the factor applied to the retry interval after each retry of a firmament request
+func GetFirmamentRetryMultiplier() float64 {
+	return config.RetryMultiplier
+}
+
+// GetFirmamentRetryMaxElapsedTime returns the time in milliseconds spent retrying a firmament request, 0 disables the retries
+func GetFirmamentRetryMaxElapsedTime() int {
+	return config.RetryMaxElapsed
+}
+
+// GetFirmamentScheduleRetryMaxElapsedTime returns the time in milliseconds spent retrying a scheduling round, 0 disables the retries
+func GetFirmamentScheduleRetryMaxElapsedTime() int {
+	return config.ScheduleRetryMax
+}
+
+// GetScheduleOnQueueDrain returns if a scheduling round is started once the pod or node work queue is drained
+func GetScheduleOnQueueDrain() bool {
+	return config.ScheduleOnDrain
+}
+
+// GetNamespaceQueues returns if the pods of every namespace are processed by their own work queue and workers
+func GetNamespaceQueues() bool {
+	return config.NamespaceQueues
+}
+
+// GetNamespaceAllowlist returns the namespaces whose pods are handled by poseidon, all namespaces are
+// handled when the list is empty
+func GetNamespaceAllowlist() []string {
+	return SplitList(config.NamespaceAllow)
+}
+
+// GetNamespaceDenylist returns the namespaces whose pods are ignored by poseidon
+func GetNamespaceDenylist() []string {
+	return SplitList(config.NamespaceDeny)
+}
+
+// SplitList returns the items of a comma separated list option, e.g. of namespaceAllowlist
+func SplitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// GetFirmamentAddress returns the address of the first firmament endpoint from config
 func GetFirmamentAddress() string {
+	return GetFirmamentAddresses()[0]
+}
+
+// GetFirmamentAddresses returns the addresses of the firmament endpoints from config, the firmament port
+// is appended to the addresses without port
+func GetFirmamentAddresses() []string {
 	// join the firmament address and port with a colon separator
 	// Passing the firmament address with port and colon separator throws an error
 	// for conversion from yaml to json
-	values := []string{config.FirmamentAddress, config.FirmamentPort}
-	return strings.Join(values, ":")
+	var addresses []string
+	for _, address := range SplitList(config.FirmamentAddress) {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, config.FirmamentPort)
+		}
+		addresses = append(addresses, address)
+	}
+	if len(addresses) == 0 {
+		return []string{net.JoinHostPort(config.FirmamentAddress, config.FirmamentPort)}
+	}
+	return addresses
+}
+
+// GetFirmamentFailoverThreshold returns the time in seconds the active firmament endpoint is unreachable before poseidon fails over to the next one
+func GetFirmamentFailoverThreshold() int {
+	return config.FailoverThreshold
+}
+
+// GetScheduleBreakerThreshold returns the number of consecutive failed scheduling rounds opening the circuit breaker, 0 disables it
+func GetScheduleBreakerThreshold() int {
+	return config.BreakerThreshold
+}
+
+// GetScheduleBreakerCoolDown returns the time in seconds the scheduling rounds are skipped once the circuit breaker is open
+func GetScheduleBreakerCoolDown() int {
+	return config.BreakerCoolDown
+}
+
+// GetFailureLogInterval returns the time in seconds between the logs of the repeated failures of a request to firmament
+func GetFailureLogInterval() int {
+	return config.FailureLogInterval
 }
 
 // GetKubeConfig returns the KubeConfig from config
@@ -83,6 +357,81 @@ func GetKubeVersion() (int, int) {
 	return kubeMajorVer, kubeMinorVer
 }
 
+// GetDisableStats returns true if no node and pod stats are sent to firmament
+func GetDisableStats() bool {
+	return config.DisableStats
+}
+
+// GetStatsSource returns the source of the node and pod stats sent to firmament, metrics-server, kubelet-summary or heapster
+func GetStatsSource() string {
+	return config.StatsSource
+}
+
+// GetStatsInterval returns the time in seconds between the stats read from metrics-server, the kubelets or Prometheus
+func GetStatsInterval() int {
+	return config.StatsInterval
+}
+
+// GetStatsKubeletWorkers returns the number of kubelet stats summaries read in parallel
+func GetStatsKubeletWorkers() int {
+	return config.StatsWorkers
+}
+
+// GetStatsKubeletTimeout returns the time in seconds a kubelet stats summary is read within
+func GetStatsKubeletTimeout() int {
+	return config.StatsTimeout
+}
+
+// GetPrometheusAddress returns the URL of the Prometheus server queried by the prometheus stats source
+func GetPrometheusAddress() string {
+	return config.PromAddress
+}
+
+// GetPrometheusNodeLabel returns the label holding the node name in the series of the node queries
+func GetPrometheusNodeLabel() string {
+	return config.PromNodeLabel
+}
+
+// GetPrometheusNodeCPUQuery returns the PromQL template of the cpu usage of the nodes, in cores
+func GetPrometheusNodeCPUQuery() string {
+	return config.PromNodeCPU
+}
+
+// GetPrometheusNodeMemoryQuery returns the PromQL template of the memory usage of the nodes, in bytes
+func GetPrometheusNodeMemoryQuery() string {
+	return config.PromNodeMemory
+}
+
+// GetPrometheusNodeNetworkRxQuery returns the PromQL template of the bytes received per second by the nodes
+func GetPrometheusNodeNetworkRxQuery() string {
+	return config.PromNodeNetRx
+}
+
+// GetPrometheusNodeNetworkTxQuery returns the PromQL template of the bytes sent per second by the nodes
+func GetPrometheusNodeNetworkTxQuery() string {
+	return config.PromNodeNetTx
+}
+
+// GetPrometheusPodCPUQuery returns the PromQL template of the cpu usage of the pods, in cores
+func GetPrometheusPodCPUQuery() string {
+	return config.PromPodCPU
+}
+
+// GetPrometheusPodMemoryQuery returns the PromQL template of the memory working set of the pods, in bytes
+func GetPrometheusPodMemoryQuery() string {
+	return config.PromPodMemory
+}
+
+// GetPrometheusPodNetworkRxQuery returns the PromQL template of the bytes received per second by the pods
+func GetPrometheusPodNetworkRxQuery() string {
+	return config.PromPodNetRx
+}
+
+// GetPrometheusPodNetworkTxQuery returns the PromQL template of the bytes sent per second by the pods
+func GetPrometheusPodNetworkTxQuery() string {
+	return config.PromPodNetTx
+}
+
 // GetStatsServerAddress returns the StatsServerAddress from the config
 // TODO(shiv): We need to have separate port and IP for stats server too like firmament address amd port.
 // This separation is required when passing address as command line flags in deployment yaml,
@@ -96,6 +445,16 @@ func GetSchedulingInterval() int {
 	return config.SchedulingInterval
 }
 
+// GetIdleSchedulingInterval returns the time in seconds between the scheduling rounds while no pod is pending
+func GetIdleSchedulingInterval() int {
+	return config.IdleInterval
+}
+
+// GetScheduleStream returns if the deltas pushed by firmament on the schedule stream are applied instead of polling the scheduling rounds
+func GetScheduleStream() bool {
+	return config.ScheduleStream
+}
+
 // GetConfigPath returns the config path from  config
 func GetConfigPath() string {
 	return config.ConfigPath
@@ -111,19 +470,24 @@ func GetPprofAddress() string {
 	return config.PprofAddress
 }
 
+// GetEnableAdminEndpoints returns if the admin endpoints, e.g. the node resync, are served on the health check address
+func GetEnableAdminEndpoints() bool {
+	return config.EnableAdmin
+}
+
 // GetMetricsBindAddress returns the port serving healthz and metrics
 func GetMetricsBindAddress() string {
 	return config.MetricsBindAddress
 }
 
 // GetConfig returns the address of the whole config
-func GetConfig() *poseidonConfig {
+func GetConfig() *Config {
 	return &config
 }
 
-// ReadFromConfigFile to read from yaml,json,toml etc poseidonConfig file
+// ReadFromConfigFile to read from yaml,json,toml etc poseidon_config file in configPath
 // Note:
-//  The poseidonConfig values will be overwritten if flag for the same key are present
+//  The config values will be overwritten if flag for the same key are present
 func ReadFromConfigFile() {
 	viper.AddConfigPath(".")
 	viper.AddConfigPath(config.ConfigPath)
@@ -158,26 +522,247 @@ func GetDisableEvents() bool {
 	return config.DisableEvents
 }
 
-// ReadFromCommandLineFlags reads command line flags and these will override poseidonConfig file flags.
-func ReadFromCommandLineFlags() {
-	pflag.StringVar(&config.SchedulerName, "schedulerName", "poseidon", "The scheduler name with which pods are labeled")
-	pflag.StringVar(&config.FirmamentAddress, "firmamentAddress", "firmament-service.kube-system", "Firmament scheduler service address")
-	pflag.StringVar(&config.FirmamentPort, "firmamentPort", "9090", "Firmament scheduler service port")
-	pflag.StringVar(&config.KubeConfig, "kubeConfig", "kubeconfig.cfg", "Path to the kubeconfig file")
-	pflag.StringVar(&config.KubeVersion, "kubeVersion", "1.6", "Kubernetes version")
-	pflag.StringVar(&config.StatsServerAddress, "statsServerAddress", "0.0.0.0:9091", "Address on which the stats server listens")
-	pflag.IntVar(&config.SchedulingInterval, "schedulingInterval", 10, "Time between scheduler runs (in seconds)")
-	pflag.StringVar(&config.ConfigPath, "configPath", ".",
-		"The path to the config file (i.e poseidon_cfg) without filename or extension, supported extensions/formats are Yaml, Json")
-	flag.BoolVar(&config.EnablePprof, "enablePprof", false, "Enable runtime profiling data via HTTP server. Address is at client URL + \"/debug/pprof/\"")
-	flag.StringVar(&config.PprofAddress, "pprofAddress", "0.0.0.0:8989", "Address on which to collect runtime profiling data,default to set for all interfaces ")
-	pflag.StringVar(&config.MetricsBindAddress, "metricsBindAddress", "0.0.0.0:8989", "Address on which to collect prometheus metrics, default to set for all interfaces")
-	pflag.StringVar(&config.HealthCheckAddress, "healthCheckAddress", "0.0.0.0:8989", "Address on which to check the health status of poseidon")
-	pflag.Float32Var(&config.K8sQPS, "k8sQPS", 1000, "k8s Client QPS to configure")
-	pflag.IntVar(&config.K8sBurst, "k8sBurst", 500, "k8s clinet burst rate to configure")
-	pflag.BoolVar(&config.DefaultBehaviour, "defaultBehaviour", false, "Enable default scheduler behaviour")
-	pflag.BoolVar(&config.DisableEvents, "disableEvents", false, "Disable/Enable events from Poseidon")
+// GetEnablePreemption returns if the pods of the tasks preempted by firmament are evicted
+func GetEnablePreemption() bool {
+	return config.EnablePreemption
+}
+
+// GetCPUOvercommitRatio returns the ratio applied to the node cpu capacity advertised to firmament
+func GetCPUOvercommitRatio() float64 {
+	return config.CPUOvercommitRatio
+}
+
+// GetMemOvercommitRatio returns the ratio applied to the node memory capacity advertised to firmament
+func GetMemOvercommitRatio() float64 {
+	return config.MemOvercommitRatio
+}
+
+// GetDefaultCPURequest returns the cpu request applied to containers without requests and limits
+func GetDefaultCPURequest() string {
+	return config.DefaultCPURequest
+}
+
+// GetDefaultMemRequest returns the memory request applied to containers without requests and limits
+func GetDefaultMemRequest() string {
+	return config.DefaultMemRequest
+}
+
+// GetWatchErrorThreshold returns the number of consecutive list/watch failures after which poseidon is not ready
+func GetWatchErrorThreshold() int {
+	return config.WatchErrThreshold
+}
+
+// GetExcludeControlPlane returns if the control plane nodes are hidden from firmament
+func GetExcludeControlPlane() bool {
+	return config.ExcludeCtrlPlane
+}
+
+// GetUnschedulableTimeout returns the time in seconds after which an unplaced pod is marked as unschedulable
+func GetUnschedulableTimeout() int {
+	return config.UnschedTimeout
+}
+
+// GetWorkers returns the number of workers of the pod and node watchers
+func GetWorkers() int {
+	return config.Workers
+}
+
+// GetMaxWorkers returns the maximum number of workers of the pod and node watchers when auto-tuned
+func GetMaxWorkers() int {
+	return config.MaxWorkers
+}
+
+// GetGangSchedulingTimeout returns the time in seconds the placements of a partially placed gang are held
+func GetGangSchedulingTimeout() int {
+	return config.GangTimeout
+}
+
+// GetBatchWindow returns the time in milliseconds the submissions of pending pods are batched for
+func GetBatchWindow() int {
+	return config.BatchWindow
+}
+
+// GetMaxBatchSize returns the maximum number of tasks submitted to firmament in a batch
+func GetMaxBatchSize() int {
+	return config.MaxBatchSize
+}
+
+// GetWorkerRestartPeriod returns the time in milliseconds after which a watcher worker which returned is restarted
+func GetWorkerRestartPeriod() int {
+	return config.RestartPeriod
+}
+
+// GetWorkerRestartJitter returns the jitter factor applied to the restart period of the watcher workers
+func GetWorkerRestartJitter() float64 {
+	return config.RestartJitter
+}
+
+// GetBindRetryAttempts returns the number of bindings attempted for a pod before a FailedScheduling event is emitted
+func GetBindRetryAttempts() int {
+	return config.BindAttempts
+}
+
+// GetBindRetryBackoff returns the time in milliseconds a task is withdrawn from firmament after its first failed binding
+func GetBindRetryBackoff() int {
+	return config.BindBackoff
+}
+
+// GetNodeResourceTopology returns if the NUMA zones of the nodes are read from their NodeResourceTopology objects
+func GetNodeResourceTopology() bool {
+	return config.NodeTopology
+}
+
+// GetLeaderElect returns if the poseidon replicas elect a leader, only the leader watches the cluster and schedules
+func GetLeaderElect() bool {
+	return config.LeaderElect
+}
+
+// GetLeaderElectNamespace returns the namespace of the leader election lock, the namespace of the pod when empty
+func GetLeaderElectNamespace() string {
+	return config.LeaderNamespace
+}
+
+// GetLeaderElectName returns the name of the ConfigMap holding the leader election lock
+func GetLeaderElectName() string {
+	return config.LeaderName
+}
+
+// GetLeaderElectLeaseDuration returns the time in seconds the standby replicas wait before taking over a lock which is not renewed
+func GetLeaderElectLeaseDuration() int {
+	return config.LeaseDuration
+}
+
+// GetLeaderElectRenewDeadline returns the time in seconds the leader renews the lock within before giving up the leadership
+func GetLeaderElectRenewDeadline() int {
+	return config.RenewDeadline
+}
+
+// GetLeaderElectRetryPeriod returns the time in seconds between two attempts to acquire or renew the lock
+func GetLeaderElectRetryPeriod() int {
+	return config.RetryPeriod
+}
+
+// GetHealthPort returns the port of the health endpoints, the port of the health check address when 0
+func GetHealthPort() int {
+	return config.HealthPort
+}
+
+// GetAnnotateTaskID returns if the pods bound by poseidon are annotated with the ID of their firmament task
+func GetAnnotateTaskID() bool {
+	return config.AnnotateTaskID
+}
+
+// GetWorkerStallTimeout returns the time in seconds a worker may make no progress on its item before poseidon is not live
+func GetWorkerStallTimeout() int {
+	return config.StallTimeout
+}
+
+// GetMaxInFlightNodeEvents returns the number of queued node events above which the node informer is paused, 0 when unbounded
+func GetMaxInFlightNodeEvents() int {
+	return config.MaxNodeEvents
+}
+
+// GetAdvertiseNodeUsage returns if the usage read from metrics-server is subtracted from the resources available on the nodes
+func GetAdvertiseNodeUsage() bool {
+	return config.AdvertiseUsage
+}
+
+// GetShutdownTimeout returns the time in seconds the work queues are drained for once poseidon is terminated
+func GetShutdownTimeout() int {
+	return config.ShutdownTimeout
+}
+
+// GetCacheSyncTimeout returns the time in seconds the watchers wait for their informer caches to sync
+func GetCacheSyncTimeout() int {
+	return config.CacheSyncTimeout
+}
+
+// GetFirmamentCostModel returns the cost model firmament schedules with, empty to keep the one of firmament
+func GetFirmamentCostModel() string {
+	return config.FirmamentCostModel
+}
 
+// GetFirmamentSolver returns the min-cost flow solver of firmament, empty to keep the one of firmament
+func GetFirmamentSolver() string {
+	return config.FirmamentSolver
+}
+
+// GetNodeWatchStaleness returns the time in seconds without node event after which the node informer is re-created
+func GetNodeWatchStaleness() int {
+	return config.NodeWatchStaleness
+}
+
+// GetPodWatchStaleness returns the time in seconds without pod event after which the pod informers are re-created
+func GetPodWatchStaleness() int {
+	return config.PodWatchStaleness
+}
+
+// GetEnableDebugEndpoints returns if the dumps of the scheduler state are served on the health check address
+func GetEnableDebugEndpoints() bool {
+	return config.EnableDebug
+}
+
+// GetRedactDebugEndpoints returns if the label values are redacted from the dumps of the debug endpoints
+func GetRedactDebugEndpoints() bool {
+	return config.RedactDebug
+}
+
+// GetLogFormat returns the format of the structured log lines, text or json
+func GetLogFormat() string {
+	return config.LogFormat
+}
+
+// GetNodeWorkers returns the number of workers of the node watcher, the one of --workers when unset
+func GetNodeWorkers() int {
+	return WorkersOrDefault(config.NodeWorkers, config.Workers)
+}
+
+// GetPodWorkers returns the number of workers of the pod watcher, the one of --workers when unset
+func GetPodWorkers() int {
+	return WorkersOrDefault(config.PodWorkers, config.Workers)
+}
+
+// GetBindConcurrency returns the number of pods bound in parallel
+func GetBindConcurrency() int {
+	return config.BindConcurrency
+}
+
+// GetPUsPerMachine returns the number of PUs advertised per node without NUMA topology, -1 for a PU per CPU core
+func GetPUsPerMachine() int {
+	return config.PUsPerMachine
+}
+
+// GetQueueRetryBaseDelay returns the backoff in milliseconds of the first retry of the work queue items
+func GetQueueRetryBaseDelay() int {
+	return config.RetryBaseDelay
+}
+
+// GetQueueRetryMaxDelay returns the cap in milliseconds of the backoff of the work queue items
+func GetQueueRetryMaxDelay() int {
+	return config.RetryMaxDelay
+}
+
+// GetQueueMaxRetries returns the number of retries after which the work queue items are dropped, 0 for no limit
+func GetQueueMaxRetries() int {
+	return config.QueueMaxRetries
+}
+
+// WorkersOrDefault returns the number of workers of a watcher, or the one of --workers when it is 0.
+func WorkersOrDefault(workers, defaultWorkers int) int {
+	if workers == 0 {
+		return defaultWorkers
+	}
+	return workers
+}
+
+// GetWriteConfigTemplate returns if the default config file is written instead of running poseidon
+func GetWriteConfigTemplate() bool {
+	return config.WriteTemplate
+}
+
+// ReadFromCommandLineFlags reads command line flags and these will override the config files.
+func ReadFromCommandLineFlags() {
+	addFlags(pflag.CommandLine, &config)
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 
@@ -190,7 +775,129 @@ func ReadFromCommandLineFlags() {
 	glog.Info("ReadFromCommandLineFlags", config)
 }
 
+// addFlags registers the flags of the options of cfg in fs, the options are set to their defaults.
+func addFlags(fs *pflag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.SchedulerName, "schedulerName", "poseidon", "The scheduler name with which pods are labeled")
+	fs.StringVar(&cfg.SchedulerNames, "schedulerNames", "", "Comma separated list of the scheduler names with which pods are labeled, overrides schedulerName when set")
+	fs.StringVar(&cfg.FirmamentAddress, "firmamentAddress", "firmament-service.kube-system", "Comma separated list of the firmament scheduler service addresses, the first healthy one is used and poseidon fails over to the next one when it is unreachable")
+	fs.StringVar(&cfg.FirmamentPort, "firmamentPort", "9090", "Firmament scheduler service port")
+	fs.BoolVar(&cfg.FirmamentTLS, "firmamentTLS", false, "Secure the connection to firmament with TLS, the connection is insecure otherwise")
+	fs.StringVar(&cfg.FirmamentCAFile, "firmamentCAFile", "", "Path to the CA certificate verifying the firmament certificate, the system roots are used when empty")
+	fs.StringVar(&cfg.FirmamentCertFile, "firmamentCertFile", "", "Path to the client certificate presented to firmament for mutual TLS, reloaded on SIGHUP or when it changes")
+	fs.StringVar(&cfg.FirmamentKeyFile, "firmamentKeyFile", "", "Path to the key of the client certificate presented to firmament for mutual TLS")
+	fs.StringVar(&cfg.FirmamentSrvName, "firmamentServerName", "", "Name verified in the firmament certificate, the host of the firmament address when empty")
+	fs.IntVar(&cfg.FirmamentTimeout, "firmamentRPCTimeout", 5, "Deadline of the requests to firmament besides the scheduling rounds (in seconds), the requests of the workers which time out are sent again")
+	fs.IntVar(&cfg.ScheduleTimeout, "firmamentScheduleTimeout", 30, "Deadline of the scheduling rounds of firmament (in seconds), a round which times out is skipped")
+	fs.IntVar(&cfg.RetryInterval, "firmamentRetryInitialInterval", 100, "Time (in milliseconds) before the first retry of a firmament request failing with UNAVAILABLE, DEADLINE_EXCEEDED or RESOURCE_EXHAUSTED")
+	fs.Float64Var(&cfg.RetryMultiplier, "firmamentRetryMultiplier", 2.0, "Factor applied to the retry interval after each retry of a firmament request, must be at least 1")
+	fs.IntVar(&cfg.RetryMaxElapsed, "firmamentRetryMaxElapsedTime", 3000, "Time (in milliseconds) spent retrying a firmament request besides the scheduling rounds, 0 disables the retries")
+	fs.IntVar(&cfg.ScheduleRetryMax, "firmamentScheduleRetryMaxElapsedTime", 0, "Time (in milliseconds) spent retrying a scheduling round of firmament, 0 disables the retries since a round is expensive")
+	fs.IntVar(&cfg.FailoverThreshold, "firmamentFailoverThreshold", 30, "Time (in seconds) the active firmament endpoint is unreachable before poseidon fails over to the next endpoint of firmamentAddress")
+	fs.IntVar(&cfg.BreakerThreshold, "firmamentScheduleBreakerThreshold", 5, "Number of consecutive failed scheduling rounds after which the rounds are skipped for firmamentScheduleBreakerCoolDown, 0 disables the circuit breaker")
+	fs.IntVar(&cfg.BreakerCoolDown, "firmamentScheduleBreakerCoolDown", 60, "Time (in seconds) the scheduling rounds are skipped once the circuit breaker is open, before a single round probes firmament")
+	fs.IntVar(&cfg.FailureLogInterval, "failureLogInterval", 10, "Time (in seconds) between the logs of the repeated failures of a request to firmament, e.g. of a node processed again while firmament is down, 0 logs every failure")
+	fs.StringVar(&cfg.KubeConfig, "kubeConfig", "", "Path to the kubeconfig file used outside a cluster, defaults to $KUBECONFIG or $HOME/.kube/config")
+	fs.StringVar(&cfg.KubeVersion, "kubeVersion", "1.6", "Kubernetes version")
+	fs.StringVar(&cfg.StatsServerAddress, "statsServerAddress", "0.0.0.0:9091", "Address on which the stats server listens")
+	fs.BoolVar(&cfg.DisableStats, "disableStats", false, "Do not read the node and pod stats nor send them to firmament, for the clusters scheduling without usage-aware cost models")
+	fs.StringVar(&cfg.StatsSource, "statsSource", "metrics-server", "Source of the node and pod stats sent to firmament, metrics-server reads them from the metrics.k8s.io API, kubelet-summary from the Summary API of the kubelets, prometheus from prometheusAddress, heapster receives them on statsServerAddress")
+	fs.IntVar(&cfg.StatsInterval, "statsInterval", 10, "Time (in seconds) between the node and pod stats read from metrics-server, the kubelets or Prometheus, at least 5 and jittered by up to 10%")
+	fs.IntVar(&cfg.StatsWorkers, "statsKubeletWorkers", 10, "Number of kubelet stats summaries read in parallel with the kubelet-summary stats source")
+	fs.IntVar(&cfg.StatsTimeout, "statsKubeletTimeout", 5, "Time (in seconds) a kubelet stats summary is read within, the nodes whose kubelet does not reply are skipped until the next cycle")
+	fs.StringVar(&cfg.PromAddress, "prometheusAddress", "http://prometheus-k8s.monitoring:9090", "URL of the Prometheus server queried by the prometheus stats source")
+	fs.StringVar(&cfg.PromNodeLabel, "prometheusNodeLabel", "node", "Label holding the node name in the series returned by the Prometheus node queries")
+	fs.StringVar(&cfg.PromNodeCPU, "prometheusNodeCPUQuery", `sum by (node) (rate(node_cpu_seconds_total{mode!="idle"}[{{.Window}}]))`, "PromQL template of the cpu usage of the nodes in cores, {{.Window}} is the rate window")
+	fs.StringVar(&cfg.PromNodeMemory, "prometheusNodeMemoryQuery", `sum by (node) (node_memory_MemTotal_bytes - node_memory_MemAvailable_bytes)`, "PromQL template of the memory usage of the nodes in bytes")
+	fs.StringVar(&cfg.PromNodeNetRx, "prometheusNodeNetworkRxQuery", `sum by (node) (rate(node_network_receive_bytes_total{device!="lo"}[{{.Window}}]))`, "PromQL template of the bytes received per second by the nodes, disabled when empty")
+	fs.StringVar(&cfg.PromNodeNetTx, "prometheusNodeNetworkTxQuery", `sum by (node) (rate(node_network_transmit_bytes_total{device!="lo"}[{{.Window}}]))`, "PromQL template of the bytes sent per second by the nodes, disabled when empty")
+	fs.StringVar(&cfg.PromPodCPU, "prometheusPodCPUQuery", `sum by (namespace, pod) (rate(container_cpu_usage_seconds_total{container!="",container!="POD"}[{{.Window}}]))`, "PromQL template of the cpu usage of the pods in cores")
+	fs.StringVar(&cfg.PromPodMemory, "prometheusPodMemoryQuery", `sum by (namespace, pod) (container_memory_working_set_bytes{container!="",container!="POD"})`, "PromQL template of the memory working set of the pods in bytes")
+	fs.StringVar(&cfg.PromPodNetRx, "prometheusPodNetworkRxQuery", `sum by (namespace, pod) (rate(container_network_receive_bytes_total[{{.Window}}]))`, "PromQL template of the bytes received per second by the pods, disabled when empty")
+	fs.StringVar(&cfg.PromPodNetTx, "prometheusPodNetworkTxQuery", `sum by (namespace, pod) (rate(container_network_transmit_bytes_total[{{.Window}}]))`, "PromQL template of the bytes sent per second by the pods, disabled when empty")
+	fs.IntVar(&cfg.SchedulingInterval, "schedulingInterval", 10, "Time between scheduler runs (in seconds)")
+	fs.IntVar(&cfg.IdleInterval, "idleSchedulingInterval", 60, "Time between scheduler runs (in seconds) while no pod is pending, schedulingInterval is used when it is shorter")
+	fs.BoolVar(&cfg.ScheduleStream, "firmamentScheduleStream", true, "Apply the scheduling deltas pushed by firmament on the schedule stream, the scheduling rounds are polled if firmament does not expose the stream")
+	fs.StringVar(&cfg.ConfigPath, "configPath", ".",
+		"The path to the config file (i.e poseidon_cfg) without filename or extension, supported extensions/formats are Yaml, Json")
+	fs.BoolVar(&cfg.EnablePprof, "enablePprof", false, "Enable runtime profiling data via HTTP server. Address is at client URL + \"/debug/pprof/\"")
+	fs.StringVar(&cfg.PprofAddress, "pprofAddress", "0.0.0.0:8989", "Address on which to collect runtime profiling data,default to set for all interfaces ")
+	fs.BoolVar(&cfg.EnableAdmin, "enableAdminEndpoints", false, "Serve the admin endpoints, e.g. \"/admin/resync?node=<name>\" to send a node to firmament again, on the health check address")
+	fs.StringVar(&cfg.MetricsBindAddress, "metricsBindAddress", "0.0.0.0:8989", "Address on which to collect prometheus metrics, default to set for all interfaces")
+	fs.StringVar(&cfg.HealthCheckAddress, "healthCheckAddress", "0.0.0.0:8989", "Address on which to check the health status of poseidon")
+	fs.IntVar(&cfg.HealthPort, "healthPort", 0, "Port of the /healthz and /readyz endpoints, overriding the port of healthCheckAddress when set")
+	fs.IntVar(&cfg.StallTimeout, "workerStallTimeout", 300, "Time (in seconds) a worker may make no progress on its item, e.g. a node change or a scheduling round, before /healthz reports poseidon as not live")
+	fs.Float32Var(&cfg.K8sQPS, "k8sQPS", 1000, "k8s Client QPS to configure")
+	fs.IntVar(&cfg.K8sBurst, "k8sBurst", 500, "k8s clinet burst rate to configure")
+	fs.BoolVar(&cfg.DefaultBehaviour, "defaultBehaviour", false, "Enable default scheduler behaviour")
+	fs.BoolVar(&cfg.DisableEvents, "disableEvents", false, "Disable/Enable events from Poseidon")
+	fs.BoolVar(&cfg.EnablePreemption, "enablePreemption", false, "Enable eviction of the pods preempted by firmament, preempted pods are deleted")
+	fs.Float64Var(&cfg.CPUOvercommitRatio, "cpuOvercommitRatio", 1.0, "Ratio applied to the node cpu capacity advertised to firmament, must be greater than 0")
+	fs.Float64Var(&cfg.MemOvercommitRatio, "memOvercommitRatio", 1.0, "Ratio applied to the node memory capacity advertised to firmament, must be greater than 0")
+	fs.StringVar(&cfg.DefaultCPURequest, "defaultCPURequest", "", "CPU request (e.g. 100m) applied to containers of BestEffort pods, disabled when empty")
+	fs.StringVar(&cfg.DefaultMemRequest, "defaultMemRequest", "", "Memory request (e.g. 200Mi) applied to containers of BestEffort pods, disabled when empty")
+	fs.IntVar(&cfg.WatchErrThreshold, "watchErrorThreshold", 3, "Number of consecutive list/watch failures after which poseidon reports not ready on /readyz")
+	fs.BoolVar(&cfg.ExcludeCtrlPlane, "excludeControlPlane", true, "Exclude the nodes with a control plane role label or taint from scheduling")
+	fs.IntVar(&cfg.UnschedTimeout, "unschedulableTimeout", 60, "Time (in seconds) a pod stays unplaced by firmament before its PodScheduled condition is set to Unschedulable")
+	fs.IntVar(&cfg.Workers, "workers", 10, "Number of workers of the pod and node watchers, -1 scales the workers with the number of CPUs")
+	fs.IntVar(&cfg.MaxWorkers, "maxWorkers", 32, "Maximum number of workers of the pod and node watchers when --workers is -1")
+	fs.IntVar(&cfg.GangTimeout, "gangSchedulingTimeout", 60, "Time (in seconds) the placements of a partially placed gang are held before they are released back to firmament")
+	fs.IntVar(&cfg.BatchWindow, "batchWindow", 500, "Time (in milliseconds) the tasks of pending pods are accumulated before they are submitted to firmament and scheduled together, 0 disables batching")
+	fs.IntVar(&cfg.MaxBatchSize, "maxBatchSize", 500, "Maximum number of tasks submitted to firmament in a batch, a full batch is submitted without waiting for the batch window")
+	fs.IntVar(&cfg.RestartPeriod, "workerRestartPeriod", 1000, "Time (in milliseconds) after which a pod or node watcher worker which returned is restarted, must be greater than 0")
+	fs.Float64Var(&cfg.RestartJitter, "workerRestartJitter", 0.5, "Jitter factor applied to the worker restart period, a worker is restarted after up to period*(1+jitter), 0 disables the jitter")
+	fs.IntVar(&cfg.BindAttempts, "bindRetryAttempts", 5, "Number of bindings attempted for a pod before giving up and recording a FailedScheduling event")
+	fs.IntVar(&cfg.BindBackoff, "bindRetryBackoff", 1000, "Time (in milliseconds) before a pod whose binding failed is submitted to firmament again, doubled after each failure")
+	fs.BoolVar(&cfg.NodeTopology, "nodeResourceTopology", false, "Read the NodeResourceTopology objects of the nodes to advertise their NUMA zones to firmament, nodes without one are advertised with a single PU")
+	fs.StringVar(&cfg.NamespaceAllow, "namespaceAllowlist", "", "Comma separated list of the namespaces whose pods are scheduled by poseidon, all namespaces when empty")
+	fs.BoolVar(&cfg.NamespaceQueues, "namespaceQueues", false, "Process the pods of every namespace with its own work queue and workers, so that a namespace with many pod changes does not delay the others")
+	fs.StringVar(&cfg.NamespaceDeny, "namespaceDenylist", "", "Comma separated list of the namespaces whose pods are ignored by poseidon, kube-system is always ignored")
+	fs.IntVar(&cfg.QoSGuaranteed, "qosPriorityGuaranteed", 0, "Base priority added to the task priority of Guaranteed pods, combined with the pod priority")
+	fs.IntVar(&cfg.QoSBurstable, "qosPriorityBurstable", 0, "Base priority added to the task priority of Burstable pods, combined with the pod priority")
+	fs.IntVar(&cfg.QoSBestEffort, "qosPriorityBestEffort", 0, "Base priority added to the task priority of BestEffort pods, combined with the pod priority")
+	fs.IntVar(&cfg.CapacityDebounce, "capacityChangeDebounce", 100, "Time (in milliseconds) the added nodes and released pods which may fit unscheduled tasks are merged before a scheduling round is triggered")
+	fs.IntVar(&cfg.NotReadyGrace, "nodeNotReadyGracePeriod", 0, "Time (in seconds) a node stays not ready or out of disk before it is failed in firmament, nodes recovering within the period are not failed")
+	fs.IntVar(&cfg.NodeResync, "nodeResyncPeriod", 0, "Time (in seconds) between two resyncs of the node informer, 0 disables the resync")
+	fs.StringVar(&cfg.NodeSelector, "nodeLabelSelector", "", "Label selector of the nodes advertised to firmament, all nodes when empty")
+	fs.BoolVar(&cfg.UseNodeCapacity, "useNodeCapacity", false, "Advertise the node capacity to firmament instead of the allocatable resources, ignoring the system and kube reservations, for experiments")
+	fs.StringVar(&cfg.MemoryUnit, "memoryUnit", "KB", "Unit of the memory capacities and requests sent to firmament, KB, MB or MiB, must match the unit firmament was built with")
+	fs.BoolVar(&cfg.LeaderElect, "leaderElect", true, "Elect a leader among the poseidon replicas, only the leader watches the cluster, sends the stats and schedules while the others stand by")
+	fs.StringVar(&cfg.LeaderNamespace, "leaderElectNamespace", "", "Namespace of the ConfigMap holding the leader election lock, the namespace of the poseidon pod when empty")
+	fs.StringVar(&cfg.LeaderName, "leaderElectName", "poseidon-leader", "Name of the ConfigMap holding the leader election lock")
+	fs.IntVar(&cfg.LeaseDuration, "leaderElectLeaseDuration", 15, "Time (in seconds) the standby replicas wait after the last renewal of the lock before taking over the leadership")
+	fs.IntVar(&cfg.RenewDeadline, "leaderElectRenewDeadline", 10, "Time (in seconds) the leader renews the lock within before giving up the leadership, must be shorter than leaderElectLeaseDuration")
+	fs.IntVar(&cfg.RetryPeriod, "leaderElectRetryPeriod", 2, "Time (in seconds) between two attempts to acquire or renew the leader election lock")
+	fs.BoolVar(&cfg.AnnotateTaskID, "annotateTaskID", false, "Annotate the pods bound by poseidon with the ID of their firmament task, to correlate them with the firmament logs")
+	fs.IntVar(&cfg.MaxNodeEvents, "maxInFlightNodeEvents", 0, "Number of node events queued and not processed yet above which the delivery of the node informer is paused until the backlog drains, 0 disables the cap")
+	fs.BoolVar(&cfg.AdvertiseUsage, "advertiseNodeUsage", false, "Subtract the usage of the nodes read from metrics-server from the resources available on the nodes advertised to firmament, the allocatable resources are advertised while metrics-server is unavailable, requires the metrics-server stats source")
+	fs.IntVar(&cfg.ShutdownTimeout, "shutdownTimeout", 25, "Time (in seconds) the queued nodes, pods and bindings are processed for once poseidon receives SIGTERM, before it exits, must be shorter than the terminationGracePeriodSeconds of its pod")
+	fs.IntVar(&cfg.CacheSyncTimeout, "cacheSyncTimeout", 300, "Time (in seconds) the node and pod watchers wait for their informer caches to sync before they fail, 0 waits until poseidon is stopped")
+	fs.StringVar(&cfg.FirmamentCostModel, "firmamentCostModel", "", "Cost model firmament schedules with: trivial, random, sjf, quincy, whare, coco, octopus, void, net-aware, quincy-interference or cpu-mem, empty keeps the one firmament was started with")
+	fs.StringVar(&cfg.FirmamentSolver, "firmamentSolver", "", "Min-cost flow solver of firmament: cs2, custom or flowlessly, empty keeps the one firmament was started with")
+	fs.IntVar(&cfg.NodeWatchStaleness, "nodeWatchStaleness", 300, "Time (in seconds) without node event after which the node informer is re-created, in case its watch silently stopped, the nodes report their status every few seconds, 0 disables the watchdog")
+	fs.IntVar(&cfg.PodWatchStaleness, "podWatchStaleness", 0, "Time (in seconds) without pod event after which a pod informer is re-created, in case its watch silently stopped, 0 disables the watchdog, e.g. on clusters whose pods change rarely")
+	fs.BoolVar(&cfg.EnableDebug, "enableDebugEndpoints", false, "Serve the dumps of the nodes, tasks and work queues of poseidon under \"/debug/poseidon/\" on the health check address")
+	fs.BoolVar(&cfg.RedactDebug, "redactDebugEndpoints", true, "Redact the values of the node and pod labels, which may hold sensitive data, from the dumps of the debug endpoints")
+	fs.StringVar(&cfg.LogFormat, "logFormat", "text", "Format of the structured log lines: text, written by glog, or json, a JSON object per line on stderr for the log pipelines, the unstructured logs stay glog lines")
+	fs.IntVar(&cfg.NodeWorkers, "nodeWorkers", 0, "Number of workers of the node watcher, -1 scales the workers with the number of CPUs, 0 uses --workers")
+	fs.IntVar(&cfg.PodWorkers, "podWorkers", 0, "Number of workers of the pod watcher, per namespace with --namespaceQueues, -1 scales the workers with the number of CPUs, 0 uses --workers")
+	fs.IntVar(&cfg.BindConcurrency, "bindConcurrency", 50, "Number of workers binding the placed pods in parallel, must be greater than 0")
+	fs.IntVar(&cfg.PUsPerMachine, "pusPerMachine", 1, "Number of PUs advertised to firmament per node without NUMA topology, sharing the node capacity evenly, -1 advertises a PU per CPU core of the node, a pod must fit in a PU")
+	fs.IntVar(&cfg.RetryBaseDelay, "queueRetryBaseDelay", 100, "Backoff (in milliseconds) of the first retry of the node and pod changes firmament failed to process, doubled by every retry of a node or pod")
+	fs.IntVar(&cfg.RetryMaxDelay, "queueRetryMaxDelay", 30000, "Cap (in milliseconds) of the backoff of the retries of the node and pod changes")
+	fs.IntVar(&cfg.QueueMaxRetries, "queueMaxRetries", 0, "Number of retries after which the changes of a node or pod are dropped with an event and counted by work_queue_dead_letters_total, 0 retries them until they are processed")
+	fs.StringVar(&cfg.ConfigFile, "config", "", "Path to a YAML config file holding the options by flag name, the flags set on the command line override the file, see writeConfigTemplate")
+	fs.BoolVar(&cfg.WriteTemplate, "writeConfigTemplate", false, "Write a YAML config file holding the default of every option to stdout and exit")
+	fs.BoolVar(&cfg.ScheduleOnDrain, "scheduleOnQueueDrain", false, "Start a scheduling round once the pod or node work queue is drained instead of waiting for the scheduling interval")
+}
+
 func init() {
 	ReadFromCommandLineFlags()
-	ReadFromConfigFile()
+	if config.ConfigFile == "" {
+		ReadFromConfigFile()
+		return
+	}
+	if err := ReadConfigFile(&config, config.ConfigFile, pflag.CommandLine); err != nil {
+		glog.Fatalf("Invalid config file: %v", err)
+	}
+	glog.Info("ReadConfigFile", config)
 }
@@ -0,0 +1,100 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/pflag"
+)
+
+// ReadConfigFile reads the YAML config file at path into cfg, the options of the file are named after their flag.
+// The options missing from the file keep their value, and the flags set in fs are applied again over the file, so
+// that the flags take precedence over the file and the file over the defaults. An unknown option is an error.
+func ReadConfigFile(cfg *Config, path string, fs *pflag.FlagSet) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// The flags are bound to the fields of cfg, their values are set again once the file overwrote the fields.
+	flags := make(map[*pflag.Flag]string)
+	fs.Visit(func(f *pflag.Flag) {
+		flags[f] = f.Value.String()
+	})
+	if err := parseConfig(cfg, data); err != nil {
+		return fmt.Errorf("unable to parse the config file %s: %v", path, err)
+	}
+	for f, value := range flags {
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("unable to apply the flag --%s over the config file %s: %v", f.Name, path, err)
+		}
+	}
+	return nil
+}
+
+// parseConfig decodes the YAML or JSON data into cfg, the unknown and mistyped options are reported by name.
+func parseConfig(cfg *Config, data []byte) error {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) == 0 || string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(cfg)
+}
+
+// DefaultConfig returns the options set to the defaults of their flag.
+func DefaultConfig() Config {
+	var cfg Config
+	addFlags(pflag.NewFlagSet("defaults", pflag.ContinueOnError), &cfg)
+	return cfg
+}
+
+// WriteConfigTemplate writes a YAML config file holding the default of every option.
+func WriteConfigTemplate(w io.Writer) error {
+	data, err := yaml.Marshal(configOptions(DefaultConfig()))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// configOptions returns the options of cfg by flag name, including the options set to their zero value which the
+// json encoding of cfg omits.
+func configOptions(cfg Config) map[string]interface{} {
+	options := make(map[string]interface{})
+	value := reflect.ValueOf(cfg)
+	for i := 0; i < value.NumField(); i++ {
+		name := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		options[name] = value.Field(i).Interface()
+	}
+	return options
+}
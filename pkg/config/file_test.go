@@ -0,0 +1,122 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// writeConfig writes the config file data in a temporary directory removed by the returned function.
+func writeConfig(t *testing.T, data string) (string, func()) {
+	dir, err := ioutil.TempDir("", "poseidon-config")
+	if err != nil {
+		t.Fatalf("unable to create the config directory: %v", err)
+	}
+	path := filepath.Join(dir, "poseidon.yaml")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("unable to write the config file: %v", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// TestConfigTemplateRoundTrip reads the config template back, every option must hold its default.
+func TestConfigTemplateRoundTrip(t *testing.T) {
+	var template bytes.Buffer
+	if err := WriteConfigTemplate(&template); err != nil {
+		t.Fatalf("WriteConfigTemplate() failed: %v", err)
+	}
+	for _, option := range []string{"schedulerName: poseidon", "workers: 10", "leaderElect: true", "enablePreemption: false", `defaultCPURequest: ""`} {
+		if !strings.Contains(template.String(), option+"\n") {
+			t.Errorf("expected the template to hold %q, got:\n%s", option, template.String())
+		}
+	}
+	path, cleanup := writeConfig(t, template.String())
+	defer cleanup()
+
+	var cfg Config
+	if err := ReadConfigFile(&cfg, path, pflag.NewFlagSet("test", pflag.ContinueOnError)); err != nil {
+		t.Fatalf("ReadConfigFile() failed: %v", err)
+	}
+	if expected := DefaultConfig(); !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected the template to hold the defaults\n%+v\ngot\n%+v", expected, cfg)
+	}
+}
+
+// TestReadConfigFilePrecedence checks that the flags set on the command line override the config file, which
+// overrides the defaults.
+func TestReadConfigFilePrecedence(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+schedulingInterval: 3
+workers: 4
+firmamentAddress: firmament-0,firmament-1
+k8sQPS: 50.5
+`)
+	defer cleanup()
+	var cfg Config
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addFlags(fs, &cfg)
+	if err := fs.Parse([]string{"--workers=7", "--leaderElect=false"}); err != nil {
+		t.Fatalf("unable to parse the flags: %v", err)
+	}
+
+	if err := ReadConfigFile(&cfg, path, fs); err != nil {
+		t.Fatalf("ReadConfigFile() failed: %v", err)
+	}
+	expected := DefaultConfig()
+	expected.SchedulingInterval = 3
+	expected.FirmamentAddress = "firmament-0,firmament-1"
+	expected.K8sQPS = 50.5
+	expected.Workers = 7
+	expected.LeaderElect = false
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected\n%+v\ngot\n%+v", expected, cfg)
+	}
+}
+
+// TestReadConfigFileErrors checks that the unknown and mistyped options are reported by name.
+func TestReadConfigFileErrors(t *testing.T) {
+	var testData = []struct {
+		data     string
+		expected string
+	}{
+		{data: "schedulingIntervl: 3\n", expected: `unknown field "schedulingIntervl"`},
+		{data: "workers: ten\n", expected: "workers"},
+		{data: "workers: [\n", expected: "yaml"},
+	}
+
+	for _, data := range testData {
+		path, cleanup := writeConfig(t, data.data)
+		cfg := DefaultConfig()
+		err := ReadConfigFile(&cfg, path, pflag.NewFlagSet("test", pflag.ContinueOnError))
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), data.expected) || !strings.Contains(err.Error(), path) {
+			t.Errorf("%q: expected an error of %s mentioning %q, got %v", data.data, path, data.expected, err)
+		}
+	}
+	cfg := DefaultConfig()
+	if err := ReadConfigFile(&cfg, "/does/not/exist.yaml", pflag.NewFlagSet("test", pflag.ContinueOnError)); err == nil {
+		t.Error("expected a missing config file to be an error")
+	}
+}
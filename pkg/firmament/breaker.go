@@ -0,0 +1,164 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BreakerState is the state of the circuit breaker of the scheduling rounds.
+type BreakerState int
+
+const (
+	// BreakerClosed lets the scheduling rounds run.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen skips the scheduling rounds until the cool-down period expires.
+	BreakerOpen
+	// BreakerHalfOpen lets a single scheduling round run, the breaker is closed if it succeeds and opened
+	// again otherwise.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// ErrCircuitOpen is returned for the scheduling rounds skipped while the circuit breaker is open.
+var ErrCircuitOpen = status.Error(codes.Unavailable, "the firmament scheduling rounds are skipped while the circuit breaker is open")
+
+// IsCircuitOpen checks if the error is returned for a scheduling round skipped by the circuit breaker.
+func IsCircuitOpen(err error) bool {
+	return err == ErrCircuitOpen
+}
+
+// circuitBreaker stops the scheduling rounds for a cool-down period after consecutive failures, so that
+// a misbehaving firmament, e.g. with a slow solver, is not called again and again. The other requests
+// are not affected, the node and task changes keep being sent.
+type circuitBreaker struct {
+	mu sync.Mutex
+	// threshold is the number of consecutive failures opening the breaker, 0 disables the breaker.
+	threshold int
+	coolDown  time.Duration
+	failures  int
+	state     BreakerState
+	openedAt  time.Time
+}
+
+// The settings of the circuit breakers of the scheduling rounds, each client has its own breaker, see New.
+var (
+	scheduleBreakerThreshold = 5
+	scheduleBreakerCoolDown  = time.Minute
+)
+
+// SetScheduleBreaker sets the number of consecutive failed scheduling rounds opening the circuit breaker,
+// 0 disables it, and the time the rounds are skipped once it is open. It must be called before any client is created.
+func SetScheduleBreaker(threshold int, coolDown time.Duration) {
+	scheduleBreakerThreshold, scheduleBreakerCoolDown = threshold, coolDown
+}
+
+// newScheduleBreaker returns a closed circuit breaker of the scheduling rounds with the settings of SetScheduleBreaker.
+func newScheduleBreaker() *circuitBreaker {
+	return &circuitBreaker{threshold: scheduleBreakerThreshold, coolDown: scheduleBreakerCoolDown}
+}
+
+func (b *circuitBreaker) currentState() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow checks if a request can be sent. Once the cool-down period of the open breaker expired, a single
+// request is allowed to probe firmament.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.coolDown {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		return true
+	case BreakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// record records the result of an allowed request.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			glog.Info("Firmament scheduling round succeeded, closing the circuit breaker")
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		glog.Errorf("%d consecutive firmament scheduling rounds failed, skipping the rounds for %v: %v", b.failures, b.coolDown, err)
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state BreakerState) {
+	b.state = state
+	metrics.FirmamentScheduleBreakerState.Set(float64(state))
+}
+
+// observeRequests returns the interceptor recording the count, the status code and the latency of the requests to
+// firmament, and skipping the scheduling rounds while the circuit breaker is open. The logs of the failures of a
+// request are no longer limited once it succeeds. The requests are sent with retryRequests.
+func observeRequests(scheduleBreaker *circuitBreaker) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		name := path.Base(method)
+		breaker := method == scheduleMethod
+		if breaker && !scheduleBreaker.allow() {
+			return ErrCircuitOpen
+		}
+		start := time.Now()
+		err := retryRequests(ctx, method, req, reply, cc, invoker, opts...)
+		metrics.FirmamentRequestLatency.WithLabelValues(name).Observe(metrics.SinceInMicroseconds(start))
+		metrics.FirmamentRequests.WithLabelValues(name, status.Code(err).String()).Inc()
+		if breaker {
+			scheduleBreaker.record(err)
+		}
+		if err == nil {
+			requestFailureLog.Reset(name)
+		}
+		return err
+	}
+}
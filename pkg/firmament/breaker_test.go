@@ -0,0 +1,144 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// requests returns the number of requests of the method with the status code counted by the metric.
+func requests(t *testing.T, method string, code codes.Code) float64 {
+	metric := &dto.Metric{}
+	if err := metrics.FirmamentRequests.WithLabelValues(method, code.String()).Write(metric); err != nil {
+		t.Fatal("error reading the requests metric ", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+// breakerState returns the value of the circuit breaker state metric.
+func breakerState(t *testing.T) BreakerState {
+	metric := &dto.Metric{}
+	if err := metrics.FirmamentScheduleBreakerState.Write(metric); err != nil {
+		t.Fatal("error reading the circuit breaker state metric ", err)
+	}
+	return BreakerState(metric.GetGauge().GetValue())
+}
+
+// TestScheduleBreaker checks that the circuit breaker opens after consecutive failed scheduling rounds, skips
+// the rounds during the cool-down, lets a single round probe firmament once it expired and closes once a round
+// succeeds, while the node requests keep being sent and are counted.
+func TestScheduleBreaker(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	server, address, stop := startMockServer(t, mockCtrl, "127.0.0.1:0")
+	defer stop()
+	failed := status.Error(codes.Internal, "the solver failed")
+	probing, release := make(chan struct{}), make(chan struct{})
+	gomock.InOrder(
+		// The failures opening the breaker, then the probe failing and opening it again.
+		server.EXPECT().Schedule(gomock.Any(), gomock.Any()).Return(nil, failed).Times(3),
+		// The probe closing the breaker is held to observe the half-open breaker.
+		server.EXPECT().Schedule(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, req *ScheduleRequest) (*SchedulingDeltas, error) {
+				close(probing)
+				<-release
+				return &SchedulingDeltas{}, nil
+			}),
+		server.EXPECT().Schedule(gomock.Any(), gomock.Any()).Return(&SchedulingDeltas{}, nil),
+	)
+	server.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+		&NodeAddedResponse{Type: NodeReplyType_NODE_ADDED_OK}, nil).Times(1)
+
+	defer SetScheduleBreaker(scheduleBreakerThreshold, scheduleBreakerCoolDown)
+	coolDown := 100 * time.Millisecond
+	SetScheduleBreaker(2, coolDown)
+	client, conn, err := New(address, TLSConfig{})
+	if err != nil {
+		t.Fatal("error creating the client ", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	schedule := func() error {
+		_, err := client.Schedule(ctx, &ScheduleRequest{})
+		return err
+	}
+	expectState := func(expected BreakerState) {
+		t.Helper()
+		if got := client.ScheduleBreakerState(); got != expected {
+			t.Errorf("expected the circuit breaker to be %v, got %v", expected, got)
+		}
+		if got := breakerState(t); got != expected {
+			t.Errorf("expected the circuit breaker metric to report %v, got %v", expected, got)
+		}
+	}
+
+	internal := requests(t, "Schedule", codes.Internal)
+	for i := 0; i < 2; i++ {
+		if err := schedule(); status.Code(err) != codes.Internal {
+			t.Errorf("expected the scheduling round %d to fail, got %v", i, err)
+		}
+	}
+	expectState(BreakerOpen)
+	if got := requests(t, "Schedule", codes.Internal) - internal; got != 2 {
+		t.Errorf("expected 2 failed scheduling rounds to be counted, got %v", got)
+	}
+	if err := schedule(); !IsCircuitOpen(err) {
+		t.Errorf("expected the scheduling round to be skipped while the breaker is open, got %v", err)
+	}
+	// The node changes are still sent while the breaker is open.
+	if err := NodeAdded(client, &ResourceTopologyNodeDescriptor{ResourceDesc: &ResourceDescriptor{Uuid: "node"}}); err != nil {
+		t.Errorf("expected the node addition to be sent while the breaker is open, got %v", err)
+	}
+	if got := requests(t, "NodeAdded", codes.OK); got < 1 {
+		t.Errorf("expected the node addition to be counted, got %v", got)
+	}
+
+	time.Sleep(coolDown)
+	if err := schedule(); status.Code(err) != codes.Internal {
+		t.Errorf("expected the probe to be sent once the cool-down expired, got %v", err)
+	}
+	expectState(BreakerOpen)
+	if err := schedule(); !IsCircuitOpen(err) {
+		t.Errorf("expected the failed probe to open the breaker again, got %v", err)
+	}
+
+	time.Sleep(coolDown)
+	probed := make(chan error, 1)
+	go func() { probed <- schedule() }()
+	<-probing
+	expectState(BreakerHalfOpen)
+	if err := schedule(); !IsCircuitOpen(err) {
+		t.Errorf("expected a single probe while the breaker is half-open, got %v", err)
+	}
+	close(release)
+	if err := <-probed; err != nil {
+		t.Errorf("expected the probe to succeed, got %v", err)
+	}
+	expectState(BreakerClosed)
+	if err := schedule(); err != nil {
+		t.Errorf("expected the scheduling round to be sent once the breaker is closed, got %v", err)
+	}
+}
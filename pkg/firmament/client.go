@@ -0,0 +1,126 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Client is the interface of the requests poseidon sends to firmament. It is implemented by the gRPC client
+// returned by NewClient, and by firmamenttest.FakeClient for the unit tests. The node requests carry the context
+// of the request, e.g. its trace context. The errors of the failed requests are returned, e.g. of the requests which timed out, see IsTimeout.
+type Client interface {
+	// NodeAdded tells firmament the node is added.
+	NodeAdded(ctx context.Context, rtnd *ResourceTopologyNodeDescriptor) error
+	// NodeRemoved tells firmament the node is removed.
+	NodeRemoved(ctx context.Context, ruid *ResourceUID) error
+	// NodeFailed tells firmament the node is failed.
+	NodeFailed(ctx context.Context, ruid *ResourceUID) error
+	// NodeUpdated tells firmament the node is updated.
+	NodeUpdated(ctx context.Context, rtnd *ResourceTopologyNodeDescriptor) error
+	// TaskSubmitted tells firmament the task is submitted.
+	TaskSubmitted(td *TaskDescription) (TaskReplyType, error)
+	// TaskUpdated tells firmament the task is updated.
+	TaskUpdated(td *TaskDescription) (TaskReplyType, error)
+	// TaskRemoved tells firmament the task is removed.
+	TaskRemoved(tuid *TaskUID) (TaskReplyType, error)
+	// TaskCompleted tells firmament the task is completed.
+	TaskCompleted(tuid *TaskUID) (TaskReplyType, error)
+	// TaskFailed tells firmament the task is failed.
+	TaskFailed(tuid *TaskUID) (TaskReplyType, error)
+	// Schedule runs a scheduling round and returns its deltas.
+	Schedule() (*SchedulingDeltas, error)
+	// ScheduleStream opens the stream of the deltas of the scheduling rounds run by firmament, see IsStreamUnsupported.
+	ScheduleStream(ctx context.Context) (DeltaStream, error)
+	// AddTaskStats sends the stats of a task.
+	AddTaskStats(ts *TaskStats) error
+	// AddNodeStats sends the stats of a node.
+	AddNodeStats(rs *ResourceStats) error
+	// AddTaskInfo sends the info of a task.
+	AddTaskInfo(ti *TaskInfo) error
+}
+
+// grpcClient implements Client with the helpers of the generated firmament scheduler client.
+type grpcClient struct {
+	client FirmamentSchedulerClient
+}
+
+// NewClient returns a Client sending the requests with the firmament scheduler client.
+func NewClient(client FirmamentSchedulerClient) Client {
+	return &grpcClient{client: client}
+}
+
+func (c *grpcClient) NodeAdded(ctx context.Context, rtnd *ResourceTopologyNodeDescriptor) error {
+	return NodeAddedWithContext(ctx, c.client, rtnd)
+}
+
+func (c *grpcClient) NodeRemoved(ctx context.Context, ruid *ResourceUID) error {
+	return NodeRemovedWithContext(ctx, c.client, ruid)
+}
+
+func (c *grpcClient) NodeFailed(ctx context.Context, ruid *ResourceUID) error {
+	return NodeFailedWithContext(ctx, c.client, ruid)
+}
+
+func (c *grpcClient) NodeUpdated(ctx context.Context, rtnd *ResourceTopologyNodeDescriptor) error {
+	return NodeUpdatedWithContext(ctx, c.client, rtnd)
+}
+
+func (c *grpcClient) TaskSubmitted(td *TaskDescription) (TaskReplyType, error) {
+	return TaskSubmitted(c.client, td)
+}
+
+func (c *grpcClient) TaskUpdated(td *TaskDescription) (TaskReplyType, error) {
+	return TaskUpdated(c.client, td)
+}
+
+func (c *grpcClient) TaskRemoved(tuid *TaskUID) (TaskReplyType, error) {
+	return TaskRemoved(c.client, tuid)
+}
+
+func (c *grpcClient) TaskCompleted(tuid *TaskUID) (TaskReplyType, error) {
+	return TaskCompleted(c.client, tuid)
+}
+
+func (c *grpcClient) TaskFailed(tuid *TaskUID) (TaskReplyType, error) {
+	return TaskFailed(c.client, tuid)
+}
+
+func (c *grpcClient) Schedule() (*SchedulingDeltas, error) {
+	return Schedule(c.client)
+}
+
+func (c *grpcClient) ScheduleStream(ctx context.Context) (DeltaStream, error) {
+	if streamer, ok := c.client.(scheduleStreamer); ok {
+		return streamer.ScheduleStream(ctx)
+	}
+	return nil, status.Error(codes.Unimplemented, "the firmament scheduler client does not open schedule streams")
+}
+
+func (c *grpcClient) AddTaskStats(ts *TaskStats) error {
+	return AddTaskStats(c.client, ts)
+}
+
+func (c *grpcClient) AddNodeStats(rs *ResourceStats) error {
+	return AddNodeStats(c.client, rs)
+}
+
+func (c *grpcClient) AddTaskInfo(ti *TaskInfo) error {
+	return AddTaskInfo(c.client, ti)
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// The connection is pinged after keepaliveTime without activity during a request, e.g. a long scheduling
+	// round, and closed if the ping is not answered within keepaliveTimeout. The idle connections are not
+	// pinged, the default keepalive policy of the firmament server closes the connections pinging while idle.
+	keepaliveTime    = 30 * time.Second
+	keepaliveTimeout = 10 * time.Second
+	// readyTimeout bounds the time a request waits for the connection to firmament to be ready.
+	readyTimeout = time.Minute
+	// stateChangesBuffer is the number of connectivity states buffered for a subscriber.
+	stateChangesBuffer = 16
+)
+
+// FirmamentClient is a firmament scheduler client tracking the connectivity state of its connection.
+type FirmamentClient struct {
+	FirmamentSchedulerClient
+	conn *grpc.ClientConn
+	// breaker is the circuit breaker of the scheduling rounds sent on the connection, nil if the connection
+	// is not created by New.
+	breaker     *circuitBreaker
+	subscribeMu sync.Mutex
+	subscribers []chan connectivity.State
+}
+
+// NewFirmamentClient returns a client of the connection and starts tracking its connectivity state
+// until the connection is closed.
+func NewFirmamentClient(conn *grpc.ClientConn) *FirmamentClient {
+	c := &FirmamentClient{
+		FirmamentSchedulerClient: NewFirmamentSchedulerClient(conn),
+		conn:                     conn,
+	}
+	go c.watchState()
+	return c
+}
+
+// ScheduleBreakerState returns the state of the circuit breaker of the scheduling rounds of the client.
+func (c *FirmamentClient) ScheduleBreakerState() BreakerState {
+	if c.breaker == nil {
+		return BreakerClosed
+	}
+	return c.breaker.currentState()
+}
+
+// IsHealthy returns if the connection to firmament is ready.
+func (c *FirmamentClient) IsHealthy() bool {
+	return c.conn.GetState() == connectivity.Ready
+}
+
+// StateChanges returns a channel receiving the connectivity state transitions of the connection, e.g. READY
+// or TRANSIENT_FAILURE. The transitions are dropped while the channel is full, IsHealthy returns the
+// current state. The channel is closed once the connection is shut down.
+func (c *FirmamentClient) StateChanges() <-chan connectivity.State {
+	c.subscribeMu.Lock()
+	defer c.subscribeMu.Unlock()
+	ch := make(chan connectivity.State, stateChangesBuffer)
+	if c.conn.GetState() == connectivity.Shutdown {
+		close(ch)
+		return ch
+	}
+	c.subscribers = append(c.subscribers, ch)
+	return ch
+}
+
+// watchState broadcasts the connectivity state transitions to the subscribers.
+func (c *FirmamentClient) watchState() {
+	state := c.conn.GetState()
+	for state != connectivity.Shutdown {
+		c.conn.WaitForStateChange(context.Background(), state)
+		state = c.conn.GetState()
+		if state == connectivity.Ready {
+			glog.Info("Connection to firmament is ready")
+		} else {
+			glog.Infof("Connection to firmament is %s", state)
+		}
+		c.broadcast(state)
+	}
+	c.subscribeMu.Lock()
+	defer c.subscribeMu.Unlock()
+	for _, ch := range c.subscribers {
+		close(ch)
+	}
+	c.subscribers = nil
+}
+
+func (c *FirmamentClient) broadcast(state connectivity.State) {
+	c.subscribeMu.Lock()
+	defer c.subscribeMu.Unlock()
+	for _, ch := range c.subscribers {
+		select {
+		case ch <- state:
+		default:
+			glog.V(2).Infof("Dropping the firmament connectivity state %s for a slow subscriber", state)
+		}
+	}
+}
+
+// waitForReady waits up to readyTimeout for the connection to firmament to be ready before sending a request,
+// so that the requests sent while firmament restarts are delayed instead of failing. The wait and the request
+// are bounded by the deadline of the request context, a request which is not sent before its deadline fails
+// with codes.DeadlineExceeded.
+func waitForReady(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	waitCtx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	for state := cc.GetState(); state != connectivity.Ready; state = cc.GetState() {
+		if state == connectivity.Shutdown {
+			return status.Errorf(codes.Unavailable, "the connection to firmament is closed")
+		}
+		if !cc.WaitForStateChange(waitCtx, state) {
+			if ctx.Err() == context.DeadlineExceeded {
+				return status.Errorf(codes.DeadlineExceeded, "the connection to firmament is not ready before the deadline, last state %s", state)
+			}
+			return status.Errorf(codes.Unavailable, "the connection to firmament is not ready after %v, last state %s", readyTimeout, state)
+		}
+	}
+	return invoker(ctx, method, req, reply, cc, append(opts, grpc.FailFast(false))...)
+}
+
+// connectionOptions returns the dial options detecting the broken connections, waiting for them to recover
+// and retrying the requests failing with a transient error, see observeRequests. The scheduling rounds are
+// guarded by the breaker.
+func connectionOptions(breaker *circuitBreaker) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    keepaliveTime,
+			Timeout: keepaliveTimeout,
+		}),
+		grpc.WithUnaryInterceptor(observeRequests(breaker)),
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// startServer serves a firmament service reporting it is serving on the address.
+func startServer(t *testing.T, mockCtrl *gomock.Controller, address string) (string, func()) {
+	_, address, stop := startMockServer(t, mockCtrl, address)
+	return address, stop
+}
+
+// startMockServer serves a firmament service reporting it is serving on the address, the expectations
+// of the other requests are set on the returned mock.
+func startMockServer(t *testing.T, mockCtrl *gomock.Controller, address string) (*MockFirmamentSchedulerServer, string, func()) {
+	listen, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal("error listening ", err)
+	}
+	server := NewMockFirmamentSchedulerServer(mockCtrl)
+	server.EXPECT().Check(gomock.Any(), gomock.Any()).Return(
+		&HealthCheckResponse{Status: ServingStatus_SERVING}, nil).AnyTimes()
+	grpcServer := grpc.NewServer()
+	RegisterFirmamentSchedulerServer(grpcServer, server)
+	go grpcServer.Serve(listen)
+	return server, listen.Addr().String(), grpcServer.Stop
+}
+
+// waitForState waits for the state to be received on the channel.
+func waitForState(t *testing.T, states <-chan connectivity.State, expected connectivity.State) {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case state, ok := <-states:
+			if !ok {
+				t.Fatalf("the state changes were closed before %s", expected)
+			}
+			if state == expected {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for the connection to be %s", expected)
+		}
+	}
+}
+
+// TestFirmamentClient_reconnect checks that the connectivity state transitions are observed while firmament
+// is stopped and restarted, and that the requests recover once it is back.
+func TestFirmamentClient_reconnect(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	address, stop := startServer(t, mockCtrl, "127.0.0.1:0")
+
+	client, conn, err := New(address, TLSConfig{})
+	if err != nil {
+		t.Fatal("error creating the client ", err)
+	}
+	states := client.StateChanges()
+	if ok, err := Check(client, &HealthCheckRequest{}); !ok || err != nil {
+		t.Fatalf("expected firmament to be serving, got %v %v", ok, err)
+	}
+	if !client.IsHealthy() {
+		t.Error("expected the client to be healthy once a request succeeded")
+	}
+
+	stop()
+	waitForState(t, states, connectivity.TransientFailure)
+	if client.IsHealthy() {
+		t.Error("expected the client not to be healthy while firmament is stopped")
+	}
+
+	// A request sent while firmament is stopped waits for it to be back.
+	checked := make(chan error, 1)
+	go func() {
+		_, err := Check(client, &HealthCheckRequest{})
+		checked <- err
+	}()
+	_, stop = startServer(t, mockCtrl, address)
+	defer stop()
+	waitForState(t, states, connectivity.Ready)
+	select {
+	case err := <-checked:
+		if err != nil {
+			t.Errorf("expected the request sent while firmament was stopped to recover, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("timed out waiting for the request sent while firmament was stopped")
+	}
+	if !client.IsHealthy() {
+		t.Error("expected the client to be healthy once firmament is back")
+	}
+
+	conn.Close()
+	for range states {
+	}
+	if _, ok := <-client.StateChanges(); ok {
+		t.Error("expected the state changes of a closed connection to be closed")
+	}
+}
+
+// TestWaitForReady checks that a request fails once the connection is not ready within the deadline of the request.
+func TestWaitForReady(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening ", err)
+	}
+	address := listen.Addr().String()
+	listen.Close()
+	client, conn, err := New(address, TLSConfig{})
+	if err != nil {
+		t.Fatal("error creating the client ", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := client.Check(ctx, &HealthCheckRequest{}); !IsTimeout(err) {
+		t.Errorf("expected the request to time out without firmament, got %v", err)
+	}
+	if client.IsHealthy() {
+		t.Error("expected the client not to be healthy without firmament")
+	}
+}
+
+// TestTimeouts checks that the requests to a firmament server slower than their deadline return once the
+// deadline expires, with an error reported as a timeout.
+func TestTimeouts(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening ", err)
+	}
+	// The slow server answers once the request is cancelled or after a few seconds.
+	wait := func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	server := NewMockFirmamentSchedulerServer(mockCtrl)
+	server.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, rtnd *ResourceTopologyNodeDescriptor) (*NodeAddedResponse, error) {
+			wait(ctx)
+			return &NodeAddedResponse{Type: NodeReplyType_NODE_ADDED_OK}, nil
+		})
+	server.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, td *TaskDescription) (*TaskSubmittedResponse, error) {
+			wait(ctx)
+			return &TaskSubmittedResponse{Type: TaskReplyType_TASK_SUBMITTED_OK}, nil
+		})
+	server.EXPECT().Schedule(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *ScheduleRequest) (*SchedulingDeltas, error) {
+			wait(ctx)
+			return &SchedulingDeltas{}, nil
+		})
+	grpcServer := grpc.NewServer()
+	RegisterFirmamentSchedulerServer(grpcServer, server)
+	go grpcServer.Serve(listen)
+	defer grpcServer.Stop()
+
+	defer SetTimeouts(rpcTimeout, scheduleTimeout)
+	SetTimeouts(200*time.Millisecond, 400*time.Millisecond)
+	client, conn, err := New(listen.Addr().String(), TLSConfig{})
+	if err != nil {
+		t.Fatal("error creating the client ", err)
+	}
+	defer conn.Close()
+
+	var testData = []struct {
+		name     string
+		deadline time.Duration
+		request  func() error
+	}{
+		{"NodeAdded", 200 * time.Millisecond, func() error {
+			return NodeAdded(client, &ResourceTopologyNodeDescriptor{ResourceDesc: &ResourceDescriptor{Uuid: "node"}})
+		}},
+		{"TaskSubmitted", 200 * time.Millisecond, func() error {
+			_, err := TaskSubmitted(client, &TaskDescription{})
+			return err
+		}},
+		{"Schedule", 400 * time.Millisecond, func() error {
+			_, err := Schedule(client)
+			return err
+		}},
+	}
+	for _, data := range testData {
+		start := time.Now()
+		err := data.request()
+		elapsed := time.Since(start)
+		if !IsTimeout(err) {
+			t.Errorf("%s: expected a timeout error, got %v", data.name, err)
+		}
+		if elapsed < data.deadline || elapsed > data.deadline+time.Second {
+			t.Errorf("%s: expected the request to return after its deadline of %v, returned after %v", data.name, data.deadline, elapsed)
+		}
+	}
+}
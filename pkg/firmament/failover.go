@@ -0,0 +1,269 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// ReplayFunc registers the state of poseidon, e.g. the nodes and the tasks, with the firmament endpoint
+// poseidon fails over to. The requests are sent with the given client.
+type ReplayFunc func(client Client) error
+
+// FailoverClient is a firmament scheduler client sending the requests to the active one of several firmament
+// endpoints, e.g. an active and a standby replica. The first endpoint is active at first. Once the active
+// endpoint is not ready for longer than the failover threshold, the client fails over to the next healthy
+// endpoint: the state of poseidon is replayed to it and the requests are sent to it once the replay completed.
+// The requests sent to the unreachable endpoint in the meantime time out, and are sent again by their callers.
+type FailoverClient struct {
+	addresses []string
+	clients   []*FirmamentClient
+	conns     []*grpc.ClientConn
+	threshold time.Duration
+	// mu guards the active endpoint.
+	mu     sync.RWMutex
+	active int
+	// replays are run on failover.
+	replayMu sync.Mutex
+	replays  []ReplayFunc
+	closed   chan struct{}
+}
+
+// NewFailover connects to the firmament endpoints at the addresses, see New, and starts watching the active
+// endpoint until the client is closed. It fails over from an endpoint once it is not ready for threshold.
+func NewFailover(addresses []string, tlsConfig TLSConfig, threshold time.Duration) (*FailoverClient, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no firmament address")
+	}
+	c := &FailoverClient{
+		addresses: addresses,
+		threshold: threshold,
+		closed:    make(chan struct{}),
+	}
+	for _, address := range addresses {
+		client, conn, err := New(address, tlsConfig)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.clients = append(c.clients, client)
+		c.conns = append(c.conns, conn)
+	}
+	c.setActive(0)
+	if len(addresses) > 1 {
+		go c.watch()
+	}
+	return c, nil
+}
+
+// OnFailover registers a replay run on the endpoint the client fails over to, before any other request is sent
+// to it. The replays are run in the order they were registered.
+func (c *FailoverClient) OnFailover(replay ReplayFunc) {
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+	c.replays = append(c.replays, replay)
+}
+
+// ActiveAddress returns the address of the active endpoint.
+func (c *FailoverClient) ActiveAddress() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.addresses[c.active]
+}
+
+// IsHealthy returns if the connection to the active endpoint is ready.
+func (c *FailoverClient) IsHealthy() bool {
+	return c.activeClient().IsHealthy()
+}
+
+// ScheduleBreakerState returns the state of the circuit breaker of the scheduling rounds of the active endpoint.
+func (c *FailoverClient) ScheduleBreakerState() BreakerState {
+	return c.activeClient().ScheduleBreakerState()
+}
+
+// Close closes the connections to the endpoints and stops watching the active endpoint.
+func (c *FailoverClient) Close() {
+	select {
+	case <-c.closed:
+		return
+	default:
+		close(c.closed)
+	}
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+}
+
+func (c *FailoverClient) activeClient() *FirmamentClient {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.clients[c.active]
+}
+
+func (c *FailoverClient) setActive(active int) {
+	c.mu.Lock()
+	c.active = active
+	c.mu.Unlock()
+	for i, address := range c.addresses {
+		value := 0.0
+		if i == active {
+			value = 1
+		}
+		metrics.FirmamentActiveEndpoint.WithLabelValues(address).Set(value)
+	}
+	glog.Infof("Firmament endpoint %s is active", c.addresses[active])
+}
+
+// watch fails over from the active endpoint each time it is unreachable, until the client is closed.
+func (c *FailoverClient) watch() {
+	for {
+		c.mu.RLock()
+		active := c.active
+		c.mu.RUnlock()
+		if !c.waitUnreachable(c.clients[active]) {
+			return
+		}
+		c.failover(active)
+	}
+}
+
+// waitUnreachable waits for the connection of the client not to be ready for the failover threshold.
+// It returns false once the client is closed.
+func (c *FailoverClient) waitUnreachable(client *FirmamentClient) bool {
+	states := client.StateChanges()
+	var unreachable <-chan time.Time
+	if !client.IsHealthy() {
+		unreachable = time.After(c.threshold)
+	}
+	for {
+		select {
+		case state, ok := <-states:
+			if !ok {
+				return false
+			}
+			if state == connectivity.Ready {
+				unreachable = nil
+			} else if unreachable == nil {
+				unreachable = time.After(c.threshold)
+			}
+		case <-unreachable:
+			return true
+		case <-c.closed:
+			return false
+		}
+	}
+}
+
+// failover replays the state of poseidon to the next healthy endpoint after the unreachable one and makes it
+// active. The unreachable endpoint stays active if no other endpoint is healthy, the failover is attempted again
+// after the threshold.
+func (c *FailoverClient) failover(unreachable int) {
+	for i := 1; i < len(c.clients); i++ {
+		next := (unreachable + i) % len(c.clients)
+		if ok, err := Check(c.clients[next], &HealthCheckRequest{}); !ok {
+			glog.Warningf("Firmament endpoint %s is not healthy, not failing over to it: %v", c.addresses[next], err)
+			continue
+		}
+		glog.Warningf("Firmament endpoint %s is unreachable for %v, failing over to %s", c.addresses[unreachable], c.threshold, c.addresses[next])
+		if err := c.replay(c.clients[next]); err != nil {
+			glog.Errorf("Replaying the state to firmament endpoint %s failed: %v", c.addresses[next], err)
+			continue
+		}
+		c.setActive(next)
+		return
+	}
+	glog.Errorf("No healthy firmament endpoint to fail over from %s, retrying in %v", c.addresses[unreachable], c.threshold)
+	select {
+	case <-time.After(c.threshold):
+	case <-c.closed:
+	}
+}
+
+func (c *FailoverClient) replay(client *FirmamentClient) error {
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+	for _, replay := range c.replays {
+		if err := replay(NewClient(client)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *FailoverClient) Schedule(ctx context.Context, in *ScheduleRequest, opts ...grpc.CallOption) (*SchedulingDeltas, error) {
+	return c.activeClient().Schedule(ctx, in, opts...)
+}
+
+func (c *FailoverClient) TaskCompleted(ctx context.Context, in *TaskUID, opts ...grpc.CallOption) (*TaskCompletedResponse, error) {
+	return c.activeClient().TaskCompleted(ctx, in, opts...)
+}
+
+func (c *FailoverClient) TaskFailed(ctx context.Context, in *TaskUID, opts ...grpc.CallOption) (*TaskFailedResponse, error) {
+	return c.activeClient().TaskFailed(ctx, in, opts...)
+}
+
+func (c *FailoverClient) TaskRemoved(ctx context.Context, in *TaskUID, opts ...grpc.CallOption) (*TaskRemovedResponse, error) {
+	return c.activeClient().TaskRemoved(ctx, in, opts...)
+}
+
+func (c *FailoverClient) TaskSubmitted(ctx context.Context, in *TaskDescription, opts ...grpc.CallOption) (*TaskSubmittedResponse, error) {
+	return c.activeClient().TaskSubmitted(ctx, in, opts...)
+}
+
+func (c *FailoverClient) TaskUpdated(ctx context.Context, in *TaskDescription, opts ...grpc.CallOption) (*TaskUpdatedResponse, error) {
+	return c.activeClient().TaskUpdated(ctx, in, opts...)
+}
+
+func (c *FailoverClient) NodeAdded(ctx context.Context, in *ResourceTopologyNodeDescriptor, opts ...grpc.CallOption) (*NodeAddedResponse, error) {
+	return c.activeClient().NodeAdded(ctx, in, opts...)
+}
+
+func (c *FailoverClient) NodeFailed(ctx context.Context, in *ResourceUID, opts ...grpc.CallOption) (*NodeFailedResponse, error) {
+	return c.activeClient().NodeFailed(ctx, in, opts...)
+}
+
+func (c *FailoverClient) NodeRemoved(ctx context.Context, in *ResourceUID, opts ...grpc.CallOption) (*NodeRemovedResponse, error) {
+	return c.activeClient().NodeRemoved(ctx, in, opts...)
+}
+
+func (c *FailoverClient) NodeUpdated(ctx context.Context, in *ResourceTopologyNodeDescriptor, opts ...grpc.CallOption) (*NodeUpdatedResponse, error) {
+	return c.activeClient().NodeUpdated(ctx, in, opts...)
+}
+
+func (c *FailoverClient) AddTaskStats(ctx context.Context, in *TaskStats, opts ...grpc.CallOption) (*TaskStatsResponse, error) {
+	return c.activeClient().AddTaskStats(ctx, in, opts...)
+}
+
+func (c *FailoverClient) AddNodeStats(ctx context.Context, in *ResourceStats, opts ...grpc.CallOption) (*ResourceStatsResponse, error) {
+	return c.activeClient().AddNodeStats(ctx, in, opts...)
+}
+
+func (c *FailoverClient) Check(ctx context.Context, in *HealthCheckRequest, opts ...grpc.CallOption) (*HealthCheckResponse, error) {
+	return c.activeClient().Check(ctx, in, opts...)
+}
+
+func (c *FailoverClient) AddTaskInfo(ctx context.Context, in *TaskInfo, opts ...grpc.CallOption) (*TaskInfoResponse, error) {
+	return c.activeClient().AddTaskInfo(ctx, in, opts...)
+}
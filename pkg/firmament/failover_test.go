@@ -0,0 +1,135 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+)
+
+// nodeRecorder records the nodes added to a fake firmament server.
+type nodeRecorder struct {
+	mu    sync.Mutex
+	nodes []string
+}
+
+func (r *nodeRecorder) nodeAdded(ctx context.Context, rtnd *ResourceTopologyNodeDescriptor) (*NodeAddedResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodes = append(r.nodes, rtnd.GetResourceDesc().GetUuid())
+	return &NodeAddedResponse{Type: NodeReplyType_NODE_ADDED_OK}, nil
+}
+
+func (r *nodeRecorder) added() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.nodes...)
+}
+
+// activeEndpoint returns the value of the active endpoint metric of the address.
+func activeEndpoint(t *testing.T, address string) float64 {
+	metric := &dto.Metric{}
+	if err := metrics.FirmamentActiveEndpoint.WithLabelValues(address).Write(metric); err != nil {
+		t.Fatal("error reading the active endpoint metric ", err)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+// TestFailoverClient checks that the client fails over to the standby firmament endpoint once the active one
+// is stopped, that the state is replayed to the standby, and that the requests continue on the standby.
+func TestFailoverClient(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	var active, standby nodeRecorder
+	activeServer, activeAddress, stopActive := startMockServer(t, mockCtrl, "127.0.0.1:0")
+	activeServer.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).DoAndReturn(active.nodeAdded).AnyTimes()
+	standbyServer, standbyAddress, stopStandby := startMockServer(t, mockCtrl, "127.0.0.1:0")
+	defer stopStandby()
+	standbyServer.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).DoAndReturn(standby.nodeAdded).AnyTimes()
+
+	defer SetTimeouts(rpcTimeout, scheduleTimeout)
+	SetTimeouts(500*time.Millisecond, time.Second)
+	client, err := NewFailover([]string{activeAddress, standbyAddress}, TLSConfig{}, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal("error creating the client ", err)
+	}
+	defer client.Close()
+	// The replay adds the nodes known by the caller to the endpoint the client fails over to.
+	var stateMu sync.Mutex
+	var state []*ResourceTopologyNodeDescriptor
+	client.OnFailover(func(fc Client) error {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		for _, rtnd := range state {
+			if err := fc.NodeAdded(context.Background(), rtnd); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// addNode adds the node the way the node workers do, sending again the requests which timed out.
+	addNode := func(uuid string) {
+		rtnd := &ResourceTopologyNodeDescriptor{ResourceDesc: &ResourceDescriptor{Uuid: uuid}}
+		for {
+			err := NodeAdded(client, rtnd)
+			if err == nil {
+				break
+			}
+			if !IsTimeout(err) {
+				t.Fatalf("unexpected error adding node %s: %v", uuid, err)
+			}
+		}
+		stateMu.Lock()
+		state = append(state, rtnd)
+		stateMu.Unlock()
+	}
+
+	if got := client.ActiveAddress(); got != activeAddress {
+		t.Fatalf("expected the first endpoint %s to be active, got %s", activeAddress, got)
+	}
+	addNode("node0")
+	addNode("node1")
+	stopActive()
+	addNode("node2")
+
+	deadline := time.Now().Add(10 * time.Second)
+	for client.ActiveAddress() != standbyAddress && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := client.ActiveAddress(); got != standbyAddress {
+		t.Fatalf("expected the client to fail over to %s, got %s", standbyAddress, got)
+	}
+	if got := active.added(); !reflect.DeepEqual(got, []string{"node0", "node1"}) {
+		t.Errorf("expected the active endpoint to receive node0 and node1, got %v", got)
+	}
+	if got := standby.added(); !reflect.DeepEqual(got, []string{"node0", "node1", "node2"}) {
+		t.Errorf("expected the standby endpoint to receive the replayed nodes before the next ones, got %v", got)
+	}
+	if activeEndpoint(t, standbyAddress) != 1 || activeEndpoint(t, activeAddress) != 0 {
+		t.Error("expected the active endpoint metric to report the standby endpoint")
+	}
+	if !client.IsHealthy() {
+		t.Error("expected the client to be healthy once it failed over")
+	}
+}
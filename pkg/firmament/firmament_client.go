@@ -18,186 +18,296 @@ package firmament
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/logging"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+var (
+	// rpcTimeout bounds the requests sent by the helpers, scheduleTimeout bounds the scheduling rounds.
+	rpcTimeout      = 5 * time.Second
+	scheduleTimeout = 30 * time.Second
+)
+
+// SetTimeouts sets the deadlines of the requests sent by the helpers. It must be called before any request is sent.
+func SetTimeouts(rpc, schedule time.Duration) {
+	rpcTimeout, scheduleTimeout = rpc, schedule
+}
+
+// IsTimeout checks if the error is returned for a request which did not complete within its deadline.
+// The requests which timed out can be sent again, firmament may have applied them though.
+func IsTimeout(err error) bool {
+	return status.Code(err) == codes.DeadlineExceeded
+}
+
+// IsTransient checks if the error is returned for a request which can be sent again, i.e. it timed out, was skipped
+// by the circuit breaker or failed with a transient error, see isRetryable. The requests rejected by firmament fail
+// again if they are sent again.
+func IsTransient(err error) bool {
+	return IsTimeout(err) || IsCircuitOpen(err) || isRetryable(err)
+}
+
+// IsNotFound checks if the error is returned for a request referring to a node firmament does not know.
+func IsNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// checkError logs and returns the error of a request, the callers decide whether to send it again. The scheduling
+// rounds skipped by the circuit breaker are only logged at a higher verbosity.
+func checkError(request string, err error) error {
+	if IsTimeout(err) {
+		requestFailureLog.Errorf(request, "Firmament %s request timed out: %v", request, err)
+		return err
+	}
+	if IsCircuitOpen(err) {
+		logging.V(2).Info("Firmament request skipped", "request", request, "err", err)
+		return err
+	}
+	requestFailureLog.Errorf(request, "Firmament %s request failed with %s: %v", request, status.Code(err), err)
+	return err
+}
+
 // Schedule sends a schedule request to firmament server.
-func Schedule(client FirmamentSchedulerClient) *SchedulingDeltas {
-	scheduleResp, err := client.Schedule(context.Background(), &ScheduleRequest{})
+// The helpers return the error of the request if it failed, e.g. it did not complete within its deadline, see IsTimeout.
+func Schedule(client FirmamentSchedulerClient) (*SchedulingDeltas, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), scheduleTimeout)
+	defer cancel()
+	scheduleResp, err := client.Schedule(ctx, &ScheduleRequest{})
 	if err != nil {
-		grpclog.Fatalf("%v.Schedule(_) = _, %v: ", client, err)
+		return nil, checkError("Schedule", err)
 	}
-	return scheduleResp
+	return scheduleResp, nil
 }
 
 // TaskCompleted tells firmament server the given task is completed.
-func TaskCompleted(client FirmamentSchedulerClient, tuid *TaskUID) {
-	tCompletedResp, err := client.TaskCompleted(context.Background(), tuid)
+// The task helpers return the reply of firmament, the tasks firmament does not know are logged
+// since they are expected after a restart of poseidon or firmament.
+func TaskCompleted(client FirmamentSchedulerClient, tuid *TaskUID) (TaskReplyType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	tCompletedResp, err := client.TaskCompleted(ctx, tuid)
 	if err != nil {
-		grpclog.Fatalf("%v.TaskCompleted(_) = _, %v: ", client, err)
+		return 0, checkError("TaskCompleted", err)
 	}
 	switch tCompletedResp.Type {
 	case TaskReplyType_TASK_NOT_FOUND:
-		glog.Fatalf("Task %d not found", tuid.TaskUid)
+		logging.Error("Task not found", "taskID", tuid.TaskUid)
 	case TaskReplyType_TASK_JOB_NOT_FOUND:
-		glog.Fatalf("Task's %d job not found", tuid.TaskUid)
+		logging.Error("Task's job not found", "taskID", tuid.TaskUid)
 	case TaskReplyType_TASK_COMPLETED_OK:
 	default:
 		panic(fmt.Sprintf("Unexpected TaskCompleted response %v for task %v", tCompletedResp, tuid.TaskUid))
 	}
+	return tCompletedResp.Type, nil
 }
 
 // TaskFailed tells firmament server the given task is failed.
-func TaskFailed(client FirmamentSchedulerClient, tuid *TaskUID) {
-	tFailedResp, err := client.TaskFailed(context.Background(), tuid)
+func TaskFailed(client FirmamentSchedulerClient, tuid *TaskUID) (TaskReplyType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	tFailedResp, err := client.TaskFailed(ctx, tuid)
 	if err != nil {
-		grpclog.Fatalf("%v.TaskFailed(_) = _, %v: ", client, err)
+		return 0, checkError("TaskFailed", err)
 	}
 	switch tFailedResp.Type {
 	case TaskReplyType_TASK_NOT_FOUND:
-		glog.Fatalf("Task %d not found", tuid.TaskUid)
+		logging.Error("Task not found", "taskID", tuid.TaskUid)
 	case TaskReplyType_TASK_JOB_NOT_FOUND:
-		glog.Fatalf("Task's %d job not found", tuid.TaskUid)
+		logging.Error("Task's job not found", "taskID", tuid.TaskUid)
 	case TaskReplyType_TASK_FAILED_OK:
 	default:
 		panic(fmt.Sprintf("Unexpected TaskFailed response %v for task %v", tFailedResp, tuid.TaskUid))
 	}
+	return tFailedResp.Type, nil
 }
 
 // TaskRemoved tells firmament server the given task is removed.
-func TaskRemoved(client FirmamentSchedulerClient, tuid *TaskUID) {
-	tRemovedResp, err := client.TaskRemoved(context.Background(), tuid)
+func TaskRemoved(client FirmamentSchedulerClient, tuid *TaskUID) (TaskReplyType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	tRemovedResp, err := client.TaskRemoved(ctx, tuid)
 	if err != nil {
-		grpclog.Fatalf("%v.TaskRemoved(_) = _, %v: ", client, err)
+		return 0, checkError("TaskRemoved", err)
 	}
 	switch tRemovedResp.Type {
 	case TaskReplyType_TASK_NOT_FOUND:
-		glog.Fatalf("Task %d not found", tuid.TaskUid)
+		logging.Error("Task not found", "taskID", tuid.TaskUid)
 	case TaskReplyType_TASK_JOB_NOT_FOUND:
-		glog.Fatalf("Task's %d job not found", tuid.TaskUid)
+		logging.Error("Task's job not found", "taskID", tuid.TaskUid)
 	case TaskReplyType_TASK_REMOVED_OK:
 	default:
 		panic(fmt.Sprintf("Unexpected TaskRemoved response %v for task %v", tRemovedResp, tuid.TaskUid))
 	}
+	return tRemovedResp.Type, nil
 }
 
 // TaskSubmitted tells firmament server the given task is submitted.
-func TaskSubmitted(client FirmamentSchedulerClient, td *TaskDescription) {
-	tSubmittedResp, err := client.TaskSubmitted(context.Background(), td)
+func TaskSubmitted(client FirmamentSchedulerClient, td *TaskDescription) (TaskReplyType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	tSubmittedResp, err := client.TaskSubmitted(ctx, td)
 	if err != nil {
-		grpclog.Fatalf("%v.TaskSubmitted(_) = _, %v: ", client, err)
+		return 0, checkError("TaskSubmitted", err)
 	}
 	switch tSubmittedResp.Type {
 	case TaskReplyType_TASK_ALREADY_SUBMITTED:
-		glog.Fatalf("Task (%s,%d) already submitted", td.JobDescriptor.Uuid, td.TaskDescriptor.Uid)
+		logging.Error("Task already submitted", "jobID", td.JobDescriptor.Uuid, "taskID", td.TaskDescriptor.Uid)
 	case TaskReplyType_TASK_STATE_NOT_CREATED:
-		glog.Fatalf("Task (%s,%d) not in created state", td.JobDescriptor.Uuid, td.TaskDescriptor.Uid)
+		logging.Error("Task not in created state", "jobID", td.JobDescriptor.Uuid, "taskID", td.TaskDescriptor.Uid)
 	case TaskReplyType_TASK_SUBMITTED_OK:
 	default:
 		panic(fmt.Sprintf("Unexpected TaskSubmitted response %v for task (%v,%v)", tSubmittedResp, td.JobDescriptor.Uuid, td.TaskDescriptor.Uid))
 	}
+	return tSubmittedResp.Type, nil
 }
 
 // TaskUpdated tells firmament server the given task is updated.
-func TaskUpdated(client FirmamentSchedulerClient, td *TaskDescription) {
-	tUpdatedResp, err := client.TaskUpdated(context.Background(), td)
+func TaskUpdated(client FirmamentSchedulerClient, td *TaskDescription) (TaskReplyType, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	tUpdatedResp, err := client.TaskUpdated(ctx, td)
 	if err != nil {
-		grpclog.Fatalf("%v.TaskUpdated(_) = _, %v: ", client, err)
+		return 0, checkError("TaskUpdated", err)
 	}
 	switch tUpdatedResp.Type {
 	case TaskReplyType_TASK_NOT_FOUND:
-		glog.Fatalf("Task (%s,%d) not found", td.JobDescriptor.Uuid, td.TaskDescriptor.Uid)
+		logging.Error("Task not found", "jobID", td.JobDescriptor.Uuid, "taskID", td.TaskDescriptor.Uid)
 	case TaskReplyType_TASK_JOB_NOT_FOUND:
-		glog.Fatalf("Task's (%s,%d) job not found", td.JobDescriptor.Uuid, td.TaskDescriptor.Uid)
+		logging.Error("Task's job not found", "jobID", td.JobDescriptor.Uuid, "taskID", td.TaskDescriptor.Uid)
 	case TaskReplyType_TASK_UPDATED_OK:
 	default:
 		panic(fmt.Sprintf("Unexpected TaskUpdated response %v for task (%v,%v)", tUpdatedResp, td.JobDescriptor.Uuid, td.TaskDescriptor.Uid))
 	}
+	return tUpdatedResp.Type, nil
 }
 
 // NodeAdded tells firmament server the given node is added.
-func NodeAdded(client FirmamentSchedulerClient, rtnd *ResourceTopologyNodeDescriptor) {
-	nAddedResp, err := client.NodeAdded(context.Background(), rtnd)
+func NodeAdded(client FirmamentSchedulerClient, rtnd *ResourceTopologyNodeDescriptor) error {
+	return NodeAddedWithContext(context.Background(), client, rtnd)
+}
+
+// NodeAddedWithContext is NodeAdded with the context of the request, e.g. carrying the trace context in its metadata.
+func NodeAddedWithContext(ctx context.Context, client FirmamentSchedulerClient, rtnd *ResourceTopologyNodeDescriptor) error {
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+	nAddedResp, err := client.NodeAdded(ctx, rtnd)
 	if err != nil {
-		grpclog.Fatalf("%v.NodeAdded(_) = _, %v: ", client, err)
+		return checkError("NodeAdded", err)
 	}
 	switch nAddedResp.Type {
 	case NodeReplyType_NODE_ALREADY_EXISTS:
-		glog.Infof("Tried to add existing node %s", rtnd.ResourceDesc.Uuid)
+		logging.Info("Tried to add existing node", "resourceUUID", rtnd.ResourceDesc.Uuid, "hostname", rtnd.ResourceDesc.FriendlyName)
 	case NodeReplyType_NODE_ADDED_OK:
 	default:
 		panic(fmt.Sprintf("Unexpected NodeAdded response %v for node %v", nAddedResp, rtnd.ResourceDesc.Uuid))
 	}
+	return nil
 }
 
 // NodeFailed tells firmament server the given node is failed.
-func NodeFailed(client FirmamentSchedulerClient, ruid *ResourceUID) {
-	nFailedResp, err := client.NodeFailed(context.Background(), ruid)
+func NodeFailed(client FirmamentSchedulerClient, ruid *ResourceUID) error {
+	return NodeFailedWithContext(context.Background(), client, ruid)
+}
+
+// NodeFailedWithContext is NodeFailed with the context of the request.
+// A node firmament does not know is logged, it is expected when a request which timed out is sent again.
+func NodeFailedWithContext(ctx context.Context, client FirmamentSchedulerClient, ruid *ResourceUID) error {
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+	nFailedResp, err := client.NodeFailed(ctx, ruid)
 	if err != nil {
-		grpclog.Fatalf("%v.NodeFailed(_) = _, %v: ", client, err)
+		return checkError("NodeFailed", err)
 	}
 	switch nFailedResp.Type {
 	case NodeReplyType_NODE_NOT_FOUND:
-		glog.Fatalf("Tried to fail non-existing node %s", ruid.ResourceUid)
+		logging.Error("Tried to fail non-existing node", "resourceUUID", ruid.ResourceUid)
 	case NodeReplyType_NODE_FAILED_OK:
 	default:
 		panic(fmt.Sprintf("Unexpected NodeFailed response %v for node %v", nFailedResp, ruid.ResourceUid))
 	}
+	return nil
 }
 
 // NodeRemoved tells firmament server the given node is removed.
-func NodeRemoved(client FirmamentSchedulerClient, ruid *ResourceUID) {
-	nRemovedResp, err := client.NodeRemoved(context.Background(), ruid)
+func NodeRemoved(client FirmamentSchedulerClient, ruid *ResourceUID) error {
+	return NodeRemovedWithContext(context.Background(), client, ruid)
+}
+
+// NodeRemovedWithContext is NodeRemoved with the context of the request.
+// A node firmament does not know is logged, it is expected when a request which timed out is sent again.
+func NodeRemovedWithContext(ctx context.Context, client FirmamentSchedulerClient, ruid *ResourceUID) error {
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+	nRemovedResp, err := client.NodeRemoved(ctx, ruid)
 	if err != nil {
-		grpclog.Fatalf("%v.NodeRemoved(_) = _, %v: ", client, err)
+		return checkError("NodeRemoved", err)
 	}
 	switch nRemovedResp.Type {
 	case NodeReplyType_NODE_NOT_FOUND:
-		glog.Fatalf("Tried to remove non-existing node %s", ruid.ResourceUid)
+		logging.Error("Tried to remove non-existing node", "resourceUUID", ruid.ResourceUid)
 	case NodeReplyType_NODE_REMOVED_OK:
 	default:
 		panic(fmt.Sprintf("Unexpected NodeRemoved response %v for node %v", nRemovedResp, ruid.ResourceUid))
 	}
+	return nil
 }
 
 // NodeUpdated tells firmament server the given node is updated.
-func NodeUpdated(client FirmamentSchedulerClient, rtnd *ResourceTopologyNodeDescriptor) {
-	nUpdatedResp, err := client.NodeUpdated(context.Background(), rtnd)
+func NodeUpdated(client FirmamentSchedulerClient, rtnd *ResourceTopologyNodeDescriptor) error {
+	return NodeUpdatedWithContext(context.Background(), client, rtnd)
+}
+
+// NodeUpdatedWithContext is NodeUpdated with the context of the request.
+// A node firmament does not know is returned as a NotFound error.
+func NodeUpdatedWithContext(ctx context.Context, client FirmamentSchedulerClient, rtnd *ResourceTopologyNodeDescriptor) error {
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+	nUpdatedResp, err := client.NodeUpdated(ctx, rtnd)
 	if err != nil {
-		grpclog.Fatalf("%v.NodeUpdated(_) = _, %v: ", client, err)
+		return checkError("NodeUpdated", err)
 	}
 	switch nUpdatedResp.Type {
 	case NodeReplyType_NODE_NOT_FOUND:
-		glog.Fatalf("Tried to updated non-existing node %s", rtnd.ResourceDesc.Uuid)
+		return status.Errorf(codes.NotFound, "tried to update non-existing node %s", rtnd.ResourceDesc.Uuid)
 	case NodeReplyType_NODE_UPDATED_OK:
 	default:
 		panic(fmt.Sprintf("Unexpected NodeUpdated response %v for node %v", nUpdatedResp, rtnd.ResourceDesc.Uuid))
 	}
+	return nil
 }
 
 // AddTaskStats sends task status to firmament server.
-func AddTaskStats(client FirmamentSchedulerClient, ts *TaskStats) {
-	_, err := client.AddTaskStats(context.Background(), ts)
+func AddTaskStats(client FirmamentSchedulerClient, ts *TaskStats) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	_, err := client.AddTaskStats(ctx, ts)
 	if err != nil {
-		grpclog.Fatalf("%v.AddTaskStats(_) = _, %v: ", client, err)
+		return checkError("AddTaskStats", err)
 	}
+	return nil
 }
 
 // AddNodeStats sends node status to firmament server.
-func AddNodeStats(client FirmamentSchedulerClient, rs *ResourceStats) {
-	_, err := client.AddNodeStats(context.Background(), rs)
+func AddNodeStats(client FirmamentSchedulerClient, rs *ResourceStats) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	_, err := client.AddNodeStats(ctx, rs)
 	if err != nil {
-		grpclog.Fatalf("%v.AddNodeStats(_) = _, %v: ", client, err)
+		return checkError("AddNodeStats", err)
 	}
+	return nil
 }
 
 // Check tests if firmament server is health
 func Check(client FirmamentSchedulerClient, req_service *HealthCheckRequest) (bool, error) {
-	res, err := client.Check(context.Background(), req_service)
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	res, err := client.Check(ctx, req_service)
 	if err == nil {
 		if res.GetStatus() == ServingStatus_SERVING {
 			return true, nil
@@ -207,23 +317,42 @@ func Check(client FirmamentSchedulerClient, req_service *HealthCheckRequest) (bo
 }
 
 // New creates a firmament scheduler client by a remote server address.
-// NOTE: it's an insecure connection.
-func New(address string) (FirmamentSchedulerClient, *grpc.ClientConn, error) {
-	var opts []grpc.DialOption
-	opts = append(opts, grpc.WithInsecure())
+// The connection is secured with TLS when it is enabled in tlsConfig and insecure otherwise, the
+// certificates are reloaded on SIGHUP and whenever their files change. The requests wait for the
+// connection to be ready, see FirmamentClient for its connectivity state. The scheduling rounds of the
+// client are guarded by its own circuit breaker, see SetScheduleBreaker.
+func New(address string, tlsConfig TLSConfig) (*FirmamentClient, *grpc.ClientConn, error) {
+	breaker := newScheduleBreaker()
+	opts := connectionOptions(breaker)
+	if tlsConfig.Enabled {
+		creds, err := NewTLSCredentials(tlsConfig)
+		if err != nil {
+			glog.Errorf("Did not connect to Firmament scheduler: %v", err)
+			return nil, nil, err
+		}
+		go creds.Watch(nil)
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	} else {
+		glog.Warningf("Connecting to Firmament scheduler at %s without TLS", address)
+		opts = append(opts, grpc.WithInsecure())
+	}
 	conn, err := grpc.Dial(address, opts...)
 	if err != nil {
 		glog.Errorf("Did not connect to Firmament scheduler: %v", err)
 		return nil, nil, err
 	}
-	fc := NewFirmamentSchedulerClient(conn)
-	return fc, conn, nil
+	client := NewFirmamentClient(conn)
+	client.breaker = breaker
+	return client, conn, nil
 }
 
-// AddTaskStats sends task status to firmament server.
-func AddTaskInfo(client FirmamentSchedulerClient, ts *TaskInfo) {
-	_, err := client.AddTaskInfo(context.Background(), ts)
+// AddTaskInfo sends task info to firmament server.
+func AddTaskInfo(client FirmamentSchedulerClient, ts *TaskInfo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	_, err := client.AddTaskInfo(ctx, ts)
 	if err != nil {
-		grpclog.Fatalf("%v.AddTaskInfo(_) = _, %v: ", client, err)
+		return checkError("AddTaskInfo", err)
 	}
+	return nil
 }
@@ -23,7 +23,7 @@ import (
 )
 
 func Test_New(t *testing.T) {
-	firClient, conn, err := New("127.0.0.1:6090")
+	firClient, conn, err := New("127.0.0.1:6090", TLSConfig{})
 	defer conn.Close()
 	if firClient == nil || conn == nil || err != nil {
 		t.Error("Failed to start the client")
@@ -111,6 +111,17 @@ func Test_TaskRemoved(t *testing.T) {
 	TaskRemoved(firmamentClient, nil)
 }
 
+func Test_TaskRemovedNotFound(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	firmamentClient := NewMockFirmamentSchedulerClient(mockCtrl)
+	firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+		&TaskRemovedResponse{Type: TaskReplyType_TASK_NOT_FOUND}, nil)
+	if reply, err := TaskRemoved(firmamentClient, &TaskUID{TaskUid: 1}); err != nil || reply != TaskReplyType_TASK_NOT_FOUND {
+		t.Errorf("expected reply %v got %v %v", TaskReplyType_TASK_NOT_FOUND, reply, err)
+	}
+}
+
 func Test_TaskFailed(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -0,0 +1,71 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmamenttest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+)
+
+// ExpectMethods fails the test unless the methods of the recorded requests are the expected ones, in order.
+func (c *FakeClient) ExpectMethods(t testing.TB, methods ...string) {
+	t.Helper()
+	var got []string
+	for _, call := range c.Calls() {
+		got = append(got, call.Method)
+	}
+	if !reflect.DeepEqual(got, methods) {
+		t.Errorf("expected the calls %v, got %v", methods, got)
+	}
+}
+
+// ExpectRequests fails the test unless the recorded requests of the method are deeply equal to the expected
+// ones, in order.
+func (c *FakeClient) ExpectRequests(t testing.TB, method string, requests ...interface{}) {
+	t.Helper()
+	if got := c.Requests(method); !reflect.DeepEqual(got, requests) {
+		t.Errorf("expected the %s requests %v, got %v", method, requests, got)
+	}
+}
+
+// ExpectNoRequests fails the test if requests of the method were recorded.
+func (c *FakeClient) ExpectNoRequests(t testing.TB, method string) {
+	t.Helper()
+	if got := c.Requests(method); len(got) != 0 {
+		t.Errorf("expected no %s requests, got %v", method, got)
+	}
+}
+
+// ExpectNodes fails the test unless the resource IDs of the recorded requests of the node method, e.g.
+// NodeAdded or NodeFailed, are the expected ones, in order.
+func (c *FakeClient) ExpectNodes(t testing.TB, method string, resourceIDs ...string) {
+	t.Helper()
+	var got []string
+	for _, request := range c.Requests(method) {
+		switch request := request.(type) {
+		case *firmament.ResourceTopologyNodeDescriptor:
+			got = append(got, request.GetResourceDesc().GetUuid())
+		case *firmament.ResourceUID:
+			got = append(got, request.GetResourceUid())
+		}
+	}
+	if !reflect.DeepEqual(got, resourceIDs) {
+		t.Errorf("expected the %s requests of the nodes %v, got %v", method, resourceIDs, got)
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package firmamenttest provides an in-memory firmament.Client recording the requests of the unit tests.
+package firmamenttest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FakeCall is a request recorded by FakeClient.
+type FakeCall struct {
+	// Method is the name of the firmament.Client method, e.g. NodeAdded.
+	Method  string
+	Request interface{}
+}
+
+// fakeStreamCapacity is the number of events queued on the schedule streams of a FakeClient.
+const fakeStreamCapacity = 100
+
+// fakeStreamEvent is received on a schedule stream of a FakeClient, either deltas or the error breaking the stream.
+type fakeStreamEvent struct {
+	deltas *firmament.SchedulingDeltas
+	err    error
+}
+
+// FakeClient is an in-memory firmament.Client for the unit tests. It records the requests, returns the canned
+// scheduling deltas and the injected errors, and replies OK to the task requests by default.
+// It is safe for concurrent use.
+type FakeClient struct {
+	mu      sync.Mutex
+	calls   []FakeCall
+	deltas  []*firmament.SchedulingDeltas
+	errors  map[string][]error
+	replies map[string]firmament.TaskReplyType
+	stream  chan fakeStreamEvent
+}
+
+// NewFakeClient returns a fake client without recorded requests.
+func NewFakeClient() *FakeClient {
+	return &FakeClient{
+		errors: make(map[string][]error),
+		replies: map[string]firmament.TaskReplyType{
+			"TaskSubmitted": firmament.TaskReplyType_TASK_SUBMITTED_OK,
+			"TaskUpdated":   firmament.TaskReplyType_TASK_UPDATED_OK,
+			"TaskRemoved":   firmament.TaskReplyType_TASK_REMOVED_OK,
+			"TaskCompleted": firmament.TaskReplyType_TASK_COMPLETED_OK,
+			"TaskFailed":    firmament.TaskReplyType_TASK_FAILED_OK,
+		},
+		stream: make(chan fakeStreamEvent, fakeStreamCapacity),
+	}
+}
+
+// AddDeltas queues the deltas returned by the next scheduling rounds, one per round.
+// The rounds return empty deltas once the queued ones are consumed.
+func (c *FakeClient) AddDeltas(deltas ...*firmament.SchedulingDeltas) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deltas = append(c.deltas, deltas...)
+}
+
+// StreamDeltas queues the deltas pushed on the schedule streams, they are received in order by the open
+// stream and then by the streams opened again once it is broken.
+func (c *FakeClient) StreamDeltas(deltas ...*firmament.SchedulingDeltas) {
+	for _, d := range deltas {
+		c.stream <- fakeStreamEvent{deltas: d}
+	}
+}
+
+// BreakStream breaks the open schedule stream with the error once the deltas queued before are received.
+func (c *FakeClient) BreakStream(err error) {
+	c.stream <- fakeStreamEvent{err: err}
+}
+
+// InjectError queues the errors returned by the next calls of the method, one per call.
+// The calls failing with an injected error are recorded as well.
+func (c *FakeClient) InjectError(method string, errs ...error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors[method] = append(c.errors[method], errs...)
+}
+
+// SetTaskReply sets the reply of firmament to the task requests of the method, e.g. TASK_NOT_FOUND for TaskRemoved.
+func (c *FakeClient) SetTaskReply(method string, reply firmament.TaskReplyType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replies[method] = reply
+}
+
+// Calls returns the recorded requests in the order they were sent.
+func (c *FakeClient) Calls() []FakeCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]FakeCall(nil), c.calls...)
+}
+
+// Requests returns the recorded requests of the method in the order they were sent.
+func (c *FakeClient) Requests(method string) []interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var requests []interface{}
+	for _, call := range c.calls {
+		if call.Method == method {
+			requests = append(requests, call.Request)
+		}
+	}
+	return requests
+}
+
+// Reset drops the recorded requests, the queued deltas and the injected errors.
+func (c *FakeClient) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = nil
+	c.deltas = nil
+	c.errors = make(map[string][]error)
+}
+
+// Replay sends the recorded requests again to the client, in the order they were sent, e.g. to rebuild the
+// state of firmament from the requests of a test. It stops at the first failing request. The scheduling rounds
+// and the schedule streams are not replayed.
+func (c *FakeClient) Replay(ctx context.Context, client firmament.Client) error {
+	for _, call := range c.Calls() {
+		var err error
+		switch request := call.Request.(type) {
+		case *firmament.ResourceTopologyNodeDescriptor:
+			if call.Method == "NodeAdded" {
+				err = client.NodeAdded(ctx, request)
+			} else {
+				err = client.NodeUpdated(ctx, request)
+			}
+		case *firmament.ResourceUID:
+			if call.Method == "NodeRemoved" {
+				err = client.NodeRemoved(ctx, request)
+			} else {
+				err = client.NodeFailed(ctx, request)
+			}
+		case *firmament.TaskDescription:
+			if call.Method == "TaskSubmitted" {
+				_, err = client.TaskSubmitted(request)
+			} else {
+				_, err = client.TaskUpdated(request)
+			}
+		case *firmament.TaskUID:
+			switch call.Method {
+			case "TaskRemoved":
+				_, err = client.TaskRemoved(request)
+			case "TaskCompleted":
+				_, err = client.TaskCompleted(request)
+			default:
+				_, err = client.TaskFailed(request)
+			}
+		case *firmament.TaskStats:
+			err = client.AddTaskStats(request)
+		case *firmament.ResourceStats:
+			err = client.AddNodeStats(request)
+		case *firmament.TaskInfo:
+			err = client.AddTaskInfo(request)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to replay %s request %v: %v", call.Method, call.Request, err)
+		}
+	}
+	return nil
+}
+
+// record records the request and returns the next error injected for the method.
+func (c *FakeClient) record(method string, request interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, FakeCall{Method: method, Request: request})
+	errs := c.errors[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	c.errors[method] = errs[1:]
+	return errs[0]
+}
+
+// taskRequest records the task request and returns the reply set for the method.
+func (c *FakeClient) taskRequest(method string, request interface{}) (firmament.TaskReplyType, error) {
+	if err := c.record(method, request); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.replies[method], nil
+}
+
+func (c *FakeClient) NodeAdded(ctx context.Context, rtnd *firmament.ResourceTopologyNodeDescriptor) error {
+	return c.record("NodeAdded", rtnd)
+}
+
+func (c *FakeClient) NodeRemoved(ctx context.Context, ruid *firmament.ResourceUID) error {
+	return c.record("NodeRemoved", ruid)
+}
+
+func (c *FakeClient) NodeFailed(ctx context.Context, ruid *firmament.ResourceUID) error {
+	return c.record("NodeFailed", ruid)
+}
+
+func (c *FakeClient) NodeUpdated(ctx context.Context, rtnd *firmament.ResourceTopologyNodeDescriptor) error {
+	return c.record("NodeUpdated", rtnd)
+}
+
+func (c *FakeClient) TaskSubmitted(td *firmament.TaskDescription) (firmament.TaskReplyType, error) {
+	return c.taskRequest("TaskSubmitted", td)
+}
+
+func (c *FakeClient) TaskUpdated(td *firmament.TaskDescription) (firmament.TaskReplyType, error) {
+	return c.taskRequest("TaskUpdated", td)
+}
+
+func (c *FakeClient) TaskRemoved(tuid *firmament.TaskUID) (firmament.TaskReplyType, error) {
+	return c.taskRequest("TaskRemoved", tuid)
+}
+
+func (c *FakeClient) TaskCompleted(tuid *firmament.TaskUID) (firmament.TaskReplyType, error) {
+	return c.taskRequest("TaskCompleted", tuid)
+}
+
+func (c *FakeClient) TaskFailed(tuid *firmament.TaskUID) (firmament.TaskReplyType, error) {
+	return c.taskRequest("TaskFailed", tuid)
+}
+
+func (c *FakeClient) Schedule() (*firmament.SchedulingDeltas, error) {
+	if err := c.record("Schedule", &firmament.ScheduleRequest{}); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.deltas) == 0 {
+		return &firmament.SchedulingDeltas{}, nil
+	}
+	deltas := c.deltas[0]
+	c.deltas = c.deltas[1:]
+	return deltas, nil
+}
+
+func (c *FakeClient) ScheduleStream(ctx context.Context) (firmament.DeltaStream, error) {
+	if err := c.record("ScheduleStream", &firmament.ScheduleRequest{}); err != nil {
+		return nil, err
+	}
+	return &fakeDeltaStream{ctx: ctx, events: c.stream}, nil
+}
+
+// fakeDeltaStream receives the deltas queued by StreamDeltas until the context is done.
+type fakeDeltaStream struct {
+	ctx    context.Context
+	events <-chan fakeStreamEvent
+}
+
+func (s *fakeDeltaStream) Recv() (*firmament.SchedulingDeltas, error) {
+	select {
+	case <-s.ctx.Done():
+		return nil, status.Error(codes.Canceled, s.ctx.Err().Error())
+	case event := <-s.events:
+		return event.deltas, event.err
+	}
+}
+
+func (c *FakeClient) AddTaskStats(ts *firmament.TaskStats) error {
+	return c.record("AddTaskStats", ts)
+}
+
+func (c *FakeClient) AddNodeStats(rs *firmament.ResourceStats) error {
+	return c.record("AddNodeStats", rs)
+}
+
+func (c *FakeClient) AddTaskInfo(ti *firmament.TaskInfo) error {
+	return c.record("AddTaskInfo", ti)
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmamenttest
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFakeClient(t *testing.T) {
+	var _ firmament.Client = NewFakeClient()
+	fc := NewFakeClient()
+	timeout := status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+	fc.InjectError("TaskSubmitted", timeout)
+	fc.SetTaskReply("TaskRemoved", firmament.TaskReplyType_TASK_NOT_FOUND)
+	deltas := &firmament.SchedulingDeltas{Deltas: []*firmament.SchedulingDelta{{TaskId: 1, ResourceId: "node0"}}}
+	fc.AddDeltas(deltas)
+
+	td := &firmament.TaskDescription{TaskDescriptor: &firmament.TaskDescriptor{Uid: 1}}
+	if _, err := fc.TaskSubmitted(td); !firmament.IsTimeout(err) {
+		t.Errorf("expected the injected timeout, got %v", err)
+	}
+	if reply, err := fc.TaskSubmitted(td); err != nil || reply != firmament.TaskReplyType_TASK_SUBMITTED_OK {
+		t.Errorf("expected reply %v, got %v %v", firmament.TaskReplyType_TASK_SUBMITTED_OK, reply, err)
+	}
+	if reply, err := fc.TaskRemoved(&firmament.TaskUID{TaskUid: 1}); err != nil || reply != firmament.TaskReplyType_TASK_NOT_FOUND {
+		t.Errorf("expected reply %v, got %v %v", firmament.TaskReplyType_TASK_NOT_FOUND, reply, err)
+	}
+	if got, err := fc.Schedule(); err != nil || got != deltas {
+		t.Errorf("expected the canned deltas %v, got %v %v", deltas, got, err)
+	}
+	if got, err := fc.Schedule(); err != nil || len(got.GetDeltas()) != 0 {
+		t.Errorf("expected no deltas once the canned ones are consumed, got %v %v", got, err)
+	}
+
+	var methods []string
+	for _, call := range fc.Calls() {
+		methods = append(methods, call.Method)
+	}
+	expected := []string{"TaskSubmitted", "TaskSubmitted", "TaskRemoved", "Schedule", "Schedule"}
+	if !reflect.DeepEqual(methods, expected) {
+		t.Errorf("expected the calls %v, got %v", expected, methods)
+	}
+	if requests := fc.Requests("TaskSubmitted"); len(requests) != 2 || requests[0] != td {
+		t.Errorf("expected the submissions of %v, got %v", td, requests)
+	}
+	fc.Reset()
+	if calls := fc.Calls(); len(calls) != 0 {
+		t.Errorf("expected no calls after a reset, got %v", calls)
+	}
+}
+
+// TestFakeClient_concurrent checks that the requests sent concurrently are all recorded.
+func TestFakeClient_concurrent(t *testing.T) {
+	fc := NewFakeClient()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				fc.NodeAdded(context.Background(), &firmament.ResourceTopologyNodeDescriptor{})
+				fc.TaskSubmitted(&firmament.TaskDescription{})
+			}
+		}()
+	}
+	wg.Wait()
+	if got := len(fc.Requests("NodeAdded")); got != 1000 {
+		t.Errorf("expected 1000 node additions, got %d", got)
+	}
+	if got := len(fc.Calls()); got != 2000 {
+		t.Errorf("expected 2000 calls, got %d", got)
+	}
+}
+
+// TestFakeClient_Replay checks that the recorded requests are sent again in order, and that the replay stops
+// at the first failing request.
+func TestFakeClient_Replay(t *testing.T) {
+	fc := NewFakeClient()
+	rtnd := &firmament.ResourceTopologyNodeDescriptor{ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node0"}}
+	td := &firmament.TaskDescription{TaskDescriptor: &firmament.TaskDescriptor{Uid: 1}}
+	fc.NodeAdded(context.Background(), rtnd)
+	fc.TaskSubmitted(td)
+	fc.Schedule()
+	fc.NodeFailed(context.Background(), &firmament.ResourceUID{ResourceUid: "node0"})
+	fc.TaskRemoved(&firmament.TaskUID{TaskUid: 1})
+
+	replayed := NewFakeClient()
+	if err := fc.Replay(context.Background(), replayed); err != nil {
+		t.Fatalf("unexpected replay error %v", err)
+	}
+	replayed.ExpectMethods(t, "NodeAdded", "TaskSubmitted", "NodeFailed", "TaskRemoved")
+	replayed.ExpectRequests(t, "TaskSubmitted", td)
+
+	failing := NewFakeClient()
+	failing.InjectError("TaskSubmitted", status.Error(codes.Unavailable, "firmament is down"))
+	if err := fc.Replay(context.Background(), failing); err == nil {
+		t.Error("expected the replay to fail")
+	}
+	failing.ExpectMethods(t, "NodeAdded", "TaskSubmitted")
+}
+
+// recordingT records the failures of the assertions instead of failing the test.
+type recordingT struct {
+	testing.TB
+	failures []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+}
+
+// TestFakeClient_expect checks that the assertion helpers pass on the recorded requests and fail otherwise.
+func TestFakeClient_expect(t *testing.T) {
+	fc := NewFakeClient()
+	rtnd := &firmament.ResourceTopologyNodeDescriptor{ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node0"}}
+	fc.NodeAdded(context.Background(), rtnd)
+	fc.NodeRemoved(context.Background(), &firmament.ResourceUID{ResourceUid: "node1"})
+
+	passing := &recordingT{TB: t}
+	fc.ExpectMethods(passing, "NodeAdded", "NodeRemoved")
+	fc.ExpectRequests(passing, "NodeAdded", rtnd)
+	fc.ExpectNoRequests(passing, "NodeFailed")
+	fc.ExpectNodes(passing, "NodeAdded", "node0")
+	fc.ExpectNodes(passing, "NodeRemoved", "node1")
+	if len(passing.failures) != 0 {
+		t.Errorf("expected the assertions to pass, got %v", passing.failures)
+	}
+
+	failing := &recordingT{TB: t}
+	fc.ExpectMethods(failing, "NodeAdded")
+	fc.ExpectRequests(failing, "NodeAdded", &firmament.ResourceTopologyNodeDescriptor{})
+	fc.ExpectNoRequests(failing, "NodeRemoved")
+	fc.ExpectNodes(failing, "NodeRemoved", "node0")
+	if len(failing.failures) != 4 {
+		t.Errorf("expected the 4 assertions to fail, got %v", failing.failures)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// LogLimiter rate limits the logs of the failures repeated while firmament is down, e.g. the requests processed
+// again and again by the workers. The logs of a key are limited by a token bucket holding up to burst tokens,
+// refilled with a token every interval. The failures which are not logged are counted, their number is appended
+// to the next log of the key.
+type LogLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    float64
+	logf     func(format string, args ...interface{})
+	buckets  map[string]*logBucket
+	now      func() time.Time
+}
+
+type logBucket struct {
+	tokens     float64
+	refilled   time.Time
+	suppressed int
+}
+
+// NewLogLimiter creates a log limiter logging up to burst failures of a key at once, then a failure every
+// interval, with logf, e.g. glog.Errorf. An interval of 0 disables the limit.
+func NewLogLimiter(interval time.Duration, burst int, logf func(format string, args ...interface{})) *LogLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &LogLimiter{
+		interval: interval,
+		burst:    float64(burst),
+		logf:     logf,
+		buckets:  make(map[string]*logBucket),
+		now:      time.Now,
+	}
+}
+
+// Errorf logs the failure of the key, unless the failures of the key are logged at a higher rate than allowed.
+// An interval of 0 logs every failure.
+func (l *LogLimiter) Errorf(key, format string, args ...interface{}) {
+	if l.interval <= 0 {
+		l.logf(format, args...)
+		return
+	}
+	l.mu.Lock()
+	now := l.now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &logBucket{tokens: l.burst, refilled: now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens += float64(now.Sub(bucket.refilled)) / float64(l.interval)
+		if bucket.tokens > l.burst {
+			bucket.tokens = l.burst
+		}
+		bucket.refilled = now
+	}
+	if bucket.tokens < 1 {
+		bucket.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	bucket.tokens--
+	suppressed := bucket.suppressed
+	bucket.suppressed = 0
+	l.mu.Unlock()
+	if suppressed > 0 {
+		format += fmt.Sprintf(" (%d similar failures not logged)", suppressed)
+	}
+	l.logf(format, args...)
+}
+
+// Reset forgets the failures of the key once its requests succeed again, its next failure is logged.
+func (l *LogLimiter) Reset(key string) {
+	l.mu.Lock()
+	delete(l.buckets, key)
+	l.mu.Unlock()
+}
+
+// requestFailureLog limits the logs of the failed requests by request name, the limit of a request is reset
+// once it succeeds, see observeRequests.
+var requestFailureLog = NewLogLimiter(10*time.Second, 1, glog.Errorf)
+
+// SetRequestFailureLogInterval sets the time between the logs of the repeated failures of a request, 0 logs every
+// failure. It must be called before any request is sent.
+func SetRequestFailureLogInterval(interval time.Duration) {
+	requestFailureLog = NewLogLimiter(interval, 1, glog.Errorf)
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestLogLimiter checks the burst and the refill of the logs of a key, the count of the failures which were
+// not logged, the keys limited independently, and the reset of a key.
+func TestLogLimiter(t *testing.T) {
+	var logs []string
+	limiter := NewLogLimiter(10*time.Second, 2, func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		limiter.Errorf("node0", "failure %d", i)
+	}
+	limiter.Errorf("node1", "failure %d", 0)
+	now = now.Add(5 * time.Second)
+	limiter.Errorf("node0", "failure %d", 5)
+	now = now.Add(5 * time.Second)
+	limiter.Errorf("node0", "failure %d", 6)
+	expected := []string{"failure 0", "failure 1", "failure 0", "failure 6 (4 similar failures not logged)"}
+	if !reflect.DeepEqual(logs, expected) {
+		t.Errorf("expected the logs %v, got %v", expected, logs)
+	}
+
+	logs = nil
+	limiter.Errorf("node0", "failure %d", 7)
+	limiter.Reset("node0")
+	limiter.Errorf("node0", "failure %d", 8)
+	if expected := []string{"failure 8"}; !reflect.DeepEqual(logs, expected) {
+		t.Errorf("expected the failure following the reset to be logged, got %v", logs)
+	}
+
+	logs = nil
+	unlimited := NewLogLimiter(0, 1, limiter.logf)
+	for i := 0; i < 3; i++ {
+		unlimited.Errorf("node0", "failure %d", i)
+	}
+	if len(logs) != 3 {
+		t.Errorf("expected every failure to be logged without interval, got %v", logs)
+	}
+}
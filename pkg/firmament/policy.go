@@ -0,0 +1,96 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// CostModels are the cost models of firmament by name, with their value of the --flow_scheduling_cost_model flag of
+// firmament.
+var CostModels = map[string]int{
+	"trivial":             0,
+	"random":              1,
+	"sjf":                 2,
+	"quincy":              3,
+	"whare":               4,
+	"coco":                5,
+	"octopus":             6,
+	"void":                7,
+	"net-aware":           8,
+	"quincy-interference": 9,
+	"cpu-mem":             10,
+}
+
+// Solvers are the min-cost flow solvers of firmament, the values of its --solver flag.
+var Solvers = []string{"cs2", "custom", "flowlessly"}
+
+// SchedulingPolicy is the cost model and the solver firmament schedules with. An empty cost model or solver keeps
+// the one firmament was started with.
+type SchedulingPolicy struct {
+	CostModel string
+	Solver    string
+}
+
+// Validate checks that the cost model and the solver are known to firmament.
+func (p SchedulingPolicy) Validate() error {
+	if _, ok := CostModels[p.CostModel]; p.CostModel != "" && !ok {
+		names := make([]string, 0, len(CostModels))
+		for name := range CostModels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown firmament cost model %q, it must be one of %s", p.CostModel, strings.Join(names, ", "))
+	}
+	if p.Solver == "" {
+		return nil
+	}
+	for _, solver := range Solvers {
+		if p.Solver == solver {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown firmament solver %q, it must be one of %s", p.Solver, strings.Join(Solvers, ", "))
+}
+
+// Flags returns the command line flags of firmament selecting the cost model and the solver of the policy.
+func (p SchedulingPolicy) Flags() []string {
+	var flags []string
+	if p.CostModel != "" {
+		flags = append(flags, fmt.Sprintf("--flow_scheduling_cost_model=%d", CostModels[p.CostModel]))
+	}
+	if p.Solver != "" {
+		flags = append(flags, "--solver="+p.Solver)
+	}
+	return flags
+}
+
+// ConfigureSchedulingPolicy forwards the policy to the firmament endpoint at address. The firmament scheduler
+// service does not offer a configuration request yet, so a warning names the flags firmament must be started with
+// instead, e.g. in the firmament deployment.
+func ConfigureSchedulingPolicy(address string, policy SchedulingPolicy) {
+	flags := policy.Flags()
+	if len(flags) == 0 {
+		return
+	}
+	glog.Warningf("Firmament endpoint %s does not support configuring the cost model %q and the solver %q at runtime, start firmament with %s",
+		address, policy.CostModel, policy.Solver, strings.Join(flags, " "))
+}
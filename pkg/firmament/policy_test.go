@@ -0,0 +1,64 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestSchedulingPolicy checks the validation of the cost model and the solver and the firmament flags selecting them.
+func TestSchedulingPolicy(t *testing.T) {
+	var testData = []struct {
+		policy   SchedulingPolicy
+		err      string
+		expected []string
+	}{
+		{policy: SchedulingPolicy{}},
+		{
+			policy:   SchedulingPolicy{CostModel: "trivial"},
+			expected: []string{"--flow_scheduling_cost_model=0"},
+		},
+		{
+			policy:   SchedulingPolicy{CostModel: "net-aware", Solver: "flowlessly"},
+			expected: []string{"--flow_scheduling_cost_model=8", "--solver=flowlessly"},
+		},
+		{
+			policy:   SchedulingPolicy{Solver: "cs2"},
+			expected: []string{"--solver=cs2"},
+		},
+		{policy: SchedulingPolicy{CostModel: "cheapest"}, err: `unknown firmament cost model "cheapest"`},
+		{policy: SchedulingPolicy{CostModel: "coco", Solver: "lemon"}, err: `unknown firmament solver "lemon"`},
+	}
+
+	for _, data := range testData {
+		err := data.policy.Validate()
+		if data.err != "" {
+			if err == nil || !strings.Contains(err.Error(), data.err) {
+				t.Errorf("%+v: expected an error mentioning %q, got %v", data.policy, data.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: Validate() failed: %v", data.policy, err)
+		}
+		if flags := data.policy.Flags(); !reflect.DeepEqual(flags, data.expected) {
+			t.Errorf("%+v: expected the flags %v, got %v", data.policy, data.expected, flags)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scheduleMethod is the full name of the Schedule request, retried with its own policy.
+const scheduleMethod = "/firmament.FirmamentScheduler/Schedule"
+
+// RetryPolicy is the exponential backoff applied to the requests to firmament failing with a transient error,
+// e.g. while firmament is restarted by a rolling update. The retries are bounded by the deadline of the
+// request as well.
+type RetryPolicy struct {
+	// InitialInterval is the wait before the first retry, multiplied by Multiplier after each retry.
+	InitialInterval time.Duration
+	Multiplier      float64
+	// MaxElapsedTime bounds the time spent retrying a request, 0 disables the retries.
+	MaxElapsedTime time.Duration
+}
+
+var (
+	retryPolicy = RetryPolicy{
+		InitialInterval: 100 * time.Millisecond,
+		Multiplier:      2,
+		MaxElapsedTime:  3 * time.Second,
+	}
+	// The scheduling rounds are not retried by default, a round is expensive and the next one
+	// is run after the scheduling interval anyway.
+	scheduleRetryPolicy = RetryPolicy{
+		InitialInterval: 100 * time.Millisecond,
+		Multiplier:      2,
+	}
+)
+
+// SetRetryPolicies sets the retry policies of the requests and of the scheduling rounds. It must be called
+// before any request is sent.
+func SetRetryPolicies(rpc, schedule RetryPolicy) {
+	retryPolicy, scheduleRetryPolicy = rpc, schedule
+}
+
+// Validate returns an error describing the first invalid setting of the policy.
+func (p RetryPolicy) Validate() error {
+	if p.MaxElapsedTime < 0 {
+		return fmt.Errorf("the maximum retry time must not be negative, got %v", p.MaxElapsedTime)
+	}
+	if p.InitialInterval <= 0 {
+		return fmt.Errorf("the initial retry interval must be positive, got %v", p.InitialInterval)
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("the retry multiplier must be at least 1, got %v", p.Multiplier)
+	}
+	return nil
+}
+
+// isRetryable checks if the request failed with a transient error and can be sent again. The requests
+// rejected by firmament, e.g. with INVALID_ARGUMENT, are never retried.
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// retryRequests sends the requests once the connection is ready, see waitForReady, and sends them again
+// with an exponential backoff while they fail with a transient error. A request is not retried once its
+// context is done, the error of the last attempt is returned.
+func retryRequests(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	policy := retryPolicy
+	if method == scheduleMethod {
+		policy = scheduleRetryPolicy
+	}
+	start := time.Now()
+	interval := policy.InitialInterval
+	for {
+		err := waitForReady(ctx, method, req, reply, cc, invoker, opts...)
+		if err == nil || !isRetryable(err) || ctx.Err() != nil || time.Since(start)+interval > policy.MaxElapsedTime {
+			return err
+		}
+		glog.V(2).Infof("Retrying the firmament %s request in %v: %v", path.Base(method), interval, err)
+		metrics.FirmamentRequestRetries.WithLabelValues(path.Base(method)).Inc()
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval = time.Duration(float64(interval) * policy.Multiplier)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retries returns the number of retries of the method counted by the metric.
+func retries(t *testing.T, method string) float64 {
+	metric := &dto.Metric{}
+	if err := metrics.FirmamentRequestRetries.WithLabelValues(method).Write(metric); err != nil {
+		t.Fatal("error reading the retries metric ", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+// TestRetryRequests checks that the requests failing with a transient error are retried until they succeed
+// or the retry budget is exhausted, and that the other errors and the scheduling rounds are not retried.
+func TestRetryRequests(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening ", err)
+	}
+	unavailable := status.Error(codes.Unavailable, "firmament is restarting")
+	server := NewMockFirmamentSchedulerServer(mockCtrl)
+	// The flaky server fails the first node additions while it restarts.
+	gomock.InOrder(
+		server.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(nil, unavailable).Times(2),
+		server.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+			&NodeAddedResponse{Type: NodeReplyType_NODE_ADDED_OK}, nil),
+	)
+	server.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(nil, unavailable).MinTimes(2)
+	server.EXPECT().NodeFailed(gomock.Any(), gomock.Any()).Return(
+		nil, status.Error(codes.InvalidArgument, "unknown resource")).Times(1)
+	server.EXPECT().Schedule(gomock.Any(), gomock.Any()).Return(nil, unavailable).Times(1)
+	grpcServer := grpc.NewServer()
+	RegisterFirmamentSchedulerServer(grpcServer, server)
+	go grpcServer.Serve(listen)
+	defer grpcServer.Stop()
+
+	defer SetRetryPolicies(retryPolicy, scheduleRetryPolicy)
+	SetRetryPolicies(RetryPolicy{InitialInterval: 10 * time.Millisecond, Multiplier: 2, MaxElapsedTime: 200 * time.Millisecond},
+		RetryPolicy{InitialInterval: 10 * time.Millisecond, Multiplier: 2})
+	client, conn, err := New(listen.Addr().String(), TLSConfig{})
+	if err != nil {
+		t.Fatal("error creating the client ", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	retried := retries(t, "NodeAdded")
+	if err := NodeAdded(client, &ResourceTopologyNodeDescriptor{ResourceDesc: &ResourceDescriptor{Uuid: "node"}}); err != nil {
+		t.Errorf("expected the node addition to succeed once firmament is back, got %v", err)
+	}
+	if got := retries(t, "NodeAdded") - retried; got != 2 {
+		t.Errorf("expected 2 retries of the node addition, got %v", got)
+	}
+
+	retried = retries(t, "TaskSubmitted")
+	start := time.Now()
+	if _, err := client.TaskSubmitted(ctx, &TaskDescription{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected the task submission to fail with UNAVAILABLE once the retries are exhausted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the retries to stop within their budget, returned after %v", elapsed)
+	}
+	if got := retries(t, "TaskSubmitted") - retried; got < 1 {
+		t.Errorf("expected the task submission to be retried, got %v retries", got)
+	}
+
+	retried = retries(t, "NodeFailed")
+	if _, err := client.NodeFailed(ctx, &ResourceUID{ResourceUid: "node"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected the node failure to fail with INVALID_ARGUMENT, got %v", err)
+	}
+	if got := retries(t, "NodeFailed") - retried; got != 0 {
+		t.Errorf("expected the rejected node failure not to be retried, got %v retries", got)
+	}
+
+	if _, err := client.Schedule(ctx, &ScheduleRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected the scheduling round not to be retried, got %v", err)
+	}
+}
+
+// TestRequestErrors checks that the helpers return the errors of the requests firmament keeps failing, once
+// their retries are exhausted, instead of exiting, so that the watchers send them again.
+func TestRequestErrors(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening ", err)
+	}
+	server := NewMockFirmamentSchedulerServer(mockCtrl)
+	server.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+		nil, status.Error(codes.Unavailable, "firmament is restarting")).MinTimes(1)
+	server.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+		nil, status.Error(codes.ResourceExhausted, "too many requests")).MinTimes(1)
+	server.EXPECT().NodeUpdated(gomock.Any(), gomock.Any()).Return(
+		&NodeUpdatedResponse{Type: NodeReplyType_NODE_NOT_FOUND}, nil)
+	grpcServer := grpc.NewServer()
+	RegisterFirmamentSchedulerServer(grpcServer, server)
+	go grpcServer.Serve(listen)
+	defer grpcServer.Stop()
+
+	defer SetRetryPolicies(retryPolicy, scheduleRetryPolicy)
+	SetRetryPolicies(RetryPolicy{InitialInterval: 10 * time.Millisecond, Multiplier: 2, MaxElapsedTime: 100 * time.Millisecond},
+		RetryPolicy{InitialInterval: 10 * time.Millisecond, Multiplier: 2})
+	client, conn, err := New(listen.Addr().String(), TLSConfig{})
+	if err != nil {
+		t.Fatal("error creating the client ", err)
+	}
+	defer conn.Close()
+
+	td := &TaskDescription{JobDescriptor: &JobDescriptor{Uuid: "job"}, TaskDescriptor: &TaskDescriptor{Uid: 1}}
+	if _, err := TaskSubmitted(client, td); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected the task submission to fail with UNAVAILABLE, got %v", err)
+	}
+	// The request is sent again by its caller.
+	if _, err := TaskSubmitted(client, td); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected the task submission sent again to fail with UNAVAILABLE, got %v", err)
+	}
+	rtnd := &ResourceTopologyNodeDescriptor{ResourceDesc: &ResourceDescriptor{Uuid: "node"}}
+	if err := NodeAdded(client, rtnd); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected the node addition to fail with RESOURCE_EXHAUSTED, got %v", err)
+	}
+	if err := NodeUpdated(client, rtnd); status.Code(err) != codes.NotFound {
+		t.Errorf("expected the update of a node firmament does not know to fail with NOT_FOUND, got %v", err)
+	}
+}
+
+func TestRetryPolicy_Validate(t *testing.T) {
+	var testData = []struct {
+		name   string
+		policy RetryPolicy
+		valid  bool
+	}{
+		{"default", retryPolicy, true},
+		{"disabled", RetryPolicy{InitialInterval: time.Second, Multiplier: 1}, true},
+		{"negative maximum", RetryPolicy{InitialInterval: time.Second, Multiplier: 2, MaxElapsedTime: -time.Second}, false},
+		{"zero interval", RetryPolicy{Multiplier: 2, MaxElapsedTime: time.Second}, false},
+		{"decreasing intervals", RetryPolicy{InitialInterval: time.Second, Multiplier: 0.5, MaxElapsedTime: time.Second}, false},
+	}
+	for _, data := range testData {
+		if err := data.policy.Validate(); (err == nil) != data.valid {
+			t.Errorf("%s: expected valid %v, got %v", data.name, data.valid, err)
+		}
+	}
+}
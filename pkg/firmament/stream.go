@@ -0,0 +1,84 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scheduleStreamMethod is the full name of the streaming variant of Schedule, exposed by the firmament builds
+// running the scheduling rounds on their own and pushing their deltas. It is not part of firmament_scheduler.proto,
+// the requests of the other builds fail with UNIMPLEMENTED, see IsStreamUnsupported.
+const scheduleStreamMethod = "/firmament.FirmamentScheduler/ScheduleStream"
+
+var scheduleStreamDesc = grpc.StreamDesc{
+	StreamName:    "ScheduleStream",
+	ServerStreams: true,
+}
+
+// DeltaStream receives the scheduling deltas pushed by firmament, in the order of the scheduling rounds.
+type DeltaStream interface {
+	// Recv blocks until the deltas of the next round are received, it returns an error once the stream is broken.
+	Recv() (*SchedulingDeltas, error)
+}
+
+// IsStreamUnsupported checks if the error is returned by a firmament build which does not expose the schedule stream.
+func IsStreamUnsupported(err error) bool {
+	return status.Code(err) == codes.Unimplemented
+}
+
+// scheduleStreamer is implemented by the firmament scheduler clients opening the schedule stream.
+type scheduleStreamer interface {
+	ScheduleStream(ctx context.Context) (DeltaStream, error)
+}
+
+// deltaStream receives the deltas of a schedule stream opened on a connection.
+type deltaStream struct {
+	grpc.ClientStream
+}
+
+func (s *deltaStream) Recv() (*SchedulingDeltas, error) {
+	deltas := new(SchedulingDeltas)
+	if err := s.RecvMsg(deltas); err != nil {
+		return nil, err
+	}
+	return deltas, nil
+}
+
+// ScheduleStream opens a schedule stream on the connection once it is ready. The stream is closed once the
+// context is done. The streams are not retried, nor guarded by the circuit breaker of the scheduling rounds.
+func (c *FirmamentClient) ScheduleStream(ctx context.Context) (DeltaStream, error) {
+	stream, err := c.conn.NewStream(ctx, &scheduleStreamDesc, scheduleStreamMethod, grpc.FailFast(false))
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&ScheduleRequest{}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &deltaStream{ClientStream: stream}, nil
+}
+
+// ScheduleStream opens a schedule stream on the active endpoint. The stream is broken once the client fails over.
+func (c *FailoverClient) ScheduleStream(ctx context.Context) (DeltaStream, error) {
+	return c.activeClient().ScheduleStream(ctx)
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startStreamServer serves a firmament service exposing the schedule stream. The stream pushes the deltas
+// and is then broken with the error.
+func startStreamServer(t *testing.T, mockCtrl *gomock.Controller, deltas []*SchedulingDeltas, err error) (string, func()) {
+	listen, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal("error listening ", listenErr)
+	}
+	server := NewMockFirmamentSchedulerServer(mockCtrl)
+	desc := _FirmamentScheduler_serviceDesc
+	desc.Streams = []grpc.StreamDesc{{
+		StreamName:    "ScheduleStream",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			if err := stream.RecvMsg(new(ScheduleRequest)); err != nil {
+				return err
+			}
+			for _, d := range deltas {
+				if err := stream.SendMsg(d); err != nil {
+					return err
+				}
+			}
+			return err
+		},
+	}}
+	grpcServer := grpc.NewServer()
+	grpcServer.RegisterService(&desc, server)
+	go grpcServer.Serve(listen)
+	return listen.Addr().String(), grpcServer.Stop
+}
+
+// TestScheduleStream checks that the deltas pushed on the schedule stream are received in order, that the error
+// breaking the stream is returned, and that the firmament builds without the stream are detected.
+func TestScheduleStream(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	var deltas []*SchedulingDeltas
+	for i := uint64(1); i <= 3; i++ {
+		deltas = append(deltas, &SchedulingDeltas{Deltas: []*SchedulingDelta{{TaskId: i, Type: SchedulingDelta_PLACE}}})
+	}
+	address, stop := startStreamServer(t, mockCtrl, deltas, status.Error(codes.Unavailable, "firmament is restarting"))
+	defer stop()
+	client, conn, err := New(address, TLSConfig{})
+	if err != nil {
+		t.Fatal("error creating the client ", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := NewClient(client).ScheduleStream(ctx)
+	if err != nil {
+		t.Fatal("error opening the schedule stream ", err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		received, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("expected the deltas of task %d, got %v", i, err)
+		}
+		if got := received.GetDeltas()[0].GetTaskId(); got != i {
+			t.Errorf("expected the deltas of task %d, got the deltas of task %d", i, got)
+		}
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable || IsStreamUnsupported(err) {
+		t.Errorf("expected the stream to be broken with UNAVAILABLE, got %v", err)
+	}
+
+	_, unsupportedAddress, stopUnsupported := startMockServer(t, mockCtrl, "127.0.0.1:0")
+	defer stopUnsupported()
+	unsupported, unsupportedConn, err := New(unsupportedAddress, TLSConfig{})
+	if err != nil {
+		t.Fatal("error creating the client ", err)
+	}
+	defer unsupportedConn.Close()
+	stream, err = unsupported.ScheduleStream(ctx)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if !IsStreamUnsupported(err) {
+		t.Errorf("expected the stream to be unsupported, got %v", err)
+	}
+	if _, err := NewClient(NewMockFirmamentSchedulerClient(mockCtrl)).ScheduleStream(ctx); !IsStreamUnsupported(err) {
+		t.Errorf("expected the stream to be unsupported by a client without connection, got %v", err)
+	}
+}
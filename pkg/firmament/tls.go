@@ -0,0 +1,206 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSConfig holds the transport security settings of the connection to firmament.
+type TLSConfig struct {
+	// Enabled secures the connection with TLS, the connection is insecure otherwise.
+	Enabled bool
+	// CAFile verifies the firmament certificate, the system roots are used when empty.
+	CAFile string
+	// CertFile and KeyFile authenticate poseidon to firmament (mutual TLS) when set.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name verified in the firmament certificate, the host of the address by default.
+	ServerName string
+}
+
+// load reads the certificates of the configuration.
+func (c TLSConfig) load() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the firmament CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the firmament CA file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("both the firmament certificate and key files are needed for mutual TLS, got %q and %q", c.CertFile, c.KeyFile)
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the firmament client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// dirs returns the directories of the certificate files. The directories are watched rather than the files
+// since the files of a mounted secret are replaced by a symlink swap.
+func (c TLSConfig) dirs() []string {
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, file := range []string{c.CAFile, c.CertFile, c.KeyFile} {
+		if file == "" {
+			continue
+		}
+		dir := filepath.Dir(file)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// TLSCredentials are the TLS transport credentials of the connection to firmament. The certificates are
+// read again from their files on Reload, the connections established afterwards use the new certificates.
+type TLSCredentials struct {
+	cfg   TLSConfig
+	mu    sync.RWMutex
+	creds credentials.TransportCredentials
+}
+
+// NewTLSCredentials loads the certificates of the configuration.
+func NewTLSCredentials(cfg TLSConfig) (*TLSCredentials, error) {
+	c := &TLSCredentials{cfg: cfg}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the certificate files again, the previous certificates are kept on error.
+func (c *TLSCredentials) Reload() error {
+	c.mu.RLock()
+	cfg := c.cfg
+	c.mu.RUnlock()
+	tlsConfig, err := cfg.load()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.creds = credentials.NewTLS(tlsConfig)
+	return nil
+}
+
+// Watch reloads the certificate files on SIGHUP and whenever their directories change, until stopCh is closed.
+func (c *TLSCredentials) Watch(stopCh <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if dirs := c.cfg.dirs(); len(dirs) > 0 {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			glog.Errorf("Failed to watch the firmament certificate files, they are only reloaded on SIGHUP: %v", err)
+		} else {
+			defer watcher.Close()
+			for _, dir := range dirs {
+				if err := watcher.Add(dir); err != nil {
+					glog.Errorf("Failed to watch the firmament certificate directory %s: %v", dir, err)
+				}
+			}
+			events, errs = watcher.Events, watcher.Errors
+		}
+	}
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-hup:
+			c.reload("SIGHUP")
+		case event := <-events:
+			c.reload(event.String())
+		case err := <-errs:
+			glog.Errorf("Error watching the firmament certificate files: %v", err)
+		}
+	}
+}
+
+func (c *TLSCredentials) reload(reason string) {
+	if err := c.Reload(); err != nil {
+		glog.Errorf("Failed to reload the firmament certificates on %s, keeping the previous ones: %v", reason, err)
+		return
+	}
+	glog.Infof("Reloaded the firmament certificates on %s", reason)
+}
+
+func (c *TLSCredentials) current() credentials.TransportCredentials {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.creds
+}
+
+// ClientHandshake does the TLS handshake with the current certificates.
+func (c *TLSCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.current().ClientHandshake(ctx, authority, rawConn)
+}
+
+// ServerHandshake does the TLS handshake with the current certificates.
+func (c *TLSCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.current().ServerHandshake(rawConn)
+}
+
+// Info returns the protocol info of the current certificates.
+func (c *TLSCredentials) Info() credentials.ProtocolInfo {
+	return c.current().Info()
+}
+
+// Clone returns a copy of the current credentials, the copy is not reloaded.
+func (c *TLSCredentials) Clone() credentials.TransportCredentials {
+	return c.current().Clone()
+}
+
+// OverrideServerName overrides the name verified in the firmament certificate, including after a reload.
+func (c *TLSCredentials) OverrideServerName(serverName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg.ServerName = serverName
+	return c.creds.OverrideServerName(serverName)
+}
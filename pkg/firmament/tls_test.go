@@ -0,0 +1,270 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firmament
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const testServerName = "firmament-service.kube-system"
+
+// testCA signs the certificates of the test firmament server and poseidon.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	ca := &testCA{}
+	ca.cert, ca.key = ca.sign(t, x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	})
+	return ca
+}
+
+// sign returns a certificate from the template, signed by the CA or self signed for the CA itself.
+func (ca *testCA) sign(t *testing.T, template x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("error generating key ", err)
+	}
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, parentKey := ca.cert, ca.key
+	if parent == nil {
+		parent, parentKey = &template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal("error creating certificate ", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("error parsing certificate ", err)
+	}
+	return cert, key
+}
+
+func (ca *testCA) keyPair(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	cert, key := ca.sign(t, x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{name},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+	})
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal("error writing ", path, err)
+	}
+}
+
+// writeKeyPair writes the certificate and the key of the key pair to the cert.pem and key.pem files of the directory.
+func writeKeyPair(t *testing.T, dir string, keyPair tls.Certificate) (string, string) {
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", keyPair.Certificate[0])
+	der, err := x509.MarshalECPrivateKey(keyPair.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal("error marshalling key ", err)
+	}
+	writePEM(t, keyFile, "EC PRIVATE KEY", der)
+	return certFile, keyFile
+}
+
+// startTLSServer serves a firmament service reporting it is serving over TLS.
+func startTLSServer(t *testing.T, mockCtrl *gomock.Controller, tlsConfig *tls.Config) (string, func()) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("error listening ", err)
+	}
+	server := NewMockFirmamentSchedulerServer(mockCtrl)
+	server.EXPECT().Check(gomock.Any(), gomock.Any()).Return(
+		&HealthCheckResponse{Status: ServingStatus_SERVING}, nil).AnyTimes()
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	RegisterFirmamentSchedulerServer(grpcServer, server)
+	go grpcServer.Serve(listen)
+	return listen.Addr().String(), grpcServer.Stop
+}
+
+// checkServing returns if the health check succeeds within a few seconds on the connection.
+func checkServing(client FirmamentSchedulerClient) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	res, err := client.Check(ctx, &HealthCheckRequest{}, grpc.FailFast(false))
+	return err == nil && res.GetStatus() == ServingStatus_SERVING
+}
+
+func TestNew_TLS(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	dir, err := ioutil.TempDir("", "firmament-tls")
+	if err != nil {
+		t.Fatal("error creating temp dir ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "firmament-ca")
+	otherCA := newTestCA(t, "other-ca")
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ca.cert.Raw)
+	otherCAFile := filepath.Join(dir, "other-ca.pem")
+	writePEM(t, otherCAFile, "CERTIFICATE", otherCA.cert.Raw)
+	clientDir := filepath.Join(dir, "client")
+	otherClientDir := filepath.Join(dir, "other-client")
+	for _, d := range []string{clientDir, otherClientDir} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal("error creating dir ", err)
+		}
+	}
+	certFile, keyFile := writeKeyPair(t, clientDir, ca.keyPair(t, "poseidon", x509.ExtKeyUsageClientAuth))
+	otherCertFile, otherKeyFile := writeKeyPair(t, otherClientDir, otherCA.keyPair(t, "poseidon", x509.ExtKeyUsageClientAuth))
+
+	serverCert := ca.keyPair(t, testServerName, x509.ExtKeyUsageServerAuth)
+	tlsAddress, stopTLS := startTLSServer(t, mockCtrl, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	defer stopTLS()
+	mTLSAddress, stopMTLS := startTLSServer(t, mockCtrl, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+	})
+	defer stopMTLS()
+
+	var testData = []struct {
+		name      string
+		address   string
+		tlsConfig TLSConfig
+		serving   bool
+	}{
+		{name: "tls", address: tlsAddress, serving: true,
+			tlsConfig: TLSConfig{Enabled: true, CAFile: caFile, ServerName: testServerName}},
+		{name: "tls unknown CA", address: tlsAddress, serving: false,
+			tlsConfig: TLSConfig{Enabled: true, CAFile: otherCAFile, ServerName: testServerName}},
+		{name: "tls wrong server name", address: tlsAddress, serving: false,
+			tlsConfig: TLSConfig{Enabled: true, CAFile: caFile, ServerName: "firmament.example.com"}},
+		{name: "insecure", address: tlsAddress, serving: false, tlsConfig: TLSConfig{}},
+		{name: "mtls", address: mTLSAddress, serving: true,
+			tlsConfig: TLSConfig{Enabled: true, CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: testServerName}},
+		{name: "mtls without client certificate", address: mTLSAddress, serving: false,
+			tlsConfig: TLSConfig{Enabled: true, CAFile: caFile, ServerName: testServerName}},
+		{name: "mtls unknown client certificate", address: mTLSAddress, serving: false,
+			tlsConfig: TLSConfig{Enabled: true, CAFile: caFile, CertFile: otherCertFile, KeyFile: otherKeyFile, ServerName: testServerName}},
+	}
+
+	for _, data := range testData {
+		client, conn, err := New(data.address, data.tlsConfig)
+		if err != nil {
+			t.Errorf("%s: error creating the client %v", data.name, err)
+			continue
+		}
+		if serving := checkServing(client); serving != data.serving {
+			t.Errorf("%s: expected the health check to succeed %v, got %v", data.name, data.serving, serving)
+		}
+		conn.Close()
+	}
+
+	if _, _, err := New(tlsAddress, TLSConfig{Enabled: true, CertFile: certFile}); err == nil {
+		t.Error("expected an error for a client certificate without key")
+	}
+	if _, _, err := New(tlsAddress, TLSConfig{Enabled: true, CAFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("expected an error for a missing CA file")
+	}
+}
+
+// TestTLSCredentials_Reload checks that the connections established after a reload use the rotated certificate.
+func TestTLSCredentials_Reload(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	dir, err := ioutil.TempDir("", "firmament-tls")
+	if err != nil {
+		t.Fatal("error creating temp dir ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "firmament-ca")
+	otherCA := newTestCA(t, "other-ca")
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ca.cert.Raw)
+	certFile, keyFile := writeKeyPair(t, dir, otherCA.keyPair(t, "poseidon", x509.ExtKeyUsageClientAuth))
+	address, stop := startTLSServer(t, mockCtrl, &tls.Config{
+		Certificates: []tls.Certificate{ca.keyPair(t, testServerName, x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+	})
+	defer stop()
+
+	creds, err := NewTLSCredentials(TLSConfig{Enabled: true, CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: testServerName})
+	if err != nil {
+		t.Fatal("error loading the credentials ", err)
+	}
+	dial := func() bool {
+		conn, err := grpc.Dial(address, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			t.Fatal("error dialing ", err)
+		}
+		defer conn.Close()
+		return checkServing(NewFirmamentSchedulerClient(conn))
+	}
+	if dial() {
+		t.Error("expected the health check to fail with a client certificate of another CA")
+	}
+
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal("error removing the key ", err)
+	}
+	if err := creds.Reload(); err == nil {
+		t.Error("expected an error reloading without the key")
+	}
+	writeKeyPair(t, dir, ca.keyPair(t, "poseidon", x509.ExtKeyUsageClientAuth))
+	if err := creds.Reload(); err != nil {
+		t.Fatal("error reloading the credentials ", err)
+	}
+	if !dial() {
+		t.Error("expected the health check to succeed with the rotated client certificate")
+	}
+}
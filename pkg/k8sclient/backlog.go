@@ -0,0 +1,99 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// backlogLimiter counts the events queued and not processed yet, and blocks the producers once the count
+// reaches the cap. Blocking the event handlers of an informer pauses the delivery of its events, so that
+// a burst of events, e.g. thousands of nodes flapping at once, does not grow the queue without bound while
+// the workers are slowed down by firmament.
+type backlogLimiter struct {
+	name     string
+	max      int
+	gauge    prometheus.Gauge
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inFlight int
+	paused   bool
+	closed   bool
+}
+
+// newBacklogLimiter returns a limiter of the events of the named queue, it never blocks when max is 0.
+func newBacklogLimiter(name string, max int, gauge prometheus.Gauge) *backlogLimiter {
+	l := &backlogLimiter{
+		name:  name,
+		max:   max,
+		gauge: gauge,
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits for the backlog to drain below the cap and counts a new event in flight.
+func (l *backlogLimiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.max > 0 && l.inFlight >= l.max && !l.closed {
+		if !l.paused {
+			l.paused = true
+			glog.Warningf("%d %s events in flight, pausing the delivery of the events until the backlog drains", l.inFlight, l.name)
+		}
+		l.cond.Wait()
+	}
+	if l.paused {
+		l.paused = false
+		glog.Infof("%d %s events in flight, resuming the delivery of the events", l.inFlight, l.name)
+	}
+	l.inFlight++
+	l.gauge.Set(float64(l.inFlight))
+}
+
+// release counts n events as processed and wakes up the producers waiting for the backlog to drain.
+func (l *backlogLimiter) release(n int) {
+	if n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight -= n
+	if l.inFlight < 0 {
+		l.inFlight = 0
+	}
+	l.gauge.Set(float64(l.inFlight))
+	l.cond.Broadcast()
+}
+
+// close releases the producers for good, e.g. once the queue is shut down.
+func (l *backlogLimiter) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+}
+
+// len returns the number of events in flight.
+func (l *backlogLimiter) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+)
+
+// ScheduleTrigger requests a scheduling round ahead of the scheduling interval.
+var ScheduleTrigger chan struct{}
+
+// TriggerSchedule requests a scheduling round, requests made while a round is pending are merged.
+func TriggerSchedule() {
+	select {
+	case ScheduleTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// taskBatcher accumulates the tasks of pending pods and submits them to firmament together, followed
+// by a single scheduling round, so that firmament solves once for a burst of pods.
+type taskBatcher struct {
+	fc      firmament.Client
+	window  time.Duration
+	maxSize int
+	// idle reports if no more tasks are about to be added, the batch is then submitted right away.
+	idle func() bool
+	// schedule is called once a batch is submitted.
+	schedule func()
+	// notify wakes the batcher up when a task is added or the idle state may have changed.
+	notify chan struct{}
+	// mu is held while a batch is submitted, so that the pending tasks are submitted before
+	// any other call for the tasks is made.
+	mu      sync.Mutex
+	tasks   []*firmament.TaskDescription
+	pending map[uint64]struct{}
+}
+
+func newTaskBatcher(fc firmament.Client, window time.Duration, maxSize int, idle func() bool, schedule func()) *taskBatcher {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	return &taskBatcher{
+		fc:       fc,
+		window:   window,
+		maxSize:  maxSize,
+		idle:     idle,
+		schedule: schedule,
+		notify:   make(chan struct{}, 1),
+		pending:  make(map[uint64]struct{}),
+	}
+}
+
+// add queues the task for the next batch.
+func (b *taskBatcher) add(td *firmament.TaskDescription) {
+	b.mu.Lock()
+	b.tasks = append(b.tasks, td)
+	b.pending[td.GetTaskDescriptor().GetUid()] = struct{}{}
+	b.mu.Unlock()
+	b.wakeUp()
+}
+
+// wakeUp tells the batcher the idle state may have changed.
+func (b *taskBatcher) wakeUp() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// isPending checks if the task is not submitted to firmament yet. It waits for the batch being
+// submitted, so a task which is not pending is known to firmament.
+func (b *taskBatcher) isPending(taskID uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.pending[taskID]
+	return ok
+}
+
+// cancel drops the task from the batch. It returns false if the task was already submitted.
+func (b *taskBatcher) cancel(taskID uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.pending[taskID]; !ok {
+		return false
+	}
+	delete(b.pending, taskID)
+	for i, td := range b.tasks {
+		if td.GetTaskDescriptor().GetUid() == taskID {
+			b.tasks = append(b.tasks[:i], b.tasks[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func (b *taskBatcher) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.tasks)
+}
+
+// run submits a batch once it is full, once the batch window expires or as soon as no more tasks
+// are about to be added. A single pending pod is therefore submitted without delay.
+func (b *taskBatcher) run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-b.notify:
+		}
+		if b.size() == 0 {
+			continue
+		}
+		windowTimer := time.NewTimer(b.window)
+	waitLoop:
+		for b.size() < b.maxSize && !b.idle() {
+			select {
+			case <-stopCh:
+				windowTimer.Stop()
+				return
+			case <-b.notify:
+			case <-windowTimer.C:
+				break waitLoop
+			}
+		}
+		windowTimer.Stop()
+		b.flush()
+	}
+}
+
+// drain submits the batched tasks until none is left or a submission fails, e.g. on shutdown.
+func (b *taskBatcher) drain() {
+	for size := b.size(); size > 0; {
+		b.flush()
+		remaining := b.size()
+		if remaining >= size {
+			return
+		}
+		size = remaining
+	}
+}
+
+// flush submits up to maxSize of the batched tasks and triggers a scheduling round.
+func (b *taskBatcher) flush() {
+	b.mu.Lock()
+	tasks := b.tasks
+	if len(tasks) > b.maxSize {
+		tasks = tasks[:b.maxSize]
+	}
+	b.tasks = b.tasks[len(tasks):]
+	for i, td := range tasks {
+		if _, err := b.fc.TaskSubmitted(td); err != nil {
+			if !firmament.IsTransient(err) {
+				// The task fails again if it is submitted again.
+				glog.Errorf("Submitting task %d failed, dropping it: %v", td.GetTaskDescriptor().GetUid(), err)
+				delete(b.pending, td.GetTaskDescriptor().GetUid())
+				continue
+			}
+			// The tasks which are not submitted stay at the head of the batch to be submitted again.
+			glog.Errorf("Submitting task %d failed, %d tasks of the batch are submitted again: %v", td.GetTaskDescriptor().GetUid(), len(tasks)-i, err)
+			if firmament.IsTimeout(err) {
+				metrics.FirmamentRequestTimeouts.Inc()
+			}
+			b.tasks = append(append([]*firmament.TaskDescription{}, tasks[i:]...), b.tasks...)
+			tasks = tasks[:i]
+			break
+		}
+		delete(b.pending, td.GetTaskDescriptor().GetUid())
+	}
+	remaining := len(b.tasks)
+	b.mu.Unlock()
+	if len(tasks) > 0 {
+		glog.V(2).Infof("Submitted a batch of %d tasks", len(tasks))
+		b.schedule()
+	}
+	if remaining > 0 {
+		b.wakeUp()
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+)
+
+// runPodBurst submits the tasks of a burst of pending pods through a batcher and returns the sizes
+// of the batches, each batch being followed by a scheduling round.
+func runPodBurst(t *testing.T, numPods int, window time.Duration, maxSize int) []int {
+	var empty map[string]string
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+
+	var lock sync.Mutex
+	submitted := 0
+	var batches []int
+	done := make(chan struct{})
+	testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+		&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil).Times(numPods).Do(
+		func(arg0, arg1 interface{}, arg2 ...interface{}) {
+			lock.Lock()
+			submitted++
+			lock.Unlock()
+		})
+	schedule := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		previous := 0
+		for _, size := range batches {
+			previous += size
+		}
+		batches = append(batches, submitted-previous)
+		if submitted == numPods {
+			close(done)
+		}
+	}
+	podWatch.batcher = newTaskBatcher(testObj.fc, window, maxSize,
+		func() bool { return podWatch.podWorkQueue.Len() == 0 }, schedule)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go podWatch.batcher.run(stopCh)
+
+	for i := 0; i < numPods; i++ {
+		pod := BuildPod("Poseidon-Namespace", fmt.Sprintf("burst-%d", i), empty, v1.PodPending, "1", "1024", nil, "owner-burst")
+		podWatch.enqueuePodAddition(GetKey(pod, t), pod)
+	}
+	go podWatch.podWorker()
+	defer podWatch.podWorkQueue.ShutDown()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the %d tasks to be submitted, got batches %v", numPods, batches)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return batches
+}
+
+// TestTaskBatcherBurst submits a burst of 200 pods and compares the number of scheduling rounds
+// with and without batching.
+func TestTaskBatcherBurst(t *testing.T) {
+	numPods := 200
+	unbatched := runPodBurst(t, numPods, time.Hour, 1)
+	if len(unbatched) != numPods {
+		t.Errorf("expected %d scheduling rounds without batching, got %d", numPods, len(unbatched))
+	}
+
+	// The burst is submitted once the work queue is idle, way before the batch window expires.
+	batched := runPodBurst(t, numPods, time.Hour, 500)
+	if len(batched) != 1 {
+		t.Errorf("expected a single scheduling round for the burst, got batches %v", batched)
+	}
+
+	capped := runPodBurst(t, numPods, time.Hour, 50)
+	if len(capped) < numPods/50 {
+		t.Errorf("expected at least %d scheduling rounds with batches of 50 tasks, got batches %v", numPods/50, capped)
+	}
+	for _, size := range capped {
+		if size > 50 {
+			t.Errorf("expected batches of at most 50 tasks, got batches %v", capped)
+			break
+		}
+	}
+	t.Logf("scheduling rounds for %d pods: %d without batching, %d batched, %d with batches of 50", numPods, len(unbatched), len(batched), len(capped))
+}
+
+// TestTaskBatcherSinglePod checks that a single pending pod does not wait for the batch window.
+func TestTaskBatcherSinglePod(t *testing.T) {
+	start := time.Now()
+	batches := runPodBurst(t, 1, time.Hour, 500)
+	if len(batches) != 1 || batches[0] != 1 {
+		t.Errorf("expected a single batch of one task, got %v", batches)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the task to be submitted right away, took %v", elapsed)
+	}
+}
+
+func TestTaskBatcherCancel(t *testing.T) {
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	batcher := newTaskBatcher(testObj.fc, time.Hour, 500, func() bool { return false }, func() {})
+	batcher.add(&firmament.TaskDescription{TaskDescriptor: &firmament.TaskDescriptor{Uid: 1}})
+	batcher.add(&firmament.TaskDescription{TaskDescriptor: &firmament.TaskDescriptor{Uid: 2}})
+	if !batcher.isPending(1) || !batcher.cancel(1) {
+		t.Error("expected the pending task 1 to be cancelled")
+	}
+	if batcher.isPending(1) || batcher.cancel(1) {
+		t.Error("expected task 1 not to be pending once cancelled")
+	}
+
+	testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), &firmament.TaskDescription{TaskDescriptor: &firmament.TaskDescriptor{Uid: 2}}).Return(
+		&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil)
+	batcher.flush()
+	if batcher.isPending(2) || batcher.cancel(2) {
+		t.Error("expected the submitted task 2 not to be cancelled")
+	}
+}
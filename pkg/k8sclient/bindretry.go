@@ -0,0 +1,211 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// maxBindRetryBackoff bounds the exponential backoff of the resubmissions after bind failures.
+const maxBindRetryBackoff = time.Minute
+
+// bindRetryMux is used to guard access to bindRetries.
+var bindRetryMux *sync.Mutex
+
+// bindRetries maps the pods whose binding failed to their retry state.
+var bindRetries map[PodIdentifier]*bindRetry
+
+// bindRetry tracks the failed bindings of a pod. The task of the pod is withdrawn from firmament
+// after a failed binding, so that firmament reclaims the resources of the placement, and is
+// resubmitted after a backoff for another scheduling round.
+type bindRetry struct {
+	// mu is held while the task is removed from or submitted to firmament, so that the pod is not forgotten
+	// meanwhile. It guards the fields below.
+	mu       sync.Mutex
+	attempts int
+	// withdrawn is set while the task is removed from firmament.
+	withdrawn bool
+	// forgotten is set once the retry state of the pod is dropped, the task is not resubmitted anymore.
+	forgotten bool
+}
+
+// isRetryableBindError checks if a binding rejected with the error may succeed later. Errors which
+// do not come from the API server, e.g. connection errors, are retried.
+func isRetryableBindError(err error) bool {
+	if _, ok := err.(errors.APIStatus); !ok {
+		return true
+	}
+	return errors.IsConflict(err) || errors.IsServerTimeout(err) || errors.IsTimeout(err) ||
+		errors.IsTooManyRequests(err) || errors.IsInternalError(err) || errors.IsServiceUnavailable(err)
+}
+
+// getBindRetryBackoff returns the backoff before the task is resubmitted after the given number of
+// failed bindings, doubling the base backoff after each failure.
+func getBindRetryBackoff(base time.Duration, attempts int) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < maxBindRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBindRetryBackoff {
+		backoff = maxBindRetryBackoff
+	}
+	return backoff
+}
+
+// handleBindFailure withdraws the task of the pod from firmament and resubmits it after a backoff, until stopCh is
+// closed. The task stays withdrawn once the error is permanent or the maximum number of attempts is reached, and is
+// not withdrawn if firmament fails to remove it. It returns false if the binding is not retried.
+func handleBindFailure(fc firmament.Client, podIdentifier PodIdentifier, err error, maxAttempts int, baseBackoff time.Duration, stopCh <-chan struct{}) bool {
+	PodMux.RLock()
+	td, ok := PodToTD[podIdentifier]
+	PodMux.RUnlock()
+	if !ok {
+		return false
+	}
+	bindRetryMux.Lock()
+	retry, ok := bindRetries[podIdentifier]
+	if !ok {
+		retry = &bindRetry{}
+		bindRetries[podIdentifier] = retry
+	}
+	bindRetryMux.Unlock()
+	retry.mu.Lock()
+	if retry.withdrawn || retry.forgotten {
+		// A binding of the pod already failed, the task is not placed anymore.
+		retry.mu.Unlock()
+		return false
+	}
+	retry.attempts++
+	attempts := retry.attempts
+	reply, removeErr := fc.TaskRemoved(&firmament.TaskUID{TaskUid: td.GetUid()})
+	if removeErr != nil || (reply != firmament.TaskReplyType_TASK_REMOVED_OK && reply != firmament.TaskReplyType_TASK_NOT_FOUND) {
+		retry.mu.Unlock()
+		glog.Errorf("Withdrawing the task of pod %v after its failed binding failed, reply: %v, err: %v", podIdentifier, reply, removeErr)
+		return false
+	}
+	retry.withdrawn = true
+	retry.mu.Unlock()
+
+	if !isRetryableBindError(err) {
+		glog.Errorf("Binding of pod %v failed permanently, err: %v", podIdentifier, err)
+		return false
+	}
+	if attempts >= maxAttempts {
+		glog.Errorf("Binding of pod %v failed %d times, giving up, err: %v", podIdentifier, attempts, err)
+		return false
+	}
+	backoff := getBindRetryBackoff(baseBackoff, attempts)
+	glog.Infof("Binding of pod %v failed %d times, resubmitting the task in %v, err: %v", podIdentifier, attempts, backoff, err)
+	go resubmitWithdrawnTask(fc, podIdentifier, backoff, stopCh)
+	return true
+}
+
+// resubmitWithdrawnTask submits the task of the pod again once the backoff expired. A submission failing with a
+// transient error is sent again after a doubled backoff, until it succeeds, the pod is forgotten or stopCh is closed.
+func resubmitWithdrawnTask(fc firmament.Client, podIdentifier PodIdentifier, backoff time.Duration, stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(backoff):
+		}
+		err := submitWithdrawnTask(fc, podIdentifier)
+		if err == nil {
+			return
+		}
+		if !firmament.IsTransient(err) {
+			// The task stays withdrawn, it fails again if it is submitted again.
+			glog.Errorf("Resubmitting the task of pod %v failed, giving up: %v", podIdentifier, err)
+			return
+		}
+		if backoff *= 2; backoff > maxBindRetryBackoff {
+			backoff = maxBindRetryBackoff
+		}
+		glog.Errorf("Resubmitting the task of pod %v failed, submitting it again in %v: %v", podIdentifier, backoff, err)
+	}
+}
+
+// submitWithdrawnTask submits the withdrawn task of the pod, it is a no-op if the task is not withdrawn anymore.
+func submitWithdrawnTask(fc firmament.Client, podIdentifier PodIdentifier) error {
+	bindRetryMux.Lock()
+	retry, ok := bindRetries[podIdentifier]
+	bindRetryMux.Unlock()
+	if !ok {
+		return nil
+	}
+	retry.mu.Lock()
+	defer retry.mu.Unlock()
+	if retry.forgotten || !retry.withdrawn {
+		return nil
+	}
+	PodMux.RLock()
+	td, okPod := PodToTD[podIdentifier]
+	var jd *firmament.JobDescriptor
+	okJob := false
+	if okPod {
+		jd, okJob = jobIDToJD[td.GetJobId()]
+	}
+	PodMux.RUnlock()
+	if !okPod || !okJob {
+		// The pod is being deleted, the task stays withdrawn until the deletion forgets it.
+		return nil
+	}
+	if _, err := fc.TaskSubmitted(&firmament.TaskDescription{
+		TaskDescriptor: td,
+		JobDescriptor:  jd,
+	}); err != nil {
+		// The task stays withdrawn until it is submitted again.
+		return err
+	}
+	retry.withdrawn = false
+	return nil
+}
+
+// isTaskWithdrawn checks if the task of the pod is removed from firmament after a failed binding.
+func isTaskWithdrawn(podIdentifier PodIdentifier) bool {
+	bindRetryMux.Lock()
+	retry, ok := bindRetries[podIdentifier]
+	bindRetryMux.Unlock()
+	if !ok {
+		return false
+	}
+	retry.mu.Lock()
+	defer retry.mu.Unlock()
+	return retry.withdrawn
+}
+
+// forgetBindRetries drops the retry state of the pod. It returns true if the task of the pod was
+// withdrawn from firmament, in which case firmament must not be told about the task anymore.
+// It waits for the removal or the submission of the task in flight.
+func forgetBindRetries(podIdentifier PodIdentifier) bool {
+	bindRetryMux.Lock()
+	retry, ok := bindRetries[podIdentifier]
+	delete(bindRetries, podIdentifier)
+	bindRetryMux.Unlock()
+	if !ok {
+		return false
+	}
+	retry.mu.Lock()
+	defer retry.mu.Unlock()
+	retry.forgotten = true
+	return retry.withdrawn
+}
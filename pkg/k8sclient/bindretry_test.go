@@ -0,0 +1,359 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+var podsResource = schema.GroupResource{Resource: "pods"}
+
+func TestIsRetryableBindError(t *testing.T) {
+	var testData = []struct {
+		err      error
+		expected bool
+	}{
+		{err: errors.NewConflict(podsResource, "Pod1", fmt.Errorf("conflict")), expected: true},
+		{err: errors.NewServerTimeout(podsResource, "create", 1), expected: true},
+		{err: errors.NewTimeoutError("timeout", 1), expected: true},
+		{err: errors.NewTooManyRequests("slow down", 1), expected: true},
+		{err: errors.NewInternalError(fmt.Errorf("internal")), expected: true},
+		{err: errors.NewServiceUnavailable("unavailable"), expected: true},
+		{err: fmt.Errorf("connection refused"), expected: true},
+		{err: errors.NewForbidden(podsResource, "Pod1", fmt.Errorf("denied by webhook")), expected: false},
+		{err: errors.NewBadRequest("bad request"), expected: false},
+		{err: errors.NewUnauthorized("unauthorized"), expected: false},
+	}
+
+	for _, data := range testData {
+		if got := isRetryableBindError(data.err); got != data.expected {
+			t.Errorf("error %v: expected retryable %v got %v", data.err, data.expected, got)
+		}
+	}
+}
+
+func TestGetBindRetryBackoff(t *testing.T) {
+	var testData = []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{attempts: 1, expected: time.Second},
+		{attempts: 2, expected: 2 * time.Second},
+		{attempts: 4, expected: 8 * time.Second},
+		{attempts: 7, expected: maxBindRetryBackoff},
+		{attempts: 100, expected: maxBindRetryBackoff},
+	}
+
+	for _, data := range testData {
+		if got := getBindRetryBackoff(time.Second, data.attempts); got != data.expected {
+			t.Errorf("attempts %d: expected %v got %v", data.attempts, data.expected, got)
+		}
+	}
+}
+
+// bindTestObj holds a pending pod known to firmament and a fake clientset recording the bindings.
+type bindTestObj struct {
+	*TestPodWatchObj
+	podIdentifier PodIdentifier
+	bindErrors    []error
+	lock          sync.Mutex
+	boundNodes    []string
+	// stopCh stops the resubmissions of the withdrawn tasks.
+	stopCh chan struct{}
+}
+
+// initializeBindObj creates the task of a pending pod, the bindings of the pod fail with the given
+// errors before they succeed.
+func initializeBindObj(t *testing.T, bindErrors ...error) *bindTestObj {
+	var empty map[string]string
+	testObj := &bindTestObj{TestPodWatchObj: initializePodObj(t), bindErrors: bindErrors, stopCh: make(chan struct{})}
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	pod := BuildPod("Poseidon-Namespace", "Pod-bind", empty, v1.PodPending, "1", "1024", nil, "owner-bind")
+	parsedPod := podWatch.parsePod(pod)
+	jd := podWatch.createNewJob(parsedPod.OwnerRef)
+	jobIDToJD[jd.Uuid] = jd
+	jobNumTasksToRemove[jd.Uuid]++
+	td := podWatch.addTaskToJob(parsedPod, jd.Uuid, jd.Name, 1)
+	PodToTD[parsedPod.Identifier] = td
+	TaskIDToPod[td.GetUid()] = parsedPod.Identifier
+	PodToK8sPodLock.Lock()
+	PodToK8sPod[parsedPod.Identifier] = pod
+	PodToK8sPodLock.Unlock()
+	testObj.podIdentifier = parsedPod.Identifier
+
+	client := fake.NewSimpleClientset(pod)
+	client.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "bindings" {
+			return false, nil, nil
+		}
+		testObj.lock.Lock()
+		defer testObj.lock.Unlock()
+		if len(testObj.bindErrors) > 0 {
+			err := testObj.bindErrors[0]
+			testObj.bindErrors = testObj.bindErrors[1:]
+			return true, nil, err
+		}
+		binding := action.(core.CreateAction).GetObject().(*v1.Binding)
+		testObj.boundNodes = append(testObj.boundNodes, binding.Target.Name)
+		return true, binding, nil
+	})
+	ClientSet = client
+	bindRetryMux = new(sync.Mutex)
+	bindRetries = make(map[PodIdentifier]*bindRetry)
+	lastPodEventsLock = new(sync.Mutex)
+	lastPodEvents = make(map[podEventKey]time.Time)
+	return testObj
+}
+
+func (testObj *bindTestObj) bind(nodeName string) {
+	bindPod(testObj.fc, BindInfo{Name: testObj.podIdentifier.Name, Namespace: testObj.podIdentifier.Namespace, Nodename: nodeName}, testObj.stopCh)
+}
+
+func (testObj *bindTestObj) failedSchedulingRecorded() bool {
+	lastPodEventsLock.Lock()
+	defer lastPodEventsLock.Unlock()
+	_, ok := lastPodEvents[podEventKey{podIdentifier: testObj.podIdentifier, reason: "FailedScheduling"}]
+	return ok
+}
+
+// TestBindPodRetry rejects the first binding of a pod with a conflict, and checks that the task is
+// withdrawn from firmament, resubmitted after the backoff and bound to the node of the new placement.
+func TestBindPodRetry(t *testing.T) {
+	testObj := initializeBindObj(t, errors.NewConflict(podsResource, "Pod-bind", fmt.Errorf("conflict")))
+	defer testObj.mockCtrl.Finish()
+	resubmitted := make(chan struct{})
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil),
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				close(resubmitted)
+			}),
+	)
+
+	testObj.bind("node1")
+	if !isTaskWithdrawn(testObj.podIdentifier) {
+		t.Error("expected the task to be withdrawn from firmament after the failed binding")
+	}
+	select {
+	case <-resubmitted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the task to be resubmitted to firmament after the backoff")
+	}
+	if isTaskWithdrawn(testObj.podIdentifier) {
+		t.Error("expected the task not to be withdrawn once resubmitted")
+	}
+
+	// Firmament places the resubmitted task onto another node.
+	testObj.bind("node2")
+	testObj.lock.Lock()
+	if !reflect.DeepEqual(testObj.boundNodes, []string{"node2"}) {
+		t.Errorf("expected the pod to be bound to node2, got %v", testObj.boundNodes)
+	}
+	testObj.lock.Unlock()
+	bindRetryMux.Lock()
+	if len(bindRetries) != 0 {
+		t.Errorf("expected the retry state to be dropped once the pod is bound, got %v", bindRetries)
+	}
+	bindRetryMux.Unlock()
+	if testObj.failedSchedulingRecorded() {
+		t.Error("expected no FailedScheduling event for a retried binding")
+	}
+}
+
+// TestBindPodPermanentFailure checks that the task of a pod whose binding is forbidden is withdrawn
+// from firmament and not resubmitted, and that the deletion of the pod is not forwarded to firmament.
+func TestBindPodPermanentFailure(t *testing.T) {
+	testObj := initializeBindObj(t, errors.NewForbidden(podsResource, "Pod-bind", fmt.Errorf("denied by webhook")))
+	defer testObj.mockCtrl.Finish()
+	testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+		&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil)
+
+	testObj.bind("node1")
+	if !testObj.failedSchedulingRecorded() {
+		t.Error("expected a FailedScheduling event for the forbidden binding")
+	}
+	if !isTaskWithdrawn(testObj.podIdentifier) {
+		t.Error("expected the task to stay withdrawn from firmament")
+	}
+	if !forgetBindRetries(testObj.podIdentifier) {
+		t.Error("expected the deletion of the pod not to be forwarded to firmament")
+	}
+}
+
+// TestHandleBindFailureMaxAttempts checks that the task is not resubmitted anymore once the
+// maximum number of bindings was attempted.
+func TestHandleBindFailureMaxAttempts(t *testing.T) {
+	conflict := errors.NewConflict(podsResource, "Pod-bind", fmt.Errorf("conflict"))
+	testObj := initializeBindObj(t)
+	defer testObj.mockCtrl.Finish()
+	resubmitted := make(chan struct{})
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil),
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				close(resubmitted)
+			}),
+		testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil),
+	)
+
+	if !handleBindFailure(testObj.fc, testObj.podIdentifier, conflict, 2, 10*time.Millisecond, testObj.stopCh) {
+		t.Error("expected the first failed binding to be retried")
+	}
+	select {
+	case <-resubmitted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the task to be resubmitted to firmament after the backoff")
+	}
+	if handleBindFailure(testObj.fc, testObj.podIdentifier, conflict, 2, 10*time.Millisecond, testObj.stopCh) {
+		t.Error("expected the binding not to be retried after 2 attempts")
+	}
+	// Let a wrongly scheduled resubmission fail the test.
+	time.Sleep(50 * time.Millisecond)
+}
+
+// TestHandleBindFailureRemovalFailed checks that the task is not marked as withdrawn, and the binding not retried,
+// if firmament fails to remove it.
+func TestHandleBindFailureRemovalFailed(t *testing.T) {
+	conflict := errors.NewConflict(podsResource, "Pod-bind", fmt.Errorf("conflict"))
+	testObj := initializeBindObj(t)
+	defer testObj.mockCtrl.Finish()
+	testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(nil, timeoutError)
+
+	if handleBindFailure(testObj.fc, testObj.podIdentifier, conflict, 2, 10*time.Millisecond, testObj.stopCh) {
+		t.Error("expected the binding not to be retried once the removal of its task failed")
+	}
+	if isTaskWithdrawn(testObj.podIdentifier) {
+		t.Error("expected the task not to be withdrawn once its removal failed")
+	}
+}
+
+// TestResubmitWithdrawnTask checks that a resubmission failing with a transient error is sent again after a
+// backoff, and that the resubmissions stop once the stop channel is closed.
+func TestResubmitWithdrawnTask(t *testing.T) {
+	conflict := errors.NewConflict(podsResource, "Pod-bind", fmt.Errorf("conflict"))
+	testObj := initializeBindObj(t)
+	defer testObj.mockCtrl.Finish()
+	resubmitted := make(chan struct{})
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil),
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(nil, timeoutError),
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				close(resubmitted)
+			}),
+		testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil),
+	)
+
+	if !handleBindFailure(testObj.fc, testObj.podIdentifier, conflict, 3, 10*time.Millisecond, testObj.stopCh) {
+		t.Fatal("expected the failed binding to be retried")
+	}
+	select {
+	case <-resubmitted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the task to be resubmitted again after the failed resubmission")
+	}
+	if isTaskWithdrawn(testObj.podIdentifier) {
+		t.Error("expected the task not to be withdrawn once resubmitted")
+	}
+
+	// No resubmission is sent once the stop channel is closed.
+	close(testObj.stopCh)
+	if !handleBindFailure(testObj.fc, testObj.podIdentifier, conflict, 3, 10*time.Millisecond, testObj.stopCh) {
+		t.Fatal("expected the second failed binding to be retried")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !isTaskWithdrawn(testObj.podIdentifier) {
+		t.Error("expected the task to stay withdrawn once the resubmissions are stopped")
+	}
+}
+
+// TestBindPodTaskIDAnnotation binds a pod whose first update conflicts with another writer, and checks that the
+// pod is annotated with the ID of its task once bound.
+func TestBindPodTaskIDAnnotation(t *testing.T) {
+	testObj := initializeBindObj(t)
+	defer testObj.mockCtrl.Finish()
+	defer func() { annotateTaskID = config.GetAnnotateTaskID }()
+	annotateTaskID = func() bool { return true }
+	conflicts := 1
+	ClientSet.(*fake.Clientset).PrependReactor("update", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if conflicts == 0 {
+			return false, nil, nil
+		}
+		conflicts--
+		return true, nil, errors.NewConflict(podsResource, "Pod-bind", fmt.Errorf("the object has been modified"))
+	})
+
+	testObj.bind("node1")
+	if conflicts != 0 {
+		t.Fatal("expected the annotation to be written after the conflict")
+	}
+	pod, err := ClientSet.CoreV1().Pods(testObj.podIdentifier.Namespace).Get(testObj.podIdentifier.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get the bound pod: %v", err)
+	}
+	PodMux.RLock()
+	expected := strconv.FormatUint(PodToTD[testObj.podIdentifier].GetUid(), 10)
+	PodMux.RUnlock()
+	if taskID := pod.Annotations[TaskIDAnnotation]; taskID != expected {
+		t.Errorf("expected the pod to be annotated with task ID %s, got %q", expected, taskID)
+	}
+}
+
+// TestBindPodToNodeDrain stops the binding worker while bindings are queued, they must be bound before it returns.
+func TestBindPodToNodeDrain(t *testing.T) {
+	testObj := initializeBindObj(t)
+	defer testObj.mockCtrl.Finish()
+	drainBinds()
+	BindChannel <- BindInfo{Name: testObj.podIdentifier.Name, Namespace: testObj.podIdentifier.Namespace, Nodename: "node1"}
+	BindChannel <- BindInfo{Name: "Pod-deleted", Namespace: testObj.podIdentifier.Namespace, Nodename: "node2"}
+	stopCh := make(chan struct{})
+	close(stopCh)
+
+	BindPodToNode(testObj.fc, stopCh)
+	if len(BindChannel) != 0 {
+		t.Errorf("expected the BindChannel to be drained, %d bindings left", len(BindChannel))
+	}
+	testObj.lock.Lock()
+	defer testObj.lock.Unlock()
+	if len(testObj.boundNodes) != 1 || testObj.boundNodes[0] != "node1" {
+		t.Errorf("expected the queued pod to be bound to node1, got %v", testObj.boundNodes)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+)
+
+// UnscheduledMux is used to guard access to the unscheduled tasks.
+var UnscheduledMux *sync.Mutex
+
+// unscheduledTasks holds the tasks firmament could not place in the last scheduling round.
+var unscheduledTasks map[uint64]struct{}
+
+// capacitySignalPending is set while the scheduling round requested by a capacity change is debounced.
+var capacitySignalPending bool
+
+// recordUnscheduledTasks replaces the unscheduled tasks with the tasks reported by the last scheduling round.
+func recordUnscheduledTasks(taskIDs []uint64) {
+	UnscheduledMux.Lock()
+	defer UnscheduledMux.Unlock()
+	unscheduledTasks = make(map[uint64]struct{}, len(taskIDs))
+	for _, taskID := range taskIDs {
+		unscheduledTasks[taskID] = struct{}{}
+	}
+}
+
+// forgetUnscheduledTask drops the task of a pod which left poseidon. It returns true if the task was unscheduled.
+func forgetUnscheduledTask(taskID uint64) bool {
+	UnscheduledMux.Lock()
+	defer UnscheduledMux.Unlock()
+	_, ok := unscheduledTasks[taskID]
+	delete(unscheduledTasks, taskID)
+	return ok
+}
+
+// releaseTaskCapacity signals the capacity released by the task of a pod which left poseidon.
+// Unscheduled tasks did not hold any capacity.
+func releaseTaskCapacity(td *firmament.TaskDescriptor) {
+	if forgetUnscheduledTask(td.GetUid()) {
+		return
+	}
+	SignalCapacityChange(td.GetResourceRequest())
+}
+
+// SignalCapacityChange triggers a scheduling round if the given resources, made available by an added node
+// or a released pod, fit one of the unscheduled tasks. The signals received within the capacity change
+// debounce window are merged into a single scheduling round.
+func SignalCapacityChange(available *firmament.ResourceVector) {
+	UnscheduledMux.Lock()
+	if capacitySignalPending || len(unscheduledTasks) == 0 {
+		UnscheduledMux.Unlock()
+		return
+	}
+	taskIDs := make([]uint64, 0, len(unscheduledTasks))
+	for taskID := range unscheduledTasks {
+		taskIDs = append(taskIDs, taskID)
+	}
+	UnscheduledMux.Unlock()
+	if !fitsUnscheduledTask(taskIDs, available) {
+		return
+	}
+
+	UnscheduledMux.Lock()
+	defer UnscheduledMux.Unlock()
+	if capacitySignalPending {
+		return
+	}
+	capacitySignalPending = true
+	time.AfterFunc(time.Duration(config.GetCapacityChangeDebounce())*time.Millisecond, func() {
+		UnscheduledMux.Lock()
+		capacitySignalPending = false
+		UnscheduledMux.Unlock()
+		glog.V(2).Info("Capacity changed for unscheduled tasks, triggering a scheduling round")
+		TriggerSchedule()
+	})
+}
+
+// fitsUnscheduledTask checks if the resources fit the request of one of the tasks.
+func fitsUnscheduledTask(taskIDs []uint64, available *firmament.ResourceVector) bool {
+	PodMux.RLock()
+	defer PodMux.RUnlock()
+	for _, taskID := range taskIDs {
+		podIdentifier, ok := TaskIDToPod[taskID]
+		if !ok {
+			continue
+		}
+		request := PodToTD[podIdentifier].GetResourceRequest()
+		if request.GetCpuCores() <= available.GetCpuCores() &&
+			request.GetRamCap() <= available.GetRamCap() &&
+			request.GetEphemeralCap() <= available.GetEphemeralCap() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// drainScheduleTrigger drops the scheduling round requested by the previous tests.
+func drainScheduleTrigger() {
+	select {
+	case <-ScheduleTrigger:
+	default:
+	}
+}
+
+// TestSignalCapacityChange covers a 16Gi pod unscheduled on a cluster of 8Gi nodes. Adding another 8Gi node
+// does not trigger a scheduling round, while the pod is placed within one scheduling round of a 32Gi node being added.
+func TestSignalCapacityChange(t *testing.T) {
+	var empty map[string]string
+	pod := BuildPod("Poseidon-Namespace", "Pod-16Gi", empty, v1.PodPending, "1", "16Gi", nil, "owner-16Gi")
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	ClientSet = fake.NewSimpleClientset(pod)
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, ClientSet, testObj.fc)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc,
+		WithResourceIDFunc(func(node *Node, friendlyName string) string {
+			return friendlyName
+		}))
+	UnscheduledMux = new(sync.Mutex)
+	unscheduledTasks = make(map[uint64]struct{})
+
+	parsedPod := podWatch.parsePod(pod)
+	jd := podWatch.createNewJob(parsedPod.OwnerRef)
+	jobIDToJD[jd.Uuid] = jd
+	jobNumTasksToRemove[jd.Uuid]++
+	td := podWatch.addTaskToJob(parsedPod, jd.Uuid, jd.Name, 1)
+	PodToTD[parsedPod.Identifier] = td
+	TaskIDToPod[td.GetUid()] = parsedPod.Identifier
+
+	addNode := func(name string, mem string) {
+		memQuantity := resource.MustParse(mem)
+		nodeWatch.processNodes(context.Background(), []interface{}{&Node{
+			Hostname:         name,
+			Phase:            NodeAdded,
+			CPUCapacity:      4000,
+			CPUAllocatable:   4000,
+			MemCapacityKb:    memQuantity.MilliValue(),
+			MemAllocatableKb: memQuantity.MilliValue(),
+		}})
+	}
+	testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+		&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil).Times(4)
+	addNode("node-8Gi-0", "8Gi")
+	addNode("node-8Gi-1", "8Gi")
+
+	scheduled := make(chan struct{})
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().Schedule(gomock.Any(), gomock.Any()).Return(
+			&firmament.SchedulingDeltas{UnscheduledTasks: []uint64{td.GetUid()}}, nil).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				close(scheduled)
+			}),
+		testObj.firmamentClient.EXPECT().Schedule(gomock.Any(), gomock.Any()).Return(&firmament.SchedulingDeltas{
+			Deltas: []*firmament.SchedulingDelta{
+				{TaskId: td.GetUid(), ResourceId: "node-32Gi", Type: firmament.SchedulingDelta_PLACE},
+			},
+		}, nil),
+	)
+	// The events of the rounds are done once the loop is stopped.
+	defer syncDeltaEvents()()
+	drainScheduleTrigger()
+	stopCh := make(chan struct{})
+	loopDone := make(chan struct{})
+	go func() {
+		RunSchedulingLoop(testObj.fc, stopCh)
+		close(loopDone)
+	}()
+	// The loop must be gone before the next test resets the state it reads.
+	defer func() {
+		close(stopCh)
+		<-loopDone
+	}()
+	<-scheduled
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		UnscheduledMux.Lock()
+		_, ok := unscheduledTasks[td.GetUid()]
+		UnscheduledMux.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the task to be recorded as unscheduled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The pod does not fit another 8Gi node.
+	addNode("node-8Gi-2", "8Gi")
+	select {
+	case bindInfo := <-BindChannel:
+		t.Fatalf("expected no scheduling round for a node the pod does not fit, got %v", bindInfo)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// The scheduling interval is much longer than the wait, the pod is placed by the triggered round.
+	addNode("node-32Gi", "32Gi")
+	select {
+	case bindInfo := <-BindChannel:
+		if bindInfo.Name != pod.Name || bindInfo.Nodename != "node-32Gi" {
+			t.Errorf("expected pod %s to be bound to node-32Gi, got %v", pod.Name, bindInfo)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the pod to be placed once the 32Gi node is added")
+	}
+}
+
+// TestReleaseTaskCapacity checks that the release of a placed task signals the capacity change while the
+// release of an unscheduled task does not.
+func TestReleaseTaskCapacity(t *testing.T) {
+	PodMux = new(sync.RWMutex)
+	UnscheduledMux = new(sync.Mutex)
+	podIdentifier := PodIdentifier{Name: "Pod-unscheduled", Namespace: "Poseidon-Namespace"}
+	unscheduledTD := &firmament.TaskDescriptor{Uid: 1, ResourceRequest: &firmament.ResourceVector{CpuCores: 1000, RamCap: 1024}}
+	PodToTD = map[PodIdentifier]*firmament.TaskDescriptor{podIdentifier: unscheduledTD}
+	TaskIDToPod = map[uint64]PodIdentifier{1: podIdentifier}
+	unscheduledTasks = map[uint64]struct{}{1: {}}
+	capacitySignalPending = false
+	drainScheduleTrigger()
+
+	var testData = []struct {
+		td        *firmament.TaskDescriptor
+		triggered bool
+	}{
+		// The released task is not large enough for the unscheduled task.
+		{td: &firmament.TaskDescriptor{Uid: 2, ResourceRequest: &firmament.ResourceVector{CpuCores: 500, RamCap: 1024}}, triggered: false},
+		{td: &firmament.TaskDescriptor{Uid: 3, ResourceRequest: &firmament.ResourceVector{CpuCores: 2000, RamCap: 2048}}, triggered: true},
+		// The unscheduled task itself did not hold any capacity.
+		{td: unscheduledTD, triggered: false},
+	}
+
+	for _, data := range testData {
+		releaseTaskCapacity(data.td)
+		select {
+		case <-ScheduleTrigger:
+			if !data.triggered {
+				t.Errorf("task %d: expected no scheduling round", data.td.GetUid())
+			}
+		case <-time.After(500 * time.Millisecond):
+			if data.triggered {
+				t.Errorf("task %d: expected a scheduling round", data.td.GetUid())
+			}
+		}
+	}
+	UnscheduledMux.Lock()
+	if len(unscheduledTasks) != 0 {
+		t.Errorf("expected the released unscheduled task to be forgotten, got %v", unscheduledTasks)
+	}
+	UnscheduledMux.Unlock()
+}
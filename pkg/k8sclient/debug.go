@@ -0,0 +1,188 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+)
+
+// RedactedValue replaces the label values of the dumps when they are redacted.
+const RedactedValue = "<redacted>"
+
+// NodeDump is the state of a node known by firmament, as dumped by the debug endpoints.
+type NodeDump struct {
+	Hostname  string                    `json:"hostname"`
+	UUID      string                    `json:"uuid"`
+	Capacity  *firmament.ResourceVector `json:"capacity,omitempty"`
+	Available *firmament.ResourceVector `json:"available,omitempty"`
+	Labels    map[string]string         `json:"labels,omitempty"`
+}
+
+// TaskDump is the state of the task of a pod, as dumped by the debug endpoints. Node is the node the task is
+// placed on, empty while the task is pending.
+type TaskDump struct {
+	Namespace string                    `json:"namespace"`
+	Pod       string                    `json:"pod"`
+	UID       uint64                    `json:"uid"`
+	State     string                    `json:"state"`
+	Request   *firmament.ResourceVector `json:"request,omitempty"`
+	Resource  string                    `json:"resource,omitempty"`
+	Node      string                    `json:"node,omitempty"`
+	Labels    map[string]string         `json:"labels,omitempty"`
+}
+
+// QueueDump is the depth of a work queue by key, as dumped by the debug endpoints. Length is the number of keys
+// queued or under processing.
+type QueueDump struct {
+	Name   string         `json:"name"`
+	Length int            `json:"length"`
+	Depths map[string]int `json:"depths"`
+}
+
+// debugMux is used to guard access to the watchers dumped by DumpQueues.
+var debugMux sync.Mutex
+
+// debugNodeWatcher and debugPodWatcher are the watchers whose work queues are dumped by DumpQueues.
+var (
+	debugNodeWatcher *NodeWatcher
+	debugPodWatcher  *PodWatcher
+)
+
+// setDebugWatchers sets the watchers whose work queues are dumped by DumpQueues.
+func setDebugWatchers(nw *NodeWatcher, pw *PodWatcher) {
+	debugMux.Lock()
+	defer debugMux.Unlock()
+	debugNodeWatcher = nw
+	debugPodWatcher = pw
+}
+
+// DumpNodes returns the nodes known by firmament sorted by hostname, with the label values redacted if redact is
+// set. The nodes are copied under NodeMux, so that the node watcher is not blocked while they are marshaled.
+func DumpNodes(redact bool) []NodeDump {
+	NodeMux.RLock()
+	nodes := make([]NodeDump, 0, len(NodeToRTND))
+	for hostname, rtnd := range NodeToRTND {
+		rd := rtnd.GetResourceDesc()
+		nodes = append(nodes, NodeDump{
+			Hostname:  hostname,
+			UUID:      rd.GetUuid(),
+			Capacity:  copyResourceVector(rd.GetResourceCapacity()),
+			Available: copyResourceVector(rd.GetAvailableResources()),
+			Labels:    dumpLabels(rd.GetLabels(), redact),
+		})
+	}
+	NodeMux.RUnlock()
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Hostname < nodes[j].Hostname })
+	return nodes
+}
+
+// DumpTasks returns the tasks of the pods sorted by namespace and name, with the label values redacted if redact is
+// set. The tasks are copied under PodMux, and their placement is resolved under NodeMux once PodMux is released.
+func DumpTasks(redact bool) []TaskDump {
+	PodMux.RLock()
+	tasks := make([]TaskDump, 0, len(PodToTD))
+	for pod, td := range PodToTD {
+		tasks = append(tasks, TaskDump{
+			Namespace: pod.Namespace,
+			Pod:       pod.Name,
+			UID:       td.GetUid(),
+			State:     td.GetState().String(),
+			Request:   copyResourceVector(td.GetResourceRequest()),
+			Resource:  td.GetScheduledToResource(),
+			Labels:    dumpLabels(td.GetLabels(), redact),
+		})
+	}
+	PodMux.RUnlock()
+	NodeMux.RLock()
+	for i := range tasks {
+		if tasks[i].Resource != "" {
+			tasks[i].Node = ResIDToNode[tasks[i].Resource]
+		}
+	}
+	NodeMux.RUnlock()
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].Namespace != tasks[j].Namespace {
+			return tasks[i].Namespace < tasks[j].Namespace
+		}
+		return tasks[i].Pod < tasks[j].Pod
+	})
+	return tasks
+}
+
+// DumpQueues returns the depths of the work queues of the watchers started by New, "nodes" and "pods", or
+// "pods/<namespace>" when the namespaces have a queue each.
+func DumpQueues() []QueueDump {
+	debugMux.Lock()
+	nw, pw := debugNodeWatcher, debugPodWatcher
+	debugMux.Unlock()
+	queues := []QueueDump{}
+	if nw != nil {
+		queues = append(queues, dumpQueue("nodes", nw.nodeWorkQueue))
+	}
+	if pw != nil {
+		if pw.namespaceQueues == nil {
+			queues = append(queues, dumpQueue("pods", pw.podWorkQueue))
+		}
+		for namespace, queue := range pw.namespaceQueues.all() {
+			queues = append(queues, dumpQueue("pods/"+namespace, queue))
+		}
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Name < queues[j].Name })
+	return queues
+}
+
+func dumpQueue(name string, queue Queue) QueueDump {
+	dump := QueueDump{Name: name, Length: queue.Len(), Depths: make(map[string]int)}
+	for key, depth := range queue.Depths() {
+		dump.Depths[fmt.Sprint(key)] = depth
+	}
+	return dump
+}
+
+func dumpLabels(labels []*firmament.Label, redact bool) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	dump := make(map[string]string, len(labels))
+	for _, label := range labels {
+		dump[label.GetKey()] = label.GetValue()
+		if redact {
+			dump[label.GetKey()] = RedactedValue
+		}
+	}
+	return dump
+}
+
+func copyResourceVector(rv *firmament.ResourceVector) *firmament.ResourceVector {
+	if rv == nil {
+		return nil
+	}
+	return &firmament.ResourceVector{
+		CpuCores:     rv.CpuCores,
+		RamBw:        rv.RamBw,
+		RamCap:       rv.RamCap,
+		DiskBw:       rv.DiskBw,
+		DiskCap:      rv.DiskCap,
+		NetTxBw:      rv.NetTxBw,
+		NetRxBw:      rv.NetRxBw,
+		EphemeralCap: rv.EphemeralCap,
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+)
+
+// populateDebugState replaces the nodes, tasks and resources with a node of two cores and the tasks of two pods, one
+// of which is placed on the core 1 of the node. The returned function restores the previous state.
+func populateDebugState() func() {
+	nodes, tasks, resources := NodeToRTND, PodToTD, ResIDToNode
+	PodMux = new(sync.RWMutex)
+	NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node-a": {ResourceDesc: &firmament.ResourceDescriptor{
+			Uuid:               "node-a-uuid",
+			ResourceCapacity:   &firmament.ResourceVector{CpuCores: 2000, RamCap: 4096},
+			AvailableResources: &firmament.ResourceVector{CpuCores: 1500, RamCap: 3072},
+			Labels:             []*firmament.Label{{Key: "zone", Value: "zone-a"}},
+		}},
+	}
+	ResIDToNode = map[string]string{"node-a-uuid": "node-a", "node-a-pu-0": "node-a", "node-a-pu-1": "node-a"}
+	PodToTD = map[PodIdentifier]*firmament.TaskDescriptor{
+		{Namespace: "default", Name: "running"}: {
+			Uid:                 1,
+			State:               firmament.TaskDescriptor_RUNNING,
+			ScheduledToResource: "node-a-pu-1",
+			ResourceRequest:     &firmament.ResourceVector{CpuCores: 500, RamCap: 1024},
+			Labels:              []*firmament.Label{{Key: "app", Value: "web"}},
+		},
+		{Namespace: "default", Name: "pending"}: {
+			Uid:             2,
+			State:           firmament.TaskDescriptor_RUNNABLE,
+			ResourceRequest: &firmament.ResourceVector{CpuCores: 100},
+		},
+	}
+	return func() {
+		NodeToRTND, PodToTD, ResIDToNode = nodes, tasks, resources
+	}
+}
+
+func TestDumpNodes(t *testing.T) {
+	defer populateDebugState()()
+	expected := []NodeDump{{
+		Hostname:  "node-a",
+		UUID:      "node-a-uuid",
+		Capacity:  &firmament.ResourceVector{CpuCores: 2000, RamCap: 4096},
+		Available: &firmament.ResourceVector{CpuCores: 1500, RamCap: 3072},
+		Labels:    map[string]string{"zone": "zone-a"},
+	}}
+	if nodes := DumpNodes(false); !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("expected %+v, got %+v", expected, nodes)
+	}
+	expected[0].Labels = map[string]string{"zone": RedactedValue}
+	if nodes := DumpNodes(true); !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("expected the label values to be redacted %+v, got %+v", expected, nodes)
+	}
+}
+
+func TestDumpTasks(t *testing.T) {
+	defer populateDebugState()()
+	expected := []TaskDump{
+		{Namespace: "default", Pod: "pending", UID: 2, State: "RUNNABLE", Request: &firmament.ResourceVector{CpuCores: 100}},
+		{Namespace: "default", Pod: "running", UID: 1, State: "RUNNING", Request: &firmament.ResourceVector{CpuCores: 500, RamCap: 1024},
+			Resource: "node-a-pu-1", Node: "node-a", Labels: map[string]string{"app": RedactedValue}},
+	}
+	if tasks := DumpTasks(true); !reflect.DeepEqual(tasks, expected) {
+		t.Errorf("expected %+v, got %+v", expected, tasks)
+	}
+	// The dump is a copy, it is not changed by the tasks changed once dumped.
+	tasks := DumpTasks(false)
+	PodToTD[PodIdentifier{Namespace: "default", Name: "running"}].ResourceRequest.CpuCores = 1000
+	if tasks[1].Request.CpuCores != 500 || tasks[1].Labels["app"] != "web" {
+		t.Errorf("expected the dump to hold the unredacted task as dumped, got %+v", tasks[1])
+	}
+}
+
+func TestDumpQueues(t *testing.T) {
+	defer setDebugWatchers(nil, nil)
+	if queues := DumpQueues(); len(queues) != 0 {
+		t.Errorf("expected no queue before the watchers are started, got %+v", queues)
+	}
+	nw := &NodeWatcher{nodeWorkQueue: NewKeyedQueue()}
+	nw.nodeWorkQueue.Add("node-a", nil)
+	nw.nodeWorkQueue.Add("node-a", nil)
+	pw := &PodWatcher{namespaceQueues: newNamespaceQueues()}
+	pw.podQueue("default").Add("default/pod-a", nil)
+	pw.podQueue("team-a").Add("team-a/pod-b", nil)
+	setDebugWatchers(nw, pw)
+
+	expected := []QueueDump{
+		{Name: "nodes", Length: 1, Depths: map[string]int{"node-a": 2}},
+		{Name: "pods/default", Length: 1, Depths: map[string]int{"default/pod-a": 1}},
+		{Name: "pods/team-a", Length: 1, Depths: map[string]int{"team-a/pod-b": 1}},
+	}
+	if queues := DumpQueues(); !reflect.DeepEqual(queues, expected) {
+		t.Errorf("expected %+v, got %+v", expected, queues)
+	}
+
+	pw = &PodWatcher{podWorkQueue: NewKeyedQueue()}
+	setDebugWatchers(nw, pw)
+	expected = []QueueDump{expected[0], {Name: "pods", Depths: map[string]int{}}}
+	if queues := DumpQueues(); !reflect.DeepEqual(queues, expected) {
+		t.Errorf("expected %+v, got %+v", expected, queues)
+	}
+}
@@ -27,8 +27,22 @@ import (
 	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/api/legacyscheme"
 	"sync"
+	"time"
 )
 
+// podEventInterval is the minimum interval between two events with the same reason for a pod,
+// so that retries do not spam the event stream of the pod.
+const podEventInterval = 30 * time.Second
+
+type podEventKey struct {
+	podIdentifier PodIdentifier
+	reason        string
+}
+
+// lastPodEvents stores when an event of each reason was last recorded for a pod.
+var lastPodEvents map[podEventKey]time.Time
+var lastPodEventsLock *sync.Mutex
+
 type PodEvents struct {
 	Recorder    record.EventRecorder
 	BroadCaster record.EventBroadcaster
@@ -96,8 +110,10 @@ func (posiedonEvents *PoseidonEvents) ProcessEvents(deltas *firmament.Scheduling
 	}
 }
 
-// ProcessFailureEvents The failed/unscheduled task events are sent only once
+// ProcessFailureEvents The failed/unscheduled task events are sent only once, once the task stayed
+// unplaced for the unschedulable timeout. The PodScheduled condition of the pod is set to Unschedulable.
 func (posiedonEvents *PoseidonEvents) ProcessFailureEvents(unscheduledTasks []uint64) {
+	now := time.Now()
 	//get the pod name from the unscheduled_tasks id
 	for _, taskId := range unscheduledTasks {
 		PodMux.RLock()
@@ -107,29 +123,42 @@ func (posiedonEvents *PoseidonEvents) ProcessFailureEvents(unscheduledTasks []ui
 			glog.Error("Task id to Pod mapping not found ", taskId)
 			continue
 		}
+		if !unschedulableTimeoutExpired(taskId, now) {
+			glog.V(2).Info("Unschedulable timeout not expired yet for ", podIdentifier)
+			continue
+		}
 
 		ProcessedPodEventsLock.Lock()
-		if _, ok := ProcessedPodEvents[podIdentifier]; !ok {
-			//update the ProcessedPodEvents map first
-			PodToK8sPodLock.Lock()
-			if poseidonToK8sPod, ok := PodToK8sPod[podIdentifier]; ok {
-				ProcessedPodEvents[podIdentifier] = poseidonToK8sPod
-				// send the failure event and update the pods status
-				posiedonEvents.podEvents.Recorder.Eventf(poseidonToK8sPod, corev1.EventTypeWarning, "FailedScheduling", "Firmament failed to schedule the pod %s in %s namespace", podIdentifier.Name, podIdentifier.Namespace)
-				Update(posiedonEvents.k8sClient, poseidonToK8sPod, &corev1.PodCondition{
-					Type:    corev1.PodScheduled,
-					Status:  corev1.ConditionFalse,
-					Reason:  corev1.PodReasonUnschedulable,
-					Message: "Firmament unable to schedule the pod",
-				})
-			} else {
-				glog.Error("k8s pod mapping for ", podIdentifier, " pod not found ")
-			}
-			PodToK8sPodLock.Unlock()
-		} else {
+		if _, ok := ProcessedPodEvents[podIdentifier]; ok {
+			ProcessedPodEventsLock.Unlock()
 			glog.V(2).Info("For ", podIdentifier, " already failure/unscheduled events sent")
+			continue
 		}
+		//update the ProcessedPodEvents map first
+		PodToK8sPodLock.Lock()
+		poseidonToK8sPod, ok := PodToK8sPod[podIdentifier]
+		if ok {
+			ProcessedPodEvents[podIdentifier] = poseidonToK8sPod
+		}
+		PodToK8sPodLock.Unlock()
 		ProcessedPodEventsLock.Unlock()
+		if !ok {
+			glog.Error("k8s pod mapping for ", podIdentifier, " pod not found ")
+			continue
+		}
+
+		// send the failure event and update the pods status
+		message := getUnschedulableMessage(podIdentifier)
+		posiedonEvents.podEvents.Recorder.Eventf(poseidonToK8sPod, corev1.EventTypeWarning, "FailedScheduling", "Firmament failed to schedule the pod: %s", message)
+		err := updatePodCondition(posiedonEvents.k8sClient, podIdentifier, &corev1.PodCondition{
+			Type:    corev1.PodScheduled,
+			Status:  corev1.ConditionFalse,
+			Reason:  corev1.PodReasonUnschedulable,
+			Message: message,
+		})
+		if err != nil {
+			glog.Errorf("Could not set the unschedulable condition of pod %v, err: %v", podIdentifier, err)
+		}
 	}
 }
 
@@ -146,29 +175,54 @@ func (posiedonEvents *PoseidonEvents) ProcessSuccessEvents(scheduledTasks []*fir
 				glog.Errorf("Task id %v to Pod mapping not found ", taskId)
 				continue
 			}
-			ProcessedPodEventsLock.Lock()
-			if _, ok := ProcessedPodEvents[podIdentifier]; ok {
-				// we remove this pod from  ProcessedPodEvents if it exists
-				// this should be done when we get a delete on this pod also
-				delete(ProcessedPodEvents, podIdentifier)
-			}
-			ProcessedPodEventsLock.Unlock()
-
 			// Now send the success event
-			PodToK8sPodLock.Lock()
-			if poseidonToK8sPod, ok := PodToK8sPod[podIdentifier]; ok {
-				NodeMux.RLock()
-				nodeName, ok := ResIDToNode[taskId.GetResourceId()]
-				NodeMux.RUnlock()
-				if ok {
-					posiedonEvents.podEvents.Recorder.Eventf(poseidonToK8sPod, corev1.EventTypeNormal, "Scheduled", "Successfully assigned %v/%v to %v", podIdentifier.Namespace, podIdentifier.Name, nodeName)
-				} else {
-					glog.Error("Node not found in Node to Resource Id mapping", taskId.GetResourceId())
-				}
+			NodeMux.RLock()
+			nodeName, ok := ResIDToNode[taskId.GetResourceId()]
+			NodeMux.RUnlock()
+			if ok {
+				posiedonEvents.RecordPodEvent(podIdentifier, corev1.EventTypeNormal, "Scheduled", "Successfully assigned %v/%v to %v", podIdentifier.Namespace, podIdentifier.Name, nodeName)
 			} else {
-				glog.Error("Pod mapping not found in PodToK8sPod map for Pod ", podIdentifier)
+				glog.Error("Node not found in Node to Resource Id mapping", taskId.GetResourceId())
 			}
-			PodToK8sPodLock.Unlock()
+		}
+	}
+}
+
+// RecordPodEvent records an event for the pod, unless an event with the same reason was recorded
+// for the pod less than podEventInterval ago.
+func (posiedonEvents *PoseidonEvents) RecordPodEvent(podIdentifier PodIdentifier, eventType, reason, messageFmt string, args ...interface{}) {
+	if !allowPodEvent(podIdentifier, reason, time.Now()) {
+		glog.V(2).Infof("Skipping %s event for pod %v, an event was recorded recently", reason, podIdentifier)
+		return
+	}
+	PodToK8sPodLock.Lock()
+	defer PodToK8sPodLock.Unlock()
+	poseidonToK8sPod, ok := PodToK8sPod[podIdentifier]
+	if !ok {
+		glog.Error("Pod mapping not found in PodToK8sPod map for Pod ", podIdentifier)
+		return
+	}
+	posiedonEvents.podEvents.Recorder.Eventf(poseidonToK8sPod, eventType, reason, messageFmt, args...)
+}
+
+func allowPodEvent(podIdentifier PodIdentifier, reason string, now time.Time) bool {
+	key := podEventKey{podIdentifier: podIdentifier, reason: reason}
+	lastPodEventsLock.Lock()
+	defer lastPodEventsLock.Unlock()
+	if last, ok := lastPodEvents[key]; ok && now.Sub(last) < podEventInterval {
+		return false
+	}
+	lastPodEvents[key] = now
+	return true
+}
+
+// forgetPodEvents drops the rate limiting state of a deleted pod.
+func forgetPodEvents(podIdentifier PodIdentifier) {
+	lastPodEventsLock.Lock()
+	defer lastPodEventsLock.Unlock()
+	for key := range lastPodEvents {
+		if key.podIdentifier == podIdentifier {
+			delete(lastPodEvents, key)
 		}
 	}
 }
@@ -0,0 +1,98 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// TestPoseidonEvents_RecordPodEvent checks that repeated events with the same reason for a pod
+// are rate limited, while events with another reason are still recorded.
+func TestPoseidonEvents_RecordPodEvent(t *testing.T) {
+	podIdentifier := PodIdentifier{Name: "Pod1", Namespace: "Poseidon-Namespace"}
+	PodToK8sPodLock = new(sync.Mutex)
+	PodToK8sPod = map[PodIdentifier]*v1.Pod{
+		podIdentifier: {ObjectMeta: metav1.ObjectMeta{Name: "Pod1", Namespace: "Poseidon-Namespace"}},
+	}
+	lastPodEventsLock = new(sync.Mutex)
+	lastPodEvents = make(map[podEventKey]time.Time)
+	recorder := record.NewFakeRecorder(10)
+	events := &PoseidonEvents{podEvents: &PodEvents{Recorder: recorder}}
+
+	events.RecordPodEvent(podIdentifier, v1.EventTypeWarning, "FailedScheduling", "Binding rejected: %v", "conflict")
+	events.RecordPodEvent(podIdentifier, v1.EventTypeWarning, "FailedScheduling", "Binding rejected: %v", "conflict")
+	events.RecordPodEvent(podIdentifier, v1.EventTypeWarning, "Preempted", "Preempted by firmament, evicting the pod from node %s", "node1")
+	// Pods without a mapping do not get events.
+	events.RecordPodEvent(PodIdentifier{Name: "Pod2", Namespace: "Poseidon-Namespace"}, v1.EventTypeNormal, "Scheduled", "Successfully assigned")
+
+	expected := []string{
+		"Warning FailedScheduling Binding rejected: conflict",
+		"Warning Preempted Preempted by firmament, evicting the pod from node node1",
+	}
+	for _, want := range expected {
+		select {
+		case got := <-recorder.Events:
+			if got != want {
+				t.Errorf("expected event %q got %q", want, got)
+			}
+		default:
+			t.Errorf("expected event %q to be recorded", want)
+		}
+	}
+	select {
+	case got := <-recorder.Events:
+		t.Errorf("unexpected event %q", got)
+	default:
+	}
+
+	// Once the pod is deleted, its events are not rate limited anymore.
+	forgetPodEvents(podIdentifier)
+	events.RecordPodEvent(podIdentifier, v1.EventTypeWarning, "FailedScheduling", "Binding rejected: %v", "conflict")
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected the event to be recorded after the pod events are forgotten, got %d events", len(recorder.Events))
+	}
+}
+
+func TestAllowPodEvent(t *testing.T) {
+	podIdentifier := PodIdentifier{Name: "Pod1", Namespace: "Poseidon-Namespace"}
+	lastPodEventsLock = new(sync.Mutex)
+	lastPodEvents = make(map[podEventKey]time.Time)
+	now := time.Now()
+
+	var testData = []struct {
+		reason   string
+		at       time.Time
+		expected bool
+	}{
+		{reason: "FailedScheduling", at: now, expected: true},
+		{reason: "FailedScheduling", at: now.Add(podEventInterval / 2), expected: false},
+		{reason: "Preempted", at: now.Add(podEventInterval / 2), expected: true},
+		{reason: "FailedScheduling", at: now.Add(podEventInterval), expected: true},
+	}
+
+	for _, data := range testData {
+		if got := allowPodEvent(podIdentifier, data.reason, data.at); got != data.expected {
+			t.Errorf("reason %s at %v: expected %v got %v", data.reason, data.at.Sub(now), data.expected, got)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+)
+
+// replayedTask is a task registered again with the firmament endpoint poseidon fails over to.
+type replayedTask struct {
+	podIdentifier PodIdentifier
+	description   *firmament.TaskDescription
+	// running is set for the tasks whose pods are not pending anymore.
+	running bool
+}
+
+// replayState registers the nodes and the tasks known by poseidon with the firmament endpoint poseidon fails
+// over to, see firmament.FailoverClient. The tasks are submitted, and the tasks of the pods which are bound
+// are updated as running, the same as the running pods recovered by recoverUnknownPod. The changes made while
+// the state is replayed are sent to the unreachable endpoint, their requests time out and are sent again.
+func replayState(fc firmament.Client) error {
+	ctx := context.Background()
+	nodes := replayedNodes()
+	for _, rtnd := range nodes {
+		if err := fc.NodeAdded(ctx, rtnd); err != nil {
+			return err
+		}
+	}
+	tasks := replayedTasks()
+	for _, task := range tasks {
+		if _, err := fc.TaskSubmitted(task.description); err != nil {
+			return err
+		}
+		if !task.running {
+			continue
+		}
+		td := *task.description.TaskDescriptor
+		td.State = firmament.TaskDescriptor_RUNNING
+		reply, err := fc.TaskUpdated(&firmament.TaskDescription{
+			TaskDescriptor: &td,
+			JobDescriptor:  task.description.JobDescriptor,
+		})
+		if err != nil {
+			return err
+		}
+		if reply != firmament.TaskReplyType_TASK_UPDATED_OK {
+			glog.Warningf("Replaying the running task %d of pod %v failed: %v", td.GetUid(), task.podIdentifier, reply)
+		}
+	}
+	glog.Infof("Replayed %d nodes and %d tasks to firmament", len(nodes), len(tasks))
+	return nil
+}
+
+// replayedNodes returns the resource topologies of the nodes sorted by node name.
+func replayedNodes() []*firmament.ResourceTopologyNodeDescriptor {
+	NodeMux.RLock()
+	defer NodeMux.RUnlock()
+	names := make([]string, 0, len(NodeToRTND))
+	for name := range NodeToRTND {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nodes := make([]*firmament.ResourceTopologyNodeDescriptor, 0, len(names))
+	for _, name := range names {
+		nodes = append(nodes, NodeToRTND[name])
+	}
+	return nodes
+}
+
+// replayedTasks returns the tasks of the pods sorted by task ID. The tasks withdrawn after a failed binding
+// are skipped, they are submitted once their backoff expires.
+func replayedTasks() []replayedTask {
+	PodMux.RLock()
+	var tasks []replayedTask
+	for podIdentifier, td := range PodToTD {
+		jd, ok := jobIDToJD[td.GetJobId()]
+		if !ok {
+			glog.Warningf("Job %s of task %d of pod %v is not known, not replaying the task", td.GetJobId(), td.GetUid(), podIdentifier)
+			continue
+		}
+		tasks = append(tasks, replayedTask{
+			podIdentifier: podIdentifier,
+			description:   &firmament.TaskDescription{TaskDescriptor: td, JobDescriptor: jd},
+		})
+	}
+	PodMux.RUnlock()
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].description.TaskDescriptor.GetUid() < tasks[j].description.TaskDescriptor.GetUid()
+	})
+	replayed := tasks[:0]
+	for _, task := range tasks {
+		if isTaskWithdrawn(task.podIdentifier) {
+			continue
+		}
+		task.running = !isPodPending(task.podIdentifier)
+		replayed = append(replayed, task)
+	}
+	return replayed
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament/firmamenttest"
+)
+
+// TestReplayState checks that the nodes and the tasks are replayed to the firmament endpoint
+// poseidon fails over to, with the tasks of the bound pods updated as running.
+func TestReplayState(t *testing.T) {
+	NodeMux = new(sync.RWMutex)
+	PodMux = new(sync.RWMutex)
+	NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node1": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node1-uuid"}},
+		"node0": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node0-uuid"}},
+	}
+	pending := PodIdentifier{Name: "pending", Namespace: "default"}
+	running := PodIdentifier{Name: "running", Namespace: "default"}
+	withdrawn := PodIdentifier{Name: "withdrawn", Namespace: "default"}
+	orphan := PodIdentifier{Name: "orphan", Namespace: "default"}
+	jd := &firmament.JobDescriptor{Uuid: "job"}
+	jobIDToJD = map[string]*firmament.JobDescriptor{"job": jd}
+	PodToTD = map[PodIdentifier]*firmament.TaskDescriptor{
+		running:   {Uid: 1, JobId: "job"},
+		pending:   {Uid: 2, JobId: "job"},
+		withdrawn: {Uid: 3, JobId: "job"},
+		orphan:    {Uid: 4, JobId: "unknown"},
+	}
+	pendingPodsMux = new(sync.Mutex)
+	pendingPods = map[PodIdentifier]pendingPod{pending: {creationTime: time.Now(), observedTime: time.Now()}}
+	bindRetryMux = new(sync.Mutex)
+	bindRetries = map[PodIdentifier]*bindRetry{withdrawn: {attempts: 1, withdrawn: true}}
+	defer func() {
+		pendingPods = make(map[PodIdentifier]pendingPod)
+		bindRetries = make(map[PodIdentifier]*bindRetry)
+	}()
+
+	fc := firmamenttest.NewFakeClient()
+	if err := replayState(fc); err != nil {
+		t.Fatal("unexpected error ", err)
+	}
+	var methods []string
+	var uids []uint64
+	for _, call := range fc.Calls() {
+		methods = append(methods, call.Method)
+		switch request := call.Request.(type) {
+		case *firmament.ResourceTopologyNodeDescriptor:
+			uids = append(uids, 0)
+		case *firmament.TaskDescription:
+			uids = append(uids, request.TaskDescriptor.GetUid())
+		}
+	}
+	expectedMethods := []string{"NodeAdded", "NodeAdded", "TaskSubmitted", "TaskUpdated", "TaskSubmitted"}
+	if !reflect.DeepEqual(methods, expectedMethods) || !reflect.DeepEqual(uids, []uint64{0, 0, 1, 1, 2}) {
+		t.Errorf("expected the requests %v of the tasks %v, got %v of %v", expectedMethods, []uint64{0, 0, 1, 1, 2}, methods, uids)
+	}
+	nodes := fc.Requests("NodeAdded")
+	if len(nodes) == 2 && nodes[0].(*firmament.ResourceTopologyNodeDescriptor).ResourceDesc.Uuid != "node0-uuid" {
+		t.Error("expected the nodes to be replayed sorted by name")
+	}
+	updated := fc.Requests("TaskUpdated")[0].(*firmament.TaskDescription)
+	if updated.TaskDescriptor.State != firmament.TaskDescriptor_RUNNING || updated.JobDescriptor != jd {
+		t.Errorf("expected the task of the bound pod to be updated as running, got %v", updated)
+	}
+	if PodToTD[running].State == firmament.TaskDescriptor_RUNNING {
+		t.Error("expected the task descriptor of poseidon not to be modified")
+	}
+
+	fc = firmamenttest.NewFakeClient()
+	fc.InjectError("TaskSubmitted", timeoutError)
+	if err := replayState(fc); err != timeoutError {
+		t.Errorf("expected the replay to fail with the error of firmament, got %v", err)
+	}
+}
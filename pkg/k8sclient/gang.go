@@ -0,0 +1,196 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// GangNameAnnotation groups the pods of a namespace carrying the same value into a gang.
+	GangNameAnnotation = "poseidon.kubernetes.io/gang-name"
+	// GangSizeAnnotation is the number of pods of the gang which have to be placed before any of them is bound.
+	GangSizeAnnotation = "poseidon.kubernetes.io/gang-size"
+)
+
+// GangMux is used to guard access to the gang registry.
+var GangMux *sync.Mutex
+
+// gangs maps the namespace/gang-name key of a gang to its members.
+var gangs map[string]*gang
+
+// taskIDToGang maps the task ID of a gang member to the key of its gang.
+var taskIDToGang map[uint64]string
+
+// gang tracks the member tasks of a gang and the placements firmament made for them.
+// Placements are held until the whole gang is placed.
+type gang struct {
+	size    int
+	members map[uint64]struct{}
+	// placements holds the placements which are not bound yet.
+	placements map[uint64]BindInfo
+	// bound holds the members whose placements were released to the bind workers.
+	bound map[uint64]struct{}
+	// placedSince is the time the first held placement was made.
+	placedSince time.Time
+}
+
+// getGang returns the namespace/gang-name key and the size of the gang the pod belongs to.
+// An empty key is returned for pods which do not belong to a gang.
+func getGang(pod *v1.Pod) (string, int) {
+	name, ok := pod.Annotations[GangNameAnnotation]
+	if !ok || len(name) == 0 {
+		return "", 0
+	}
+	size, err := strconv.Atoi(pod.Annotations[GangSizeAnnotation])
+	if err != nil || size < 1 {
+		glog.Errorf("Pod %s/%s has an invalid %s annotation %q, scheduling it without its gang", pod.Namespace, pod.Name, GangSizeAnnotation, pod.Annotations[GangSizeAnnotation])
+		return "", 0
+	}
+	return fmt.Sprintf("%s/%s", pod.Namespace, name), size
+}
+
+// getJobOwnerReference returns the seed of the firmament job of the pod. The members of a gang
+// share a single job, the other pods are grouped by their owner.
+func getJobOwnerReference(pod *v1.Pod) string {
+	if gangKey, _ := getGang(pod); len(gangKey) > 0 {
+		return "gang/" + gangKey
+	}
+	return GetOwnerReference(pod)
+}
+
+// registerGangMember adds the task to the gang, the gang is created by its first member.
+func registerGangMember(gangKey string, size int, taskID uint64) {
+	GangMux.Lock()
+	defer GangMux.Unlock()
+	g, ok := gangs[gangKey]
+	if !ok {
+		g = &gang{
+			members:    make(map[uint64]struct{}),
+			placements: make(map[uint64]BindInfo),
+			bound:      make(map[uint64]struct{}),
+		}
+		gangs[gangKey] = g
+	}
+	// The size of the most recently added member wins.
+	g.size = size
+	g.members[taskID] = struct{}{}
+	taskIDToGang[taskID] = gangKey
+}
+
+// removeGangMember drops the task and its held placement from its gang.
+func removeGangMember(taskID uint64) {
+	GangMux.Lock()
+	defer GangMux.Unlock()
+	gangKey, ok := taskIDToGang[taskID]
+	if !ok {
+		return
+	}
+	delete(taskIDToGang, taskID)
+	g := gangs[gangKey]
+	delete(g.members, taskID)
+	delete(g.placements, taskID)
+	delete(g.bound, taskID)
+	if len(g.placements) == 0 {
+		g.placedSince = time.Time{}
+	}
+	if len(g.members) == 0 {
+		delete(gangs, gangKey)
+	}
+}
+
+// QueuePlacement queues the binding of a task placed by firmament. The placements of gang members
+// are held until placements exist for the entire gang, the whole gang is then bound at once.
+func QueuePlacement(taskID uint64, bindInfo BindInfo) {
+	binds := holdGangPlacement(taskID, bindInfo, time.Now())
+	for _, gangBind := range binds {
+		QueueBind(gangBind)
+	}
+}
+
+// holdGangPlacement returns the bindings which can be queued once the task is placed.
+func holdGangPlacement(taskID uint64, bindInfo BindInfo, now time.Time) []BindInfo {
+	GangMux.Lock()
+	defer GangMux.Unlock()
+	gangKey, ok := taskIDToGang[taskID]
+	if !ok {
+		return []BindInfo{bindInfo}
+	}
+	g := gangs[gangKey]
+	if _, ok := g.bound[taskID]; ok {
+		return []BindInfo{bindInfo}
+	}
+	if len(g.placements) == 0 {
+		g.placedSince = now
+	}
+	g.placements[taskID] = bindInfo
+	if len(g.placements)+len(g.bound) < g.size {
+		glog.V(2).Infof("Holding placement of pod %s/%s, %d of %d pods of gang %s are placed", bindInfo.Namespace, bindInfo.Name, len(g.placements)+len(g.bound), g.size, gangKey)
+		return nil
+	}
+	glog.Infof("All %d pods of gang %s are placed, binding the gang", g.size, gangKey)
+	var binds []BindInfo
+	for placedTaskID, placement := range g.placements {
+		binds = append(binds, placement)
+		g.bound[placedTaskID] = struct{}{}
+	}
+	g.placements = make(map[uint64]BindInfo)
+	g.placedSince = time.Time{}
+	return binds
+}
+
+// ReleaseExpiredGangPlacements releases the placements of the gangs which could not be fully placed
+// within the timeout. The tasks are resubmitted to firmament, which frees the resources the partial
+// placements hold and lets firmament place the gang again.
+func ReleaseExpiredGangPlacements(fc firmament.Client, timeout time.Duration) {
+	for _, taskID := range expireGangPlacements(timeout, time.Now()) {
+		PodMux.RLock()
+		podIdentifier, ok := TaskIDToPod[taskID]
+		PodMux.RUnlock()
+		if !ok {
+			continue
+		}
+		ResubmitTask(fc, podIdentifier)
+	}
+}
+
+// expireGangPlacements drops the held placements of the gangs placed partially for longer than
+// the timeout and returns the task IDs of the released placements.
+func expireGangPlacements(timeout time.Duration, now time.Time) []uint64 {
+	GangMux.Lock()
+	defer GangMux.Unlock()
+	var taskIDs []uint64
+	for gangKey, g := range gangs {
+		if len(g.placements) == 0 || now.Sub(g.placedSince) < timeout {
+			continue
+		}
+		glog.Infof("Gang %s was not fully placed within %v, releasing %d of %d placements", gangKey, timeout, len(g.placements), g.size)
+		for taskID := range g.placements {
+			taskIDs = append(taskIDs, taskID)
+		}
+		g.placements = make(map[uint64]BindInfo)
+		g.placedSince = time.Time{}
+	}
+	return taskIDs
+}
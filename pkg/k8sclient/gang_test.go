@@ -0,0 +1,182 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+)
+
+// resetGangs clears the gang registry and registers a gang of the given size with the given tasks.
+func resetGangs(gangKey string, size int, taskIDs ...uint64) {
+	GangMux = new(sync.Mutex)
+	gangs = make(map[string]*gang)
+	taskIDToGang = make(map[uint64]string)
+	for _, taskID := range taskIDs {
+		registerGangMember(gangKey, size, taskID)
+	}
+}
+
+// drainBinds returns the names of the pods queued on the BindChannel.
+func drainBinds() []string {
+	var names []string
+	for {
+		select {
+		case bindInfo := <-BindChannel:
+			names = append(names, bindInfo.Name)
+		default:
+			sort.Strings(names)
+			return names
+		}
+	}
+}
+
+func TestGetGang(t *testing.T) {
+	var testData = []struct {
+		annotations  map[string]string
+		expectedKey  string
+		expectedSize int
+	}{
+		{annotations: nil, expectedKey: "", expectedSize: 0},
+		{annotations: map[string]string{GangSizeAnnotation: "4"}, expectedKey: "", expectedSize: 0},
+		{annotations: map[string]string{GangNameAnnotation: "train"}, expectedKey: "", expectedSize: 0},
+		{annotations: map[string]string{GangNameAnnotation: "train", GangSizeAnnotation: "0"}, expectedKey: "", expectedSize: 0},
+		{annotations: map[string]string{GangNameAnnotation: "train", GangSizeAnnotation: "four"}, expectedKey: "", expectedSize: 0},
+		{annotations: map[string]string{GangNameAnnotation: "train", GangSizeAnnotation: "4"}, expectedKey: "Poseidon-Namespace/train", expectedSize: 4},
+	}
+
+	var empty map[string]string
+	for _, data := range testData {
+		pod := BuildPod("Poseidon-Namespace", "Pod1", empty, v1.PodPending, "1", "1024", nil, "owner-1")
+		pod.Annotations = data.annotations
+		key, size := getGang(pod)
+		if key != data.expectedKey || size != data.expectedSize {
+			t.Errorf("annotations %v: expected (%q, %d) got (%q, %d)", data.annotations, data.expectedKey, data.expectedSize, key, size)
+		}
+	}
+}
+
+// TestGetJobOwnerReference checks that the members of a gang share a job regardless of their owners.
+func TestGetJobOwnerReference(t *testing.T) {
+	var empty map[string]string
+	gangAnnotations := map[string]string{GangNameAnnotation: "train", GangSizeAnnotation: "2"}
+	podOne := BuildPod("Poseidon-Namespace", "Pod1", empty, v1.PodPending, "1", "1024", nil, "owner-1")
+	podOne.Annotations = gangAnnotations
+	podTwo := BuildPod("Poseidon-Namespace", "Pod2", empty, v1.PodPending, "1", "1024", nil, "owner-2")
+	podTwo.Annotations = gangAnnotations
+	otherNamespace := BuildPod("Other-Namespace", "Pod3", empty, v1.PodPending, "1", "1024", nil, "owner-1")
+	otherNamespace.Annotations = gangAnnotations
+	noGang := BuildPod("Poseidon-Namespace", "Pod4", empty, v1.PodPending, "1", "1024", nil, "owner-1")
+
+	if getJobOwnerReference(podOne) != getJobOwnerReference(podTwo) {
+		t.Errorf("expected the gang members to share a job, got %q and %q", getJobOwnerReference(podOne), getJobOwnerReference(podTwo))
+	}
+	if getJobOwnerReference(podOne) == getJobOwnerReference(otherNamespace) {
+		t.Errorf("expected gangs of different namespaces not to share a job, got %q", getJobOwnerReference(podOne))
+	}
+	if getJobOwnerReference(noGang) != GetOwnerReference(noGang) {
+		t.Errorf("expected pods without gang to be grouped by owner %q, got %q", GetOwnerReference(noGang), getJobOwnerReference(noGang))
+	}
+}
+
+// TestQueuePlacement checks that the placements of a gang are held until the entire gang is placed.
+func TestQueuePlacement(t *testing.T) {
+	resetGangs("Poseidon-Namespace/train", 3, 1, 2, 3)
+	drainBinds()
+
+	QueuePlacement(9, BindInfo{Name: "no-gang", Namespace: "Poseidon-Namespace", Nodename: "node1"})
+	if binds := drainBinds(); !reflect.DeepEqual(binds, []string{"no-gang"}) {
+		t.Errorf("expected the pod without gang to be bound right away, got %v", binds)
+	}
+	QueuePlacement(1, BindInfo{Name: "train-1", Namespace: "Poseidon-Namespace", Nodename: "node1"})
+	QueuePlacement(2, BindInfo{Name: "train-2", Namespace: "Poseidon-Namespace", Nodename: "node2"})
+	if binds := drainBinds(); len(binds) > 0 {
+		t.Errorf("expected the placements of the partially placed gang to be held, got %v", binds)
+	}
+	QueuePlacement(3, BindInfo{Name: "train-3", Namespace: "Poseidon-Namespace", Nodename: "node2"})
+	if binds := drainBinds(); !reflect.DeepEqual(binds, []string{"train-1", "train-2", "train-3"}) {
+		t.Errorf("expected the entire gang to be bound, got %v", binds)
+	}
+
+	// A member replacing a deleted member is bound right away since the rest of the gang runs.
+	removeGangMember(3)
+	registerGangMember("Poseidon-Namespace/train", 3, 4)
+	QueuePlacement(4, BindInfo{Name: "train-4", Namespace: "Poseidon-Namespace", Nodename: "node2"})
+	if binds := drainBinds(); !reflect.DeepEqual(binds, []string{"train-4"}) {
+		t.Errorf("expected the replacing member to be bound, got %v", binds)
+	}
+
+	for _, taskID := range []uint64{1, 2, 4} {
+		removeGangMember(taskID)
+	}
+	if len(gangs) != 0 || len(taskIDToGang) != 0 {
+		t.Errorf("expected the gang registry to be empty, got %v and %v", gangs, taskIDToGang)
+	}
+}
+
+func TestExpireGangPlacements(t *testing.T) {
+	resetGangs("Poseidon-Namespace/train", 3, 1, 2, 3)
+	now := time.Now()
+	holdGangPlacement(1, BindInfo{Name: "train-1"}, now)
+	holdGangPlacement(2, BindInfo{Name: "train-2"}, now.Add(30*time.Second))
+
+	if taskIDs := expireGangPlacements(time.Minute, now.Add(50*time.Second)); len(taskIDs) > 0 {
+		t.Errorf("expected no placement to expire before the timeout, got %v", taskIDs)
+	}
+	taskIDs := expireGangPlacements(time.Minute, now.Add(time.Minute))
+	sort.Slice(taskIDs, func(i, j int) bool { return taskIDs[i] < taskIDs[j] })
+	if !reflect.DeepEqual(taskIDs, []uint64{1, 2}) {
+		t.Errorf("expected the placements of tasks 1 and 2 to expire, got %v", taskIDs)
+	}
+	if binds := holdGangPlacement(3, BindInfo{Name: "train-3"}, now.Add(2*time.Minute)); len(binds) > 0 {
+		t.Errorf("expected the released placements not to count towards the gang, got %v", binds)
+	}
+}
+
+// TestReleaseExpiredGangPlacements checks that the tasks of the released placements are resubmitted to firmament.
+func TestReleaseExpiredGangPlacements(t *testing.T) {
+	var empty map[string]string
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	pod := BuildPod("Poseidon-Namespace", "train-1", empty, v1.PodPending, "1", "1024", nil, "owner-1")
+	parsedPod := podWatch.parsePod(pod)
+	jd := podWatch.createNewJob(parsedPod.OwnerRef)
+	jobIDToJD[jd.Uuid] = jd
+	td := podWatch.addTaskToJob(parsedPod, jd.Uuid, jd.Name, 1)
+	PodToTD[parsedPod.Identifier] = td
+	TaskIDToPod[td.GetUid()] = parsedPod.Identifier
+	resetGangs("Poseidon-Namespace/train", 2, td.GetUid(), td.GetUid()+1)
+	holdGangPlacement(td.GetUid(), BindInfo{Name: "train-1"}, time.Now().Add(-time.Minute))
+
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), &firmament.TaskUID{TaskUid: td.GetUid()}).Return(
+			&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil),
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil),
+	)
+	ReleaseExpiredGangPlacements(testObj.fc, 30*time.Second)
+	// The placements are released once.
+	ReleaseExpiredGangPlacements(testObj.fc, 30*time.Second)
+}
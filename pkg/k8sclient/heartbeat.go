@@ -0,0 +1,108 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The loops of workers whose progress is checked by the liveness endpoint.
+const (
+	LoopNodes      = "nodes"
+	LoopPods       = "pods"
+	LoopBinding    = "binding"
+	LoopScheduling = "scheduling"
+)
+
+// heartbeats tracks the progress of the loops, see StalledLoops.
+var heartbeats = newHeartbeatTracker()
+
+// nodeCachesSynced and podCachesSynced are 1 once the caches of the node and the pod informers are synced.
+var nodeCachesSynced, podCachesSynced int32
+
+// heartbeatTracker records when the workers of a loop start and finish their items. A loop is stalled when
+// it holds items in flight and none of them started or finished for a while, e.g. a worker deadlocked on a
+// mutex. An idle loop waiting for items is never stalled.
+type heartbeatTracker struct {
+	mu    sync.Mutex
+	loops map[string]*heartbeat
+	now   func() time.Time
+}
+
+type heartbeat struct {
+	inFlight int
+	lastBeat time.Time
+}
+
+func newHeartbeatTracker() *heartbeatTracker {
+	return &heartbeatTracker{
+		loops: make(map[string]*heartbeat),
+		now:   time.Now,
+	}
+}
+
+// start records that a worker of the loop picked up an item, the returned function records that it is done.
+func (t *heartbeatTracker) start(loop string) func() {
+	t.mu.Lock()
+	beat, ok := t.loops[loop]
+	if !ok {
+		beat = &heartbeat{}
+		t.loops[loop] = beat
+	}
+	beat.inFlight++
+	beat.lastBeat = t.now()
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		beat.inFlight--
+		beat.lastBeat = t.now()
+		t.mu.Unlock()
+	}
+}
+
+// stalled returns the loops, sorted, holding items in flight without a heartbeat for more than timeout, with
+// the time elapsed since their last heartbeat.
+func (t *heartbeatTracker) stalled(timeout time.Duration) ([]string, map[string]time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var loops []string
+	elapsed := make(map[string]time.Duration)
+	for loop, beat := range t.loops {
+		if since := now.Sub(beat.lastBeat); beat.inFlight > 0 && since > timeout {
+			loops = append(loops, loop)
+			elapsed[loop] = since
+		}
+	}
+	sort.Strings(loops)
+	return loops, elapsed
+}
+
+// StalledLoops returns the loops of workers which made no progress on their items for more than timeout, with
+// the time elapsed since their last progress. It is used by the liveness endpoint.
+func StalledLoops(timeout time.Duration) ([]string, map[string]time.Duration) {
+	return heartbeats.stalled(timeout)
+}
+
+// CachesSynced returns whether the caches of the node and the pod informers are synced, it is used by the
+// readiness endpoint.
+func CachesSynced() bool {
+	return atomic.LoadInt32(&nodeCachesSynced) == 1 && atomic.LoadInt32(&podCachesSynced) == 1
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestHeartbeatTracker checks that a loop is stalled only while it holds items in flight without any progress.
+func TestHeartbeatTracker(t *testing.T) {
+	tracker := newHeartbeatTracker()
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+	timeout := time.Minute
+
+	doneNode := tracker.start(LoopNodes)
+	donePods := tracker.start(LoopPods)
+	donePods()
+	now = now.Add(2 * time.Minute)
+	loops, elapsed := tracker.stalled(timeout)
+	if !reflect.DeepEqual(loops, []string{LoopNodes}) || elapsed[LoopNodes] != 2*time.Minute {
+		t.Errorf("stalled() = %v %v, want the nodes loop stalled for 2m", loops, elapsed)
+	}
+
+	// Another item of the loop started meanwhile is progress.
+	doneOther := tracker.start(LoopNodes)
+	if loops, _ := tracker.stalled(timeout); len(loops) != 0 {
+		t.Errorf("stalled() = %v after a new item started, want none", loops)
+	}
+	doneOther()
+	doneNode()
+	now = now.Add(time.Hour)
+	// An idle loop waits for items.
+	if loops, _ := tracker.stalled(timeout); len(loops) != 0 {
+		t.Errorf("stalled() = %v for idle loops, want none", loops)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+)
+
+// HostnameLabel is the node label holding the hostname of the node, it is used to exclude a node from
+// the placements of a task.
+const HostnameLabel = "kubernetes.io/hostname"
+
+// defaultHostIP is the host IP of the host ports which do not set one, it conflicts with every host IP.
+const defaultHostIP = "0.0.0.0"
+
+// HostPort is a host port declared by a container of a pod.
+type HostPort struct {
+	HostIP   string
+	Protocol v1.Protocol
+	Port     int32
+}
+
+// conflicts checks if the host ports can not be used on the same node, following the kube-scheduler rules.
+func (hp HostPort) conflicts(other HostPort) bool {
+	if hp.Port != other.Port || hp.Protocol != other.Protocol {
+		return false
+	}
+	return hp.HostIP == other.HostIP || hp.HostIP == defaultHostIP || other.HostIP == defaultHostIP
+}
+
+// HostPortMux is used to guard access to the host port maps.
+var HostPortMux *sync.Mutex
+
+// nodeToHostPorts maps node name to the host ports used by the pods bound or being bound to the node.
+var nodeToHostPorts map[string]map[PodIdentifier][]HostPort
+
+// podToHostPortNode maps a pod to the node its host ports are reserved on.
+var podToHostPortNode map[PodIdentifier]string
+
+// getHostPorts returns the host ports declared by the containers of the pod.
+func getHostPorts(pod *v1.Pod) []HostPort {
+	var hostPorts []HostPort
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.HostPort <= 0 {
+				continue
+			}
+			hostPort := HostPort{HostIP: port.HostIP, Protocol: port.Protocol, Port: port.HostPort}
+			if len(hostPort.HostIP) == 0 {
+				hostPort.HostIP = defaultHostIP
+			}
+			if len(hostPort.Protocol) == 0 {
+				hostPort.Protocol = v1.ProtocolTCP
+			}
+			hostPorts = append(hostPorts, hostPort)
+		}
+	}
+	return hostPorts
+}
+
+// reserveHostPorts reserves the host ports of the pod on the node. It returns false if one of the host ports
+// conflicts with a host port used by another pod on the node. The host ports a pod reserved on another node,
+// e.g. before its binding failed, are released.
+func reserveHostPorts(podIdentifier PodIdentifier, nodeName string, hostPorts []HostPort) bool {
+	if len(hostPorts) == 0 {
+		return true
+	}
+	HostPortMux.Lock()
+	defer HostPortMux.Unlock()
+	for otherPod, otherHostPorts := range nodeToHostPorts[nodeName] {
+		if otherPod == podIdentifier {
+			continue
+		}
+		for _, hostPort := range hostPorts {
+			for _, otherHostPort := range otherHostPorts {
+				if hostPort.conflicts(otherHostPort) {
+					glog.V(2).Infof("Host port %v of pod %v conflicts with pod %v on node %s", hostPort, podIdentifier, otherPod, nodeName)
+					return false
+				}
+			}
+		}
+	}
+	recordHostPortsLocked(podIdentifier, nodeName, hostPorts)
+	return true
+}
+
+// recordHostPorts records the host ports of a pod already bound to the node, without checking for conflicts.
+func recordHostPorts(podIdentifier PodIdentifier, nodeName string, hostPorts []HostPort) {
+	if len(hostPorts) == 0 {
+		return
+	}
+	HostPortMux.Lock()
+	recordHostPortsLocked(podIdentifier, nodeName, hostPorts)
+	HostPortMux.Unlock()
+}
+
+func recordHostPortsLocked(podIdentifier PodIdentifier, nodeName string, hostPorts []HostPort) {
+	releaseHostPortsLocked(podIdentifier)
+	if _, ok := nodeToHostPorts[nodeName]; !ok {
+		nodeToHostPorts[nodeName] = make(map[PodIdentifier][]HostPort)
+	}
+	nodeToHostPorts[nodeName][podIdentifier] = hostPorts
+	podToHostPortNode[podIdentifier] = nodeName
+}
+
+// releaseHostPorts releases the host ports of a deleted or terminated pod.
+func releaseHostPorts(podIdentifier PodIdentifier) {
+	HostPortMux.Lock()
+	releaseHostPortsLocked(podIdentifier)
+	HostPortMux.Unlock()
+}
+
+func releaseHostPortsLocked(podIdentifier PodIdentifier) {
+	nodeName, ok := podToHostPortNode[podIdentifier]
+	if !ok {
+		return
+	}
+	delete(podToHostPortNode, podIdentifier)
+	delete(nodeToHostPorts[nodeName], podIdentifier)
+	if len(nodeToHostPorts[nodeName]) == 0 {
+		delete(nodeToHostPorts, nodeName)
+	}
+}
+
+// reservePlacementHostPorts reserves the host ports of a placed pod on its node. A placement conflicting
+// with the host ports used on the node is rejected: the node is excluded from the placements of the task
+// and the task is resubmitted, so that firmament picks another node.
+func reservePlacementHostPorts(fc firmament.Client, podIdentifier PodIdentifier, nodeName string) bool {
+	PodToK8sPodLock.Lock()
+	pod, ok := PodToK8sPod[podIdentifier]
+	PodToK8sPodLock.Unlock()
+	if !ok || reserveHostPorts(podIdentifier, nodeName, getHostPorts(pod)) {
+		return true
+	}
+	glog.Infof("Placement of pod %v on node %s conflicts with the host ports used on the node, resubmitting the task", podIdentifier, nodeName)
+	excludeNodeFromTask(podIdentifier, nodeName)
+	ResubmitTask(fc, podIdentifier)
+	return false
+}
+
+// excludeNodeFromTask adds a label selector excluding the node to the task of the pod. The selector
+// is dropped once the task is updated.
+func excludeNodeFromTask(podIdentifier PodIdentifier, nodeName string) {
+	hostname := nodeName
+	NodeMux.RLock()
+	if rtnd, ok := NodeToRTND[nodeName]; ok {
+		for _, label := range rtnd.GetResourceDesc().GetLabels() {
+			if label.GetKey() == HostnameLabel {
+				hostname = label.GetValue()
+			}
+		}
+	}
+	NodeMux.RUnlock()
+	PodMux.Lock()
+	defer PodMux.Unlock()
+	td, ok := PodToTD[podIdentifier]
+	if !ok {
+		return
+	}
+	for _, selector := range td.LabelSelectors {
+		if selector.GetType() == firmament.LabelSelector_NOT_IN_SET && selector.GetKey() == HostnameLabel {
+			selector.Values = append(selector.Values, hostname)
+			return
+		}
+	}
+	td.LabelSelectors = append(td.LabelSelectors, &firmament.LabelSelector{
+		Type:   firmament.LabelSelector_NOT_IN_SET,
+		Key:    HostnameLabel,
+		Values: []string{hostname},
+	})
+}
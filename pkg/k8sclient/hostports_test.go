@@ -0,0 +1,174 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHostPort_conflicts(t *testing.T) {
+	hostPort := HostPort{HostIP: "10.0.0.1", Protocol: v1.ProtocolTCP, Port: 8080}
+
+	var testData = []struct {
+		other    HostPort
+		expected bool
+	}{
+		{other: HostPort{HostIP: "10.0.0.1", Protocol: v1.ProtocolTCP, Port: 8080}, expected: true},
+		// The default host IP conflicts with every host IP.
+		{other: HostPort{HostIP: defaultHostIP, Protocol: v1.ProtocolTCP, Port: 8080}, expected: true},
+		{other: HostPort{HostIP: "10.0.0.2", Protocol: v1.ProtocolTCP, Port: 8080}, expected: false},
+		{other: HostPort{HostIP: "10.0.0.1", Protocol: v1.ProtocolUDP, Port: 8080}, expected: false},
+		{other: HostPort{HostIP: "10.0.0.1", Protocol: v1.ProtocolTCP, Port: 8081}, expected: false},
+	}
+
+	for _, data := range testData {
+		if got := hostPort.conflicts(data.other); got != data.expected {
+			t.Errorf("host port %v with %v: expected %v got %v", hostPort, data.other, data.expected, got)
+		}
+	}
+}
+
+func TestGetHostPorts(t *testing.T) {
+	var empty map[string]string
+	pod := BuildPod("Poseidon-Namespace", "pod", empty, v1.PodPending, "1", "1024", nil, "owner")
+	pod.Spec.Containers[0].Ports = []v1.ContainerPort{
+		{ContainerPort: 80},
+		{ContainerPort: 80, HostPort: 8080},
+		{ContainerPort: 53, HostPort: 53, HostIP: "10.0.0.1", Protocol: v1.ProtocolUDP},
+	}
+	expected := []HostPort{
+		{HostIP: defaultHostIP, Protocol: v1.ProtocolTCP, Port: 8080},
+		{HostIP: "10.0.0.1", Protocol: v1.ProtocolUDP, Port: 53},
+	}
+	if got := getHostPorts(pod); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected host ports %v got %v", expected, got)
+	}
+}
+
+// TestScheduleRoundHostPortConflict places two pods using the same TCP host port and a pod using the port
+// over UDP onto the same node. The second TCP pod is resubmitted without the node and placed onto another node.
+func TestScheduleRoundHostPortConflict(t *testing.T) {
+	var empty map[string]string
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	NodeMux = new(sync.RWMutex)
+	NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node1": {ResourceDesc: &firmament.ResourceDescriptor{Labels: []*firmament.Label{{Key: HostnameLabel, Value: "node1-hostname"}}}},
+		"node2": {ResourceDesc: &firmament.ResourceDescriptor{}},
+	}
+	ResIDToNode = map[string]string{"node1-res-id": "node1", "node2-res-id": "node2"}
+	PodToK8sPod = make(map[PodIdentifier]*v1.Pod)
+	nodeToHostPorts = make(map[string]map[PodIdentifier][]HostPort)
+	podToHostPortNode = make(map[PodIdentifier]string)
+
+	taskIDs := make(map[string]uint64)
+	for i, data := range []struct {
+		name     string
+		protocol v1.Protocol
+	}{
+		{name: "web-1", protocol: v1.ProtocolTCP},
+		{name: "web-2", protocol: v1.ProtocolTCP},
+		{name: "dns", protocol: v1.ProtocolUDP},
+	} {
+		pod := BuildPod("Poseidon-Namespace", data.name, empty, v1.PodPending, "1", "1024", nil, "owner-ports")
+		pod.Spec.Containers[0].Ports = []v1.ContainerPort{{ContainerPort: 8080, HostPort: 8080, Protocol: data.protocol}}
+		parsedPod := podWatch.parsePod(pod)
+		jd := podWatch.createNewJob(parsedPod.OwnerRef)
+		jobIDToJD[jd.Uuid] = jd
+		jobNumTasksToRemove[jd.Uuid]++
+		td := podWatch.addTaskToJob(parsedPod, jd.Uuid, jd.Name, i+1)
+		PodToTD[parsedPod.Identifier] = td
+		TaskIDToPod[td.GetUid()] = parsedPod.Identifier
+		PodToK8sPod[parsedPod.Identifier] = pod
+		taskIDs[data.name] = td.GetUid()
+	}
+	ClientSet = fake.NewSimpleClientset()
+
+	web2 := PodIdentifier{Name: "web-2", Namespace: "Poseidon-Namespace"}
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().Schedule(gomock.Any(), gomock.Any()).Return(&firmament.SchedulingDeltas{
+			Deltas: []*firmament.SchedulingDelta{
+				{TaskId: taskIDs["web-1"], ResourceId: "node1-res-id", Type: firmament.SchedulingDelta_PLACE},
+				{TaskId: taskIDs["web-2"], ResourceId: "node1-res-id", Type: firmament.SchedulingDelta_PLACE},
+				{TaskId: taskIDs["dns"], ResourceId: "node1-res-id", Type: firmament.SchedulingDelta_PLACE},
+			},
+		}, nil),
+		testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), &firmament.TaskUID{TaskUid: taskIDs["web-2"]}).Return(
+			&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil),
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				selectors := arg1.(*firmament.TaskDescription).GetTaskDescriptor().GetLabelSelectors()
+				excluded := selectors[len(selectors)-1]
+				if excluded.GetType() != firmament.LabelSelector_NOT_IN_SET || excluded.GetKey() != HostnameLabel ||
+					!reflect.DeepEqual(excluded.GetValues(), []string{"node1-hostname"}) {
+					t.Errorf("expected node1 to be excluded from the resubmitted task, got %v", excluded)
+				}
+			}),
+		testObj.firmamentClient.EXPECT().Schedule(gomock.Any(), gomock.Any()).Return(&firmament.SchedulingDeltas{
+			Deltas: []*firmament.SchedulingDelta{
+				{TaskId: taskIDs["web-2"], ResourceId: "node2-res-id", Type: firmament.SchedulingDelta_PLACE},
+			},
+		}, nil),
+	)
+
+	receiveBinds := func(n int) []BindInfo {
+		var binds []BindInfo
+		for i := 0; i < n; i++ {
+			select {
+			case bindInfo := <-BindChannel:
+				binds = append(binds, bindInfo)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("expected %d bindings, got %v", n, binds)
+			}
+		}
+		select {
+		case bindInfo := <-BindChannel:
+			t.Fatalf("unexpected binding %v", bindInfo)
+		default:
+		}
+		return binds
+	}
+
+	scheduleRound(testObj.fc)
+	expected := []BindInfo{
+		{Name: "web-1", Namespace: "Poseidon-Namespace", Nodename: "node1"},
+		{Name: "dns", Namespace: "Poseidon-Namespace", Nodename: "node1"},
+	}
+	if got := receiveBinds(2); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected bindings %v got %v", expected, got)
+	}
+	scheduleRound(testObj.fc)
+	expected = []BindInfo{{Name: "web-2", Namespace: "Poseidon-Namespace", Nodename: "node2"}}
+	if got := receiveBinds(1); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected bindings %v got %v", expected, got)
+	}
+	HostPortMux.Lock()
+	defer HostPortMux.Unlock()
+	if podToHostPortNode[web2] != "node2" || len(nodeToHostPorts["node1"]) != 2 {
+		t.Errorf("expected the host ports of web-2 on node2 and of two pods on node1, got %v", nodeToHostPorts)
+	}
+}
@@ -17,27 +17,72 @@ limitations under the License.
 package k8sclient
 
 import (
+	"github.com/kubernetes-sigs/poseidon/pkg/clientconfig"
 	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 
+	"context"
 	"github.com/golang/glog"
 	config2 "github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"strconv"
 	"sync"
 	"time"
 )
 
 var ClientSet kubernetes.Interface
 
-// BindPodToNode call Kubernetes API to place a pod on a node.
-func BindPodToNode() {
+// watcherEvents counts the node and pod changes handled by the watchers.
+var watcherEvents = metrics.NewCounterVec("watcher_events_total", "Total node and pod changes handled by the watchers, by resource and phase", "resource", "phase")
+
+// BindPodToNode call Kubernetes API to place a pod on a node. Once stopCh is closed, it returns after binding the
+// pods queued on the BindChannel so far, so that no pod placed by firmament is left half-scheduled.
+func BindPodToNode(fc firmament.Client, stopCh <-chan struct{}) {
 	for {
-		bindInfo := <-BindChannel
-		err := ClientSet.CoreV1().Pods(bindInfo.Namespace).Bind(&v1.Binding{
+		select {
+		case bindInfo := <-BindChannel:
+			bindQueuedPod(fc, bindInfo, stopCh)
+		case <-stopCh:
+			for {
+				select {
+				case bindInfo := <-BindChannel:
+					bindQueuedPod(fc, bindInfo, stopCh)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// bindQueuedPod binds a pod received on the BindChannel.
+func bindQueuedPod(fc firmament.Client, bindInfo BindInfo, stopCh <-chan struct{}) {
+	done := heartbeats.start(LoopBinding)
+	bindPod(fc, bindInfo, stopCh)
+	done()
+}
+
+// bindPod binds the pod unless it was deleted while the binding was in flight. The task of a pod
+// whose binding failed is withdrawn from firmament and resubmitted after a backoff, until stopCh is closed.
+func bindPod(fc firmament.Client, bindInfo BindInfo, stopCh <-chan struct{}) {
+	podIdentifier := PodIdentifier{Name: bindInfo.Name, Namespace: bindInfo.Namespace}
+	PodMux.RLock()
+	td, ok := PodToTD[podIdentifier]
+	PodMux.RUnlock()
+	if !ok {
+		glog.Infof("Pod %v was deleted before it was bound to node %s, aborting the binding", podIdentifier, bindInfo.Nodename)
+		return
+	}
+	err := selectNodeForClaims(ClientSet, podIdentifier, bindInfo.Nodename)
+	if err == nil {
+		bindStartTime := time.Now()
+		err = ClientSet.CoreV1().Pods(bindInfo.Namespace).Bind(&v1.Binding{
 			TypeMeta: meta_v1.TypeMeta{},
 			ObjectMeta: meta_v1.ObjectMeta{
 				Name: bindInfo.Name,
@@ -46,10 +91,59 @@ func BindPodToNode() {
 				Namespace: bindInfo.Namespace,
 				Name:      bindInfo.Nodename,
 			}})
-		if err != nil {
-			glog.Errorf("Could not bind pod:%s to nodeName:%s, error: %v", bindInfo.Name, bindInfo.Nodename, err)
+		metrics.BindingLatency.Observe(metrics.SinceInMicroseconds(bindStartTime))
+	}
+	if errors.IsNotFound(err) {
+		glog.Infof("Pod %v was deleted while it was bound to node %s", podIdentifier, bindInfo.Nodename)
+		return
+	}
+	if err != nil {
+		glog.Errorf("Could not bind pod:%s to nodeName:%s, error: %v", bindInfo.Name, bindInfo.Nodename, err)
+		metrics.SchedulingAttempts.WithLabelValues(attemptError).Inc()
+		clearNominatedNode(ClientSet, podIdentifier)
+		baseBackoff := time.Duration(config2.GetBindRetryBackoff()) * time.Millisecond
+		if !handleBindFailure(fc, podIdentifier, err, config2.GetBindRetryAttempts(), baseBackoff, stopCh) {
+			NewPoseidonEvents(ClientSet).RecordPodEvent(podIdentifier, v1.EventTypeWarning, "FailedScheduling", "Binding rejected: %v", err)
 		}
+		return
 	}
+	forgetBindRetries(podIdentifier)
+	recordPodBound(podIdentifier)
+	if annotateTaskID() {
+		if err := setTaskIDAnnotation(ClientSet, podIdentifier, td.GetUid()); err != nil {
+			glog.Errorf("Could not annotate pod %v with its task ID %d, err: %v", podIdentifier, td.GetUid(), err)
+		}
+	}
+	clearNominatedNode(ClientSet, podIdentifier)
+	// The pod may have been marked as unschedulable before firmament placed it.
+	clearUnschedulableCondition(ClientSet, podIdentifier)
+}
+
+// TaskIDAnnotation holds the ID of the firmament task of a pod bound by poseidon, see setTaskIDAnnotation.
+const TaskIDAnnotation = "poseidon.kubernetes.io/task-id"
+
+// annotateTaskID reports if the bound pods are annotated with their task ID, it is overridden by the tests.
+var annotateTaskID = config2.GetAnnotateTaskID
+
+// setTaskIDAnnotation annotates the pod with the ID of its firmament task, the kubelet and the controllers may
+// update the pod once bound, the update is retried on conflicts.
+func setTaskIDAnnotation(client kubernetes.Interface, podIdentifier PodIdentifier, taskID uint64) error {
+	value := strconv.FormatUint(taskID, 10)
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		pod, err := client.CoreV1().Pods(podIdentifier.Namespace).Get(podIdentifier.Name, meta_v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pod.Annotations[TaskIDAnnotation] == value {
+			return nil
+		}
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[TaskIDAnnotation] = value
+		_, err = client.CoreV1().Pods(podIdentifier.Namespace).Update(pod)
+		return err
+	})
 }
 
 // DeletePod calls Kubernetes API to delete a Pod by its namespace and name.
@@ -60,43 +154,73 @@ func DeletePod(podName string, namespace string) {
 	}
 }
 
-// GetClientConfig returns a kubeconfig object which to be passed to a Kubernetes client on initialization.
+// GetClientConfig returns the config of the API server client with the QPS and the burst of the flags, the config is
+// resolved by clientconfig.Load from the in-cluster service account or the kubeconfig file.
 func GetClientConfig(kubeconfig string) (*rest.Config, error) {
-	if kubeconfig != "" {
-		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	restConfig, err := clientconfig.Load(kubeconfig)
+	if err != nil {
+		return nil, err
 	}
-	return rest.InClusterConfig()
+	restConfig.QPS = config2.GetQPS()
+	restConfig.Burst = config2.GetBurst()
+	return restConfig, nil
 }
 
-// New initializes a firmament and Kubernetes client and starts watching Pod and Node.
-func New(schedulerName string, kubeConfig string, kubeVersionMajor, kubeVersionMinor int, firmamentAddress string) {
+// New initializes a Kubernetes client and starts watching Pod and Node until stopCh is closed, it returns once
+// the watchers drained their queues. The state of poseidon is replayed to the firmament endpoints the firmament
+// client fails over to. The node watcher is configured by the flags and the options, e.g. WithNodeEventRecorder.
+func New(schedulerNames []string, kubeConfig string, kubeVersionMajor, kubeVersionMinor int, firmamentClient *firmament.FailoverClient, stopCh <-chan struct{}, opts ...NodeWatcherOption) {
 
 	config, err := GetClientConfig(kubeConfig)
 	if err != nil {
 		glog.Fatalf("Failed to load client config: %v", err)
 	}
-	//
-
-	config.QPS = config2.GetQPS()
-	config.Burst = config2.GetBurst()
 
 	ClientSet, err = kubernetes.NewForConfig(config)
 	if err != nil {
 		glog.Fatalf("Failed to create connection: %v", err)
 	}
-	fc, conn, err := firmament.New(firmamentAddress)
-	if err != nil {
-		glog.Fatalf("Failed to connect to Firmament: %v", err)
-	}
-	defer conn.Close()
+	fc := firmament.NewClient(firmamentClient)
+	firmamentClient.OnFailover(replayState)
 	glog.Info("k8s newclient called")
-	stopCh := make(chan struct{})
-	go NewPodWatcher(kubeVersionMajor, kubeVersionMinor, schedulerName, ClientSet, fc).Run(stopCh, 10)
-	go NewNodeWatcher(ClientSet, fc).Run(stopCh, 10)
-	go NewK8sPodWatcher(kubeVersionMajor, kubeVersionMinor, schedulerName, ClientSet, fc).controller.Run(stopCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var running sync.WaitGroup
+	running.Add(2)
+	podWatcher := NewPodWatcher(kubeVersionMajor, kubeVersionMinor, schedulerNames, ClientSet, fc)
+	go func() {
+		defer running.Done()
+		if err := podWatcher.Run(ctx, podWatcher.cfg.Workers); err != nil {
+			glog.Fatalf("Failed to run the pod watcher: %v", err)
+		}
+	}()
+	nodeWatcherConfig := DefaultNodeWatcherConfig()
+	nodeWatcherOpts := []NodeWatcherOption{WithNodeWatcherConfig(nodeWatcherConfig)}
+	if config2.GetNodeResourceTopology() {
+		nodeWatcherOpts = append(nodeWatcherOpts, WithNodeTopologyFunc(NewNodeResourceTopologyFunc(ClientSet.Discovery().RESTClient())))
+	}
+	nodeWatcherOpts = append(nodeWatcherOpts, opts...)
+	nodeWatcher := NewNodeWatcher(ClientSet, fc, nodeWatcherOpts...)
+	setResyncNodeWatcher(nodeWatcher)
+	setReadyWatchers(nodeWatcher)
+	setDebugWatchers(nodeWatcher, podWatcher)
+	go func() {
+		defer running.Done()
+		if err := nodeWatcher.Run(ctx, nodeWatcherConfig.Workers); err != nil {
+			glog.Fatalf("Failed to run the node watcher: %v", err)
+		}
+	}()
+	go NewK8sPodWatcher(kubeVersionMajor, kubeVersionMinor, schedulerNames, ClientSet, fc).controller.Run(stopCh)
 
-	// We block here.
-	<-stopCh
+	// We block here until the watchers drained their queues.
+	running.Wait()
 }
 
 func init() {
@@ -107,15 +231,45 @@ func init() {
 	ProcessedPodEventsLock = new(sync.Mutex)
 	PodToK8sPod = make(map[PodIdentifier]*v1.Pod)
 	ProcessedPodEvents = make(map[PodIdentifier]*v1.Pod)
+	lastPodEventsLock = new(sync.Mutex)
+	lastPodEvents = make(map[podEventKey]time.Time)
+	PreemptionMux = new(sync.Mutex)
+	EvictedTasks = make(map[uint64]string)
+	nodeToVictims = make(map[string]map[PodIdentifier]uint64)
+	nodeToDeferredBinds = make(map[string][]BindInfo)
+	nominatedPods = make(map[PodIdentifier]string)
+	VolumeMux = new(sync.Mutex)
+	claimToWaitingPods = make(map[string]map[PodIdentifier]*v1.Pod)
+	podToDelayedClaims = make(map[PodIdentifier][]string)
+	GangMux = new(sync.Mutex)
+	gangs = make(map[string]*gang)
+	taskIDToGang = make(map[uint64]string)
+	ScheduleTrigger = make(chan struct{}, 1)
+	UnscheduledMux = new(sync.Mutex)
+	unscheduledTasks = make(map[uint64]struct{})
+	bindRetryMux = new(sync.Mutex)
+	bindRetries = make(map[PodIdentifier]*bindRetry)
+	preassignedPods = make(map[PodIdentifier]*preassignedPod)
+	HostPortMux = new(sync.Mutex)
+	nodeToHostPorts = make(map[string]map[PodIdentifier][]HostPort)
+	podToHostPortNode = make(map[PodIdentifier]string)
+	pendingPodsMux = new(sync.Mutex)
+	pendingPods = make(map[PodIdentifier]pendingPod)
 }
 
-// Run starts a pod watcher.
-func BindPodWorkers(stopCh <-chan struct{}, nWorkers int) {
-
+// BindPodWorkers runs nWorkers workers binding the pods read from the BindChannel, so that at most nWorkers pods are
+// bound at once, until stopCh is closed. It returns once they bound the queued pods.
+func BindPodWorkers(fc firmament.Client, stopCh <-chan struct{}, nWorkers int) {
+	var running sync.WaitGroup
+	running.Add(nWorkers)
 	for i := 0; i < nWorkers; i++ {
-		go wait.Until(BindPodToNode, time.Second, stopCh)
+		go func() {
+			defer running.Done()
+			wait.Until(func() { BindPodToNode(fc, stopCh) }, time.Second, stopCh)
+		}()
 	}
 
 	<-stopCh
-	glog.Info("Stopping RunBindPods")
+	glog.Infof("Stopping RunBindPods, binding %d queued pods", len(BindChannel))
+	running.Wait()
 }
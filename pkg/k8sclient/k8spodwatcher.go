@@ -19,6 +19,7 @@ package k8sclient
 import (
 	"github.com/golang/glog"
 	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"strings"
 	"time"
 
 	"k8s.io/api/core/v1"
@@ -32,22 +33,25 @@ import (
 )
 
 // NewK8sPodWatcher initialize a PodWatcher.
-func NewK8sPodWatcher(kubeVerMajor, kubeVerMinor int, schedulerName string, client kubernetes.Interface, fc firmament.FirmamentSchedulerClient) *K8sPodWatcher {
+func NewK8sPodWatcher(kubeVerMajor, kubeVerMinor int, schedulerNames []string, client kubernetes.Interface, fc firmament.Client) *K8sPodWatcher {
 	glog.V(2).Info("Starting K8sPodWatcher...")
 	podWatcher := &K8sPodWatcher{
 		clientset: client,
 		fc:        fc,
 		K8sPods:   make(map[string]*firmament.TaskInfo),
 	}
-	schedulerSelector := fields.Everything()
-	schedulerSelector = fields.ParseSelectorOrDie("spec.schedulerName!=" + schedulerName)
+	var schedulerSelectors []fields.Selector
+	for _, schedulerName := range schedulerNames {
+		schedulerSelectors = append(schedulerSelectors, fields.OneTermNotEqualSelector("spec.schedulerName", schedulerName))
+	}
+	schedulerSelector := fields.AndSelectors(schedulerSelectors...)
 	podSelector := labels.Everything()
 	var err error
-	podSelector, err = labels.Parse("scheduler notin (" + schedulerName + ")")
+	podSelector, err = labels.Parse("scheduler notin (" + strings.Join(schedulerNames, ",") + ")")
 	if err != nil {
 		glog.Fatal("Failed to parse scheduler label selector")
 	}
-	glog.V(2).Info("sch name ", schedulerName, "podSelector", podSelector, "schedulerSelector", schedulerSelector)
+	glog.V(2).Info("sch names ", schedulerNames, "podSelector", podSelector, "schedulerSelector", schedulerSelector)
 	_, controller := cache.NewInformer(
 		&cache.ListWatch{
 			ListFunc: func(alo metav1.ListOptions) (runtime.Object, error) {
@@ -107,22 +111,13 @@ func NodeInfoUpdated() bool {
 }
 
 func (pw *K8sPodWatcher) getCPUMemRequest(pod *v1.Pod) (int64, int64, int64) {
-	cpuReq := int64(0)
-	memReq := int64(0)
-	ephemeralReq := int64(0)
-	for _, container := range pod.Spec.Containers {
-		request := container.Resources.Requests
-		cpuReqQuantity := request[v1.ResourceCPU]
-		cpuReq += cpuReqQuantity.MilliValue()
-		memReqQuantity := request[v1.ResourceMemory]
-		memReqCont, _ := memReqQuantity.AsInt64()
-		memReq += memReqCont
-		ephemeralReqQuantity := request[v1.ResourceEphemeralStorage]
-		ephemeralReqCont, _ := ephemeralReqQuantity.AsInt64()
-		ephemeralReq += ephemeralReqCont
-
-	}
-	return cpuReq, memReq, ephemeralReq
+	request := getPodResourceRequest(pod)
+	cpuReqQuantity := request[v1.ResourceCPU]
+	memReqQuantity := request[v1.ResourceMemory]
+	memReq, _ := memReqQuantity.AsInt64()
+	ephemeralReqQuantity := request[v1.ResourceEphemeralStorage]
+	ephemeralReq, _ := ephemeralReqQuantity.AsInt64()
+	return cpuReqQuantity.MilliValue(), memReq, ephemeralReq
 }
 
 func (pw *K8sPodWatcher) parsePod(pod *v1.Pod) *firmament.TaskInfo {
@@ -213,7 +208,7 @@ func (pw *K8sPodWatcher) enqueuePodAddition(key interface{}, obj interface{}) {
 		if pw.CheckAndUpdateK8sPodMap(addedPod) {
 			// can send the info
 			// this can be for a pod already running/succeeded or newly added and in pending state
-			firmament.AddTaskInfo(pw.fc, addedPod)
+			pw.fc.AddTaskInfo(addedPod)
 			glog.V(2).Info("enqueuePodAddition: AddTaskInfo with TASKINFO_ADD type sent for pod", addedPod.GetTaskName())
 		} else {
 			glog.V(2).Info("ignoring the AddTaskInfo for already existing task in enqueuePodAddition", addedPod.GetTaskName())
@@ -230,13 +225,13 @@ func (pw *K8sPodWatcher) enqueuePodDeletion(key interface{}, obj interface{}) {
 				//check the opType and send it to firmament
 				if pw.CheckOpType(deletePod, firmament.TaskInfoType_TASKINFO_REMOVE) {
 					glog.Info("enqueuePodDeletion: AddTaskInfo with TASKINFO_REMOVE type sent for pod", deletePod.GetTaskName())
-					firmament.AddTaskInfo(pw.fc, deletePod)
+					pw.fc.AddTaskInfo(deletePod)
 					_ = pw.RemoveTaskfromK8sPodMap(deletePod)
 				} else {
 					glog.V(2).Info("OpType for deleting pod is different", deletePod.GetType(), " should be ", firmament.TaskInfoType_TASKINFO_REMOVE)
 					deletePod.Type = firmament.TaskInfoType_TASKINFO_REMOVE
 					glog.Info("enqueuePodDeletion: AddTaskInfo with TASKINFO_REMOVE type sent for pod", deletePod.GetTaskName())
-					firmament.AddTaskInfo(pw.fc, deletePod)
+					pw.fc.AddTaskInfo(deletePod)
 					_ = pw.RemoveTaskfromK8sPodMap(deletePod)
 				}
 			} else {
@@ -259,7 +254,7 @@ func (pw *K8sPodWatcher) enqueuePodUpdate(key, oldObj, newObj interface{}) {
 				if pw.CheckAndUpdateK8sPodMap(addedPod) {
 					// can send the info
 					// this can be for a pod already running/succeeded or newly added and in pending state
-					firmament.AddTaskInfo(pw.fc, addedPod)
+					pw.fc.AddTaskInfo(addedPod)
 					glog.V(2).Info("enqueuePodUpdate: AddTaskInfo with TASKINFO_ADD type sent for pod", addedPod.GetTaskName())
 				} else {
 					glog.V(2).Info("ignoring the AddTaskInfo for already existing task enqueuePodUpdate", addedPod.GetTaskName())
@@ -272,13 +267,13 @@ func (pw *K8sPodWatcher) enqueuePodUpdate(key, oldObj, newObj interface{}) {
 					//check the opType and send it to firmament
 					if pw.CheckOpType(deletePod, firmament.TaskInfoType_TASKINFO_REMOVE) {
 						glog.Info("enqueuePodUpdate: AddTaskInfo with TASKINFO_REMOVE type sent for pod", deletePod.GetTaskName())
-						firmament.AddTaskInfo(pw.fc, deletePod)
+						pw.fc.AddTaskInfo(deletePod)
 						_ = pw.RemoveTaskfromK8sPodMap(deletePod)
 					} else {
 						glog.V(2).Info("OpType for deleting pod is different", deletePod.GetType(), " should be ", firmament.TaskInfoType_TASKINFO_REMOVE)
 						deletePod.Type = firmament.TaskInfoType_TASKINFO_REMOVE
 						glog.Info("enqueuePodUpdate: AddTaskInfo with TASKINFO_REMOVE type sent for pod", deletePod.GetTaskName())
-						firmament.AddTaskInfo(pw.fc, deletePod)
+						pw.fc.AddTaskInfo(deletePod)
 						_ = pw.RemoveTaskfromK8sPodMap(deletePod)
 					}
 				} else {
@@ -17,7 +17,11 @@ limitations under the License.
 package k8sclient
 
 import (
+	"fmt"
 	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
 )
 
 // Queue is an interface which abstracts a queue.
@@ -26,25 +30,121 @@ type Queue interface {
 	Add(key interface{}, item interface{})
 	// Get removes an item from the queue and inserts the item to the currently processing key set.
 	Get() (key interface{}, items []interface{}, shutdown bool)
+	// Requeue enqueues the items of a key under processing ahead of the items added meanwhile.
+	Requeue(key interface{}, items []interface{})
+	// AddRateLimited enqueues the items of a key once the backoff of the key expires, ahead of the items added
+	// meanwhile.
+	AddRateLimited(key interface{}, items ...interface{})
+	// Forget resets the backoff of a key, once its items are processed.
+	Forget(key interface{})
+	// NumRequeues returns the number of times the items of a key were requeued by AddRateLimited.
+	NumRequeues(key interface{}) int
 	// Done removes the item under processing.
 	Done(key interface{})
 	// ShutDown shuts down the queue.
 	ShutDown()
 	// ShuttingDown tests if the queue is shutting down.
 	ShuttingDown() bool
+	// Len returns the number of keys queued, backing off or under processing.
+	Len() int
+	// Depths returns the number of items queued by key, the keys backing off or under processing are included.
+	Depths() map[interface{}]int
 }
 
 type tk interface{}
 
+// QueueRetryPolicy is the backoff of the keys requeued by AddRateLimited. The n-th requeue of a key is delayed by
+// BaseDelay*2^(n-1), capped by MaxDelay. Once a key is requeued more than MaxRetries times in a row its items are
+// handed to the dead letter function and its backoff is reset, the keys are requeued forever if MaxRetries is 0.
+type QueueRetryPolicy struct {
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	MaxRetries int
+}
+
+// DefaultQueueRetryPolicy is the retry policy of the queues created without WithQueueRetryPolicy.
+var DefaultQueueRetryPolicy = QueueRetryPolicy{
+	BaseDelay: 100 * time.Millisecond,
+	MaxDelay:  30 * time.Second,
+}
+
+// Validate returns an error if the delays are negative or inverted, or if the max retries are negative.
+func (p QueueRetryPolicy) Validate() error {
+	if p.BaseDelay < 0 {
+		return fmt.Errorf("invalid retry base delay %v, expected a delay >= 0", p.BaseDelay)
+	}
+	if p.MaxDelay < p.BaseDelay {
+		return fmt.Errorf("invalid retry max delay %v, expected a delay >= the base delay %v", p.MaxDelay, p.BaseDelay)
+	}
+	if p.MaxRetries < 0 {
+		return fmt.Errorf("invalid max retries %d, expected a number >= 0", p.MaxRetries)
+	}
+	return nil
+}
+
+// backoff returns the delay of the n-th requeue of a key.
+func (p QueueRetryPolicy) backoff(requeues int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < requeues && delay < p.MaxDelay; i++ {
+		if delay > p.MaxDelay/2 {
+			// Doubling the delay would exceed the cap, or overflow.
+			return p.MaxDelay
+		}
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// DeadLetterFunc is called with the items of a key once the key exhausted its retries. It is called by the caller
+// of AddRateLimited, outside the lock of the queue.
+type DeadLetterFunc func(key interface{}, items []interface{})
+
+// QueueOption configures a queue created by NewKeyedQueue.
+type QueueOption func(*Type)
+
+// WithQueueRetryPolicy sets the backoff and the max retries of the keys requeued by AddRateLimited.
+func WithQueueRetryPolicy(policy QueueRetryPolicy) QueueOption {
+	return func(q *Type) {
+		q.policy = policy
+	}
+}
+
+// WithDeadLetter sets the function called with the items of the keys which exhausted their retries, the items are
+// dropped if it is not set.
+func WithDeadLetter(deadLetter DeadLetterFunc) QueueOption {
+	return func(q *Type) {
+		q.deadLetter = deadLetter
+	}
+}
+
+// withQueueClock sets the clock of the backoff, used by the tests to fake the time.
+func withQueueClock(c clock.Clock) QueueOption {
+	return func(q *Type) {
+		q.clock = c
+	}
+}
+
 // NewKeyedQueue initializes a queue.
-func NewKeyedQueue() *Type {
-	return &Type{
+func NewKeyedQueue(opts ...QueueOption) *Type {
+	q := &Type{
 		items:        map[tk][]interface{}{},
 		toQueue:      map[tk][]interface{}{},
 		processing:   set{},
+		requeues:     map[tk]int{},
+		waiting:      map[tk]*waitingKey{},
 		shuttingDown: false,
 		cond:         sync.NewCond(&sync.Mutex{}),
+		policy:       DefaultQueueRetryPolicy,
+		clock:        clock.RealClock{},
+		stopCh:       make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
 }
 
 // Type implements the Queue interface.
@@ -57,9 +157,24 @@ type Type struct {
 	toQueue map[tk][]interface{}
 	// Set of keys currently under processing.
 	processing set
+	// Number of times each key was requeued by AddRateLimited since it was last forgotten.
+	requeues map[tk]int
+	// Keys backing off, their items are queued once their timer fires.
+	waiting map[tk]*waitingKey
 	// shuttingDown is the flag representing if the queue is shutting down.
 	shuttingDown bool
 	cond         *sync.Cond
+	policy       QueueRetryPolicy
+	deadLetter   DeadLetterFunc
+	clock        clock.Clock
+	// stopCh stops the timers of the waiting keys on shut down.
+	stopCh chan struct{}
+}
+
+// waitingKey holds the items of a key backing off: the items requeued, then the items added meanwhile.
+type waitingKey struct {
+	retries []interface{}
+	adds    []interface{}
 }
 
 type empty struct{}
@@ -85,6 +200,16 @@ func (q *Type) Add(key interface{}, item interface{}) {
 	if q.shuttingDown {
 		return
 	}
+	if w, ok := q.waiting[key]; ok {
+		// Key is backing off. The item is queued after the items requeued.
+		w.adds = append(w.adds, item)
+		return
+	}
+	q.add(key, item)
+}
+
+// add enqueues the item of a key which is not backing off. q.cond.L must be held.
+func (q *Type) add(key interface{}, item interface{}) {
 	if q.processing.has(key) {
 		// Key is under processing. Can not add it to the queue.
 		q.toQueue[key] = append(q.toQueue[key], item)
@@ -120,6 +245,137 @@ func (q *Type) Get() (key interface{}, items []interface{}, shutdown bool) {
 	return key, items, false
 }
 
+// Requeue enqueues the items of a key under processing ahead of the items added while it is processed,
+// e.g. the items which could not be processed yet. It must be called before Done.
+func (q *Type) Requeue(key interface{}, items []interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.shuttingDown || !q.processing.has(key) || len(items) == 0 {
+		return
+	}
+	if w, ok := q.waiting[key]; ok {
+		w.retries = append(append([]interface{}{}, items...), w.retries...)
+		return
+	}
+	q.toQueue[key] = append(append([]interface{}{}, items...), q.toQueue[key]...)
+}
+
+// AddRateLimited enqueues the items of a key once the backoff of the key expires, e.g. the items which could not be
+// processed yet. The items are queued ahead of the items of the key added meanwhile, so that the items of a key are
+// processed in order. The items are requeued as a whole, the backoff of the key grows once per call. The items are
+// handed to the dead letter function instead once the key exhausted its retries.
+func (q *Type) AddRateLimited(key interface{}, items ...interface{}) {
+	q.cond.L.Lock()
+	if q.shuttingDown || len(items) == 0 {
+		q.cond.L.Unlock()
+		return
+	}
+	q.requeues[key]++
+	requeues := q.requeues[key]
+	if q.policy.MaxRetries > 0 && requeues > q.policy.MaxRetries {
+		delete(q.requeues, key)
+		deadLetter := q.deadLetter
+		q.cond.L.Unlock()
+		if deadLetter != nil {
+			deadLetter(key, items)
+		}
+		return
+	}
+	defer q.cond.L.Unlock()
+	delay := q.policy.backoff(requeues)
+	w, ok := q.waiting[key]
+	if !ok && delay <= 0 {
+		// No backoff, the items are requeued ahead of the items queued meanwhile.
+		q.requeue(key, items)
+		return
+	}
+	if ok {
+		// Key is backing off already. The items are queued after the items requeued earlier.
+		w.retries = append(w.retries, items...)
+		return
+	}
+	w = &waitingKey{retries: append([]interface{}{}, items...)}
+	// The items queued meanwhile wait for the items requeued.
+	if q.processing.has(key) {
+		w.adds = q.toQueue[key]
+		delete(q.toQueue, key)
+	} else if queued, ok := q.items[key]; ok {
+		w.adds = queued
+		delete(q.items, key)
+		q.removeFromQueue(key)
+	}
+	q.waiting[key] = w
+	timer := q.clock.NewTimer(delay)
+	go func() {
+		select {
+		case <-timer.C():
+			q.release(key, w)
+		case <-q.stopCh:
+			timer.Stop()
+		}
+	}()
+}
+
+// requeue enqueues the items of a key ahead of the items queued meanwhile. q.cond.L must be held.
+func (q *Type) requeue(key interface{}, items []interface{}) {
+	if q.processing.has(key) {
+		q.toQueue[key] = append(append([]interface{}{}, items...), q.toQueue[key]...)
+		return
+	}
+	if queued, ok := q.items[key]; ok {
+		q.items[key] = append(append([]interface{}{}, items...), queued...)
+		return
+	}
+	q.items[key] = append([]interface{}{}, items...)
+	q.queue = append(q.queue, key)
+	q.cond.Signal()
+}
+
+func (q *Type) removeFromQueue(key interface{}) {
+	for i, k := range q.queue {
+		if k == key {
+			q.queue = append(q.queue[:i], q.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// release enqueues the items of a key once its backoff expired, unless they were flushed by ShutDown.
+func (q *Type) release(key interface{}, w *waitingKey) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.waiting[key] != w {
+		return
+	}
+	q.flush(key, w)
+}
+
+// flush enqueues the items of a waiting key. q.cond.L must be held.
+func (q *Type) flush(key interface{}, w *waitingKey) {
+	delete(q.waiting, key)
+	for _, item := range w.retries {
+		q.add(key, item)
+	}
+	for _, item := range w.adds {
+		q.add(key, item)
+	}
+}
+
+// Forget resets the backoff of a key, e.g. once its items are processed.
+func (q *Type) Forget(key interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	delete(q.requeues, key)
+}
+
+// NumRequeues returns the number of times the items of a key were requeued by AddRateLimited since the key was
+// forgotten.
+func (q *Type) NumRequeues(key interface{}) int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.requeues[key]
+}
+
 // Done removes the item under processing and put the queued item into the to-be-processed set.
 func (q *Type) Done(key interface{}) {
 	q.cond.L.Lock()
@@ -136,10 +392,17 @@ func (q *Type) Done(key interface{}) {
 
 // ShutDown shuts down the queue.
 // After ShutDown is called new items will not be appended to the queue. Only
-// already appended items will be drained.
+// already appended items will be drained, the items of the keys backing off are
+// queued without waiting for their backoff.
 func (q *Type) ShutDown() {
 	q.cond.L.Lock()
 	defer q.cond.L.Unlock()
+	if !q.shuttingDown {
+		for key, w := range q.waiting {
+			q.flush(key, w)
+		}
+		close(q.stopCh)
+	}
 	q.shuttingDown = true
 	q.cond.Broadcast()
 }
@@ -150,3 +413,35 @@ func (q *Type) ShuttingDown() bool {
 	defer q.cond.L.Unlock()
 	return q.shuttingDown
 }
+
+// Len returns the number of keys queued, backing off or under processing.
+func (q *Type) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	n := len(q.queue) + len(q.processing)
+	for key := range q.waiting {
+		// The keys backing off are not queued, but may be under processing.
+		if !q.processing.has(key) {
+			n++
+		}
+	}
+	return n
+}
+
+// Depths returns the number of items queued by key, including the items queued while their key is processed or
+// backing off. The keys under processing are included, with the items queued meanwhile.
+func (q *Type) Depths() map[interface{}]int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	depths := make(map[interface{}]int, len(q.items)+len(q.processing)+len(q.waiting))
+	for key, items := range q.items {
+		depths[key] = len(items)
+	}
+	for key := range q.processing {
+		depths[key] = len(q.toQueue[key])
+	}
+	for key, w := range q.waiting {
+		depths[key] += len(w.retries) + len(w.adds)
+	}
+	return depths
+}
@@ -17,9 +17,15 @@ limitations under the License.
 package k8sclient
 
 import (
+	"fmt"
 	"reflect"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 func TestAdd(t *testing.T) {
@@ -151,6 +157,33 @@ func TestDone(t *testing.T) {
 	}
 }
 
+func TestRequeue(t *testing.T) {
+	fakeQueue := NewKeyedQueue()
+	fakeQueue.Add("Item1", "Value1")
+	fakeQueue.Add("Item1", "Value2")
+	key, items, _ := fakeQueue.Get()
+	fakeQueue.Add("Item1", "Value3")
+	fakeQueue.Add("Item2", "Value1")
+	fakeQueue.Requeue(key, items[1:])
+	// A key which is not under processing is not requeued.
+	fakeQueue.Requeue("Item2", []interface{}{"Value0"})
+	fakeQueue.Done(key)
+
+	var testResult = []struct {
+		key   interface{}
+		value []interface{}
+	}{
+		{"Item2", []interface{}{"Value1"}},
+		{"Item1", []interface{}{"Value2", "Value3"}},
+	}
+	for _, testValue := range testResult {
+		key, value, _ := fakeQueue.Get()
+		if !reflect.DeepEqual(key, testValue.key) || !reflect.DeepEqual(value, testValue.value) {
+			t.Error("expected ", testValue.key, testValue.value, "got ", key, value)
+		}
+	}
+}
+
 func TestShutDown(t *testing.T) {
 	fakeQueue := NewKeyedQueue()
 	var testDatas = []struct {
@@ -235,3 +268,290 @@ func TestShuttingDown(t *testing.T) {
 		t.Error("expected ", nil, nil, true, "got ", key, value, down)
 	}
 }
+
+func TestLen(t *testing.T) {
+	fakeQueue := NewKeyedQueue()
+	fakeQueue.Add("Item1", "Value1")
+	fakeQueue.Add("Item1", "Value11")
+	fakeQueue.Add("Item2", "Value2")
+	if fakeQueue.Len() != 2 {
+		t.Error("expected ", 2, "got ", fakeQueue.Len())
+	}
+	key, _, _ := fakeQueue.Get()
+	// The key under processing is still counted.
+	if fakeQueue.Len() != 2 {
+		t.Error("expected ", 2, "got ", fakeQueue.Len())
+	}
+	fakeQueue.Done(key)
+	if fakeQueue.Len() != 1 {
+		t.Error("expected ", 1, "got ", fakeQueue.Len())
+	}
+}
+
+func TestDepths(t *testing.T) {
+	fakeQueue := NewKeyedQueue()
+	fakeQueue.Add("Item1", "Value1")
+	fakeQueue.Add("Item1", "Value11")
+	fakeQueue.Add("Item2", "Value2")
+	if expected := map[interface{}]int{"Item1": 2, "Item2": 1}; !reflect.DeepEqual(fakeQueue.Depths(), expected) {
+		t.Error("expected ", expected, "got ", fakeQueue.Depths())
+	}
+	key, _, _ := fakeQueue.Get()
+	// The key under processing is reported with the items queued meanwhile.
+	if expected := map[interface{}]int{"Item1": 0, "Item2": 1}; !reflect.DeepEqual(fakeQueue.Depths(), expected) {
+		t.Error("expected ", expected, "got ", fakeQueue.Depths())
+	}
+	fakeQueue.Add(key, "Value111")
+	if expected := map[interface{}]int{"Item1": 1, "Item2": 1}; !reflect.DeepEqual(fakeQueue.Depths(), expected) {
+		t.Error("expected ", expected, "got ", fakeQueue.Depths())
+	}
+}
+
+func TestQueueRetryPolicy_backoff(t *testing.T) {
+	policy := QueueRetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	var testData = []struct {
+		requeues int
+		expected time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	}
+	for _, data := range testData {
+		if delay := policy.backoff(data.requeues); delay != data.expected {
+			t.Errorf("requeue %d: expected delay %v, got %v", data.requeues, data.expected, delay)
+		}
+	}
+	// The delay does not overflow below a huge cap.
+	policy.MaxDelay = time.Duration(1<<63 - 1)
+	if delay := policy.backoff(100); delay != policy.MaxDelay {
+		t.Errorf("expected delay %v, got %v", policy.MaxDelay, delay)
+	}
+}
+
+// queuedKeys returns the number of keys ready to be processed, the keys backing off are not included.
+func queuedKeys(q *Type) int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return len(q.queue)
+}
+
+// TestAddRateLimitedOrdering checks that the items requeued by AddRateLimited are processed ahead of the items of
+// their key added while the key is processed or backing off, and that the other keys are not delayed.
+func TestAddRateLimitedOrdering(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	fakeQueue := NewKeyedQueue(WithQueueRetryPolicy(QueueRetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}), withQueueClock(fakeClock))
+	fakeQueue.Add("Item1", "Value1")
+	fakeQueue.Add("Item1", "Value2")
+	key, items, _ := fakeQueue.Get()
+	fakeQueue.Add("Item1", "Value3")
+	fakeQueue.AddRateLimited(key, items[1:]...)
+	fakeQueue.Done(key)
+	fakeQueue.Add("Item1", "Value4")
+	fakeQueue.Add("Item2", "Value1")
+
+	// Item1 is backing off, Item2 is processed meanwhile.
+	if expected := map[interface{}]int{"Item1": 3, "Item2": 1}; !reflect.DeepEqual(fakeQueue.Depths(), expected) {
+		t.Error("expected ", expected, "got ", fakeQueue.Depths())
+	}
+	key, items, _ = fakeQueue.Get()
+	if key != "Item2" || !reflect.DeepEqual(items, []interface{}{"Value1"}) {
+		t.Error("expected ", "Item2", []interface{}{"Value1"}, "got ", key, items)
+	}
+	fakeQueue.Done(key)
+	if fakeQueue.Len() != 1 {
+		t.Error("expected ", 1, "got ", fakeQueue.Len())
+	}
+
+	fakeClock.Step(time.Second)
+	key, items, _ = fakeQueue.Get()
+	if expected := []interface{}{"Value2", "Value3", "Value4"}; key != "Item1" || !reflect.DeepEqual(items, expected) {
+		t.Error("expected ", "Item1", expected, "got ", key, items)
+	}
+	if fakeQueue.NumRequeues("Item1") != 1 {
+		t.Error("expected ", 1, "got ", fakeQueue.NumRequeues("Item1"))
+	}
+	fakeQueue.Forget(key)
+	fakeQueue.Done(key)
+	if fakeQueue.NumRequeues("Item1") != 0 || fakeQueue.Len() != 0 {
+		t.Error("expected the key to be forgotten, got requeues ", fakeQueue.NumRequeues("Item1"), "length ", fakeQueue.Len())
+	}
+}
+
+// TestAddRateLimitedBackoff checks that the backoff of a key doubles with each requeue up to the cap, and is reset
+// by Forget.
+func TestAddRateLimitedBackoff(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	fakeQueue := NewKeyedQueue(WithQueueRetryPolicy(QueueRetryPolicy{BaseDelay: time.Second, MaxDelay: 4 * time.Second}), withQueueClock(fakeClock))
+	fakeQueue.Add("Item1", "Value1")
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, time.Second} {
+		if i == 4 {
+			fakeQueue.Forget("Item1")
+		}
+		key, items, _ := fakeQueue.Get()
+		fakeQueue.AddRateLimited(key, items...)
+		fakeQueue.Done(key)
+
+		fakeClock.Step(delay - time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		if queuedKeys(fakeQueue) != 0 {
+			t.Fatalf("retry %d: expected the key to back off for %v", i, delay)
+		}
+		fakeClock.Step(time.Millisecond)
+		if err := wait.PollImmediate(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			return queuedKeys(fakeQueue) == 1, nil
+		}); err != nil {
+			t.Fatalf("retry %d: expected the key to be queued after %v", i, delay)
+		}
+	}
+	if fakeQueue.NumRequeues("Item1") != 1 {
+		t.Error("expected ", 1, "got ", fakeQueue.NumRequeues("Item1"))
+	}
+}
+
+// TestAddRateLimitedDeadLetter checks that the items of a key which exhausted its retries are handed to the dead
+// letter function, and that the items added meanwhile are still processed.
+func TestAddRateLimitedDeadLetter(t *testing.T) {
+	var deadKeys []interface{}
+	var deadItems [][]interface{}
+	fakeQueue := NewKeyedQueue(
+		WithQueueRetryPolicy(QueueRetryPolicy{MaxRetries: 2}),
+		WithDeadLetter(func(key interface{}, items []interface{}) {
+			deadKeys = append(deadKeys, key)
+			deadItems = append(deadItems, items)
+		}))
+	fakeQueue.Add("Item1", "Value1")
+	for i := 1; i <= 2; i++ {
+		key, items, _ := fakeQueue.Get()
+		fakeQueue.AddRateLimited(key, items...)
+		fakeQueue.Done(key)
+		if fakeQueue.NumRequeues(key) != i {
+			t.Error("expected ", i, "got ", fakeQueue.NumRequeues(key))
+		}
+	}
+	key, items, _ := fakeQueue.Get()
+	if !reflect.DeepEqual(items, []interface{}{"Value1"}) {
+		t.Error("expected ", []interface{}{"Value1"}, "got ", items)
+	}
+	fakeQueue.Add(key, "Value2")
+	fakeQueue.AddRateLimited(key, items...)
+	fakeQueue.Done(key)
+	if !reflect.DeepEqual(deadKeys, []interface{}{"Item1"}) || !reflect.DeepEqual(deadItems, [][]interface{}{{"Value1"}}) {
+		t.Error("expected the dead letter of ", "Item1", []interface{}{"Value1"}, "got ", deadKeys, deadItems)
+	}
+	if fakeQueue.NumRequeues(key) != 0 {
+		t.Error("expected ", 0, "got ", fakeQueue.NumRequeues(key))
+	}
+	key, items, _ = fakeQueue.Get()
+	if key != "Item1" || !reflect.DeepEqual(items, []interface{}{"Value2"}) {
+		t.Error("expected ", "Item1", []interface{}{"Value2"}, "got ", key, items)
+	}
+}
+
+// TestShutDownFlushesBackoff checks that the items of the keys backing off are drained on shut down.
+func TestShutDownFlushesBackoff(t *testing.T) {
+	fakeQueue := NewKeyedQueue(withQueueClock(clock.NewFakeClock(time.Now())))
+	fakeQueue.Add("Item1", "Value1")
+	// The items queued already wait for the items requeued.
+	fakeQueue.AddRateLimited("Item1", "Value0")
+	if fakeQueue.Len() != 1 || queuedKeys(fakeQueue) != 0 {
+		t.Error("expected the key to back off, got length ", fakeQueue.Len(), "queued ", queuedKeys(fakeQueue))
+	}
+	fakeQueue.ShutDown()
+	fakeQueue.AddRateLimited("Item2", "Value2")
+	key, items, shutdown := fakeQueue.Get()
+	if expected := []interface{}{"Value0", "Value1"}; key != "Item1" || !reflect.DeepEqual(items, expected) || shutdown {
+		t.Error("expected ", "Item1", expected, "got ", key, items, shutdown)
+	}
+	fakeQueue.Done(key)
+	if _, _, shutdown := fakeQueue.Get(); !shutdown {
+		t.Error("expected the queue to be drained")
+	}
+}
+
+// TestKeyOrderUnderConcurrency adds the items of many keys concurrently and processes them with many workers, which
+// process at most maxItems items of a key at a time and requeue the others. The items of a key must be processed in
+// the order they were added, and a key must not be processed by two workers at once.
+func TestKeyOrderUnderConcurrency(t *testing.T) {
+	const (
+		keys        = 200
+		itemsPerKey = 100
+		workers     = 32
+		maxItems    = 3
+	)
+	fakeQueue := NewKeyedQueue()
+	var mu sync.Mutex
+	processing := make(map[interface{}]bool)
+	next := make(map[interface{}]int)
+	var failures []string
+
+	var running sync.WaitGroup
+	running.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer running.Done()
+			for {
+				key, items, shutdown := fakeQueue.Get()
+				if shutdown {
+					return
+				}
+				mu.Lock()
+				if processing[key] {
+					failures = append(failures, fmt.Sprintf("key %v processed by two workers at once", key))
+				}
+				processing[key] = true
+				mu.Unlock()
+				// Items of the key are added while it is processed, they must be queued after the requeued ones.
+				runtime.Gosched()
+				if len(items) > maxItems {
+					fakeQueue.Requeue(key, items[maxItems:])
+					items = items[:maxItems]
+				}
+				mu.Lock()
+				for _, item := range items {
+					if item.(int) != next[key] {
+						failures = append(failures, fmt.Sprintf("key %v: expected item %d, got %d", key, next[key], item))
+					}
+					next[key] = item.(int) + 1
+				}
+				processing[key] = false
+				mu.Unlock()
+				fakeQueue.Done(key)
+			}
+		}()
+	}
+
+	var adding sync.WaitGroup
+	adding.Add(keys)
+	for k := 0; k < keys; k++ {
+		go func(key string) {
+			defer adding.Done()
+			for i := 0; i < itemsPerKey; i++ {
+				fakeQueue.Add(key, i)
+				runtime.Gosched()
+			}
+		}(fmt.Sprintf("key-%d", k))
+	}
+	adding.Wait()
+	// The items requeued once the queue is shutting down are dropped, the queue is shut down once it is drained.
+	if err := wait.PollImmediate(time.Millisecond, 10*time.Second, func() (bool, error) { return fakeQueue.Len() == 0, nil }); err != nil {
+		t.Errorf("expected the queue to be drained, %d keys are left", fakeQueue.Len())
+	}
+	fakeQueue.ShutDown()
+	running.Wait()
+
+	for _, failure := range failures {
+		t.Error(failure)
+	}
+	if len(next) != keys {
+		t.Errorf("expected %d keys to be processed, got %d", keys, len(next))
+	}
+	for key, n := range next {
+		if n != itemsPerKey {
+			t.Errorf("key %v: expected %d items to be processed, got %d", key, itemsPerKey, n)
+		}
+	}
+}
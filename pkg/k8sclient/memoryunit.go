@@ -0,0 +1,68 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/units"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// MemoryUnit is the unit of the memory capacities and requests sent to firmament, it must match the unit
+// firmament was built with.
+type MemoryUnit string
+
+const (
+	// MemoryUnitKB is the default unit. It keeps the memory values sent so far, the milli values of the
+	// quantities, so that the existing firmament deployments see the same capacities and requests.
+	MemoryUnitKB MemoryUnit = "KB"
+	// MemoryUnitMB sends the memory in megabytes, 10^6 bytes.
+	MemoryUnitMB MemoryUnit = "MB"
+	// MemoryUnitMiB sends the memory in mebibytes, 2^20 bytes.
+	MemoryUnitMiB MemoryUnit = "MiB"
+)
+
+// Validate returns an error if the unit is not one of KB, MB and MiB.
+func (u MemoryUnit) Validate() error {
+	switch u {
+	case MemoryUnitKB, MemoryUnitMB, MemoryUnitMiB:
+		return nil
+	}
+	return fmt.Errorf("invalid memory unit %q, expected %s, %s or %s", u, MemoryUnitKB, MemoryUnitMB, MemoryUnitMiB)
+}
+
+// memoryValue returns the memory quantity in the unit, the quantities are rounded down.
+func (u MemoryUnit) memoryValue(quantity resource.Quantity) int64 {
+	switch u {
+	case MemoryUnitMB:
+		return units.BytesToMB(quantity.Value())
+	case MemoryUnitMiB:
+		return units.BytesToMiB(quantity.Value())
+	}
+	return quantity.MilliValue()
+}
+
+// getMemoryValue returns the memory quantity of a node in the unit. It returns an error if the quantity
+// is negative or too large, see getMilliValue.
+func getMemoryValue(resources v1.ResourceList, unit MemoryUnit) (int64, error) {
+	if _, err := getMilliValue(resources, v1.ResourceMemory); err != nil {
+		return 0, err
+	}
+	return unit.memoryValue(resources[v1.ResourceMemory]), nil
+}
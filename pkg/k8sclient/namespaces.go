@@ -0,0 +1,237 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceFilter selects the namespaces whose pods are handled by the pod watcher. The pods of
+// kube-system and of the denied namespaces are ignored, even when the namespace is allowed too.
+type namespaceFilter struct {
+	// allowed is empty when the pods of all the namespaces are handled.
+	allowed map[string]bool
+	denied  map[string]bool
+}
+
+func newNamespaceFilter(allowlist, denylist []string) namespaceFilter {
+	filter := namespaceFilter{
+		allowed: make(map[string]bool),
+		denied:  map[string]bool{metav1.NamespaceSystem: true},
+	}
+	for _, namespace := range allowlist {
+		filter.allowed[namespace] = true
+	}
+	for _, namespace := range denylist {
+		filter.denied[namespace] = true
+	}
+	return filter
+}
+
+// handles checks if the pods of the namespace are handled by the pod watcher.
+func (f namespaceFilter) handles(namespace string) bool {
+	if f.denied[namespace] {
+		return false
+	}
+	return len(f.allowed) == 0 || f.allowed[namespace]
+}
+
+// watchedNamespaces returns the namespaces the pod watcher lists and watches the pods of. All the namespaces
+// are watched at once without allowlist, the denied namespaces are filtered out by the enqueue functions then.
+func (f namespaceFilter) watchedNamespaces() []string {
+	if len(f.allowed) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	var namespaces []string
+	for namespace := range f.allowed {
+		if f.handles(namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// namespaceQueues holds a work queue per namespace. Each queue is processed by its own workers,
+// so that the pods of a namespace with many pod changes do not delay the pods of the other namespaces.
+type namespaceQueues struct {
+	lock   *sync.Mutex
+	queues map[string]Queue
+	// startWorkers starts the workers of a queue, it is nil until the pod watcher runs.
+	startWorkers func(queue Queue)
+	// shuttingDown is set once the queues are shut down.
+	shuttingDown bool
+	// queueOpts configure the queues created by get.
+	queueOpts []QueueOption
+}
+
+func newNamespaceQueues(opts ...QueueOption) *namespaceQueues {
+	return &namespaceQueues{
+		lock:      new(sync.Mutex),
+		queues:    make(map[string]Queue),
+		queueOpts: opts,
+	}
+}
+
+// get returns the queue of the namespace. The queue is created on first use, and its workers are
+// started right away if the pod watcher runs.
+func (nq *namespaceQueues) get(namespace string) Queue {
+	nq.lock.Lock()
+	defer nq.lock.Unlock()
+	queue, ok := nq.queues[namespace]
+	if !ok {
+		queue = NewKeyedQueue(nq.queueOpts...)
+		nq.queues[namespace] = queue
+		if nq.shuttingDown {
+			// The workers of a queue created once the watcher is stopping return right away.
+			queue.ShutDown()
+		}
+		if nq.startWorkers != nil {
+			nq.startWorkers(queue)
+		}
+	}
+	return queue
+}
+
+// run starts the workers of the queues created so far, and of the queues created afterwards.
+func (nq *namespaceQueues) run(startWorkers func(queue Queue)) {
+	nq.lock.Lock()
+	defer nq.lock.Unlock()
+	nq.startWorkers = startWorkers
+	for _, queue := range nq.queues {
+		startWorkers(queue)
+	}
+}
+
+// Len returns the number of keys queued or under processing in all the queues.
+func (nq *namespaceQueues) Len() int {
+	nq.lock.Lock()
+	defer nq.lock.Unlock()
+	n := 0
+	for _, queue := range nq.queues {
+		n += queue.Len()
+	}
+	return n
+}
+
+// all returns the queues by namespace, none for nil namespace queues.
+func (nq *namespaceQueues) all() map[string]Queue {
+	if nq == nil {
+		return nil
+	}
+	nq.lock.Lock()
+	defer nq.lock.Unlock()
+	queues := make(map[string]Queue, len(nq.queues))
+	for namespace, queue := range nq.queues {
+		queues[namespace] = queue
+	}
+	return queues
+}
+
+func (nq *namespaceQueues) shutDown() {
+	nq.lock.Lock()
+	defer nq.lock.Unlock()
+	nq.shuttingDown = true
+	for _, queue := range nq.queues {
+		queue.ShutDown()
+	}
+}
+
+func newPodListWatch(client kubernetes.Interface, namespace string, schedulerSelector fields.Selector, podSelector labels.Selector) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(alo metav1.ListOptions) (runtime.Object, error) {
+			alo.FieldSelector = schedulerSelector.String()
+			alo.LabelSelector = podSelector.String()
+			return client.CoreV1().Pods(namespace).List(alo)
+		},
+		WatchFunc: func(alo metav1.ListOptions) (watch.Interface, error) {
+			alo.FieldSelector = schedulerSelector.String()
+			alo.LabelSelector = podSelector.String()
+			return client.CoreV1().Pods(namespace).Watch(alo)
+		},
+	}
+}
+
+// newNamespaceInformer watches the deletion of the namespaces to remove the tasks of their pods.
+func (pw *PodWatcher) newNamespaceInformer() cache.Controller {
+	_, controller := cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(alo metav1.ListOptions) (runtime.Object, error) {
+				return pw.clientset.CoreV1().Namespaces().List(alo)
+			},
+			WatchFunc: func(alo metav1.ListOptions) (watch.Interface, error) {
+				return pw.clientset.CoreV1().Namespaces().Watch(alo)
+			},
+		},
+		&v1.Namespace{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			DeleteFunc: func(obj interface{}) {
+				namespace, ok := obj.(*v1.Namespace)
+				if !ok {
+					tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+					if !ok {
+						glog.Errorf("DeleteFunc: unexpected object %v", obj)
+						return
+					}
+					if namespace, ok = tombstone.Obj.(*v1.Namespace); !ok {
+						glog.Errorf("DeleteFunc: tombstone contains an unexpected object %v", tombstone.Obj)
+						return
+					}
+				}
+				pw.enqueueNamespaceDeletion(namespace.Name)
+			},
+		},
+	)
+	return controller
+}
+
+// enqueueNamespaceDeletion removes the tasks of the pods of a deleted namespace, so that the pending pods
+// are not placed by firmament while the pod deletions of the namespace controller are on their way.
+func (pw *PodWatcher) enqueueNamespaceDeletion(namespace string) {
+	if !pw.namespaces.handles(namespace) {
+		return
+	}
+	var pods []*v1.Pod
+	PodToK8sPodLock.Lock()
+	for identifier, pod := range PodToK8sPod {
+		if identifier.Namespace == namespace {
+			pods = append(pods, pod)
+		}
+	}
+	PodToK8sPodLock.Unlock()
+	glog.V(2).Infof("enqueueNamespaceDeletion: Removing %d pods of namespace %s", len(pods), namespace)
+	for _, pod := range pods {
+		key, err := cache.MetaNamespaceKeyFunc(pod)
+		if err != nil {
+			glog.Errorf("enqueueNamespaceDeletion: error getting key %v", err)
+			continue
+		}
+		pw.enqueueDeletedPod(key, pod)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNamespaceFilter(t *testing.T) {
+	var testData = []struct {
+		allowlist []string
+		denylist  []string
+		handled   map[string]bool
+		watched   []string
+	}{
+		{
+			// Without allowlist all the namespaces are watched at once, the denied ones are filtered.
+			denylist: []string{"tenant-c"},
+			handled:  map[string]bool{"tenant-a": true, "tenant-c": false, "kube-system": false},
+			watched:  []string{metav1.NamespaceAll},
+		},
+		{
+			allowlist: []string{"tenant-b", "tenant-a"},
+			handled:   map[string]bool{"tenant-a": true, "tenant-b": true, "tenant-c": false},
+			watched:   []string{"tenant-a", "tenant-b"},
+		},
+		{
+			// The denylist wins over the allowlist, and kube-system is never handled.
+			allowlist: []string{"tenant-a", "tenant-b", "kube-system"},
+			denylist:  []string{"tenant-b"},
+			handled:   map[string]bool{"tenant-a": true, "tenant-b": false, "kube-system": false},
+			watched:   []string{"tenant-a"},
+		},
+	}
+
+	for _, data := range testData {
+		filter := newNamespaceFilter(data.allowlist, data.denylist)
+		for namespace, expected := range data.handled {
+			if got := filter.handles(namespace); got != expected {
+				t.Errorf("allowlist %v denylist %v namespace %s: expected %v got %v", data.allowlist, data.denylist, namespace, expected, got)
+			}
+		}
+		if got := filter.watchedNamespaces(); !reflect.DeepEqual(got, data.watched) {
+			t.Errorf("allowlist %v denylist %v: expected watched namespaces %v got %v", data.allowlist, data.denylist, data.watched, got)
+		}
+	}
+}
+
+// TestNewPodListWatch checks that the pods of an allowed namespace are listed on their own.
+func TestNewPodListWatch(t *testing.T) {
+	var empty map[string]string
+	client := fake.NewSimpleClientset(
+		BuildPod("tenant-a", "pod-a", empty, v1.PodPending, "1", "1024", nil, "owner"),
+		BuildPod("tenant-b", "pod-b", empty, v1.PodPending, "1", "1024", nil, "owner"),
+	)
+	obj, err := newPodListWatch(client, "tenant-a", fields.Everything(), labels.Everything()).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal("error listing the pods ", err)
+	}
+	pods := obj.(*v1.PodList)
+	if len(pods.Items) != 1 || pods.Items[0].Name != "pod-a" {
+		t.Errorf("expected only pod-a to be listed, got %v", pods.Items)
+	}
+}
+
+// TestPodWatcher_namespaceDenylist checks that the pods of the denied namespaces are not enqueued.
+func TestPodWatcher_namespaceDenylist(t *testing.T) {
+	var empty map[string]string
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	podWatch.namespaces = newNamespaceFilter(nil, []string{"tenant-c"})
+
+	for _, namespace := range []string{"tenant-a", "tenant-c", metav1.NamespaceSystem} {
+		pod := BuildPod(namespace, "pod", empty, v1.PodPending, "1", "1024", nil, "owner")
+		podWatch.enqueuePodAddition(GetKey(pod, t), pod)
+		podWatch.enqueuePodDeletion(GetKey(pod, t), pod)
+	}
+	if got := podWatch.podWorkQueue.Len(); got != 1 {
+		t.Errorf("expected only the pod of tenant-a to be enqueued, got %d keys", got)
+	}
+}
+
+// TestPodWatcher_enqueueNamespaceDeletion checks that the tasks of the pending pods of a deleted namespace are removed.
+func TestPodWatcher_enqueueNamespaceDeletion(t *testing.T) {
+	var empty map[string]string
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	PodToK8sPod = make(map[PodIdentifier]*v1.Pod)
+	NodeMux = new(sync.RWMutex)
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil).Times(3),
+		testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil).Times(2),
+	)
+	processPods := func() {
+		podWatch.podWorkQueue.ShutDown()
+		podWatch.podWorker()
+		podWatch.podWorkQueue = NewKeyedQueue()
+	}
+
+	for _, pod := range []*v1.Pod{
+		BuildPod("tenant-a", "pod-1", empty, v1.PodPending, "1", "1024", nil, "owner-a"),
+		BuildPod("tenant-a", "pod-2", empty, v1.PodPending, "1", "1024", nil, "owner-a"),
+		BuildPod("tenant-b", "pod-1", empty, v1.PodPending, "1", "1024", nil, "owner-b"),
+	} {
+		podWatch.enqueuePodAddition(GetKey(pod, t), pod)
+	}
+	processPods()
+	podWatch.enqueueNamespaceDeletion("tenant-a")
+	processPods()
+
+	PodMux.RLock()
+	defer PodMux.RUnlock()
+	if len(PodToTD) != 1 {
+		t.Fatalf("expected only the task of tenant-b to be left, got %v", PodToTD)
+	}
+	if _, ok := PodToTD[PodIdentifier{Name: "pod-1", Namespace: "tenant-b"}]; !ok {
+		t.Errorf("expected the task of tenant-b/pod-1 to be left, got %v", PodToTD)
+	}
+}
+
+// TestPodWatcher_namespaceQueues saturates the queue of namespace-b with pods whose submission to firmament
+// blocks, and checks that the pods of namespace-a are still processed by the workers of their own queue.
+func TestPodWatcher_namespaceQueues(t *testing.T) {
+	var empty map[string]string
+	const numBlockedPods = 5
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	podWatch.namespaceQueues = newNamespaceQueues()
+	defer podWatch.namespaceQueues.shutDown()
+	if podWatch.podQueue("namespace-a") == podWatch.podQueue("namespace-b") {
+		t.Fatal("expected the namespaces to have their own queues")
+	}
+
+	release := make(chan struct{})
+	submittedA := make(chan struct{})
+	submittedB := make(chan struct{}, numBlockedPods)
+	testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+		&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil).Times(numBlockedPods + 1).Do(
+		func(arg0, arg1 interface{}, arg2 ...interface{}) {
+			if arg1.(*firmament.TaskDescription).GetTaskDescriptor().GetNamespace() == "namespace-a" {
+				close(submittedA)
+				return
+			}
+			<-release
+			submittedB <- struct{}{}
+		})
+
+	for i := 0; i < numBlockedPods; i++ {
+		pod := BuildPod("namespace-b", fmt.Sprintf("pod-%d", i), empty, v1.PodPending, "1", "1024", nil, "owner-b")
+		podWatch.enqueuePodAddition(GetKey(pod, t), pod)
+	}
+	podWatch.namespaceQueues.run(func(queue Queue) {
+		go podWatch.processPodQueue(queue)
+	})
+	// The queue of namespace-a is created and its workers started once its first pod is added.
+	podA := BuildPod("namespace-a", "pod-a", empty, v1.PodPending, "1", "1024", nil, "owner-a")
+	podWatch.enqueuePodAddition(GetKey(podA, t), podA)
+
+	select {
+	case <-submittedA:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the pod of namespace-a to be submitted while namespace-b is saturated")
+	}
+	if got := podWatch.podQueue("namespace-b").Len(); got != numBlockedPods {
+		t.Errorf("expected %d pods under processing in namespace-b, got %d", numBlockedPods, got)
+	}
+
+	close(release)
+	for i := 0; i < numBlockedPods; i++ {
+		select {
+		case <-submittedB:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected the pods of namespace-b to be submitted once released, got %d", i)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for podWatch.queuedPods() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the queues to be drained, got %d pods", podWatch.queuedPods())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
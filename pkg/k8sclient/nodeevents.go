@@ -0,0 +1,128 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/api/legacyscheme"
+)
+
+// Reasons of the events recorded on the nodes, see WithNodeEventRecorder.
+const (
+	NodeRegisteredReason       = "NodeRegistered"
+	NodeDeregisteredReason     = "NodeDeregistered"
+	NodeFailedSchedulingReason = "NodeFailedScheduling"
+	NodeDroppedReason          = "NodeChangesDropped"
+)
+
+// nodeEventInterval is the minimum interval between two events with the same reason for a node, so that a
+// flapping node does not spam its event stream.
+const nodeEventInterval = time.Minute
+
+// NewEventRecorder returns a recorder of the events of poseidon, sent to the API server by client.
+func NewEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(legacyscheme.Scheme, corev1.EventSource{Component: "Poseidon"})
+}
+
+// WithNodeEventRecorder records an event on the nodes once firmament accepted their addition, removal or failure,
+// or once their changes are dropped, so that they show up in kubectl describe node. The events of a node are rate
+// limited by reason.
+func WithNodeEventRecorder(recorder record.EventRecorder) NodeWatcherOption {
+	return WithNodeObserver(newNodeEvents(recorder, nodeEventInterval, time.Now).observer())
+}
+
+type nodeEventKey struct {
+	hostname string
+	reason   string
+}
+
+// nodeEvents records the node lifecycle events, at most one per node and reason per interval.
+type nodeEvents struct {
+	recorder record.EventRecorder
+	interval time.Duration
+	now      func() time.Time
+	// mu is used to guard access to last.
+	mu   sync.Mutex
+	last map[nodeEventKey]time.Time
+}
+
+func newNodeEvents(recorder record.EventRecorder, interval time.Duration, now func() time.Time) *nodeEvents {
+	return &nodeEvents{
+		recorder: recorder,
+		interval: interval,
+		now:      now,
+		last:     make(map[nodeEventKey]time.Time),
+	}
+}
+
+// observer returns the observer recording the events of the node changes.
+func (e *nodeEvents) observer() NodeObserver {
+	return NodeObserver{
+		OnNodeAdded: func(node *Node) {
+			e.record(node, corev1.EventTypeNormal, NodeRegisteredReason, "Node registered with Firmament, pods are scheduled to it")
+		},
+		OnNodeDeleted: func(node *Node) {
+			e.record(node, corev1.EventTypeNormal, NodeDeregisteredReason, "Node removed from Firmament, pods are not scheduled to it anymore")
+		},
+		OnNodeFailed: func(node *Node) {
+			e.record(node, corev1.EventTypeWarning, NodeFailedSchedulingReason, "Node failed in Firmament as it is not ready or out of disk, pods are not scheduled to it until it recovers")
+		},
+		OnNodeDropped: func(node *Node) {
+			e.record(node, corev1.EventTypeWarning, NodeDroppedReason, "Changes of the node dropped as Firmament failed to process them, the node is updated on its next change")
+		},
+	}
+}
+
+// record records the event on the node, unless an event with the same reason was recorded for the node less than
+// the interval ago.
+func (e *nodeEvents) record(node *Node, eventType, reason, message string) {
+	if !e.allow(node.Hostname, reason) {
+		glog.V(2).Infof("Skipping %s event for node %s, an event was recorded recently", reason, node.Hostname)
+		return
+	}
+	// The events reference the node by name, the removed nodes may not carry their UID.
+	ref := &corev1.ObjectReference{Kind: "Node", Name: node.Hostname, UID: types.UID(node.UID)}
+	e.recorder.Event(ref, eventType, reason, message)
+}
+
+func (e *nodeEvents) allow(hostname, reason string) bool {
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key := nodeEventKey{hostname: hostname, reason: reason}
+	if last, ok := e.last[key]; ok && now.Sub(last) < e.interval {
+		return false
+	}
+	// The expired entries are dropped, so that the removed nodes are forgotten.
+	for k, last := range e.last {
+		if now.Sub(last) >= e.interval {
+			delete(e.last, k)
+		}
+	}
+	e.last[key] = now
+	return true
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament/firmamenttest"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// recordedEvents returns the type and the reason of the events recorded by the fake recorder so far.
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			fields := strings.Fields(event)
+			events = append(events, fields[0]+" "+fields[1])
+		default:
+			return events
+		}
+	}
+}
+
+// TestNodeEvents checks the events recorded for a node going from ready to not ready and back to ready, and that
+// the events of a flapping node are rate limited.
+func TestNodeEvents(t *testing.T) {
+	recorder := record.NewFakeRecorder(100)
+	now := time.Now()
+	events := newNodeEvents(recorder, time.Minute, func() time.Time { return now })
+	nodeWatch := NewNodeWatcher(&fake.Clientset{}, firmamenttest.NewFakeClient(), WithNodeObserver(events.observer()))
+	flap := func() {
+		for _, phase := range []NodePhase{NodeAdded, NodeFailed, NodeRecovered} {
+			node, err := nodeWatch.parseNode(BuildNode("node0", "10", "10000000", nil, nil, false), phase)
+			if err != nil {
+				t.Fatalf("error parsing node %v", err)
+			}
+			nodeWatch.processNodes(context.Background(), []interface{}{node})
+		}
+	}
+
+	flap()
+	expected := []string{"Normal " + NodeRegisteredReason, "Warning " + NodeFailedSchedulingReason}
+	if got := recordedEvents(recorder); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the events %v, got %v", expected, got)
+	}
+	if _, ok := NodeToRTND["node0"]; !ok {
+		t.Error("expected the recovered node to be added again")
+	}
+
+	// The node added again within the interval is not recorded again.
+	nodeWatch.processNodes(context.Background(), []interface{}{&Node{Hostname: "node0", Phase: NodeDeleted}})
+	flap()
+	expected = []string{"Normal " + NodeDeregisteredReason}
+	if got := recordedEvents(recorder); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the events of the flapping node to be rate limited to %v, got %v", expected, got)
+	}
+
+	now = now.Add(time.Minute)
+	nodeWatch.processNodes(context.Background(), []interface{}{&Node{Hostname: "node0", Phase: NodeDeleted}})
+	flap()
+	expected = []string{"Normal " + NodeDeregisteredReason, "Normal " + NodeRegisteredReason, "Warning " + NodeFailedSchedulingReason}
+	if got := recordedEvents(recorder); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the events %v once the interval elapsed, got %v", expected, got)
+	}
+	if len(events.last) != 3 {
+		t.Errorf("expected the expired events to be forgotten, got %v", events.last)
+	}
+}
+
+// TestNodeWatcher_dropNodes checks that the changes of a node dropped by the work queue are released from the
+// backlog and recorded on the node.
+func TestNodeWatcher_dropNodes(t *testing.T) {
+	recorder := record.NewFakeRecorder(100)
+	nodeWatch := NewNodeWatcher(&fake.Clientset{}, firmamenttest.NewFakeClient(), WithNodeEventRecorder(recorder))
+	nodeWatch.backlog.acquire()
+	nodeWatch.backlog.acquire()
+	nodeWatch.dropNodes("node0", []interface{}{&Node{Hostname: "node0", Phase: NodeAdded}, &Node{Hostname: "node0", Phase: NodeUpdated}})
+	expected := []string{"Warning " + NodeDroppedReason}
+	if got := recordedEvents(recorder); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the events %v, got %v", expected, got)
+	}
+	if nodeWatch.backlog.inFlight != 0 {
+		t.Errorf("expected the dropped changes to be released, got %d in flight", nodeWatch.backlog.inFlight)
+	}
+}
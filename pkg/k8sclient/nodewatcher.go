@@ -17,75 +17,224 @@ limitations under the License.
 package k8sclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"net"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/jinzhu/copier"
 	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/logging"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	"github.com/kubernetes-sigs/poseidon/pkg/units"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 )
 
+// Role labels and taint keys identifying the control plane nodes.
+const (
+	ControlPlaneRoleLabel = "node-role.kubernetes.io/control-plane"
+	MasterRoleLabel       = "node-role.kubernetes.io/master"
+)
+
+// stateConsistencyCheckInterval is the interval between two checks of the node and resource maps.
+const stateConsistencyCheckInterval = time.Minute
+
+// ResourceIDFunc generates the firmament resource ID of the node or one of its PUs, identified by friendlyName.
+type ResourceIDFunc func(node *Node, friendlyName string) string
+
+// NodeWatcherOption configures optional behavior of the NodeWatcher.
+type NodeWatcherOption func(nw *NodeWatcher)
+
+// WithResourceIDFunc replaces the default UUID based resource ID generation, e.g. to embed the
+// machine-id or cloud instance-id of the node in its firmament resource IDs.
+func WithResourceIDFunc(resourceIDFunc ResourceIDFunc) NodeWatcherOption {
+	return func(nw *NodeWatcher) {
+		nw.resourceIDFunc = resourceIDFunc
+	}
+}
+
+// defaultResourceIDFunc generates a UUID seeded by the friendly name of the resource.
+func defaultResourceIDFunc(node *Node, friendlyName string) string {
+	return GenerateUUID(friendlyName)
+}
+
+// FriendlyNameFunc generates the firmament friendly name of the machine resource of the node.
+// The names of the resources below the machine are derived from it.
+type FriendlyNameFunc func(node *Node) string
+
+// WithFriendlyNameFunc replaces the hostname as friendly name of the machines, e.g. to prefix it with
+// the cloud region or the cluster name.
+func WithFriendlyNameFunc(friendlyNameFunc FriendlyNameFunc) NodeWatcherOption {
+	return func(nw *NodeWatcher) {
+		nw.friendlyNameFunc = friendlyNameFunc
+	}
+}
+
+// defaultFriendlyNameFunc names the machine after the hostname of the node.
+func defaultFriendlyNameFunc(node *Node) string {
+	return node.Hostname
+}
+
+// NodeObserver is notified of the node topology changes once firmament accepted them, e.g. to let
+// an autoscaler react to the cluster as seen by poseidon. The callbacks are invoked without holding
+// NodeMux, nil callbacks are skipped. OnNodeDropped is invoked with the last change of a node once its changes
+// are dropped, as firmament failed to process them within the retries of the work queue, or with a change
+// firmament rejected.
+type NodeObserver struct {
+	OnNodeAdded   func(*Node)
+	OnNodeDeleted func(*Node)
+	OnNodeFailed  func(*Node)
+	OnNodeUpdated func(*Node)
+	OnNodeDropped func(*Node)
+}
+
+// WithNodeObserver registers an observer of the node topology changes, several observers can be registered.
+func WithNodeObserver(observer NodeObserver) NodeWatcherOption {
+	return func(nw *NodeWatcher) {
+		nw.observers = append(nw.observers, observer)
+	}
+}
+
 // NewNodeWatcher initializes a NodeWatcher based on the given Kubernetes client and Firmament client.
-func NewNodeWatcher(client kubernetes.Interface, fc firmament.FirmamentSchedulerClient) *NodeWatcher {
+func NewNodeWatcher(client kubernetes.Interface, fc firmament.Client, opts ...NodeWatcherOption) *NodeWatcher {
+	nodewatcher := newNodeWatcher(client, fc, opts)
+	nodewatcher.controller = newWatchdogInformer(
+		"nodes",
+		newNodeListWatch(client, nodewatcher.cfg.LabelSelector, nodewatcher.watchErrors),
+		&v1.Node{},
+		nodewatcher.cfg.ResyncPeriod,
+		nodewatcher.cfg.WatchStaleness,
+		nodewatcher.nodeEventHandler(),
+	)
+	return nodewatcher
+}
+
+// NewNodeWatcherWithInformer initializes a NodeWatcher receiving the node events of a shared informer, e.g. the
+// node informer of a SharedInformerFactory, instead of watching the nodes itself. The informer is started by its
+// owner, Run only waits for it to sync. The watcher ignores the nodes not matching its label selector, and does
+// not track the list/watch failures of the informer.
+func NewNodeWatcherWithInformer(informer cache.SharedIndexInformer, client kubernetes.Interface, fc firmament.Client, opts ...NodeWatcherOption) *NodeWatcher {
+	nodewatcher := newNodeWatcher(client, fc, opts)
+	// The label selector is validated by newNodeWatcher.
+	selector, _ := labels.Parse(nodewatcher.cfg.LabelSelector)
+	informer.AddEventHandlerWithResyncPeriod(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			node, ok := obj.(*v1.Node)
+			return ok && selector.Matches(labels.Set(node.Labels))
+		},
+		Handler: nodewatcher.nodeEventHandler(),
+	}, nodewatcher.cfg.ResyncPeriod)
+	nodewatcher.controller = informer
+	nodewatcher.sharedInformer = true
+	return nodewatcher
+}
+
+// newNodeWatcher initializes a NodeWatcher without informer.
+func newNodeWatcher(client kubernetes.Interface, fc firmament.Client, opts []NodeWatcherOption) *NodeWatcher {
 	glog.Info("Starting NodeWatcher...")
 	NodeMux = new(sync.RWMutex)
 	NodeToRTND = make(map[string]*firmament.ResourceTopologyNodeDescriptor)
 	ResIDToNode = make(map[string]string)
+	nodeToUID = make(map[string]string)
 	nodewatcher := &NodeWatcher{
-		clientset: client,
-		fc:        fc,
+		clientset:        client,
+		fc:               fc,
+		cfg:              DefaultNodeWatcherConfig(),
+		resourceIDFunc:   defaultResourceIDFunc,
+		friendlyNameFunc: defaultFriendlyNameFunc,
+		tracer:           noopTracer{},
+		notReadyLock:     new(sync.Mutex),
+		notReadyTimers:   make(map[string]*time.Timer),
+		deferredLock:     new(sync.Mutex),
+		deferredNodes:    make(map[string]bool),
+		nodeAddedLock:    new(sync.Mutex),
+		nodeAdded:        make(chan struct{}),
+		partialLock:      new(sync.Mutex),
+		partialNodes:     make(map[string]string),
 	}
-	_, controller := cache.NewInformer(
-		&cache.ListWatch{
-			ListFunc: func(alo metav1.ListOptions) (runtime.Object, error) {
-				return client.CoreV1().Nodes().List(alo)
-			},
-			WatchFunc: func(alo metav1.ListOptions) (watch.Interface, error) {
-				return client.CoreV1().Nodes().Watch(alo)
-			},
-		},
-		&v1.Node{},
-		0,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				key, err := cache.MetaNamespaceKeyFunc(obj)
-				if err != nil {
-					glog.Errorf("AddFunc: error getting key %v", err)
-				}
-				nodewatcher.enqueueNodeAddition(key, obj)
-			},
-			UpdateFunc: func(old, new interface{}) {
-				key, err := cache.MetaNamespaceKeyFunc(new)
-				if err != nil {
-					glog.Errorf("UpdateFunc: error getting key %v", err)
-				}
-				nodewatcher.enqueueNodeUpdate(key, old, new)
-			},
-			DeleteFunc: func(obj interface{}) {
-				key, err := cache.MetaNamespaceKeyFunc(obj)
-				if err != nil {
-					glog.Errorf("DeleteFunc: error getting key %v", err)
-				}
-				nodewatcher.enqueueNodeDeletion(key, obj)
-			},
-		},
-	)
-	nodewatcher.controller = controller
-	nodewatcher.nodeWorkQueue = NewKeyedQueue()
+	for _, opt := range opts {
+		opt(nodewatcher)
+	}
+	if err := nodewatcher.cfg.Validate(); err != nil {
+		glog.Fatalf("Invalid node watcher configuration: %v", err)
+	}
+	nodewatcher.watchErrors = newWatchErrorTracker("nodes", nodewatcher.cfg.WatchErrorThreshold)
+	nodewatcher.failureLog = newFailureLog(nodewatcher.cfg.FailureLogInterval)
+	nodewatcher.nodeWorkQueue = NewKeyedQueue(WithQueueRetryPolicy(nodewatcher.cfg.QueueRetry), WithDeadLetter(nodewatcher.dropNodes))
+	nodewatcher.backlog = newBacklogLimiter("node", nodewatcher.cfg.MaxInFlightNodeEvents, metrics.InFlightNodeEvents)
 	return nodewatcher
 }
 
+// nodeEventHandler queues the node events of the informer.
+func (nw *NodeWatcher) nodeEventHandler() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    nw.onAdd,
+		UpdateFunc: nw.onUpdate,
+		DeleteFunc: nw.onDelete,
+	}
+}
+
+// onAdd queues the addition of a node received from the informer, the objects which are not nodes are dropped.
+func (nw *NodeWatcher) onAdd(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("AddFunc: error getting key %v", err)
+		return
+	}
+	if _, ok := obj.(*v1.Node); !ok {
+		glog.Errorf("AddFunc: unexpected object %T for key %s", obj, key)
+		return
+	}
+	nw.enqueueNodeAddition(key, obj)
+}
+
+// onUpdate queues the update of a node received from the informer, the objects which are not nodes are dropped.
+func (nw *NodeWatcher) onUpdate(oldObj, newObj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(newObj)
+	if err != nil {
+		glog.Errorf("UpdateFunc: error getting key %v", err)
+		return
+	}
+	_, oldOK := oldObj.(*v1.Node)
+	_, newOK := newObj.(*v1.Node)
+	if !oldOK || !newOK {
+		glog.Errorf("UpdateFunc: unexpected objects %T and %T for key %s", oldObj, newObj, key)
+		return
+	}
+	nw.enqueueNodeUpdate(key, oldObj, newObj)
+}
+
+// onDelete queues the deletion of a node received from the informer, either the node or the tombstone of a
+// deletion missed by the watch.
+func (nw *NodeWatcher) onDelete(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("DeleteFunc: error getting key %v", err)
+		return
+	}
+	nw.enqueueNodeDeletion(key, obj)
+}
+
 func (nw *NodeWatcher) getReadyAndOutOfDiskConditions(node *v1.Node) (isReady bool, isOutOfDisk bool) {
 	isReady = false
 	isOutOfDisk = false
@@ -106,64 +255,287 @@ func (nw *NodeWatcher) getTaints(node *v1.Node) []Taint {
 	return taints
 }
 
-func (nw *NodeWatcher) parseNode(node *v1.Node, phase NodePhase) *Node {
+// maxMilliQuantity is the largest quantity whose milli value fits into an int64.
+var maxMilliQuantity = resource.NewMilliQuantity(math.MaxInt64, resource.DecimalSI)
+
+// getMilliValue returns the milli value of a node resource quantity. It returns an error if the quantity
+// is negative or if its milli value can not be represented as an int64.
+func getMilliValue(resources v1.ResourceList, name v1.ResourceName) (int64, error) {
+	quantity := resources[name]
+	if quantity.Sign() < 0 || quantity.Cmp(*maxMilliQuantity) > 0 {
+		return 0, fmt.Errorf("unparsable %s quantity %s", name, quantity.String())
+	}
+	return quantity.MilliValue(), nil
+}
+
+// HugePagesCapacityLabelSuffix is appended to the hugepages resource names to build the resource labels
+// advertising the hugepages capacities of a node, e.g. hugepages-2MiCapacityKb, since the firmament
+// resource vector has no field for them.
+const HugePagesCapacityLabelSuffix = "CapacityKb"
+
+// getHugePagesKb returns the hugepages quantities in Kb keyed by the hugepages resource name,
+// or nil if there are no hugepages resources.
+func getHugePagesKb(resources v1.ResourceList) (map[v1.ResourceName]int64, error) {
+	var hugePages map[v1.ResourceName]int64
+	for name, quantity := range resources {
+		if !strings.HasPrefix(string(name), v1.ResourceHugePagesPrefix) {
+			continue
+		}
+		if quantity.Sign() < 0 {
+			return nil, fmt.Errorf("unparsable %s quantity %s", name, quantity.String())
+		}
+		if hugePages == nil {
+			hugePages = make(map[v1.ResourceName]int64)
+		}
+		hugePages[name] = units.BytesToKB(quantity.Value())
+	}
+	return hugePages, nil
+}
+
+// Labels advertising the first internal IPv4 and IPv6 addresses of a node, since the firmament resource
+// descriptor has no field for the node addresses.
+const (
+	InternalIPv4Label = "address.poseidon/internal-ipv4"
+	InternalIPv6Label = "address.poseidon/internal-ipv6"
+)
+
+// getNodeAddresses returns the internal IP, external IP and hostname addresses of the node in the order
+// reported by the kubelet, or nil if there are none.
+func getNodeAddresses(node *v1.Node) []v1.NodeAddress {
+	var addresses []v1.NodeAddress
+	for _, address := range node.Status.Addresses {
+		switch address.Type {
+		case v1.NodeInternalIP, v1.NodeExternalIP, v1.NodeHostName:
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// getAddressLabels returns the resource labels advertising the first internal IPv4 and IPv6 addresses of
+// the node.
+func getAddressLabels(node *Node) []*firmament.Label {
+	var ipv4, ipv6 string
+	for _, address := range node.Addresses {
+		if address.Type != v1.NodeInternalIP {
+			continue
+		}
+		ip := net.ParseIP(address.Address)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			if ipv4 == "" {
+				ipv4 = ip.String()
+			}
+		} else if ipv6 == "" {
+			ipv6 = ip.String()
+		}
+	}
+	var labels []*firmament.Label
+	if ipv4 != "" {
+		labels = append(labels, &firmament.Label{Key: InternalIPv4Label, Value: ipv4})
+	}
+	if ipv6 != "" {
+		labels = append(labels, &firmament.Label{Key: InternalIPv6Label, Value: ipv6})
+	}
+	return labels
+}
+
+// getNodeLabels returns the resource labels of the node sorted by key, followed by the hugepages, the
+// address and the taint labels, so that the same node always produces the same resource descriptor.
+func getNodeLabels(node *Node) []*firmament.Label {
+	keys := make([]string, 0, len(node.Labels))
+	for key := range node.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var labels []*firmament.Label
+	for _, key := range keys {
+		labels = append(labels, &firmament.Label{
+			Key:   key,
+			Value: node.Labels[key],
+		})
+	}
+	labels = append(labels, getHugePagesLabels(node)...)
+	labels = append(labels, getAddressLabels(node)...)
+	return append(labels, getTaintLabels(node)...)
+}
+
+// getHugePagesLabels returns the resource labels advertising the hugepages capacities of the node,
+// sorted by resource name.
+func getHugePagesLabels(node *Node) []*firmament.Label {
+	var names []string
+	for name := range node.HugePagesCapKb {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	var labels []*firmament.Label
+	for _, name := range names {
+		labels = append(labels, &firmament.Label{
+			Key:   name + HugePagesCapacityLabelSuffix,
+			Value: strconv.FormatInt(node.HugePagesCapKb[v1.ResourceName(name)], 10),
+		})
+	}
+	return labels
+}
+
+func (nw *NodeWatcher) parseNode(node *v1.Node, phase NodePhase) (*Node, error) {
 	isReady, isOutOfDisk := nw.getReadyAndOutOfDiskConditions(node)
-	cpuCapQuantity := node.Status.Capacity[v1.ResourceCPU]
-	cpuAllocQuantity := node.Status.Allocatable[v1.ResourceCPU]
-	memCapQuantity := node.Status.Capacity[v1.ResourceMemory]
-	memCap := memCapQuantity.MilliValue()
-	memAllocQuantity := node.Status.Allocatable[v1.ResourceMemory]
-	memAlloc := memAllocQuantity.MilliValue()
-	ephemeralCapQty := node.Status.Capacity[v1.ResourceEphemeralStorage]
-	ephemeralCap := ephemeralCapQty.MilliValue()
-	ephemeralAllocQty := node.Status.Allocatable[v1.ResourceEphemeralStorage]
-	ephemeralAlloc := ephemeralAllocQty.MilliValue()
+	cpuCap, err := getMilliValue(node.Status.Capacity, v1.ResourceCPU)
+	if err != nil {
+		return nil, err
+	}
+	cpuAlloc, err := getMilliValue(node.Status.Allocatable, v1.ResourceCPU)
+	if err != nil {
+		return nil, err
+	}
+	memCap, err := getMemoryValue(node.Status.Capacity, nw.cfg.MemoryUnit)
+	if err != nil {
+		return nil, err
+	}
+	memAlloc, err := getMemoryValue(node.Status.Allocatable, nw.cfg.MemoryUnit)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralCap, err := getMilliValue(node.Status.Capacity, v1.ResourceEphemeralStorage)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralAlloc, err := getMilliValue(node.Status.Allocatable, v1.ResourceEphemeralStorage)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getMilliValue(node.Status.Allocatable, v1.ResourcePods); err != nil {
+		return nil, err
+	}
 	podAllocQuantity := node.Status.Allocatable[v1.ResourcePods]
+	hugePagesCap, err := getHugePagesKb(node.Status.Capacity)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Node{
 		Hostname:         node.Name,
+		UID:              string(node.UID),
 		Phase:            phase,
 		IsReady:          isReady,
 		IsOutOfDisk:      isOutOfDisk,
-		CPUCapacity:      cpuCapQuantity.MilliValue(),
-		CPUAllocatable:   cpuAllocQuantity.MilliValue(),
+		CPUCapacity:      cpuCap,
+		CPUAllocatable:   cpuAlloc,
 		MemCapacityKb:    memCap,
 		MemAllocatableKb: memAlloc,
 		EphemeralCapKb:   ephemeralCap,
 		EphemeralAllocKb: ephemeralAlloc,
 		PodAllocatable:   podAllocQuantity.Value(),
+		HugePagesCapKb:   hugePagesCap,
 		Labels:           node.Labels,
 		Annotations:      node.Annotations,
 		Taints:           nw.getTaints(node),
+		Addresses:        getNodeAddresses(node),
+	}, nil
+}
+
+// isControlPlaneNode checks if the node bears a control plane role label or a NoSchedule control plane taint.
+func isControlPlaneNode(node *v1.Node) bool {
+	for _, role := range []string{ControlPlaneRoleLabel, MasterRoleLabel} {
+		if _, ok := node.Labels[role]; ok {
+			return true
+		}
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == role && taint.Effect == v1.TaintEffectNoSchedule {
+				return true
+			}
+		}
 	}
+	return false
+}
+
+// isExcludedNode checks if the node must not be advertised to firmament.
+func (nw *NodeWatcher) isExcludedNode(node *v1.Node) bool {
+	return node.Spec.Unschedulable || (nw.cfg.ExcludeControlPlane && isControlPlaneNode(node))
+}
+
+// queueNode queues the event of a node once the backlog of the workers is below MaxInFlightNodeEvents. The
+// event handlers of the informer block meanwhile, which pauses the delivery of the node events.
+func (nw *NodeWatcher) queueNode(key interface{}, node *Node) {
+	nw.backlog.acquire()
+	nw.nodeWorkQueue.Add(key, node)
 }
 
 func (nw *NodeWatcher) enqueueNodeAddition(key, obj interface{}) {
 	node := obj.(*v1.Node)
 	if node.Spec.Unschedulable {
-		glog.Info("enqueueNodeAddition: received an Unschedulable node", node.Name)
+		logging.Info("enqueueNodeAddition: skipping an unschedulable node", "hostname", node.Name)
+		return
+	}
+	if nw.cfg.ExcludeControlPlane && isControlPlaneNode(node) {
+		logging.Info("enqueueNodeAddition: excluding a control plane node", "hostname", node.Name)
+		return
+	}
+	if nw.deferZeroAllocatableNode(node) {
 		return
 	}
-	addedNode := nw.parseNode(node, NodeAdded)
-	nw.nodeWorkQueue.Add(key, addedNode)
-	glog.Info("enqueueNodeAdition: Added node ", addedNode.Hostname)
+	addedNode, err := nw.parseNode(node, NodeAdded)
+	if err != nil {
+		logging.Error("enqueueNodeAddition: skipping node", "hostname", node.Name, "err", err)
+		return
+	}
+	nw.queueNode(key, addedNode)
+	logging.Info("enqueueNodeAddition: added node", "hostname", addedNode.Hostname, "phase", addedNode.Phase)
 }
 
 func (nw *NodeWatcher) enqueueNodeUpdate(key, oldObj, newObj interface{}) {
 	// XXX(ionel): enqueueNodeUpdate gets called whenever one of node's timestamp is updated. Figure out solution such that the method is called only when certain fields change.
 	oldNode := oldObj.(*v1.Node)
 	newNode := newObj.(*v1.Node)
-	if oldNode.Spec.Unschedulable != newNode.Spec.Unschedulable {
-		if oldNode.Spec.Unschedulable {
-			addedNode := nw.parseNode(newNode, NodeAdded)
-			nw.nodeWorkQueue.Add(key, addedNode)
-			glog.Info("enqueueNodeUpdate: Added node ", addedNode.Hostname)
+	oldIsExcluded, newIsExcluded := nw.isExcludedNode(oldNode), nw.isExcludedNode(newNode)
+	if nw.isDeferredNode(newNode.Name) {
+		// The node was never added, it is added once it reports allocatable resources.
+		if newIsExcluded {
+			nw.forgetDeferredNode(newNode.Name)
+			return
+		}
+		if nw.deferZeroAllocatableNode(newNode) {
 			return
 		}
-		// Can not schedule pods on the node any more.
-		deletedNode := nw.parseNode(newNode, NodeDeleted)
-		nw.nodeWorkQueue.Add(key, deletedNode)
-		glog.Info("enqueueNodeUpdate: Deleted node ", deletedNode.Hostname)
+		nw.forgetDeferredNode(newNode.Name)
+		addedNode, err := nw.parseNode(newNode, NodeAdded)
+		if err != nil {
+			logging.Error("enqueueNodeUpdate: skipping node", "hostname", newNode.Name, "err", err)
+			return
+		}
+		nw.queueNode(key, addedNode)
+		logging.Info("enqueueNodeUpdate: added deferred node", "hostname", addedNode.Hostname, "phase", addedNode.Phase)
+		return
+	}
+	if oldIsExcluded && newIsExcluded {
+		return
+	}
+	if oldIsExcluded != newIsExcluded {
+		if oldIsExcluded {
+			if nw.deferZeroAllocatableNode(newNode) {
+				return
+			}
+			addedNode, err := nw.parseNode(newNode, NodeAdded)
+			if err != nil {
+				logging.Error("enqueueNodeUpdate: skipping node", "hostname", newNode.Name, "err", err)
+				return
+			}
+			nw.queueNode(key, addedNode)
+			logging.Info("enqueueNodeUpdate: added node", "hostname", addedNode.Hostname, "phase", addedNode.Phase)
+			return
+		}
+		nw.cancelNodeFailure(newNode.Name)
+		// Can not schedule pods on the node any more, it became unschedulable or a control plane node.
+		// The node is removed based on its name only, so that nodes with unparsable resource quantities
+		// are removed as well.
+		deletedNode := &Node{
+			Hostname: newNode.Name,
+			Phase:    NodeDeleted,
+		}
+		nw.queueNode(key, deletedNode)
+		logging.Info("enqueueNodeUpdate: deleted node", "hostname", deletedNode.Hostname, "phase", deletedNode.Phase)
 		return
 	}
 	oldIsReady, oldIsOutOfDisk := nw.getReadyAndOutOfDiskConditions(oldNode)
@@ -171,14 +543,24 @@ func (nw *NodeWatcher) enqueueNodeUpdate(key, oldObj, newObj interface{}) {
 
 	if oldIsReady != newIsReady || oldIsOutOfDisk != newIsOutOfDisk {
 		if newIsReady && !newIsOutOfDisk {
-			addedNode := nw.parseNode(newNode, NodeAdded)
-			nw.nodeWorkQueue.Add(key, addedNode)
-			glog.Info("enqueueNodeUpdate: Added node ", addedNode.Hostname)
+			if nw.cancelNodeFailure(newNode.Name) {
+				// The node recovered within its grace period, it was not failed.
+				logging.Info("enqueueNodeUpdate: node recovered within its grace period", "hostname", newNode.Name)
+				return
+			}
+			if nw.deferZeroAllocatableNode(newNode) {
+				return
+			}
+			recoveredNode, err := nw.parseNode(newNode, NodeRecovered)
+			if err != nil {
+				logging.Error("enqueueNodeUpdate: skipping node", "hostname", newNode.Name, "err", err)
+				return
+			}
+			nw.queueNode(key, recoveredNode)
+			logging.Info("enqueueNodeUpdate: recovered failed node", "hostname", recoveredNode.Hostname, "phase", recoveredNode.Phase)
 			return
 		}
-		failedNode := nw.parseNode(newNode, NodeFailed)
-		nw.nodeWorkQueue.Add(key, failedNode)
-		glog.Info("enqueueNodeUpdate: Failed node ", failedNode.Hostname)
+		nw.enqueueNodeFailure(key, newNode.Name)
 		return
 	}
 	nodeUpdated := false
@@ -191,124 +573,540 @@ func (nw *NodeWatcher) enqueueNodeUpdate(key, oldObj, newObj interface{}) {
 	if !reflect.DeepEqual(oldNode.Spec.Taints, newNode.Spec.Taints) {
 		nodeUpdated = true
 	}
+	if !reflect.DeepEqual(getNodeAddresses(oldNode), getNodeAddresses(newNode)) {
+		nodeUpdated = true
+	}
+	oldHugePages, _ := getHugePagesKb(oldNode.Status.Capacity)
+	newHugePages, _ := getHugePagesKb(newNode.Status.Capacity)
+	if !reflect.DeepEqual(oldHugePages, newHugePages) {
+		nodeUpdated = true
+	}
 	if nodeUpdated {
-		updatedNode := nw.parseNode(newNode, NodeUpdated)
-		nw.nodeWorkQueue.Add(key, updatedNode)
-		glog.Info("enqueueNodeUpdate: Updated node ", updatedNode.Hostname)
+		updatedNode, err := nw.parseNode(newNode, NodeUpdated)
+		if err != nil {
+			logging.Error("enqueueNodeUpdate: skipping node", "hostname", newNode.Name, "err", err)
+			return
+		}
+		nw.queueNode(key, updatedNode)
+		logging.Info("enqueueNodeUpdate: updated node", "hostname", updatedNode.Hostname, "phase", updatedNode.Phase)
 	}
 }
 
 func (nw *NodeWatcher) enqueueNodeDeletion(key, obj interface{}) {
-	node := obj.(*v1.Node)
-	if node.Spec.Unschedulable {
-		// Poseidon doesn't care about Unschedulable nodes.
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		// The deletion was missed by the watch, the last known state of the node is in the tombstone.
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			logging.Error("enqueueNodeDeletion: unexpected object", "object", fmt.Sprintf("%T", obj))
+			return
+		}
+		if node, ok = tombstone.Obj.(*v1.Node); !ok {
+			logging.Error("enqueueNodeDeletion: tombstone contains an unexpected object", "key", tombstone.Key, "object", fmt.Sprintf("%T", tombstone.Obj))
+			return
+		}
+	}
+	nw.cancelNodeFailure(node.Name)
+	if nw.forgetDeferredNode(node.Name) {
+		// The node was never added to firmament.
+		return
+	}
+	if nw.isExcludedNode(node) {
+		// Poseidon doesn't care about Unschedulable and excluded control plane nodes.
 		return
 	}
 	deletedNode := &Node{
 		Hostname: node.Name,
 		Phase:    NodeDeleted,
 	}
-	nw.nodeWorkQueue.Add(key, deletedNode)
-	glog.Info("enqueueNodeDeletion: Deleted node ", deletedNode.Hostname)
+	nw.queueNode(key, deletedNode)
+	logging.Info("enqueueNodeDeletion: deleted node", "hostname", deletedNode.Hostname, "phase", deletedNode.Phase)
 }
 
-// Run starts node watcher.
-func (nw *NodeWatcher) Run(stopCh <-chan struct{}, nWorkers int) {
+// enqueueNodeFailure fails the node once it stayed not ready for the grace period, or right away without grace period.
+func (nw *NodeWatcher) enqueueNodeFailure(key interface{}, nodeName string) {
+	fail := func() {
+		failedNode := &Node{
+			Hostname: nodeName,
+			Phase:    NodeFailed,
+		}
+		nw.queueNode(key, failedNode)
+		logging.Info("enqueueNodeFailure: failed node", "hostname", failedNode.Hostname, "phase", failedNode.Phase)
+	}
+	if nw.cfg.NotReadyGracePeriod <= 0 {
+		fail()
+		return
+	}
+	nw.notReadyLock.Lock()
+	defer nw.notReadyLock.Unlock()
+	if _, ok := nw.notReadyTimers[nodeName]; ok {
+		return
+	}
+	logging.Info("enqueueNodeFailure: node is not ready, failing it after the grace period", "hostname", nodeName, "gracePeriod", nw.cfg.NotReadyGracePeriod)
+	var timer *time.Timer
+	timer = time.AfterFunc(nw.cfg.NotReadyGracePeriod, func() {
+		nw.notReadyLock.Lock()
+		// The timer may have been cancelled while it fired.
+		if nw.notReadyTimers[nodeName] != timer {
+			nw.notReadyLock.Unlock()
+			return
+		}
+		delete(nw.notReadyTimers, nodeName)
+		nw.notReadyLock.Unlock()
+		fail()
+	})
+	nw.notReadyTimers[nodeName] = timer
+}
+
+// cancelNodeFailure stops the grace period of a not ready node. It returns false if the node was
+// not within its grace period.
+func (nw *NodeWatcher) cancelNodeFailure(nodeName string) bool {
+	nw.notReadyLock.Lock()
+	defer nw.notReadyLock.Unlock()
+	timer, ok := nw.notReadyTimers[nodeName]
+	if !ok {
+		return false
+	}
+	timer.Stop()
+	delete(nw.notReadyTimers, nodeName)
+	return true
+}
+
+// deferZeroAllocatableNode defers the addition of a node which reports zero allocatable cpu or memory,
+// firmament would treat it as a real machine which cannot run any task. It returns true if the node is deferred.
+func (nw *NodeWatcher) deferZeroAllocatableNode(node *v1.Node) bool {
+	cpu := node.Status.Allocatable[v1.ResourceCPU]
+	mem := node.Status.Allocatable[v1.ResourceMemory]
+	if !cpu.IsZero() && !mem.IsZero() {
+		return false
+	}
+	glog.Warningf("Deferring node %s until it reports allocatable resources, got cpu %s memory %s", node.Name, cpu.String(), mem.String())
+	nw.deferredLock.Lock()
+	defer nw.deferredLock.Unlock()
+	nw.deferredNodes[node.Name] = true
+	return true
+}
+
+func (nw *NodeWatcher) isDeferredNode(nodeName string) bool {
+	nw.deferredLock.Lock()
+	defer nw.deferredLock.Unlock()
+	return nw.deferredNodes[nodeName]
+}
+
+// forgetDeferredNode returns false if the node was not deferred.
+func (nw *NodeWatcher) forgetDeferredNode(nodeName string) bool {
+	nw.deferredLock.Lock()
+	defer nw.deferredLock.Unlock()
+	deferred := nw.deferredNodes[nodeName]
+	delete(nw.deferredNodes, nodeName)
+	return deferred
+}
+
+// notifyNodeAdded wakes up the WaitForNodes callers.
+func (nw *NodeWatcher) notifyNodeAdded() {
+	nw.nodeAddedLock.Lock()
+	defer nw.nodeAddedLock.Unlock()
+	close(nw.nodeAdded)
+	nw.nodeAdded = make(chan struct{})
+}
+
+// WaitForNodes blocks until at least one node is tracked by the node watcher. It returns the
+// context error if the context is cancelled first, e.g. because the watcher is shut down.
+func (nw *NodeWatcher) WaitForNodes(ctx context.Context) error {
+	for {
+		// The channel is taken before the nodes are counted, so that a node added in between is not missed.
+		nw.nodeAddedLock.Lock()
+		nodeAdded := nw.nodeAdded
+		nw.nodeAddedLock.Unlock()
+		NodeMux.RLock()
+		numNodes := len(NodeToRTND)
+		NodeMux.RUnlock()
+		if numNodes > 0 {
+			return nil
+		}
+		select {
+		case <-nodeAdded:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Run starts node watcher. Once ctx is cancelled, it returns nil after the workers processed the queued nodes.
+// An error is returned if the number of workers is invalid, see getWorkerCount, or if the caches did not sync
+// within the cache sync timeout, so that the caller may restart the watcher or exit.
+func (nw *NodeWatcher) Run(ctx context.Context, nWorkers int) error {
+	workers, err := getWorkerCount(nWorkers, nw.cfg.MaxWorkers)
+	if err != nil {
+		return err
+	}
+	restart, err := getWorkerRestart(nw.cfg.WorkerRestartPeriod, nw.cfg.WorkerRestartJitter)
+	if err != nil {
+		return err
+	}
 	defer utilruntime.HandleCrash()
+	stopCh := ctx.Done()
 
 	// The workers can stop when we are done.
+	defer nw.backlog.close()
 	defer nw.nodeWorkQueue.ShutDown()
 	defer glog.Info("Shutting down NodeWatcher")
 	glog.Info("Getting node updates...")
 
-	go nw.controller.Run(stopCh)
-
-	if !cache.WaitForCacheSync(stopCh, nw.controller.HasSynced) {
-		utilruntime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
-		return
+	if !nw.sharedInformer {
+		go nw.controller.Run(stopCh)
 	}
 
-	glog.Info("Starting node watching workers")
-	for i := 0; i < nWorkers; i++ {
-		go wait.Until(nw.nodeWorker, time.Second, stopCh)
+	if ok, err := waitForCacheSync(ctx, "node", nw.controller.HasSynced); !ok {
+		return err
 	}
+	atomic.StoreInt32(&nodeCachesSynced, 1)
+
+	glog.Infof("Starting %d node watching workers", workers)
+	var running sync.WaitGroup
+	startWorkers(nw.nodeWorker, workers, restart, stopCh, &running)
+	go wait.Until(func() { nw.checkStateConsistency() }, stateConsistencyCheckInterval, stopCh)
 
 	<-stopCh
-	glog.Info("Stopping node watcher")
+	// The nodes queued so far are still sent to firmament, the workers return once the queue is drained.
+	glog.Infof("Stopping node watcher, draining %d queued nodes", nw.nodeWorkQueue.Len())
+	nw.nodeWorkQueue.ShutDown()
+	nw.backlog.close()
+	running.Wait()
+	return nil
 }
 
 func (nw *NodeWatcher) nodeWorker() {
-	for {
-		func() {
-			key, items, quit := nw.nodeWorkQueue.Get()
-			if quit {
-				return
+	for nw.processNextItem() {
+	}
+}
+
+// processNextItem handles the next node key of the work queue. It returns false once the queue
+// is shut down. Done is called exactly once for every key returned by Get, since the queue does
+// not hand out a key again before Done is called for it.
+func (nw *NodeWatcher) processNextItem() bool {
+	key, items, quit := nw.nodeWorkQueue.Get()
+	if quit {
+		return false
+	}
+	done := heartbeats.start(LoopNodes)
+	defer done()
+	ctx, span := nw.tracer.Start(context.Background(), "poseidon.ProcessNode", map[string]string{traceNodeAttribute: fmt.Sprint(key)})
+	retry := nw.processNodes(ctx, items)
+	if len(retry) > 0 {
+		nw.nodeWorkQueue.AddRateLimited(key, retry...)
+	} else {
+		nw.nodeWorkQueue.Forget(key)
+	}
+	span.End()
+	nw.nodeWorkQueue.Done(key)
+	// The requeued events are still in flight.
+	nw.backlog.release(len(items) - len(retry))
+	triggerScheduleOnDrain(nw.nodeWorkQueue.Len())
+	return true
+}
+
+// processNodes applies the queued changes of a node to firmament and to the node state.
+// The requests sent to firmament are traced as children of the span carried by the context.
+// Once a request to firmament fails with a transient error, e.g. times out, the node state is left as before the
+// change and the change and the next ones are returned to be processed again, see retryNodes. The topology of a node whose addition failed is
+// removed from firmament at once, or before the node is added again if its removal fails too, see removePartialNode.
+func (nw *NodeWatcher) processNodes(ctx context.Context, items []interface{}) []interface{} {
+	for i, item := range items {
+		node := item.(*Node)
+		phase := nw.nodePhase(node)
+		watcherEvents.WithLabelValues("nodes", string(phase)).Inc()
+		switch phase {
+		case NodeAdded:
+			if err := nw.removePartialNode(ctx, node); err != nil {
+				return nw.retryNodes(ctx, node, err, items[i:])
 			}
-			for _, item := range items {
-				node := item.(*Node)
-				switch node.Phase {
-				case NodeAdded:
-					NodeMux.Lock()
-					rtnd := nw.createResourceTopologyForNode(node)
-					_, ok := NodeToRTND[node.Hostname]
-					if ok {
-						glog.Infof("Node %s already exists", node.Hostname)
-						NodeMux.Unlock()
-						continue
-					}
-					NodeToRTND[node.Hostname] = rtnd
-					glog.Info(NodeToRTND, " in Nodedded")
-					ResIDToNode[rtnd.GetResourceDesc().GetUuid()] = node.Hostname
-					NodeMux.Unlock()
-					firmament.NodeAdded(nw.fc, rtnd)
-
-				case NodeDeleted:
-					NodeMux.RLock()
-					rtnd, ok := NodeToRTND[node.Hostname]
-					NodeMux.RUnlock()
-					if !ok {
-						glog.Fatalf("Node %s does not exist", node.Hostname)
-					}
-					resID := rtnd.GetResourceDesc().GetUuid()
-					firmament.NodeRemoved(nw.fc, &firmament.ResourceUID{ResourceUid: resID})
-					NodeMux.Lock()
-					nw.cleanResourceStateForNode(rtnd)
-					delete(NodeToRTND, node.Hostname)
-					delete(ResIDToNode, resID)
-					NodeMux.Unlock()
-					glog.Info(NodeToRTND, " in NodeDeleted")
-				case NodeFailed:
-					NodeMux.RLock()
-					rtnd, ok := NodeToRTND[node.Hostname]
-					NodeMux.RUnlock()
-					if !ok {
-						glog.Fatalf("Node %s does not exist", node.Hostname)
-					}
-					resID := rtnd.GetResourceDesc().GetUuid()
-					firmament.NodeFailed(nw.fc, &firmament.ResourceUID{ResourceUid: resID})
-					NodeMux.Lock()
-					nw.cleanResourceStateForNode(rtnd)
-					delete(NodeToRTND, node.Hostname)
-					delete(ResIDToNode, resID)
+			// The topology is read before NodeMux is held, it requires a request to the API server.
+			node.Topology = nw.getNodeTopology(node.Hostname)
+			NodeMux.Lock()
+			// Check for the node before registering the resource IDs of its topology in ResIDToNode,
+			// the IDs of a duplicate node would not be cleaned up. A node quickly uncordoned twice
+			// is added twice, the second addition is a no-op.
+			_, ok := NodeToRTND[node.Hostname]
+			if ok {
+				// Two nodes sharing a name, e.g. in virtual kubelet setups, would be advertised with the
+				// same resource IDs, the duplicate is skipped.
+				if uid := nodeToUID[node.Hostname]; uid != "" && node.UID != "" && uid != node.UID {
 					NodeMux.Unlock()
-					glog.Info(NodeToRTND, " in NodFailed")
-				case NodeUpdated:
-					NodeMux.RLock()
-					rtnd, ok := NodeToRTND[node.Hostname]
-					if !ok {
-						glog.Fatalf("Node %s does not exist", node.Hostname)
-					}
-					nw.updateResourceDescriptor(node, rtnd)
-					NodeMux.RUnlock()
-					firmament.NodeUpdated(nw.fc, rtnd)
-					glog.Info(NodeToRTND, " in NodeUpdated")
-				default:
-					glog.Fatalf("Unexpected node %s phase %s", node.Hostname, node.Phase)
+					logging.Error("processNodes: skipping duplicate node, a node of the same name is tracked",
+						"hostname", node.Hostname, "uid", node.UID, "trackedUID", uid)
+					metrics.DuplicateNodes.Inc()
+					continue
+				}
+				logging.Info("processNodes: node already exists", "hostname", node.Hostname)
+				NodeMux.Unlock()
+				continue
+			}
+			rtnd := nw.createResourceTopologyForNode(node)
+			NodeToRTND[node.Hostname] = rtnd
+			nodeToUID[node.Hostname] = node.UID
+			nw.registerResourceStateForNode(rtnd, node.Hostname)
+			nodes := len(NodeToRTND)
+			NodeMux.Unlock()
+			logging.Info("processNodes: adding node", "hostname", node.Hostname, "resourceUUID", rtnd.GetResourceDesc().GetUuid(), "nodes", nodes)
+			err := nw.traceFirmamentRequest(ctx, "firmament.NodeAdded", node, rtnd.GetResourceDesc().GetUuid(), func(ctx context.Context) error {
+				return nw.fc.NodeAdded(ctx, rtnd)
+			})
+			if err != nil {
+				NodeMux.Lock()
+				nw.cleanResourceStateForNode(rtnd)
+				delete(NodeToRTND, node.Hostname)
+				delete(nodeToUID, node.Hostname)
+				NodeMux.Unlock()
+				nw.setPartialNode(node.Hostname, rtnd.GetResourceDesc().GetUuid())
+				// The part of the topology firmament applied is removed at once, so that no task is placed
+				// onto it until the node is added again.
+				if err := nw.removePartialNode(ctx, node); err != nil {
+					logging.V(2).Info("processNodes: removing the partially added node failed, removing it before the next addition",
+						"hostname", node.Hostname, "err", err)
+				}
+				return nw.retryNodes(ctx, node, err, items[i:])
+			}
+			nw.notifyNodeAdded()
+			SignalCapacityChange(rtnd.GetResourceDesc().GetAvailableResources())
+
+		case NodeDeleted:
+			NodeMux.RLock()
+			rtnd, ok := NodeToRTND[node.Hostname]
+			NodeMux.RUnlock()
+			if !ok {
+				// The node may have been skipped because of unparsable resource quantities, or already
+				// removed when it was quickly cordoned twice. The removal is a no-op then, but for the
+				// topology its failed addition may have left in firmament.
+				if err := nw.removePartialNode(ctx, node); err != nil {
+					return nw.retryNodes(ctx, node, err, items[i:])
+				}
+				logging.Info("processNodes: node does not exist, nothing to remove", "hostname", node.Hostname)
+				continue
+			}
+			resID := rtnd.GetResourceDesc().GetUuid()
+			err := nw.traceFirmamentRequest(ctx, "firmament.NodeRemoved", node, resID, func(ctx context.Context) error {
+				return nw.fc.NodeRemoved(ctx, &firmament.ResourceUID{ResourceUid: resID})
+			})
+			if err != nil {
+				return nw.retryNodes(ctx, node, err, items[i:])
+			}
+			NodeMux.Lock()
+			nw.cleanResourceStateForNode(rtnd)
+			delete(NodeToRTND, node.Hostname)
+			delete(nodeToUID, node.Hostname)
+			delete(ResIDToNode, resID)
+			NodeMux.Unlock()
+			logging.Info("processNodes: removed node", "hostname", node.Hostname, "resourceUUID", resID)
+		case NodeFailed:
+			NodeMux.RLock()
+			rtnd, ok := NodeToRTND[node.Hostname]
+			NodeMux.RUnlock()
+			if !ok {
+				if err := nw.removePartialNode(ctx, node); err != nil {
+					return nw.retryNodes(ctx, node, err, items[i:])
 				}
+				logging.Error("processNodes: node to fail does not exist", "hostname", node.Hostname)
+				continue
 			}
-			defer nw.nodeWorkQueue.Done(key)
-		}()
+			resID := rtnd.GetResourceDesc().GetUuid()
+			err := nw.traceFirmamentRequest(ctx, "firmament.NodeFailed", node, resID, func(ctx context.Context) error {
+				return nw.fc.NodeFailed(ctx, &firmament.ResourceUID{ResourceUid: resID})
+			})
+			if err != nil {
+				return nw.retryNodes(ctx, node, err, items[i:])
+			}
+			NodeMux.Lock()
+			nw.cleanResourceStateForNode(rtnd)
+			delete(NodeToRTND, node.Hostname)
+			delete(nodeToUID, node.Hostname)
+			delete(ResIDToNode, resID)
+			NodeMux.Unlock()
+			logging.Info("processNodes: failed node", "hostname", node.Hostname, "resourceUUID", resID)
+		case NodeUpdated:
+			NodeMux.RLock()
+			current, ok := NodeToRTND[node.Hostname]
+			var rtnd *firmament.ResourceTopologyNodeDescriptor
+			if ok {
+				rtnd = nw.updatedResourceDescriptor(node, current)
+			}
+			NodeMux.RUnlock()
+			if !ok {
+				logging.Error("processNodes: node to update does not exist", "hostname", node.Hostname)
+				continue
+			}
+			err := nw.traceFirmamentRequest(ctx, "firmament.NodeUpdated", node, rtnd.GetResourceDesc().GetUuid(), func(ctx context.Context) error {
+				return nw.fc.NodeUpdated(ctx, rtnd)
+			})
+			if firmament.IsNotFound(err) {
+				// Firmament lost the node, e.g. it restarted, the node is added again.
+				logging.Error("processNodes: node to update is not known by firmament, adding it again", "hostname", node.Hostname)
+				err = nw.traceFirmamentRequest(ctx, "firmament.NodeAdded", node, rtnd.GetResourceDesc().GetUuid(), func(ctx context.Context) error {
+					return nw.fc.NodeAdded(ctx, rtnd)
+				})
+			}
+			if err != nil {
+				return nw.retryNodes(ctx, node, err, items[i:])
+			}
+			NodeMux.Lock()
+			replaceNodeTopology(node.Hostname, current, rtnd)
+			NodeMux.Unlock()
+			nw.evictPodsNotToleratingNoExecuteTaints(node.Hostname, node.Taints)
+			logging.Info("processNodes: updated node", "hostname", node.Hostname, "resourceUUID", rtnd.GetResourceDesc().GetUuid())
+		default:
+			glog.Fatalf("Unexpected node %s phase %s", node.Hostname, node.Phase)
+		}
+		// The observers are only notified of the changes firmament accepted, the others continue the loop above.
+		nw.notifyObservers(node, phase)
+		nw.failureLog.Reset(node.Hostname)
+	}
+	return nil
+}
+
+// setPartialNode records the machine resource of the node whose addition failed, see removePartialNode.
+func (nw *NodeWatcher) setPartialNode(nodeName, resID string) {
+	nw.partialLock.Lock()
+	defer nw.partialLock.Unlock()
+	nw.partialNodes[nodeName] = resID
+}
+
+// removePartialNode removes the topology of the node from firmament if its last addition failed. Firmament may have
+// applied a part of the topology before failing, and would reply that the node already exists to the next addition.
+func (nw *NodeWatcher) removePartialNode(ctx context.Context, node *Node) error {
+	nw.partialLock.Lock()
+	resID, ok := nw.partialNodes[node.Hostname]
+	nw.partialLock.Unlock()
+	if !ok {
+		return nil
+	}
+	err := nw.traceFirmamentRequest(ctx, "firmament.NodeRemoved", node, resID, func(ctx context.Context) error {
+		return nw.fc.NodeRemoved(ctx, &firmament.ResourceUID{ResourceUid: resID})
+	})
+	if err != nil {
+		return err
+	}
+	nw.partialLock.Lock()
+	delete(nw.partialNodes, node.Hostname)
+	nw.partialLock.Unlock()
+	return nil
+}
+
+// nodePhase returns the phase the change of the node is processed as. A recovered node is added again
+// if its failure removed it, and updated if it is still tracked, e.g. it was added while not ready.
+func (nw *NodeWatcher) nodePhase(node *Node) NodePhase {
+	if node.Phase != NodeRecovered {
+		return node.Phase
+	}
+	NodeMux.RLock()
+	_, ok := NodeToRTND[node.Hostname]
+	NodeMux.RUnlock()
+	if ok {
+		glog.Infof("Node %s recovered, updating it", node.Hostname)
+		return NodeUpdated
 	}
+	glog.Infof("Node %s recovered, adding it again", node.Hostname)
+	return NodeAdded
+}
+
+// newFailureLog creates the limiter of the logs of the requests to firmament failing again and again, logged
+// once per interval.
+func newFailureLog(interval time.Duration) *firmament.LogLimiter {
+	return firmament.NewLogLimiter(interval, 1, glog.Errorf)
+}
+
+// retryNodes logs the request to firmament which failed for the change of the node. Once it failed with a transient
+// error, e.g. timed out or rejected while the circuit breaker is open, the changes are returned to be processed again.
+// The logs of a node are rate limited until its requests succeed. A change rejected by firmament is dropped, and the
+// next changes of the node are processed.
+func (nw *NodeWatcher) retryNodes(ctx context.Context, node *Node, err error, items []interface{}) []interface{} {
+	if !firmament.IsTransient(err) {
+		logging.Error("processNodes: dropping node change rejected by firmament", "hostname", node.Hostname, "phase", node.Phase, "err", err)
+		for _, observer := range nw.observers {
+			if observer.OnNodeDropped != nil {
+				observer.OnNodeDropped(node)
+			}
+		}
+		return nw.processNodes(ctx, items[1:])
+	}
+	nw.failureLog.Errorf(node.Hostname, "Request for node %s %s failed, processing it again: %v", node.Hostname, node.Phase, err)
+	if firmament.IsTimeout(err) {
+		metrics.FirmamentRequestTimeouts.Inc()
+	}
+	return items
+}
+
+// dropNodes drops the changes of a node which exhausted the retries of the work queue. The node state is left as
+// before the first change, the next event of the node, e.g. on resync, is processed as usual.
+func (nw *NodeWatcher) dropNodes(key interface{}, items []interface{}) {
+	logging.Error("processNextItem: dropping node changes, retries exhausted", "hostname", key, "changes", len(items))
+	metrics.WorkQueueDeadLetters.WithLabelValues("nodes").Add(float64(len(items)))
+	nw.backlog.release(len(items))
+	node := items[len(items)-1].(*Node)
+	for _, observer := range nw.observers {
+		if observer.OnNodeDropped != nil {
+			observer.OnNodeDropped(node)
+		}
+	}
+}
+
+// notifyObservers invokes the callbacks of the observers for the phase the change of the node was processed as.
+func (nw *NodeWatcher) notifyObservers(node *Node, phase NodePhase) {
+	for _, observer := range nw.observers {
+		var callback func(*Node)
+		switch phase {
+		case NodeAdded:
+			callback = observer.OnNodeAdded
+		case NodeDeleted:
+			callback = observer.OnNodeDeleted
+		case NodeFailed:
+			callback = observer.OnNodeFailed
+		case NodeUpdated:
+			callback = observer.OnNodeUpdated
+		}
+		if callback != nil {
+			callback(node)
+		}
+	}
+}
+
+// checkStateConsistency verifies that every resource of the topologies in NodeToRTND has a matching
+// ResIDToNode entry and vice versa. The offending keys are logged and counted in the state inconsistencies
+// metric. It returns the number of inconsistencies found.
+func (nw *NodeWatcher) checkStateConsistency() int {
+	NodeMux.RLock()
+	defer NodeMux.RUnlock()
+	nodeResIDs := make(map[string]string)
+	for nodeName, rtnd := range NodeToRTND {
+		collectResourceIDs(rtnd, nodeName, nodeResIDs)
+	}
+	inconsistencies := 0
+	for resID, nodeName := range nodeResIDs {
+		if resNodeName, ok := ResIDToNode[resID]; !ok || resNodeName != nodeName {
+			glog.Errorf("Resource %s of node %s has no matching ResIDToNode entry, found node %q", resID, nodeName, resNodeName)
+			inconsistencies++
+		}
+	}
+	for resID, nodeName := range ResIDToNode {
+		if _, ok := nodeResIDs[resID]; !ok {
+			glog.Errorf("ResIDToNode entry %s for node %s has no matching resource in NodeToRTND", resID, nodeName)
+			inconsistencies++
+		}
+	}
+	metrics.StateInconsistencies.Add(float64(inconsistencies))
+	return inconsistencies
+}
+
+func collectResourceIDs(rtnd *firmament.ResourceTopologyNodeDescriptor, nodeName string, resIDs map[string]string) {
+	resIDs[rtnd.GetResourceDesc().GetUuid()] = nodeName
+	for _, childRTND := range rtnd.GetChildren() {
+		collectResourceIDs(childRTND, nodeName, resIDs)
+	}
+}
+
+// registerResourceStateForNode maps the resource IDs of the topology of a node to the node. The node worker
+// is the only writer of ResIDToNode, the caller must hold NodeMux.
+func (nw *NodeWatcher) registerResourceStateForNode(rtnd *firmament.ResourceTopologyNodeDescriptor, nodeName string) {
+	collectResourceIDs(rtnd, nodeName, ResIDToNode)
 }
 
 func (nw *NodeWatcher) cleanResourceStateForNode(rtnd *firmament.ResourceTopologyNodeDescriptor) {
@@ -318,30 +1116,35 @@ func (nw *NodeWatcher) cleanResourceStateForNode(rtnd *firmament.ResourceTopolog
 	}
 }
 
+// overcommitCPU applies the cpu overcommit ratio to a node cpu quantity.
+func (nw *NodeWatcher) overcommitCPU(cpu int64) float32 {
+	return float32(float64(cpu) * nw.cfg.CPUOvercommitRatio)
+}
+
+// overcommitMem applies the memory overcommit ratio to a node memory quantity.
+func (nw *NodeWatcher) overcommitMem(mem int64) uint64 {
+	return uint64(float64(mem) * nw.cfg.MemOvercommitRatio)
+}
+
+// createResourceTopologyForNode builds the resource topology of a node. The resource IDs of the topology
+// are not registered in ResIDToNode, see registerResourceStateForNode.
 func (nw *NodeWatcher) createResourceTopologyForNode(node *Node) *firmament.ResourceTopologyNodeDescriptor {
-	resUUID := nw.generateResourceID(node.Hostname)
+	friendlyName := nw.generateFriendlyName(node)
+	resUUID := nw.generateResourceID(node, friendlyName)
 	rtnd := &firmament.ResourceTopologyNodeDescriptor{
 		ResourceDesc: &firmament.ResourceDescriptor{
-			Uuid:         resUUID,
-			Type:         firmament.ResourceDescriptor_RESOURCE_MACHINE,
-			State:        firmament.ResourceDescriptor_RESOURCE_IDLE,
-			FriendlyName: node.Hostname,
-			ResourceCapacity: &firmament.ResourceVector{
-				RamCap:       uint64(node.MemCapacityKb),
-				CpuCores:     float32(node.CPUCapacity),
-				EphemeralCap: uint64(node.EphemeralCapKb),
-			},
+			Uuid:             resUUID,
+			Type:             firmament.ResourceDescriptor_RESOURCE_MACHINE,
+			State:            firmament.ResourceDescriptor_RESOURCE_IDLE,
+			FriendlyName:     friendlyName,
+			ResourceCapacity: nw.nodeCapacity(node),
 			AvailableResources: &firmament.ResourceVector{
-				RamCap:       uint64(node.MemAllocatableKb),
-				CpuCores:     float32(node.CPUAllocatable),
+				RamCap:       nw.overcommitMem(node.MemAllocatableKb),
+				CpuCores:     nw.overcommitCPU(node.CPUAllocatable),
 				EphemeralCap: uint64(node.EphemeralAllocKb),
 			},
-			ReservedResources: &firmament.ResourceVector{
-				RamCap:       uint64(node.MemCapacityKb - node.MemAllocatableKb),
-				CpuCores:     float32(node.CPUCapacity - node.CPUAllocatable),
-				EphemeralCap: uint64(node.EphemeralCapKb - node.EphemeralAllocKb),
-			},
-			MaxPods: uint64(node.PodAllocatable),
+			ReservedResources: nw.nodeReservation(node),
+			MaxPods:           uint64(node.PodAllocatable),
 		},
 	}
 
@@ -350,17 +1153,11 @@ func (nw *NodeWatcher) createResourceTopologyForNode(node *Node) *firmament.Reso
 		glog.Error("Unable to retrieve avoid-pods annotation for the node", err)
 	}
 	rtnd.ResourceDesc.Avoids = avoidPods
+	reservePreassignedPodsOnNode(node.Hostname, rtnd.ResourceDesc)
 
-	ResIDToNode[resUUID] = node.Hostname
 	// TODO(ionel) Add annotations.
 	// Add labels.
-	for label, value := range node.Labels {
-		rtnd.ResourceDesc.Labels = append(rtnd.ResourceDesc.Labels,
-			&firmament.Label{
-				Key:   label,
-				Value: value,
-			})
-	}
+	rtnd.ResourceDesc.Labels = getNodeLabels(node)
 
 	for _, taint := range node.Taints {
 		rtnd.ResourceDesc.Taints = append(rtnd.ResourceDesc.Taints,
@@ -371,57 +1168,164 @@ func (nw *NodeWatcher) createResourceTopologyForNode(node *Node) *firmament.Reso
 			})
 	}
 
-	// TODO(ionel): In the future, we want to get real node topology.
-	// We currently only create a PU per machine because Heapster doesn't
-	// provide per PU/core statistics.
-	friendlyName := node.Hostname + "_PU #0"
-	puUUID := nw.generateResourceID(friendlyName)
-	puRtnd := &firmament.ResourceTopologyNodeDescriptor{
-		ResourceDesc: &firmament.ResourceDescriptor{
-			Uuid:         puUUID,
-			Type:         firmament.ResourceDescriptor_RESOURCE_PU,
-			State:        firmament.ResourceDescriptor_RESOURCE_IDLE,
-			FriendlyName: friendlyName,
-			Labels:       rtnd.ResourceDesc.Labels,
-			ResourceCapacity: &firmament.ResourceVector{
-				RamCap:       uint64(node.MemCapacityKb),
-				CpuCores:     float32(node.CPUCapacity),
-				EphemeralCap: uint64(node.EphemeralCapKb),
-			},
-			Taints: rtnd.ResourceDesc.Taints,
-		},
-		ParentId: resUUID,
+	if zones := getNUMAZones(node.Topology); len(zones) > 0 {
+		for i := range zones {
+			nw.createNUMAZone(node, rtnd, &zones[i])
+		}
+		return rtnd
+	}
+	// Nodes without a NodeResourceTopology object are advertised with PUsPerMachine PUs
+	// sharing the capacity of the whole machine.
+	for i, capacity := range splitResourceVector(nw.nodeCapacity(node), nw.puCount(node)) {
+		nw.createPU(node, rtnd, fmt.Sprintf("%s_PU #%d", friendlyName, i), capacity)
 	}
-
-	rtnd.Children = append(rtnd.Children, puRtnd)
-	ResIDToNode[puUUID] = node.Hostname
 	return rtnd
 }
 
-func (nw *NodeWatcher) generateResourceID(seed string) string {
-	return GenerateUUID(seed)
+// nodeCapacity returns the capacity of the node advertised to firmament, the allocatable resources unless
+// the watcher is configured to advertise the node capacity.
+func (nw *NodeWatcher) nodeCapacity(node *Node) *firmament.ResourceVector {
+	if nw.cfg.UseNodeCapacity {
+		return &firmament.ResourceVector{
+			RamCap:       nw.overcommitMem(node.MemCapacityKb),
+			CpuCores:     nw.overcommitCPU(node.CPUCapacity),
+			EphemeralCap: uint64(node.EphemeralCapKb),
+		}
+	}
+	return &firmament.ResourceVector{
+		RamCap:       nw.overcommitMem(node.MemAllocatableKb),
+		CpuCores:     nw.overcommitCPU(node.CPUAllocatable),
+		EphemeralCap: uint64(node.EphemeralAllocKb),
+	}
 }
 
-// updateResourceDescriptor to update the labels to resource descriptor
-func (nw *NodeWatcher) updateResourceDescriptor(node *Node, rtnd *firmament.ResourceTopologyNodeDescriptor) {
-	rtnd.ResourceDesc.Labels = nil
-	rtnd.ResourceDesc.Taints = nil
-	for label, value := range node.Labels {
-		rtnd.ResourceDesc.Labels = append(rtnd.ResourceDesc.Labels,
-			&firmament.Label{
-				Key:   label,
-				Value: value,
-			})
+// nodeReservation returns the resources of the node which are not allocatable when the node capacity is
+// advertised, they are reserved for the system and the kubelet. Nothing is reserved otherwise.
+func (nw *NodeWatcher) nodeReservation(node *Node) *firmament.ResourceVector {
+	if nw.cfg.UseNodeCapacity {
+		return &firmament.ResourceVector{
+			RamCap:       nw.overcommitMem(node.MemCapacityKb - node.MemAllocatableKb),
+			CpuCores:     nw.overcommitCPU(node.CPUCapacity - node.CPUAllocatable),
+			EphemeralCap: uint64(node.EphemeralCapKb - node.EphemeralAllocKb),
+		}
+	}
+	return &firmament.ResourceVector{}
+}
+
+// generateFriendlyName falls back to the hostname if the friendly name function returns an empty name.
+func (nw *NodeWatcher) generateFriendlyName(node *Node) string {
+	if friendlyName := nw.friendlyNameFunc(node); len(friendlyName) > 0 {
+		return friendlyName
 	}
+	glog.Errorf("Empty friendly name generated for %s, falling back to the hostname", node.Hostname)
+	return defaultFriendlyNameFunc(node)
+}
+
+// generateResourceID falls back to a UUID if the resource ID function returns an empty ID.
+func (nw *NodeWatcher) generateResourceID(node *Node, friendlyName string) string {
+	if resID := nw.resourceIDFunc(node, friendlyName); len(resID) > 0 {
+		return resID
+	}
+	glog.Errorf("Empty resource ID generated for %s, falling back to a UUID", friendlyName)
+	return defaultResourceIDFunc(node, friendlyName)
+}
 
+// updatedResourceDescriptor returns a copy of the topology of the node with the labels and taints of the node.
+// The topology tracked in NodeToRTND is left unchanged until firmament accepts the update, see replaceNodeTopology.
+func (nw *NodeWatcher) updatedResourceDescriptor(node *Node, rtnd *firmament.ResourceTopologyNodeDescriptor) *firmament.ResourceTopologyNodeDescriptor {
+	rd := *rtnd.GetResourceDesc()
+	rd.Labels = getNodeLabels(node)
+	rd.Taints = nil
 	for _, taint := range node.Taints {
-		rtnd.ResourceDesc.Taints = append(rtnd.ResourceDesc.Taints,
+		rd.Taints = append(rd.Taints,
 			&firmament.Taint{
 				Key:    taint.Key,
 				Value:  taint.Value,
 				Effect: taint.Effect,
 			})
 	}
+	updated := *rtnd
+	updated.ResourceDesc = &rd
+	return &updated
+}
+
+// replaceNodeTopology tracks the updated topology of the node in place of the current one, unless the node was
+// removed or added again meanwhile. NodeMux must be held for writing.
+func replaceNodeTopology(hostname string, current, updated *firmament.ResourceTopologyNodeDescriptor) {
+	if NodeToRTND[hostname] != current {
+		return
+	}
+	NodeToRTND[hostname] = updated
+	if applied, ok := appliedUsages[hostname]; ok && applied.rd == current.GetResourceDesc() {
+		// The usage subtracted from the available resources, shared by both topologies, is kept.
+		applied.rd = updated.GetResourceDesc()
+		appliedUsages[hostname] = applied
+	}
+}
+
+// evictPodsNotToleratingNoExecuteTaints deletes the Poseidon scheduled pods running on the node which
+// do not tolerate its NoExecute taints. Pods tolerating the taints for a limited time are deleted once
+// their tolerationSeconds have elapsed, if the taints are still present on the node by then.
+func (nw *NodeWatcher) evictPodsNotToleratingNoExecuteTaints(nodeName string, taints []Taint) {
+	if len(getUntoleratedTaints(nil, taints, v1.TaintEffectNoExecute)) == 0 {
+		return
+	}
+	pods, err := nw.clientset.CoreV1().Pods("").List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	})
+	if err != nil || pods == nil {
+		glog.Errorf("Unable to list the pods running on node %s, err: %v", nodeName, err)
+		return
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		podIdentifier := PodIdentifier{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		}
+		PodMux.RLock()
+		_, ok := PodToTD[podIdentifier]
+		PodMux.RUnlock()
+		if !ok {
+			// Only pods placed by Poseidon are evicted.
+			continue
+		}
+		var tolerations []Toleration
+		copier.Copy(&tolerations, pod.Spec.Tolerations)
+		delay, evict := getNoExecuteEvictionDelay(tolerations, taints)
+		if !evict {
+			continue
+		}
+		if delay == 0 {
+			nw.evictPod(podIdentifier, nodeName)
+			continue
+		}
+		glog.V(2).Infof("Pod %v tolerates the NoExecute taints of node %s for %v", podIdentifier, nodeName, delay)
+		time.AfterFunc(delay, func() {
+			NodeMux.RLock()
+			rtnd, ok := NodeToRTND[nodeName]
+			var currentTaints []Taint
+			if ok {
+				currentTaints = taintsFromFirmament(rtnd.GetResourceDesc().GetTaints())
+			}
+			NodeMux.RUnlock()
+			if !ok {
+				return
+			}
+			if _, evict := getNoExecuteEvictionDelay(tolerations, currentTaints); evict {
+				nw.evictPod(podIdentifier, nodeName)
+			}
+		})
+	}
+}
+
+// evictPod deletes the pod gracefully, its task is removed once the pod deletion is observed by the pod watcher.
+func (nw *NodeWatcher) evictPod(podIdentifier PodIdentifier, nodeName string) {
+	glog.Infof("Evicting pod %v from node %s because of NoExecute taints", podIdentifier, nodeName)
+	err := nw.clientset.CoreV1().Pods(podIdentifier.Namespace).Delete(podIdentifier.Name, &metav1.DeleteOptions{})
+	if err != nil {
+		glog.Errorf("Could not evict pod %v from node %s, err: %v", podIdentifier, nodeName, err)
+	}
 }
 
 func GetAvoidPodsFromNodeAnnotations(annotations map[string]string) ([]*firmament.AvoidPodsAnnotation, error) {
@@ -17,22 +17,43 @@ limitations under the License.
 package k8sclient
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament/firmamenttest"
+	"github.com/kubernetes-sigs/poseidon/pkg/logging"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
 
 	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/cache"
 )
 
 type TestNodeWatchObj struct {
 	firmamentClient *firmament.MockFirmamentSchedulerClient
+	fc              firmament.Client
 	kubeClient      *fake.Clientset
 	mockCtrl        *gomock.Controller
 }
@@ -42,6 +63,7 @@ func initializeNodeObj(t *testing.T) *TestNodeWatchObj {
 	mockCtrl := gomock.NewController(t)
 	testObj := &TestNodeWatchObj{}
 	testObj.firmamentClient = firmament.NewMockFirmamentSchedulerClient(mockCtrl)
+	testObj.fc = firmament.NewClient(testObj.firmamentClient)
 	testObj.kubeClient = &fake.Clientset{}
 	testObj.mockCtrl = mockCtrl
 	return testObj
@@ -87,7 +109,7 @@ func BuildFirmamentResourceDescriptor(
 	}
 }
 
-//BuildNode build a v1.Node struct to test
+// BuildNode build a v1.Node struct to test
 func BuildNode(name, requestCPU, requestMem string,
 	nodeLabel map[string]string,
 	nodeConditions []v1.NodeCondition,
@@ -109,6 +131,10 @@ func BuildNode(name, requestCPU, requestMem string,
 				v1.ResourceName(v1.ResourceCPU):    resource.MustParse(requestCPU),
 				v1.ResourceName(v1.ResourceMemory): resource.MustParse(requestMem),
 			},
+			Allocatable: v1.ResourceList{
+				v1.ResourceName(v1.ResourceCPU):    resource.MustParse(requestCPU),
+				v1.ResourceName(v1.ResourceMemory): resource.MustParse(requestMem),
+			},
 		},
 	}
 	return newnode
@@ -118,7 +144,7 @@ func BuildNode(name, requestCPU, requestMem string,
 func TestNewNodeWatcher(t *testing.T) {
 	testObj := initializeNodeObj(t)
 	defer testObj.mockCtrl.Finish()
-	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.firmamentClient)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
 	t.Logf("Node watcher=%v", nodeWatch)
 }
 
@@ -167,7 +193,7 @@ func TestNodeWatcher_getReadyAndOutOfDiskConditions(t *testing.T) {
 	testObj := initializeNodeObj(t)
 	defer testObj.mockCtrl.Finish()
 
-	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.firmamentClient)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
 
 	for _, testValue := range testData {
 		resultOne, resultTwo := nodeWatch.getReadyAndOutOfDiskConditions(testValue.node)
@@ -199,9 +225,9 @@ func TestNodeWatcher_parseNode(t *testing.T) {
 				IsReady:          false,
 				IsOutOfDisk:      false,
 				CPUCapacity:      10000,
-				CPUAllocatable:   0,
+				CPUAllocatable:   10000,
 				MemCapacityKb:    10000000000,
-				MemAllocatableKb: 0,
+				MemAllocatableKb: 10000000000,
 				Labels:           nil,
 				Annotations:      nil,
 			},
@@ -210,16 +236,53 @@ func TestNodeWatcher_parseNode(t *testing.T) {
 
 	testObj := initializeNodeObj(t)
 	defer testObj.mockCtrl.Finish()
-	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.firmamentClient)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
 
 	for _, testValue := range testData {
-		result := nodeWatch.parseNode(testValue.node, testValue.phase)
+		result, err := nodeWatch.parseNode(testValue.node, testValue.phase)
+		if err != nil {
+			t.Error("unexpected error ", err)
+		}
 		if !reflect.DeepEqual(result, testValue.expected) {
 			t.Error("expected ", testValue.expected, "got ", result)
 		}
 	}
 }
 
+// TestNodeWatcher_parseNodeUnparsableQuantity checks that nodes with resource quantities which can not be
+// converted are not parsed into zeroed nodes, and are not enqueued.
+func TestNodeWatcher_parseNodeUnparsableQuantity(t *testing.T) {
+	negativeMem := BuildNode("node0", "10", "1024", nil, nil, false)
+	negativeMem.Status.Allocatable = v1.ResourceList{
+		v1.ResourceMemory: resource.MustParse("-1Ki"),
+	}
+	var testData = []*v1.Node{
+		BuildNode("node0", "10", "100E", nil, nil, false),
+		BuildNode("node0", "10000000000000000", "1024", nil, nil, false),
+		negativeMem,
+	}
+
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+
+	for _, node := range testData {
+		result, err := nodeWatch.parseNode(node, NodeAdded)
+		if err == nil {
+			t.Error("expected an error for node ", node.Status, "got ", result)
+		}
+		key, err := cache.MetaNamespaceKeyFunc(node)
+		if err != nil {
+			t.Error("AddFunc: error getting key ", err)
+		}
+		nodeWatch.enqueueNodeAddition(key, node)
+	}
+	nodeWatch.nodeWorkQueue.ShutDown()
+	if _, items, _ := nodeWatch.nodeWorkQueue.Get(); len(items) != 0 {
+		t.Error("expected nodes with unparsable quantities to be skipped, got ", items)
+	}
+}
+
 func TestNodeWatcher_enqueueNodeAddition(t *testing.T) {
 	var testData = []struct {
 		node     *v1.Node
@@ -240,9 +303,9 @@ func TestNodeWatcher_enqueueNodeAddition(t *testing.T) {
 				IsReady:          false,
 				IsOutOfDisk:      false,
 				CPUCapacity:      10000,
-				CPUAllocatable:   0,
+				CPUAllocatable:   10000,
 				MemCapacityKb:    10000000000,
-				MemAllocatableKb: 0,
+				MemAllocatableKb: 10000000000,
 				Labels:           nil,
 				Annotations:      nil,
 			},
@@ -261,9 +324,9 @@ func TestNodeWatcher_enqueueNodeAddition(t *testing.T) {
 				IsReady:          false,
 				IsOutOfDisk:      false,
 				CPUCapacity:      10000,
-				CPUAllocatable:   0,
+				CPUAllocatable:   10000,
 				MemCapacityKb:    10000000000,
-				MemAllocatableKb: 0,
+				MemAllocatableKb: 10000000000,
 				Labels:           nil,
 				Annotations:      nil,
 			},
@@ -272,7 +335,7 @@ func TestNodeWatcher_enqueueNodeAddition(t *testing.T) {
 	testObj := initializeNodeObj(t)
 	defer testObj.mockCtrl.Finish()
 
-	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.firmamentClient)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
 	keychain := make(chan interface{})
 	itemschan := make(chan []interface{})
 
@@ -306,6 +369,266 @@ func TestNodeWatcher_enqueueNodeAddition(t *testing.T) {
 	}
 }
 
+// TestNodeWatcher_enqueueNodeAdditionJSONLog checks that the addition of a node is logged as a JSON object holding
+// the hostname of the node once the log format is json.
+func TestNodeWatcher_enqueueNodeAdditionJSONLog(t *testing.T) {
+	if err := logging.SetFormat(logging.FormatJSON); err != nil {
+		t.Fatalf("SetFormat() failed: %v", err)
+	}
+	output := &syncBuffer{}
+	previous := logging.SetOutput(output)
+	defer func() {
+		logging.SetFormat(logging.FormatText)
+		logging.SetOutput(previous)
+	}()
+	node := BuildNode("node-json", "4", "8Gi", nil, nil, false)
+	nodeWatch := NewNodeWatcher(fake.NewSimpleClientset(), firmamenttest.NewFakeClient())
+	nodeWatch.enqueueNodeAddition("node-json", node)
+
+	var added map[string]interface{}
+	for _, line := range strings.Split(output.String(), "\n") {
+		var entry map[string]interface{}
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["hostname"] == "node-json" {
+			added = entry
+		}
+	}
+	if added == nil {
+		t.Fatalf("expected the node addition to be logged as JSON, got %q", output.String())
+	}
+	expected := map[string]interface{}{"level": "info", "msg": "enqueueNodeAddition: added node", "hostname": "node-json", "phase": string(NodeAdded)}
+	for key, value := range expected {
+		if added[key] != value {
+			t.Errorf("expected %s to be %v, got %v", key, value, added[key])
+		}
+	}
+	for _, key := range []string{"time", "caller"} {
+		if _, ok := added[key]; !ok {
+			t.Errorf("expected the %s key, got %v", key, added)
+		}
+	}
+}
+
+// syncBuffer is a buffer written by concurrent loggers.
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+// TestNodeWatcher_enqueueNodeDeletionTombstone checks that the deletion of a node missed by the watch is
+// queued from the tombstone of the informer, and that unexpected objects are dropped without panicking.
+func TestNodeWatcher_enqueueNodeDeletionTombstone(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	node := BuildNode("node0", "10", "10000000", nil, nil, false)
+	key, err := cache.MetaNamespaceKeyFunc(node)
+	if err != nil {
+		t.Fatal("error getting key ", err)
+	}
+	tombstone := cache.DeletedFinalStateUnknown{Key: key, Obj: node}
+	if tombstoneKey, err := cache.DeletionHandlingMetaNamespaceKeyFunc(tombstone); err != nil || tombstoneKey != key {
+		t.Fatalf("expected the key %s of the tombstone, got %s, err: %v", key, tombstoneKey, err)
+	}
+
+	nodeWatch.enqueueNodeDeletion(key, "unexpected")
+	nodeWatch.enqueueNodeDeletion(key, cache.DeletedFinalStateUnknown{Key: key, Obj: "unexpected"})
+	if got := nodeWatch.nodeWorkQueue.Len(); got != 0 {
+		t.Fatalf("expected the unexpected objects to be dropped, got %d queued nodes", got)
+	}
+	nodeWatch.enqueueNodeDeletion(key, tombstone)
+	newKey, items, _ := nodeWatch.nodeWorkQueue.Get()
+	expected := &Node{Hostname: "node0", Phase: NodeDeleted}
+	if newKey != key || len(items) != 1 || !reflect.DeepEqual(items[0], expected) {
+		t.Errorf("expected the deletion %v of key %s to be queued, got %v of key %v", expected, key, items, newKey)
+	}
+}
+
+// TestNodeWatcher_excludeControlPlane checks that the nodes with the control plane and the legacy master role
+// labels are not added, and that a node becoming a control plane node is deleted.
+func TestNodeWatcher_excludeControlPlane(t *testing.T) {
+	controlPlaneTaint := BuildNode("node2", "10", "1024", nil, nil, false)
+	controlPlaneTaint.Spec.Taints = []v1.Taint{{Key: ControlPlaneRoleLabel, Effect: v1.TaintEffectNoSchedule}}
+	var testData = []*v1.Node{
+		BuildNode("node0", "10", "1024", map[string]string{ControlPlaneRoleLabel: ""}, nil, false),
+		BuildNode("node1", "10", "1024", map[string]string{MasterRoleLabel: ""}, nil, false),
+		controlPlaneTaint,
+	}
+
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	if !nodeWatch.cfg.ExcludeControlPlane {
+		t.Fatal("expected control plane nodes to be excluded by default")
+	}
+	for _, node := range testData {
+		if !isControlPlaneNode(node) {
+			t.Errorf("expected node %s to be a control plane node", node.Name)
+		}
+		key, err := cache.MetaNamespaceKeyFunc(node)
+		if err != nil {
+			t.Error("AddFunc: error getting key ", err)
+		}
+		nodeWatch.enqueueNodeAddition(key, node)
+	}
+
+	// The legacy master role label is added to a worker node later on.
+	workerNode := BuildNode("node3", "10", "1024", nil, nil, false)
+	masterNode := workerNode.DeepCopy()
+	masterNode.Labels = map[string]string{MasterRoleLabel: ""}
+	key, err := cache.MetaNamespaceKeyFunc(workerNode)
+	if err != nil {
+		t.Error("UpdateFunc: error getting key ", err)
+	}
+	nodeWatch.enqueueNodeUpdate(key, workerNode, masterNode)
+	nodeWatch.nodeWorkQueue.ShutDown()
+
+	var queued []*Node
+	for {
+		_, items, shutdown := nodeWatch.nodeWorkQueue.Get()
+		if shutdown {
+			break
+		}
+		for _, item := range items {
+			queued = append(queued, item.(*Node))
+		}
+	}
+	expected := []*Node{{Hostname: "node3", Phase: NodeDeleted}}
+	if !reflect.DeepEqual(expected, queued) {
+		t.Error("expected ", expected, "got ", queued)
+	}
+}
+
+// TestNodeWatcher_notReadyGracePeriod tests that nodes recovering within the grace period are not failed.
+func TestNodeWatcher_notReadyGracePeriod(t *testing.T) {
+	readyConditions := []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	notReadyConditions := []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	nodeWatch.cfg.NotReadyGracePeriod = 100 * time.Millisecond
+
+	// The flapping node recovers within the grace period.
+	flappingReady := BuildNode("node0", "10", "1024", nil, readyConditions, false)
+	flappingNotReady := BuildNode("node0", "10", "1024", nil, notReadyConditions, false)
+	// The failing node stays not ready.
+	failingReady := BuildNode("node1", "10", "1024", nil, readyConditions, false)
+	failingNotReady := BuildNode("node1", "10", "1024", nil, notReadyConditions, false)
+	flappingKey, _ := cache.MetaNamespaceKeyFunc(flappingReady)
+	failingKey, _ := cache.MetaNamespaceKeyFunc(failingReady)
+	nodeWatch.enqueueNodeUpdate(flappingKey, flappingReady, flappingNotReady)
+	nodeWatch.enqueueNodeUpdate(failingKey, failingReady, failingNotReady)
+	nodeWatch.enqueueNodeUpdate(flappingKey, flappingNotReady, flappingReady)
+	if nodeWatch.nodeWorkQueue.Len() != 0 {
+		t.Fatalf("expected no node to be failed within the grace period, got %d queued", nodeWatch.nodeWorkQueue.Len())
+	}
+
+	time.Sleep(3 * nodeWatch.cfg.NotReadyGracePeriod)
+	nodeWatch.nodeWorkQueue.ShutDown()
+	var queued []*Node
+	for {
+		_, items, shutdown := nodeWatch.nodeWorkQueue.Get()
+		if shutdown {
+			break
+		}
+		for _, item := range items {
+			queued = append(queued, item.(*Node))
+		}
+	}
+	expected := []*Node{{Hostname: "node1", Phase: NodeFailed}}
+	if !reflect.DeepEqual(expected, queued) {
+		t.Error("expected ", expected, "got ", queued)
+	}
+}
+
+// TestNodeWatcher_failureRecovery drives nodes through their failure and recovery, and checks that a failed
+// node is added again once it recovers while a node added before being ready is updated.
+func TestNodeWatcher_failureRecovery(t *testing.T) {
+	readyConditions := []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	notReadyConditions := []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}
+	var testData = []struct {
+		name          string
+		conditions    [][]v1.NodeCondition
+		expectedCalls []string
+		expectedNotes []string
+	}{
+		{
+			name:          "add fail recover",
+			conditions:    [][]v1.NodeCondition{readyConditions, notReadyConditions, readyConditions},
+			expectedCalls: []string{"NodeAdded", "NodeFailed", "NodeAdded"},
+			expectedNotes: []string{"added", "failed", "added"},
+		},
+		{
+			name:          "add fail recover twice",
+			conditions:    [][]v1.NodeCondition{readyConditions, notReadyConditions, readyConditions, notReadyConditions, readyConditions},
+			expectedCalls: []string{"NodeAdded", "NodeFailed", "NodeAdded", "NodeFailed", "NodeAdded"},
+			expectedNotes: []string{"added", "failed", "added", "failed", "added"},
+		},
+		{
+			name:          "added not ready",
+			conditions:    [][]v1.NodeCondition{notReadyConditions, readyConditions},
+			expectedCalls: []string{"NodeAdded", "NodeUpdated"},
+			expectedNotes: []string{"added", "updated"},
+		},
+	}
+
+	for _, data := range testData {
+		fc := firmamenttest.NewFakeClient()
+		var notified []string
+		nodeWatch := NewNodeWatcher(&fake.Clientset{}, fc, WithNodeObserver(NodeObserver{
+			OnNodeAdded:   func(*Node) { notified = append(notified, "added") },
+			OnNodeFailed:  func(*Node) { notified = append(notified, "failed") },
+			OnNodeUpdated: func(*Node) { notified = append(notified, "updated") },
+		}))
+		process := func() {
+			for nodeWatch.nodeWorkQueue.Len() > 0 {
+				nodeWatch.processNextItem()
+			}
+		}
+		nodes := make([]*v1.Node, len(data.conditions))
+		for i, conditions := range data.conditions {
+			nodes[i] = BuildNode("node0", "10", "10000000", nil, conditions, false)
+		}
+		key, err := cache.MetaNamespaceKeyFunc(nodes[0])
+		if err != nil {
+			t.Fatal("error getting key ", err)
+		}
+		nodeWatch.enqueueNodeAddition(key, nodes[0])
+		process()
+		for i := 1; i < len(nodes); i++ {
+			nodeWatch.enqueueNodeUpdate(key, nodes[i-1], nodes[i])
+			process()
+		}
+
+		var calls []string
+		for _, call := range fc.Calls() {
+			calls = append(calls, call.Method)
+		}
+		if !reflect.DeepEqual(calls, data.expectedCalls) {
+			t.Errorf("%s: expected the requests %v, got %v", data.name, data.expectedCalls, calls)
+		}
+		if !reflect.DeepEqual(notified, data.expectedNotes) {
+			t.Errorf("%s: expected the observers to be notified of %v, got %v", data.name, data.expectedNotes, notified)
+		}
+		if _, ok := NodeToRTND["node0"]; !ok {
+			t.Errorf("%s: expected the recovered node to be tracked", data.name)
+		}
+		if got := nodeWatch.checkStateConsistency(); got != 0 {
+			t.Errorf("%s: expected no inconsistency, got %d", data.name, got)
+		}
+	}
+}
+
 func TestNodeWatcher_createResourceTopologyForNode(t *testing.T) {
 	var testData = []struct {
 		node     *Node
@@ -353,7 +676,9 @@ func TestNodeWatcher_createResourceTopologyForNode(t *testing.T) {
 		},
 	}
 	testObj := initializeNodeObj(t)
-	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.firmamentClient)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	// The capacity of the nodes is advertised, their resources are reserved for the system.
+	nodeWatch.cfg.UseNodeCapacity = true
 	for _, testValue := range testData {
 		got := nodeWatch.createResourceTopologyForNode(testValue.node)
 		if !reflect.DeepEqual(got, testValue.expected) {
@@ -362,6 +687,248 @@ func TestNodeWatcher_createResourceTopologyForNode(t *testing.T) {
 	}
 }
 
+// TestNodeWatcher_createResourceTopologyForNodeOvercommit checks that the cpu overcommit ratio is applied
+// to the capacity advertised to firmament.
+func TestNodeWatcher_createResourceTopologyForNodeOvercommit(t *testing.T) {
+	node := &Node{
+		Hostname:         "node0",
+		Phase:            NodeAdded,
+		CPUCapacity:      4000,
+		CPUAllocatable:   3000,
+		MemCapacityKb:    2048,
+		MemAllocatableKb: 1024,
+	}
+	testObj := initializeNodeObj(t)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	nodeWatch.cfg.CPUOvercommitRatio = 2.0
+
+	rtnd := nodeWatch.createResourceTopologyForNode(node)
+	if got := rtnd.ResourceDesc.ResourceCapacity.CpuCores; got != 6000 {
+		t.Error("expected cpu capacity 6000 got ", got)
+	}
+	if got := rtnd.ResourceDesc.AvailableResources.CpuCores; got != 6000 {
+		t.Error("expected available cpu 6000 got ", got)
+	}
+	if got := rtnd.Children[0].ResourceDesc.ResourceCapacity.CpuCores; got != 6000 {
+		t.Error("expected PU cpu capacity 6000 got ", got)
+	}
+	if got := rtnd.ResourceDesc.ResourceCapacity.RamCap; got != 1024 {
+		t.Error("expected memory capacity to be unchanged, got ", got)
+	}
+}
+
+// TestNodeWatcher_memoryUnit checks that the memory of a node is advertised to firmament in the configured unit.
+func TestNodeWatcher_memoryUnit(t *testing.T) {
+	var testData = []struct {
+		unit     MemoryUnit
+		expected uint64
+	}{
+		{MemoryUnitKB, 8 * 1024 * 1024 * 1024 * 1000},
+		{MemoryUnitMB, 8589},
+		{MemoryUnitMiB, 8192},
+	}
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	for _, data := range testData {
+		cfg := DefaultNodeWatcherConfig()
+		cfg.MemoryUnit = data.unit
+		nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc, WithNodeWatcherConfig(cfg))
+		node, err := nodeWatch.parseNode(BuildNode("node0", "4", "8Gi", nil, nil, false), NodeAdded)
+		if err != nil {
+			t.Fatal("error parsing node ", err)
+		}
+		rtnd := nodeWatch.createResourceTopologyForNode(node)
+		if got := rtnd.ResourceDesc.ResourceCapacity.RamCap; got != data.expected {
+			t.Errorf("%s: expected memory capacity %d, got %d", data.unit, data.expected, got)
+		}
+		if got := rtnd.Children[0].ResourceDesc.ResourceCapacity.RamCap; got != data.expected {
+			t.Errorf("%s: expected PU memory capacity %d, got %d", data.unit, data.expected, got)
+		}
+	}
+}
+
+// TestNodeWatcher_createResourceTopologyForNodeAllocatable checks that the allocatable resources of a node
+// are advertised to firmament by default, and its capacity when configured.
+func TestNodeWatcher_createResourceTopologyForNodeAllocatable(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	k8sNode := BuildNode("node0", "8", "16Gi", nil, nil, false)
+	k8sNode.Status.Allocatable[v1.ResourceCPU] = resource.MustParse("7500m")
+	node, err := nodeWatch.parseNode(k8sNode, NodeAdded)
+	if err != nil {
+		t.Fatal("error parsing node ", err)
+	}
+
+	rtnd := nodeWatch.createResourceTopologyForNode(node)
+	if got := rtnd.ResourceDesc.ResourceCapacity.CpuCores; got != 7500 {
+		t.Error("expected the allocatable cpu 7500 to be advertised, got ", got)
+	}
+	if got := rtnd.Children[0].ResourceDesc.ResourceCapacity.CpuCores; got != 7500 {
+		t.Error("expected PU cpu capacity 7500 got ", got)
+	}
+	if got := rtnd.ResourceDesc.ReservedResources.CpuCores; got != 0 {
+		t.Error("expected no reserved cpu, got ", got)
+	}
+
+	nodeWatch.cfg.UseNodeCapacity = true
+	rtnd = nodeWatch.createResourceTopologyForNode(node)
+	if got := rtnd.ResourceDesc.ResourceCapacity.CpuCores; got != 8000 {
+		t.Error("expected the cpu capacity 8000 to be advertised, got ", got)
+	}
+	if got := rtnd.ResourceDesc.AvailableResources.CpuCores; got != 7500 {
+		t.Error("expected available cpu 7500 got ", got)
+	}
+	if got := rtnd.ResourceDesc.ReservedResources.CpuCores; got != 500 {
+		t.Error("expected the cpu reserved for the system 500 got ", got)
+	}
+}
+
+// TestNodeWatcher_createResourceTopologyForNodeLabelOrder checks that the labels of the machine and PU
+// descriptors are sorted by key, whatever the iteration order of the node labels.
+func TestNodeWatcher_createResourceTopologyForNodeLabelOrder(t *testing.T) {
+	node := &Node{
+		Hostname:       "node0",
+		Phase:          NodeAdded,
+		CPUCapacity:    1000,
+		MemCapacityKb:  2048,
+		HugePagesCapKb: map[v1.ResourceName]int64{"hugepages-2Mi": 2048},
+		Labels:         make(map[string]string),
+	}
+	var expected []string
+	for i := 0; i < 16; i++ {
+		key := fmt.Sprintf("label-%02d", i)
+		node.Labels[key] = "value"
+		expected = append(expected, key)
+	}
+	expected = append(expected, "hugepages-2Mi"+HugePagesCapacityLabelSuffix)
+	testObj := initializeNodeObj(t)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+
+	labelKeys := func(labels []*firmament.Label) []string {
+		var keys []string
+		for _, label := range labels {
+			keys = append(keys, label.GetKey())
+		}
+		return keys
+	}
+	for i := 0; i < 10; i++ {
+		rtnd := nodeWatch.createResourceTopologyForNode(node)
+		if got := labelKeys(rtnd.GetResourceDesc().GetLabels()); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected machine labels %v got %v", expected, got)
+		}
+		if got := labelKeys(rtnd.GetChildren()[0].GetResourceDesc().GetLabels()); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected PU labels %v got %v", expected, got)
+		}
+		rtnd = nodeWatch.updatedResourceDescriptor(node, rtnd)
+		if got := labelKeys(rtnd.GetResourceDesc().GetLabels()); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected updated machine labels %v got %v", expected, got)
+		}
+	}
+}
+
+// TestNodeWatcher_createResourceTopologyForNodeResourceIDFunc checks that the resource IDs generated by a
+// custom resource ID function are used.
+func TestNodeWatcher_createResourceTopologyForNodeResourceIDFunc(t *testing.T) {
+	node := &Node{
+		Hostname:         "node0",
+		Phase:            NodeAdded,
+		CPUCapacity:      1000,
+		MemCapacityKb:    2048,
+		MemAllocatableKb: 1024,
+	}
+	testObj := initializeNodeObj(t)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc,
+		WithResourceIDFunc(func(node *Node, friendlyName string) string {
+			return friendlyName
+		}))
+
+	rtnd := nodeWatch.createResourceTopologyForNode(node)
+	if got := rtnd.ResourceDesc.GetUuid(); got != "node0" {
+		t.Error("expected resource ID node0 got ", got)
+	}
+	if got := rtnd.Children[0].ResourceDesc.GetUuid(); got != "node0_PU #0" {
+		t.Error("expected PU resource ID node0_PU #0 got ", got)
+	}
+	if got := rtnd.Children[0].GetParentId(); got != "node0" {
+		t.Error("expected PU parent ID node0 got ", got)
+	}
+
+	// Empty resource IDs fall back to the default UUIDs.
+	nodeWatch = NewNodeWatcher(testObj.kubeClient, testObj.fc,
+		WithResourceIDFunc(func(node *Node, friendlyName string) string {
+			return ""
+		}))
+	rtnd = nodeWatch.createResourceTopologyForNode(node)
+	if got := rtnd.ResourceDesc.GetUuid(); got != GenerateUUID("node0") {
+		t.Error("expected the default resource ID got ", got)
+	}
+}
+
+func TestNodeWatcher_createResourceTopologyForNodeFriendlyNameFunc(t *testing.T) {
+	node := &Node{
+		Hostname:         "node0",
+		Phase:            NodeAdded,
+		CPUCapacity:      1000,
+		MemCapacityKb:    2048,
+		MemAllocatableKb: 1024,
+	}
+	testObj := initializeNodeObj(t)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc,
+		WithFriendlyNameFunc(func(node *Node) string {
+			return "us-east-1/" + node.Hostname
+		}))
+
+	rtnd := nodeWatch.createResourceTopologyForNode(node)
+	if got := rtnd.ResourceDesc.GetFriendlyName(); got != "us-east-1/node0" {
+		t.Error("expected machine friendly name us-east-1/node0 got ", got)
+	}
+	if got := rtnd.Children[0].ResourceDesc.GetFriendlyName(); got != "us-east-1/node0_PU #0" {
+		t.Error("expected PU friendly name us-east-1/node0_PU #0 got ", got)
+	}
+
+	// Empty friendly names fall back to the hostname.
+	nodeWatch = NewNodeWatcher(testObj.kubeClient, testObj.fc,
+		WithFriendlyNameFunc(func(node *Node) string {
+			return ""
+		}))
+	rtnd = nodeWatch.createResourceTopologyForNode(node)
+	if got := rtnd.ResourceDesc.GetFriendlyName(); got != "node0" {
+		t.Error("expected machine friendly name node0 got ", got)
+	}
+}
+
+// TestNodeWatcher_checkStateConsistency corrupts the resource map and checks that the inconsistencies are flagged.
+func TestNodeWatcher_checkStateConsistency(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	rtnd := nodeWatch.createResourceTopologyForNode(&Node{Hostname: "node0", CPUCapacity: 1000, MemCapacityKb: 1024})
+	NodeToRTND["node0"] = rtnd
+	nodeWatch.registerResourceStateForNode(rtnd, "node0")
+
+	counterValue := func() float64 {
+		metric := &dto.Metric{}
+		if err := metrics.StateInconsistencies.Write(metric); err != nil {
+			t.Fatal("unable to read the state inconsistencies metric ", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	before := counterValue()
+	if got := nodeWatch.checkStateConsistency(); got != 0 {
+		t.Error("expected no inconsistency got ", got)
+	}
+
+	// Drop the PU of the node from the resource map and add a stray resource.
+	delete(ResIDToNode, rtnd.GetChildren()[0].GetResourceDesc().GetUuid())
+	ResIDToNode["stray-resource"] = "node1"
+	if got := nodeWatch.checkStateConsistency(); got != 2 {
+		t.Error("expected 2 inconsistencies got ", got)
+	}
+	if got := counterValue() - before; got != 2 {
+		t.Error("expected the state inconsistencies metric to increase by 2, got ", got)
+	}
+}
+
 func TestNodeWatcher_nodeWorker(t *testing.T) {
 	fakeNow := metav1.Now()
 	var testData = []struct {
@@ -442,7 +1009,7 @@ func TestNodeWatcher_nodeWorker(t *testing.T) {
 		testObj.firmamentClient.EXPECT().NodeUpdated(gomock.Any(), gomock.Any()).Return(
 			&firmament.NodeUpdatedResponse{Type: firmament.NodeReplyType_NODE_UPDATED_OK}, nil),
 	)
-	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.firmamentClient)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
 	for index, testValue := range testData {
 
 		key, err := cache.MetaNamespaceKeyFunc(testValue.node)
@@ -483,3 +1050,1003 @@ func TestNodeWatcher_nodeWorker(t *testing.T) {
 	<-timer1.C
 	nodeWatch.nodeWorkQueue.ShutDown()
 }
+
+// TestNodeWatcher_nodeWorkerResIDToNode adds a node twice and deletes it, and checks that no resource ID
+// of the node or its PUs is left in ResIDToNode, even with resource IDs which change with every call.
+func TestNodeWatcher_nodeWorkerResIDToNode(t *testing.T) {
+	node := BuildNode("node0", "1", "10000000000", nil, nil, false)
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+
+	removed := make(chan struct{})
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+			&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil),
+		testObj.firmamentClient.EXPECT().NodeRemoved(gomock.Any(), gomock.Any()).Return(
+			&firmament.NodeRemovedResponse{Type: firmament.NodeReplyType_NODE_REMOVED_OK}, nil).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				close(removed)
+			}),
+	)
+	resIDCount := 0
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc,
+		WithResourceIDFunc(func(node *Node, friendlyName string) string {
+			resIDCount++
+			return fmt.Sprintf("%s-%d", friendlyName, resIDCount)
+		}))
+	key, err := cache.MetaNamespaceKeyFunc(node)
+	if err != nil {
+		t.Fatal("error getting key ", err)
+	}
+	nodeWatch.enqueueNodeAddition(key, node)
+	nodeWatch.enqueueNodeAddition(key, node)
+	nodeWatch.enqueueNodeDeletion(key, node)
+	go nodeWatch.nodeWorker()
+	defer nodeWatch.nodeWorkQueue.ShutDown()
+
+	select {
+	case <-removed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the node to be removed from firmament")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		NodeMux.RLock()
+		numResIDs, numNodes := len(ResIDToNode), len(NodeToRTND)
+		NodeMux.RUnlock()
+		if numResIDs == 0 && numNodes == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected ResIDToNode and NodeToRTND to be empty, got %v and %d nodes", ResIDToNode, numNodes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestNodeWatcher_hugePages checks that the hugepages capacity of a node is advertised to firmament
+// through resource labels, and that a change of the capacity updates the node.
+func TestNodeWatcher_hugePages(t *testing.T) {
+	node := BuildNode("node0", "1", "10000000000", nil, nil, false)
+	node.Status.Capacity[v1.ResourceName("hugepages-2Mi")] = resource.MustParse("512Mi")
+	testObj := initializeNodeObj(t)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+
+	parsedNode, err := nodeWatch.parseNode(node, NodeAdded)
+	if err != nil {
+		t.Fatal("error parsing node ", err)
+	}
+	if got := parsedNode.HugePagesCapKb[v1.ResourceName("hugepages-2Mi")]; got != 524288 {
+		t.Error("expected hugepages-2Mi capacity 524288Kb got ", got)
+	}
+
+	rtnd := nodeWatch.createResourceTopologyForNode(parsedNode)
+	expected := &firmament.Label{Key: "hugepages-2Mi" + HugePagesCapacityLabelSuffix, Value: "524288"}
+	for _, rd := range []*firmament.ResourceDescriptor{rtnd.GetResourceDesc(), rtnd.GetChildren()[0].GetResourceDesc()} {
+		if !reflect.DeepEqual(rd.GetLabels(), []*firmament.Label{expected}) {
+			t.Errorf("expected labels %v on resource %s got %v", expected, rd.GetFriendlyName(), rd.GetLabels())
+		}
+	}
+
+	updatedNode := node.DeepCopy()
+	updatedNode.Status.Capacity[v1.ResourceName("hugepages-2Mi")] = resource.MustParse("1Gi")
+	key, err := cache.MetaNamespaceKeyFunc(node)
+	if err != nil {
+		t.Fatal("error getting key ", err)
+	}
+	nodeWatch.enqueueNodeUpdate(key, node, updatedNode)
+	_, items, _ := nodeWatch.nodeWorkQueue.Get()
+	if len(items) != 1 || items[0].(*Node).Phase != NodeUpdated {
+		t.Fatalf("expected the node to be updated, got %v", items)
+	}
+	if got := items[0].(*Node).HugePagesCapKb[v1.ResourceName("hugepages-2Mi")]; got != 1048576 {
+		t.Error("expected updated hugepages-2Mi capacity 1048576Kb got ", got)
+	}
+}
+
+// TestNodeWatcher_dualStackAddresses checks that both address families of a dual-stack node are captured,
+// that its internal IPs are advertised to firmament through resource labels, and that a change of the
+// addresses updates the node.
+func TestNodeWatcher_dualStackAddresses(t *testing.T) {
+	node := BuildNode("node0", "1", "10000000000", nil, nil, false)
+	node.Status.Addresses = []v1.NodeAddress{
+		{Type: v1.NodeInternalIP, Address: "10.0.0.10"},
+		{Type: v1.NodeInternalIP, Address: "fd00::10"},
+		{Type: v1.NodeExternalIP, Address: "2001:db8::10"},
+		{Type: v1.NodeHostName, Address: "node0"},
+		{Type: v1.NodeInternalDNS, Address: "node0.cluster.internal"},
+	}
+	testObj := initializeNodeObj(t)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+
+	parsedNode, err := nodeWatch.parseNode(node, NodeAdded)
+	if err != nil {
+		t.Fatal("error parsing node ", err)
+	}
+	expectedAddresses := node.Status.Addresses[:4]
+	if !reflect.DeepEqual(parsedNode.Addresses, expectedAddresses) {
+		t.Errorf("expected addresses %v got %v", expectedAddresses, parsedNode.Addresses)
+	}
+
+	rtnd := nodeWatch.createResourceTopologyForNode(parsedNode)
+	expected := []*firmament.Label{
+		{Key: InternalIPv4Label, Value: "10.0.0.10"},
+		{Key: InternalIPv6Label, Value: "fd00::10"},
+	}
+	if labels := rtnd.GetResourceDesc().GetLabels(); !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected labels %v got %v", expected, labels)
+	}
+
+	updatedNode := node.DeepCopy()
+	updatedNode.Status.Addresses[1].Address = "fd00::20"
+	key, err := cache.MetaNamespaceKeyFunc(node)
+	if err != nil {
+		t.Fatal("error getting key ", err)
+	}
+	nodeWatch.enqueueNodeUpdate(key, node, updatedNode)
+	_, items, _ := nodeWatch.nodeWorkQueue.Get()
+	if len(items) != 1 || items[0].(*Node).Phase != NodeUpdated {
+		t.Fatalf("expected the node to be updated, got %v", items)
+	}
+	if got := items[0].(*Node).Addresses[1].Address; got != "fd00::20" {
+		t.Error("expected updated internal IPv6 address fd00::20 got ", got)
+	}
+}
+
+// countingQueue wraps a Queue and counts the keys handed out by Get and released by Done.
+type countingQueue struct {
+	Queue
+	gets  map[interface{}]int
+	dones map[interface{}]int
+}
+
+func (q *countingQueue) Get() (interface{}, []interface{}, bool) {
+	key, items, quit := q.Queue.Get()
+	if !quit {
+		q.gets[key]++
+	}
+	return key, items, quit
+}
+
+func (q *countingQueue) Done(key interface{}) {
+	q.dones[key]++
+	q.Queue.Done(key)
+}
+
+// TestNodeWatcher_processNextItem checks that Done is called exactly once for every key returned by Get
+// and that the node worker returns once the queue is shut down.
+func TestNodeWatcher_processNextItem(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+		&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil).Times(2)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	queue := &countingQueue{Queue: nodeWatch.nodeWorkQueue, gets: make(map[interface{}]int), dones: make(map[interface{}]int)}
+	nodeWatch.nodeWorkQueue = queue
+
+	for _, node := range []*v1.Node{
+		BuildNode("node-worker-1", "1", "10000000000", nil, nil, false),
+		BuildNode("node-worker-2", "1", "10000000000", nil, nil, false),
+	} {
+		key, err := cache.MetaNamespaceKeyFunc(node)
+		if err != nil {
+			t.Fatal("error getting key ", err)
+		}
+		nodeWatch.enqueueNodeAddition(key, node)
+	}
+	for i := 0; i < 2; i++ {
+		if !nodeWatch.processNextItem() {
+			t.Fatal("expected processNextItem to return true before the queue is shut down")
+		}
+	}
+	if len(queue.gets) != 2 || !reflect.DeepEqual(queue.gets, queue.dones) {
+		t.Errorf("expected Done to be called once per Get, got gets %v and dones %v", queue.gets, queue.dones)
+	}
+
+	queue.ShutDown()
+	stopped := make(chan struct{})
+	go func() {
+		nodeWatch.nodeWorker()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the node worker to return once the queue is shut down")
+	}
+}
+
+// TestNodeWatcher_WaitForNodes checks that a waiter is woken up by a node addition and by a context cancellation.
+func TestNodeWatcher_WaitForNodes(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+		&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+
+	// The context is cancelled while no node is tracked.
+	ctx, cancel := context.WithCancel(context.Background())
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- nodeWatch.WaitForNodes(ctx) }()
+	select {
+	case err := <-waitErr:
+		t.Fatalf("expected the waiter to block without nodes, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-waitErr:
+		if err != context.Canceled {
+			t.Errorf("expected %v got %v", context.Canceled, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the waiter to return once the context is cancelled")
+	}
+
+	// A node is added while waiting.
+	go func() { waitErr <- nodeWatch.WaitForNodes(context.Background()) }()
+	node := BuildNode("node-wait", "1", "10000000000", nil, nil, false)
+	key, err := cache.MetaNamespaceKeyFunc(node)
+	if err != nil {
+		t.Fatal("error getting key ", err)
+	}
+	nodeWatch.enqueueNodeAddition(key, node)
+	if !nodeWatch.processNextItem() {
+		t.Fatal("expected processNextItem to return true before the queue is shut down")
+	}
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			t.Errorf("expected no error got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the waiter to return once a node is added")
+	}
+
+	// Nodes are tracked already, the waiter returns right away.
+	if err := nodeWatch.WaitForNodes(context.Background()); err != nil {
+		t.Errorf("expected no error got %v", err)
+	}
+}
+
+// TestNodeWatcher_observers registers an observer and checks that it is notified with the right node
+// on each phase, without NodeMux being held.
+func TestNodeWatcher_observers(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+			&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil),
+		testObj.firmamentClient.EXPECT().NodeUpdated(gomock.Any(), gomock.Any()).Return(
+			&firmament.NodeUpdatedResponse{Type: firmament.NodeReplyType_NODE_UPDATED_OK}, nil),
+		testObj.firmamentClient.EXPECT().NodeFailed(gomock.Any(), gomock.Any()).Return(
+			&firmament.NodeFailedResponse{Type: firmament.NodeReplyType_NODE_FAILED_OK}, nil),
+		testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+			&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil),
+		testObj.firmamentClient.EXPECT().NodeRemoved(gomock.Any(), gomock.Any()).Return(
+			&firmament.NodeRemovedResponse{Type: firmament.NodeReplyType_NODE_REMOVED_OK}, nil),
+	)
+	var notified []string
+	record := func(event string) func(*Node) {
+		return func(node *Node) {
+			// The callbacks would deadlock if NodeMux was held.
+			NodeMux.Lock()
+			NodeMux.Unlock()
+			notified = append(notified, event+" "+node.Hostname)
+		}
+	}
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc, WithNodeObserver(NodeObserver{
+		OnNodeAdded:   record("added"),
+		OnNodeDeleted: record("deleted"),
+		OnNodeFailed:  record("failed"),
+		OnNodeUpdated: record("updated"),
+	}))
+
+	var items []interface{}
+	for _, phase := range []NodePhase{NodeAdded, NodeUpdated, NodeFailed, NodeAdded, NodeDeleted} {
+		node, err := nodeWatch.parseNode(BuildNode("node-observed", "1", "10000000000", nil, nil, false), phase)
+		if err != nil {
+			t.Fatal("error parsing node ", err)
+		}
+		items = append(items, node)
+	}
+	// A deletion of an unknown node is not forwarded to firmament nor to the observers.
+	unknown, err := nodeWatch.parseNode(BuildNode("node-unknown", "1", "10000000000", nil, nil, false), NodeDeleted)
+	if err != nil {
+		t.Fatal("error parsing node ", err)
+	}
+	items = append(items, unknown)
+
+	processed := make(chan struct{})
+	go func() {
+		nodeWatch.processNodes(context.Background(), items)
+		close(processed)
+	}()
+	select {
+	case <-processed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the observers to be invoked without NodeMux being held")
+	}
+	expected := []string{"added node-observed", "updated node-observed", "failed node-observed", "added node-observed", "deleted node-observed"}
+	if !reflect.DeepEqual(notified, expected) {
+		t.Errorf("expected the observers to be notified of %v, got %v", expected, notified)
+	}
+}
+
+// TestNodeWatcher_registerResourceStateForNode checks that building the topology of a node does not touch
+// ResIDToNode, and that the node worker registers a single entry per resource of the topology.
+func TestNodeWatcher_registerResourceStateForNode(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+		&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc,
+		WithNodeTopologyFunc(func(nodeName string) (*NodeResourceTopology, error) {
+			return parseNodeResourceTopology([]byte(fakeNodeResourceTopology))
+		}))
+	node := &Node{
+		Hostname:         "node0",
+		Phase:            NodeAdded,
+		CPUCapacity:      8000,
+		CPUAllocatable:   7000,
+		MemCapacityKb:    16384,
+		MemAllocatableKb: 15360,
+	}
+
+	nodeWatch.createResourceTopologyForNode(node)
+	if len(ResIDToNode) != 0 {
+		t.Fatalf("expected the topology to be built without registering resource IDs, got %v", ResIDToNode)
+	}
+
+	nodeWatch.processNodes(context.Background(), []interface{}{node})
+	rtnd, ok := NodeToRTND["node0"]
+	if !ok {
+		t.Fatal("expected node0 to be added")
+	}
+	expected := make(map[string]string)
+	collectResourceIDs(rtnd, "node0", expected)
+	// A machine with two NUMA zones holding a PU each.
+	if len(expected) != 5 {
+		t.Errorf("expected 5 resources in the topology of node0, got %v", expected)
+	}
+	if !reflect.DeepEqual(ResIDToNode, expected) {
+		t.Errorf("expected ResIDToNode %v got %v", expected, ResIDToNode)
+	}
+	if got := nodeWatch.checkStateConsistency(); got != 0 {
+		t.Error("expected no inconsistency got ", got)
+	}
+}
+
+// TestNodeWatcher_firmamentTimeouts checks that the node state is left unchanged when a request to firmament
+// times out, and that the change and the next ones are returned to be processed again.
+func TestNodeWatcher_firmamentTimeouts(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	added, err := nodeWatch.parseNode(BuildNode("node0", "10", "10000000", nil, nil, false), NodeAdded)
+	if err != nil {
+		t.Fatal("error parsing node ", err)
+	}
+	deleted, err := nodeWatch.parseNode(BuildNode("node0", "10", "10000000", nil, nil, false), NodeDeleted)
+	if err != nil {
+		t.Fatal("error parsing node ", err)
+	}
+
+	// The topology firmament may have applied before timing out is removed at once, the removal times out too.
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(nil, timeoutError),
+		testObj.firmamentClient.EXPECT().NodeRemoved(gomock.Any(), gomock.Any()).Return(nil, timeoutError),
+	)
+	items := []interface{}{added, deleted}
+	if retry := nodeWatch.processNodes(context.Background(), items); !reflect.DeepEqual(retry, items) {
+		t.Fatalf("expected the changes %v to be processed again, got %v", items, retry)
+	}
+	if len(NodeToRTND) != 0 || len(ResIDToNode) != 0 {
+		t.Fatalf("expected the node not to be added, got %v %v", NodeToRTND, ResIDToNode)
+	}
+
+	// The topology is removed before the node is added again.
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().NodeRemoved(gomock.Any(), gomock.Any()).Return(
+			&firmament.NodeRemovedResponse{Type: firmament.NodeReplyType_NODE_REMOVED_OK}, nil),
+		testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+			&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil),
+		testObj.firmamentClient.EXPECT().NodeRemoved(gomock.Any(), gomock.Any()).Return(nil, timeoutError),
+	)
+	if retry := nodeWatch.processNodes(context.Background(), items); !reflect.DeepEqual(retry, items[1:]) {
+		t.Fatalf("expected the deletion to be processed again, got %v", retry)
+	}
+	if _, ok := NodeToRTND["node0"]; !ok {
+		t.Fatal("expected the node to stay until its removal is accepted")
+	}
+
+	testObj.firmamentClient.EXPECT().NodeRemoved(gomock.Any(), gomock.Any()).Return(
+		&firmament.NodeRemovedResponse{Type: firmament.NodeReplyType_NODE_REMOVED_OK}, nil)
+	if retry := nodeWatch.processNodes(context.Background(), items[1:]); len(retry) != 0 {
+		t.Fatalf("expected the deletion to be processed, got %v", retry)
+	}
+	if len(NodeToRTND) != 0 || len(ResIDToNode) != 0 {
+		t.Errorf("expected the node to be removed, got %v %v", NodeToRTND, ResIDToNode)
+	}
+}
+
+// TestNodeWatcher_processNodesDuplicateName checks that a node sharing the name of a tracked node with a different
+// UID is skipped and counted, while the tracked node is kept, and that the name can be reused once it is deleted.
+func TestNodeWatcher_processNodesDuplicateName(t *testing.T) {
+	fc := firmamenttest.NewFakeClient()
+	nodeWatch := NewNodeWatcher(&fake.Clientset{}, fc)
+	parse := func(uid string, phase NodePhase) *Node {
+		k8sNode := BuildNode("node0", "10", "10000000", nil, nil, false)
+		k8sNode.UID = types.UID(uid)
+		node, err := nodeWatch.parseNode(k8sNode, phase)
+		if err != nil {
+			t.Fatalf("error parsing node %v", err)
+		}
+		return node
+	}
+	duplicates := readMetric(t, metrics.DuplicateNodes).GetCounter().GetValue()
+
+	nodeWatch.processNodes(context.Background(), []interface{}{parse("uid-a", NodeAdded), parse("uid-b", NodeAdded)})
+	fc.ExpectMethods(t, "NodeAdded")
+	if _, ok := NodeToRTND["node0"]; !ok || nodeToUID["node0"] != "uid-a" {
+		t.Errorf("expected the first node0 to be tracked, got UID %q", nodeToUID["node0"])
+	}
+	if got := readMetric(t, metrics.DuplicateNodes).GetCounter().GetValue() - duplicates; got != 1 {
+		t.Errorf("expected a duplicate node to be counted, got %v", got)
+	}
+
+	// The node added again is not a duplicate.
+	nodeWatch.processNodes(context.Background(), []interface{}{parse("uid-a", NodeAdded)})
+	if got := readMetric(t, metrics.DuplicateNodes).GetCounter().GetValue() - duplicates; got != 1 {
+		t.Errorf("expected the node added again not to be counted, got %v duplicates", got)
+	}
+
+	nodeWatch.processNodes(context.Background(), []interface{}{parse("uid-a", NodeDeleted), parse("uid-b", NodeAdded)})
+	fc.ExpectMethods(t, "NodeAdded", "NodeRemoved", "NodeAdded")
+	if _, ok := NodeToRTND["node0"]; !ok || nodeToUID["node0"] != "uid-b" {
+		t.Errorf("expected the second node0 to be tracked once the first one is deleted, got UID %q", nodeToUID["node0"])
+	}
+	if got := nodeWatch.checkStateConsistency(); got != 0 {
+		t.Errorf("expected the node state to be consistent, got %d inconsistencies", got)
+	}
+}
+
+// TestNodeWatcher_processNodesFakeClient runs the node worker against the fake firmament client, and checks
+// the requests sent to firmament, the node state and the changes returned to be processed again.
+func TestNodeWatcher_processNodesFakeClient(t *testing.T) {
+	var testData = []struct {
+		name          string
+		phases        []NodePhase
+		errors        map[string][]error
+		expectedCalls []string
+		expectedNode  bool
+		expectedRetry int
+	}{
+		{name: "added", phases: []NodePhase{NodeAdded},
+			expectedCalls: []string{"NodeAdded"}, expectedNode: true},
+		{name: "added twice", phases: []NodePhase{NodeAdded, NodeAdded},
+			expectedCalls: []string{"NodeAdded"}, expectedNode: true},
+		{name: "added and updated", phases: []NodePhase{NodeAdded, NodeUpdated},
+			expectedCalls: []string{"NodeAdded", "NodeUpdated"}, expectedNode: true},
+		{name: "added and deleted", phases: []NodePhase{NodeAdded, NodeDeleted},
+			expectedCalls: []string{"NodeAdded", "NodeRemoved"}},
+		{name: "added and failed", phases: []NodePhase{NodeAdded, NodeFailed},
+			expectedCalls: []string{"NodeAdded", "NodeFailed"}},
+		{name: "deleted twice", phases: []NodePhase{NodeAdded, NodeDeleted, NodeDeleted},
+			expectedCalls: []string{"NodeAdded", "NodeRemoved"}},
+		{name: "unknown node", phases: []NodePhase{NodeUpdated, NodeDeleted, NodeFailed}},
+		{name: "addition timed out", phases: []NodePhase{NodeAdded, NodeDeleted},
+			errors:        map[string][]error{"NodeAdded": {timeoutError}},
+			expectedCalls: []string{"NodeAdded", "NodeRemoved"}, expectedRetry: 2},
+		{name: "update timed out", phases: []NodePhase{NodeAdded, NodeUpdated, NodeDeleted},
+			errors:        map[string][]error{"NodeUpdated": {timeoutError}},
+			expectedCalls: []string{"NodeAdded", "NodeUpdated"}, expectedNode: true, expectedRetry: 2},
+		{name: "update rejected", phases: []NodePhase{NodeAdded, NodeUpdated, NodeDeleted},
+			errors:        map[string][]error{"NodeUpdated": {status.Error(codes.InvalidArgument, "invalid topology")}},
+			expectedCalls: []string{"NodeAdded", "NodeUpdated", "NodeRemoved"}},
+		{name: "update of a node unknown to firmament", phases: []NodePhase{NodeAdded, NodeUpdated},
+			errors:        map[string][]error{"NodeUpdated": {status.Error(codes.NotFound, "unknown node")}},
+			expectedCalls: []string{"NodeAdded", "NodeUpdated", "NodeAdded"}, expectedNode: true},
+		{name: "removal timed out", phases: []NodePhase{NodeAdded, NodeDeleted},
+			errors:        map[string][]error{"NodeRemoved": {timeoutError}},
+			expectedCalls: []string{"NodeAdded", "NodeRemoved"}, expectedNode: true, expectedRetry: 1},
+	}
+
+	for _, data := range testData {
+		fc := firmamenttest.NewFakeClient()
+		for method, errs := range data.errors {
+			fc.InjectError(method, errs...)
+		}
+		nodeWatch := NewNodeWatcher(&fake.Clientset{}, fc)
+		var items []interface{}
+		for _, phase := range data.phases {
+			node, err := nodeWatch.parseNode(BuildNode("node0", "10", "10000000", nil, nil, false), phase)
+			if err != nil {
+				t.Fatalf("%s: error parsing node %v", data.name, err)
+			}
+			items = append(items, node)
+		}
+
+		retry := nodeWatch.processNodes(context.Background(), items)
+		if len(retry) != data.expectedRetry {
+			t.Errorf("%s: expected %d changes to be processed again, got %d", data.name, data.expectedRetry, len(retry))
+		}
+		var calls []string
+		for _, call := range fc.Calls() {
+			calls = append(calls, call.Method)
+		}
+		if !reflect.DeepEqual(calls, data.expectedCalls) {
+			t.Errorf("%s: expected the requests %v, got %v", data.name, data.expectedCalls, calls)
+		}
+		if _, ok := NodeToRTND["node0"]; ok != data.expectedNode {
+			t.Errorf("%s: expected node0 to be tracked %v, got %v", data.name, data.expectedNode, ok)
+		}
+		if got := nodeWatch.checkStateConsistency(); got != 0 {
+			t.Errorf("%s: expected no inconsistency, got %d", data.name, got)
+		}
+		// The removals refer to the resource of the added node.
+		for _, request := range fc.Requests("NodeRemoved") {
+			added := fc.Requests("NodeAdded")[0].(*firmament.ResourceTopologyNodeDescriptor)
+			if uid := request.(*firmament.ResourceUID).GetResourceUid(); uid != added.GetResourceDesc().GetUuid() {
+				t.Errorf("%s: expected the removal of resource %s, got %s", data.name, added.GetResourceDesc().GetUuid(), uid)
+			}
+		}
+	}
+}
+
+// TestNodeWatcher_processNodesUpdateFailed checks that the topology of a node is only replaced by its update once
+// firmament accepts it, and that the topology tracked meanwhile is left unchanged.
+func TestNodeWatcher_processNodesUpdateFailed(t *testing.T) {
+	fc := firmamenttest.NewFakeClient()
+	fc.InjectError("NodeUpdated", timeoutError)
+	nodeWatch := NewNodeWatcher(&fake.Clientset{}, fc)
+	added, err := nodeWatch.parseNode(BuildNode("node0", "10", "10000000", map[string]string{"zone": "a"}, nil, false), NodeAdded)
+	if err != nil {
+		t.Fatalf("error parsing node %v", err)
+	}
+	updated, err := nodeWatch.parseNode(BuildNode("node0", "10", "10000000", map[string]string{"zone": "b"}, nil, false), NodeUpdated)
+	if err != nil {
+		t.Fatalf("error parsing node %v", err)
+	}
+	zone := func(rtnd *firmament.ResourceTopologyNodeDescriptor) string {
+		for _, label := range rtnd.GetResourceDesc().GetLabels() {
+			if label.GetKey() == "zone" {
+				return label.GetValue()
+			}
+		}
+		return ""
+	}
+
+	if retry := nodeWatch.processNodes(context.Background(), []interface{}{added, updated}); len(retry) != 1 {
+		t.Fatalf("expected the update to be processed again, got %d changes", len(retry))
+	}
+	NodeMux.RLock()
+	current := NodeToRTND["node0"]
+	NodeMux.RUnlock()
+	if got := zone(current); got != "a" {
+		t.Errorf("expected the tracked topology to keep zone a after the failed update, got %q", got)
+	}
+	if got := zone(fc.Requests("NodeUpdated")[0].(*firmament.ResourceTopologyNodeDescriptor)); got != "b" {
+		t.Errorf("expected the update to be sent with zone b, got %q", got)
+	}
+
+	if retry := nodeWatch.processNodes(context.Background(), []interface{}{updated}); len(retry) != 0 {
+		t.Fatalf("expected the update to succeed, got %d changes to be processed again", len(retry))
+	}
+	NodeMux.RLock()
+	rtnd := NodeToRTND["node0"]
+	NodeMux.RUnlock()
+	if got := zone(rtnd); got != "b" {
+		t.Errorf("expected the tracked topology to have zone b after the update, got %q", got)
+	}
+	if got := zone(current); got != "a" {
+		t.Errorf("expected the replaced topology to be left unchanged, got zone %q", got)
+	}
+	if got := nodeWatch.checkStateConsistency(); got != 0 {
+		t.Errorf("expected no inconsistency, got %d", got)
+	}
+}
+
+// TestNodeWatcher_retryNodesLogLimit processes a node addition failing 1000 times in a row, and checks that
+// only a handful of failures are logged, and that the next failure is logged once the addition succeeded.
+func TestNodeWatcher_retryNodesLogLimit(t *testing.T) {
+	const failures = 1000
+	fc := firmamenttest.NewFakeClient()
+	for i := 0; i < failures; i++ {
+		fc.InjectError("NodeAdded", timeoutError)
+	}
+	nodeWatch := NewNodeWatcher(&fake.Clientset{}, fc)
+	logs := 0
+	nodeWatch.failureLog = firmament.NewLogLimiter(10*time.Second, 1, func(format string, args ...interface{}) {
+		logs++
+	})
+	node, err := nodeWatch.parseNode(BuildNode("node0", "10", "10000000", nil, nil, false), NodeAdded)
+	if err != nil {
+		t.Fatal("error parsing node ", err)
+	}
+	items := []interface{}{node}
+	for i := 0; i < failures; i++ {
+		if len(nodeWatch.processNodes(context.Background(), items)) != 1 {
+			t.Fatalf("expected the addition to be processed again after failure %d", i)
+		}
+	}
+	if logs < 1 || logs > 3 {
+		t.Errorf("expected a handful of the %d failures to be logged, got %d logs", failures, logs)
+	}
+
+	if retry := nodeWatch.processNodes(context.Background(), items); len(retry) != 0 {
+		t.Fatalf("expected the addition to succeed, got %d changes to process again", len(retry))
+	}
+	logs = 0
+	fc.InjectError("NodeRemoved", timeoutError)
+	node.Phase = NodeDeleted
+	nodeWatch.processNodes(context.Background(), items)
+	if logs != 1 {
+		t.Errorf("expected the failure following the succeeded addition to be logged, got %d logs", logs)
+	}
+}
+
+// TestNodeWatcher_deferZeroAllocatableNode feeds a booting node without allocatable resources followed by an
+// update reporting them, and checks that only the populated node is enqueued.
+func TestNodeWatcher_deferZeroAllocatableNode(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+
+	booting := BuildNode("node0", "10", "10000000", nil, nil, false)
+	booting.Status.Allocatable = v1.ResourceList{v1.ResourceMemory: resource.MustParse("10000000")}
+	stillBooting := booting.DeepCopy()
+	stillBooting.Labels = map[string]string{"boot": "done"}
+	populated := BuildNode("node0", "10", "10000000", map[string]string{"boot": "done"}, nil, false)
+	key, err := cache.MetaNamespaceKeyFunc(booting)
+	if err != nil {
+		t.Fatal("error getting key ", err)
+	}
+
+	nodeWatch.enqueueNodeAddition(key, booting)
+	nodeWatch.enqueueNodeUpdate(key, booting, stillBooting)
+	if got := nodeWatch.nodeWorkQueue.Len(); got != 0 {
+		t.Fatalf("expected the node without allocatable cpu to be deferred, got %d queued nodes", got)
+	}
+	nodeWatch.enqueueNodeUpdate(key, stillBooting, populated)
+	nodeWatch.nodeWorkQueue.ShutDown()
+	var nodes []*Node
+	for {
+		_, items, quit := nodeWatch.nodeWorkQueue.Get()
+		if quit {
+			break
+		}
+		for _, item := range items {
+			nodes = append(nodes, item.(*Node))
+		}
+	}
+	if len(nodes) != 1 || nodes[0].Phase != NodeAdded || nodes[0].CPUAllocatable != 10000 {
+		t.Fatalf("expected the populated node to be added, got %v", nodes)
+	}
+	if nodeWatch.isDeferredNode("node0") {
+		t.Error("expected node0 not to be deferred once it is added")
+	}
+
+	// A deferred node is deleted without ever being added to firmament.
+	nodeWatch = NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	nodeWatch.enqueueNodeAddition(key, booting)
+	nodeWatch.enqueueNodeDeletion(key, booting)
+	if got := nodeWatch.nodeWorkQueue.Len(); got != 0 || nodeWatch.isDeferredNode("node0") {
+		t.Errorf("expected the deleted deferred node to be forgotten, got %d queued nodes", got)
+	}
+}
+
+// TestNodeWatcher_cordonToggle replays a node quickly cordoned, uncordoned and cordoned again, in order and
+// with duplicated or reordered deliveries, and checks that the tracked nodes match the final node spec.
+func TestNodeWatcher_cordonToggle(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	schedulable := BuildNode("node0", "10", "10000000", nil, nil, false)
+	cordoned := BuildNode("node0", "10", "10000000", nil, nil, true)
+	key, err := cache.MetaNamespaceKeyFunc(schedulable)
+	if err != nil {
+		t.Fatal("error getting key ", err)
+	}
+	added, removed := 0, 0
+	testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Do(func(ctx, rtnd interface{}, opts ...interface{}) {
+		added++
+	}).Return(&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil).AnyTimes()
+	testObj.firmamentClient.EXPECT().NodeRemoved(gomock.Any(), gomock.Any()).Do(func(ctx, ruid interface{}, opts ...interface{}) {
+		removed++
+	}).Return(&firmament.NodeRemovedResponse{Type: firmament.NodeReplyType_NODE_REMOVED_OK}, nil).AnyTimes()
+	checkState := func(step string, tracked bool, expectedAdded, expectedRemoved int) {
+		NodeMux.RLock()
+		_, ok := NodeToRTND["node0"]
+		NodeMux.RUnlock()
+		if ok != tracked {
+			t.Errorf("%s: expected node0 tracked %v, got %v", step, tracked, ok)
+		}
+		if added != expectedAdded || removed != expectedRemoved {
+			t.Errorf("%s: expected %d additions and %d removals, got %d and %d", step, expectedAdded, expectedRemoved, added, removed)
+		}
+		if inconsistencies := nodeWatch.checkStateConsistency(); inconsistencies != 0 {
+			t.Errorf("%s: expected no leaked resource IDs, got %d inconsistencies", step, inconsistencies)
+		}
+		if len(ResIDToNode) != len(NodeToRTND)*2 {
+			t.Errorf("%s: expected the resource IDs of the machine and its PU per node, got %v", step, ResIDToNode)
+		}
+	}
+
+	nodeWatch.enqueueNodeAddition(key, schedulable)
+	nodeWatch.processNextItem()
+	checkState("added", true, 1, 0)
+
+	// The toggles are merged under the node key and applied in order by a single worker.
+	nodeWatch.enqueueNodeUpdate(key, schedulable, cordoned)
+	nodeWatch.enqueueNodeUpdate(key, cordoned, schedulable)
+	nodeWatch.enqueueNodeUpdate(key, schedulable, cordoned)
+	nodeWatch.processNextItem()
+	checkState("cordon, uncordon, cordon", false, 2, 2)
+
+	// A removal of a node which is not tracked any more and a duplicate addition are no-ops.
+	nodeWatch.processNodes(context.Background(), []interface{}{
+		&Node{Hostname: "node0", Phase: NodeDeleted},
+	})
+	checkState("duplicate removal", false, 2, 2)
+	nodeWatch.enqueueNodeUpdate(key, cordoned, schedulable)
+	nodeWatch.enqueueNodeUpdate(key, cordoned, schedulable)
+	nodeWatch.processNextItem()
+	checkState("duplicate uncordon", true, 3, 2)
+
+	nodeWatch.enqueueNodeUpdate(key, schedulable, cordoned)
+	nodeWatch.enqueueNodeUpdate(key, cordoned, schedulable)
+	nodeWatch.processNextItem()
+	nodeWatch.enqueueNodeUpdate(key, schedulable, cordoned)
+	nodeWatch.processNextItem()
+	checkState("cordon, uncordon then cordon", false, 4, 4)
+	if got := nodeWatch.nodeWorkQueue.Len(); got != 0 {
+		t.Errorf("expected no queued node left, got %d", got)
+	}
+}
+
+// TestNewNodeWatcherWithInformer runs a node watcher and another handler on a shared node informer, and checks that
+// both receive the nodes listed and added while the watcher ignores the nodes not matching its label selector.
+func TestNewNodeWatcherWithInformer(t *testing.T) {
+	readyConditions := []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	client := fake.NewSimpleClientset(BuildNode("node0", "4", "8Gi", map[string]string{"pool": "poseidon"}, readyConditions, false))
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().Nodes().List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().Nodes().Watch(options)
+		},
+	}, &v1.Node{}, 0, cache.Indexers{})
+	sharedNodes := make(chan string, 10)
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { sharedNodes <- obj.(*v1.Node).Name },
+	})
+	fc := firmamenttest.NewFakeClient()
+	cfg := DefaultNodeWatcherConfig()
+	cfg.LabelSelector = "pool=poseidon"
+	nodeWatch := NewNodeWatcherWithInformer(informer, client, fc, WithNodeWatcherConfig(cfg))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go informer.Run(stopCh)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go nodeWatch.Run(ctx, 1)
+
+	if err := nodeWatch.WaitForNodes(ctx); err != nil {
+		t.Fatalf("expected the listed node to be added, got %v", err)
+	}
+	client.CoreV1().Nodes().Create(BuildNode("node1", "2", "4Gi", nil, readyConditions, false))
+	client.CoreV1().Nodes().Create(BuildNode("node2", "2", "4Gi", map[string]string{"pool": "poseidon"}, readyConditions, false))
+	for _, expected := range []string{"node0", "node1", "node2"} {
+		select {
+		case name := <-sharedNodes:
+			if name != expected {
+				t.Errorf("expected the shared handler to receive %s, got %s", expected, name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the shared handler to receive %s", expected)
+		}
+	}
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(fc.Requests("NodeAdded")) == 2, nil
+	})
+	if err != nil {
+		t.Fatalf("expected %d nodes added to firmament, got %v", 2, fc.Requests("NodeAdded"))
+	}
+	NodeMux.RLock()
+	_, ok0 := NodeToRTND["node0"]
+	_, ok1 := NodeToRTND["node1"]
+	_, ok2 := NodeToRTND["node2"]
+	NodeMux.RUnlock()
+	if !ok0 || ok1 || !ok2 {
+		t.Errorf("expected node0 and node2 to be tracked, got node0 %v, node1 %v and node2 %v", ok0, ok1, ok2)
+	}
+}
+
+// TestNodeWatcher_metricsEndpoint processes a node change and scrapes the metrics registry served by the metrics
+// endpoint, the poseidon series of the watchers and the process collectors must be exposed.
+func TestNodeWatcher_metricsEndpoint(t *testing.T) {
+	metrics.Register()
+	nodeWatch := NewNodeWatcher(&fake.Clientset{}, firmamenttest.NewFakeClient())
+	nodeWatch.nodeWorkQueue.Add("node-metrics", &Node{
+		Hostname:         "node-metrics",
+		Phase:            NodeAdded,
+		CPUCapacity:      8000,
+		CPUAllocatable:   7000,
+		MemCapacityKb:    16384,
+		MemAllocatableKb: 15360,
+	})
+	nodeWatch.processNextItem()
+
+	server := httptest.NewServer(promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("unable to scrape the metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read the metrics: %v", err)
+	}
+	for _, series := range []string{`poseidon_watcher_events_total{phase="Added",resource="nodes"}`, "process_start_time_seconds", "go_goroutines"} {
+		if !strings.Contains(string(body), series) {
+			t.Errorf("expected the metrics to expose %s, got:\n%s", series, body)
+		}
+	}
+}
+
+// TestNodeWatcher_maxInFlightNodeEvents floods the watcher with more node events than MaxInFlightNodeEvents, the
+// event handler must block once the cap is reached and resume as the workers drain the backlog.
+func TestNodeWatcher_maxInFlightNodeEvents(t *testing.T) {
+	cfg := DefaultNodeWatcherConfig()
+	cfg.MaxInFlightNodeEvents = 2
+	nodeWatch := NewNodeWatcher(&fake.Clientset{}, firmamenttest.NewFakeClient(), WithNodeWatcherConfig(cfg))
+	const flood = 5
+	queued := make(chan int, flood)
+	go func() {
+		for i := 0; i < flood; i++ {
+			name := fmt.Sprintf("node%d", i)
+			nodeWatch.enqueueNodeAddition(name, BuildNode(name, "4", "8Gi", nil, nil, false))
+			queued <- i
+		}
+		close(queued)
+	}()
+	expectQueued := func(step string, expected int) {
+		select {
+		case i := <-queued:
+			if i != expected {
+				t.Fatalf("%s: expected node%d to be queued, got node%d", step, expected, i)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("%s: node%d was not queued", step, expected)
+		}
+	}
+	expectPaused := func(step string) {
+		select {
+		case i, ok := <-queued:
+			t.Fatalf("%s: expected the event handler to be paused, node%d queued (%v)", step, i, ok)
+		case <-time.After(100 * time.Millisecond):
+		}
+		var m dto.Metric
+		metrics.InFlightNodeEvents.Write(&m)
+		if got := m.GetGauge().GetValue(); got != 2 {
+			t.Errorf("%s: expected 2 node events in flight, got %v", step, got)
+		}
+	}
+
+	expectQueued("below the cap", 0)
+	expectQueued("below the cap", 1)
+	expectPaused("cap reached")
+	// Each processed event lets one more event in.
+	for i := 2; i < flood; i++ {
+		nodeWatch.processNextItem()
+		expectQueued("after a processed event", i)
+		if i < flood-1 {
+			expectPaused("cap reached again")
+		}
+	}
+	if _, ok := <-queued; ok {
+		t.Error("expected the flood to be over")
+	}
+	nodeWatch.processNextItem()
+	nodeWatch.processNextItem()
+	if got := nodeWatch.backlog.len(); got != 0 {
+		t.Errorf("expected no node event in flight once drained, got %d", got)
+	}
+	NodeMux.RLock()
+	defer NodeMux.RUnlock()
+	if len(NodeToRTND) != flood {
+		t.Errorf("expected %d nodes added, got %d", flood, len(NodeToRTND))
+	}
+}
+
+// TestNodeWatcher_RunDrainsQueue stops a running watcher while nodes are queued, Run must return once they are
+// sent to firmament.
+func TestNodeWatcher_RunDrainsQueue(t *testing.T) {
+	readyConditions := []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	fc := firmamenttest.NewFakeClient()
+	nodeWatch := NewNodeWatcher(fake.NewSimpleClientset(BuildNode("node0", "4", "8Gi", nil, readyConditions, false)), fc)
+	runCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	stopped := make(chan error)
+	go func() { stopped <- nodeWatch.Run(runCtx, 1) }()
+	ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+	defer cancel()
+	if err := nodeWatch.WaitForNodes(ctx); err != nil {
+		t.Fatalf("expected the listed node to be added, got %v", err)
+	}
+
+	const queued = 20
+	for i := 1; i <= queued; i++ {
+		name := fmt.Sprintf("node%d", i)
+		nodeWatch.enqueueNodeAddition(name, BuildNode(name, "4", "8Gi", nil, readyConditions, false))
+	}
+	stop()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Run() failed: %v", err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("expected Run to return once the queue is drained")
+	}
+	if added := len(fc.Requests("NodeAdded")); added != queued+1 {
+		t.Errorf("expected %d nodes added to firmament before Run returned, got %d", queued+1, added)
+	}
+	NodeMux.RLock()
+	tracked := len(NodeToRTND)
+	NodeMux.RUnlock()
+	if tracked != queued+1 {
+		t.Errorf("expected %d nodes to be tracked, got %d", queued+1, tracked)
+	}
+	if n := nodeWatch.nodeWorkQueue.Len(); n != 0 {
+		t.Errorf("expected the queue to be drained, %d nodes left", n)
+	}
+}
+
+// TestNodeWatcher_eventHandlers calls the event handlers with nodes, tombstones and objects which are not nodes, the
+// objects whose key can not be computed or which are not nodes must be dropped.
+func TestNodeWatcher_eventHandlers(t *testing.T) {
+	readyConditions := []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	node := BuildNode("node-handlers", "4", "8Gi", map[string]string{"pool": "a"}, readyConditions, false)
+	relabeled := BuildNode("node-handlers", "4", "8Gi", map[string]string{"pool": "b"}, readyConditions, false)
+	tombstone := cache.DeletedFinalStateUnknown{Key: "node-handlers", Obj: node}
+	pod := BuildPod("default", "pod-handlers", nil, v1.PodPending, "1", "1Gi", nil, "")
+	var testData = []struct {
+		name     string
+		handle   func(nw *NodeWatcher)
+		expected NodePhase
+	}{
+		{name: "added node", handle: func(nw *NodeWatcher) { nw.onAdd(node) }, expected: NodeAdded},
+		{name: "added string", handle: func(nw *NodeWatcher) { nw.onAdd("node-handlers") }},
+		{name: "added pod", handle: func(nw *NodeWatcher) { nw.onAdd(pod) }},
+		{name: "updated node", handle: func(nw *NodeWatcher) { nw.onUpdate(node, relabeled) }, expected: NodeUpdated},
+		{name: "updated nil", handle: func(nw *NodeWatcher) { nw.onUpdate(node, nil) }},
+		{name: "updated from pod", handle: func(nw *NodeWatcher) { nw.onUpdate(pod, relabeled) }},
+		{name: "deleted node", handle: func(nw *NodeWatcher) { nw.onDelete(node) }, expected: NodeDeleted},
+		{name: "deleted tombstone", handle: func(nw *NodeWatcher) { nw.onDelete(tombstone) }, expected: NodeDeleted},
+		{name: "deleted number", handle: func(nw *NodeWatcher) { nw.onDelete(42) }},
+	}
+
+	for _, data := range testData {
+		nodeWatch := NewNodeWatcher(&fake.Clientset{}, firmamenttest.NewFakeClient())
+		data.handle(nodeWatch)
+		if data.expected == "" {
+			if n := nodeWatch.nodeWorkQueue.Len(); n != 0 {
+				t.Errorf("%s: expected the object to be dropped, %d nodes queued", data.name, n)
+			}
+			continue
+		}
+		if n := nodeWatch.nodeWorkQueue.Len(); n != 1 {
+			t.Errorf("%s: expected the node to be queued, %d nodes queued", data.name, n)
+			continue
+		}
+		key, items, _ := nodeWatch.nodeWorkQueue.Get()
+		nodeWatch.nodeWorkQueue.Done(key)
+		if key != "node-handlers" || len(items) != 1 || items[0].(*Node).Phase != data.expected {
+			t.Errorf("%s: expected node-handlers to be queued as %s, got %v %v", data.name, data.expected, key, items)
+		}
+	}
+}
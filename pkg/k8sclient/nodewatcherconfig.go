@@ -0,0 +1,157 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// NodeWatcherConfig holds the tunables of the NodeWatcher.
+type NodeWatcherConfig struct {
+	// ResyncPeriod is the resync period of the node informer, 0 disables the resync.
+	ResyncPeriod time.Duration
+	// Workers is the number of node workers, AutoWorkers scales them with the number of CPUs up to MaxWorkers.
+	Workers    int
+	MaxWorkers int
+	// LabelSelector restricts the nodes advertised to firmament, all nodes are watched when empty.
+	LabelSelector string
+	// Ratios applied to the node capacity advertised to firmament.
+	CPUOvercommitRatio float64
+	MemOvercommitRatio float64
+	// MemoryUnit is the unit of the memory capacities advertised to firmament.
+	MemoryUnit MemoryUnit
+	// UseNodeCapacity advertises the node capacity instead of the allocatable resources, ignoring the
+	// resources reserved for the system and the kubelet.
+	UseNodeCapacity bool
+	// ExcludeControlPlane hides the control plane nodes from firmament.
+	ExcludeControlPlane bool
+	// NotReadyGracePeriod is the time a node stays not ready before it is failed, 0 fails it at once.
+	NotReadyGracePeriod time.Duration
+	// WatchErrorThreshold is the number of consecutive list/watch failures after which the watcher is not ready.
+	WatchErrorThreshold int
+	// MaxInFlightNodeEvents is the number of node events queued and not processed yet above which the
+	// event handlers of the informer block until the workers drain the backlog, 0 disables the cap.
+	MaxInFlightNodeEvents int
+	// WorkerRestartPeriod in milliseconds and WorkerRestartJitter restart the workers which returned, see
+	// getWorkerRestart.
+	WorkerRestartPeriod int
+	WorkerRestartJitter float64
+	// FailureLogInterval is the time between the logs of the repeated failures of a node, 0 logs every failure.
+	FailureLogInterval time.Duration
+	// WatchStaleness is the time without node event after which the node informer is re-created, 0 disables the
+	// watchdog, see watchdogInformer. The shared informers are not re-created.
+	WatchStaleness time.Duration
+	// PUsPerMachine is the number of PUs the capacity of the nodes without NUMA zones is split among, AutoPUs
+	// advertises a PU per CPU core. The requests of a pod must fit in a PU.
+	PUsPerMachine int
+	// QueueRetry is the backoff of the node changes firmament failed to process, and the number of retries after which
+	// they are dropped.
+	QueueRetry QueueRetryPolicy
+}
+
+// DefaultNodeWatcherConfig returns the NodeWatcher configuration read from the command line flags and the config file.
+func DefaultNodeWatcherConfig() NodeWatcherConfig {
+	return NewNodeWatcherConfig(config.GetConfig())
+}
+
+// NewNodeWatcherConfig returns the NodeWatcher configuration of the poseidon options in cfg.
+func NewNodeWatcherConfig(cfg *config.Config) NodeWatcherConfig {
+	return NodeWatcherConfig{
+		ResyncPeriod:          time.Duration(cfg.NodeResync) * time.Second,
+		Workers:               config.WorkersOrDefault(cfg.NodeWorkers, cfg.Workers),
+		MaxWorkers:            cfg.MaxWorkers,
+		LabelSelector:         cfg.NodeSelector,
+		CPUOvercommitRatio:    cfg.CPUOvercommitRatio,
+		MemOvercommitRatio:    cfg.MemOvercommitRatio,
+		MemoryUnit:            MemoryUnit(cfg.MemoryUnit),
+		UseNodeCapacity:       cfg.UseNodeCapacity,
+		ExcludeControlPlane:   cfg.ExcludeCtrlPlane,
+		NotReadyGracePeriod:   time.Duration(cfg.NotReadyGrace) * time.Second,
+		WatchErrorThreshold:   cfg.WatchErrThreshold,
+		MaxInFlightNodeEvents: cfg.MaxNodeEvents,
+		WorkerRestartPeriod:   cfg.RestartPeriod,
+		WorkerRestartJitter:   cfg.RestartJitter,
+		FailureLogInterval:    time.Duration(cfg.FailureLogInterval) * time.Second,
+		WatchStaleness:        time.Duration(cfg.NodeWatchStaleness) * time.Second,
+		PUsPerMachine:         cfg.PUsPerMachine,
+		QueueRetry:            newQueueRetryPolicy(cfg),
+	}
+}
+
+// Validate returns an error describing the first invalid setting of the configuration.
+func (c NodeWatcherConfig) Validate() error {
+	if c.ResyncPeriod < 0 {
+		return fmt.Errorf("the resync period must not be negative, got %v", c.ResyncPeriod)
+	}
+	if _, err := getWorkerCount(c.Workers, c.MaxWorkers); err != nil {
+		return err
+	}
+	if _, err := labels.Parse(c.LabelSelector); err != nil {
+		return fmt.Errorf("invalid node label selector %q: %v", c.LabelSelector, err)
+	}
+	if c.CPUOvercommitRatio <= 0 || c.MemOvercommitRatio <= 0 {
+		return fmt.Errorf("overcommit ratios must be greater than 0, got cpu %v memory %v", c.CPUOvercommitRatio, c.MemOvercommitRatio)
+	}
+	if err := c.MemoryUnit.Validate(); err != nil {
+		return err
+	}
+	if c.NotReadyGracePeriod < 0 {
+		return fmt.Errorf("the not ready grace period must not be negative, got %v", c.NotReadyGracePeriod)
+	}
+	if c.WatchErrorThreshold < 1 {
+		return fmt.Errorf("the watch error threshold must be at least 1, got %d", c.WatchErrorThreshold)
+	}
+	if c.MaxInFlightNodeEvents < 0 {
+		return fmt.Errorf("the maximum of in-flight node events must not be negative, got %d", c.MaxInFlightNodeEvents)
+	}
+	if _, err := getWorkerRestart(c.WorkerRestartPeriod, c.WorkerRestartJitter); err != nil {
+		return err
+	}
+	if c.FailureLogInterval < 0 {
+		return fmt.Errorf("the failure log interval must not be negative, got %v", c.FailureLogInterval)
+	}
+	if c.WatchStaleness < 0 {
+		return fmt.Errorf("the watch staleness must not be negative, got %v", c.WatchStaleness)
+	}
+	if c.PUsPerMachine < 1 && c.PUsPerMachine != AutoPUs {
+		return fmt.Errorf("the number of PUs per machine must be at least 1 or %d for a PU per core, got %d", AutoPUs, c.PUsPerMachine)
+	}
+	if err := c.QueueRetry.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newQueueRetryPolicy returns the retry policy of the work queues of the watchers of the poseidon options in cfg.
+func newQueueRetryPolicy(cfg *config.Config) QueueRetryPolicy {
+	return QueueRetryPolicy{
+		BaseDelay:  time.Duration(cfg.RetryBaseDelay) * time.Millisecond,
+		MaxDelay:   time.Duration(cfg.RetryMaxDelay) * time.Millisecond,
+		MaxRetries: cfg.QueueMaxRetries,
+	}
+}
+
+// WithNodeWatcherConfig replaces the configuration read from the command line flags and the config file.
+func WithNodeWatcherConfig(cfg NodeWatcherConfig) NodeWatcherOption {
+	return func(nw *NodeWatcher) {
+		nw.cfg = cfg
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeWatcherConfig_Validate(t *testing.T) {
+	var testData = []struct {
+		name   string
+		modify func(cfg *NodeWatcherConfig)
+		valid  bool
+	}{
+		{name: "default", modify: func(cfg *NodeWatcherConfig) {}, valid: true},
+		{name: "auto workers", modify: func(cfg *NodeWatcherConfig) { cfg.Workers = AutoWorkers }, valid: true},
+		{name: "selector", modify: func(cfg *NodeWatcherConfig) { cfg.LabelSelector = "pool=batch,!gpu" }, valid: true},
+		{name: "negative resync", modify: func(cfg *NodeWatcherConfig) { cfg.ResyncPeriod = -time.Second }, valid: false},
+		{name: "zero workers", modify: func(cfg *NodeWatcherConfig) { cfg.Workers = 0 }, valid: false},
+		{name: "PU per core", modify: func(cfg *NodeWatcherConfig) { cfg.PUsPerMachine = AutoPUs }, valid: true},
+		{name: "zero PUs", modify: func(cfg *NodeWatcherConfig) { cfg.PUsPerMachine = 0 }, valid: false},
+		{name: "max retries", modify: func(cfg *NodeWatcherConfig) { cfg.QueueRetry.MaxRetries = 5 }, valid: true},
+		{name: "retry max delay below base delay", modify: func(cfg *NodeWatcherConfig) { cfg.QueueRetry.MaxDelay = cfg.QueueRetry.BaseDelay / 2 }, valid: false},
+		{name: "auto workers without maximum", modify: func(cfg *NodeWatcherConfig) {
+			cfg.Workers = AutoWorkers
+			cfg.MaxWorkers = 0
+		}, valid: false},
+		{name: "invalid selector", modify: func(cfg *NodeWatcherConfig) { cfg.LabelSelector = "pool in (batch" }, valid: false},
+		{name: "zero cpu overcommit", modify: func(cfg *NodeWatcherConfig) { cfg.CPUOvercommitRatio = 0 }, valid: false},
+		{name: "negative memory overcommit", modify: func(cfg *NodeWatcherConfig) { cfg.MemOvercommitRatio = -1 }, valid: false},
+		{name: "MiB memory unit", modify: func(cfg *NodeWatcherConfig) { cfg.MemoryUnit = MemoryUnitMiB }, valid: true},
+		{name: "invalid memory unit", modify: func(cfg *NodeWatcherConfig) { cfg.MemoryUnit = "GB" }, valid: false},
+		{name: "negative grace period", modify: func(cfg *NodeWatcherConfig) { cfg.NotReadyGracePeriod = -time.Second }, valid: false},
+		{name: "zero watch error threshold", modify: func(cfg *NodeWatcherConfig) { cfg.WatchErrorThreshold = 0 }, valid: false},
+		{name: "watchdog disabled", modify: func(cfg *NodeWatcherConfig) { cfg.WatchStaleness = 0 }, valid: true},
+		{name: "negative watch staleness", modify: func(cfg *NodeWatcherConfig) { cfg.WatchStaleness = -time.Second }, valid: false},
+	}
+
+	for _, data := range testData {
+		cfg := DefaultNodeWatcherConfig()
+		data.modify(&cfg)
+		if err := cfg.Validate(); (err == nil) != data.valid {
+			t.Errorf("%s: expected valid %v, got err %v", data.name, data.valid, err)
+		}
+	}
+}
+
+// TestWithNodeWatcherConfig checks that the configuration given to NewNodeWatcher is used by the watcher.
+func TestWithNodeWatcherConfig(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	cfg := DefaultNodeWatcherConfig()
+	cfg.LabelSelector = "pool=batch"
+	cfg.CPUOvercommitRatio = 2.0
+	cfg.WatchErrorThreshold = 5
+	client := fake.NewSimpleClientset(
+		BuildNode("batch-node", "10", "10000000", map[string]string{"pool": "batch"}, nil, false),
+		BuildNode("web-node", "10", "10000000", map[string]string{"pool": "web"}, nil, false))
+
+	nodeWatch := NewNodeWatcher(client, testObj.fc, WithNodeWatcherConfig(cfg))
+	if nodeWatch.cfg != cfg {
+		t.Errorf("expected the node watcher configuration %v, got %v", cfg, nodeWatch.cfg)
+	}
+	if nodeWatch.watchErrors.threshold != 5 {
+		t.Errorf("expected a watch error threshold of 5, got %d", nodeWatch.watchErrors.threshold)
+	}
+	obj, err := newNodeListWatch(client, cfg.LabelSelector, nodeWatch.watchErrors).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal("error listing nodes ", err)
+	}
+	nodes := obj.(*v1.NodeList).Items
+	if len(nodes) != 1 || nodes[0].Name != "batch-node" {
+		t.Errorf("expected only batch-node to be listed, got %v", nodes)
+	}
+}
+
+// TestNewNodeWatcherConfig checks that the node watcher configuration is read from the poseidon options it is given.
+func TestNewNodeWatcherConfig(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.NodeSelector = "pool=batch"
+	cfg.NotReadyGrace = 30
+	cfg.MaxNodeEvents = 100
+	cfg.RestartPeriod = 250
+
+	nodeCfg := NewNodeWatcherConfig(&cfg)
+	if nodeCfg.LabelSelector != "pool=batch" || nodeCfg.NotReadyGracePeriod != 30*time.Second ||
+		nodeCfg.MaxInFlightNodeEvents != 100 || nodeCfg.WorkerRestartPeriod != 250 {
+		t.Errorf("expected the node watcher configuration of the options %+v, got %+v", cfg, nodeCfg)
+	}
+	if err := nodeCfg.Validate(); err != nil {
+		t.Errorf("expected the configuration to be valid, got %v", err)
+	}
+	if nodeCfg.Workers != cfg.Workers {
+		t.Errorf("expected the %d workers of --workers, got %d", cfg.Workers, nodeCfg.Workers)
+	}
+	cfg.NodeWorkers = 4
+	if workers := NewNodeWatcherConfig(&cfg).Workers; workers != 4 {
+		t.Errorf("expected 4 node workers, got %d", workers)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+)
+
+// Results of the scheduling attempts, the same as the ones of kube-scheduler.
+const (
+	attemptScheduled     = "scheduled"
+	attemptUnschedulable = "unschedulable"
+	attemptError         = "error"
+)
+
+// pendingPodsMux is used to guard access to the pending pods.
+var pendingPodsMux *sync.Mutex
+
+// pendingPod holds the creation time of a pod waiting to be bound by poseidon, and the time it was observed
+// unscheduled by the pod watcher.
+type pendingPod struct {
+	creationTime time.Time
+	observedTime time.Time
+}
+
+// pendingPods maps the pods waiting to be bound by poseidon to their creation and observation times.
+var pendingPods map[PodIdentifier]pendingPod
+
+// pendingPodsNow returns the time the pods are observed unscheduled and bound at, it is faked by the tests.
+var pendingPodsNow = time.Now
+
+// markPodPending records a pod waiting to be bound, it is a no-op for pods already pending.
+func markPodPending(podIdentifier PodIdentifier, creationTime time.Time) {
+	pendingPodsMux.Lock()
+	defer pendingPodsMux.Unlock()
+	if _, ok := pendingPods[podIdentifier]; ok {
+		return
+	}
+	pendingPods[podIdentifier] = pendingPod{creationTime: creationTime, observedTime: pendingPodsNow()}
+	metrics.PendingPods.Set(float64(len(pendingPods)))
+}
+
+// isPodPending checks if the pod waits to be bound by poseidon.
+func isPodPending(podIdentifier PodIdentifier) bool {
+	pendingPodsMux.Lock()
+	defer pendingPodsMux.Unlock()
+	_, ok := pendingPods[podIdentifier]
+	return ok
+}
+
+// hasPendingPods checks if pods wait to be bound by poseidon.
+func hasPendingPods() bool {
+	pendingPodsMux.Lock()
+	defer pendingPodsMux.Unlock()
+	return len(pendingPods) > 0
+}
+
+// forgetPendingPod removes a pod from the pending pods, it returns the creation and observation times of the pod
+// if it was pending.
+func forgetPendingPod(podIdentifier PodIdentifier) (pendingPod, bool) {
+	pendingPodsMux.Lock()
+	defer pendingPodsMux.Unlock()
+	pending, ok := pendingPods[podIdentifier]
+	if !ok {
+		return pending, false
+	}
+	delete(pendingPods, podIdentifier)
+	metrics.PendingPods.Set(float64(len(pendingPods)))
+	return pending, true
+}
+
+// recordPodBound records the scheduling attempt of a bound pod, its end-to-end scheduling latency from its
+// creation, and the scheduling latency of poseidon from its observation by the pod watcher.
+func recordPodBound(podIdentifier PodIdentifier) {
+	metrics.SchedulingAttempts.WithLabelValues(attemptScheduled).Inc()
+	if pending, ok := forgetPendingPod(podIdentifier); ok {
+		metrics.E2eSchedulingLatency.Observe(metrics.SinceInMicroseconds(pending.creationTime))
+		metrics.SchedulingLatency.Observe(pendingPodsNow().Sub(pending.observedTime).Seconds())
+	}
+}
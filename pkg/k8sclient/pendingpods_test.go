@@ -0,0 +1,110 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func readMetric(t *testing.T, metric prometheus.Metric) *dto.Metric {
+	m := &dto.Metric{}
+	if err := metric.Write(m); err != nil {
+		t.Fatalf("could not read metric, err: %v", err)
+	}
+	return m
+}
+
+// TestRecordPodBound checks that binding a pending pod records a scheduled attempt and the scheduling
+// latencies, and removes the pod from the pending pods.
+func TestRecordPodBound(t *testing.T) {
+	testObj := initializeBindObj(t)
+	defer testObj.mockCtrl.Finish()
+	pendingPodsMux = new(sync.Mutex)
+	pendingPods = make(map[PodIdentifier]pendingPod)
+
+	markPodPending(testObj.podIdentifier, time.Now().Add(-time.Second))
+	markPodPending(testObj.podIdentifier, time.Now())
+	if got := readMetric(t, metrics.PendingPods).GetGauge().GetValue(); got != 1 {
+		t.Fatalf("expected 1 pending pod, got %v", got)
+	}
+
+	scheduled := readMetric(t, metrics.SchedulingAttempts.WithLabelValues(attemptScheduled)).GetCounter().GetValue()
+	e2eLatencies := readMetric(t, metrics.E2eSchedulingLatency).GetHistogram().GetSampleCount()
+	bindLatencies := readMetric(t, metrics.BindingLatency).GetHistogram().GetSampleCount()
+	testObj.bind("node1")
+
+	if got := readMetric(t, metrics.PendingPods).GetGauge().GetValue(); got != 0 {
+		t.Errorf("expected no pending pod once the pod is bound, got %v", got)
+	}
+	if got := readMetric(t, metrics.SchedulingAttempts.WithLabelValues(attemptScheduled)).GetCounter().GetValue(); got != scheduled+1 {
+		t.Errorf("expected %v scheduled attempts, got %v", scheduled+1, got)
+	}
+	e2eLatency := readMetric(t, metrics.E2eSchedulingLatency).GetHistogram()
+	if e2eLatency.GetSampleCount() != e2eLatencies+1 || e2eLatency.GetSampleSum() < float64(time.Second/time.Microsecond) {
+		t.Errorf("expected the e2e scheduling latency of the pod created a second ago to be observed, got %v", e2eLatency)
+	}
+	if got := readMetric(t, metrics.BindingLatency).GetHistogram().GetSampleCount(); got != bindLatencies+1 {
+		t.Errorf("expected %d binding latencies, got %d", bindLatencies+1, got)
+	}
+}
+
+// TestSchedulingLatency drives a pod from its observation by the pod watcher to its binding with a fake clock,
+// and checks the scheduling latency observed.
+func TestSchedulingLatency(t *testing.T) {
+	podObj := initializePodObj(t)
+	defer podObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(podObj.kubeVerMajor, podObj.kubeVerMinor, []string{podObj.schedulerName}, podObj.kubeClient, podObj.fc)
+	testObj := initializeBindObj(t)
+	defer testObj.mockCtrl.Finish()
+	pendingPodsMux = new(sync.Mutex)
+	pendingPods = make(map[PodIdentifier]pendingPod)
+	now := time.Now()
+	pendingPodsNow = func() time.Time { return now }
+	defer func() { pendingPodsNow = time.Now }()
+
+	PodToK8sPodLock.Lock()
+	pod := PodToK8sPod[testObj.podIdentifier]
+	PodToK8sPodLock.Unlock()
+	podWatch.enqueuePodAddition(testObj.podIdentifier.UniqueName(), pod)
+	if !isPodPending(testObj.podIdentifier) {
+		t.Fatal("expected the pod observed by the pod watcher to be pending")
+	}
+
+	latency := readMetric(t, metrics.SchedulingLatency).GetHistogram()
+	now = now.Add(1500 * time.Millisecond)
+	testObj.bind("node1")
+
+	got := readMetric(t, metrics.SchedulingLatency).GetHistogram()
+	if got.GetSampleCount() != latency.GetSampleCount()+1 || got.GetSampleSum()-latency.GetSampleSum() != 1.5 {
+		t.Errorf("expected a scheduling latency of 1.5s to be observed, got %v", got)
+	}
+	var bucket *dto.Bucket
+	for _, b := range got.GetBucket() {
+		if b.GetUpperBound() == 2.048 {
+			bucket = b
+		}
+	}
+	if bucket == nil || bucket.GetCumulativeCount() != got.GetSampleCount() {
+		t.Errorf("expected the latency to fall in the 2.048s bucket, got %v", got.GetBucket())
+	}
+}
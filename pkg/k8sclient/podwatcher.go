@@ -17,16 +17,20 @@ limitations under the License.
 package k8sclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kubernetes-sigs/poseidon/pkg/config"
 	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/logging"
 	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
 
 	"github.com/golang/glog"
@@ -35,10 +39,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 )
@@ -53,6 +54,22 @@ const (
 	GangSchedulingAnnotation = "firmament-gang-scheduling"
 )
 
+// SchedulerNameLabel is the task label carrying the scheduler name requested by the pod.
+const SchedulerNameLabel = "schedulerName"
+
+// PodDroppedReason is the reason of the events recorded on the pods whose changes are dropped once they exhausted
+// the retries of the work queue.
+const PodDroppedReason = "PodChangesDropped"
+
+// The kinds of the pod state inconsistencies recovered by the pod workers.
+const (
+	recoveryUnknownDelete        = "unknown_delete"
+	recoveryUnknownUpdatePending = "unknown_update_pending"
+	recoveryUnknownUpdateRunning = "unknown_update_running"
+	recoveryTaskNotFound         = "task_not_found"
+	recoveryTaskAlreadySubmitted = "task_already_submitted"
+)
+
 // SortNodeSelectorsKey sort node selectors keys and return an slice of sorted keys.
 func SortNodeSelectorsKey(nodeSelector NodeSelectors) []string {
 	var keyArray []string
@@ -68,93 +85,125 @@ func SortNodeSelectorsKey(nodeSelector NodeSelectors) []string {
 	return keyArray
 }
 
-// NewPodWatcher initialize a PodWatcher.
-func NewPodWatcher(kubeVerMajor, kubeVerMinor int, schedulerName string, client kubernetes.Interface, fc firmament.FirmamentSchedulerClient) *PodWatcher {
+// NewPodWatcher initialize a PodWatcher, configured by DefaultPodWatcherConfig unless replaced by the options.
+func NewPodWatcher(kubeVerMajor, kubeVerMinor int, schedulerNames []string, client kubernetes.Interface, fc firmament.Client, opts ...PodWatcherOption) *PodWatcher {
 	glog.V(2).Info("Starting PodWatcher...")
 	PodMux = new(sync.RWMutex)
 	PodToTD = make(map[PodIdentifier]*firmament.TaskDescriptor)
 	TaskIDToPod = make(map[uint64]PodIdentifier)
+	taskSubmitTime = make(map[uint64]time.Time)
 	jobIDToJD = make(map[string]*firmament.JobDescriptor)
 	jobNumTasksToRemove = make(map[string]int)
 	podWatcher := &PodWatcher{
 		clientset: client,
 		fc:        fc,
+		cfg:       DefaultPodWatcherConfig(),
+	}
+	for _, opt := range opts {
+		opt(podWatcher)
 	}
+	if err := podWatcher.cfg.Validate(); err != nil {
+		glog.Fatalf("Invalid pod watcher configuration: %v", err)
+	}
+	podWatcher.failureLog = newFailureLog(podWatcher.cfg.FailureLogInterval)
+	// The default requests are validated with the configuration.
+	podWatcher.defaultRequests, _ = parseDefaultRequests(podWatcher.cfg.DefaultCPURequest, podWatcher.cfg.DefaultMemRequest)
+	podWatcher.qosPriorities = podWatcher.cfg.QoSPriorities
+	podWatcher.namespaces = newNamespaceFilter(podWatcher.cfg.NamespaceAllowlist, podWatcher.cfg.NamespaceDenylist)
+	podWatcher.memoryUnit = podWatcher.cfg.MemoryUnit
 	schedulerSelector := fields.Everything()
 	podSelector := labels.Everything()
 
-	if config.GetDefaultBehaviour() == false {
+	podWatcher.schedulerNames = make(map[string]bool)
+	for _, schedulerName := range schedulerNames {
+		podWatcher.schedulerNames[schedulerName] = true
+	}
+
+	if podWatcher.cfg.DefaultBehaviour == false {
 		if kubeVerMajor >= 1 && kubeVerMinor >= 6 {
 			// schedulerName is only available in Kubernetes >= 1.6.
-			schedulerSelector = fields.ParseSelectorOrDie("spec.schedulerName==" + schedulerName)
+			// Field selectors can not match a set of values, pods are filtered by the watcher with several scheduler names.
+			if len(schedulerNames) == 1 {
+				schedulerSelector = fields.OneTermEqualSelector("spec.schedulerName", schedulerNames[0])
+			} else {
+				podWatcher.filterSchedulerNames = true
+			}
 		} else {
 			var err error
-			podSelector, err = labels.Parse("scheduler in (" + schedulerName + ")")
+			podSelector, err = labels.Parse("scheduler in (" + strings.Join(schedulerNames, ",") + ")")
 			if err != nil {
 				glog.Fatal("Failed to parse scheduler label selector")
 			}
 		}
 	}
-	_, controller := cache.NewInformer(
-		&cache.ListWatch{
-			ListFunc: func(alo metav1.ListOptions) (runtime.Object, error) {
-				alo.FieldSelector = schedulerSelector.String()
-				alo.LabelSelector = podSelector.String()
-				return client.CoreV1().Pods("").List(alo)
-			},
-			WatchFunc: func(alo metav1.ListOptions) (watch.Interface, error) {
-				alo.FieldSelector = schedulerSelector.String()
-				alo.LabelSelector = podSelector.String()
-				return client.CoreV1().Pods("").Watch(alo)
-			},
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err != nil {
+				glog.Errorf("AddFunc: error getting key %v", err)
+			}
+			podWatcher.enqueuePodAddition(key, obj)
 		},
-		&v1.Pod{},
-		0,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				key, err := cache.MetaNamespaceKeyFunc(obj)
-				if err != nil {
-					glog.Errorf("AddFunc: error getting key %v", err)
-				}
-				podWatcher.enqueuePodAddition(key, obj)
-			},
-			UpdateFunc: func(old, new interface{}) {
-				key, err := cache.MetaNamespaceKeyFunc(new)
-				if err != nil {
-					glog.Errorf("UpdateFunc: error getting key %v", err)
-				}
-				podWatcher.enqueuePodUpdate(key, old, new)
-			},
-			DeleteFunc: func(obj interface{}) {
-				key, err := cache.MetaNamespaceKeyFunc(obj)
-				if err != nil {
-					glog.Errorf("DeleteFunc: error getting key %v", err)
-				}
-				podWatcher.enqueuePodDeletion(key, obj)
-			},
+		UpdateFunc: func(old, new interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(new)
+			if err != nil {
+				glog.Errorf("UpdateFunc: error getting key %v", err)
+			}
+			podWatcher.enqueuePodUpdate(key, old, new)
 		},
-	)
-	podWatcher.controller = controller
-	podWatcher.podWorkQueue = NewKeyedQueue()
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err != nil {
+				glog.Errorf("DeleteFunc: error getting key %v", err)
+			}
+			podWatcher.enqueuePodDeletion(key, obj)
+		},
+	}
+	// With an allowlist, the pods of every allowed namespace are watched on their own instead of
+	// watching the pods of the whole cluster.
+	for _, namespace := range podWatcher.namespaces.watchedNamespaces() {
+		controller := newWatchdogInformer("pods", newPodListWatch(client, namespace, schedulerSelector, podSelector), &v1.Pod{}, 0, podWatcher.cfg.WatchStaleness, handler)
+		podWatcher.controllers = append(podWatcher.controllers, controller)
+	}
+	podWatcher.controllers = append(podWatcher.controllers, podWatcher.newNamespaceInformer())
+	podWatcher.controllers = append(podWatcher.controllers, podWatcher.newVolumeInformers()...)
+	queueOpts := []QueueOption{WithQueueRetryPolicy(podWatcher.cfg.QueueRetry), WithDeadLetter(podWatcher.dropPods)}
+	podWatcher.podWorkQueue = NewKeyedQueue(queueOpts...)
+	if podWatcher.cfg.NamespaceQueues {
+		podWatcher.namespaceQueues = newNamespaceQueues(queueOpts...)
+	}
 	return podWatcher
 }
 
 func (pw *PodWatcher) getCPUMemEphemeralRequest(pod *v1.Pod) (int64, int64, int64) {
-	cpuReq := int64(0)
-	memReq := int64(0)
-	ephemeralReq := int64(0)
-	for _, container := range pod.Spec.Containers {
-		request := container.Resources.Requests
-		cpuReqQuantity := request[v1.ResourceCPU]
-		cpuReq += cpuReqQuantity.MilliValue()
-		memReqQuantity := request[v1.ResourceMemory]
-		memReqCont := memReqQuantity.MilliValue()
-		memReq += memReqCont
-		ephemeralReqQuantity := request[v1.ResourceEphemeralStorage]
-		ephemeralReqCont := ephemeralReqQuantity.MilliValue()
-		ephemeralReq += ephemeralReqCont
-	}
-	return cpuReq, memReq, ephemeralReq
+	request := getPodResourceRequest(pod)
+	cpuReqQuantity := request[v1.ResourceCPU]
+	memReqQuantity := request[v1.ResourceMemory]
+	ephemeralReqQuantity := request[v1.ResourceEphemeralStorage]
+	return cpuReqQuantity.MilliValue(), pw.memoryUnit.memoryValue(memReqQuantity), ephemeralReqQuantity.MilliValue()
+}
+
+func (pw *PodWatcher) getCPUMemEphemeralLimit(pod *v1.Pod) (int64, int64, int64) {
+	limit := getPodResourceLimit(pod)
+	cpuLimitQuantity := limit[v1.ResourceCPU]
+	memLimitQuantity := limit[v1.ResourceMemory]
+	ephemeralLimitQuantity := limit[v1.ResourceEphemeralStorage]
+	return cpuLimitQuantity.MilliValue(), pw.memoryUnit.memoryValue(memLimitQuantity), ephemeralLimitQuantity.MilliValue()
+}
+
+// podResourceSummary holds the pod requests and limits forwarded to firmament.
+type podResourceSummary struct {
+	cpuRequest, memRequest, ephemeralRequest int64
+	cpuLimit, memLimit, ephemeralLimit       int64
+}
+
+// getPodResourceSummary derives the requests and limits of the pod, so that updates which do not
+// change them, e.g. resourceVersion or status only updates, are not forwarded to firmament.
+func (pw *PodWatcher) getPodResourceSummary(pod *v1.Pod) podResourceSummary {
+	var summary podResourceSummary
+	summary.cpuRequest, summary.memRequest, summary.ephemeralRequest = pw.getCPUMemEphemeralRequest(pod)
+	summary.cpuLimit, summary.memLimit, summary.ephemeralLimit = pw.getCPUMemEphemeralLimit(pod)
+	return summary
 }
 
 func (pw *PodWatcher) getNodeSelectorTerm(pod *v1.Pod) []NodeSelectorTerm {
@@ -247,9 +296,30 @@ func (pw *PodWatcher) getTolerations(pod *v1.Pod) []Toleration {
 	return tolerations
 }
 
+// getPodPriority returns the priority of the pod. The priority is resolved from the pod's PriorityClass
+// when the priority admission controller did not set it, and is zero if the pod has no priority.
+func (pw *PodWatcher) getPodPriority(pod *v1.Pod) int32 {
+	if pod.Spec.Priority != nil {
+		return *pod.Spec.Priority
+	}
+	if pod.Spec.PriorityClassName == "" {
+		return 0
+	}
+	priorityClass, err := pw.clientset.SchedulingV1beta1().PriorityClasses().Get(pod.Spec.PriorityClassName, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("Unable to resolve PriorityClass %s for pod %s/%s, err: %v", pod.Spec.PriorityClassName, pod.Namespace, pod.Name, err)
+		return 0
+	}
+	return priorityClass.Value
+}
+
 func (pw *PodWatcher) parsePod(pod *v1.Pod) *Pod {
-	cpuReq, memReq, ephemeralReq := pw.getCPUMemEphemeralRequest(pod)
+	requestPod, defaultRequest := applyDefaultRequests(pod, pw.defaultRequests)
+	cpuReq, memReq, ephemeralReq := pw.getCPUMemEphemeralRequest(requestPod)
+	cpuLimit, memLimit, ephemeralLimit := pw.getCPUMemEphemeralLimit(pod)
 	kind, uid := GetOwnersKindandUid(pod)
+	gangKey, gangSize := getGang(pod)
+	qosClass := getPodQOSClass(pod)
 	podPhase := PodUnknown
 	switch pod.Status.Phase {
 	case v1.PodPending:
@@ -270,10 +340,16 @@ func (pw *PodWatcher) parsePod(pod *v1.Pod) *Pod {
 		CPURequest:     cpuReq,
 		MemRequestKb:   memReq,
 		EphemeralReqKb: ephemeralReq,
+		CPULimit:       cpuLimit,
+		MemLimitKb:     memLimit,
+		EphemeralLimKb: ephemeralLimit,
+		QOSClass:       qosClass,
+		DefaultRequest: defaultRequest,
+		SchedulerName:  pod.Spec.SchedulerName,
 		Labels:         pod.Labels,
 		Annotations:    pod.Annotations,
 		NodeSelector:   pod.Spec.NodeSelector,
-		OwnerRef:       GetOwnerReference(pod),
+		OwnerRef:       getJobOwnerReference(pod),
 		Affinity: &Affinity{
 			NodeAffinity: &NodeAffinity{
 				HardScheduling: &NodeSelector{
@@ -294,33 +370,82 @@ func (pw *PodWatcher) parsePod(pod *v1.Pod) *Pod {
 		Tolerations:     pw.getTolerations(pod),
 		OwnerKind:       kind,
 		OwnerUid:        uid,
+		Priority:        pw.getPodPriority(pod),
+		QoSPriority:     pw.qosPriorities[qosClass],
+		ExitInfo:        getContainerExitInfo(pod),
+		Gang:            gangKey,
+		GangSize:        gangSize,
+		NodeName:        pod.Spec.NodeName,
+		HostPorts:       getHostPorts(pod),
 	}
 }
 
+// getContainerExitInfo describes how the terminated containers of the pod exited, e.g. "app: exit code 1 (Error)".
+func getContainerExitInfo(pod *v1.Pod) string {
+	var exitInfo []string
+	for _, status := range pod.Status.ContainerStatuses {
+		terminated := status.State.Terminated
+		if terminated == nil {
+			continue
+		}
+		info := fmt.Sprintf("%s: exit code %d", status.Name, terminated.ExitCode)
+		if len(terminated.Reason) > 0 {
+			info = fmt.Sprintf("%s (%s)", info, terminated.Reason)
+		}
+		exitInfo = append(exitInfo, info)
+	}
+	return strings.Join(exitInfo, ", ")
+}
+
+// isPoseidonPod checks if the pod requests one of the scheduler names serviced by the watcher and
+// belongs to a handled namespace. Pods are only filtered by scheduler name here when the informer
+// can not select them by scheduler name.
+func (pw *PodWatcher) isPoseidonPod(pod *v1.Pod) bool {
+	if !pw.namespaces.handles(pod.Namespace) {
+		return false
+	}
+	if !pw.filterSchedulerNames {
+		return true
+	}
+	return pw.schedulerNames[pod.Spec.SchedulerName]
+}
+
 func (pw *PodWatcher) enqueuePodAddition(key interface{}, obj interface{}) {
 	pod := obj.(*v1.Pod)
-	if config.GetDefaultBehaviour() == true {
+	if pw.cfg.DefaultBehaviour == true {
 		//check if its a kube-system pod or SchedulerName is not set ignore the pod
 		if pod.Spec.SchedulerName == "" {
 			return
 		}
 	}
+	if !pw.isPoseidonPod(pod) {
+		return
+	}
 
 	addedPod := pw.parsePod(pod)
+	if isPreassignedPod(pod) {
+		// DaemonSet, static and mirror pods are not scheduled, only their requests are accounted.
+		if addedPod.State == PodPending || addedPod.State == PodRunning {
+			addedPod.State = PodPreassigned
+			pw.podQueue(addedPod.Identifier.Namespace).Add(key, addedPod)
+			logging.V(2).Info("enqueuePodAddition: added preassigned pod", "pod", addedPod.Identifier.UniqueName(), "state", addedPod.State, "node", addedPod.NodeName)
+		}
+		return
+	}
+	if addedPod.State == PodPending && len(pod.Spec.NodeName) == 0 {
+		markPodPending(addedPod.Identifier, pod.CreationTimestamp.Time)
+	}
 	// if the pod had volumes
 	// check for the bounded volumes
 	if len(pod.Spec.Volumes) > 0 {
 		newPod := pod.DeepCopy()
 		newPod, ok := pw.getPVNodeAffinity(pod.Spec.Volumes, newPod)
-		if ok {
-			addedPod = pw.parsePod(newPod)
-		} else {
-			// Note: after we ignore this pod, the same pod we could get updated
-			// this case has to be handled
-			// also we need to broadcast the pod failure event here.
-			glog.Error("Falied to find the matching volumes for the pod", addedPod)
+		if !ok {
+			// The pod is submitted once its claims are bound.
+			logging.V(2).Info("enqueuePodAddition: volumes of pod are not available yet", "pod", addedPod.Identifier.UniqueName())
 			return
 		}
+		addedPod = pw.parsePod(newPod)
 	}
 	// update the pod
 	// Note the sequence is importatnt
@@ -331,56 +456,93 @@ func (pw *PodWatcher) enqueuePodAddition(key interface{}, obj interface{}) {
 	}
 	PodToK8sPod[identifier] = pod.DeepCopy()
 	PodToK8sPodLock.Unlock()
-	pw.podWorkQueue.Add(key, addedPod)
-	glog.V(2).Info("enqueuePodAddition: Added pod ", addedPod.Identifier)
+	pw.podQueue(addedPod.Identifier.Namespace).Add(key, addedPod)
+	logging.V(2).Info("enqueuePodAddition: added pod", "pod", addedPod.Identifier.UniqueName(), "state", addedPod.State)
 }
 
 func (pw *PodWatcher) enqueuePodDeletion(key interface{}, obj interface{}) {
-	pod := obj.(*v1.Pod)
-	if config.GetDefaultBehaviour() == true {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		// The deletion was missed by the watch, the last known state of the pod is in the tombstone.
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			logging.Error("enqueuePodDeletion: unexpected object", "object", fmt.Sprintf("%T", obj))
+			return
+		}
+		if pod, ok = tombstone.Obj.(*v1.Pod); !ok {
+			logging.Error("enqueuePodDeletion: tombstone contains an unexpected object", "key", tombstone.Key, "object", fmt.Sprintf("%T", tombstone.Obj))
+			return
+		}
+	}
+	if pw.cfg.DefaultBehaviour == true {
 		//check if its a kube-system pod or SchedulerName is not set ignore the pod
 		if pod.Spec.SchedulerName == "" {
 			return
 		}
 	}
+	if !pw.isPoseidonPod(pod) {
+		return
+	}
+	// Pods which are not bound yet are deleted without a DeletionTimestamp, the task of
+	// the pod is removed in any case.
+	pw.enqueueDeletedPod(key, pod)
+}
 
-	if pod.DeletionTimestamp != nil {
-		// Only delete pods if they have a DeletionTimestamp.
-		deletedPod := &Pod{
-			Identifier: PodIdentifier{
-				Name:      pod.Name,
-				Namespace: pod.Namespace,
-			},
-			State:    PodDeleted,
-			OwnerRef: GetOwnerReference(pod),
-		}
-		ProcessedPodEventsLock.Lock()
-		if _, ok := ProcessedPodEvents[deletedPod.Identifier]; ok {
-			delete(ProcessedPodEvents, deletedPod.Identifier)
-		}
-		ProcessedPodEventsLock.Unlock()
-		PodToK8sPodLock.Lock()
-		if _, ok := PodToK8sPod[deletedPod.Identifier]; ok {
-			// the only place where the pod is deleted from the map
-			delete(PodToK8sPod, deletedPod.Identifier)
-		}
-		PodToK8sPodLock.Unlock()
-		pw.podWorkQueue.Add(key, deletedPod)
-
-		glog.V(2).Info("enqueuePodDeletion: Added pod ", deletedPod.Identifier)
+func (pw *PodWatcher) enqueueDeletedPod(key interface{}, pod *v1.Pod) {
+	deletedPod := &Pod{
+		Identifier: PodIdentifier{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+		State:    PodDeleted,
+		OwnerRef: getJobOwnerReference(pod),
 	}
+	ProcessedPodEventsLock.Lock()
+	if _, ok := ProcessedPodEvents[deletedPod.Identifier]; ok {
+		delete(ProcessedPodEvents, deletedPod.Identifier)
+	}
+	ProcessedPodEventsLock.Unlock()
+	forgetPodEvents(deletedPod.Identifier)
+	forgetPodVolumes(deletedPod.Identifier)
+	forgetPendingPod(deletedPod.Identifier)
+	PodToK8sPodLock.Lock()
+	if _, ok := PodToK8sPod[deletedPod.Identifier]; ok {
+		// the only place where the pod is deleted from the map
+		delete(PodToK8sPod, deletedPod.Identifier)
+	}
+	PodToK8sPodLock.Unlock()
+	pw.podQueue(deletedPod.Identifier.Namespace).Add(key, deletedPod)
+
+	logging.V(2).Info("enqueuePodDeletion: deleted pod", "pod", deletedPod.Identifier.UniqueName(), "state", deletedPod.State)
 }
 
 func (pw *PodWatcher) enqueuePodUpdate(key, oldObj, newObj interface{}) {
 	oldPod := oldObj.(*v1.Pod)
 	newPod := newObj.(*v1.Pod)
 
-	if config.GetDefaultBehaviour() == true {
+	if pw.cfg.DefaultBehaviour == true {
 		//check if its a kube-system pod or SchedulerName is not set ignore the pod
 		if oldPod.Namespace == "kube-system" || oldPod.Spec.SchedulerName == "" {
 			return
 		}
 	}
+	oldIsPoseidonPod, newIsPoseidonPod := pw.isPoseidonPod(oldPod), pw.isPoseidonPod(newPod)
+	if !oldIsPoseidonPod && !newIsPoseidonPod {
+		return
+	}
+	if newIsPoseidonPod && updateWaitingPod(newPod) {
+		// The pod is not submitted until its claims are bound.
+		return
+	}
+	if oldIsPoseidonPod != newIsPoseidonPod {
+		// The scheduler name of the pod changed, the pod is added to or removed from poseidon.
+		if newIsPoseidonPod {
+			pw.enqueuePodAddition(key, newPod)
+		} else {
+			pw.enqueueDeletedPod(key, newPod)
+		}
+		return
+	}
 
 	if oldPod.Status.Phase != newPod.Status.Phase {
 		// TODO(ionel): pw code assumes that if other fields changed as well then Firmament will automatically update them upon state transition. pw is currently not true.
@@ -393,190 +555,488 @@ func (pw *PodWatcher) enqueuePodUpdate(key, oldObj, newObj interface{}) {
 		}
 		PodToK8sPod[identifier] = newPod.DeepCopy()
 		PodToK8sPodLock.Unlock()
-		pw.podWorkQueue.Add(key, updatedPod)
-		glog.V(2).Infof("enqueuePodUpdate: Updated pod state change %v %s", updatedPod.Identifier, updatedPod.State)
+		if updatedPod.State != PodPending {
+			forgetPendingPod(updatedPod.Identifier)
+		}
+		pw.podQueue(updatedPod.Identifier.Namespace).Add(key, updatedPod)
+		logging.V(2).Info("enqueuePodUpdate: pod state changed", "pod", updatedPod.Identifier.UniqueName(), "state", updatedPod.State)
 		return
 	}
-	oldCPUReq, oldMemReq, oldEphemeralReq := pw.getCPUMemEphemeralRequest(oldPod)
-	newCPUReq, newMemReq, newEphemeralReq := pw.getCPUMemEphemeralRequest(newPod)
-	if oldCPUReq != newCPUReq || oldMemReq != newMemReq || oldEphemeralReq != newEphemeralReq ||
+	// Requests may change after the pod submission because of mutating webhooks or in-place
+	// vertical scaling. Pending pods are scheduled with the updated requests while firmament
+	// only updates the accounting of running pods.
+	if pw.getPodResourceSummary(oldPod) != pw.getPodResourceSummary(newPod) ||
 		!reflect.DeepEqual(oldPod.Labels, newPod.Labels) ||
 		!reflect.DeepEqual(oldPod.Annotations, newPod.Annotations) ||
 		!reflect.DeepEqual(oldPod.Spec.NodeSelector, newPod.Spec.NodeSelector) {
 		if updatedPod := pw.parsePod(newPod); updatedPod != nil {
 			// we need to change the state here
 			updatedPod.State = PodUpdated
-			pw.podWorkQueue.Add(key, updatedPod)
-			glog.V(2).Infof("enqueuePodUpdate: Updated pod %v", updatedPod.Identifier)
+			pw.podQueue(updatedPod.Identifier.Namespace).Add(key, updatedPod)
+			logging.V(2).Info("enqueuePodUpdate: updated pod", "pod", updatedPod.Identifier.UniqueName(), "state", updatedPod.State)
 		}
 		return
 	}
 }
 
-// Run starts a pod watcher.
-func (pw *PodWatcher) Run(stopCh <-chan struct{}, nWorkers int) {
+// Run starts a pod watcher. Once ctx is cancelled, it returns nil after the workers processed the queued pods and
+// the batched tasks are submitted.
+// An error is returned if the number of workers is invalid, see getWorkerCount, or if the caches did not sync
+// within the cache sync timeout.
+func (pw *PodWatcher) Run(ctx context.Context, nWorkers int) error {
+	workers, err := getWorkerCount(nWorkers, pw.cfg.MaxWorkers)
+	if err != nil {
+		return err
+	}
+	restart, err := getWorkerRestart(pw.cfg.WorkerRestartPeriod, pw.cfg.WorkerRestartJitter)
+	if err != nil {
+		return err
+	}
 	defer utilruntime.HandleCrash()
+	stopCh := ctx.Done()
 
 	// The workers can stop when we are done.
 	defer pw.podWorkQueue.ShutDown()
+	if pw.namespaceQueues != nil {
+		defer pw.namespaceQueues.shutDown()
+	}
 	defer glog.V(2).Info("Shutting down PodWatcher")
 	glog.V(2).Info("Getting pod updates...")
 
-	go pw.controller.Run(stopCh)
-
-	if !cache.WaitForCacheSync(stopCh, pw.controller.HasSynced) {
-		utilruntime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
-		return
+	var synced []cache.InformerSynced
+	for _, controller := range pw.controllers {
+		go controller.Run(stopCh)
+		synced = append(synced, controller.HasSynced)
 	}
 
-	glog.V(2).Info("Starting pod watching workers")
-	for i := 0; i < nWorkers; i++ {
-		go wait.Until(pw.podWorker, time.Second, stopCh)
+	if ok, err := waitForCacheSync(ctx, "pod", synced...); !ok {
+		return err
+	}
+	atomic.StoreInt32(&podCachesSynced, 1)
+
+	// The batcher runs until the workers drained the queues, they still add tasks meanwhile.
+	batcherStopCh := make(chan struct{})
+	defer close(batcherStopCh)
+	if pw.cfg.BatchWindow > 0 {
+		pw.batcher = newTaskBatcher(pw.fc, pw.cfg.BatchWindow, pw.cfg.MaxBatchSize,
+			func() bool { return pw.queuedPods() == 0 }, TriggerSchedule)
+		go pw.batcher.run(batcherStopCh)
+	}
+	var running sync.WaitGroup
+	if pw.namespaceQueues != nil {
+		glog.V(2).Infof("Starting %d pod watching workers per namespace", workers)
+		pw.namespaceQueues.run(func(queue Queue) {
+			startWorkers(func() { pw.processPodQueue(queue) }, workers, restart, stopCh, &running)
+		})
+	} else {
+		glog.V(2).Infof("Starting %d pod watching workers", workers)
+		startWorkers(pw.podWorker, workers, restart, stopCh, &running)
 	}
 
 	<-stopCh
-	glog.V(2).Info("Stopping pod watcher")
+	glog.V(2).Infof("Stopping pod watcher, draining %d queued pods", pw.queuedPods())
+	pw.podWorkQueue.ShutDown()
+	if pw.namespaceQueues != nil {
+		pw.namespaceQueues.shutDown()
+	}
+	running.Wait()
+	if pw.batcher != nil {
+		pw.batcher.drain()
+	}
+	return nil
 }
 
 func (pw *PodWatcher) podWorker() {
+	pw.processPodQueue(pw.podWorkQueue)
+}
+
+// processPodQueue processes the pods of the queue until it is shut down.
+// The requests to firmament which time out are requeued with the next items of their key once the backoff
+// of the key expires, so that the pods of a key are still processed in order.
+func (pw *PodWatcher) processPodQueue(queue Queue) {
 	func() {
 		wg := new(sync.WaitGroup)
 		defer func() {
 			wg.Wait()
 		}()
 		for {
-			key, items, quit := pw.podWorkQueue.Get()
+			key, items, quit := queue.Get()
 			if quit {
 				return
 			}
 			wg.Add(1)
 			go func(key interface{}, items []interface{}, wg *sync.WaitGroup) {
+				done := heartbeats.start(LoopPods)
 				defer func() {
-					pw.podWorkQueue.Done(key)
+					done()
+					queue.Done(key)
+					if pw.batcher != nil {
+						// The batch is submitted once the work queue is idle.
+						pw.batcher.wakeUp()
+					} else {
+						triggerScheduleOnDrain(pw.queuedPods())
+					}
 					wg.Done()
 				}()
-				for _, item := range items {
-					pod := item.(*Pod)
-					switch pod.State {
-					case PodPending:
-						glog.V(2).Info("PodPending ", pod.Identifier)
-						PodMux.Lock()
-
-						// check if the pod already exists
-						// this cases happened when Replicaset are used.
-						// When a replicaset is delete it creates more pods with the same name
-						_, ok := PodToTD[pod.Identifier]
-						if ok {
-							// we ignore this since the pod already exists
-							// release the lock
-							glog.V(2).Info("Pod already added", pod.Identifier.Name, pod.Identifier.Namespace)
-							PodMux.Unlock()
-							continue
-						}
-						jobID := pw.generateJobID(pod.OwnerRef)
-						jd, ok := jobIDToJD[jobID]
-						if !ok {
-							jd = pw.createNewJob(pod.OwnerRef)
-							// get requirement for gang scheduling if enabled
-							jd = pw.updateGangSchedulingrequireent(pod, jd)
-							jobIDToJD[jobID] = jd
-							jobNumTasksToRemove[jobID] = 0
-						}
-						jobNumTasksToRemove[jobID]++
-						taskCount := jobNumTasksToRemove[jobID]
-						PodMux.Unlock()
-						td := pw.addTaskToJob(pod, jd.Uuid, jd.Name, (taskCount))
-						PodMux.Lock()
-						// if taskCount is '1' it means root task, update the RootTask pointer in the JobDescriptor
-						if taskCount == 1 {
-							jd.RootTask = td
-						}
-						PodToTD[pod.Identifier] = td
-						TaskIDToPod[td.GetUid()] = pod.Identifier
-						taskDescription := &firmament.TaskDescription{
-							TaskDescriptor: td,
-							JobDescriptor:  jd,
-						}
-						PodMux.Unlock()
-						metrics.SchedulingSubmitmLatency.Observe(metrics.SinceInMicroseconds(time.Time(pod.CreateTimeStamp.Time)))
-						firmament.TaskSubmitted(pw.fc, taskDescription)
-					case PodSucceeded:
-						glog.V(2).Info("PodSucceeded ", pod.Identifier)
-						PodMux.RLock()
-						td, ok := PodToTD[pod.Identifier]
-						PodMux.RUnlock()
-						if !ok {
-							glog.Fatalf("Pod %v does not exist", pod.Identifier)
-						}
-						firmament.TaskCompleted(pw.fc, &firmament.TaskUID{TaskUid: td.Uid})
-					case PodDeleted:
-						glog.V(2).Info("PodDeleted ", pod.Identifier)
-						PodMux.RLock()
-						td, ok := PodToTD[pod.Identifier]
-						PodMux.RUnlock()
-						if !ok {
-							glog.Infof("Pod %s does not exist", pod.Identifier)
-							continue
-						}
-						// TODO(jiaxuanzhou) need to metric the task remove latency ?
-						firmament.TaskRemoved(pw.fc, &firmament.TaskUID{TaskUid: td.Uid})
-						PodMux.Lock()
-						delete(PodToTD, pod.Identifier)
-						delete(TaskIDToPod, td.GetUid())
-						// TODO(ionel): Should we delete the task from JD's spawned field?
-						jobID := pw.generateJobID(pod.OwnerRef)
-						jobNumTasksToRemove[jobID]--
-						if jobNumTasksToRemove[jobID] == 0 {
-							// Clean state because the job doesn't have any tasks left.
-							delete(jobNumTasksToRemove, jobID)
-							delete(jobIDToJD, jobID)
-						}
-						PodMux.Unlock()
-					case PodFailed:
-						glog.V(2).Info("PodFailed ", pod.Identifier)
-						PodMux.RLock()
-						td, ok := PodToTD[pod.Identifier]
-						PodMux.RUnlock()
-						if !ok {
-							glog.Fatalf("Pod %s does not exist", pod.Identifier)
-						}
-						firmament.TaskFailed(pw.fc, &firmament.TaskUID{TaskUid: td.Uid})
-					case PodRunning:
-						glog.V(2).Info("PodRunning ", pod.Identifier)
-						// We don't have to do anything.
-					case PodUnknown:
-						glog.Errorf("Pod %s in unknown state", pod.Identifier)
-						// TODO(ionel): Handle Unknown case.
-					case PodUpdated:
-						glog.V(2).Info("PodUpdated ", pod.Identifier)
-						PodMux.Lock()
-						jobId := pw.generateJobID(pod.OwnerRef)
-						jd, okJob := jobIDToJD[jobId]
-						td, okPod := PodToTD[pod.Identifier]
-						PodMux.Unlock()
-						if !okJob {
-							glog.Infof("Pod's %v job does not exist", pod.Identifier)
-							continue
-						}
-						if !okPod {
-							glog.Infof("Pod %v does not exist", pod.Identifier)
-							continue
-						}
-						pw.updateTask(pod, td)
-						taskDescription := &firmament.TaskDescription{
-							TaskDescriptor: td,
-							JobDescriptor:  jd,
-						}
-						firmament.TaskUpdated(pw.fc, taskDescription)
-					default:
-						glog.Fatalf("Pod %v in unexpected state %v", pod.Identifier, pod.State)
+				for i, item := range items {
+					var retry *firmamentRequest
+					if request, ok := item.(*firmamentRequest); ok {
+						retry = pw.sendTaskRequest(request.name, request.send)
+					} else {
+						retry = pw.processPod(item.(*Pod))
+					}
+					if retry != nil {
+						queue.AddRateLimited(key, append([]interface{}{retry}, items[i+1:]...)...)
+						return
 					}
 				}
+				queue.Forget(key)
 			}(key, items, wg)
 		}
 	}()
 }
 
+// dropPods drops the changes of a pod which exhausted the retries of the work queue, a warning is recorded on the
+// pod unless the events are disabled.
+func (pw *PodWatcher) dropPods(key interface{}, items []interface{}) {
+	logging.Error("processPodQueue: dropping pod changes, retries exhausted", "pod", key, "changes", len(items))
+	metrics.WorkQueueDeadLetters.WithLabelValues("pods").Add(float64(len(items)))
+	if config.GetDisableEvents() {
+		return
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(fmt.Sprint(key))
+	if err != nil {
+		return
+	}
+	NewPoseidonEvents(pw.clientset).RecordPodEvent(PodIdentifier{Name: name, Namespace: namespace}, v1.EventTypeWarning, PodDroppedReason,
+		"Changes of the pod dropped as Firmament failed to process them after %d retries", pw.cfg.QueueRetry.MaxRetries)
+}
+
+// processPod forwards the state of the pod to firmament. It returns the request to send again
+// if the request to firmament failed.
+func (pw *PodWatcher) processPod(pod *Pod) *firmamentRequest {
+	watcherEvents.WithLabelValues("pods", string(pod.State)).Inc()
+	logging.V(2).Info("processPod: processing pod", "pod", pod.Identifier.UniqueName(), "state", pod.State)
+	switch pod.State {
+	case PodPending:
+		return pw.addPendingPod(pod)
+	case PodSucceeded:
+		if releasePreassignedPod(pw.fc, pod.Identifier) {
+			return nil
+		}
+		PodMux.RLock()
+		td, ok := PodToTD[pod.Identifier]
+		PodMux.RUnlock()
+		if !ok {
+			logging.Info("processPod: completed pod does not exist", "pod", pod.Identifier.UniqueName())
+			return nil
+		}
+		logging.V(2).Info("processPod: pod completed", "pod", pod.Identifier.UniqueName(), "taskID", td.GetUid(), "containers", pod.ExitInfo)
+		var retry *firmamentRequest
+		if !pw.cancelSubmission(td) {
+			retry = pw.sendTaskRequest("TaskCompleted of pod "+pod.Identifier.UniqueName(), func() (firmament.TaskReplyType, error) {
+				return pw.fc.TaskCompleted(&firmament.TaskUID{TaskUid: td.Uid})
+			})
+		}
+		// The resources of the task are released by firmament, the deletion of the pod
+		// does not have to be forwarded anymore.
+		if pw.removeTask(pod, td) {
+			releaseTaskCapacity(td)
+		}
+		return retry
+	case PodDeleted:
+		if releasePreassignedPod(pw.fc, pod.Identifier) {
+			return nil
+		}
+		PodMux.RLock()
+		td, ok := PodToTD[pod.Identifier]
+		PodMux.RUnlock()
+		releasePreemptionVictim(pod.Identifier)
+		forgetPreemptor(pod.Identifier)
+		// The task state is removed before firmament is notified, so that bindings
+		// still in flight for the pod are aborted and the task is only removed once.
+		if !ok || !pw.removeTask(pod, td) {
+			// Expected after a restart or a relist of the informer, the deletion is dropped.
+			logging.Info("processPod: deleted pod does not exist", "pod", pod.Identifier.UniqueName())
+			metrics.PodStateRecoveries.WithLabelValues(recoveryUnknownDelete).Inc()
+			return nil
+		}
+		// The task may have been withdrawn from firmament after a failed binding.
+		if pw.cancelSubmission(td) || forgetBindRetries(pod.Identifier) {
+			return nil
+		}
+		// TODO(jiaxuanzhou) need to metric the task remove latency ?
+		retry := pw.sendTaskRequest("TaskRemoved of pod "+pod.Identifier.UniqueName(), func() (firmament.TaskReplyType, error) {
+			return pw.fc.TaskRemoved(&firmament.TaskUID{TaskUid: td.Uid})
+		})
+		releaseTaskCapacity(td)
+		return retry
+	case PodFailed:
+		if releasePreassignedPod(pw.fc, pod.Identifier) {
+			return nil
+		}
+		PodMux.RLock()
+		td, ok := PodToTD[pod.Identifier]
+		PodMux.RUnlock()
+		if !ok {
+			logging.Info("processPod: failed pod does not exist", "pod", pod.Identifier.UniqueName())
+			return nil
+		}
+		logging.Info("processPod: pod failed", "pod", pod.Identifier.UniqueName(), "taskID", td.GetUid(), "containers", pod.ExitInfo)
+		var retry *firmamentRequest
+		if !pw.cancelSubmission(td) {
+			retry = pw.sendTaskRequest("TaskFailed of pod "+pod.Identifier.UniqueName(), func() (firmament.TaskReplyType, error) {
+				return pw.fc.TaskFailed(&firmament.TaskUID{TaskUid: td.Uid})
+			})
+		}
+		if pw.removeTask(pod, td) {
+			releaseTaskCapacity(td)
+		}
+		return retry
+	case PodPreassigned:
+		reservePreassignedPod(pw.fc, pod)
+	case PodRunning:
+		// We don't have to do anything.
+	case PodUnknown:
+		logging.Error("processPod: pod in unknown state", "pod", pod.Identifier.UniqueName())
+		// TODO(ionel): Handle Unknown case.
+	case PodUpdated:
+		PodMux.Lock()
+		jobId := pw.generateJobID(pod.OwnerRef)
+		jd, okJob := jobIDToJD[jobId]
+		td, okPod := PodToTD[pod.Identifier]
+		PodMux.Unlock()
+		if !okJob || !okPod {
+			return pw.recoverUnknownPod(pod)
+		}
+		pw.updateTask(pod, td)
+		if (pw.batcher != nil && pw.batcher.isPending(td.GetUid())) || isTaskWithdrawn(pod.Identifier) {
+			// The pending submission carries the updated task descriptor.
+			return nil
+		}
+		taskDescription := &firmament.TaskDescription{
+			TaskDescriptor: td,
+			JobDescriptor:  jd,
+		}
+		return pw.sendTaskRequest("TaskUpdated of pod "+pod.Identifier.UniqueName(), func() (firmament.TaskReplyType, error) {
+			return pw.fc.TaskUpdated(taskDescription)
+		})
+	default:
+		glog.Fatalf("Pod %v in unexpected state %v", pod.Identifier, pod.State)
+	}
+	return nil
+}
+
+// podQueue returns the work queue of the pods of the namespace.
+func (pw *PodWatcher) podQueue(namespace string) Queue {
+	if pw.namespaceQueues == nil {
+		return pw.podWorkQueue
+	}
+	return pw.namespaceQueues.get(namespace)
+}
+
+// queuedPods returns the number of pods queued or under processing in the work queues.
+func (pw *PodWatcher) queuedPods() int {
+	if pw.namespaceQueues == nil {
+		return pw.podWorkQueue.Len()
+	}
+	return pw.namespaceQueues.Len()
+}
+
+// addPendingPod creates the task of a pending pod and submits it to firmament.
+// It returns the submission to send again if it failed.
+func (pw *PodWatcher) addPendingPod(pod *Pod) *firmamentRequest {
+	PodMux.Lock()
+
+	// check if the pod already exists
+	// this cases happened when Replicaset are used.
+	// When a replicaset is delete it creates more pods with the same name
+	_, ok := PodToTD[pod.Identifier]
+	if ok {
+		// we ignore this since the pod already exists
+		// release the lock
+		logging.V(2).Info("addPendingPod: pod already added", "pod", pod.Identifier.UniqueName())
+		PodMux.Unlock()
+		return nil
+	}
+	jobID := pw.generateJobID(pod.OwnerRef)
+	jd, ok := jobIDToJD[jobID]
+	if !ok {
+		jd = pw.createNewJob(pod.OwnerRef)
+		if len(pod.Gang) > 0 {
+			jd.MinNumberOfTasks = uint64(pod.GangSize)
+			jd.IsGangSchedulingJob = true
+		} else {
+			// get requirement for gang scheduling if enabled
+			jd = pw.updateGangSchedulingrequireent(pod, jd)
+		}
+		jobIDToJD[jobID] = jd
+		jobNumTasksToRemove[jobID] = 0
+	}
+	jobNumTasksToRemove[jobID]++
+	taskCount := jobNumTasksToRemove[jobID]
+	PodMux.Unlock()
+	td := pw.addTaskToJob(pod, jd.Uuid, jd.Name, (taskCount))
+	PodMux.Lock()
+	// if taskCount is '1' it means root task, update the RootTask pointer in the JobDescriptor
+	if taskCount == 1 {
+		jd.RootTask = td
+	}
+	PodToTD[pod.Identifier] = td
+	TaskIDToPod[td.GetUid()] = pod.Identifier
+	taskSubmitTime[td.GetUid()] = time.Now()
+	if len(pod.Gang) > 0 {
+		registerGangMember(pod.Gang, pod.GangSize, td.GetUid())
+	}
+	taskDescription := &firmament.TaskDescription{
+		TaskDescriptor: td,
+		JobDescriptor:  jd,
+	}
+	PodMux.Unlock()
+	metrics.SchedulingSubmitmLatency.Observe(metrics.SinceInMicroseconds(time.Time(pod.CreateTimeStamp.Time)))
+	return pw.submitTask(taskDescription)
+}
+
+// recoverUnknownPod handles an update of a pod missing from the task maps, which happens after a
+// restart of poseidon or a relist of the informer. Pods which are not placed yet are added as pending pods.
+// Firmament has no task lookup, the task of a placed pod is rebuilt and probed with a task update.
+// The task is adopted if firmament knows it, otherwise the update is dropped.
+// It returns the request to send again if it failed.
+func (pw *PodWatcher) recoverUnknownPod(pod *Pod) *firmamentRequest {
+	if len(pod.NodeName) == 0 {
+		glog.Infof("Pod %v does not exist, adding it as a pending pod", pod.Identifier)
+		metrics.PodStateRecoveries.WithLabelValues(recoveryUnknownUpdatePending).Inc()
+		return pw.addPendingPod(pod)
+	}
+	glog.Infof("Pod %v running on node %s does not exist, reconciling it with firmament", pod.Identifier, pod.NodeName)
+	metrics.PodStateRecoveries.WithLabelValues(recoveryUnknownUpdateRunning).Inc()
+	jobID := pw.generateJobID(pod.OwnerRef)
+	PodMux.RLock()
+	jd, okJob := jobIDToJD[jobID]
+	taskCount := jobNumTasksToRemove[jobID] + 1
+	PodMux.RUnlock()
+	if !okJob {
+		jd = pw.createNewJob(pod.OwnerRef)
+	}
+	td := pw.addTaskToJob(pod, jd.Uuid, jd.Name, taskCount)
+	td.State = firmament.TaskDescriptor_RUNNING
+	return pw.sendTaskRequest("TaskUpdated of pod "+pod.Identifier.UniqueName(), func() (firmament.TaskReplyType, error) {
+		reply, err := pw.fc.TaskUpdated(&firmament.TaskDescription{
+			TaskDescriptor: td,
+			JobDescriptor:  jd,
+		})
+		if err == nil {
+			pw.adoptTask(pod, jobID, jd, td, reply)
+		}
+		return reply, err
+	})
+}
+
+// adoptTask registers the task rebuilt for a pod running on a node once firmament replied to the task update.
+func (pw *PodWatcher) adoptTask(pod *Pod, jobID string, jd *firmament.JobDescriptor, td *firmament.TaskDescriptor, reply firmament.TaskReplyType) {
+	if reply != firmament.TaskReplyType_TASK_UPDATED_OK {
+		glog.Infof("Task of pod %v is not known by firmament, dropping the update", pod.Identifier)
+		return
+	}
+	PodMux.Lock()
+	defer PodMux.Unlock()
+	if _, ok := PodToTD[pod.Identifier]; ok {
+		return
+	}
+	if _, ok := jobIDToJD[jobID]; !ok {
+		jobIDToJD[jobID] = jd
+		jobNumTasksToRemove[jobID] = 0
+	}
+	jd = jobIDToJD[jobID]
+	jobNumTasksToRemove[jobID]++
+	if jobNumTasksToRemove[jobID] == 1 {
+		jd.RootTask = td
+	}
+	PodToTD[pod.Identifier] = td
+	TaskIDToPod[td.GetUid()] = pod.Identifier
+	glog.Infof("Adopted task %d of pod %v", td.GetUid(), pod.Identifier)
+}
+
+// recordTaskReply counts the replies of firmament which reveal a drift between the pods and the tasks of firmament.
+func recordTaskReply(reply firmament.TaskReplyType) {
+	switch reply {
+	case firmament.TaskReplyType_TASK_NOT_FOUND, firmament.TaskReplyType_TASK_JOB_NOT_FOUND:
+		metrics.PodStateRecoveries.WithLabelValues(recoveryTaskNotFound).Inc()
+	case firmament.TaskReplyType_TASK_ALREADY_SUBMITTED, firmament.TaskReplyType_TASK_STATE_NOT_CREATED:
+		metrics.PodStateRecoveries.WithLabelValues(recoveryTaskAlreadySubmitted).Inc()
+	}
+}
+
+// firmamentRequest is a task request to firmament which failed with a transient error. It is queued ahead of the next
+// items of the pod and sent again by the pod workers.
+type firmamentRequest struct {
+	name string
+	send func() (firmament.TaskReplyType, error)
+}
+
+// sendTaskRequest sends a task request to firmament and records its reply.
+// It returns the request to send again if it failed with a transient error, see firmament.IsTransient.
+func (pw *PodWatcher) sendTaskRequest(name string, send func() (firmament.TaskReplyType, error)) *firmamentRequest {
+	reply, err := send()
+	if err != nil {
+		if !firmament.IsTransient(err) {
+			// The request fails again if it is sent again, the next changes of the pod are processed.
+			glog.Errorf("%s failed, dropping it: %v", name, err)
+			return nil
+		}
+		pw.failureLog.Errorf(name, "%s failed, sending it again: %v", name, err)
+		if firmament.IsTimeout(err) {
+			metrics.FirmamentRequestTimeouts.Inc()
+		}
+		return &firmamentRequest{name: name, send: send}
+	}
+	pw.failureLog.Reset(name)
+	recordTaskReply(reply)
+	return nil
+}
+
+// submitTask submits the task to firmament, or adds it to the next batch when batching is enabled.
+// It returns the submission to send again if it failed.
+func (pw *PodWatcher) submitTask(taskDescription *firmament.TaskDescription) *firmamentRequest {
+	if pw.batcher == nil {
+		return pw.sendTaskRequest("TaskSubmitted of task "+strconv.FormatUint(taskDescription.TaskDescriptor.GetUid(), 10), func() (firmament.TaskReplyType, error) {
+			return pw.fc.TaskSubmitted(taskDescription)
+		})
+	}
+	pw.batcher.add(taskDescription)
+	return nil
+}
+
+// cancelSubmission drops the task from the batch it waits in. It returns false if the task
+// was submitted to firmament.
+func (pw *PodWatcher) cancelSubmission(td *firmament.TaskDescriptor) bool {
+	return pw.batcher != nil && pw.batcher.cancel(td.GetUid())
+}
+
+// removeTask drops the pod to task mapping and the job of the task once it has no tasks left.
+// It returns false if the task of the pod was already removed.
+func (pw *PodWatcher) removeTask(pod *Pod, td *firmament.TaskDescriptor) bool {
+	PodMux.Lock()
+	defer PodMux.Unlock()
+	if PodToTD[pod.Identifier] != td {
+		return false
+	}
+	delete(PodToTD, pod.Identifier)
+	delete(TaskIDToPod, td.GetUid())
+	delete(taskSubmitTime, td.GetUid())
+	removeGangMember(td.GetUid())
+	releaseHostPorts(pod.Identifier)
+	// TODO(ionel): Should we delete the task from JD's spawned field?
+	jobID := pw.generateJobID(pod.OwnerRef)
+	jobNumTasksToRemove[jobID]--
+	if jobNumTasksToRemove[jobID] == 0 {
+		// Clean state because the job doesn't have any tasks left.
+		delete(jobNumTasksToRemove, jobID)
+		delete(jobIDToJD, jobID)
+	}
+	return true
+}
+
 func (pw *PodWatcher) createNewJob(jobName string) *firmament.JobDescriptor {
 	jobDesc := &firmament.JobDescriptor{
 		Uuid:  pw.generateJobID(jobName),
@@ -590,6 +1050,8 @@ func (pw *PodWatcher) updateTask(pod *Pod, td *firmament.TaskDescriptor) {
 	// TODO(ionel): Update LabelSelector!
 	td.ResourceRequest.CpuCores = float32(pod.CPURequest)
 	td.ResourceRequest.RamCap = uint64(pod.MemRequestKb)
+	td.ResourceRequest.EphemeralCap = uint64(pod.EphemeralReqKb)
+	td.Priority = getPodTaskPriority(pod)
 	// Update labels.
 	td.Labels = nil
 	for label, value := range pod.Labels {
@@ -599,55 +1061,18 @@ func (pw *PodWatcher) updateTask(pod *Pod, td *firmament.TaskDescriptor) {
 				Value: value,
 			})
 	}
+	setTaskResourceLabels(td, pod)
+	setTaskSchedulerNameLabel(td, pod)
 
 	// update label selectors
 	td.LabelSelectors = nil
-	td.LabelSelectors = pw.getFirmamentLabelSelectorFromNodeSelectorMap(pod.NodeSelector, SortNodeSelectorsKey(pod.NodeSelector))
+	td.LabelSelectors = pw.getFirmamentLabelSelectors(pod)
+	td.LabelSelectors = append(td.LabelSelectors, getTaintLabelSelectors(pod.Tolerations)...)
 
 	//Add tolerations
-	for _, tolerations := range pod.Tolerations {
-		td.Toleration = append(td.Toleration,
-			&firmament.Toleration{
-				Key:      tolerations.Key,
-				Value:    tolerations.Value,
-				Operator: tolerations.Operator,
-				Effect:   tolerations.Effect,
-			})
-	}
-
-	nodeAffinity := len(pod.Affinity.NodeAffinity.HardScheduling.NodeSelectorTerms) > 0 || len(pod.Affinity.NodeAffinity.SoftScheduling) > 0
-	podAffinity := len(pod.Affinity.PodAffinity.HardScheduling) > 0 || len(pod.Affinity.PodAffinity.SoftScheduling) > 0
-	podAntiAffinity := len(pod.Affinity.PodAntiAffinity.HardScheduling) > 0 || len(pod.Affinity.PodAntiAffinity.SoftScheduling) > 0
-	localAffinity := new(firmament.Affinity)
-
-	if nodeAffinity {
-		localAffinity.NodeAffinity = &firmament.NodeAffinity{
-			RequiredDuringSchedulingIgnoredDuringExecution: &firmament.NodeSelector{
-				NodeSelectorTerms: pw.getFirmamentNodeSelTerm(pod),
-			},
-			PreferredDuringSchedulingIgnoredDuringExecution: pw.getFirmamentPreferredSchedulingTerm(pod),
-		}
-	}
-
-	if podAffinity {
-		localAffinity.PodAffinity = &firmament.PodAffinity{
-			RequiredDuringSchedulingIgnoredDuringExecution:  pw.getFirmamentPodAffinityTerm(pod),
-			PreferredDuringSchedulingIgnoredDuringExecution: pw.getFirmamentWeightedPodAffinityTerm(pod),
-		}
-	}
-
-	if podAntiAffinity {
-		localAffinity.PodAntiAffinity = &firmament.PodAntiAffinity{
-			RequiredDuringSchedulingIgnoredDuringExecution:  pw.getFirmamentPodAffinityTermforPodAntiAffinity(pod),
-			PreferredDuringSchedulingIgnoredDuringExecution: pw.getFirmamentWeightedPodAffinityTermforPodAntiAffinity(pod),
-		}
+	td.Toleration = getFirmamentTolerations(pod.Tolerations)
 
-	}
-
-	td.Affinity = localAffinity
-	if nodeAffinity == false && podAffinity == false && podAntiAffinity == false {
-		td.Affinity = nil
-	}
+	td.Affinity = pw.getFirmamentAffinity(pod)
 }
 
 func (pw *PodWatcher) addTaskToJob(pod *Pod, jdUid string, jdName string, tdID int) *firmament.TaskDescriptor {
@@ -664,6 +1089,7 @@ func (pw *PodWatcher) addTaskToJob(pod *Pod, jdUid string, jdName string, tdID i
 		},
 		OwnerRefKind: pod.OwnerKind,
 		OwnerRefUid:  pod.OwnerUid,
+		Priority:     getPodTaskPriority(pod),
 	}
 
 	// Add labels.
@@ -674,54 +1100,17 @@ func (pw *PodWatcher) addTaskToJob(pod *Pod, jdUid string, jdName string, tdID i
 				Value: value,
 			})
 	}
+	setTaskResourceLabels(task, pod)
+	setTaskSchedulerNameLabel(task, pod)
 
 	//Add tolerations
-	for _, tolerations := range pod.Tolerations {
-		task.Toleration = append(task.Toleration,
-			&firmament.Toleration{
-				Key:      tolerations.Key,
-				Value:    tolerations.Value,
-				Operator: tolerations.Operator,
-				Effect:   tolerations.Effect,
-			})
-	}
+	task.Toleration = getFirmamentTolerations(pod.Tolerations)
 	// Get the network requirement from pods label, and set it in ResourceRequest of the TaskDescriptor
 	setTaskNetworkRequirement(task, pod.Labels)
-	task.LabelSelectors = pw.getFirmamentLabelSelectorFromNodeSelectorMap(pod.NodeSelector, SortNodeSelectorsKey(pod.NodeSelector))
-
-	nodeAffinity := len(pod.Affinity.NodeAffinity.HardScheduling.NodeSelectorTerms) > 0 || len(pod.Affinity.NodeAffinity.SoftScheduling) > 0
-	podAffinity := len(pod.Affinity.PodAffinity.HardScheduling) > 0 || len(pod.Affinity.PodAffinity.SoftScheduling) > 0
-	podAntiAffinity := len(pod.Affinity.PodAntiAffinity.HardScheduling) > 0 || len(pod.Affinity.PodAntiAffinity.SoftScheduling) > 0
-	localAffinity := new(firmament.Affinity)
+	task.LabelSelectors = pw.getFirmamentLabelSelectors(pod)
+	task.LabelSelectors = append(task.LabelSelectors, getTaintLabelSelectors(pod.Tolerations)...)
 
-	if nodeAffinity {
-		localAffinity.NodeAffinity = &firmament.NodeAffinity{
-			RequiredDuringSchedulingIgnoredDuringExecution: &firmament.NodeSelector{
-				NodeSelectorTerms: pw.getFirmamentNodeSelTerm(pod),
-			},
-			PreferredDuringSchedulingIgnoredDuringExecution: pw.getFirmamentPreferredSchedulingTerm(pod),
-		}
-	}
-
-	if podAffinity {
-		localAffinity.PodAffinity = &firmament.PodAffinity{
-			RequiredDuringSchedulingIgnoredDuringExecution:  pw.getFirmamentPodAffinityTerm(pod),
-			PreferredDuringSchedulingIgnoredDuringExecution: pw.getFirmamentWeightedPodAffinityTerm(pod),
-		}
-	}
-
-	if podAntiAffinity {
-		localAffinity.PodAntiAffinity = &firmament.PodAntiAffinity{
-			RequiredDuringSchedulingIgnoredDuringExecution:  pw.getFirmamentPodAffinityTermforPodAntiAffinity(pod),
-			PreferredDuringSchedulingIgnoredDuringExecution: pw.getFirmamentWeightedPodAffinityTermforPodAntiAffinity(pod),
-		}
-
-	}
-
-	task.Affinity = localAffinity
-	if nodeAffinity == false && podAffinity == false && podAntiAffinity == false {
-		task.Affinity = nil
-	}
+	task.Affinity = pw.getFirmamentAffinity(pod)
 
 	setTaskType(task)
 	// No need to update the RootTask.Spawned here, it will be updated by firmament on processing the task submit call.
@@ -784,6 +1173,104 @@ func (pw *PodWatcher) getFirmamentLabelSelectorFromNodeSelectorMap(nodeSelector
 	return firmamentLabelSelector
 }
 
+// getFirmamentLabelSelectors returns the label selector constraints for a pod, built from
+// its node selector and its required node affinity.
+func (pw *PodWatcher) getFirmamentLabelSelectors(pod *Pod) []*firmament.LabelSelector {
+	labelSelectors := pw.getFirmamentLabelSelectorFromNodeSelectorMap(pod.NodeSelector, SortNodeSelectorsKey(pod.NodeSelector))
+	if pod.Affinity == nil || pod.Affinity.NodeAffinity == nil || pod.Affinity.NodeAffinity.HardScheduling == nil {
+		return labelSelectors
+	}
+	nodeSelTerms := pod.Affinity.NodeAffinity.HardScheduling.NodeSelectorTerms
+	// Label selectors on a task are ANDed while node selector terms are ORed, so
+	// only a single term can be expressed as label selectors. Multiple terms are
+	// still passed on to firmament through the task affinity.
+	if len(nodeSelTerms) != 1 {
+		return labelSelectors
+	}
+	return append(labelSelectors, pw.getFirmamentLabelSelectorFromNodeSelectorTerm(pod, nodeSelTerms[0])...)
+}
+
+// getFirmamentLabelSelectorFromNodeSelectorTerm converts the match expressions of a node selector term
+// to firmament label selectors. Requirements with unsupported operators are logged and skipped.
+func (pw *PodWatcher) getFirmamentLabelSelectorFromNodeSelectorTerm(pod *Pod, nodeSelTerm NodeSelectorTerm) []*firmament.LabelSelector {
+	var firmamentLabelSelector []*firmament.LabelSelector
+	for _, req := range nodeSelTerm.MatchExpressions {
+		var selectorType firmament.LabelSelector_SelectorType
+		switch v1.NodeSelectorOperator(req.Operator) {
+		case v1.NodeSelectorOpIn:
+			selectorType = firmament.LabelSelector_IN_SET
+		case v1.NodeSelectorOpNotIn:
+			selectorType = firmament.LabelSelector_NOT_IN_SET
+		case v1.NodeSelectorOpExists:
+			selectorType = firmament.LabelSelector_EXISTS_KEY
+		case v1.NodeSelectorOpDoesNotExist:
+			selectorType = firmament.LabelSelector_NOT_EXISTS_KEY
+		case v1.NodeSelectorOpGt, v1.NodeSelectorOpLt:
+			if len(req.Values) != 1 {
+				glog.Errorf("Skipping node selector requirement %v for pod %v, operator %s needs exactly one value", req, pod.Identifier, req.Operator)
+				continue
+			}
+			if _, err := strconv.ParseInt(req.Values[0], 10, 64); err != nil {
+				glog.Errorf("Skipping node selector requirement %v for pod %v, operator %s needs an integer value, err: %v", req, pod.Identifier, req.Operator, err)
+				continue
+			}
+			selectorType = firmament.LabelSelector_GREATER_THAN
+			if v1.NodeSelectorOperator(req.Operator) == v1.NodeSelectorOpLt {
+				selectorType = firmament.LabelSelector_LESSER_THAN
+			}
+		default:
+			glog.Errorf("Skipping node selector requirement %v for pod %v, unsupported operator %s", req, pod.Identifier, req.Operator)
+			continue
+		}
+		firmamentLabelSelector = append(firmamentLabelSelector, &firmament.LabelSelector{
+			Type:   selectorType,
+			Key:    req.Key,
+			Values: req.Values,
+		})
+	}
+	return firmamentLabelSelector
+}
+
+// getFirmamentAffinity returns the affinity of the task of the pod, or nil if the pod has no affinity. The preferred
+// terms are soft constraints weighted by firmament, the nodes matching the terms of higher weight get lower costs.
+// The required node selector is only set with required terms, so that a pod with preferred terms only may still be
+// placed on the nodes matching none of them.
+func (pw *PodWatcher) getFirmamentAffinity(pod *Pod) *firmament.Affinity {
+	nodeAffinity := len(pod.Affinity.NodeAffinity.HardScheduling.NodeSelectorTerms) > 0 || len(pod.Affinity.NodeAffinity.SoftScheduling) > 0
+	podAffinity := len(pod.Affinity.PodAffinity.HardScheduling) > 0 || len(pod.Affinity.PodAffinity.SoftScheduling) > 0
+	podAntiAffinity := len(pod.Affinity.PodAntiAffinity.HardScheduling) > 0 || len(pod.Affinity.PodAntiAffinity.SoftScheduling) > 0
+	if nodeAffinity == false && podAffinity == false && podAntiAffinity == false {
+		return nil
+	}
+	localAffinity := new(firmament.Affinity)
+
+	if nodeAffinity {
+		localAffinity.NodeAffinity = &firmament.NodeAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: pw.getFirmamentPreferredSchedulingTerm(pod),
+		}
+		if len(pod.Affinity.NodeAffinity.HardScheduling.NodeSelectorTerms) > 0 {
+			localAffinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &firmament.NodeSelector{
+				NodeSelectorTerms: pw.getFirmamentNodeSelTerm(pod),
+			}
+		}
+	}
+
+	if podAffinity {
+		localAffinity.PodAffinity = &firmament.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  pw.getFirmamentPodAffinityTerm(pod),
+			PreferredDuringSchedulingIgnoredDuringExecution: pw.getFirmamentWeightedPodAffinityTerm(pod),
+		}
+	}
+
+	if podAntiAffinity {
+		localAffinity.PodAntiAffinity = &firmament.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  pw.getFirmamentPodAffinityTermforPodAntiAffinity(pod),
+			PreferredDuringSchedulingIgnoredDuringExecution: pw.getFirmamentWeightedPodAffinityTermforPodAntiAffinity(pod),
+		}
+	}
+	return localAffinity
+}
+
 func (pw *PodWatcher) getFirmamentNodeSelTerm(pod *Pod) []*firmament.NodeSelectorTerm {
 	var fns []*firmament.NodeSelectorTerm
 	err := copier.Copy(&fns, pod.Affinity.NodeAffinity.HardScheduling.NodeSelectorTerms)
@@ -838,6 +1325,23 @@ func (pw *PodWatcher) getFirmamentWeightedPodAffinityTermforPodAntiAffinity(pod
 	return wpat
 }
 
+func getFirmamentTolerations(tolerations []Toleration) []*firmament.Toleration {
+	var firmamentTolerations []*firmament.Toleration
+	for _, toleration := range tolerations {
+		firmamentToleration := &firmament.Toleration{
+			Key:      toleration.Key,
+			Value:    toleration.Value,
+			Operator: toleration.Operator,
+			Effect:   toleration.Effect,
+		}
+		if toleration.TolerationSeconds != nil {
+			firmamentToleration.TolerationSeconds = *toleration.TolerationSeconds
+		}
+		firmamentTolerations = append(firmamentTolerations, firmamentToleration)
+	}
+	return firmamentTolerations
+}
+
 func setTaskNetworkRequirement(td *firmament.TaskDescriptor, nodeSelectors NodeSelectors) {
 	if val, ok := nodeSelectors["networkRequirement"]; ok {
 		res, err := strconv.ParseUint(val, 10, 64)
@@ -849,6 +1353,12 @@ func setTaskNetworkRequirement(td *firmament.TaskDescriptor, nodeSelectors NodeS
 	}
 }
 
+func setTaskSchedulerNameLabel(td *firmament.TaskDescriptor, pod *Pod) {
+	if pod.SchedulerName != "" {
+		td.Labels = append(td.Labels, &firmament.Label{Key: SchedulerNameLabel, Value: pod.SchedulerName})
+	}
+}
+
 func setTaskType(td *firmament.TaskDescriptor) {
 	for _, label := range td.Labels {
 		if label.Key == "taskType" {
@@ -868,96 +1378,6 @@ func setTaskType(td *firmament.TaskDescriptor) {
 	}
 }
 
-// getPVNodeAffinity this method will check if the pod have any PVC's which are pre-bound to a PV and
-// this will create an node selector term in the Pod's NodeAffinity section, based on the PV's node-selector and pass it on to firmamnet.
-// When firmament see a node selector it will try to schdeule the task on that Node, provided all the other
-// constraints are satisfied.
-func (pw *PodWatcher) getPVNodeAffinity(volumes []v1.Volume, pod *v1.Pod) (*v1.Pod, bool) {
-
-	var pvcName string
-	if pod.Spec.Affinity != nil && pod.Spec.Affinity.NodeAffinity != nil {
-		glog.V(2).Info("Pod already has an node affinity field ", pod.Spec.Affinity.NodeAffinity)
-	}
-	for _, v := range volumes {
-		glog.V(2).Info(v, " is the volume name for pod ", pod.Name)
-		if v.VolumeSource.PersistentVolumeClaim != nil {
-			pvcName = v.VolumeSource.PersistentVolumeClaim.ClaimName
-			glog.V(3).Info("Found a PV claim name ", pvcName, " for Pod", pod.Name)
-		} else {
-			glog.V(3).Info("No PV claim found for the Pod ", pod.Name)
-			continue
-		}
-		// get the PVc object associated with the PV claim name from the api-server
-		pvc, err := pw.clientset.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(pvcName, metav1.GetOptions{})
-		if err != nil {
-			glog.Error(err, " Unable to retrieve the PVC object for PVC ", pvcName, " associated with Pod ", pod.Name)
-			return nil, false
-		}
-		if pvc.Spec.VolumeName != "" {
-			// search for PV associated with this PVC
-			pv, err := pw.clientset.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
-			if err != nil {
-				glog.Error(err, "Unable to get the PV associated with the PVC volume name", pvc.Spec.VolumeName)
-				return nil, false
-			}
-			var pvNodeSelector *v1.NodeSelector
-			if pv.Spec.NodeAffinity != nil && pv.Spec.NodeAffinity.Required != nil {
-				pvNodeSelector = pv.Spec.NodeAffinity.Required
-			} else {
-				glog.V(2).Info("No matching node selector for PV volume found", pvc.Spec.VolumeName)
-				continue
-			}
-			// update the pods NodeAfiinity field with he PV's NodeAffinity term
-			if pod.Spec.Affinity != nil {
-				podNodeAffinity := pod.Spec.Affinity.NodeAffinity
-				if podNodeAffinity != nil {
-					// Check if the NodeAffinity Hard section is available, update only the RequiredDuringSchedulingIgnoredDuringExecution section
-					// of the pod NodeAffinity
-					if podNodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
-						podNodeSelector := podNodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
-
-						// check Pods NodeSelectorTerms and prepend PV's Node selector requirement to the first NodeSelectorTerms
-						if len(podNodeSelector.NodeSelectorTerms) > 0 {
-							//get the first nodeselector term and update the match expression with our term
-							nodeSelectorTerm := podNodeSelector.NodeSelectorTerms[0]
-							for _, pvNodeSelector := range pvNodeSelector.NodeSelectorTerms {
-								//Note: we don't use the node fields terms
-								nodeSelectorTerm.MatchExpressions = append(nodeSelectorTerm.MatchExpressions, pvNodeSelector.MatchExpressions...)
-							}
-							podNodeSelector.NodeSelectorTerms[0] = nodeSelectorTerm
-						} else {
-							podNodeSelector.NodeSelectorTerms = append(podNodeSelector.NodeSelectorTerms, pvNodeSelector.NodeSelectorTerms...)
-						}
-					} else {
-						podNodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &v1.NodeSelector{
-							NodeSelectorTerms: pvNodeSelector.NodeSelectorTerms,
-						}
-					}
-				} else {
-					pod.Spec.Affinity.NodeAffinity = &v1.NodeAffinity{
-						RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
-							NodeSelectorTerms: pvNodeSelector.NodeSelectorTerms,
-						}}
-				}
-			} else {
-				pod.Spec.Affinity = &v1.Affinity{
-					NodeAffinity: &v1.NodeAffinity{
-						RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
-							NodeSelectorTerms: pvNodeSelector.NodeSelectorTerms,
-						},
-					},
-				}
-			}
-		} else {
-			// cannot find the right pv
-			glog.V(2).Info("Cannot schedule this pod since no matchin PV found", pod.Name)
-			return nil, false
-		}
-	}
-
-	return pod, true
-}
-
 func Update(pw kubernetes.Interface, pod *v1.Pod, condition *v1.PodCondition) error {
 	glog.V(1).Infof("Updating pod condition for %s/%s to (%s==%s)", pod.Namespace, pod.Name, condition.Type, condition.Status)
 	if UpdatePodCondition(&pod.Status, condition) {
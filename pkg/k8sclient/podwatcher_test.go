@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"github.com/golang/mock/gomock"
 	"k8s.io/api/core/v1"
+	schedulingv1beta1 "k8s.io/api/scheduling/v1beta1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -28,6 +29,10 @@ import (
 	"time"
 
 	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/cache"
 	"log"
@@ -35,6 +40,7 @@ import (
 
 type TestPodWatchObj struct {
 	firmamentClient *firmament.MockFirmamentSchedulerClient
+	fc              firmament.Client
 	kubeClient      *fake.Clientset
 	kubeVerMajor    int
 	kubeVerMinor    int
@@ -47,6 +53,7 @@ func initializePodObj(t *testing.T) *TestPodWatchObj {
 	testObj := &TestPodWatchObj{}
 	testObj.mockCtrl = gomock.NewController(t)
 	testObj.firmamentClient = firmament.NewMockFirmamentSchedulerClient(testObj.mockCtrl)
+	testObj.fc = firmament.NewClient(testObj.firmamentClient)
 	testObj.kubeClient = &fake.Clientset{}
 	testObj.kubeVerMajor = 1
 	testObj.kubeVerMinor = 6
@@ -54,6 +61,20 @@ func initializePodObj(t *testing.T) *TestPodWatchObj {
 	return testObj
 }
 
+// runPodWorker starts a pod worker of the watcher. The returned function shuts the queue down and waits for the
+// worker, so that it is gone before the next test resets the pod state.
+func runPodWorker(podWatch *PodWatcher) func() {
+	done := make(chan struct{})
+	go func() {
+		podWatch.podWorker()
+		close(done)
+	}()
+	return func() {
+		podWatch.podWorkQueue.ShutDown()
+		<-done
+	}
+}
+
 func ChangePodPhase(pod *v1.Pod, newPhase string) *v1.Pod {
 	newPod := *pod
 	newPod.Status = v1.PodStatus{
@@ -183,7 +204,7 @@ func GetPodPhase(strPhase string) v1.PodPhase {
 	return podPhase
 }
 
-//get the meta key for the pod
+// get the meta key for the pod
 func GetKey(pod *v1.Pod, t *testing.T) string {
 	key, err := cache.MetaNamespaceKeyFunc(pod)
 	if err != nil {
@@ -198,13 +219,13 @@ func TestNewPodWatcher(t *testing.T) {
 	defer testObj.mockCtrl.Finish()
 
 	// for default k8s 1.6
-	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, testObj.schedulerName, testObj.kubeClient, testObj.firmamentClient)
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
 	t.Logf("Pod watcher for v1.6=%v", podWatch)
 
 	// for k8s 1.5
 	testObj.kubeVerMajor = 1
 	testObj.kubeVerMinor = 5
-	podWatch = NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, testObj.schedulerName, testObj.kubeClient, testObj.firmamentClient)
+	podWatch = NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
 	t.Logf("Pod watcher for v1.5=%v", podWatch)
 
 }
@@ -230,6 +251,9 @@ func TestPodWatcher_enqueuePodAddition(t *testing.T) {
 				},
 				CPURequest:   2000,
 				MemRequestKb: 1024000,
+				CPULimit:     2000,
+				MemLimitKb:   1024000,
+				QOSClass:     v1.PodQOSBurstable,
 				OwnerRef:     fakeOwnerRef,
 				Affinity: &Affinity{
 					NodeAffinity: &NodeAffinity{
@@ -300,6 +324,9 @@ func TestPodWatcher_enqueuePodAddition(t *testing.T) {
 				},
 				CPURequest:   2000,
 				MemRequestKb: 1024000,
+				CPULimit:     2000,
+				MemLimitKb:   1024000,
+				QOSClass:     v1.PodQOSBurstable,
 				OwnerRef:     fakeOwnerRef,
 				Affinity: &Affinity{
 					NodeAffinity: &NodeAffinity{
@@ -370,6 +397,9 @@ func TestPodWatcher_enqueuePodAddition(t *testing.T) {
 				},
 				CPURequest:   2000,
 				MemRequestKb: 1024000,
+				CPULimit:     2000,
+				MemLimitKb:   1024000,
+				QOSClass:     v1.PodQOSBurstable,
 				OwnerRef:     fakeOwnerRef,
 				Affinity: &Affinity{
 					NodeAffinity: &NodeAffinity{
@@ -440,6 +470,9 @@ func TestPodWatcher_enqueuePodAddition(t *testing.T) {
 				},
 				CPURequest:   2000,
 				MemRequestKb: 1024000,
+				CPULimit:     2000,
+				MemLimitKb:   1024000,
+				QOSClass:     v1.PodQOSBurstable,
 				OwnerRef:     fakeOwnerRef,
 				Affinity: &Affinity{
 					NodeAffinity: &NodeAffinity{
@@ -504,7 +537,7 @@ func TestPodWatcher_enqueuePodAddition(t *testing.T) {
 
 	testObj := initializePodObj(t)
 	defer testObj.mockCtrl.Finish()
-	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, testObj.schedulerName, testObj.kubeClient, testObj.firmamentClient)
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
 
 	for _, podData := range testData {
 		key := GetKey(podData.pod, t)
@@ -544,7 +577,7 @@ func TestPodWatcher_CaseOne_podWorker(t *testing.T) {
 
 	testObj := initializePodObj(t)
 	defer testObj.mockCtrl.Finish()
-	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, testObj.schedulerName, testObj.kubeClient, testObj.firmamentClient)
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
 
 	key := GetKey(testData.pod, t)
 	podWatch.enqueuePodAddition(key, testData.pod)
@@ -555,7 +588,7 @@ func TestPodWatcher_CaseOne_podWorker(t *testing.T) {
 	var buf bytes.Buffer
 	log.SetOutput(&buf)
 
-	go podWatch.podWorker()
+	defer runPodWorker(podWatch)()
 	newTimer := time.NewTimer(time.Second * 1)
 	t.Log(buf.String())
 	<-newTimer.C
@@ -576,7 +609,7 @@ func TestPodWatcher_CaseTwo_podWorker(t *testing.T) {
 
 	testObj := initializePodObj(t)
 	defer testObj.mockCtrl.Finish()
-	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, testObj.schedulerName, testObj.kubeClient, testObj.firmamentClient)
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
 
 	key := GetKey(testData.pod, t)
 	podWatch.enqueuePodAddition(key, testData.pod)
@@ -592,7 +625,7 @@ func TestPodWatcher_CaseTwo_podWorker(t *testing.T) {
 	var buf bytes.Buffer
 	log.SetOutput(&buf)
 
-	go podWatch.podWorker()
+	defer runPodWorker(podWatch)()
 	newTimer := time.NewTimer(time.Second * 1)
 	t.Log(buf.String())
 	<-newTimer.C
@@ -613,7 +646,7 @@ func TestPodWatcher_CaseThree_podWorker(t *testing.T) {
 
 	testObj := initializePodObj(t)
 	defer testObj.mockCtrl.Finish()
-	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, testObj.schedulerName, testObj.kubeClient, testObj.firmamentClient)
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
 
 	key := GetKey(testData.pod, t)
 	podWatch.enqueuePodAddition(key, testData.pod)
@@ -629,7 +662,7 @@ func TestPodWatcher_CaseThree_podWorker(t *testing.T) {
 	var buf bytes.Buffer
 	log.SetOutput(&buf)
 
-	go podWatch.podWorker()
+	defer runPodWorker(podWatch)()
 	newTimer := time.NewTimer(time.Second * 1)
 	t.Log(buf.String())
 	<-newTimer.C
@@ -650,7 +683,7 @@ func TestPodWatcher_CaseFour_podWorker(t *testing.T) {
 
 	testObj := initializePodObj(t)
 	defer testObj.mockCtrl.Finish()
-	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, testObj.schedulerName, testObj.kubeClient, testObj.firmamentClient)
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
 
 	key := GetKey(testData.pod, t)
 	podWatch.enqueuePodAddition(key, testData.pod)
@@ -666,7 +699,7 @@ func TestPodWatcher_CaseFour_podWorker(t *testing.T) {
 	var buf bytes.Buffer
 	log.SetOutput(&buf)
 
-	go podWatch.podWorker()
+	defer runPodWorker(podWatch)()
 	newTimer := time.NewTimer(time.Second * 1)
 	t.Log(buf.String())
 	<-newTimer.C
@@ -687,7 +720,7 @@ func TestPodWatcher_CaseFive_podWorker(t *testing.T) {
 
 	testObj := initializePodObj(t)
 	defer testObj.mockCtrl.Finish()
-	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, testObj.schedulerName, testObj.kubeClient, testObj.firmamentClient)
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
 
 	key := GetKey(testData.pod, t)
 	podWatch.enqueuePodAddition(key, testData.pod)
@@ -703,8 +736,1078 @@ func TestPodWatcher_CaseFive_podWorker(t *testing.T) {
 	var buf bytes.Buffer
 	log.SetOutput(&buf)
 
-	go podWatch.podWorker()
+	defer runPodWorker(podWatch)()
 	newTimer := time.NewTimer(time.Second * 1)
 	t.Log(buf.String())
 	<-newTimer.C
 }
+
+// TestPodWatcher_terminalPhases drives a pod through the pod worker until it terminates, and checks
+// that firmament is only notified of the submission and the termination of the task: a crash looping
+// container does not change the pod phase, and the deletion of a terminated pod is not forwarded.
+func TestPodWatcher_terminalPhases(t *testing.T) {
+	var empty map[string]string
+	fakeNow := metav1.Now()
+
+	var testData = []struct {
+		phase    string
+		exitCode int32
+		reason   string
+		exitInfo string
+	}{
+		{phase: "Succeeded", exitCode: 0, reason: "Completed", exitInfo: "container-Pod-Succeeded: exit code 0 (Completed)"},
+		{phase: "Failed", exitCode: 137, reason: "OOMKilled", exitInfo: "container-Pod-Failed: exit code 137 (OOMKilled)"},
+	}
+
+	for _, data := range testData {
+		name := "Pod-" + data.phase
+		pod := BuildPod("Poseidon-Namespace", name, empty, GetPodPhase("Pending"), "2", "1024", &fakeNow, "owner-"+data.phase)
+		running := ChangePodPhase(pod, "Running")
+		crashLooping := running.DeepCopy()
+		crashLooping.Status.ContainerStatuses = []v1.ContainerStatus{{
+			Name:                 "container-" + name,
+			RestartCount:         3,
+			State:                v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+			LastTerminationState: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 1}},
+		}}
+		terminated := ChangePodPhase(crashLooping, data.phase)
+		terminated.Status.ContainerStatuses = []v1.ContainerStatus{{
+			Name:  "container-" + name,
+			State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: data.exitCode, Reason: data.reason}},
+		}}
+		if got := getContainerExitInfo(terminated); got != data.exitInfo {
+			t.Errorf("phase %s: expected exit info %q got %q", data.phase, data.exitInfo, got)
+		}
+
+		testObj := initializePodObj(t)
+		podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+		done := make(chan struct{})
+		submitted := testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil)
+		if data.phase == "Succeeded" {
+			testObj.firmamentClient.EXPECT().TaskCompleted(gomock.Any(), gomock.Any()).Return(
+				&firmament.TaskCompletedResponse{Type: firmament.TaskReplyType_TASK_COMPLETED_OK}, nil).After(submitted).Do(
+				func(arg0, arg1 interface{}, arg2 ...interface{}) {
+					close(done)
+				})
+		} else {
+			testObj.firmamentClient.EXPECT().TaskFailed(gomock.Any(), gomock.Any()).Return(
+				&firmament.TaskFailedResponse{Type: firmament.TaskReplyType_TASK_FAILED_OK}, nil).After(submitted).Do(
+				func(arg0, arg1 interface{}, arg2 ...interface{}) {
+					close(done)
+				})
+		}
+
+		key := GetKey(pod, t)
+		podWatch.enqueuePodAddition(key, pod)
+		podWatch.enqueuePodUpdate(key, pod, running)
+		podWatch.enqueuePodUpdate(key, running, crashLooping)
+		podWatch.enqueuePodUpdate(key, crashLooping, terminated)
+		deleted := terminated.DeepCopy()
+		deleted.DeletionTimestamp = &fakeNow
+		podWatch.enqueuePodDeletion(key, deleted)
+		stopWorker := runPodWorker(podWatch)
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("phase %s: expected firmament to be notified of the terminated task", data.phase)
+		}
+		// Let the worker process the deletion of the pod.
+		time.Sleep(200 * time.Millisecond)
+		PodMux.RLock()
+		if len(PodToTD) != 0 || len(TaskIDToPod) != 0 || len(jobIDToJD) != 0 {
+			t.Errorf("phase %s: expected the task state to be removed, got %v %v %v", data.phase, PodToTD, TaskIDToPod, jobIDToJD)
+		}
+		PodMux.RUnlock()
+		stopWorker()
+		testObj.mockCtrl.Finish()
+	}
+}
+
+// timeoutError is the error of a request to firmament which did not complete within its deadline.
+var timeoutError = status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+
+// TestPodWatcher_firmamentTimeouts checks that the task requests which time out or fail, e.g. while firmament
+// is unavailable, are sent again before the next changes of the pod are processed.
+func TestPodWatcher_firmamentTimeouts(t *testing.T) {
+	var empty map[string]string
+	fakeNow := metav1.Now()
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	defer podWatch.podWorkQueue.ShutDown()
+
+	done := make(chan struct{})
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(nil, timeoutError),
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil),
+		testObj.firmamentClient.EXPECT().TaskCompleted(gomock.Any(), gomock.Any()).Return(
+			nil, status.Error(codes.Unavailable, "firmament is restarting")),
+		testObj.firmamentClient.EXPECT().TaskCompleted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskCompletedResponse{Type: firmament.TaskReplyType_TASK_COMPLETED_OK}, nil).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				close(done)
+			}),
+	)
+
+	pod := BuildPod("Poseidon-Namespace", "Pod-Timeout", empty, GetPodPhase("Pending"), "2", "1024", &fakeNow, "owner-timeout")
+	key := GetKey(pod, t)
+	podWatch.enqueuePodAddition(key, pod)
+	podWatch.enqueuePodUpdate(key, pod, ChangePodPhase(pod, "Succeeded"))
+	defer runPodWorker(podWatch)()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the requests which failed to be sent again")
+	}
+	PodMux.RLock()
+	defer PodMux.RUnlock()
+	if len(PodToTD) != 0 || len(TaskIDToPod) != 0 || len(jobIDToJD) != 0 {
+		t.Errorf("expected the task state to be removed, got %v %v %v", PodToTD, TaskIDToPod, jobIDToJD)
+	}
+}
+
+// TestPodWatcher_firmamentRejections checks that a task request rejected by firmament is not sent again, and
+// that the next changes of the pod are processed.
+func TestPodWatcher_firmamentRejections(t *testing.T) {
+	var empty map[string]string
+	fakeNow := metav1.Now()
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+
+	done := make(chan struct{})
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			nil, status.Error(codes.InvalidArgument, "invalid task")),
+		testObj.firmamentClient.EXPECT().TaskCompleted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskCompletedResponse{Type: firmament.TaskReplyType_TASK_COMPLETED_OK}, nil).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				close(done)
+			}),
+	)
+
+	pod := BuildPod("Poseidon-Namespace", "Pod-Rejected", empty, GetPodPhase("Pending"), "2", "1024", &fakeNow, "owner-rejected")
+	key := GetKey(pod, t)
+	podWatch.enqueuePodAddition(key, pod)
+	podWatch.enqueuePodUpdate(key, pod, ChangePodPhase(pod, "Succeeded"))
+	defer runPodWorker(podWatch)()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the change following the rejected request to be processed")
+	}
+}
+
+// TestPodWatcher_podDeletion checks that the task of a deleted pod is removed from firmament exactly once,
+// whether the pod is still pending, about to be bound or running, and that bindings still in flight
+// for a deleted pod are aborted.
+func TestPodWatcher_podDeletion(t *testing.T) {
+	var empty map[string]string
+	fakeNow := metav1.Now()
+
+	for _, state := range []string{"pending", "binding", "running"} {
+		// Pending pods are deleted without a DeletionTimestamp.
+		pod := BuildPod("Poseidon-Namespace", "Pod-"+state, empty, GetPodPhase("Pending"), "2", "1024", nil, "owner-"+state)
+		testObj := initializePodObj(t)
+		podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+		client := fake.NewSimpleClientset(pod)
+		ClientSet = client
+		removed := make(chan struct{})
+		gomock.InOrder(
+			testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+				&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil),
+			testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+				&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil).Do(
+				func(arg0, arg1 interface{}, arg2 ...interface{}) {
+					close(removed)
+				}),
+		)
+
+		key := GetKey(pod, t)
+		podWatch.enqueuePodAddition(key, pod)
+		switch state {
+		case "pending", "binding":
+			podWatch.enqueuePodDeletion(key, pod)
+		case "running":
+			running := ChangePodPhase(pod, "Running")
+			podWatch.enqueuePodUpdate(key, pod, running)
+			deleted := running.DeepCopy()
+			deleted.DeletionTimestamp = &fakeNow
+			// The deletion is observed twice, once through a tombstone.
+			podWatch.enqueuePodDeletion(key, cache.DeletedFinalStateUnknown{Key: key, Obj: deleted})
+			podWatch.enqueuePodDeletion(key, deleted)
+		}
+		stopWorker := runPodWorker(podWatch)
+
+		select {
+		case <-removed:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s pod: expected the task to be removed from firmament", state)
+		}
+		// Let the worker process the remaining deletions.
+		time.Sleep(200 * time.Millisecond)
+		PodMux.RLock()
+		if len(PodToTD) != 0 || len(TaskIDToPod) != 0 || len(jobIDToJD) != 0 {
+			t.Errorf("%s pod: expected the task state to be removed, got %v %v %v", state, PodToTD, TaskIDToPod, jobIDToJD)
+		}
+		PodMux.RUnlock()
+
+		if state == "binding" {
+			// Firmament placed the pod before the deletion was observed.
+			bindPod(testObj.fc, BindInfo{Name: pod.Name, Namespace: pod.Namespace, Nodename: "node1"}, nil)
+			for _, action := range client.Actions() {
+				if action.GetSubresource() == "bindings" {
+					t.Errorf("expected the binding of the deleted pod to be aborted, got %v", action)
+				}
+			}
+		}
+		stopWorker()
+		testObj.mockCtrl.Finish()
+	}
+}
+
+// TestPodWatcher_unknownPods replays the events observed after a restart of poseidon, when the pod
+// workers receive updates and deletions of pods missing from the task maps. The worker has to stay alive,
+// recover the pods and leave the maps consistent.
+func TestPodWatcher_unknownPods(t *testing.T) {
+	fakeNow := metav1.Now()
+	counterValue := func(kind string) float64 {
+		metric := &dto.Metric{}
+		if err := metrics.PodStateRecoveries.WithLabelValues(kind).Write(metric); err != nil {
+			t.Fatal("unable to read the pod state recoveries metric ", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+
+	var testData = []struct {
+		name string
+		// events enqueues the replayed events, expect sets the expected firmament calls and closes done on the last one.
+		events          func(pw *PodWatcher, key string, pod *v1.Pod)
+		expect          func(fc *firmament.MockFirmamentSchedulerClient, done chan struct{})
+		expectedTasks   int
+		expectedRecover map[string]float64
+	}{
+		{
+			name: "deletion of an unknown pod followed by its addition",
+			events: func(pw *PodWatcher, key string, pod *v1.Pod) {
+				deleted := pod.DeepCopy()
+				deleted.DeletionTimestamp = &fakeNow
+				pw.enqueuePodDeletion(key, deleted)
+				pw.enqueuePodAddition(key, pod)
+			},
+			expect: func(fc *firmament.MockFirmamentSchedulerClient, done chan struct{}) {
+				fc.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+					&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil).Do(
+					func(arg0, arg1 interface{}, arg2 ...interface{}) {
+						close(done)
+					})
+			},
+			expectedTasks:   1,
+			expectedRecover: map[string]float64{recoveryUnknownDelete: 1},
+		},
+		{
+			name: "update of an unknown pending pod",
+			events: func(pw *PodWatcher, key string, pod *v1.Pod) {
+				relabeled := pod.DeepCopy()
+				relabeled.Labels = map[string]string{"version": "2"}
+				pw.enqueuePodUpdate(key, pod, relabeled)
+				pw.enqueuePodDeletion(key, relabeled)
+			},
+			expect: func(fc *firmament.MockFirmamentSchedulerClient, done chan struct{}) {
+				gomock.InOrder(
+					fc.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+						&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil),
+					fc.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+						&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil).Do(
+						func(arg0, arg1 interface{}, arg2 ...interface{}) {
+							close(done)
+						}),
+				)
+			},
+			expectedTasks:   0,
+			expectedRecover: map[string]float64{recoveryUnknownUpdatePending: 1},
+		},
+		{
+			name: "update of an unknown running pod known by firmament",
+			events: func(pw *PodWatcher, key string, pod *v1.Pod) {
+				running := ChangePodPhase(pod, "Running")
+				running.Spec.NodeName = "node1"
+				relabeled := running.DeepCopy()
+				relabeled.Labels = map[string]string{"version": "2"}
+				pw.enqueuePodUpdate(key, running, relabeled)
+			},
+			expect: func(fc *firmament.MockFirmamentSchedulerClient, done chan struct{}) {
+				fc.EXPECT().TaskUpdated(gomock.Any(), gomock.Any()).Return(
+					&firmament.TaskUpdatedResponse{Type: firmament.TaskReplyType_TASK_UPDATED_OK}, nil).Do(
+					func(arg0, arg1 interface{}, arg2 ...interface{}) {
+						close(done)
+					})
+			},
+			expectedTasks:   1,
+			expectedRecover: map[string]float64{recoveryUnknownUpdateRunning: 1},
+		},
+		{
+			name: "update of an unknown running pod unknown by firmament",
+			events: func(pw *PodWatcher, key string, pod *v1.Pod) {
+				running := ChangePodPhase(pod, "Running")
+				running.Spec.NodeName = "node1"
+				relabeled := running.DeepCopy()
+				relabeled.Labels = map[string]string{"version": "2"}
+				pw.enqueuePodUpdate(key, running, relabeled)
+				deleted := relabeled.DeepCopy()
+				deleted.DeletionTimestamp = &fakeNow
+				pw.enqueuePodDeletion(key, deleted)
+				pw.enqueuePodAddition(key, pod)
+			},
+			expect: func(fc *firmament.MockFirmamentSchedulerClient, done chan struct{}) {
+				gomock.InOrder(
+					fc.EXPECT().TaskUpdated(gomock.Any(), gomock.Any()).Return(
+						&firmament.TaskUpdatedResponse{Type: firmament.TaskReplyType_TASK_NOT_FOUND}, nil),
+					fc.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+						&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil).Do(
+						func(arg0, arg1 interface{}, arg2 ...interface{}) {
+							close(done)
+						}),
+				)
+			},
+			expectedTasks: 1,
+			expectedRecover: map[string]float64{
+				recoveryUnknownUpdateRunning: 1,
+				recoveryTaskNotFound:         1,
+				recoveryUnknownDelete:        1,
+			},
+		},
+	}
+
+	for _, data := range testData {
+		pod := BuildPod("Poseidon-Namespace", "Pod-unknown", map[string]string{"version": "1"}, GetPodPhase("Pending"), "2", "1024", nil, "owner-unknown")
+		testObj := initializePodObj(t)
+		podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+		ClientSet = fake.NewSimpleClientset(pod)
+		before := make(map[string]float64)
+		for kind := range data.expectedRecover {
+			before[kind] = counterValue(kind)
+		}
+		done := make(chan struct{})
+		data.expect(testObj.firmamentClient, done)
+
+		data.events(podWatch, GetKey(pod, t), pod)
+		stopWorker := runPodWorker(podWatch)
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: expected the worker to process all the events", data.name)
+		}
+		// Let the worker update the maps after the last call.
+		time.Sleep(200 * time.Millisecond)
+		PodMux.RLock()
+		if len(PodToTD) != data.expectedTasks || len(TaskIDToPod) != data.expectedTasks || len(jobIDToJD) != data.expectedTasks {
+			t.Errorf("%s: expected %d tasks got %v %v %v", data.name, data.expectedTasks, PodToTD, TaskIDToPod, jobIDToJD)
+		}
+		for podIdentifier, td := range PodToTD {
+			if TaskIDToPod[td.GetUid()] != podIdentifier {
+				t.Errorf("%s: expected task %d to map to pod %v got %v", data.name, td.GetUid(), podIdentifier, TaskIDToPod[td.GetUid()])
+			}
+		}
+		PodMux.RUnlock()
+		for kind, expected := range data.expectedRecover {
+			if got := counterValue(kind) - before[kind]; got != expected {
+				t.Errorf("%s: expected %v %s recoveries got %v", data.name, expected, kind, got)
+			}
+		}
+		stopWorker()
+		testObj.mockCtrl.Finish()
+	}
+}
+
+// TestPodWatcher_resourceUpdates doubles the memory request of a pending pod and updates the cpu limit of
+// the running pod, and checks that firmament receives the updated task descriptors while updates which
+// do not change the resources are not forwarded.
+func TestPodWatcher_resourceUpdates(t *testing.T) {
+	var empty map[string]string
+	pod := BuildPod("Poseidon-Namespace", "Pod-resources", empty, GetPodPhase("Pending"), "2", "1024", nil, "owner-resources")
+	resourceVersionOnly := pod.DeepCopy()
+	resourceVersionOnly.ResourceVersion = "2"
+	doubledMem := ChangePodCPUAndMemRequest(resourceVersionOnly, "2", "2048")
+	running := ChangePodPhase(doubledMem, "Running")
+	limited := running.DeepCopy()
+	limited.Spec.Containers[0].Resources.Limits = v1.ResourceList{v1.ResourceCPU: resource.MustParse("4")}
+	limitedResourceVersionOnly := limited.DeepCopy()
+	limitedResourceVersionOnly.ResourceVersion = "3"
+
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	var ramCaps []uint64
+	var cpuLimits []string
+	done := make(chan struct{})
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil),
+		testObj.firmamentClient.EXPECT().TaskUpdated(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskUpdatedResponse{Type: firmament.TaskReplyType_TASK_UPDATED_OK}, nil).Times(2).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				td := arg1.(*firmament.TaskDescription).GetTaskDescriptor()
+				ramCaps = append(ramCaps, td.GetResourceRequest().GetRamCap())
+				for _, label := range td.GetLabels() {
+					if label.GetKey() == CPULimitLabel {
+						cpuLimits = append(cpuLimits, label.GetValue())
+					}
+				}
+				if len(ramCaps) == 2 {
+					close(done)
+				}
+			}),
+	)
+
+	key := GetKey(pod, t)
+	podWatch.enqueuePodAddition(key, pod)
+	podWatch.enqueuePodUpdate(key, pod, resourceVersionOnly)
+	podWatch.enqueuePodUpdate(key, resourceVersionOnly, doubledMem)
+	podWatch.enqueuePodUpdate(key, doubledMem, running)
+	podWatch.enqueuePodUpdate(key, running, limited)
+	podWatch.enqueuePodUpdate(key, limited, limitedResourceVersionOnly)
+	defer runPodWorker(podWatch)()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected firmament to receive the updated tasks")
+	}
+	// Let the worker process the remaining updates.
+	time.Sleep(200 * time.Millisecond)
+	if !reflect.DeepEqual(ramCaps, []uint64{2048000, 2048000}) {
+		t.Errorf("expected the updated memory requests [2048000 2048000] got %v", ramCaps)
+	}
+	if !reflect.DeepEqual(cpuLimits, []string{"2000", "4000"}) {
+		t.Errorf("expected the updated cpu limits [2000 4000] got %v", cpuLimits)
+	}
+	podWatch.podWorkQueue.ShutDown()
+}
+
+// TestPodWatcher_getFirmamentLabelSelectors checks that node selectors and required node affinity
+// are converted to firmament label selectors.
+func TestPodWatcher_getFirmamentLabelSelectors(t *testing.T) {
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+
+	var testData = []struct {
+		nodeSelector map[string]string
+		terms        []NodeSelectorTerm
+		expected     []*firmament.LabelSelector
+	}{
+		{
+			nodeSelector: map[string]string{"disk": "ssd"},
+			terms: []NodeSelectorTerm{
+				{
+					MatchExpressions: []NodeSelectorRequirement{
+						{Key: "zone", Operator: "In", Values: []string{"a", "b"}},
+						{Key: "mem-type", Operator: "NotIn", Values: []string{"DDR"}},
+						{Key: "gpu", Operator: "Exists"},
+					},
+				},
+			},
+			expected: []*firmament.LabelSelector{
+				{Type: firmament.LabelSelector_IN_SET, Key: "disk", Values: []string{"ssd"}},
+				{Type: firmament.LabelSelector_IN_SET, Key: "zone", Values: []string{"a", "b"}},
+				{Type: firmament.LabelSelector_NOT_IN_SET, Key: "mem-type", Values: []string{"DDR"}},
+				{Type: firmament.LabelSelector_EXISTS_KEY, Key: "gpu"},
+			},
+		},
+		{
+			terms: []NodeSelectorTerm{
+				{
+					MatchExpressions: []NodeSelectorRequirement{
+						{Key: "cores", Operator: "Gt", Values: []string{"4"}},
+						{Key: "cores", Operator: "Lt", Values: []string{"many"}},
+					},
+				},
+			},
+			expected: []*firmament.LabelSelector{
+				{Type: firmament.LabelSelector_GREATER_THAN, Key: "cores", Values: []string{"4"}},
+			},
+		},
+		{
+			// Terms are ORed, so they can not be expressed as label selectors.
+			terms: []NodeSelectorTerm{
+				{MatchExpressions: []NodeSelectorRequirement{{Key: "zone", Operator: "In", Values: []string{"a"}}}},
+				{MatchExpressions: []NodeSelectorRequirement{{Key: "zone", Operator: "In", Values: []string{"b"}}}},
+			},
+			expected: nil,
+		},
+	}
+
+	for _, data := range testData {
+		pod := &Pod{
+			NodeSelector: data.nodeSelector,
+			Affinity: &Affinity{
+				NodeAffinity: &NodeAffinity{
+					HardScheduling: &NodeSelector{NodeSelectorTerms: data.terms},
+				},
+			},
+		}
+		labelSelectors := podWatch.getFirmamentLabelSelectors(pod)
+		if !reflect.DeepEqual(data.expected, labelSelectors) {
+			t.Error("expected ", data.expected, "got ", labelSelectors)
+		}
+	}
+}
+
+// TestPodWatcher_getPodPriority checks that pods of differing priority are submitted with differing task priorities,
+// and that the priority of a pod is resolved from its PriorityClass when it is not set.
+func TestPodWatcher_getPodPriority(t *testing.T) {
+	var empty map[string]string
+	fakeNow := metav1.Now()
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	kubeClient := fake.NewSimpleClientset(&schedulingv1beta1.PriorityClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "critical"},
+		Value:      100000,
+	})
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, kubeClient, testObj.fc)
+
+	lowPriority := int32(10)
+	lowPod := BuildPod("Poseidon-Namespace", "low", empty, GetPodPhase("Pending"), "2", "1024", &fakeNow, "owner")
+	lowPod.Spec.Priority = &lowPriority
+	criticalPod := BuildPod("Poseidon-Namespace", "critical", empty, GetPodPhase("Pending"), "2", "1024", &fakeNow, "owner")
+	criticalPod.Spec.PriorityClassName = "critical"
+	unknownPod := BuildPod("Poseidon-Namespace", "unknown", empty, GetPodPhase("Pending"), "2", "1024", &fakeNow, "owner")
+	unknownPod.Spec.PriorityClassName = "missing"
+
+	var testData = []struct {
+		pod      *v1.Pod
+		expected uint32
+	}{
+		{pod: lowPod, expected: 10},
+		{pod: criticalPod, expected: 100000},
+		{pod: unknownPod, expected: 0},
+	}
+
+	for i, data := range testData {
+		td := podWatch.addTaskToJob(podWatch.parsePod(data.pod), "job-uuid", "job", i+1)
+		if td.GetPriority() != data.expected {
+			t.Errorf("pod %s: expected task priority %d got %d", data.pod.Name, data.expected, td.GetPriority())
+		}
+	}
+}
+
+// TestPodWatcher_qosPriority checks that the base priority of the QoS class is added to the priority of the pod.
+func TestPodWatcher_qosPriority(t *testing.T) {
+	var empty map[string]string
+	fakeNow := metav1.Now()
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	kubeClient := fake.NewSimpleClientset(&schedulingv1beta1.PriorityClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "critical"},
+		Value:      100000,
+	})
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, kubeClient, testObj.fc)
+	podWatch.qosPriorities = map[v1.PodQOSClass]int32{
+		v1.PodQOSGuaranteed: 1000,
+		v1.PodQOSBurstable:  500,
+		v1.PodQOSBestEffort: 0,
+	}
+
+	guaranteedPod := BuildPod("Poseidon-Namespace", "guaranteed", empty, GetPodPhase("Pending"), "2", "1024", &fakeNow, "owner")
+	guaranteedPod.Spec.Containers[0].Resources.Limits = guaranteedPod.Spec.Containers[0].Resources.Requests
+	burstablePod := BuildPod("Poseidon-Namespace", "burstable", empty, GetPodPhase("Pending"), "2", "1024", &fakeNow, "owner")
+	bestEffortPod := BuildPod("Poseidon-Namespace", "besteffort", empty, GetPodPhase("Pending"), "2", "1024", &fakeNow, "owner")
+	bestEffortPod.Spec.Containers[0].Resources = v1.ResourceRequirements{}
+	criticalPod := BuildPod("Poseidon-Namespace", "critical", empty, GetPodPhase("Pending"), "2", "1024", &fakeNow, "owner")
+	criticalPod.Spec.Containers[0].Resources.Limits = criticalPod.Spec.Containers[0].Resources.Requests
+	criticalPod.Spec.PriorityClassName = "critical"
+
+	var testData = []struct {
+		pod         *v1.Pod
+		expected    uint32
+		expectedQoS string
+	}{
+		{pod: guaranteedPod, expected: 1000, expectedQoS: "1000"},
+		{pod: burstablePod, expected: 500, expectedQoS: "500"},
+		{pod: bestEffortPod, expected: 0, expectedQoS: ""},
+		{pod: criticalPod, expected: 101000, expectedQoS: "1000"},
+	}
+
+	for i, data := range testData {
+		td := podWatch.addTaskToJob(podWatch.parsePod(data.pod), "job-uuid", "job", i+1)
+		if td.GetPriority() != data.expected {
+			t.Errorf("pod %s: expected task priority %d got %d", data.pod.Name, data.expected, td.GetPriority())
+		}
+		qosPriority := ""
+		for _, label := range td.GetLabels() {
+			if label.GetKey() == QoSPriorityLabel {
+				qosPriority = label.GetValue()
+			}
+		}
+		if qosPriority != data.expectedQoS {
+			t.Errorf("pod %s: expected %s label %q got %q", data.pod.Name, QoSPriorityLabel, data.expectedQoS, qosPriority)
+		}
+	}
+}
+
+// TestPodWatcher_getCPUMemEphemeralRequest checks that the request of a pod is the larger of the sum of its
+// container requests and the largest init container request, per resource.
+func TestPodWatcher_getCPUMemEphemeralRequest(t *testing.T) {
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+
+	requests := func(cpu, mem string) v1.ResourceRequirements {
+		return v1.ResourceRequirements{
+			Requests: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse(cpu),
+				v1.ResourceMemory: resource.MustParse(mem),
+			},
+		}
+	}
+	limitsOnly := v1.ResourceRequirements{
+		Limits: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("8"),
+			v1.ResourceMemory: resource.MustParse("8Ki"),
+		},
+	}
+
+	var testData = []struct {
+		name           string
+		containers     []v1.ResourceRequirements
+		initContainers []v1.ResourceRequirements
+		expectedCPU    int64
+		expectedMem    int64
+	}{
+		{
+			name:        "containers only",
+			containers:  []v1.ResourceRequirements{requests("1", "1Ki"), requests("500m", "2Ki")},
+			expectedCPU: 1500,
+			expectedMem: 3072000,
+		},
+		{
+			name:           "containers dominate",
+			containers:     []v1.ResourceRequirements{requests("1", "1Ki"), requests("1", "2Ki")},
+			initContainers: []v1.ResourceRequirements{requests("1500m", "1Ki")},
+			expectedCPU:    2000,
+			expectedMem:    3072000,
+		},
+		{
+			name:           "init container dominates",
+			containers:     []v1.ResourceRequirements{requests("1", "1Ki")},
+			initContainers: []v1.ResourceRequirements{requests("500m", "1Ki"), requests("4", "2Ki")},
+			expectedCPU:    4000,
+			expectedMem:    2048000,
+		},
+		{
+			name:           "mixed per resource",
+			containers:     []v1.ResourceRequirements{requests("1", "4Ki")},
+			initContainers: []v1.ResourceRequirements{requests("2", "1Ki")},
+			expectedCPU:    2000,
+			expectedMem:    4096000,
+		},
+		{
+			name:           "init container with limits but no requests",
+			containers:     []v1.ResourceRequirements{requests("1", "1Ki")},
+			initContainers: []v1.ResourceRequirements{limitsOnly},
+			expectedCPU:    1000,
+			expectedMem:    1024000,
+		},
+		{
+			name:           "init containers only",
+			initContainers: []v1.ResourceRequirements{requests("1", "1Ki"), requests("2", "1Ki")},
+			expectedCPU:    2000,
+			expectedMem:    1024000,
+		},
+	}
+
+	for _, data := range testData {
+		pod := &v1.Pod{}
+		for _, resources := range data.containers {
+			pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Resources: resources})
+		}
+		for _, resources := range data.initContainers {
+			pod.Spec.InitContainers = append(pod.Spec.InitContainers, v1.Container{Resources: resources})
+		}
+		cpu, mem, _ := podWatch.getCPUMemEphemeralRequest(pod)
+		if cpu != data.expectedCPU || mem != data.expectedMem {
+			t.Errorf("%s: expected cpu %d mem %d got cpu %d mem %d", data.name, data.expectedCPU, data.expectedMem, cpu, mem)
+		}
+	}
+}
+
+// TestPodWatcher_QOSClass checks the resource request, the resource limits and the QoS class submitted
+// to firmament for pods of the three QoS classes.
+func TestPodWatcher_QOSClass(t *testing.T) {
+	resources := func(cpuReq, memReq, cpuLimit, memLimit string) v1.ResourceRequirements {
+		requirements := v1.ResourceRequirements{Requests: v1.ResourceList{}, Limits: v1.ResourceList{}}
+		if cpuReq != "" {
+			requirements.Requests[v1.ResourceCPU] = resource.MustParse(cpuReq)
+			requirements.Requests[v1.ResourceMemory] = resource.MustParse(memReq)
+		}
+		if cpuLimit != "" {
+			requirements.Limits[v1.ResourceCPU] = resource.MustParse(cpuLimit)
+			requirements.Limits[v1.ResourceMemory] = resource.MustParse(memLimit)
+		}
+		return requirements
+	}
+
+	var testData = []struct {
+		name           string
+		resources      v1.ResourceRequirements
+		expectedReq    *firmament.ResourceVector
+		expectedLabels map[string]string
+	}{
+		{
+			name:        "guaranteed",
+			resources:   resources("1", "1Ki", "1", "1Ki"),
+			expectedReq: &firmament.ResourceVector{CpuCores: 1000, RamCap: 1024000},
+			expectedLabels: map[string]string{
+				QoSClassLabel:       "Guaranteed",
+				CPULimitLabel:       "1000",
+				MemLimitLabel:       "1024000",
+				EphemeralLimitLabel: "0",
+			},
+		},
+		{
+			name:        "burstable",
+			resources:   resources("500m", "1Ki", "2", "4Ki"),
+			expectedReq: &firmament.ResourceVector{CpuCores: 500, RamCap: 1024000},
+			expectedLabels: map[string]string{
+				QoSClassLabel:       "Burstable",
+				CPULimitLabel:       "2000",
+				MemLimitLabel:       "4096000",
+				EphemeralLimitLabel: "0",
+			},
+		},
+		{
+			name:        "burstable-limits-only",
+			resources:   resources("", "", "2", "4Ki"),
+			expectedReq: &firmament.ResourceVector{},
+			expectedLabels: map[string]string{
+				QoSClassLabel:       "Burstable",
+				CPULimitLabel:       "2000",
+				MemLimitLabel:       "4096000",
+				EphemeralLimitLabel: "0",
+			},
+		},
+		{
+			name:        "besteffort",
+			resources:   resources("", "", "", ""),
+			expectedReq: &firmament.ResourceVector{},
+			expectedLabels: map[string]string{
+				QoSClassLabel:       "BestEffort",
+				CPULimitLabel:       "0",
+				MemLimitLabel:       "0",
+				EphemeralLimitLabel: "0",
+			},
+		},
+	}
+
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	submitted := make(chan *firmament.TaskDescription)
+	testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Do(
+		func(_ interface{}, td *firmament.TaskDescription) {
+			submitted <- td
+		}).Return(&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil).Times(len(testData))
+	defer runPodWorker(podWatch)()
+
+	var empty map[string]string
+	for _, data := range testData {
+		pod := BuildPod("Poseidon-Namespace", data.name, empty, GetPodPhase("Pending"), "0", "0", nil, data.name)
+		pod.Spec.Containers[0].Resources = data.resources
+		podWatch.enqueuePodAddition(GetKey(pod, t), pod)
+
+		waitTimer := time.NewTimer(time.Second * 2)
+		select {
+		case <-waitTimer.C:
+			t.Fatalf("%s: expected the task to be submitted", data.name)
+		case td := <-submitted:
+			if !reflect.DeepEqual(data.expectedReq, td.TaskDescriptor.GetResourceRequest()) {
+				t.Errorf("%s: expected request %v got %v", data.name, data.expectedReq, td.TaskDescriptor.GetResourceRequest())
+			}
+			labels := make(map[string]string)
+			for _, label := range td.TaskDescriptor.GetLabels() {
+				labels[label.Key] = label.Value
+			}
+			if !reflect.DeepEqual(data.expectedLabels, labels) {
+				t.Errorf("%s: expected labels %v got %v", data.name, data.expectedLabels, labels)
+			}
+		}
+	}
+}
+
+// TestGetPodQOSClass checks that the QoS class is derived from the requests and the limits of the containers and
+// the init containers like Kubernetes does, and that the class reported in the pod status takes precedence.
+func TestGetPodQOSClass(t *testing.T) {
+	list := func(cpu, mem string) v1.ResourceList {
+		resources := v1.ResourceList{}
+		if cpu != "" {
+			resources[v1.ResourceCPU] = resource.MustParse(cpu)
+		}
+		if mem != "" {
+			resources[v1.ResourceMemory] = resource.MustParse(mem)
+		}
+		return resources
+	}
+	guaranteed := v1.ResourceRequirements{Requests: list("1", "1Gi"), Limits: list("1", "1Gi")}
+
+	var testData = []struct {
+		name           string
+		containers     []v1.ResourceRequirements
+		initContainers []v1.ResourceRequirements
+		status         v1.PodQOSClass
+		expected       v1.PodQOSClass
+	}{
+		{
+			name:       "requests equal to the limits",
+			containers: []v1.ResourceRequirements{guaranteed, guaranteed},
+			expected:   v1.PodQOSGuaranteed,
+		},
+		{
+			name:           "init container requests equal to the limits",
+			containers:     []v1.ResourceRequirements{guaranteed},
+			initContainers: []v1.ResourceRequirements{{Requests: list("500m", "1Gi"), Limits: list("500m", "1Gi")}},
+			expected:       v1.PodQOSGuaranteed,
+		},
+		{
+			name:       "requests below the limits",
+			containers: []v1.ResourceRequirements{{Requests: list("500m", "1Gi"), Limits: list("1", "1Gi")}},
+			expected:   v1.PodQOSBurstable,
+		},
+		{
+			name:       "only the cpu limited",
+			containers: []v1.ResourceRequirements{{Requests: list("1", ""), Limits: list("1", "")}},
+			expected:   v1.PodQOSBurstable,
+		},
+		{
+			name:       "a container without limits",
+			containers: []v1.ResourceRequirements{guaranteed, {Requests: list("1", "1Gi")}},
+			expected:   v1.PodQOSBurstable,
+		},
+		{
+			name:           "an init container without limits",
+			containers:     []v1.ResourceRequirements{guaranteed},
+			initContainers: []v1.ResourceRequirements{{Requests: list("1", "")}},
+			expected:       v1.PodQOSBurstable,
+		},
+		{
+			name:       "no requests nor limits",
+			containers: []v1.ResourceRequirements{{}, {}},
+			expected:   v1.PodQOSBestEffort,
+		},
+		{
+			name:       "zero requests and other resources",
+			containers: []v1.ResourceRequirements{{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("0"), v1.ResourceEphemeralStorage: resource.MustParse("1Gi")}}},
+			expected:   v1.PodQOSBestEffort,
+		},
+		{
+			name:       "class of the pod status",
+			containers: []v1.ResourceRequirements{{}},
+			status:     v1.PodQOSGuaranteed,
+			expected:   v1.PodQOSGuaranteed,
+		},
+	}
+
+	for _, data := range testData {
+		pod := &v1.Pod{Status: v1.PodStatus{QOSClass: data.status}}
+		for _, resources := range data.containers {
+			pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Resources: resources})
+		}
+		for _, resources := range data.initContainers {
+			pod.Spec.InitContainers = append(pod.Spec.InitContainers, v1.Container{Resources: resources})
+		}
+		if class := getPodQOSClass(pod); class != data.expected {
+			t.Errorf("%s: expected the QoS class %s, got %s", data.name, data.expected, class)
+		}
+	}
+}
+
+// TestPodWatcher_defaultRequests checks that the default requests are applied to a BestEffort pod
+// and that a Burstable pod is left untouched.
+func TestPodWatcher_defaultRequests(t *testing.T) {
+	var empty map[string]string
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	podWatch.defaultRequests = v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse("100m"),
+		v1.ResourceMemory: resource.MustParse("200Mi"),
+	}
+
+	bestEffortPod := BuildPod("Poseidon-Namespace", "besteffort", empty, GetPodPhase("Pending"), "0", "0", nil, "owner")
+	bestEffortPod.Spec.Containers[0].Resources = v1.ResourceRequirements{}
+	burstablePod := BuildPod("Poseidon-Namespace", "burstable", empty, GetPodPhase("Pending"), "0", "0", nil, "owner")
+	burstablePod.Spec.Containers[0].Resources = v1.ResourceRequirements{
+		Limits: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")},
+	}
+
+	var testData = []struct {
+		pod           *v1.Pod
+		expectedReq   *firmament.ResourceVector
+		expectedLabel string
+	}{
+		{
+			pod:           bestEffortPod,
+			expectedReq:   &firmament.ResourceVector{CpuCores: 100, RamCap: 209715200000},
+			expectedLabel: "cpu=100m,memory=200Mi",
+		},
+		{
+			pod:         burstablePod,
+			expectedReq: &firmament.ResourceVector{},
+		},
+	}
+
+	for i, data := range testData {
+		td := podWatch.addTaskToJob(podWatch.parsePod(data.pod), "job-uuid", "job", i+1)
+		if !reflect.DeepEqual(data.expectedReq, td.GetResourceRequest()) {
+			t.Errorf("pod %s: expected request %v got %v", data.pod.Name, data.expectedReq, td.GetResourceRequest())
+		}
+		label := ""
+		for _, l := range td.GetLabels() {
+			if l.Key == DefaultRequestLabel {
+				label = l.Value
+			}
+		}
+		if label != data.expectedLabel {
+			t.Errorf("pod %s: expected %s label %q got %q", data.pod.Name, DefaultRequestLabel, data.expectedLabel, label)
+		}
+	}
+	if len(bestEffortPod.Spec.Containers[0].Resources.Requests) != 0 {
+		t.Error("expected the watched pod not to be modified, got requests ", bestEffortPod.Spec.Containers[0].Resources.Requests)
+	}
+}
+
+// TestPodWatcher_schedulerNames checks that the pods of every serviced scheduler name are scheduled with
+// their scheduler name as task label, and that pods of the default scheduler are ignored.
+func TestPodWatcher_schedulerNames(t *testing.T) {
+	var empty map[string]string
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{"poseidon", "poseidon-batch"}, testObj.kubeClient, testObj.fc)
+
+	schedulerNames := map[string]string{
+		"service-pod": "poseidon",
+		"batch-pod":   "poseidon-batch",
+		"default-pod": "default-scheduler",
+	}
+	for podName, schedulerName := range schedulerNames {
+		pod := BuildPod("Poseidon-Namespace", podName, empty, GetPodPhase("Pending"), "2", "1024", nil, podName)
+		pod.Spec.SchedulerName = schedulerName
+		podWatch.enqueuePodAddition(GetKey(pod, t), pod)
+	}
+	// A pod moving to the default scheduler is removed from poseidon.
+	movedPod := BuildPod("Poseidon-Namespace", "moved-pod", empty, GetPodPhase("Pending"), "2", "1024", nil, "moved-pod")
+	movedPod.Spec.SchedulerName = "poseidon-batch"
+	recreatedPod := movedPod.DeepCopy()
+	recreatedPod.Spec.SchedulerName = "default-scheduler"
+	podWatch.enqueuePodUpdate(GetKey(movedPod, t), movedPod, recreatedPod)
+	podWatch.podWorkQueue.ShutDown()
+
+	queued := make(map[string]*Pod)
+	for {
+		_, items, shutdown := podWatch.podWorkQueue.Get()
+		if shutdown {
+			break
+		}
+		for _, item := range items {
+			pod := item.(*Pod)
+			queued[pod.Identifier.Name] = pod
+		}
+	}
+	if len(queued) != 3 {
+		t.Fatal("expected 3 queued pods got ", queued)
+	}
+	if _, ok := queued["default-pod"]; ok {
+		t.Error("expected the pod of the default scheduler to be ignored")
+	}
+	if pod, ok := queued["moved-pod"]; !ok || pod.State != PodDeleted {
+		t.Error("expected the pod moved to the default scheduler to be deleted, got ", pod)
+	}
+	for i, podName := range []string{"service-pod", "batch-pod"} {
+		pod, ok := queued[podName]
+		if !ok {
+			t.Errorf("expected pod %s to be queued", podName)
+			continue
+		}
+		td := podWatch.addTaskToJob(pod, "job-uuid", "job", i+1)
+		label := ""
+		for _, l := range td.GetLabels() {
+			if l.Key == SchedulerNameLabel {
+				label = l.Value
+			}
+		}
+		if label != schedulerNames[podName] {
+			t.Errorf("pod %s: expected %s label %q got %q", podName, SchedulerNameLabel, schedulerNames[podName], label)
+		}
+	}
+}
+
+// TestPodWatcher_preferredNodeAffinity checks that the weights of the preferred node affinity terms of a pod are
+// sent to firmament, which lowers the cost of the nodes matching the terms of higher weight, and that a pod with
+// preferred terms only is not constrained to the nodes matching them.
+func TestPodWatcher_preferredNodeAffinity(t *testing.T) {
+	var empty map[string]string
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+
+	preferredTerm := func(weight int32, zone string) v1.PreferredSchedulingTerm {
+		return v1.PreferredSchedulingTerm{
+			Weight: weight,
+			Preference: v1.NodeSelectorTerm{
+				MatchExpressions: []v1.NodeSelectorRequirement{{
+					Key:      "zone",
+					Operator: v1.NodeSelectorOpIn,
+					Values:   []string{zone},
+				}},
+			},
+		}
+	}
+	pod := BuildPod("Poseidon-Namespace", "Pod-preferred", empty, GetPodPhase("Pending"), "1", "1024", nil, "owner-preferred")
+	pod.Spec.Affinity = &v1.Affinity{
+		NodeAffinity: &v1.NodeAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []v1.PreferredSchedulingTerm{
+				preferredTerm(10, "zone-a"),
+				preferredTerm(100, "zone-b"),
+			},
+		},
+	}
+	parsedPod := podWatch.parsePod(pod)
+	td := podWatch.addTaskToJob(parsedPod, "job-uuid", "job", 1)
+
+	nodeAffinity := td.GetAffinity().GetNodeAffinity()
+	if nodeAffinity.GetRequiredDuringSchedulingIgnoredDuringExecution() != nil {
+		t.Errorf("expected no required node selector for preferred terms only, got %v", nodeAffinity.GetRequiredDuringSchedulingIgnoredDuringExecution())
+	}
+	terms := nodeAffinity.GetPreferredDuringSchedulingIgnoredDuringExecution()
+	if len(terms) != 2 {
+		t.Fatalf("expected 2 preferred terms, got %v", terms)
+	}
+	for i, expected := range []struct {
+		weight int32
+		zone   string
+	}{{10, "zone-a"}, {100, "zone-b"}} {
+		expressions := terms[i].GetPreference().GetMatchExpressions()
+		if terms[i].GetWeight() != expected.weight || len(expressions) != 1 || !reflect.DeepEqual(expressions[0].GetValues(), []string{expected.zone}) {
+			t.Errorf("expected the preferred term of weight %d for %s, got %v", expected.weight, expected.zone, terms[i])
+		}
+	}
+
+	// The required terms are kept with the preferred ones, and updated with the pod.
+	pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &v1.NodeSelector{
+		NodeSelectorTerms: []v1.NodeSelectorTerm{preferredTerm(0, "zone-a").Preference},
+	}
+	podWatch.updateTask(podWatch.parsePod(pod), td)
+	nodeAffinity = td.GetAffinity().GetNodeAffinity()
+	if required := nodeAffinity.GetRequiredDuringSchedulingIgnoredDuringExecution().GetNodeSelectorTerms(); len(required) != 1 {
+		t.Errorf("expected the required node selector term, got %v", required)
+	}
+	if terms := nodeAffinity.GetPreferredDuringSchedulingIgnoredDuringExecution(); len(terms) != 2 {
+		t.Errorf("expected 2 preferred terms, got %v", terms)
+	}
+}
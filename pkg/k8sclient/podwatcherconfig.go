@@ -0,0 +1,138 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"k8s.io/api/core/v1"
+)
+
+// PodWatcherConfig holds the tunables of the PodWatcher.
+type PodWatcherConfig struct {
+	// Workers is the number of pod workers, per namespace with NamespaceQueues, AutoWorkers scales them with the
+	// number of CPUs up to MaxWorkers.
+	Workers    int
+	MaxWorkers int
+	// WorkerRestartPeriod in milliseconds and WorkerRestartJitter restart the workers which returned, see
+	// getWorkerRestart.
+	WorkerRestartPeriod int
+	WorkerRestartJitter float64
+	// DefaultCPURequest and DefaultMemRequest are applied to the containers of the BestEffort pods, they are
+	// not applied when empty.
+	DefaultCPURequest string
+	DefaultMemRequest string
+	// QoSPriorities holds the base priorities of the QoS classes, added to the task priorities of the pods.
+	QoSPriorities map[v1.PodQOSClass]int32
+	// NamespaceAllowlist restricts the namespaces whose pods are handled, all when empty, the pods of the
+	// namespaces of NamespaceDenylist are ignored.
+	NamespaceAllowlist []string
+	NamespaceDenylist  []string
+	// NamespaceQueues processes the pods of every namespace with a work queue and workers of its own.
+	NamespaceQueues bool
+	// MemoryUnit is the unit of the memory requests and limits sent to firmament.
+	MemoryUnit MemoryUnit
+	// DefaultBehaviour watches the pods of every scheduler name.
+	DefaultBehaviour bool
+	// BatchWindow is the time the tasks are accumulated before they are submitted together, 0 disables the
+	// batching, MaxBatchSize submits a full batch without waiting for the window.
+	BatchWindow  time.Duration
+	MaxBatchSize int
+	// FailureLogInterval is the time between the logs of the repeated failures of a task, 0 logs every failure.
+	FailureLogInterval time.Duration
+	// WatchStaleness is the time without pod event after which a pod informer is re-created, 0 disables the
+	// watchdog, see watchdogInformer.
+	WatchStaleness time.Duration
+	// QueueRetry is the backoff of the pod changes firmament failed to process, and the number of retries after which
+	// they are dropped.
+	QueueRetry QueueRetryPolicy
+}
+
+// DefaultPodWatcherConfig returns the PodWatcher configuration read from the command line flags and the config file.
+func DefaultPodWatcherConfig() PodWatcherConfig {
+	return NewPodWatcherConfig(config.GetConfig())
+}
+
+// NewPodWatcherConfig returns the PodWatcher configuration of the poseidon options in cfg.
+func NewPodWatcherConfig(cfg *config.Config) PodWatcherConfig {
+	return PodWatcherConfig{
+		Workers:             config.WorkersOrDefault(cfg.PodWorkers, cfg.Workers),
+		MaxWorkers:          cfg.MaxWorkers,
+		WorkerRestartPeriod: cfg.RestartPeriod,
+		WorkerRestartJitter: cfg.RestartJitter,
+		DefaultCPURequest:   cfg.DefaultCPURequest,
+		DefaultMemRequest:   cfg.DefaultMemRequest,
+		QoSPriorities:       getQoSPriorities(cfg),
+		NamespaceAllowlist:  config.SplitList(cfg.NamespaceAllow),
+		NamespaceDenylist:   config.SplitList(cfg.NamespaceDeny),
+		NamespaceQueues:     cfg.NamespaceQueues,
+		MemoryUnit:          MemoryUnit(cfg.MemoryUnit),
+		DefaultBehaviour:    cfg.DefaultBehaviour,
+		BatchWindow:         time.Duration(cfg.BatchWindow) * time.Millisecond,
+		MaxBatchSize:        cfg.MaxBatchSize,
+		FailureLogInterval:  time.Duration(cfg.FailureLogInterval) * time.Second,
+		WatchStaleness:      time.Duration(cfg.PodWatchStaleness) * time.Second,
+		QueueRetry:          newQueueRetryPolicy(cfg),
+	}
+}
+
+// Validate returns an error describing the first invalid setting of the configuration.
+func (c PodWatcherConfig) Validate() error {
+	if c.MaxWorkers <= 0 {
+		return fmt.Errorf("the maximum number of workers must be greater than 0, got %d", c.MaxWorkers)
+	}
+	if _, err := getWorkerCount(c.Workers, c.MaxWorkers); err != nil {
+		return err
+	}
+	if _, err := getWorkerRestart(c.WorkerRestartPeriod, c.WorkerRestartJitter); err != nil {
+		return err
+	}
+	if _, err := parseDefaultRequests(c.DefaultCPURequest, c.DefaultMemRequest); err != nil {
+		return err
+	}
+	if err := c.MemoryUnit.Validate(); err != nil {
+		return err
+	}
+	if c.BatchWindow < 0 {
+		return fmt.Errorf("the batch window must not be negative, got %v", c.BatchWindow)
+	}
+	if c.BatchWindow > 0 && c.MaxBatchSize < 1 {
+		return fmt.Errorf("the maximum batch size must be at least 1, got %d", c.MaxBatchSize)
+	}
+	if c.FailureLogInterval < 0 {
+		return fmt.Errorf("the failure log interval must not be negative, got %v", c.FailureLogInterval)
+	}
+	if c.WatchStaleness < 0 {
+		return fmt.Errorf("the watch staleness must not be negative, got %v", c.WatchStaleness)
+	}
+	if err := c.QueueRetry.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// PodWatcherOption configures a PodWatcher created by NewPodWatcher.
+type PodWatcherOption func(pw *PodWatcher)
+
+// WithPodWatcherConfig replaces the configuration read from the command line flags and the config file.
+func WithPodWatcherConfig(cfg PodWatcherConfig) PodWatcherOption {
+	return func(pw *PodWatcher) {
+		pw.cfg = cfg
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"k8s.io/api/core/v1"
+)
+
+func TestPodWatcherConfig_Validate(t *testing.T) {
+	var testData = []struct {
+		name   string
+		modify func(cfg *PodWatcherConfig)
+		valid  bool
+	}{
+		{name: "default", modify: func(cfg *PodWatcherConfig) {}, valid: true},
+		{name: "default requests", modify: func(cfg *PodWatcherConfig) {
+			cfg.DefaultCPURequest = "100m"
+			cfg.DefaultMemRequest = "200Mi"
+		}, valid: true},
+		{name: "auto workers", modify: func(cfg *PodWatcherConfig) { cfg.Workers = AutoWorkers }, valid: true},
+		{name: "zero workers", modify: func(cfg *PodWatcherConfig) { cfg.Workers = 0 }, valid: false},
+		{name: "negative retry base delay", modify: func(cfg *PodWatcherConfig) { cfg.QueueRetry.BaseDelay = -time.Millisecond }, valid: false},
+		{name: "negative max retries", modify: func(cfg *PodWatcherConfig) { cfg.QueueRetry.MaxRetries = -1 }, valid: false},
+		{name: "zero maximum workers", modify: func(cfg *PodWatcherConfig) { cfg.MaxWorkers = 0 }, valid: false},
+		{name: "zero restart period", modify: func(cfg *PodWatcherConfig) { cfg.WorkerRestartPeriod = 0 }, valid: false},
+		{name: "invalid cpu request", modify: func(cfg *PodWatcherConfig) { cfg.DefaultCPURequest = "a lot" }, valid: false},
+		{name: "negative memory request", modify: func(cfg *PodWatcherConfig) { cfg.DefaultMemRequest = "-1Mi" }, valid: false},
+		{name: "invalid memory unit", modify: func(cfg *PodWatcherConfig) { cfg.MemoryUnit = "GB" }, valid: false},
+		{name: "negative batch window", modify: func(cfg *PodWatcherConfig) { cfg.BatchWindow = -time.Second }, valid: false},
+		{name: "empty batches", modify: func(cfg *PodWatcherConfig) { cfg.MaxBatchSize = 0 }, valid: false},
+		{name: "watchdog", modify: func(cfg *PodWatcherConfig) { cfg.WatchStaleness = time.Minute }, valid: true},
+		{name: "negative watch staleness", modify: func(cfg *PodWatcherConfig) { cfg.WatchStaleness = -time.Second }, valid: false},
+		{name: "empty batches without batching", modify: func(cfg *PodWatcherConfig) {
+			cfg.BatchWindow = 0
+			cfg.MaxBatchSize = 0
+		}, valid: true},
+	}
+
+	for _, data := range testData {
+		cfg := DefaultPodWatcherConfig()
+		data.modify(&cfg)
+		if err := cfg.Validate(); (err == nil) != data.valid {
+			t.Errorf("%s: expected valid %v, got err %v", data.name, data.valid, err)
+		}
+	}
+}
+
+// TestNewPodWatcherConfig checks that the pod watcher is configured by the poseidon options it is given rather
+// than by the command line flags.
+func TestNewPodWatcherConfig(t *testing.T) {
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	cfg := config.DefaultConfig()
+	cfg.NamespaceAllow = "team-a, team-b"
+	cfg.DefaultCPURequest = "100m"
+	cfg.QoSBestEffort = -10
+	cfg.MemoryUnit = string(MemoryUnitMiB)
+	cfg.BatchWindow = 0
+	cfg.PodWorkers = 24
+
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc,
+		WithPodWatcherConfig(NewPodWatcherConfig(&cfg)))
+	if expected := []string{"team-a", "team-b"}; !reflect.DeepEqual(podWatch.cfg.NamespaceAllowlist, expected) {
+		t.Errorf("expected the namespace allowlist %v, got %v", expected, podWatch.cfg.NamespaceAllowlist)
+	}
+	if !podWatch.namespaces.handles("team-a") || podWatch.namespaces.handles("team-c") {
+		t.Errorf("expected only the allowed namespaces to be watched, got %v", podWatch.namespaces)
+	}
+	if request := podWatch.defaultRequests[v1.ResourceCPU]; request.MilliValue() != 100 {
+		t.Errorf("expected a default cpu request of 100m, got %v", podWatch.defaultRequests)
+	}
+	if priority := podWatch.qosPriorities[v1.PodQOSBestEffort]; priority != -10 {
+		t.Errorf("expected a BestEffort priority of -10, got %d", priority)
+	}
+	if podWatch.memoryUnit != MemoryUnitMiB {
+		t.Errorf("expected the memory unit %s, got %s", MemoryUnitMiB, podWatch.memoryUnit)
+	}
+	if podWatch.cfg.BatchWindow != 0 {
+		t.Errorf("expected the batching to be disabled, got a window of %v", podWatch.cfg.BatchWindow)
+	}
+	if podWatch.cfg.Workers != 24 {
+		t.Errorf("expected 24 pod workers, got %d", podWatch.cfg.Workers)
+	}
+	// The pod workers default to the workers of --workers.
+	cfg.PodWorkers = 0
+	if workers := NewPodWatcherConfig(&cfg).Workers; workers != cfg.Workers {
+		t.Errorf("expected the %d workers of --workers, got %d", cfg.Workers, workers)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+)
+
+// MirrorPodAnnotation is set by the kubelet on the mirror pods of the static pods it runs.
+const MirrorPodAnnotation = "kubernetes.io/config.mirror"
+
+// preassignedPod holds the requests of a pod placed onto a node without poseidon.
+type preassignedPod struct {
+	nodeName       string
+	cpuRequest     int64
+	memRequestKb   int64
+	ephemeralReqKb int64
+}
+
+// preassignedPods maps the DaemonSet, static and mirror pods to their requests, which are
+// reserved on the resources of their nodes advertised to firmament. It is guarded by NodeMux.
+var preassignedPods map[PodIdentifier]*preassignedPod
+
+// isPreassignedPod checks if the pod is placed onto a node without being scheduled,
+// i.e. it arrives with spec.nodeName set or it is the mirror pod of a static pod.
+func isPreassignedPod(pod *v1.Pod) bool {
+	if _, ok := pod.Annotations[MirrorPodAnnotation]; ok {
+		return true
+	}
+	return len(pod.Spec.NodeName) > 0
+}
+
+// reservePreassignedPod reduces the available resources of the node of the pod by its requests.
+// The requests of pods whose node is not known yet are reserved once the node is added.
+func reservePreassignedPod(fc firmament.Client, pod *Pod) {
+	NodeMux.Lock()
+	if _, ok := preassignedPods[pod.Identifier]; ok {
+		NodeMux.Unlock()
+		glog.V(2).Infof("Preassigned pod %v is already accounted", pod.Identifier)
+		return
+	}
+	preassigned := &preassignedPod{
+		nodeName:       pod.NodeName,
+		cpuRequest:     pod.CPURequest,
+		memRequestKb:   pod.MemRequestKb,
+		ephemeralReqKb: pod.EphemeralReqKb,
+	}
+	preassignedPods[pod.Identifier] = preassigned
+	rtnd, ok := NodeToRTND[preassigned.nodeName]
+	if ok {
+		reserveResources(rtnd.GetResourceDesc(), preassigned, 1)
+	}
+	NodeMux.Unlock()
+	recordHostPorts(pod.Identifier, pod.NodeName, pod.HostPorts)
+	if !ok {
+		glog.V(2).Infof("Node %s of preassigned pod %v does not exist yet", preassigned.nodeName, pod.Identifier)
+		return
+	}
+	fc.NodeUpdated(context.Background(), rtnd)
+}
+
+// releasePreassignedPod gives the requests of a deleted or terminated preassigned pod back to its node.
+// It returns false if the pod is not a preassigned pod.
+func releasePreassignedPod(fc firmament.Client, podIdentifier PodIdentifier) bool {
+	NodeMux.Lock()
+	preassigned, ok := preassignedPods[podIdentifier]
+	if !ok {
+		NodeMux.Unlock()
+		return false
+	}
+	delete(preassignedPods, podIdentifier)
+	rtnd, nodeOk := NodeToRTND[preassigned.nodeName]
+	if nodeOk {
+		reserveResources(rtnd.GetResourceDesc(), preassigned, -1)
+	}
+	NodeMux.Unlock()
+	releaseHostPorts(podIdentifier)
+	if nodeOk {
+		fc.NodeUpdated(context.Background(), rtnd)
+	}
+	return true
+}
+
+// reservePreassignedPodsOnNode reserves the requests of the preassigned pods which arrived before their node.
+// It is called with NodeMux held.
+func reservePreassignedPodsOnNode(nodeName string, rd *firmament.ResourceDescriptor) {
+	for _, preassigned := range preassignedPods {
+		if preassigned.nodeName == nodeName {
+			reserveResources(rd, preassigned, 1)
+		}
+	}
+}
+
+// reserveResources moves the requests of the pod from the available to the reserved resources of
+// the node when sign is 1, and back when sign is -1.
+func reserveResources(rd *firmament.ResourceDescriptor, preassigned *preassignedPod, sign int64) {
+	available, reserved := rd.GetAvailableResources(), rd.GetReservedResources()
+	if available == nil || reserved == nil {
+		return
+	}
+	cpu := float32(sign * preassigned.cpuRequest)
+	if cpu > available.CpuCores {
+		cpu = available.CpuCores
+	} else if -cpu > reserved.CpuCores {
+		cpu = -reserved.CpuCores
+	}
+	available.CpuCores -= cpu
+	reserved.CpuCores += cpu
+	available.RamCap, reserved.RamCap = moveCapacity(available.RamCap, reserved.RamCap, sign*preassigned.memRequestKb)
+	available.EphemeralCap, reserved.EphemeralCap = moveCapacity(available.EphemeralCap, reserved.EphemeralCap, sign*preassigned.ephemeralReqKb)
+}
+
+// moveCapacity moves the quantity from the available to the reserved capacity without underflowing either.
+func moveCapacity(available, reserved uint64, quantity int64) (uint64, uint64) {
+	if quantity < 0 {
+		reserved, available = moveCapacity(reserved, available, -quantity)
+		return available, reserved
+	}
+	if uint64(quantity) > available {
+		quantity = int64(available)
+	}
+	return available - uint64(quantity), reserved + uint64(quantity)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIsPreassignedPod(t *testing.T) {
+	var empty map[string]string
+	pending := BuildPod("Poseidon-Namespace", "pending", empty, v1.PodPending, "1", "1024", nil, "owner")
+	daemon := BuildPod("Poseidon-Namespace", "daemon", empty, v1.PodPending, "1", "1024", nil, "owner")
+	daemon.Spec.NodeName = "node0"
+	mirror := BuildPod("Poseidon-Namespace", "mirror", empty, v1.PodRunning, "1", "1024", nil, "owner")
+	mirror.Annotations = map[string]string{MirrorPodAnnotation: "checksum"}
+
+	var testData = []struct {
+		pod      *v1.Pod
+		expected bool
+	}{
+		{pod: pending, expected: false},
+		{pod: daemon, expected: true},
+		{pod: mirror, expected: true},
+	}
+
+	for _, data := range testData {
+		if got := isPreassignedPod(data.pod); got != data.expected {
+			t.Errorf("pod %s: expected %v got %v", data.pod.Name, data.expected, got)
+		}
+	}
+}
+
+// TestPreassignedPods covers a daemonset-like pod on every node: the pods are not submitted to firmament,
+// the advertised free capacity of each node is reduced by the requests of its pod and given back on deletion.
+func TestPreassignedPods(t *testing.T) {
+	var empty map[string]string
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	preassignedPods = make(map[PodIdentifier]*preassignedPod)
+	// No task is submitted for the preassigned pods.
+	testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+		&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil).Times(3)
+	testObj.firmamentClient.EXPECT().NodeUpdated(gomock.Any(), gomock.Any()).Return(
+		&firmament.NodeUpdatedResponse{Type: firmament.NodeReplyType_NODE_UPDATED_OK}, nil).Times(3)
+
+	addNode := func(name string) {
+		k8sNode := BuildNode(name, "4", "8Gi", nil, nil, false)
+		k8sNode.Status.Allocatable = v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("4"),
+			v1.ResourceMemory: resource.MustParse("8Gi"),
+		}
+		node, err := nodeWatch.parseNode(k8sNode, NodeAdded)
+		if err != nil {
+			t.Fatal("error parsing node ", err)
+		}
+		nodeWatch.processNodes(context.Background(), []interface{}{node})
+	}
+	processPods := func() {
+		podWatch.podWorkQueue.ShutDown()
+		podWatch.podWorker()
+		podWatch.podWorkQueue = NewKeyedQueue()
+	}
+	checkAvailable := func(name string, expectedCPU float32, expectedMem uint64) {
+		NodeMux.RLock()
+		defer NodeMux.RUnlock()
+		available := NodeToRTND[name].GetResourceDesc().GetAvailableResources()
+		if available.GetCpuCores() != expectedCPU || available.GetRamCap() != expectedMem {
+			t.Errorf("node %s: expected available cpu %v mem %v, got cpu %v mem %v", name, expectedCPU, expectedMem,
+				available.GetCpuCores(), available.GetRamCap())
+		}
+	}
+	nodeMemQuantity, podMemQuantity := resource.MustParse("8Gi"), resource.MustParse("512Mi")
+	nodeMem, podMem := uint64(nodeMemQuantity.MilliValue()), uint64(podMemQuantity.MilliValue())
+
+	var pods []*v1.Pod
+	for i := 0; i < 2; i++ {
+		addNode(fmt.Sprintf("node%d", i))
+		pod := BuildPod("Poseidon-Namespace", fmt.Sprintf("daemon-node%d", i), empty, v1.PodPending, "500m", "512Mi", nil, "daemon-owner")
+		pod.Spec.NodeName = fmt.Sprintf("node%d", i)
+		pods = append(pods, pod)
+	}
+	// The mirror pod of a static pod arrives before its node.
+	mirror := BuildPod("Poseidon-Namespace", "mirror-node2", empty, v1.PodRunning, "500m", "512Mi", nil, "")
+	mirror.Spec.NodeName = "node2"
+	mirror.Annotations = map[string]string{MirrorPodAnnotation: "checksum"}
+	pods = append(pods, mirror)
+	for _, pod := range pods {
+		podWatch.enqueuePodAddition(GetKey(pod, t), pod)
+	}
+	processPods()
+	addNode("node2")
+
+	for i := 0; i < 3; i++ {
+		checkAvailable(fmt.Sprintf("node%d", i), 3500, nodeMem-podMem)
+	}
+	PodMux.RLock()
+	if len(PodToTD) != 0 {
+		t.Errorf("expected no task for the preassigned pods, got %v", PodToTD)
+	}
+	PodMux.RUnlock()
+
+	fakeNow := metav1.Now()
+	deletedPod := pods[0].DeepCopy()
+	deletedPod.DeletionTimestamp = &fakeNow
+	podWatch.enqueuePodDeletion(GetKey(deletedPod, t), deletedPod)
+	processPods()
+	checkAvailable("node0", 4000, nodeMem)
+	checkAvailable("node1", 3500, nodeMem-podMem)
+	NodeMux.RLock()
+	if _, ok := preassignedPods[PodIdentifier{Name: "daemon-node0", Namespace: "Poseidon-Namespace"}]; ok {
+		t.Error("expected the deleted preassigned pod to be released")
+	}
+	NodeMux.RUnlock()
+}
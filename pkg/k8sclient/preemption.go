@@ -0,0 +1,207 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"math"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// PreemptionMux is used to guard access to the preemption related maps.
+var PreemptionMux *sync.Mutex
+
+// EvictedTasks maps the task ID of a preempted pod to the node the pod is evicted from.
+var EvictedTasks map[uint64]string
+
+// nodeToVictims maps node name to the preempted pods which are not yet deleted from the node.
+var nodeToVictims map[string]map[PodIdentifier]uint64
+
+// nodeToDeferredBinds maps node name to the bindings waiting for the preempted pods on the node to be deleted.
+var nodeToDeferredBinds map[string][]BindInfo
+
+// nominatedPods maps the pods whose binding is deferred to the node nominated in their status.
+var nominatedPods map[PodIdentifier]string
+
+// getPodTaskPriority converts the priority of a pod, with the base priority of its QoS class added,
+// to a firmament task priority. Negative priorities are mapped to the lowest task priority.
+func getPodTaskPriority(pod *Pod) uint32 {
+	priority := int64(pod.Priority) + int64(pod.QoSPriority)
+	if priority < 0 {
+		return 0
+	}
+	if priority > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(priority)
+}
+
+// EvictPreemptedTask handles a PREEMPT scheduling delta. The pod of the preempted task is deleted
+// gracefully and its task is marked as evicted. Pods placed onto the node the victim runs on are
+// not bound until the deletion of the victim is observed.
+func EvictPreemptedTask(delta *firmament.SchedulingDelta) {
+	PodMux.RLock()
+	podIdentifier, ok := TaskIDToPod[delta.GetTaskId()]
+	PodMux.RUnlock()
+	if !ok {
+		skipUnknownTaskDelta(delta)
+		return
+	}
+	NodeMux.RLock()
+	nodeName, ok := ResIDToNode[delta.GetResourceId()]
+	NodeMux.RUnlock()
+	if !ok {
+		glog.Errorf("Preempted task %d on resource %s without node pairing", delta.GetTaskId(), delta.GetResourceId())
+		return
+	}
+	PreemptionMux.Lock()
+	if _, ok := EvictedTasks[delta.GetTaskId()]; ok {
+		PreemptionMux.Unlock()
+		glog.V(2).Infof("Task %d of pod %v is already evicted", delta.GetTaskId(), podIdentifier)
+		return
+	}
+	EvictedTasks[delta.GetTaskId()] = nodeName
+	if _, ok := nodeToVictims[nodeName]; !ok {
+		nodeToVictims[nodeName] = make(map[PodIdentifier]uint64)
+	}
+	nodeToVictims[nodeName][podIdentifier] = delta.GetTaskId()
+	metrics.PreemptionVictims.Inc()
+	PreemptionMux.Unlock()
+
+	glog.Infof("Evicting preempted pod %v from node %s", podIdentifier, nodeName)
+	NewPoseidonEvents(ClientSet).RecordPodEvent(podIdentifier, v1.EventTypeWarning, "Preempted", "Preempted by firmament, evicting the pod from node %s", nodeName)
+	err := ClientSet.CoreV1().Pods(podIdentifier.Namespace).Delete(podIdentifier.Name, &metav1.DeleteOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			releasePreemptionVictim(podIdentifier)
+			return
+		}
+		glog.Errorf("Could not evict preempted pod %v from node %s, err: %v", podIdentifier, nodeName, err)
+	}
+}
+
+// QueueBind sends the binding to the bind workers. Bindings onto a node which still runs
+// preempted pods are deferred until the preempted pods are deleted, the node is nominated in the
+// status of the pod meanwhile so that other schedulers and the autoscaler do not act on the freed capacity.
+// Pods which are bound at once are not nominated.
+func QueueBind(bindInfo BindInfo) {
+	podIdentifier := PodIdentifier{Name: bindInfo.Name, Namespace: bindInfo.Namespace}
+	PreemptionMux.Lock()
+	// The pod may have been placed onto another node while its binding was deferred.
+	dropDeferredBindLocked(podIdentifier)
+	if len(nodeToVictims[bindInfo.Nodename]) > 0 {
+		glog.V(2).Infof("Deferring binding of pod %s/%s until preempted pods leave node %s", bindInfo.Namespace, bindInfo.Name, bindInfo.Nodename)
+		nodeToDeferredBinds[bindInfo.Nodename] = append(nodeToDeferredBinds[bindInfo.Nodename], bindInfo)
+		nominate := nominatedPods[podIdentifier] != bindInfo.Nodename
+		nominatedPods[podIdentifier] = bindInfo.Nodename
+		PreemptionMux.Unlock()
+		if nominate {
+			if err := setNominatedNodeName(ClientSet, podIdentifier, bindInfo.Nodename); err != nil {
+				glog.Errorf("Could not nominate node %s for pod %v, err: %v", bindInfo.Nodename, podIdentifier, err)
+			}
+		}
+		return
+	}
+	PreemptionMux.Unlock()
+	BindChannel <- bindInfo
+}
+
+func dropDeferredBindLocked(podIdentifier PodIdentifier) {
+	for nodeName, binds := range nodeToDeferredBinds {
+		for i, bindInfo := range binds {
+			if bindInfo.Name == podIdentifier.Name && bindInfo.Namespace == podIdentifier.Namespace {
+				nodeToDeferredBinds[nodeName] = append(binds[:i], binds[i+1:]...)
+				break
+			}
+		}
+		if len(nodeToDeferredBinds[nodeName]) == 0 {
+			delete(nodeToDeferredBinds, nodeName)
+		}
+	}
+}
+
+// clearNominatedNode clears the nominated node of a pod once it is bound or its binding failed.
+func clearNominatedNode(client kubernetes.Interface, podIdentifier PodIdentifier) {
+	PreemptionMux.Lock()
+	_, ok := nominatedPods[podIdentifier]
+	delete(nominatedPods, podIdentifier)
+	PreemptionMux.Unlock()
+	if !ok {
+		return
+	}
+	if err := setNominatedNodeName(client, podIdentifier, ""); err != nil {
+		glog.Errorf("Could not clear the nominated node of pod %v, err: %v", podIdentifier, err)
+	}
+}
+
+// forgetPreemptor drops the deferred binding and the nomination of a deleted pod.
+func forgetPreemptor(podIdentifier PodIdentifier) {
+	PreemptionMux.Lock()
+	defer PreemptionMux.Unlock()
+	dropDeferredBindLocked(podIdentifier)
+	delete(nominatedPods, podIdentifier)
+}
+
+// setNominatedNodeName writes the nominated node in the status of the pod, an empty node name clears it.
+func setNominatedNodeName(client kubernetes.Interface, podIdentifier PodIdentifier, nodeName string) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		pod, err := client.CoreV1().Pods(podIdentifier.Namespace).Get(podIdentifier.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pod.Status.NominatedNodeName == nodeName {
+			return nil
+		}
+		pod.Status.NominatedNodeName = nodeName
+		_, err = client.CoreV1().Pods(podIdentifier.Namespace).UpdateStatus(pod)
+		return err
+	})
+}
+
+// releasePreemptionVictim is called once the deletion of a pod is observed. If the pod was evicted
+// because of preemption, the bindings deferred on its node are released once no victim is left on the node.
+func releasePreemptionVictim(podIdentifier PodIdentifier) {
+	var binds []BindInfo
+	PreemptionMux.Lock()
+	for nodeName, victims := range nodeToVictims {
+		taskID, ok := victims[podIdentifier]
+		if !ok {
+			continue
+		}
+		delete(victims, podIdentifier)
+		delete(EvictedTasks, taskID)
+		metrics.PreemptionVictims.Dec()
+		if len(victims) == 0 {
+			delete(nodeToVictims, nodeName)
+			binds = nodeToDeferredBinds[nodeName]
+			delete(nodeToDeferredBinds, nodeName)
+		}
+		break
+	}
+	PreemptionMux.Unlock()
+	for _, bindInfo := range binds {
+		BindChannel <- bindInfo
+	}
+}
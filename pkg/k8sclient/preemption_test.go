@@ -0,0 +1,196 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+// TestPreemption covers a node saturated by low priority pods: a high priority pod arrives, firmament
+// preempts one of the low priority pods, the victim is evicted and the high priority pod is bound once
+// the deletion of the victim is observed.
+func TestPreemption(t *testing.T) {
+	var empty map[string]string
+	lowPriority := int32(10)
+	highPriority := int32(1000)
+
+	lowPodOne := BuildPod("Poseidon-Namespace", "low-1", empty, v1.PodRunning, "2", "1024", nil, "low-owner")
+	lowPodOne.Spec.Priority = &lowPriority
+	lowPodTwo := BuildPod("Poseidon-Namespace", "low-2", empty, v1.PodRunning, "2", "1024", nil, "low-owner")
+	lowPodTwo.Spec.Priority = &lowPriority
+	highPod := BuildPod("Poseidon-Namespace", "high", empty, v1.PodPending, "2", "1024", nil, "high-owner")
+	highPod.Spec.Priority = &highPriority
+
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	ClientSet = fake.NewSimpleClientset(lowPodOne, lowPodTwo, highPod)
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, ClientSet, testObj.fc)
+	NodeMux = new(sync.RWMutex)
+	ResIDToNode = map[string]string{"node-res-id": "node1"}
+
+	tds := make(map[string]*firmament.TaskDescriptor)
+	for i, pod := range []*v1.Pod{lowPodOne, lowPodTwo, highPod} {
+		parsedPod := podWatch.parsePod(pod)
+		jd := podWatch.createNewJob(parsedPod.OwnerRef)
+		jobIDToJD[jd.Uuid] = jd
+		jobNumTasksToRemove[jd.Uuid]++
+		td := podWatch.addTaskToJob(parsedPod, jd.Uuid, jd.Name, i+1)
+		PodToTD[parsedPod.Identifier] = td
+		TaskIDToPod[td.GetUid()] = parsedPod.Identifier
+		tds[pod.Name] = td
+	}
+	if tds["high"].GetPriority() <= tds["low-1"].GetPriority() {
+		t.Fatalf("expected task priority of the high priority pod %d to be higher than %d", tds["high"].GetPriority(), tds["low-1"].GetPriority())
+	}
+
+	EvictPreemptedTask(&firmament.SchedulingDelta{
+		TaskId:     tds["low-1"].GetUid(),
+		ResourceId: "node-res-id",
+		Type:       firmament.SchedulingDelta_PREEMPT,
+	})
+	PreemptionMux.Lock()
+	if nodeName, ok := EvictedTasks[tds["low-1"].GetUid()]; !ok || nodeName != "node1" {
+		t.Errorf("expected task of pod low-1 to be evicted from node1, got %v %v", nodeName, ok)
+	}
+	PreemptionMux.Unlock()
+	if _, err := ClientSet.CoreV1().Pods("Poseidon-Namespace").Get("low-1", metav1.GetOptions{}); err == nil {
+		t.Error("expected the victim pod low-1 to be deleted")
+	}
+	if _, err := ClientSet.CoreV1().Pods("Poseidon-Namespace").Get("low-2", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected pod low-2 to keep running, err: %v", err)
+	}
+
+	// The preemptor is placed onto the node of the victim, it must not be bound yet.
+	QueueBind(BindInfo{Name: "high", Namespace: "Poseidon-Namespace", Nodename: "node1"})
+	select {
+	case bindInfo := <-BindChannel:
+		t.Fatalf("expected the binding to be deferred, got %v", bindInfo)
+	default:
+	}
+
+	// The deletion of the victim is observed by the pod watcher.
+	testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+		&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil)
+	fakeNow := metav1.Now()
+	deletedPod := lowPodOne.DeepCopy()
+	deletedPod.DeletionTimestamp = &fakeNow
+	podWatch.enqueuePodDeletion(GetKey(deletedPod, t), deletedPod)
+	workerDone := make(chan struct{})
+	go func() {
+		podWatch.podWorker()
+		close(workerDone)
+	}()
+	// The worker must be gone before the next test resets the pod state.
+	defer func() {
+		podWatch.podWorkQueue.ShutDown()
+		<-workerDone
+	}()
+
+	waitTimer := time.NewTimer(time.Second * 2)
+	select {
+	case <-waitTimer.C:
+		t.Fatal("expected the preemptor to be bound once the victim is deleted")
+	case bindInfo := <-BindChannel:
+		if bindInfo.Name != "high" || bindInfo.Nodename != "node1" {
+			t.Errorf("expected pod high to be bound to node1, got %v", bindInfo)
+		}
+	}
+	PreemptionMux.Lock()
+	if _, ok := EvictedTasks[tds["low-1"].GetUid()]; ok {
+		t.Error("expected the evicted task to be cleared once its pod is deleted")
+	}
+	PreemptionMux.Unlock()
+}
+
+// TestPreemption_nominatedNodeName checks that the node of the victims is nominated in the status of the
+// preemptor while its binding is deferred, and that the nomination is cleared once the preemptor is bound.
+func TestPreemption_nominatedNodeName(t *testing.T) {
+	var empty map[string]string
+	preemptor := BuildPod("Poseidon-Namespace", "preemptor", empty, v1.PodPending, "2", "1024", nil, "high-owner")
+	other := BuildPod("Poseidon-Namespace", "other", empty, v1.PodPending, "2", "1024", nil, "other-owner")
+	victim := PodIdentifier{Name: "victim", Namespace: "Poseidon-Namespace"}
+
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	client := fake.NewSimpleClientset(preemptor, other)
+	client.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "bindings" {
+			return false, nil, nil
+		}
+		return true, action.(core.CreateAction).GetObject(), nil
+	})
+	ClientSet = client
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, ClientSet, testObj.fc)
+	for i, pod := range []*v1.Pod{preemptor, other} {
+		parsedPod := podWatch.parsePod(pod)
+		jd := podWatch.createNewJob(parsedPod.OwnerRef)
+		jobIDToJD[jd.Uuid] = jd
+		td := podWatch.addTaskToJob(parsedPod, jd.Uuid, jd.Name, i+1)
+		PodToTD[parsedPod.Identifier] = td
+		TaskIDToPod[td.GetUid()] = parsedPod.Identifier
+	}
+	PreemptionMux = new(sync.Mutex)
+	EvictedTasks = map[uint64]string{1: "node1"}
+	nodeToVictims = map[string]map[PodIdentifier]uint64{"node1": {victim: 1}}
+	nodeToDeferredBinds = make(map[string][]BindInfo)
+	nominatedPods = make(map[PodIdentifier]string)
+	nominatedNodeName := func(name string) string {
+		pod, err := ClientSet.CoreV1().Pods("Poseidon-Namespace").Get(name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("could not get pod %s, err: %v", name, err)
+		}
+		return pod.Status.NominatedNodeName
+	}
+
+	// A pod placed onto a node without victims is bound at once and not nominated.
+	QueueBind(BindInfo{Name: "other", Namespace: "Poseidon-Namespace", Nodename: "node2"})
+	bindPod(testObj.fc, <-BindChannel, nil)
+	if got := nominatedNodeName("other"); got != "" {
+		t.Errorf("expected pod other not to be nominated, got %q", got)
+	}
+
+	QueueBind(BindInfo{Name: "preemptor", Namespace: "Poseidon-Namespace", Nodename: "node1"})
+	if got := nominatedNodeName("preemptor"); got != "node1" {
+		t.Fatalf("expected node1 to be nominated for the preemptor during the eviction, got %q", got)
+	}
+
+	releasePreemptionVictim(victim)
+	select {
+	case bindInfo := <-BindChannel:
+		bindPod(testObj.fc, bindInfo, nil)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the preemptor to be bound once the victim is deleted")
+	}
+	if got := nominatedNodeName("preemptor"); got != "" {
+		t.Errorf("expected the nominated node to be cleared once the preemptor is bound, got %q", got)
+	}
+	PreemptionMux.Lock()
+	defer PreemptionMux.Unlock()
+	if len(nominatedPods) != 0 {
+		t.Errorf("expected no nominated pod left, got %v", nominatedPods)
+	}
+}
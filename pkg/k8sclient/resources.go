@@ -0,0 +1,236 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Labels added to the task descriptor of a pod, carrying the pod resource limits and QoS class
+// to firmament since the task descriptor only has a field for the resource request.
+const (
+	QoSClassLabel       = "qosClass"
+	CPULimitLabel       = "cpuLimit"
+	MemLimitLabel       = "memLimitKb"
+	EphemeralLimitLabel = "ephemeralLimitKb"
+	// DefaultRequestLabel records the default requests applied to the containers of a BestEffort pod.
+	DefaultRequestLabel = "defaultRequest"
+	// QoSPriorityLabel records the base priority of the QoS class added to the task priority.
+	QoSPriorityLabel = "qosPriority"
+)
+
+// getQoSPriorities returns the base priorities of the QoS classes in cfg.
+func getQoSPriorities(cfg *config.Config) map[v1.PodQOSClass]int32 {
+	return map[v1.PodQOSClass]int32{
+		v1.PodQOSGuaranteed: int32(cfg.QoSGuaranteed),
+		v1.PodQOSBurstable:  int32(cfg.QoSBurstable),
+		v1.PodQOSBestEffort: int32(cfg.QoSBestEffort),
+	}
+}
+
+// parseDefaultRequests returns the default cpu and memory requests applied to the containers of BestEffort pods,
+// an empty request is not applied.
+func parseDefaultRequests(cpu, memory string) (v1.ResourceList, error) {
+	defaultRequests := v1.ResourceList{}
+	for name, value := range map[v1.ResourceName]string{
+		v1.ResourceCPU:    cpu,
+		v1.ResourceMemory: memory,
+	} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid default %s request %s", name, value)
+		}
+		defaultRequests[name] = quantity
+	}
+	return defaultRequests, nil
+}
+
+// applyDefaultRequests returns the pod with the default requests set on the containers which have neither
+// cpu and memory requests nor limits, along with a description of the substitution. Containers specifying
+// limits are left untouched since their requests default to their limits. The given pod is not modified.
+func applyDefaultRequests(pod *v1.Pod, defaultRequests v1.ResourceList) (*v1.Pod, string) {
+	if len(defaultRequests) == 0 {
+		return pod, ""
+	}
+	var defaultedPod *v1.Pod
+	for i, container := range pod.Spec.Containers {
+		if hasQOSResource(container.Resources.Requests) || hasQOSResource(container.Resources.Limits) {
+			continue
+		}
+		if defaultedPod == nil {
+			defaultedPod = pod.DeepCopy()
+		}
+		requests := defaultedPod.Spec.Containers[i].Resources.Requests
+		if requests == nil {
+			requests = v1.ResourceList{}
+			defaultedPod.Spec.Containers[i].Resources.Requests = requests
+		}
+		for name, quantity := range defaultRequests {
+			requests[name] = quantity
+		}
+	}
+	if defaultedPod == nil {
+		return pod, ""
+	}
+	var substitutions []string
+	for _, name := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+		if quantity, ok := defaultRequests[name]; ok {
+			substitutions = append(substitutions, string(name)+"="+quantity.String())
+		}
+	}
+	return defaultedPod, strings.Join(substitutions, ",")
+}
+
+func hasQOSResource(resources v1.ResourceList) bool {
+	for name := range resources {
+		if isQOSResource(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// getPodResourceRequest returns the effective resource request of a pod. Per resource, it is the larger
+// of the sum of the container requests and the largest init container request, since init containers
+// run one after the other before the containers are started.
+func getPodResourceRequest(pod *v1.Pod) v1.ResourceList {
+	return aggregatePodResources(pod, func(container *v1.Container) v1.ResourceList {
+		return container.Resources.Requests
+	})
+}
+
+// getPodResourceLimit returns the effective resource limit of a pod, aggregated like the request.
+// The limit of a container resource defaults to its request when unset.
+func getPodResourceLimit(pod *v1.Pod) v1.ResourceList {
+	return aggregatePodResources(pod, func(container *v1.Container) v1.ResourceList {
+		limits := v1.ResourceList{}
+		for name, quantity := range container.Resources.Requests {
+			limits[name] = quantity
+		}
+		for name, quantity := range container.Resources.Limits {
+			limits[name] = quantity
+		}
+		return limits
+	})
+}
+
+// aggregatePodResources sums the resources of the containers, and raises them to the resources of the largest
+// init container. The pod overhead declared by RuntimeClasses is not added, spec.overhead is only available
+// from Kubernetes 1.16 while the vendored API is 1.11.
+func aggregatePodResources(pod *v1.Pod, getResources func(*v1.Container) v1.ResourceList) v1.ResourceList {
+	podResources := v1.ResourceList{}
+	for i := range pod.Spec.Containers {
+		for name, quantity := range getResources(&pod.Spec.Containers[i]) {
+			addQuantity(podResources, name, quantity)
+		}
+	}
+	for i := range pod.Spec.InitContainers {
+		for name, quantity := range getResources(&pod.Spec.InitContainers[i]) {
+			if value, ok := podResources[name]; !ok || quantity.Cmp(value) > 0 {
+				podResources[name] = *quantity.Copy()
+			}
+		}
+	}
+	return podResources
+}
+
+// getPodQOSClass returns the QoS class of a pod. The class reported in the pod status is used when set,
+// otherwise it is derived from the container requests and limits the same way Kubernetes does.
+func getPodQOSClass(pod *v1.Pod) v1.PodQOSClass {
+	if len(pod.Status.QOSClass) > 0 {
+		return pod.Status.QOSClass
+	}
+	requests := v1.ResourceList{}
+	limits := v1.ResourceList{}
+	isGuaranteed := true
+	containers := append(append([]v1.Container{}, pod.Spec.Containers...), pod.Spec.InitContainers...)
+	for _, container := range containers {
+		for name, quantity := range container.Resources.Requests {
+			if !isQOSResource(name) || quantity.Sign() <= 0 {
+				continue
+			}
+			addQuantity(requests, name, quantity)
+		}
+		limitsFound := 0
+		for name, quantity := range container.Resources.Limits {
+			if !isQOSResource(name) || quantity.Sign() <= 0 {
+				continue
+			}
+			limitsFound++
+			addQuantity(limits, name, quantity)
+		}
+		// Guaranteed pods have both a cpu and a memory limit on every container.
+		if limitsFound != 2 {
+			isGuaranteed = false
+		}
+	}
+	if len(requests) == 0 && len(limits) == 0 {
+		return v1.PodQOSBestEffort
+	}
+	if isGuaranteed {
+		for name, request := range requests {
+			if limit, ok := limits[name]; !ok || limit.Cmp(request) != 0 {
+				isGuaranteed = false
+				break
+			}
+		}
+	}
+	if isGuaranteed && len(requests) == len(limits) {
+		return v1.PodQOSGuaranteed
+	}
+	return v1.PodQOSBurstable
+}
+
+func isQOSResource(name v1.ResourceName) bool {
+	return name == v1.ResourceCPU || name == v1.ResourceMemory
+}
+
+func addQuantity(resources v1.ResourceList, name v1.ResourceName, quantity resource.Quantity) {
+	if value, ok := resources[name]; ok {
+		value.Add(quantity)
+		resources[name] = value
+		return
+	}
+	resources[name] = *quantity.Copy()
+}
+
+// setTaskResourceLabels adds the resource limits and the QoS class of the pod to the task labels,
+// so that firmament cost models can use them.
+func setTaskResourceLabels(td *firmament.TaskDescriptor, pod *Pod) {
+	td.Labels = append(td.Labels,
+		&firmament.Label{Key: QoSClassLabel, Value: string(pod.QOSClass)},
+		&firmament.Label{Key: CPULimitLabel, Value: strconv.FormatInt(pod.CPULimit, 10)},
+		&firmament.Label{Key: MemLimitLabel, Value: strconv.FormatInt(pod.MemLimitKb, 10)},
+		&firmament.Label{Key: EphemeralLimitLabel, Value: strconv.FormatInt(pod.EphemeralLimKb, 10)},
+	)
+	if pod.DefaultRequest != "" {
+		td.Labels = append(td.Labels, &firmament.Label{Key: DefaultRequestLabel, Value: pod.DefaultRequest})
+	}
+	if pod.QoSPriority != 0 {
+		td.Labels = append(td.Labels, &firmament.Label{Key: QoSPriorityLabel, Value: strconv.FormatInt(int64(pod.QoSPriority), 10)})
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UnknownNodeError is returned when resyncing a node which is neither known by firmament nor by Kubernetes.
+type UnknownNodeError struct {
+	Hostname string
+}
+
+func (e *UnknownNodeError) Error() string {
+	return fmt.Sprintf("node %s is unknown", e.Hostname)
+}
+
+// resyncMux is used to guard access to resyncNodeWatcher.
+var resyncMux sync.Mutex
+
+// resyncNodeWatcher is the node watcher of the nodes resynced by ResyncNode.
+var resyncNodeWatcher *NodeWatcher
+
+// setResyncNodeWatcher sets the node watcher of the nodes resynced by ResyncNode.
+func setResyncNodeWatcher(nw *NodeWatcher) {
+	resyncMux.Lock()
+	defer resyncMux.Unlock()
+	resyncNodeWatcher = nw
+}
+
+// ResyncNode resyncs the node with the node watcher started by New, see Resync. It is used by the admin endpoint.
+func ResyncNode(hostname string) error {
+	resyncMux.Lock()
+	nw := resyncNodeWatcher
+	resyncMux.Unlock()
+	if nw == nil {
+		return fmt.Errorf("the node watcher is not started")
+	}
+	return nw.Resync(hostname)
+}
+
+// Resync sends the resource topology of the node to firmament again, e.g. when the view of the node in firmament
+// is suspected to have drifted. A node known by firmament is updated, a node of the cluster which is not known
+// by firmament is queued to be added, unless it is excluded from scheduling. An UnknownNodeError is returned
+// for a node which does not exist.
+func (nw *NodeWatcher) Resync(hostname string) error {
+	NodeMux.RLock()
+	rtnd, ok := NodeToRTND[hostname]
+	NodeMux.RUnlock()
+	if ok {
+		glog.Infof("Resyncing node %s with firmament", hostname)
+		return nw.fc.NodeUpdated(context.Background(), rtnd)
+	}
+	node, err := nw.clientset.CoreV1().Nodes().Get(hostname, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return &UnknownNodeError{Hostname: hostname}
+	}
+	if err != nil {
+		return err
+	}
+	glog.Infof("Node %s is not known by firmament, queuing it to be added", hostname)
+	nw.enqueueNodeAddition(hostname, node)
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"testing"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament/firmamenttest"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// TestNodeWatcher_Resync checks that a node known by firmament is sent again, that a node of the cluster
+// unknown by firmament is queued to be added, and that an error is returned for an unknown node.
+func TestNodeWatcher_Resync(t *testing.T) {
+	fc := firmamenttest.NewFakeClient()
+	nodeWatch := NewNodeWatcher(fake.NewSimpleClientset(BuildNode("node1", "4", "8Gi", nil, nil, false)), fc)
+	rtnd := &firmament.ResourceTopologyNodeDescriptor{ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node0-uuid"}}
+	NodeToRTND["node0"] = rtnd
+
+	if err := nodeWatch.Resync("node0"); err != nil {
+		t.Fatal("unexpected error resyncing a known node ", err)
+	}
+	if updated := fc.Requests("NodeUpdated"); len(updated) != 1 || updated[0] != rtnd {
+		t.Errorf("expected the topology of the node to be sent again, got %v", updated)
+	}
+
+	if err := nodeWatch.Resync("node1"); err != nil {
+		t.Fatal("unexpected error resyncing a node unknown by firmament ", err)
+	}
+	if got := nodeWatch.nodeWorkQueue.Len(); got != 1 {
+		t.Errorf("expected the node unknown by firmament to be queued to be added, got %d queued nodes", got)
+	}
+
+	err := nodeWatch.Resync("node2")
+	if _, ok := err.(*UnknownNodeError); !ok {
+		t.Errorf("expected an unknown node error, got %v", err)
+	}
+	if calls := fc.Calls(); len(calls) != 1 {
+		t.Errorf("expected no other request to firmament, got %v", calls)
+	}
+
+	fc.InjectError("NodeUpdated", timeoutError)
+	if err := nodeWatch.Resync("node0"); err != timeoutError {
+		t.Errorf("expected the error of firmament to be returned, got %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/logging"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+)
+
+// scheduleStreamRetryInterval is the time before opening again a broken schedule stream.
+var scheduleStreamRetryInterval = time.Second
+
+// RunSchedulingLoop applies the scheduling deltas until the stop channel is closed. The deltas pushed by firmament
+// on the schedule stream are applied as they arrive, unless the stream is disabled or not exposed by firmament.
+// The scheduling rounds are polled otherwise, see waitForRound.
+func RunSchedulingLoop(fc firmament.Client, stopCh <-chan struct{}) {
+	if config.GetScheduleStream() && runScheduleStream(fc, stopCh) {
+		return
+	}
+	for {
+		scheduleRound(fc)
+		if !waitForRound(stopCh, time.Now()) {
+			return
+		}
+	}
+}
+
+// runScheduleStream applies the deltas received on the schedule stream until the stop channel is closed.
+// A broken stream is opened again, followed by a scheduling round catching up the deltas missed meanwhile.
+// It returns false, without waiting for the stop channel, if firmament does not expose the stream.
+func runScheduleStream(fc firmament.Client, stopCh <-chan struct{}) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	catchUp := false
+	for {
+		err := receiveDeltas(ctx, fc, catchUp)
+		if ctx.Err() != nil {
+			return true
+		}
+		if firmament.IsStreamUnsupported(err) {
+			glog.Infof("Firmament does not expose the schedule stream, polling the scheduling rounds: %v", err)
+			return false
+		}
+		glog.Errorf("Schedule stream broken, opening it again: %v", err)
+		metrics.ScheduleStreamReconnects.Inc()
+		catchUp = true
+		select {
+		case <-stopCh:
+			return true
+		case <-time.After(scheduleStreamRetryInterval):
+		}
+	}
+}
+
+// receiveDeltas opens a schedule stream and applies the deltas in the order they are received, until the stream
+// is broken. With catchUp, a scheduling round is run once the stream is open, so that the deltas of the rounds
+// run by firmament while the previous stream was broken are applied.
+func receiveDeltas(ctx context.Context, fc firmament.Client, catchUp bool) error {
+	stream, err := fc.ScheduleStream(ctx)
+	if err != nil {
+		return err
+	}
+	if catchUp {
+		scheduleRound(fc)
+	}
+	for {
+		deltas, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		done := heartbeats.start(LoopScheduling)
+		applyDeltas(fc, deltas)
+		done()
+	}
+}
+
+// waitForRound waits for the next polled scheduling round. A round is run every scheduling interval while pods
+// are pending and every idle scheduling interval otherwise, or as soon as it is triggered by TriggerSchedule.
+// It returns false once the stop channel is closed.
+func waitForRound(stopCh <-chan struct{}, lastRound time.Time) bool {
+	for {
+		select {
+		case <-stopCh:
+			return false
+		case <-time.After(time.Duration(config.GetSchedulingInterval()) * time.Second):
+		case <-ScheduleTrigger:
+			return true
+		}
+		if isRoundDue(lastRound, time.Now()) {
+			return true
+		}
+	}
+}
+
+// isRoundDue checks if a polled scheduling round is due, i.e. pods are pending or the idle scheduling interval elapsed.
+func isRoundDue(lastRound, now time.Time) bool {
+	return hasPendingPods() || now.Sub(lastRound) >= time.Duration(config.GetIdleSchedulingInterval())*time.Second
+}
+
+// scheduleRound asks firmament for the scheduling deltas and applies them.
+func scheduleRound(fc firmament.Client) {
+	done := heartbeats.start(LoopScheduling)
+	defer done()
+	scheduleStartTime := time.Now()
+	deltas, err := fc.Schedule()
+	if firmament.IsCircuitOpen(err) {
+		// The tasks are still pending in firmament, they are scheduled once the circuit breaker is closed.
+		return
+	}
+	if err != nil {
+		// The tasks are still pending in firmament, they are scheduled by the next round.
+		logging.Error("Scheduling round failed", "err", err)
+		if firmament.IsTimeout(err) {
+			metrics.FirmamentRequestTimeouts.Inc()
+		}
+		return
+	}
+	metrics.SchedulingAlgorithmLatency.Observe(metrics.SinceInMicroseconds(scheduleStartTime))
+	applyDeltas(fc, deltas)
+}
+
+// processDeltaEvents records the events of the deltas of a scheduling round without blocking the round, the tests
+// replace it to wait for the events.
+var processDeltaEvents = func(deltas *firmament.SchedulingDeltas) {
+	go NewPoseidonEvents(ClientSet).ProcessEvents(deltas)
+}
+
+// applyDeltas applies the deltas of a scheduling round, polled or received on the schedule stream.
+func applyDeltas(fc firmament.Client, deltas *firmament.SchedulingDeltas) {
+	logging.Info("Scheduler returned deltas", "deltas", len(deltas.GetDeltas()))
+	metrics.SchedulingAttempts.WithLabelValues(attemptUnschedulable).Add(float64(len(deltas.GetUnscheduledTasks())))
+	recordUnscheduledTasks(deltas.GetUnscheduledTasks())
+	if (len(deltas.GetUnscheduledTasks()) > 0) || (len(deltas.GetDeltas()) > 0) {
+		if ClientSet != nil {
+			processDeltaEvents(deltas)
+		}
+	}
+	for _, delta := range deltas.GetDeltas() {
+		applyDelta(fc, delta)
+	}
+	ReleaseExpiredGangPlacements(fc, time.Duration(config.GetGangSchedulingTimeout())*time.Second)
+}
+
+// applyDelta binds the pod of a placed task to the node of the resource it is placed on, and evicts
+// the pods of the preempted and migrated tasks.
+func applyDelta(fc firmament.Client, delta *firmament.SchedulingDelta) {
+	switch delta.GetType() {
+	case firmament.SchedulingDelta_PLACE:
+		PodMux.RLock()
+		podIdentifier, ok := TaskIDToPod[delta.GetTaskId()]
+		PodMux.RUnlock()
+		if !ok {
+			skipUnknownTaskDelta(delta)
+			return
+		}
+		NodeMux.RLock()
+		nodeName, ok := ResIDToNode[delta.GetResourceId()]
+		NodeMux.RUnlock()
+		if !ok {
+			// Firmament may still hold a part of the topology of a node whose addition failed.
+			logging.Error("Placed task on a resource without node pairing, resubmitting the task", "taskID", delta.GetTaskId(), "pod", podIdentifier.UniqueName(), "resourceUUID", delta.GetResourceId())
+			skippedDeltas.WithLabelValues(delta.GetType().String(), "unknown_resource").Inc()
+			ResubmitTask(fc, podIdentifier)
+			return
+		}
+		if !PodToleratesNodeTaints(podIdentifier, nodeName) {
+			logging.Error("Placed task on a node with taints not tolerated by its pod, resubmitting the task", "taskID", delta.GetTaskId(), "hostname", nodeName, "pod", podIdentifier.UniqueName(), "resourceUUID", delta.GetResourceId())
+			refreshTaintLabelSelectors(podIdentifier)
+			ResubmitTask(fc, podIdentifier)
+			return
+		}
+		if !reservePlacementHostPorts(fc, podIdentifier, nodeName) {
+			return
+		}
+		QueuePlacement(delta.GetTaskId(), BindInfo{Name: podIdentifier.Name, Namespace: podIdentifier.Namespace, Nodename: nodeName})
+	case firmament.SchedulingDelta_PREEMPT:
+		if !config.GetEnablePreemption() {
+			logging.V(2).Info("Ignoring preemption of task, preemption is disabled", "taskID", delta.GetTaskId())
+			return
+		}
+		preemptionStartTime := time.Now()
+		metrics.PreemptionAttempts.Inc()
+		EvictPreemptedTask(delta)
+		metrics.SchedulingPremptionEvaluationDuration.Observe(metrics.SinceInMicroseconds(preemptionStartTime))
+	case firmament.SchedulingDelta_MIGRATE:
+		PodMux.RLock()
+		preemptionStartTime := time.Now()
+		podIdentifier, ok := TaskIDToPod[delta.GetTaskId()]
+		PodMux.RUnlock()
+		if !ok {
+			skipUnknownTaskDelta(delta)
+			return
+		}
+		metrics.PreemptionAttempts.Inc()
+		// XXX(ionel): HACK! Kubernetes does not yet have support for preemption.
+		// However, preemption can be achieved by deleting the preempted pod
+		// and relying on the controller mechanism (e.g., job, replica set)
+		// to submit another instance of this pod.
+		DeletePod(podIdentifier.Name, podIdentifier.Namespace)
+		metrics.SchedulingPremptionEvaluationDuration.Observe(metrics.SinceInMicroseconds(preemptionStartTime))
+	case firmament.SchedulingDelta_NOOP:
+	default:
+		glog.Fatalf("Unexpected SchedulingDelta type %v", delta.GetType())
+	}
+}
+
+// skippedDeltas counts the scheduling deltas skipped by poseidon.
+var skippedDeltas = metrics.NewCounterVec("skipped_scheduling_deltas_total", "Total scheduling deltas skipped as their task or resource is not known by poseidon, by type and reason", "type", "reason")
+
+// skipUnknownTaskDelta skips the delta of a task poseidon does not know. The pod of the task is removed while its
+// TaskRemoved request is pending, e.g. sent again after a timeout, and firmament schedules the task meanwhile.
+func skipUnknownTaskDelta(delta *firmament.SchedulingDelta) {
+	logging.Error("Skipping scheduling delta of task without pod pairing", "taskID", delta.GetTaskId(), "type", delta.GetType(), "resourceUUID", delta.GetResourceId())
+	skippedDeltas.WithLabelValues(delta.GetType().String(), "unknown_task").Inc()
+}
+
+// triggerScheduleOnDrain starts a scheduling round once the work queue is drained, i.e. no key is queued
+// or under processing, so that the changes applied to firmament are scheduled without waiting for the
+// scheduling interval.
+func triggerScheduleOnDrain(queued int) {
+	if config.GetScheduleOnQueueDrain() && queued == 0 {
+		TriggerSchedule()
+	}
+}
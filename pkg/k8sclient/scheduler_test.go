@@ -0,0 +1,310 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament/firmamenttest"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// syncDeltaEvents records the events of the scheduling rounds synchronously, so that they are done once the round
+// returns. The returned function restores the asynchronous events.
+func syncDeltaEvents() func() {
+	previous := processDeltaEvents
+	processDeltaEvents = func(deltas *firmament.SchedulingDeltas) {
+		events := NewPoseidonEvents(ClientSet)
+		events.ProcessFailureEvents(deltas.GetUnscheduledTasks())
+		events.ProcessSuccessEvents(deltas.GetDeltas())
+	}
+	return func() {
+		processDeltaEvents = previous
+	}
+}
+
+// TestScheduleRound checks that a placement returned by firmament is bound to the node of the placed resource.
+func TestScheduleRound(t *testing.T) {
+	testObj := initializeBindObj(t)
+	defer testObj.mockCtrl.Finish()
+	NodeMux = new(sync.RWMutex)
+	NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node1": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node1-res-id"}},
+	}
+	ResIDToNode = map[string]string{"node1-res-id": "node1"}
+	PodMux.RLock()
+	taskID := PodToTD[testObj.podIdentifier].GetUid()
+	PodMux.RUnlock()
+
+	testObj.firmamentClient.EXPECT().Schedule(gomock.Any(), gomock.Any()).Return(&firmament.SchedulingDeltas{
+		Deltas: []*firmament.SchedulingDelta{
+			{TaskId: taskID, ResourceId: "node1-res-id", Type: firmament.SchedulingDelta_PLACE},
+		},
+	}, nil)
+	defer syncDeltaEvents()()
+	scheduleRound(testObj.fc)
+
+	select {
+	case bindInfo := <-BindChannel:
+		bindPod(testObj.fc, bindInfo, testObj.stopCh)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the placement to be queued for binding")
+	}
+	testObj.lock.Lock()
+	defer testObj.lock.Unlock()
+	if !reflect.DeepEqual(testObj.boundNodes, []string{"node1"}) {
+		t.Errorf("expected pod %v to be bound to node1, got %v", testObj.podIdentifier, testObj.boundNodes)
+	}
+}
+
+// TestScheduleRound_removedTask checks that a round placing or migrating the task of a deleted pod, while its
+// TaskRemoved request is still pending, skips the deltas of the task.
+func TestScheduleRound_removedTask(t *testing.T) {
+	var empty map[string]string
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+	NodeMux = new(sync.RWMutex)
+	ResIDToNode = map[string]string{"node1-res-id": "node1"}
+	BindChannel = make(chan BindInfo, 10)
+	ClientSet = nil
+	skipped := func() float64 {
+		metric := &dto.Metric{}
+		if err := skippedDeltas.WithLabelValues("PLACE", "unknown_task").Write(metric); err != nil {
+			t.Fatal("unable to read the skipped deltas metric ", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+
+	var taskID uint64
+	pending := make(chan struct{})
+	roundDone := make(chan struct{})
+	removed := make(chan struct{})
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				taskID = arg1.(*firmament.TaskDescription).GetTaskDescriptor().GetUid()
+			}),
+		testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(nil, timeoutError).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				close(pending)
+			}),
+		// The request sent again waits for the round.
+		testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil).Do(
+			func(arg0, arg1 interface{}, arg2 ...interface{}) {
+				<-roundDone
+				close(removed)
+			}),
+	)
+	pod := BuildPod("Poseidon-Namespace", "Pod-removed", empty, GetPodPhase("Pending"), "2", "1024", nil, "owner-removed")
+	key := GetKey(pod, t)
+	podWatch.enqueuePodAddition(key, pod)
+	podWatch.enqueuePodDeletion(key, pod)
+	defer runPodWorker(podWatch)()
+	select {
+	case <-pending:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the task to be removed from firmament")
+	}
+
+	testObj.firmamentClient.EXPECT().Schedule(gomock.Any(), gomock.Any()).Return(&firmament.SchedulingDeltas{
+		Deltas: []*firmament.SchedulingDelta{
+			{TaskId: taskID, ResourceId: "node1-res-id", Type: firmament.SchedulingDelta_PLACE},
+			{TaskId: taskID, ResourceId: "node1-res-id", Type: firmament.SchedulingDelta_MIGRATE},
+		},
+	}, nil)
+	before := skipped()
+	scheduleRound(testObj.fc)
+	close(roundDone)
+	if got := skipped() - before; got != 1 {
+		t.Errorf("expected the placement of the removed task to be skipped, got %v skipped placements", got)
+	}
+	select {
+	case bindInfo := <-BindChannel:
+		t.Errorf("expected the removed task not to be bound, got %v", bindInfo)
+	default:
+	}
+	select {
+	case <-removed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the TaskRemoved request to be sent again")
+	}
+}
+
+// TestScheduleRound_unknownResource checks that a placement onto a resource poseidon does not know, e.g. left in
+// firmament by a failed node addition, is skipped and its task is submitted again.
+func TestScheduleRound_unknownResource(t *testing.T) {
+	testObj := initializeBindObj(t)
+	defer testObj.mockCtrl.Finish()
+	NodeMux = new(sync.RWMutex)
+	ResIDToNode = map[string]string{"node1-res-id": "node1"}
+	BindChannel = make(chan BindInfo, 10)
+	PodMux.RLock()
+	taskID := PodToTD[testObj.podIdentifier].GetUid()
+	PodMux.RUnlock()
+
+	gomock.InOrder(
+		testObj.firmamentClient.EXPECT().Schedule(gomock.Any(), gomock.Any()).Return(&firmament.SchedulingDeltas{
+			Deltas: []*firmament.SchedulingDelta{
+				{TaskId: taskID, ResourceId: "partial-res-id", Type: firmament.SchedulingDelta_PLACE},
+			},
+		}, nil),
+		testObj.firmamentClient.EXPECT().TaskRemoved(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskRemovedResponse{Type: firmament.TaskReplyType_TASK_REMOVED_OK}, nil),
+		testObj.firmamentClient.EXPECT().TaskSubmitted(gomock.Any(), gomock.Any()).Return(
+			&firmament.TaskSubmittedResponse{Type: firmament.TaskReplyType_TASK_SUBMITTED_OK}, nil),
+	)
+	defer syncDeltaEvents()()
+	scheduleRound(testObj.fc)
+	select {
+	case bindInfo := <-BindChannel:
+		t.Errorf("expected the placement onto the unknown resource not to be bound, got %v", bindInfo)
+	default:
+	}
+}
+
+// TestScheduleRound_failures checks that only the scheduling rounds which timed out are counted as timeouts.
+func TestScheduleRound_failures(t *testing.T) {
+	timeouts := func() float64 {
+		metric := &dto.Metric{}
+		if err := metrics.FirmamentRequestTimeouts.Write(metric); err != nil {
+			t.Fatal("unable to read the request timeouts metric ", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	fc := firmamenttest.NewFakeClient()
+	fc.InjectError("Schedule", status.Error(codes.Unavailable, "firmament is restarting"), timeoutError)
+
+	before := timeouts()
+	scheduleRound(fc)
+	if got := timeouts() - before; got != 0 {
+		t.Errorf("expected the failed round not to be counted as a timeout, got %v timeouts", got)
+	}
+	scheduleRound(fc)
+	if got := timeouts() - before; got != 1 {
+		t.Errorf("expected the round which timed out to be counted, got %v timeouts", got)
+	}
+}
+
+// TestRunScheduleStream checks that the deltas pushed on the schedule stream are applied in order, and that a
+// broken stream is opened again, followed by a scheduling round catching up the deltas missed meanwhile.
+func TestRunScheduleStream(t *testing.T) {
+	testObj := initializeBindObj(t)
+	defer testObj.mockCtrl.Finish()
+	NodeMux = new(sync.RWMutex)
+	NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node1": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node1-res-id"}},
+	}
+	ResIDToNode = map[string]string{"node1-res-id": "node1"}
+	BindChannel = make(chan BindInfo, 10)
+	ClientSet = nil
+	PodMux.Lock()
+	for i := 1; i <= 4; i++ {
+		pod := PodIdentifier{Name: fmt.Sprintf("pod%d", i), Namespace: "default"}
+		PodToTD[pod] = &firmament.TaskDescriptor{Uid: uint64(100 + i)}
+		TaskIDToPod[uint64(100+i)] = pod
+	}
+	PodMux.Unlock()
+	place := func(i int) *firmament.SchedulingDeltas {
+		return &firmament.SchedulingDeltas{Deltas: []*firmament.SchedulingDelta{
+			{TaskId: uint64(100 + i), ResourceId: "node1-res-id", Type: firmament.SchedulingDelta_PLACE},
+		}}
+	}
+
+	fc := firmamenttest.NewFakeClient()
+	fc.StreamDeltas(place(1), place(2))
+	fc.BreakStream(status.Error(codes.Unavailable, "firmament restarted"))
+	// The catch-up round runs before the deltas pushed on the stream opened again are received.
+	fc.AddDeltas(place(3))
+	fc.StreamDeltas(place(4))
+	defer func(interval time.Duration) { scheduleStreamRetryInterval = interval }(scheduleStreamRetryInterval)
+	scheduleStreamRetryInterval = 10 * time.Millisecond
+	stopCh := make(chan struct{})
+	done := make(chan bool)
+	go func() { done <- runScheduleStream(fc, stopCh) }()
+
+	var bound []string
+	for len(bound) < 4 {
+		select {
+		case bindInfo := <-BindChannel:
+			bound = append(bound, bindInfo.Name)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected the 4 placements to be queued for binding, got %v", bound)
+		}
+	}
+	if expected := []string{"pod1", "pod2", "pod3", "pod4"}; !reflect.DeepEqual(bound, expected) {
+		t.Errorf("expected the placements %v in order, got %v", expected, bound)
+	}
+	close(stopCh)
+	select {
+	case streamed := <-done:
+		if !streamed {
+			t.Error("expected the stream to be used until the stop channel is closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the stream to be closed once the stop channel is closed")
+	}
+	var methods []string
+	for _, call := range fc.Calls() {
+		methods = append(methods, call.Method)
+	}
+	if expected := []string{"ScheduleStream", "ScheduleStream", "Schedule"}; !reflect.DeepEqual(methods, expected) {
+		t.Errorf("expected the requests %v, got %v", expected, methods)
+	}
+}
+
+// TestRunScheduleStream_unsupported checks that the scheduling rounds are polled if firmament does not expose
+// the schedule stream.
+func TestRunScheduleStream_unsupported(t *testing.T) {
+	fc := firmamenttest.NewFakeClient()
+	fc.InjectError("ScheduleStream", status.Error(codes.Unimplemented, "unknown method ScheduleStream"))
+	if runScheduleStream(fc, make(chan struct{})) {
+		t.Error("expected the stream not to be used")
+	}
+}
+
+// TestIsRoundDue checks that the polled scheduling rounds are due while pods are pending, and once the idle
+// scheduling interval elapsed otherwise.
+func TestIsRoundDue(t *testing.T) {
+	pendingPodsMux = new(sync.Mutex)
+	pendingPods = make(map[PodIdentifier]pendingPod)
+	lastRound := time.Now()
+	idle := time.Duration(config.GetIdleSchedulingInterval()) * time.Second
+	if isRoundDue(lastRound, lastRound.Add(idle/2)) {
+		t.Error("expected no round to be due while idle")
+	}
+	if !isRoundDue(lastRound, lastRound.Add(idle)) {
+		t.Error("expected a round to be due once the idle scheduling interval elapsed")
+	}
+	markPodPending(PodIdentifier{Name: "pod", Namespace: "default"}, lastRound)
+	defer func() { pendingPods = make(map[PodIdentifier]pendingPod) }()
+	if !isRoundDue(lastRound, lastRound) {
+		t.Error("expected a round to be due while pods are pending")
+	}
+}
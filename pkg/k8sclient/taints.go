@@ -0,0 +1,283 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+)
+
+// TaintLabelPrefix prefixes the labels advertising the NoSchedule and NoExecute taints of the nodes to firmament.
+// The tasks exclude the nodes whose taints they do not tolerate with label selectors on these labels.
+const TaintLabelPrefix = "taint.poseidon/"
+
+// ToleratesTaint checks if the toleration tolerates the taint.
+// An empty toleration key with the Exists operator tolerates every taint.
+func (t *Toleration) ToleratesTaint(taint *Taint) bool {
+	if len(t.Effect) > 0 && t.Effect != taint.Effect {
+		return false
+	}
+	if len(t.Key) > 0 && t.Key != taint.Key {
+		return false
+	}
+	switch v1.TolerationOperator(t.Operator) {
+	// Empty operator means Equal.
+	case "", v1.TolerationOpEqual:
+		return t.Value == taint.Value
+	case v1.TolerationOpExists:
+		return true
+	default:
+		return false
+	}
+}
+
+// TolerationsTolerateTaint checks if the taint is tolerated by any of the tolerations.
+func TolerationsTolerateTaint(tolerations []Toleration, taint *Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+// getUntoleratedTaints returns the taints with one of the given effects which are not tolerated by the tolerations.
+func getUntoleratedTaints(tolerations []Toleration, taints []Taint, effects ...v1.TaintEffect) []Taint {
+	var untolerated []Taint
+	for i := range taints {
+		if !hasTaintEffect(&taints[i], effects) {
+			continue
+		}
+		if !TolerationsTolerateTaint(tolerations, &taints[i]) {
+			untolerated = append(untolerated, taints[i])
+		}
+	}
+	return untolerated
+}
+
+func hasTaintEffect(taint *Taint, effects []v1.TaintEffect) bool {
+	for _, effect := range effects {
+		if v1.TaintEffect(taint.Effect) == effect {
+			return true
+		}
+	}
+	return false
+}
+
+// getNoExecuteEvictionDelay returns whether a pod with the given tolerations has to be evicted because of the
+// NoExecute taints, and how long the eviction has to be delayed according to the tolerationSeconds of the
+// tolerations in use. A pod which tolerates all the NoExecute taints forever is not evicted.
+func getNoExecuteEvictionDelay(tolerations []Toleration, taints []Taint) (time.Duration, bool) {
+	minTolerationSeconds := int64(-1)
+	for i := range taints {
+		if v1.TaintEffect(taints[i].Effect) != v1.TaintEffectNoExecute {
+			continue
+		}
+		tolerated := false
+		for j := range tolerations {
+			if !tolerations[j].ToleratesTaint(&taints[i]) {
+				continue
+			}
+			tolerated = true
+			if tolerations[j].TolerationSeconds == nil {
+				continue
+			}
+			tolerationSeconds := *tolerations[j].TolerationSeconds
+			// Zero and negative values are treated as evict immediately.
+			if tolerationSeconds <= 0 {
+				return 0, true
+			}
+			if minTolerationSeconds == -1 || tolerationSeconds < minTolerationSeconds {
+				minTolerationSeconds = tolerationSeconds
+			}
+		}
+		if !tolerated {
+			return 0, true
+		}
+	}
+	if minTolerationSeconds == -1 {
+		return 0, false
+	}
+	return time.Duration(minTolerationSeconds) * time.Second, true
+}
+
+func taintsFromFirmament(firmamentTaints []*firmament.Taint) []Taint {
+	var taints []Taint
+	for _, taint := range firmamentTaints {
+		taints = append(taints, Taint{
+			Key:    taint.GetKey(),
+			Value:  taint.GetValue(),
+			Effect: taint.GetEffect(),
+		})
+	}
+	return taints
+}
+
+func tolerationsFromFirmament(firmamentTolerations []*firmament.Toleration) []Toleration {
+	var tolerations []Toleration
+	for _, toleration := range firmamentTolerations {
+		tolerations = append(tolerations, Toleration{
+			Key:      toleration.GetKey(),
+			Operator: toleration.GetOperator(),
+			Value:    toleration.GetValue(),
+			Effect:   toleration.GetEffect(),
+		})
+	}
+	return tolerations
+}
+
+// taintLabelKey returns the key of the label advertising the taint, the taints with the same key and different
+// effects are advertised with different labels.
+func taintLabelKey(taint *Taint) string {
+	return TaintLabelPrefix + taint.Effect + "." + taint.Key
+}
+
+// getTaintLabels returns the labels advertising the NoSchedule and NoExecute taints of the node, sorted by key.
+func getTaintLabels(node *Node) []*firmament.Label {
+	var labels []*firmament.Label
+	for i := range node.Taints {
+		if !hasTaintEffect(&node.Taints[i], []v1.TaintEffect{v1.TaintEffectNoSchedule, v1.TaintEffectNoExecute}) {
+			continue
+		}
+		labels = append(labels, &firmament.Label{
+			Key:   taintLabelKey(&node.Taints[i]),
+			Value: node.Taints[i].Value,
+		})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Key < labels[j].Key })
+	return labels
+}
+
+// getTaintLabelSelectors returns the label selectors excluding the nodes with NoSchedule or NoExecute taints
+// which are not tolerated by the tolerations, sorted by key. The taints are the ones of the nodes known when
+// the task is built, a placement on a node tainted afterwards is rejected by PodToleratesNodeTaints.
+func getTaintLabelSelectors(tolerations []Toleration) []*firmament.LabelSelector {
+	var taints []Taint
+	NodeMux.RLock()
+	for _, rtnd := range NodeToRTND {
+		taints = append(taints, taintsFromFirmament(rtnd.GetResourceDesc().GetTaints())...)
+	}
+	NodeMux.RUnlock()
+	values := make(map[string]map[string]bool)
+	for _, taint := range getUntoleratedTaints(tolerations, taints, v1.TaintEffectNoSchedule, v1.TaintEffectNoExecute) {
+		key := taintLabelKey(&taint)
+		if values[key] == nil {
+			values[key] = make(map[string]bool)
+		}
+		values[key][taint.Value] = true
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var selectors []*firmament.LabelSelector
+	for _, key := range keys {
+		selector := &firmament.LabelSelector{Type: firmament.LabelSelector_NOT_IN_SET, Key: key}
+		for value := range values[key] {
+			selector.Values = append(selector.Values, value)
+		}
+		sort.Strings(selector.Values)
+		selectors = append(selectors, selector)
+	}
+	return selectors
+}
+
+// refreshTaintLabelSelectors rebuilds the taint label selectors of the task of the pod, so that the resubmitted
+// task of a pod placed on a node tainted after the task was built excludes the node.
+func refreshTaintLabelSelectors(podIdentifier PodIdentifier) {
+	PodMux.RLock()
+	td, ok := PodToTD[podIdentifier]
+	var tolerations []Toleration
+	if ok {
+		tolerations = tolerationsFromFirmament(td.GetToleration())
+	}
+	PodMux.RUnlock()
+	if !ok {
+		return
+	}
+	taintSelectors := getTaintLabelSelectors(tolerations)
+	PodMux.Lock()
+	defer PodMux.Unlock()
+	var labelSelectors []*firmament.LabelSelector
+	for _, selector := range td.LabelSelectors {
+		if !strings.HasPrefix(selector.GetKey(), TaintLabelPrefix) {
+			labelSelectors = append(labelSelectors, selector)
+		}
+	}
+	td.LabelSelectors = append(labelSelectors, taintSelectors...)
+}
+
+// PodToleratesNodeTaints checks if the pod tolerates the NoSchedule and NoExecute taints of the node.
+// It is used to validate a placement received from firmament before binding the pod.
+func PodToleratesNodeTaints(podIdentifier PodIdentifier, nodeName string) bool {
+	PodMux.RLock()
+	td, ok := PodToTD[podIdentifier]
+	PodMux.RUnlock()
+	if !ok {
+		glog.Errorf("Pod %v does not exist", podIdentifier)
+		return false
+	}
+	NodeMux.RLock()
+	rtnd, ok := NodeToRTND[nodeName]
+	var taints []Taint
+	if ok {
+		taints = taintsFromFirmament(rtnd.GetResourceDesc().GetTaints())
+	}
+	NodeMux.RUnlock()
+	if !ok {
+		glog.Errorf("Node %s does not exist", nodeName)
+		return false
+	}
+	untolerated := getUntoleratedTaints(tolerationsFromFirmament(td.GetToleration()), taints, v1.TaintEffectNoSchedule, v1.TaintEffectNoExecute)
+	if len(untolerated) > 0 {
+		glog.V(2).Infof("Pod %v does not tolerate taints %v of node %s", podIdentifier, untolerated, nodeName)
+		return false
+	}
+	return true
+}
+
+// ResubmitTask removes the task of the given pod from firmament and submits it again,
+// so that firmament can find another placement for it.
+func ResubmitTask(fc firmament.Client, podIdentifier PodIdentifier) {
+	PodMux.RLock()
+	td, okPod := PodToTD[podIdentifier]
+	var jd *firmament.JobDescriptor
+	okJob := false
+	if okPod {
+		jd, okJob = jobIDToJD[td.GetJobId()]
+	}
+	PodMux.RUnlock()
+	if !okPod {
+		glog.Errorf("Pod %v does not exist", podIdentifier)
+		return
+	}
+	if !okJob {
+		glog.Errorf("Pod's %v job does not exist", podIdentifier)
+		return
+	}
+	fc.TaskRemoved(&firmament.TaskUID{TaskUid: td.GetUid()})
+	fc.TaskSubmitted(&firmament.TaskDescription{
+		TaskDescriptor: td,
+		JobDescriptor:  jd,
+	})
+}
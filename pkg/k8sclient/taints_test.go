@@ -0,0 +1,204 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+)
+
+// TestToleration_ToleratesTaint tests the Equal and Exists operators and the empty key toleration.
+func TestToleration_ToleratesTaint(t *testing.T) {
+	taint := &Taint{Key: "dedicated", Value: "user1", Effect: "NoSchedule"}
+
+	var testData = []struct {
+		toleration Toleration
+		expected   bool
+	}{
+		{toleration: Toleration{Key: "dedicated", Operator: "Equal", Value: "user1", Effect: "NoSchedule"}, expected: true},
+		{toleration: Toleration{Key: "dedicated", Value: "user1"}, expected: true},
+		{toleration: Toleration{Key: "dedicated", Operator: "Equal", Value: "user2", Effect: "NoSchedule"}, expected: false},
+		{toleration: Toleration{Key: "dedicated", Operator: "Equal", Value: "user1", Effect: "NoExecute"}, expected: false},
+		{toleration: Toleration{Key: "dedicated", Operator: "Exists"}, expected: true},
+		{toleration: Toleration{Key: "other", Operator: "Exists"}, expected: false},
+		// An empty key with the Exists operator tolerates everything.
+		{toleration: Toleration{Operator: "Exists"}, expected: true},
+		{toleration: Toleration{Operator: "Exists", Effect: "NoExecute"}, expected: false},
+	}
+
+	for _, data := range testData {
+		if got := data.toleration.ToleratesTaint(taint); got != data.expected {
+			t.Errorf("toleration %v for taint %v: expected %v got %v", data.toleration, taint, data.expected, got)
+		}
+	}
+}
+
+func TestGetNoExecuteEvictionDelay(t *testing.T) {
+	tenSeconds := int64(10)
+	fiveSeconds := int64(5)
+	taints := []Taint{
+		{Key: "dedicated", Value: "user1", Effect: "NoExecute"},
+		{Key: "disk", Value: "slow", Effect: "NoSchedule"},
+	}
+
+	var testData = []struct {
+		tolerations   []Toleration
+		expectedDelay time.Duration
+		expectedEvict bool
+	}{
+		{tolerations: nil, expectedDelay: 0, expectedEvict: true},
+		{tolerations: []Toleration{{Key: "dedicated", Operator: "Exists"}}, expectedDelay: 0, expectedEvict: false},
+		{tolerations: []Toleration{{Operator: "Exists"}}, expectedDelay: 0, expectedEvict: false},
+		{
+			tolerations: []Toleration{
+				{Key: "dedicated", Operator: "Exists", TolerationSeconds: &tenSeconds},
+				{Key: "dedicated", Operator: "Equal", Value: "user1", TolerationSeconds: &fiveSeconds},
+			},
+			expectedDelay: 5 * time.Second,
+			expectedEvict: true,
+		},
+	}
+
+	for _, data := range testData {
+		delay, evict := getNoExecuteEvictionDelay(data.tolerations, taints)
+		if delay != data.expectedDelay || evict != data.expectedEvict {
+			t.Errorf("tolerations %v: expected (%v, %v) got (%v, %v)", data.tolerations, data.expectedDelay, data.expectedEvict, delay, evict)
+		}
+	}
+}
+
+func TestPodToleratesNodeTaints(t *testing.T) {
+	PodMux = new(sync.RWMutex)
+	NodeMux = new(sync.RWMutex)
+	podIdentifier := PodIdentifier{Name: "Pod1", Namespace: "Poseidon-Namespace"}
+	PodToTD = map[PodIdentifier]*firmament.TaskDescriptor{
+		podIdentifier: {
+			Toleration: []*firmament.Toleration{
+				{Key: "dedicated", Operator: "Equal", Value: "user1", Effect: "NoSchedule"},
+			},
+		},
+	}
+	NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"tolerated": {ResourceDesc: &firmament.ResourceDescriptor{
+			Taints: []*firmament.Taint{{Key: "dedicated", Value: "user1", Effect: "NoSchedule"}},
+		}},
+		"untolerated": {ResourceDesc: &firmament.ResourceDescriptor{
+			Taints: []*firmament.Taint{{Key: "dedicated", Value: "user2", Effect: "NoSchedule"}},
+		}},
+		"prefer": {ResourceDesc: &firmament.ResourceDescriptor{
+			Taints: []*firmament.Taint{{Key: "dedicated", Value: "user2", Effect: "PreferNoSchedule"}},
+		}},
+		"clean": {ResourceDesc: &firmament.ResourceDescriptor{}},
+	}
+
+	var testData = []struct {
+		nodeName string
+		expected bool
+	}{
+		{nodeName: "tolerated", expected: true},
+		{nodeName: "untolerated", expected: false},
+		{nodeName: "prefer", expected: true},
+		{nodeName: "clean", expected: true},
+		{nodeName: "missing", expected: false},
+	}
+
+	for _, data := range testData {
+		if got := PodToleratesNodeTaints(podIdentifier, data.nodeName); got != data.expected {
+			t.Errorf("node %s: expected %v got %v", data.nodeName, data.expected, got)
+		}
+	}
+}
+
+// TestGetTaintLabelSelectors checks that the tasks exclude the nodes whose NoSchedule and NoExecute taints
+// they do not tolerate, and that the taint labels of the nodes match the selectors.
+func TestGetTaintLabelSelectors(t *testing.T) {
+	NodeMux = new(sync.RWMutex)
+	nodes := []*Node{
+		{Hostname: "dedicated", Taints: []Taint{{Key: "dedicated", Value: "user1", Effect: "NoSchedule"}}},
+		{Hostname: "other", Taints: []Taint{{Key: "dedicated", Value: "user2", Effect: "NoSchedule"}}},
+		{Hostname: "gpu", Taints: []Taint{
+			{Key: "gpu", Effect: "NoExecute"},
+			{Key: "disk", Value: "slow", Effect: "PreferNoSchedule"},
+		}},
+		{Hostname: "clean"},
+	}
+	NodeToRTND = make(map[string]*firmament.ResourceTopologyNodeDescriptor)
+	for _, node := range nodes {
+		var taints []*firmament.Taint
+		for _, taint := range node.Taints {
+			taints = append(taints, &firmament.Taint{Key: taint.Key, Value: taint.Value, Effect: taint.Effect})
+		}
+		NodeToRTND[node.Hostname] = &firmament.ResourceTopologyNodeDescriptor{ResourceDesc: &firmament.ResourceDescriptor{
+			Labels: getTaintLabels(node),
+			Taints: taints,
+		}}
+	}
+	dedicated := &firmament.LabelSelector{Type: firmament.LabelSelector_NOT_IN_SET, Key: "taint.poseidon/NoSchedule.dedicated", Values: []string{"user1", "user2"}}
+	gpu := &firmament.LabelSelector{Type: firmament.LabelSelector_NOT_IN_SET, Key: "taint.poseidon/NoExecute.gpu", Values: []string{""}}
+
+	var testData = []struct {
+		name        string
+		tolerations []Toleration
+		expected    []*firmament.LabelSelector
+	}{
+		{name: "untolerated", expected: []*firmament.LabelSelector{gpu, dedicated}},
+		{
+			name:        "tolerated value",
+			tolerations: []Toleration{{Key: "dedicated", Operator: "Equal", Value: "user1", Effect: "NoSchedule"}},
+			expected: []*firmament.LabelSelector{gpu,
+				{Type: firmament.LabelSelector_NOT_IN_SET, Key: "taint.poseidon/NoSchedule.dedicated", Values: []string{"user2"}}},
+		},
+		{
+			name:        "tolerated key",
+			tolerations: []Toleration{{Key: "dedicated", Operator: "Exists"}, {Key: "gpu", Operator: "Exists", Effect: "NoExecute"}},
+		},
+		{name: "tolerate all", tolerations: []Toleration{{Operator: "Exists"}}},
+	}
+
+	for _, data := range testData {
+		if got := getTaintLabelSelectors(data.tolerations); !reflect.DeepEqual(got, data.expected) {
+			t.Errorf("%s: expected the selectors %v, got %v", data.name, data.expected, got)
+		}
+	}
+
+	// The nodes matching the selectors of a toleration of the dedicated user1 nodes.
+	var matching []string
+	selectors := getTaintLabelSelectors([]Toleration{{Key: "dedicated", Value: "user1"}})
+	for _, node := range nodes {
+		labels := make(map[string]string)
+		for _, label := range NodeToRTND[node.Hostname].ResourceDesc.Labels {
+			labels[label.Key] = label.Value
+		}
+		excluded := false
+		for _, selector := range selectors {
+			value, ok := labels[selector.Key]
+			for _, excludedValue := range selector.Values {
+				excluded = excluded || (ok && value == excludedValue)
+			}
+		}
+		if !excluded {
+			matching = append(matching, node.Hostname)
+		}
+	}
+	if expected := []string{"dedicated", "clean"}; !reflect.DeepEqual(matching, expected) {
+		t.Errorf("expected the candidate nodes %v, got %v", expected, matching)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/units"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/rest"
+)
+
+// NodeResourceTopologyPath is the API path of the NodeResourceTopology objects, which are named after their nodes.
+const NodeResourceTopologyPath = "/apis/topology.node.k8s.io/v1alpha1/noderesourcetopologies"
+
+// NUMAZoneType is the type of the NodeResourceTopology zones describing a NUMA node.
+const NUMAZoneType = "Node"
+
+// NodeResourceTopology is the subset of the NodeResourceTopology object used to build the node topology.
+type NodeResourceTopology struct {
+	Zones []TopologyZone `json:"zones"`
+}
+
+// TopologyZone is a zone of a NodeResourceTopology object, e.g. a NUMA node.
+type TopologyZone struct {
+	Name      string             `json:"name"`
+	Type      string             `json:"type"`
+	Resources []TopologyResource `json:"resources,omitempty"`
+}
+
+// TopologyResource holds the quantities of a resource of a zone.
+type TopologyResource struct {
+	Name        string            `json:"name"`
+	Capacity    resource.Quantity `json:"capacity"`
+	Allocatable resource.Quantity `json:"allocatable"`
+}
+
+// AutoPUs advertises a PU per CPU core of the nodes without NUMA zones, see NodeWatcherConfig.PUsPerMachine.
+const AutoPUs = -1
+
+// NodeTopologyFunc returns the topology of the node, or nil if the node has no topology object.
+type NodeTopologyFunc func(nodeName string) (*NodeResourceTopology, error)
+
+// WithNodeTopologyFunc makes the NodeWatcher advertise the NUMA zones of the nodes returned by the
+// topology function to firmament, instead of a single PU per node.
+func WithNodeTopologyFunc(topologyFunc NodeTopologyFunc) NodeWatcherOption {
+	return func(nw *NodeWatcher) {
+		nw.topologyFunc = topologyFunc
+	}
+}
+
+// NewNodeResourceTopologyFunc returns a NodeTopologyFunc getting the NodeResourceTopology objects through
+// the REST client. A missing object or CRD is not an error, the node has a flat topology then.
+func NewNodeResourceTopologyFunc(client rest.Interface) NodeTopologyFunc {
+	return func(nodeName string) (*NodeResourceTopology, error) {
+		data, err := client.Get().AbsPath(NodeResourceTopologyPath, nodeName).DoRaw()
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return parseNodeResourceTopology(data)
+	}
+}
+
+func parseNodeResourceTopology(data []byte) (*NodeResourceTopology, error) {
+	topology := &NodeResourceTopology{}
+	if err := json.Unmarshal(data, topology); err != nil {
+		return nil, fmt.Errorf("unable to parse NodeResourceTopology: %v", err)
+	}
+	return topology, nil
+}
+
+// getNodeTopology reads the topology of the node, the node falls back to a flat topology on errors.
+func (nw *NodeWatcher) getNodeTopology(nodeName string) *NodeResourceTopology {
+	if nw.topologyFunc == nil {
+		return nil
+	}
+	topology, err := nw.topologyFunc(nodeName)
+	if err != nil {
+		glog.Errorf("Unable to read the topology of node %s, using a flat topology: %v", nodeName, err)
+		return nil
+	}
+	return topology
+}
+
+// getNUMAZones returns the NUMA zones of the topology which hold cpu or memory.
+func getNUMAZones(topology *NodeResourceTopology) []TopologyZone {
+	if topology == nil {
+		return nil
+	}
+	var zones []TopologyZone
+	for _, zone := range topology.Zones {
+		if zone.Type != NUMAZoneType {
+			continue
+		}
+		if _, ok := zone.getResource(v1.ResourceCPU); !ok {
+			if _, ok := zone.getResource(v1.ResourceMemory); !ok {
+				continue
+			}
+		}
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+func (zone *TopologyZone) getResource(name v1.ResourceName) (*TopologyResource, bool) {
+	for i := range zone.Resources {
+		if v1.ResourceName(zone.Resources[i].Name) == name {
+			return &zone.Resources[i], true
+		}
+	}
+	return nil, false
+}
+
+// getZoneMilliValues returns the capacity and the allocatable quantity of the resource of the zone.
+func (zone *TopologyZone) getZoneMilliValues(name v1.ResourceName) (int64, int64) {
+	res, ok := zone.getResource(name)
+	if !ok {
+		return 0, 0
+	}
+	return res.Capacity.MilliValue(), res.Allocatable.MilliValue()
+}
+
+// getZoneMemoryValues returns the memory capacity and the allocatable memory of the zone in the unit.
+func (zone *TopologyZone) getZoneMemoryValues(unit MemoryUnit) (int64, int64) {
+	res, ok := zone.getResource(v1.ResourceMemory)
+	if !ok {
+		return 0, 0
+	}
+	return unit.memoryValue(res.Capacity), unit.memoryValue(res.Allocatable)
+}
+
+// createNUMAZone adds a NUMA node resource holding the capacity of the zone, and a PU below it, to the machine.
+// The allocatable resources of the zone are advertised as its capacity, see nodeCapacity.
+func (nw *NodeWatcher) createNUMAZone(node *Node, rtnd *firmament.ResourceTopologyNodeDescriptor, zone *TopologyZone) {
+	cpuCap, cpuAlloc := zone.getZoneMilliValues(v1.ResourceCPU)
+	memCap, memAlloc := zone.getZoneMemoryValues(nw.cfg.MemoryUnit)
+	ephemeralCap := node.EphemeralCapKb
+	if !nw.cfg.UseNodeCapacity {
+		cpuCap, memCap, ephemeralCap = cpuAlloc, memAlloc, node.EphemeralAllocKb
+	}
+	friendlyName := rtnd.ResourceDesc.GetFriendlyName() + "_" + zone.Name
+	zoneUUID := nw.generateResourceID(node, friendlyName)
+	zoneRtnd := &firmament.ResourceTopologyNodeDescriptor{
+		ResourceDesc: &firmament.ResourceDescriptor{
+			Uuid:         zoneUUID,
+			Type:         firmament.ResourceDescriptor_RESOURCE_NUMA_NODE,
+			State:        firmament.ResourceDescriptor_RESOURCE_IDLE,
+			FriendlyName: friendlyName,
+			Labels:       rtnd.ResourceDesc.Labels,
+			ResourceCapacity: &firmament.ResourceVector{
+				RamCap:   nw.overcommitMem(memCap),
+				CpuCores: nw.overcommitCPU(cpuCap),
+			},
+			AvailableResources: &firmament.ResourceVector{
+				RamCap:   nw.overcommitMem(memAlloc),
+				CpuCores: nw.overcommitCPU(cpuAlloc),
+			},
+			Taints: rtnd.ResourceDesc.Taints,
+		},
+		ParentId: rtnd.ResourceDesc.Uuid,
+	}
+	rtnd.Children = append(rtnd.Children, zoneRtnd)
+	// Ephemeral storage is not bound to a NUMA node, every zone may use the storage of the machine.
+	nw.createPU(node, zoneRtnd, friendlyName+"_PU #0", &firmament.ResourceVector{
+		RamCap:       nw.overcommitMem(memCap),
+		CpuCores:     nw.overcommitCPU(cpuCap),
+		EphemeralCap: uint64(ephemeralCap),
+	})
+}
+
+// createPU adds a PU with the given capacity below the parent resource.
+func (nw *NodeWatcher) createPU(node *Node, parent *firmament.ResourceTopologyNodeDescriptor, friendlyName string, capacity *firmament.ResourceVector) {
+	puUUID := nw.generateResourceID(node, friendlyName)
+	puRtnd := &firmament.ResourceTopologyNodeDescriptor{
+		ResourceDesc: &firmament.ResourceDescriptor{
+			Uuid:             puUUID,
+			Type:             firmament.ResourceDescriptor_RESOURCE_PU,
+			State:            firmament.ResourceDescriptor_RESOURCE_IDLE,
+			FriendlyName:     friendlyName,
+			Labels:           parent.ResourceDesc.Labels,
+			ResourceCapacity: capacity,
+			Taints:           parent.ResourceDesc.Taints,
+		},
+		ParentId: parent.ResourceDesc.Uuid,
+	}
+	parent.Children = append(parent.Children, puRtnd)
+}
+
+// puCount returns the number of PUs of a node without NUMA zones, at least 1 with AutoPUs.
+func (nw *NodeWatcher) puCount(node *Node) int {
+	if nw.cfg.PUsPerMachine != AutoPUs {
+		return nw.cfg.PUsPerMachine
+	}
+	if cores := int(node.CPUCapacity / units.MilliPerCore); cores > 1 {
+		return cores
+	}
+	return 1
+}
+
+// splitResourceVector splits the capacity evenly among n PUs, the remainders of the integer resources are given
+// to the first PUs so that the PUs add up to the capacity.
+func splitResourceVector(capacity *firmament.ResourceVector, n int) []*firmament.ResourceVector {
+	if n < 1 {
+		n = 1
+	}
+	share := func(total uint64, i int) uint64 {
+		value := total / uint64(n)
+		if uint64(i) < total%uint64(n) {
+			value++
+		}
+		return value
+	}
+	vectors := make([]*firmament.ResourceVector, n)
+	for i := range vectors {
+		vectors[i] = &firmament.ResourceVector{
+			CpuCores:     capacity.GetCpuCores() / float32(n),
+			RamCap:       share(capacity.GetRamCap(), i),
+			EphemeralCap: share(capacity.GetEphemeralCap(), i),
+		}
+	}
+	return vectors
+}
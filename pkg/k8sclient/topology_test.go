@@ -0,0 +1,274 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament/firmamenttest"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeNodeResourceTopology is a NodeResourceTopology object of a node with two NUMA zones.
+const fakeNodeResourceTopology = `{
+	"apiVersion": "topology.node.k8s.io/v1alpha1",
+	"kind": "NodeResourceTopology",
+	"metadata": {"name": "node0"},
+	"topologyPolicies": ["SingleNUMANodeContainerLevel"],
+	"zones": [
+		{
+			"name": "node-0",
+			"type": "Node",
+			"resources": [
+				{"name": "cpu", "capacity": "4", "allocatable": "3"},
+				{"name": "memory", "capacity": "8Gi", "allocatable": "7Gi"}
+			]
+		},
+		{
+			"name": "node-1",
+			"type": "Node",
+			"resources": [
+				{"name": "cpu", "capacity": "4", "allocatable": "4"},
+				{"name": "memory", "capacity": "8Gi", "allocatable": "8Gi"}
+			]
+		},
+		{
+			"name": "cache-0",
+			"type": "L3Cache"
+		}
+	]
+}`
+
+// TestNodeWatcher_createResourceTopologyForNodeNUMAZones checks that a node with a NodeResourceTopology object
+// is advertised with a NUMA node resource per zone, each holding a PU with the capacity of its zone.
+func TestNodeWatcher_createResourceTopologyForNodeNUMAZones(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Return(
+		&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil).Times(2)
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc,
+		WithNodeTopologyFunc(func(nodeName string) (*NodeResourceTopology, error) {
+			if nodeName != "node0" {
+				// The node has no NodeResourceTopology object.
+				return nil, nil
+			}
+			return parseNodeResourceTopology([]byte(fakeNodeResourceTopology))
+		}),
+		WithResourceIDFunc(func(node *Node, friendlyName string) string {
+			return friendlyName
+		}))
+
+	for _, nodeName := range []string{"node0", "node1"} {
+		nodeWatch.processNodes(context.Background(), []interface{}{&Node{
+			Hostname:         nodeName,
+			Phase:            NodeAdded,
+			CPUCapacity:      8000,
+			CPUAllocatable:   7000,
+			MemCapacityKb:    16384,
+			MemAllocatableKb: 15360,
+		}})
+	}
+
+	// The allocatable resources of the zones are advertised.
+	zoneCPUs := []float32{3000, 4000}
+	zoneMems := []string{"7Gi", "8Gi"}
+	rtnd := NodeToRTND["node0"]
+	if len(rtnd.GetChildren()) != 2 {
+		t.Fatalf("expected 2 NUMA zones, got %v", rtnd.GetChildren())
+	}
+	for i, zoneRtnd := range rtnd.GetChildren() {
+		zoneName := fmt.Sprintf("node0_node-%d", i)
+		desc := zoneRtnd.GetResourceDesc()
+		zoneCPU := zoneCPUs[i]
+		zoneMemQuantity := resource.MustParse(zoneMems[i])
+		zoneMem := uint64(zoneMemQuantity.MilliValue())
+		if desc.GetType() != firmament.ResourceDescriptor_RESOURCE_NUMA_NODE || desc.GetUuid() != zoneName || zoneRtnd.GetParentId() != "node0" {
+			t.Errorf("expected NUMA zone %s below node0, got %v", zoneName, zoneRtnd)
+		}
+		if desc.GetResourceCapacity().GetCpuCores() != zoneCPU || desc.GetResourceCapacity().GetRamCap() != zoneMem {
+			t.Errorf("expected zone %s capacity cpu %v mem %v, got %v", zoneName, zoneCPU, zoneMem, desc.GetResourceCapacity())
+		}
+		if len(zoneRtnd.GetChildren()) != 1 {
+			t.Fatalf("expected a PU below zone %s, got %v", zoneName, zoneRtnd.GetChildren())
+		}
+		pu := zoneRtnd.GetChildren()[0]
+		if pu.GetResourceDesc().GetType() != firmament.ResourceDescriptor_RESOURCE_PU || pu.GetParentId() != zoneName ||
+			pu.GetResourceDesc().GetResourceCapacity().GetCpuCores() != zoneCPU {
+			t.Errorf("expected a PU with the capacity of zone %s, got %v", zoneName, pu)
+		}
+		for _, resID := range []string{zoneName, pu.GetResourceDesc().GetUuid()} {
+			if ResIDToNode[resID] != "node0" {
+				t.Errorf("expected resource %s to be registered for node0, got %q", resID, ResIDToNode[resID])
+			}
+		}
+	}
+	if got := rtnd.GetChildren()[0].GetResourceDesc().GetAvailableResources().GetCpuCores(); got != 3000 {
+		t.Error("expected available cpu 3000 in the first zone, got ", got)
+	}
+
+	// A node without NodeResourceTopology object falls back to a single PU.
+	flat := NodeToRTND["node1"]
+	if len(flat.GetChildren()) != 1 || flat.GetChildren()[0].GetResourceDesc().GetUuid() != "node1_PU #0" {
+		t.Errorf("expected a single PU for node1, got %v", flat.GetChildren())
+	}
+	if nodeWatch.checkStateConsistency() != 0 {
+		t.Error("expected the resources of the zones to be consistent")
+	}
+}
+
+func TestGetNUMAZones(t *testing.T) {
+	topology, err := parseNodeResourceTopology([]byte(fakeNodeResourceTopology))
+	if err != nil {
+		t.Fatal("error parsing the NodeResourceTopology ", err)
+	}
+	var testData = []struct {
+		topology *NodeResourceTopology
+		expected int
+	}{
+		{topology: nil, expected: 0},
+		{topology: &NodeResourceTopology{}, expected: 0},
+		// Zones without cpu or memory are skipped.
+		{topology: &NodeResourceTopology{Zones: []TopologyZone{{Name: "node-0", Type: NUMAZoneType}}}, expected: 0},
+		{topology: topology, expected: 2},
+	}
+
+	for _, data := range testData {
+		if got := len(getNUMAZones(data.topology)); got != data.expected {
+			t.Errorf("topology %v: expected %d zones got %d", data.topology, data.expected, got)
+		}
+	}
+	if _, err := parseNodeResourceTopology([]byte("{")); err == nil {
+		t.Error("expected an error for a malformed NodeResourceTopology")
+	}
+}
+
+// TestNodeWatcher_partialNodeAdded fails the addition of a node with two NUMA zones, and checks that the node state
+// is rolled back and the node queued again, and that the topology firmament may have applied is removed before the
+// node is added again.
+// TestNodeWatcher_createResourceTopologyForNodePUs checks that the capacity of a node is split evenly among
+// PUsPerMachine PUs, which are registered in ResIDToNode and cleaned once the node is deleted.
+func TestNodeWatcher_createResourceTopologyForNodePUs(t *testing.T) {
+	fc := firmamenttest.NewFakeClient()
+	cfg := DefaultNodeWatcherConfig()
+	cfg.PUsPerMachine = 4
+	nodeWatch := NewNodeWatcher(&fake.Clientset{}, fc, WithNodeWatcherConfig(cfg),
+		WithResourceIDFunc(func(node *Node, friendlyName string) string {
+			return friendlyName
+		}))
+	node := &Node{
+		Hostname:         "node0",
+		Phase:            NodeAdded,
+		CPUCapacity:      8000,
+		CPUAllocatable:   8000,
+		MemCapacityKb:    16386,
+		MemAllocatableKb: 16386,
+	}
+
+	nodeWatch.processNodes(context.Background(), []interface{}{node})
+	rtnd := NodeToRTND["node0"]
+	if len(rtnd.GetChildren()) != 4 {
+		t.Fatalf("expected 4 PUs, got %v", rtnd.GetChildren())
+	}
+	var mem uint64
+	for i, pu := range rtnd.GetChildren() {
+		desc := pu.GetResourceDesc()
+		puName := fmt.Sprintf("node0_PU #%d", i)
+		if desc.GetType() != firmament.ResourceDescriptor_RESOURCE_PU || desc.GetUuid() != puName || pu.GetParentId() != "node0" {
+			t.Errorf("expected PU %s below node0, got %v", puName, pu)
+		}
+		if got := desc.GetResourceCapacity().GetCpuCores(); got != 2000 {
+			t.Errorf("expected PU %s cpu capacity 2000, got %v", puName, got)
+		}
+		// The remainder of the memory is given to the first PUs.
+		expectedMem := uint64(4096)
+		if i < 2 {
+			expectedMem++
+		}
+		if got := desc.GetResourceCapacity().GetRamCap(); got != expectedMem {
+			t.Errorf("expected PU %s memory capacity %d, got %d", puName, expectedMem, got)
+		}
+		mem += desc.GetResourceCapacity().GetRamCap()
+		if ResIDToNode[puName] != "node0" {
+			t.Errorf("expected PU %s to be registered for node0, got %q", puName, ResIDToNode[puName])
+		}
+	}
+	if mem != rtnd.GetResourceDesc().GetResourceCapacity().GetRamCap() {
+		t.Errorf("expected the PUs to add up to the memory of the node, got %d", mem)
+	}
+	if len(ResIDToNode) != 5 || nodeWatch.checkStateConsistency() != 0 {
+		t.Errorf("expected the node and its 4 PUs to be registered, got %v", ResIDToNode)
+	}
+
+	nodeWatch.processNodes(context.Background(), []interface{}{&Node{Hostname: "node0", Phase: NodeDeleted}})
+	fc.ExpectMethods(t, "NodeAdded", "NodeRemoved")
+	if len(NodeToRTND) != 0 || len(ResIDToNode) != 0 {
+		t.Errorf("expected the node and its PUs to be cleaned, got %v %v", NodeToRTND, ResIDToNode)
+	}
+
+	// AutoPUs advertises a PU per core.
+	nodeWatch.cfg.PUsPerMachine = AutoPUs
+	if got := len(nodeWatch.createResourceTopologyForNode(node).GetChildren()); got != 8 {
+		t.Errorf("expected a PU per core, got %d PUs", got)
+	}
+	node.CPUCapacity = 500
+	if got := len(nodeWatch.createResourceTopologyForNode(node).GetChildren()); got != 1 {
+		t.Errorf("expected a single PU for a node of less than a core, got %d PUs", got)
+	}
+}
+
+func TestNodeWatcher_partialNodeAdded(t *testing.T) {
+	fc := firmamenttest.NewFakeClient()
+	fc.InjectError("NodeAdded", timeoutError)
+	nodeWatch := NewNodeWatcher(&fake.Clientset{}, fc,
+		WithNodeTopologyFunc(func(nodeName string) (*NodeResourceTopology, error) {
+			return parseNodeResourceTopology([]byte(fakeNodeResourceTopology))
+		}),
+		WithResourceIDFunc(func(node *Node, friendlyName string) string {
+			return friendlyName
+		}))
+	nodeWatch.nodeWorkQueue.Add("node0", &Node{
+		Hostname:         "node0",
+		Phase:            NodeAdded,
+		CPUCapacity:      8000,
+		CPUAllocatable:   7000,
+		MemCapacityKb:    16384,
+		MemAllocatableKb: 15360,
+	})
+
+	nodeWatch.processNextItem()
+	if len(NodeToRTND) != 0 || len(ResIDToNode) != 0 {
+		t.Errorf("expected the failed addition to be rolled back, got %v %v", NodeToRTND, ResIDToNode)
+	}
+	if got := nodeWatch.nodeWorkQueue.Len(); got != 1 {
+		t.Fatalf("expected the node to be queued again, got %d queued nodes", got)
+	}
+
+	nodeWatch.processNextItem()
+	fc.ExpectMethods(t, "NodeAdded", "NodeRemoved", "NodeAdded")
+	fc.ExpectNodes(t, "NodeRemoved", "node0")
+	if rtnd, ok := NodeToRTND["node0"]; !ok || len(rtnd.GetChildren()) != 2 {
+		t.Errorf("expected node0 to be added with its 2 NUMA zones, got %v", rtnd)
+	}
+	if len(ResIDToNode) != 5 {
+		t.Errorf("expected the 5 resources of node0 to be registered, got %v", ResIDToNode)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Attributes of the node watcher spans.
+const (
+	traceNodeAttribute       = "node.hostname"
+	tracePhaseAttribute      = "node.phase"
+	traceResourceIDAttribute = "resource.uuid"
+)
+
+// TraceSpan is a traced operation, ended once the operation is done.
+type TraceSpan interface {
+	End()
+}
+
+// NodeTracer traces the processing of the node events and the requests sent to firmament, e.g. on top of
+// an OpenTelemetry tracer. No span is recorded by default.
+type NodeTracer interface {
+	// Start starts a span, child of the span carried by the context if any, and returns the context carrying it.
+	Start(ctx context.Context, name string, attributes map[string]string) (context.Context, TraceSpan)
+	// Inject returns the trace context of the span carried by the context, as gRPC metadata key/value pairs.
+	Inject(ctx context.Context) map[string]string
+}
+
+type noopTracer struct{}
+
+type noopSpan struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attributes map[string]string) (context.Context, TraceSpan) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) Inject(ctx context.Context) map[string]string {
+	return nil
+}
+
+func (noopSpan) End() {}
+
+// WithNodeTracer traces the node events processed by the node workers with the tracer.
+func WithNodeTracer(tracer NodeTracer) NodeWatcherOption {
+	return func(nw *NodeWatcher) {
+		nw.tracer = tracer
+	}
+}
+
+// traceFirmamentRequest runs a request to firmament within a child span of the span of the node event.
+// The trace context is propagated to firmament in the gRPC metadata of the request. The error of the request is returned.
+func (nw *NodeWatcher) traceFirmamentRequest(ctx context.Context, name string, node *Node, resourceID string, request func(ctx context.Context) error) error {
+	ctx, span := nw.tracer.Start(ctx, name, map[string]string{
+		traceNodeAttribute:       node.Hostname,
+		tracePhaseAttribute:      string(node.Phase),
+		traceResourceIDAttribute: resourceID,
+	})
+	defer span.End()
+	for key, value := range nw.tracer.Inject(ctx) {
+		ctx = metadata.AppendToOutgoingContext(ctx, key, value)
+	}
+	return request(ctx)
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/client-go/tools/cache"
+)
+
+type recordedSpanKey struct{}
+
+// recordedSpan is a span recorded in memory by the spanRecorder.
+type recordedSpan struct {
+	id         int
+	parent     int
+	name       string
+	attributes map[string]string
+	ended      bool
+}
+
+// spanRecorder is a NodeTracer recording the spans in memory.
+type spanRecorder struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *spanRecorder) Start(ctx context.Context, name string, attributes map[string]string) (context.Context, TraceSpan) {
+	r.Lock()
+	defer r.Unlock()
+	span := &recordedSpan{id: len(r.spans) + 1, name: name, attributes: attributes}
+	if parent, ok := ctx.Value(recordedSpanKey{}).(*recordedSpan); ok {
+		span.parent = parent.id
+	}
+	r.spans = append(r.spans, span)
+	return context.WithValue(ctx, recordedSpanKey{}, span), span
+}
+
+func (r *spanRecorder) Inject(ctx context.Context) map[string]string {
+	span := ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	return map[string]string{"trace-span": fmt.Sprint(span.id)}
+}
+
+func (s *recordedSpan) End() {
+	s.ended = true
+}
+
+// TestNodeWatcher_tracing checks that a span is recorded for every processed node event, with a child span
+// for the request sent to firmament whose trace context is propagated in the gRPC metadata.
+func TestNodeWatcher_tracing(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	recorder := &spanRecorder{}
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc, WithNodeTracer(recorder))
+
+	var propagated []string
+	testObj.firmamentClient.EXPECT().NodeAdded(gomock.Any(), gomock.Any()).Do(func(ctx, rtnd interface{}, opts ...interface{}) {
+		md, _ := metadata.FromOutgoingContext(ctx.(context.Context))
+		propagated = append(propagated, md["trace-span"]...)
+	}).Return(&firmament.NodeAddedResponse{Type: firmament.NodeReplyType_NODE_ADDED_OK}, nil).Times(2)
+	for _, name := range []string{"node0", "node1"} {
+		node := BuildNode(name, "10", "10000000", nil, nil, false)
+		key, err := cache.MetaNamespaceKeyFunc(node)
+		if err != nil {
+			t.Fatal("error getting key ", err)
+		}
+		nodeWatch.enqueueNodeAddition(key, node)
+	}
+	nodeWatch.processNextItem()
+	nodeWatch.processNextItem()
+
+	if len(recorder.spans) != 4 {
+		t.Fatalf("expected a span per node event and per firmament request, got %d spans", len(recorder.spans))
+	}
+	for i, name := range []string{"node0", "node1"} {
+		eventSpan, requestSpan := recorder.spans[2*i], recorder.spans[2*i+1]
+		if eventSpan.name != "poseidon.ProcessNode" || eventSpan.parent != 0 || eventSpan.attributes[traceNodeAttribute] != name {
+			t.Errorf("expected a root span for the event of %s, got %+v", name, eventSpan)
+		}
+		if requestSpan.name != "firmament.NodeAdded" || requestSpan.parent != eventSpan.id ||
+			requestSpan.attributes[traceNodeAttribute] != name ||
+			requestSpan.attributes[tracePhaseAttribute] != string(NodeAdded) ||
+			requestSpan.attributes[traceResourceIDAttribute] != NodeToRTND[name].GetResourceDesc().GetUuid() {
+			t.Errorf("expected a child span for the NodeAdded request of %s, got %+v", name, requestSpan)
+		}
+		if !eventSpan.ended || !requestSpan.ended {
+			t.Errorf("expected the spans of %s to be ended", name)
+		}
+		if i >= len(propagated) || propagated[i] != fmt.Sprint(requestSpan.id) {
+			t.Errorf("expected the trace context of span %d to be propagated to firmament, got %v", requestSpan.id, propagated)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package k8sclient
 
 import (
 	"sync"
+	"time"
 
 	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
 	"k8s.io/api/core/v1"
@@ -26,8 +27,6 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
-const bytesToKb = 1024
-
 // PodMux is used to guard access to the pod, task and job related maps.
 var PodMux *sync.RWMutex
 
@@ -36,18 +35,25 @@ var PodToTD map[PodIdentifier]*firmament.TaskDescriptor
 
 // TaskIDToPod maps firmament task ID to Kubernetes pod identifier(namespace + name).
 var TaskIDToPod map[uint64]PodIdentifier
+
+// taskSubmitTime maps firmament task ID to the time the task was submitted to firmament.
+var taskSubmitTime map[uint64]time.Time
 var jobIDToJD map[string]*firmament.JobDescriptor
 var jobNumTasksToRemove map[string]int
 
 // NodeMux is used to guard access to the node and resource related maps.
-var NodeMux *sync.RWMutex
+var NodeMux = new(sync.RWMutex)
 
 // NodeToRTND maps node name to firmament resource topology node descriptor.
 var NodeToRTND map[string]*firmament.ResourceTopologyNodeDescriptor
 
-// ResIDToNode maps resource ID to node name.
+// ResIDToNode maps resource ID to node name, for the machine and every resource below it.
+// The entries of a node are only added and removed by the node worker while holding NodeMux.
 var ResIDToNode map[string]string
 
+// nodeToUID maps node name to the UID of the node tracked in NodeToRTND, to detect the nodes sharing a name.
+var nodeToUID map[string]string
+
 // NodePhase represents a node phase.
 type NodePhase string
 
@@ -60,6 +66,8 @@ const (
 	NodeFailed NodePhase = "Failed"
 	// NodeUpdated represents a node updated phase.
 	NodeUpdated NodePhase = "Updated"
+	// NodeRecovered represents a node schedulable again after a failure.
+	NodeRecovered NodePhase = "Recovered"
 )
 
 type Taint struct {
@@ -81,6 +89,7 @@ type Taint struct {
 // Node is an internal structure for a Kubernetes node.
 type Node struct {
 	Hostname         string
+	UID              string
 	Phase            NodePhase
 	IsReady          bool
 	IsOutOfDisk      bool
@@ -91,9 +100,15 @@ type Node struct {
 	EphemeralCapKb   int64
 	EphemeralAllocKb int64
 	PodAllocatable   int64
-	Labels           map[string]string
-	Annotations      map[string]string
-	Taints           []Taint
+	// Hugepages capacities keyed by the hugepages resource name, e.g. hugepages-2Mi.
+	HugePagesCapKb map[v1.ResourceName]int64
+	Labels         map[string]string
+	Annotations    map[string]string
+	Taints         []Taint
+	// Internal IP, external IP and hostname addresses of the node, both address families of a dual-stack node.
+	Addresses []v1.NodeAddress
+	// Topology of the node read from its NodeResourceTopology object, nil for a flat topology.
+	Topology *NodeResourceTopology
 }
 
 // PodPhase represents a pod phase.
@@ -114,6 +129,8 @@ const (
 	PodDeleted PodPhase = "Deleted"
 	// PodUpdated is an internal phase for pods that are externally updated.
 	PodUpdated PodPhase = "Updated"
+	// PodPreassigned is an internal phase used for pods placed onto a node without poseidon.
+	PodPreassigned PodPhase = "Preassigned"
 )
 
 // PodIdentifier is used to identify a pod by its namespace and name.
@@ -215,6 +232,12 @@ type Pod struct {
 	CPURequest      int64
 	MemRequestKb    int64
 	EphemeralReqKb  int64
+	CPULimit        int64
+	MemLimitKb      int64
+	EphemeralLimKb  int64
+	QOSClass        v1.PodQOSClass
+	DefaultRequest  string
+	SchedulerName   string
 	Labels          map[string]string
 	Annotations     map[string]string
 	NodeSelector    map[string]string
@@ -224,6 +247,13 @@ type Pod struct {
 	Tolerations     []Toleration
 	OwnerKind       string
 	OwnerUid        string
+	Priority        int32
+	QoSPriority     int32
+	ExitInfo        string
+	Gang            string
+	GangSize        int
+	NodeName        string
+	HostPorts       []HostPort
 }
 
 // NodeWatcher is a Kubernetes node watcher.
@@ -232,16 +262,75 @@ type NodeWatcher struct {
 	clientset     kubernetes.Interface
 	nodeWorkQueue Queue
 	controller    cache.Controller
-	fc            firmament.FirmamentSchedulerClient
+	fc            firmament.Client
+	// sharedInformer is set when the controller is a shared informer run by its owner, see
+	// NewNodeWatcherWithInformer.
+	sharedInformer bool
+	// cfg holds the tunables of the watcher, see NodeWatcherConfig.
+	cfg NodeWatcherConfig
+	// resourceIDFunc generates the firmament resource IDs of the nodes.
+	resourceIDFunc ResourceIDFunc
+	// friendlyNameFunc generates the firmament friendly names of the machines.
+	friendlyNameFunc FriendlyNameFunc
+	// topologyFunc reads the NUMA zones of the nodes, the nodes have a flat topology when nil.
+	topologyFunc NodeTopologyFunc
+	// Nodes which are not ready are only failed once they stayed not ready for the grace period,
+	// notReadyTimers holds the timers of the nodes within their grace period.
+	notReadyLock   *sync.Mutex
+	notReadyTimers map[string]*time.Timer
+	// deferredNodes holds the nodes which are not added yet because they report zero allocatable
+	// cpu or memory, e.g. during their boot. They are added once an update reports real values.
+	deferredLock  *sync.Mutex
+	deferredNodes map[string]bool
+	// nodeAdded is closed and replaced whenever a node is added, waking up the WaitForNodes callers.
+	nodeAddedLock *sync.Mutex
+	nodeAdded     chan struct{}
+	// partialNodes holds the machine resource IDs of the nodes whose addition to firmament failed, their
+	// topology is removed from firmament before they are added again.
+	partialLock  *sync.Mutex
+	partialNodes map[string]string
+	// backlog counts the node events in flight and pauses the event handlers above MaxInFlightNodeEvents.
+	backlog *backlogLimiter
+	// tracer traces the node events processed by the workers.
+	tracer NodeTracer
+	// observers are notified of the node topology changes.
+	observers []NodeObserver
+	// failureLog limits the logs of the changes processed again by node, while firmament is down.
+	failureLog *firmament.LogLimiter
+	// watchErrors tracks the list/watch failures of the node informer, see Ready.
+	watchErrors *watchErrorTracker
 }
 
 // PodWatcher is a Kubernetes pod watcher.
 type PodWatcher struct {
 	//ID string
+	cfg          PodWatcherConfig
 	clientset    kubernetes.Interface
 	podWorkQueue Queue
-	controller   cache.Controller
-	fc           firmament.FirmamentSchedulerClient
+	controllers  []cache.Controller
+	fc           firmament.Client
+	// Requests applied to the containers without cpu and memory requests and limits.
+	defaultRequests v1.ResourceList
+	// Base priorities of the QoS classes, added to the task priorities of the pods.
+	qosPriorities map[v1.PodQOSClass]int32
+	// Scheduler names serviced by the watcher, pods are filtered by the watcher when
+	// filterSchedulerNames is set.
+	schedulerNames       map[string]bool
+	filterSchedulerNames bool
+	// batcher batches the task submissions, the tasks are submitted right away when it is nil.
+	batcher *taskBatcher
+	// namespaces selects the namespaces whose pods are handled.
+	namespaces namespaceFilter
+	// memoryUnit is the unit of the memory requests and limits sent to firmament, the unit of the node watcher.
+	memoryUnit MemoryUnit
+	// namespaceQueues holds a work queue per namespace when the pods of the namespaces are processed
+	// independently, podWorkQueue holds the pods of all the namespaces when it is nil.
+	namespaceQueues *namespaceQueues
+	// Caches of the persistent volumes and claims used by the pods.
+	volumeStore cache.Store
+	claimStore  cache.Store
+	// failureLog limits the logs of the task requests sent again by request, while firmament is down.
+	failureLog *firmament.LogLimiter
 }
 
 // BindInfo
@@ -264,7 +353,7 @@ type K8sPodWatcher struct {
 	//ID string
 	clientset  kubernetes.Interface
 	controller cache.Controller
-	fc         firmament.FirmamentSchedulerClient
+	fc         firmament.Client
 	K8sPods    map[string]*firmament.TaskInfo
 	sync.Mutex
 }
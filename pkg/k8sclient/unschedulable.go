@@ -0,0 +1,183 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Reasons for which a node cannot run a pod, reported in the PodScheduled condition of unschedulable pods.
+const (
+	insufficientCPUReason       = "Insufficient cpu"
+	insufficientMemoryReason    = "Insufficient memory"
+	insufficientEphemeralReason = "Insufficient ephemeral-storage"
+	nodeSelectorMismatchReason  = "node(s) didn't match node selector"
+	untoleratedTaintReason      = "node(s) had taints that the pod didn't tolerate"
+)
+
+// unschedulableTimeoutExpired checks if the task was submitted to firmament at least the unschedulable timeout ago.
+// Tasks without a submit time are considered expired.
+func unschedulableTimeoutExpired(taskID uint64, now time.Time) bool {
+	PodMux.RLock()
+	submitTime, ok := taskSubmitTime[taskID]
+	PodMux.RUnlock()
+	if !ok {
+		return true
+	}
+	return now.Sub(submitTime) >= time.Duration(config.GetUnschedulableTimeout())*time.Second
+}
+
+// getUnschedulableMessage summarizes why the nodes known to poseidon cannot run the pod, in the same
+// format as kube-scheduler, e.g. "0/3 nodes are available: 1 Insufficient cpu, 2 node(s) didn't match node selector.".
+func getUnschedulableMessage(podIdentifier PodIdentifier) string {
+	PodMux.RLock()
+	td, ok := PodToTD[podIdentifier]
+	PodMux.RUnlock()
+	if !ok {
+		return "Firmament unable to schedule the pod"
+	}
+	reasonCounts := make(map[string]int)
+	NodeMux.RLock()
+	numNodes := len(NodeToRTND)
+	for _, rtnd := range NodeToRTND {
+		for _, reason := range getNodeUnfitReasons(td, rtnd.GetResourceDesc()) {
+			reasonCounts[reason]++
+		}
+	}
+	NodeMux.RUnlock()
+	if len(reasonCounts) == 0 {
+		return fmt.Sprintf("0/%d nodes are available: firmament found no feasible placement.", numNodes)
+	}
+	var reasons []string
+	for reason, count := range reasonCounts {
+		reasons = append(reasons, fmt.Sprintf("%d %s", count, reason))
+	}
+	sort.Strings(reasons)
+	return fmt.Sprintf("0/%d nodes are available: %s.", numNodes, strings.Join(reasons, ", "))
+}
+
+// getNodeUnfitReasons returns the reasons for which the resource cannot run the task.
+func getNodeUnfitReasons(td *firmament.TaskDescriptor, rd *firmament.ResourceDescriptor) []string {
+	var reasons []string
+	request := td.GetResourceRequest()
+	available := rd.GetAvailableResources()
+	if request.GetCpuCores() > available.GetCpuCores() {
+		reasons = append(reasons, insufficientCPUReason)
+	}
+	if request.GetRamCap() > available.GetRamCap() {
+		reasons = append(reasons, insufficientMemoryReason)
+	}
+	if request.GetEphemeralCap() > available.GetEphemeralCap() {
+		reasons = append(reasons, insufficientEphemeralReason)
+	}
+	labels := make(map[string]string)
+	for _, label := range rd.GetLabels() {
+		labels[label.GetKey()] = label.GetValue()
+	}
+	for _, labelSelector := range td.GetLabelSelectors() {
+		if !labelSelectorMatches(labelSelector, labels) {
+			reasons = append(reasons, nodeSelectorMismatchReason)
+			break
+		}
+	}
+	untolerated := getUntoleratedTaints(tolerationsFromFirmament(td.GetToleration()), taintsFromFirmament(rd.GetTaints()), v1.TaintEffectNoSchedule, v1.TaintEffectNoExecute)
+	if len(untolerated) > 0 {
+		reasons = append(reasons, untoleratedTaintReason)
+	}
+	return reasons
+}
+
+func labelSelectorMatches(labelSelector *firmament.LabelSelector, labels map[string]string) bool {
+	value, exists := labels[labelSelector.GetKey()]
+	switch labelSelector.GetType() {
+	case firmament.LabelSelector_IN_SET:
+		return exists && containsString(labelSelector.GetValues(), value)
+	case firmament.LabelSelector_NOT_IN_SET:
+		return !exists || !containsString(labelSelector.GetValues(), value)
+	case firmament.LabelSelector_EXISTS_KEY:
+		return exists
+	case firmament.LabelSelector_NOT_EXISTS_KEY:
+		return !exists
+	case firmament.LabelSelector_GREATER_THAN, firmament.LabelSelector_LESSER_THAN:
+		if !exists || len(labelSelector.GetValues()) != 1 {
+			return false
+		}
+		nodeValue, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		selectorValue, err := strconv.ParseInt(labelSelector.GetValues()[0], 10, 64)
+		if err != nil {
+			return false
+		}
+		if labelSelector.GetType() == firmament.LabelSelector_GREATER_THAN {
+			return nodeValue > selectorValue
+		}
+		return nodeValue < selectorValue
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// updatePodCondition sets the condition on the latest version of the pod, retrying on update conflicts.
+func updatePodCondition(client kubernetes.Interface, podIdentifier PodIdentifier, condition *v1.PodCondition) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		pod, err := client.CoreV1().Pods(podIdentifier.Namespace).Get(podIdentifier.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		return Update(client, pod, condition.DeepCopy())
+	})
+}
+
+// clearUnschedulableCondition overwrites the Unschedulable PodScheduled condition of a pod once it is bound.
+func clearUnschedulableCondition(client kubernetes.Interface, podIdentifier PodIdentifier) {
+	ProcessedPodEventsLock.Lock()
+	_, ok := ProcessedPodEvents[podIdentifier]
+	delete(ProcessedPodEvents, podIdentifier)
+	ProcessedPodEventsLock.Unlock()
+	if !ok {
+		return
+	}
+	err := updatePodCondition(client, podIdentifier, &v1.PodCondition{
+		Type:   v1.PodScheduled,
+		Status: v1.ConditionTrue,
+	})
+	if err != nil {
+		glog.Errorf("Could not clear the unschedulable condition of pod %v, err: %v", podIdentifier, err)
+	}
+}
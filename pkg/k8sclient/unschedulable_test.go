@@ -0,0 +1,166 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestGetUnschedulableMessage(t *testing.T) {
+	PodMux = new(sync.RWMutex)
+	NodeMux = new(sync.RWMutex)
+	podIdentifier := PodIdentifier{Name: "Pod1", Namespace: "Poseidon-Namespace"}
+	PodToTD = map[PodIdentifier]*firmament.TaskDescriptor{
+		podIdentifier: {
+			ResourceRequest: &firmament.ResourceVector{CpuCores: 2000, RamCap: 1024},
+			LabelSelectors: []*firmament.LabelSelector{
+				{Type: firmament.LabelSelector_IN_SET, Key: "disk", Values: []string{"ssd"}},
+			},
+		},
+	}
+	available := &firmament.ResourceVector{CpuCores: 4000, RamCap: 4096}
+	ssd := []*firmament.Label{{Key: "disk", Value: "ssd"}}
+	NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"small": {ResourceDesc: &firmament.ResourceDescriptor{
+			AvailableResources: &firmament.ResourceVector{CpuCores: 1000, RamCap: 4096},
+			Labels:             ssd,
+		}},
+		"hdd": {ResourceDesc: &firmament.ResourceDescriptor{
+			AvailableResources: available,
+			Labels:             []*firmament.Label{{Key: "disk", Value: "hdd"}},
+		}},
+		"tainted": {ResourceDesc: &firmament.ResourceDescriptor{
+			AvailableResources: available,
+			Labels:             ssd,
+			Taints:             []*firmament.Taint{{Key: "dedicated", Value: "user1", Effect: "NoSchedule"}},
+		}},
+	}
+
+	expected := "0/3 nodes are available: 1 Insufficient cpu, 1 node(s) didn't match node selector, 1 node(s) had taints that the pod didn't tolerate."
+	if got := getUnschedulableMessage(podIdentifier); got != expected {
+		t.Errorf("expected message %q got %q", expected, got)
+	}
+
+	// Firmament may not find a placement for reasons which are not visible to poseidon.
+	NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"fit": {ResourceDesc: &firmament.ResourceDescriptor{AvailableResources: available, Labels: ssd}},
+	}
+	expected = "0/1 nodes are available: firmament found no feasible placement."
+	if got := getUnschedulableMessage(podIdentifier); got != expected {
+		t.Errorf("expected message %q got %q", expected, got)
+	}
+}
+
+// TestPoseidonEvents_ProcessFailureEvents checks that the PodScheduled condition is only set once the
+// unschedulable timeout expired, that update conflicts are retried, and that the condition is
+// overwritten once the pod is bound.
+func TestPoseidonEvents_ProcessFailureEvents(t *testing.T) {
+	var empty map[string]string
+	pod := BuildPod("Poseidon-Namespace", "Pod1", empty, v1.PodPending, "2", "1024", nil, "owner")
+	podIdentifier := PodIdentifier{Name: "Pod1", Namespace: "Poseidon-Namespace"}
+	client := fake.NewSimpleClientset(pod)
+	statusConflicts := 0
+	client.PrependReactor("update", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "status" && statusConflicts == 0 {
+			statusConflicts++
+			return true, nil, errors.NewConflict(v1.Resource("pods"), "Pod1", fmt.Errorf("stale pod"))
+		}
+		return false, nil, nil
+	})
+
+	PodMux = new(sync.RWMutex)
+	NodeMux = new(sync.RWMutex)
+	PodToK8sPodLock = new(sync.Mutex)
+	ProcessedPodEventsLock = new(sync.Mutex)
+	PodToK8sPod = map[PodIdentifier]*v1.Pod{podIdentifier: pod}
+	ProcessedPodEvents = make(map[PodIdentifier]*v1.Pod)
+	PodToTD = map[PodIdentifier]*firmament.TaskDescriptor{
+		podIdentifier: {ResourceRequest: &firmament.ResourceVector{CpuCores: 2000}},
+	}
+	TaskIDToPod = map[uint64]PodIdentifier{1: podIdentifier}
+	taskSubmitTime = map[uint64]time.Time{1: time.Now()}
+	NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node1": {ResourceDesc: &firmament.ResourceDescriptor{
+			AvailableResources: &firmament.ResourceVector{CpuCores: 1000},
+		}},
+	}
+	recorder := record.NewFakeRecorder(10)
+	events := &PoseidonEvents{podEvents: &PodEvents{Recorder: recorder}, k8sClient: client}
+
+	getCondition := func() *v1.PodCondition {
+		pod, err := client.CoreV1().Pods("Poseidon-Namespace").Get("Pod1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("could not get pod, err: %v", err)
+		}
+		_, condition := GetPodCondition(&pod.Status, v1.PodScheduled)
+		return condition
+	}
+
+	// The task was just submitted, the pod is not marked as unschedulable yet.
+	events.ProcessFailureEvents([]uint64{1})
+	if condition := getCondition(); condition != nil {
+		t.Errorf("expected no PodScheduled condition before the timeout, got %v", condition)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no event before the timeout, got %d events", len(recorder.Events))
+	}
+
+	timeout := time.Duration(config.GetUnschedulableTimeout()) * time.Second
+	taskSubmitTime[1] = time.Now().Add(-timeout - time.Second)
+	events.ProcessFailureEvents([]uint64{1})
+	condition := getCondition()
+	if condition == nil || condition.Status != v1.ConditionFalse || condition.Reason != v1.PodReasonUnschedulable {
+		t.Fatalf("expected PodScheduled=False with reason Unschedulable, got %v", condition)
+	}
+	if expected := "0/1 nodes are available: 1 Insufficient cpu."; condition.Message != expected {
+		t.Errorf("expected message %q got %q", expected, condition.Message)
+	}
+	if statusConflicts != 1 {
+		t.Errorf("expected the status update to hit one conflict, got %d", statusConflicts)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected one FailedScheduling event, got %d events", len(recorder.Events))
+	}
+
+	// The failure is only reported once.
+	events.ProcessFailureEvents([]uint64{1})
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected the FailedScheduling event to be sent once, got %d events", len(recorder.Events))
+	}
+
+	// Firmament eventually places the pod.
+	clearUnschedulableCondition(client, podIdentifier)
+	if condition := getCondition(); condition == nil || condition.Status != v1.ConditionTrue || condition.Reason != "" {
+		t.Errorf("expected PodScheduled=True once the pod is bound, got %v", condition)
+	}
+	if _, ok := ProcessedPodEvents[podIdentifier]; ok {
+		t.Error("expected the pod to be removed from the processed pod events")
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"k8s.io/api/core/v1"
+)
+
+// appliedUsage is the usage subtracted from the available resources of a machine, see ApplyNodeUsage.
+type appliedUsage struct {
+	// rd is the resource descriptor the usage was subtracted from, a node added again gets a new one.
+	rd     *firmament.ResourceDescriptor
+	cpu    float32
+	ramCap uint64
+}
+
+// appliedUsages holds the usage subtracted from the machines by hostname, it is guarded by NodeMux.
+var appliedUsages = make(map[string]appliedUsage)
+
+// ApplyNodeUsage subtracts the usage of the nodes, e.g. read from metrics-server, from the resources available
+// on their machines, and sends the machines whose available resources changed to firmament. The usage
+// subtracted by the previous call is added back first, so that a node without usage, or every node when usage
+// is nil, falls back to its allocatable resources. The available resources never drop below zero.
+func ApplyNodeUsage(fc firmament.Client, usage map[string]v1.ResourceList) {
+	unit := MemoryUnit(config.GetMemoryUnit())
+	var updated []*firmament.ResourceTopologyNodeDescriptor
+	NodeMux.Lock()
+	hostnames := make([]string, 0, len(NodeToRTND))
+	for hostname := range NodeToRTND {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	for hostname, applied := range appliedUsages {
+		if rtnd, ok := NodeToRTND[hostname]; !ok || rtnd.GetResourceDesc() != applied.rd {
+			// The node was removed or added again since, the usage was not subtracted from its machine.
+			delete(appliedUsages, hostname)
+		}
+	}
+	for _, hostname := range hostnames {
+		rtnd := NodeToRTND[hostname]
+		available := rtnd.GetResourceDesc().GetAvailableResources()
+		if available == nil {
+			continue
+		}
+		previous := appliedUsages[hostname]
+		available.CpuCores += previous.cpu
+		available.RamCap += previous.ramCap
+		current := appliedUsage{rd: rtnd.GetResourceDesc()}
+		if resources, ok := usage[hostname]; ok {
+			current.cpu = float32(resources.Cpu().MilliValue())
+			if current.cpu > available.CpuCores {
+				current.cpu = available.CpuCores
+			}
+			if current.cpu < 0 {
+				current.cpu = 0
+			}
+			if mem := unit.memoryValue(*resources.Memory()); mem > 0 {
+				current.ramCap = uint64(mem)
+			}
+			if current.ramCap > available.RamCap {
+				current.ramCap = available.RamCap
+			}
+			available.CpuCores -= current.cpu
+			available.RamCap -= current.ramCap
+		}
+		if current.cpu == 0 && current.ramCap == 0 {
+			delete(appliedUsages, hostname)
+		} else {
+			appliedUsages[hostname] = current
+		}
+		if current.cpu != previous.cpu || current.ramCap != previous.ramCap {
+			updated = append(updated, rtnd)
+		}
+	}
+	NodeMux.Unlock()
+	for _, rtnd := range updated {
+		if err := fc.NodeUpdated(context.Background(), rtnd); err != nil {
+			glog.Errorf("Unable to update the available resources of machine %s: %v", rtnd.GetResourceDesc().GetFriendlyName(), err)
+		}
+	}
+}
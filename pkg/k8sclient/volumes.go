@@ -0,0 +1,343 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// SelectedNodeAnnotation is set on the WaitForFirstConsumer claims of a placed pod, the volume
+	// of the claim is provisioned on the annotated node.
+	SelectedNodeAnnotation = "volume.kubernetes.io/selected-node"
+	// BetaStorageClassAnnotation is the legacy way to set the storage class of a claim.
+	BetaStorageClassAnnotation = "volume.beta.kubernetes.io/storage-class"
+	// ZoneLabel and RegionLabel are set on the zonal volumes, e.g. EBS and GCE PD volumes, and on the nodes.
+	ZoneLabel   = "failure-domain.beta.kubernetes.io/zone"
+	RegionLabel = "failure-domain.beta.kubernetes.io/region"
+	// zonesSeparator separates the zones of the volumes replicated to several zones.
+	zonesSeparator = "__"
+)
+
+// VolumeMux is used to guard access to the volume related maps.
+var VolumeMux *sync.Mutex
+
+// claimToWaitingPods maps a claim key (namespace/name) to the pods which are not submitted until the claim is bound.
+var claimToWaitingPods map[string]map[PodIdentifier]*v1.Pod
+
+// podToDelayedClaims maps a pod to its unbound WaitForFirstConsumer claims, the node the pod is placed
+// onto is selected for these claims before the pod is bound.
+var podToDelayedClaims map[PodIdentifier][]string
+
+func newVolumeListWatch(client kubernetes.Interface) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(alo metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().PersistentVolumes().List(alo)
+		},
+		WatchFunc: func(alo metav1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().PersistentVolumes().Watch(alo)
+		},
+	}
+}
+
+func newClaimListWatch(client kubernetes.Interface) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(alo metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(alo)
+		},
+		WatchFunc: func(alo metav1.ListOptions) (watch.Interface, error) {
+			return client.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).Watch(alo)
+		},
+	}
+}
+
+// newVolumeInformers caches the persistent volumes and claims, and submits the pods waiting for a claim
+// once the claim is bound.
+func (pw *PodWatcher) newVolumeInformers() []cache.Controller {
+	var volumeController, claimController cache.Controller
+	pw.volumeStore, volumeController = cache.NewInformer(newVolumeListWatch(pw.clientset), &v1.PersistentVolume{}, 0, cache.ResourceEventHandlerFuncs{})
+	pw.claimStore, claimController = cache.NewInformer(
+		newClaimListWatch(pw.clientset),
+		&v1.PersistentVolumeClaim{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				pw.enqueueClaimUpdate(obj.(*v1.PersistentVolumeClaim))
+			},
+			UpdateFunc: func(old, new interface{}) {
+				pw.enqueueClaimUpdate(new.(*v1.PersistentVolumeClaim))
+			},
+		},
+	)
+	return []cache.Controller{volumeController, claimController}
+}
+
+// getClaim returns the claim from the informer cache, the API server is queried for the claims
+// which are not cached yet.
+func (pw *PodWatcher) getClaim(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	if pw.claimStore != nil {
+		if obj, exists, err := pw.claimStore.GetByKey(namespace + "/" + name); err == nil && exists {
+			return obj.(*v1.PersistentVolumeClaim), nil
+		}
+	}
+	return pw.clientset.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+}
+
+// getVolume returns the persistent volume from the informer cache, the API server is queried for the
+// volumes which are not cached yet.
+func (pw *PodWatcher) getVolume(name string) (*v1.PersistentVolume, error) {
+	if pw.volumeStore != nil {
+		if obj, exists, err := pw.volumeStore.GetByKey(name); err == nil && exists {
+			return obj.(*v1.PersistentVolume), nil
+		}
+	}
+	return pw.clientset.CoreV1().PersistentVolumes().Get(name, metav1.GetOptions{})
+}
+
+// getClaimStorageClass returns the storage class name of the claim, the beta annotation takes precedence.
+func getClaimStorageClass(claim *v1.PersistentVolumeClaim) string {
+	if class, ok := claim.Annotations[BetaStorageClassAnnotation]; ok {
+		return class
+	}
+	if claim.Spec.StorageClassName != nil {
+		return *claim.Spec.StorageClassName
+	}
+	return ""
+}
+
+// isDelayedBinding checks if the claim is only bound once a pod using it is placed.
+func (pw *PodWatcher) isDelayedBinding(claim *v1.PersistentVolumeClaim) bool {
+	className := getClaimStorageClass(claim)
+	if className == "" {
+		return false
+	}
+	class, err := pw.clientset.StorageV1().StorageClasses().Get(className, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("Could not get storage class %s of claim %s/%s, err: %v", className, claim.Namespace, claim.Name, err)
+		return false
+	}
+	return class.VolumeBindingMode != nil && *class.VolumeBindingMode == storagev1.VolumeBindingWaitForFirstConsumer
+}
+
+// getVolumeNodeSelectorTerms returns the node selector terms a node has to match to access the volume.
+// The zone and region labels of zonal volumes are required on every term.
+func getVolumeNodeSelectorTerms(pv *v1.PersistentVolume) []v1.NodeSelectorTerm {
+	var terms []v1.NodeSelectorTerm
+	if pv.Spec.NodeAffinity != nil && pv.Spec.NodeAffinity.Required != nil {
+		for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+			terms = append(terms, *term.DeepCopy())
+		}
+	}
+	var topology []v1.NodeSelectorRequirement
+	for _, key := range []string{ZoneLabel, RegionLabel} {
+		if value, ok := pv.Labels[key]; ok && value != "" {
+			topology = append(topology, v1.NodeSelectorRequirement{
+				Key:      key,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   strings.Split(value, zonesSeparator),
+			})
+		}
+	}
+	if len(topology) == 0 {
+		return terms
+	}
+	if len(terms) == 0 {
+		return []v1.NodeSelectorTerm{{MatchExpressions: topology}}
+	}
+	for i := range terms {
+		terms[i].MatchExpressions = append(terms[i].MatchExpressions, topology...)
+	}
+	return terms
+}
+
+// mergeNodeSelectorTerms requires the volume terms on top of the required node affinity of the pod.
+// Terms are ORed and the requirements of a term are ANDed, so every pod term is combined with every volume term.
+func mergeNodeSelectorTerms(pod *v1.Pod, volumeTerms []v1.NodeSelectorTerm) {
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &v1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &v1.NodeAffinity{}
+	}
+	nodeAffinity := pod.Spec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil ||
+		len(nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms) == 0 {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &v1.NodeSelector{NodeSelectorTerms: volumeTerms}
+		return
+	}
+	var merged []v1.NodeSelectorTerm
+	for _, podTerm := range nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		for _, volumeTerm := range volumeTerms {
+			term := podTerm.DeepCopy()
+			term.MatchExpressions = append(term.MatchExpressions, volumeTerm.MatchExpressions...)
+			term.MatchFields = append(term.MatchFields, volumeTerm.MatchFields...)
+			merged = append(merged, *term)
+		}
+	}
+	nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = merged
+}
+
+// getPVNodeAffinity adds the node affinity of the persistent volumes bound to the claims of the pod to the
+// required node affinity of the pod, so that firmament only places the pod onto nodes the volumes can be used on.
+// Pods with unbound claims are not submitted until the claims are bound, except for the WaitForFirstConsumer
+// claims which are bound once the pod is placed. It returns false if the pod can not be submitted yet.
+func (pw *PodWatcher) getPVNodeAffinity(volumes []v1.Volume, pod *v1.Pod) (*v1.Pod, bool) {
+	podIdentifier := PodIdentifier{Name: pod.Name, Namespace: pod.Namespace}
+	var volumeTerms [][]v1.NodeSelectorTerm
+	var delayedClaims []string
+	for _, volume := range volumes {
+		if volume.VolumeSource.PersistentVolumeClaim == nil {
+			continue
+		}
+		claimName := volume.VolumeSource.PersistentVolumeClaim.ClaimName
+		claim, err := pw.getClaim(pod.Namespace, claimName)
+		if errors.IsNotFound(err) {
+			holdPodForClaim(pod.Namespace+"/"+claimName, pod)
+			return nil, false
+		}
+		if err != nil {
+			glog.Errorf("Unable to retrieve the claim %s of pod %v, err: %v", claimName, podIdentifier, err)
+			return nil, false
+		}
+		if claim.Spec.VolumeName == "" {
+			if pw.isDelayedBinding(claim) {
+				delayedClaims = append(delayedClaims, claimName)
+				continue
+			}
+			holdPodForClaim(pod.Namespace+"/"+claimName, pod)
+			return nil, false
+		}
+		pv, err := pw.getVolume(claim.Spec.VolumeName)
+		if err != nil {
+			glog.Errorf("Unable to retrieve the volume %s bound to claim %s of pod %v, err: %v", claim.Spec.VolumeName, claimName, podIdentifier, err)
+			return nil, false
+		}
+		if terms := getVolumeNodeSelectorTerms(pv); len(terms) > 0 {
+			volumeTerms = append(volumeTerms, terms)
+		}
+	}
+	for _, terms := range volumeTerms {
+		mergeNodeSelectorTerms(pod, terms)
+	}
+	VolumeMux.Lock()
+	if len(delayedClaims) > 0 {
+		podToDelayedClaims[podIdentifier] = delayedClaims
+	} else {
+		delete(podToDelayedClaims, podIdentifier)
+	}
+	VolumeMux.Unlock()
+	return pod, true
+}
+
+// holdPodForClaim keeps the pod until the claim is bound.
+func holdPodForClaim(claimKey string, pod *v1.Pod) {
+	podIdentifier := PodIdentifier{Name: pod.Name, Namespace: pod.Namespace}
+	VolumeMux.Lock()
+	defer VolumeMux.Unlock()
+	if _, ok := claimToWaitingPods[claimKey]; !ok {
+		claimToWaitingPods[claimKey] = make(map[PodIdentifier]*v1.Pod)
+	}
+	claimToWaitingPods[claimKey][podIdentifier] = pod
+	glog.V(2).Infof("Pod %v waits for claim %s to be bound", podIdentifier, claimKey)
+}
+
+// updateWaitingPod replaces the pod waiting for a claim with its latest version. It returns false if the
+// pod is not waiting for a claim.
+func updateWaitingPod(pod *v1.Pod) bool {
+	podIdentifier := PodIdentifier{Name: pod.Name, Namespace: pod.Namespace}
+	VolumeMux.Lock()
+	defer VolumeMux.Unlock()
+	for _, pods := range claimToWaitingPods {
+		if _, ok := pods[podIdentifier]; ok {
+			pods[podIdentifier] = pod.DeepCopy()
+			return true
+		}
+	}
+	return false
+}
+
+// forgetPodVolumes drops the volume state of a deleted pod.
+func forgetPodVolumes(podIdentifier PodIdentifier) {
+	VolumeMux.Lock()
+	defer VolumeMux.Unlock()
+	delete(podToDelayedClaims, podIdentifier)
+	for claimKey, pods := range claimToWaitingPods {
+		delete(pods, podIdentifier)
+		if len(pods) == 0 {
+			delete(claimToWaitingPods, claimKey)
+		}
+	}
+}
+
+// enqueueClaimUpdate submits the pods waiting for the claim once it is bound.
+func (pw *PodWatcher) enqueueClaimUpdate(claim *v1.PersistentVolumeClaim) {
+	if claim.Spec.VolumeName == "" {
+		return
+	}
+	claimKey := claim.Namespace + "/" + claim.Name
+	VolumeMux.Lock()
+	pods := claimToWaitingPods[claimKey]
+	delete(claimToWaitingPods, claimKey)
+	VolumeMux.Unlock()
+	for _, pod := range pods {
+		key, err := cache.MetaNamespaceKeyFunc(pod)
+		if err != nil {
+			glog.Errorf("enqueueClaimUpdate: error getting key %v", err)
+			continue
+		}
+		glog.V(2).Infof("enqueueClaimUpdate: Claim %s is bound, adding pod %s", claimKey, key)
+		pw.enqueuePodAddition(key, pod)
+	}
+}
+
+// selectNodeForClaims sets the node the pod is placed onto on its unbound WaitForFirstConsumer claims,
+// so that the volumes are provisioned on the node before the pod is bound.
+func selectNodeForClaims(client kubernetes.Interface, podIdentifier PodIdentifier, nodeName string) error {
+	VolumeMux.Lock()
+	claims := podToDelayedClaims[podIdentifier]
+	VolumeMux.Unlock()
+	for _, claimName := range claims {
+		claim, err := client.CoreV1().PersistentVolumeClaims(podIdentifier.Namespace).Get(claimName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if claim.Spec.VolumeName != "" || claim.Annotations[SelectedNodeAnnotation] == nodeName {
+			continue
+		}
+		claim = claim.DeepCopy()
+		if claim.Annotations == nil {
+			claim.Annotations = make(map[string]string)
+		}
+		claim.Annotations[SelectedNodeAnnotation] = nodeName
+		if _, err := client.CoreV1().PersistentVolumeClaims(podIdentifier.Namespace).Update(claim); err != nil {
+			return err
+		}
+		glog.V(2).Infof("Selected node %s for claim %s/%s of pod %v", nodeName, claim.Namespace, claim.Name, podIdentifier)
+	}
+	return nil
+}
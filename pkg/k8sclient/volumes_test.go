@@ -0,0 +1,220 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func buildClaim(namespace, name, volumeName, className string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: v1.PersistentVolumeClaimSpec{
+			VolumeName:       volumeName,
+			StorageClassName: &className,
+		},
+	}
+}
+
+func buildLocalVolume(name, nodeName string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{MatchExpressions: []v1.NodeSelectorRequirement{{Key: HostnameLabel, Operator: v1.NodeSelectorOpIn, Values: []string{nodeName}}}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func addClaimVolume(pod *v1.Pod, claimName string) *v1.Pod {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+		Name: claimName,
+		VolumeSource: v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+		},
+	})
+	return pod
+}
+
+func TestGetVolumeNodeSelectorTerms(t *testing.T) {
+	zonal := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "zonal",
+			Labels: map[string]string{ZoneLabel: "us-east-1a__us-east-1b", RegionLabel: "us-east-1"},
+		},
+	}
+	localZonal := buildLocalVolume("local-zonal", "node1")
+	localZonal.Labels = map[string]string{ZoneLabel: "us-east-1a"}
+	hostnameReq := v1.NodeSelectorRequirement{Key: HostnameLabel, Operator: v1.NodeSelectorOpIn, Values: []string{"node1"}}
+
+	var testData = []struct {
+		pv       *v1.PersistentVolume
+		expected []v1.NodeSelectorTerm
+	}{
+		{pv: &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "network"}}, expected: nil},
+		{pv: buildLocalVolume("local", "node1"), expected: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{hostnameReq}}}},
+		{
+			pv: zonal,
+			expected: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{
+				{Key: ZoneLabel, Operator: v1.NodeSelectorOpIn, Values: []string{"us-east-1a", "us-east-1b"}},
+				{Key: RegionLabel, Operator: v1.NodeSelectorOpIn, Values: []string{"us-east-1"}},
+			}}},
+		},
+		{
+			pv: localZonal,
+			expected: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{
+				hostnameReq,
+				{Key: ZoneLabel, Operator: v1.NodeSelectorOpIn, Values: []string{"us-east-1a"}},
+			}}},
+		},
+	}
+
+	for _, data := range testData {
+		if got := getVolumeNodeSelectorTerms(data.pv); !reflect.DeepEqual(got, data.expected) {
+			t.Errorf("volume %s: expected %v got %v", data.pv.Name, data.expected, got)
+		}
+	}
+}
+
+// TestMergeNodeSelectorTerms tests that the volume terms are required by each of the terms of the pod.
+func TestMergeNodeSelectorTerms(t *testing.T) {
+	var empty map[string]string
+	diskReq := v1.NodeSelectorRequirement{Key: "disk", Operator: v1.NodeSelectorOpIn, Values: []string{"ssd"}}
+	gpuReq := v1.NodeSelectorRequirement{Key: "gpu", Operator: v1.NodeSelectorOpExists}
+	hostnameReq := v1.NodeSelectorRequirement{Key: HostnameLabel, Operator: v1.NodeSelectorOpIn, Values: []string{"node1"}}
+	volumeTerms := []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{hostnameReq}}}
+
+	pod := BuildPod("Poseidon-Namespace", "Pod1", empty, v1.PodPending, "1", "1024", nil, "owner")
+	pod.Spec.Affinity = nil
+	mergeNodeSelectorTerms(pod, volumeTerms)
+	if got := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms; !reflect.DeepEqual(got, volumeTerms) {
+		t.Errorf("pod without affinity: expected %v got %v", volumeTerms, got)
+	}
+
+	pod = BuildPod("Poseidon-Namespace", "Pod2", empty, v1.PodPending, "1", "1024", nil, "owner")
+	pod.Spec.Affinity = &v1.Affinity{NodeAffinity: &v1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{
+			{MatchExpressions: []v1.NodeSelectorRequirement{diskReq}},
+			{MatchExpressions: []v1.NodeSelectorRequirement{gpuReq}},
+		}},
+	}}
+	mergeNodeSelectorTerms(pod, volumeTerms)
+	expected := []v1.NodeSelectorTerm{
+		{MatchExpressions: []v1.NodeSelectorRequirement{diskReq, hostnameReq}},
+		{MatchExpressions: []v1.NodeSelectorRequirement{gpuReq, hostnameReq}},
+	}
+	if got := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms; !reflect.DeepEqual(got, expected) {
+		t.Errorf("pod with affinity: expected %v got %v", expected, got)
+	}
+}
+
+// TestPodWatcher_waitForClaim tests that a pod with an unbound claim is submitted once the claim is bound,
+// with the node affinity of the bound local volume.
+func TestPodWatcher_waitForClaim(t *testing.T) {
+	var empty map[string]string
+	pod := addClaimVolume(BuildPod("Poseidon-Namespace", "Pod1", empty, v1.PodPending, "1", "1024", nil, "owner"), "data")
+	pod.Spec.Affinity = nil
+	claim := buildClaim("Poseidon-Namespace", "data", "", "")
+
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	testObj.kubeClient = fake.NewSimpleClientset(claim, buildLocalVolume("local-pv", "node1"))
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+
+	podWatch.enqueuePodAddition(GetKey(pod, t), pod)
+	if podWatch.podWorkQueue.Len() != 0 {
+		t.Fatalf("expected the pod to wait for its claim, got %d queued", podWatch.podWorkQueue.Len())
+	}
+
+	// The claim is read again once the pod is released, the pod keeps waiting while the claim is still unbound.
+	boundClaim := buildClaim("Poseidon-Namespace", "data", "local-pv", "")
+	podWatch.enqueueClaimUpdate(boundClaim)
+	if podWatch.podWorkQueue.Len() != 0 {
+		t.Fatalf("expected the pod to keep waiting for its claim, got %d queued", podWatch.podWorkQueue.Len())
+	}
+	if _, err := testObj.kubeClient.CoreV1().PersistentVolumeClaims("Poseidon-Namespace").Update(boundClaim); err != nil {
+		t.Fatal(err)
+	}
+	podWatch.enqueueClaimUpdate(boundClaim)
+	podWatch.podWorkQueue.ShutDown()
+	var queued []*Pod
+	for {
+		_, items, shutdown := podWatch.podWorkQueue.Get()
+		if shutdown {
+			break
+		}
+		for _, item := range items {
+			queued = append(queued, item.(*Pod))
+		}
+	}
+	if len(queued) != 1 {
+		t.Fatalf("expected the pod to be queued once its claim is bound, got %v", queued)
+	}
+	expected := []NodeSelectorTerm{{MatchExpressions: []NodeSelectorRequirement{{Key: HostnameLabel, Operator: "In", Values: []string{"node1"}}}}}
+	if got := queued[0].Affinity.NodeAffinity.HardScheduling.NodeSelectorTerms; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected node selector terms %v got %v", expected, got)
+	}
+}
+
+// TestSelectNodeForClaims tests that the WaitForFirstConsumer claims are annotated with the node of the pod.
+func TestSelectNodeForClaims(t *testing.T) {
+	var empty map[string]string
+	waitForFirstConsumer := storagev1.VolumeBindingWaitForFirstConsumer
+	class := &storagev1.StorageClass{
+		ObjectMeta:        metav1.ObjectMeta{Name: "local-storage"},
+		VolumeBindingMode: &waitForFirstConsumer,
+	}
+	pod := addClaimVolume(BuildPod("Poseidon-Namespace", "Pod1", empty, v1.PodPending, "1", "1024", nil, "owner"), "data")
+	claim := buildClaim("Poseidon-Namespace", "data", "", "local-storage")
+
+	testObj := initializePodObj(t)
+	defer testObj.mockCtrl.Finish()
+	testObj.kubeClient = fake.NewSimpleClientset(claim, class)
+	podWatch := NewPodWatcher(testObj.kubeVerMajor, testObj.kubeVerMinor, []string{testObj.schedulerName}, testObj.kubeClient, testObj.fc)
+
+	if _, ok := podWatch.getPVNodeAffinity(pod.Spec.Volumes, pod.DeepCopy()); !ok {
+		t.Fatal("expected a pod with a WaitForFirstConsumer claim to be submitted")
+	}
+	podIdentifier := PodIdentifier{Name: pod.Name, Namespace: pod.Namespace}
+	if err := selectNodeForClaims(testObj.kubeClient, podIdentifier, "node1"); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := testObj.kubeClient.CoreV1().PersistentVolumeClaims("Poseidon-Namespace").Get("data", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Annotations[SelectedNodeAnnotation] != "node1" {
+		t.Errorf("expected claim to select node1, got %v", updated.Annotations)
+	}
+	forgetPodVolumes(podIdentifier)
+	VolumeMux.Lock()
+	if _, ok := podToDelayedClaims[podIdentifier]; ok {
+		t.Error("expected the claims of the deleted pod to be forgotten")
+	}
+	VolumeMux.Unlock()
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+// informerRestarts counts the informers re-created by their watchdog.
+var informerRestarts = metrics.NewCounterVec("informer_restarts_total", "Total informers re-created by their watchdog, by resource and reason", "resource", "reason")
+
+// Reasons of the informer restarts.
+const (
+	restartStale    = "stale"
+	restartUnsynced = "unsynced"
+)
+
+// watchdogInformer is an informer re-created by a watchdog when its watch silently stopped delivering events, a
+// client-go edge case where the watch neither errors nor closes. The informer is stale once no event was delivered
+// within the staleness window while its store holds objects, which keep changing on an active cluster, or once
+// HasSynced regressed. The re-created informer lists into the store of the previous one, so the objects changed
+// and deleted meanwhile are delivered as updates and deletions.
+type watchdogInformer struct {
+	resource    string
+	lw          cache.ListerWatcher
+	objType     runtime.Object
+	resync      time.Duration
+	handler     cache.ResourceEventHandler
+	store       cache.Store
+	staleness   time.Duration
+	lastEventMu sync.Mutex
+	lastEvent   time.Time
+	now         func() time.Time
+	// controller is the current informer, stop stops it and synced is set once it synced.
+	mu         sync.RWMutex
+	controller cache.Controller
+	stop       chan struct{}
+	synced     bool
+}
+
+// newWatchdogInformer returns the informer of the objects of lw resynced every resyncPeriod, whose events are
+// delivered to handler. A staleness of 0 disables the watchdog.
+func newWatchdogInformer(resource string, lw cache.ListerWatcher, objType runtime.Object, resyncPeriod, staleness time.Duration, handler cache.ResourceEventHandler) *watchdogInformer {
+	w := &watchdogInformer{
+		resource:  resource,
+		lw:        lw,
+		objType:   objType,
+		resync:    resyncPeriod,
+		handler:   handler,
+		store:     cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
+		staleness: staleness,
+		now:       time.Now,
+	}
+	w.controller = w.newController()
+	return w
+}
+
+// newController is cache.NewInformer over the store of the watchdog, with the events recorded before they are
+// delivered to the handler. The resync updates do not change the resource version and are not recorded.
+func (w *watchdogInformer) newController() cache.Controller {
+	fifo := cache.NewDeltaFIFO(cache.MetaNamespaceKeyFunc, w.store)
+	return cache.New(&cache.Config{
+		Queue:            fifo,
+		ListerWatcher:    w.lw,
+		ObjectType:       w.objType,
+		FullResyncPeriod: w.resync,
+		Process: func(obj interface{}) error {
+			for _, d := range obj.(cache.Deltas) {
+				switch d.Type {
+				case cache.Sync, cache.Added, cache.Updated:
+					if old, exists, err := w.store.Get(d.Object); err == nil && exists {
+						if err := w.store.Update(d.Object); err != nil {
+							return err
+						}
+						if resourceVersion(old) != resourceVersion(d.Object) {
+							w.recordEvent()
+						}
+						w.handler.OnUpdate(old, d.Object)
+					} else {
+						if err := w.store.Add(d.Object); err != nil {
+							return err
+						}
+						w.recordEvent()
+						w.handler.OnAdd(d.Object)
+					}
+				case cache.Deleted:
+					if err := w.store.Delete(d.Object); err != nil {
+						return err
+					}
+					w.recordEvent()
+					w.handler.OnDelete(d.Object)
+				}
+			}
+			return nil
+		},
+	})
+}
+
+func resourceVersion(obj interface{}) string {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return accessor.GetResourceVersion()
+}
+
+func (w *watchdogInformer) recordEvent() {
+	w.lastEventMu.Lock()
+	w.lastEvent = w.now()
+	w.lastEventMu.Unlock()
+}
+
+func (w *watchdogInformer) sinceLastEvent() time.Duration {
+	w.lastEventMu.Lock()
+	defer w.lastEventMu.Unlock()
+	return w.now().Sub(w.lastEvent)
+}
+
+// Run runs the informer and its watchdog until stopCh is closed.
+func (w *watchdogInformer) Run(stopCh <-chan struct{}) {
+	w.mu.Lock()
+	w.stop = make(chan struct{})
+	go w.controller.Run(w.stop)
+	w.mu.Unlock()
+	w.recordEvent()
+	if w.staleness > 0 {
+		go wait.Until(w.check, w.staleness/4, stopCh)
+	}
+	<-stopCh
+	w.mu.Lock()
+	close(w.stop)
+	w.mu.Unlock()
+}
+
+// HasSynced returns whether the current informer synced.
+func (w *watchdogInformer) HasSynced() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.controller.HasSynced()
+}
+
+// LastSyncResourceVersion returns the resource version the current informer last synced to.
+func (w *watchdogInformer) LastSyncResourceVersion() string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.controller.LastSyncResourceVersion()
+}
+
+// check re-creates the informer once it is stale or its HasSynced regressed.
+func (w *watchdogInformer) check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	synced := w.controller.HasSynced()
+	var reason string
+	switch {
+	case w.synced && !synced:
+		glog.Warningf("The %s informer is not synced anymore, re-creating it", w.resource)
+		reason = restartUnsynced
+	case synced && len(w.store.ListKeys()) > 0 && w.sinceLastEvent() > w.staleness:
+		glog.Warningf("The %s informer delivered no event for %v, re-creating it", w.resource, w.sinceLastEvent())
+		reason = restartStale
+	default:
+		w.synced = w.synced || synced
+		return
+	}
+	informerRestarts.WithLabelValues(w.resource, reason).Inc()
+	close(w.stop)
+	w.stop = make(chan struct{})
+	w.controller = w.newController()
+	w.synced = false
+	w.recordEvent()
+	go w.controller.Run(w.stop)
+}
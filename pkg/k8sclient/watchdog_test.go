@@ -0,0 +1,195 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// stalledListWatch lists the nodes of the next list in lists, the last one once they are exhausted, and returns
+// watches which never deliver an event.
+type stalledListWatch struct {
+	mu    sync.Mutex
+	lists [][]v1.Node
+	calls int
+}
+
+func (lw *stalledListWatch) List(options metav1.ListOptions) (runtime.Object, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	nodes := lw.lists[len(lw.lists)-1]
+	if lw.calls < len(lw.lists) {
+		nodes = lw.lists[lw.calls]
+	}
+	lw.calls++
+	return &v1.NodeList{ListMeta: metav1.ListMeta{ResourceVersion: fmt.Sprint(lw.calls)}, Items: nodes}, nil
+}
+
+func (lw *stalledListWatch) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	return watch.NewFake(), nil
+}
+
+func (lw *stalledListWatch) listCalls() int {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.calls
+}
+
+func watchdogNode(name, resourceVersion string) v1.Node {
+	return v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: resourceVersion}}
+}
+
+// recordingHandler records the events delivered by an informer as "add node-a", "update node-a 1->2" and
+// "delete node-a", but for the updates which do not change the resource version.
+type recordingHandler struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *recordingHandler) record(event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, event)
+}
+
+func (h *recordingHandler) handler() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			h.record("add " + obj.(*v1.Node).Name)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, newNode := oldObj.(*v1.Node), newObj.(*v1.Node)
+			// The unchanged nodes of the relists are not recorded.
+			if oldNode.ResourceVersion == newNode.ResourceVersion {
+				return
+			}
+			h.record(fmt.Sprintf("update %s %s->%s", newNode.Name, oldNode.ResourceVersion, newNode.ResourceVersion))
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			h.record("delete " + obj.(*v1.Node).Name)
+		},
+	}
+}
+
+func (h *recordingHandler) recorded() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := append([]string(nil), h.events...)
+	sort.Strings(events)
+	return events
+}
+
+// TestWatchdogInformer_restartsStaleInformer simulates a watch which stopped delivering events, the watchdog must
+// re-create the informer, which delivers the changes missed meanwhile.
+func TestWatchdogInformer_restartsStaleInformer(t *testing.T) {
+	lw := &stalledListWatch{lists: [][]v1.Node{
+		{watchdogNode("node-a", "1"), watchdogNode("node-b", "1")},
+		{watchdogNode("node-a", "2"), watchdogNode("node-c", "1")},
+	}}
+	handler := &recordingHandler{}
+	restarts := readMetric(t, informerRestarts.WithLabelValues("nodes", restartStale)).GetCounter().GetValue()
+	informer := newWatchdogInformer("nodes", lw, &v1.Node{}, 0, 200*time.Millisecond, handler.handler())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		t.Fatal("expected the informer to sync")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lw.listCalls() < 2 || !informer.HasSynced() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the stale informer to be re-created, listed %d times", lw.listCalls())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if value := readMetric(t, informerRestarts.WithLabelValues("nodes", restartStale)).GetCounter().GetValue(); value <= restarts {
+		t.Errorf("expected the restart to be counted, got %v restarts", value-restarts)
+	}
+	// The delivery of the events of the relist may lag behind HasSynced.
+	expected := []string{"add node-a", "add node-b", "add node-c", "delete node-b", "update node-a 1->2"}
+	for !reflect.DeepEqual(handler.recorded(), expected) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if events := handler.recorded(); !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected the events %v, got %v", expected, events)
+	}
+}
+
+// TestWatchdogInformer_emptyStore checks that an informer without objects, e.g. of a namespace without pods, is not
+// re-created for the lack of events.
+func TestWatchdogInformer_emptyStore(t *testing.T) {
+	lw := &stalledListWatch{lists: [][]v1.Node{{}}}
+	informer := newWatchdogInformer("nodes", lw, &v1.Node{}, 0, 20*time.Millisecond, (&recordingHandler{}).handler())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		t.Fatal("expected the informer to sync")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if calls := lw.listCalls(); calls != 1 {
+		t.Errorf("expected the informer not to be re-created, listed %d times", calls)
+	}
+}
+
+// syncedController is a controller whose HasSynced is set by the test.
+type syncedController struct {
+	synced bool
+}
+
+func (c *syncedController) Run(stopCh <-chan struct{})      { <-stopCh }
+func (c *syncedController) HasSynced() bool                 { return c.synced }
+func (c *syncedController) LastSyncResourceVersion() string { return "" }
+
+// TestWatchdogInformer_unsynced checks that the informer is re-created once its HasSynced regressed.
+func TestWatchdogInformer_unsynced(t *testing.T) {
+	lw := &stalledListWatch{lists: [][]v1.Node{{}}}
+	informer := newWatchdogInformer("nodes", lw, &v1.Node{}, 0, time.Hour, (&recordingHandler{}).handler())
+	controller := &syncedController{synced: true}
+	informer.controller = controller
+	informer.stop = make(chan struct{})
+	defer func() { close(informer.stop) }()
+	restarts := readMetric(t, informerRestarts.WithLabelValues("nodes", restartUnsynced)).GetCounter().GetValue()
+
+	informer.check()
+	if informer.controller != controller {
+		t.Fatal("expected the synced informer to be kept")
+	}
+	controller.synced = false
+	informer.check()
+	if informer.controller == controller {
+		t.Fatal("expected the informer to be re-created once it is not synced anymore")
+	}
+	if value := readMetric(t, informerRestarts.WithLabelValues("nodes", restartUnsynced)).GetCounter().GetValue(); value != restarts+1 {
+		t.Errorf("expected 1 restart to be counted, got %v", value-restarts)
+	}
+}
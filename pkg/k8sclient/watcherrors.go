@@ -0,0 +1,130 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchErrorTracker counts the consecutive list/watch failures of an informer. The informer
+// is considered not ready once the failures reach the threshold, until a list/watch succeeds.
+type watchErrorTracker struct {
+	resource  string
+	threshold int
+	sync.Mutex
+	failures int
+}
+
+func newWatchErrorTracker(resource string, threshold int) *watchErrorTracker {
+	return &watchErrorTracker{
+		resource:  resource,
+		threshold: threshold,
+	}
+}
+
+func (t *watchErrorTracker) onError(operation string, err error) {
+	metrics.WatchErrors.WithLabelValues(t.resource).Inc()
+	t.Lock()
+	t.failures++
+	failures := t.failures
+	t.Unlock()
+	glog.Errorf("Failed to %s %s, %d consecutive failures, err: %v", operation, t.resource, failures, err)
+	if failures == t.threshold {
+		glog.Errorf("%s informer is not ready after %d consecutive list/watch failures", t.resource, failures)
+	}
+}
+
+func (t *watchErrorTracker) onSuccess() {
+	t.Lock()
+	defer t.Unlock()
+	if t.failures >= t.threshold {
+		glog.Infof("%s informer is ready again", t.resource)
+	}
+	t.failures = 0
+}
+
+func (t *watchErrorTracker) ready() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.failures < t.threshold
+}
+
+// newNodeListWatch returns the list/watch functions of the node informer, reporting their failures to the tracker.
+// Only the nodes matching the label selector are listed and watched.
+func newNodeListWatch(client kubernetes.Interface, labelSelector string, tracker *watchErrorTracker) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(alo metav1.ListOptions) (runtime.Object, error) {
+			alo.LabelSelector = labelSelector
+			nodes, err := client.CoreV1().Nodes().List(alo)
+			if err != nil {
+				tracker.onError("list", err)
+				return nil, err
+			}
+			tracker.onSuccess()
+			return nodes, nil
+		},
+		WatchFunc: func(alo metav1.ListOptions) (watch.Interface, error) {
+			alo.LabelSelector = labelSelector
+			w, err := client.CoreV1().Nodes().Watch(alo)
+			if err != nil {
+				tracker.onError("watch", err)
+				return nil, err
+			}
+			tracker.onSuccess()
+			return w, nil
+		},
+	}
+}
+
+// Ready returns whether the node informer is receiving updates. The list/watch failures of a shared informer are not
+// tracked, see NewNodeWatcherWithInformer.
+func (nw *NodeWatcher) Ready() bool {
+	return nw.watchErrors.ready()
+}
+
+// readyMux is used to guard access to readyNodeWatcher.
+var readyMux sync.Mutex
+
+// readyNodeWatcher is the node watcher checked by WatchersReady.
+var readyNodeWatcher *NodeWatcher
+
+// setReadyWatchers sets the watchers checked by WatchersReady.
+func setReadyWatchers(nw *NodeWatcher) {
+	readyMux.Lock()
+	defer readyMux.Unlock()
+	readyNodeWatcher = nw
+}
+
+// WatchersReady returns whether the informers of the watchers started by New are receiving updates, it is used by
+// the readiness endpoint.
+func WatchersReady() bool {
+	readyMux.Lock()
+	nw := readyNodeWatcher
+	readyMux.Unlock()
+	if nw == nil {
+		return false
+	}
+	return nw.Ready()
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"errors"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/testing"
+)
+
+// TestWatchersReady injects a failing node list function and checks that readiness flips after
+// the consecutive failures reach the threshold, and is restored once the list succeeds again.
+func TestWatchersReady(t *testing.T) {
+	testObj := initializeNodeObj(t)
+	defer testObj.mockCtrl.Finish()
+	nodeWatch := NewNodeWatcher(testObj.kubeClient, testObj.fc)
+	nodeWatch.watchErrors.threshold = 3
+	if WatchersReady() {
+		t.Fatal("expected the watchers not to be ready before they are started")
+	}
+	setReadyWatchers(nodeWatch)
+	defer setReadyWatchers(nil)
+	failing := true
+	testObj.kubeClient.PrependReactor("list", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		if failing {
+			return true, nil, errors.New("nodes is forbidden")
+		}
+		return false, nil, nil
+	})
+	listWatch := newNodeListWatch(testObj.kubeClient, "", nodeWatch.watchErrors)
+
+	if !WatchersReady() {
+		t.Fatal("expected the watchers to be ready before any failure")
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err := listWatch.List(metav1.ListOptions{}); err == nil {
+			t.Fatal("expected the node list to fail")
+		}
+		if expected := i < 3; WatchersReady() != expected {
+			t.Errorf("after %d failures: expected ready %v got %v", i, expected, !expected)
+		}
+	}
+
+	failing = false
+	if _, err := listWatch.List(metav1.ListOptions{}); err != nil {
+		t.Fatal("expected the node list to succeed, got ", err)
+	}
+	if !WatchersReady() {
+		t.Error("expected the watchers to be ready once the list succeeds")
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+// AutoWorkers makes the watchers scale their number of workers with the number of CPUs.
+const AutoWorkers = -1
+
+// autoWorkersPerCPU is the number of workers started per CPU in the AutoWorkers mode. The workers
+// mostly wait on the firmament and Kubernetes APIs, so more workers than CPUs are run.
+const autoWorkersPerCPU = 2
+
+// getWorkerCount validates the number of workers of a watcher, or computes it in the AutoWorkers mode.
+func getWorkerCount(nWorkers, maxWorkers int) (int, error) {
+	if nWorkers == AutoWorkers {
+		return autoWorkerCount(runtime.NumCPU(), maxWorkers)
+	}
+	if nWorkers <= 0 {
+		return 0, fmt.Errorf("the number of workers must be greater than 0 or %d for auto-tuning, got %d", AutoWorkers, nWorkers)
+	}
+	return nWorkers, nil
+}
+
+// autoWorkerCount scales the number of workers with the number of CPUs, bounded by maxWorkers.
+func autoWorkerCount(numCPU, maxWorkers int) (int, error) {
+	if maxWorkers <= 0 {
+		return 0, fmt.Errorf("the maximum number of workers must be greater than 0, got %d", maxWorkers)
+	}
+	workers := numCPU * autoWorkersPerCPU
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > maxWorkers {
+		workers = maxWorkers
+	}
+	return workers, nil
+}
+
+// workerRestart is the period after which a worker which returned is restarted and the jitter
+// factor applied to the period, so that workers failing together are not restarted in lockstep.
+type workerRestart struct {
+	period time.Duration
+	jitter float64
+}
+
+// getWorkerRestart validates the restart period in milliseconds and the jitter factor of the workers.
+func getWorkerRestart(periodMs int, jitter float64) (workerRestart, error) {
+	if periodMs <= 0 {
+		return workerRestart{}, fmt.Errorf("the worker restart period must be greater than 0, got %d", periodMs)
+	}
+	if jitter < 0 {
+		return workerRestart{}, fmt.Errorf("the worker restart jitter must not be negative, got %v", jitter)
+	}
+	return workerRestart{period: time.Duration(periodMs) * time.Millisecond, jitter: jitter}, nil
+}
+
+// startWorkers runs the workers until stopCh is closed, restarting each worker after it returns. The workers
+// are counted in running until they stopped, so that the watchers wait for their queues to drain.
+func startWorkers(worker func(), nWorkers int, restart workerRestart, stopCh <-chan struct{}, running *sync.WaitGroup) {
+	running.Add(nWorkers)
+	for i := 0; i < nWorkers; i++ {
+		go func() {
+			defer running.Done()
+			wait.JitterUntil(worker, restart.period, restart.jitter, true, stopCh)
+		}()
+	}
+}
+
+// cacheSyncTimeout returns the time the watchers wait for their caches to sync, 0 waits until they are stopped.
+var cacheSyncTimeout = func() time.Duration {
+	return time.Duration(config.GetCacheSyncTimeout()) * time.Second
+}
+
+// waitForCacheSync waits for the caches of the named watcher to sync. It returns false without an error when ctx
+// is cancelled first, and an error once the caches did not sync within cacheSyncTimeout.
+func waitForCacheSync(ctx context.Context, name string, synced ...cache.InformerSynced) (bool, error) {
+	syncCtx := ctx
+	timeout := cacheSyncTimeout()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		syncCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if cache.WaitForCacheSync(syncCtx.Done(), synced...) {
+		return true, nil
+	}
+	if ctx.Err() != nil {
+		return false, nil
+	}
+	return false, fmt.Errorf("timed out waiting for the %s caches to sync within %v", name, timeout)
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+func TestGetWorkerCount(t *testing.T) {
+	var testData = []struct {
+		nWorkers    int
+		maxWorkers  int
+		expected    int
+		expectedErr bool
+	}{
+		{nWorkers: 10, maxWorkers: 32, expected: 10},
+		// The maximum only bounds the auto-tuned number of workers.
+		{nWorkers: 64, maxWorkers: 32, expected: 64},
+		{nWorkers: 0, maxWorkers: 32, expectedErr: true},
+		{nWorkers: -2, maxWorkers: 32, expectedErr: true},
+		{nWorkers: AutoWorkers, maxWorkers: 0, expectedErr: true},
+	}
+
+	for _, data := range testData {
+		got, err := getWorkerCount(data.nWorkers, data.maxWorkers)
+		if (err != nil) != data.expectedErr {
+			t.Errorf("workers %d max %d: expected error %v got %v", data.nWorkers, data.maxWorkers, data.expectedErr, err)
+			continue
+		}
+		if got != data.expected {
+			t.Errorf("workers %d max %d: expected %d got %d", data.nWorkers, data.maxWorkers, data.expected, got)
+		}
+	}
+}
+
+func TestAutoWorkerCount(t *testing.T) {
+	var testData = []struct {
+		numCPU     int
+		maxWorkers int
+		expected   int
+	}{
+		{numCPU: 1, maxWorkers: 32, expected: 2},
+		{numCPU: 4, maxWorkers: 32, expected: 8},
+		{numCPU: 16, maxWorkers: 32, expected: 32},
+		{numCPU: 64, maxWorkers: 32, expected: 32},
+		{numCPU: 0, maxWorkers: 32, expected: 1},
+		{numCPU: 4, maxWorkers: 1, expected: 1},
+	}
+
+	for _, data := range testData {
+		got, err := autoWorkerCount(data.numCPU, data.maxWorkers)
+		if err != nil {
+			t.Errorf("cpus %d max %d: unexpected error %v", data.numCPU, data.maxWorkers, err)
+			continue
+		}
+		if got != data.expected {
+			t.Errorf("cpus %d max %d: expected %d got %d", data.numCPU, data.maxWorkers, data.expected, got)
+		}
+	}
+}
+
+// TestRunInvalidWorkers checks that the watchers refuse to run without workers.
+func TestRunInvalidWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nodeObj := initializeNodeObj(t)
+	if err := NewNodeWatcher(nodeObj.kubeClient, nodeObj.fc).Run(ctx, 0); err == nil {
+		t.Error("expected the node watcher to reject 0 workers")
+	}
+	podObj := initializePodObj(t)
+	podWatch := NewPodWatcher(podObj.kubeVerMajor, podObj.kubeVerMinor, []string{podObj.schedulerName}, podObj.kubeClient, podObj.fc)
+	if err := podWatch.Run(ctx, -2); err == nil {
+		t.Error("expected the pod watcher to reject -2 workers")
+	}
+}
+
+// TestRunContext checks that the watchers return nil once their context is cancelled, and an error once their
+// caches do not sync within the cache sync timeout.
+func TestRunContext(t *testing.T) {
+	defaultTimeout := cacheSyncTimeout
+	defer func() { cacheSyncTimeout = defaultTimeout }()
+	cacheSyncTimeout = func() time.Duration { return 0 }
+	expectReturn := func(step string, returned chan error, expectErr bool) {
+		select {
+		case err := <-returned:
+			if (err != nil) != expectErr {
+				t.Errorf("%s: expected an error %v, got %v", step, expectErr, err)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("%s: expected Run to return", step)
+		}
+	}
+
+	nodeObj := initializeNodeObj(t)
+	defer nodeObj.mockCtrl.Finish()
+	nodeWatch := NewNodeWatcher(fake.NewSimpleClientset(), nodeObj.fc)
+	podObj := initializePodObj(t)
+	defer podObj.mockCtrl.Finish()
+	podWatch := NewPodWatcher(podObj.kubeVerMajor, podObj.kubeVerMinor, []string{podObj.schedulerName}, fake.NewSimpleClientset(), podObj.fc)
+	ctx, cancel := context.WithCancel(context.Background())
+	nodeReturned := make(chan error, 1)
+	podReturned := make(chan error, 1)
+	go func() { nodeReturned <- nodeWatch.Run(ctx, 1) }()
+	go func() { podReturned <- podWatch.Run(ctx, 1) }()
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		for _, controller := range podWatch.controllers {
+			if !controller.HasSynced() {
+				return false, nil
+			}
+		}
+		return nodeWatch.controller.HasSynced(), nil
+	})
+	if err != nil {
+		t.Fatal("expected the caches to sync")
+	}
+	cancel()
+	expectReturn("node watcher cancelled", nodeReturned, false)
+	expectReturn("pod watcher cancelled", podReturned, false)
+
+	cacheSyncTimeout = func() time.Duration { return 50 * time.Millisecond }
+	nodeObj = initializeNodeObj(t)
+	defer nodeObj.mockCtrl.Finish()
+	nodeObj.kubeClient.PrependReactor("list", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("nodes is forbidden")
+	})
+	podObj = initializePodObj(t)
+	defer podObj.mockCtrl.Finish()
+	podObj.kubeClient.PrependReactor("list", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("pods is forbidden")
+	})
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() { nodeReturned <- NewNodeWatcher(nodeObj.kubeClient, nodeObj.fc).Run(ctx, 1) }()
+	go func() {
+		podReturned <- NewPodWatcher(podObj.kubeVerMajor, podObj.kubeVerMinor, []string{podObj.schedulerName}, podObj.kubeClient, podObj.fc).Run(ctx, 1)
+	}()
+	expectReturn("node caches not synced", nodeReturned, true)
+	expectReturn("pod caches not synced", podReturned, true)
+}
+
+func TestGetWorkerRestart(t *testing.T) {
+	var testData = []struct {
+		periodMs    int
+		jitter      float64
+		expected    workerRestart
+		expectedErr bool
+	}{
+		{periodMs: 1000, jitter: 0.5, expected: workerRestart{period: time.Second, jitter: 0.5}},
+		{periodMs: 250, jitter: 0, expected: workerRestart{period: 250 * time.Millisecond}},
+		{periodMs: 0, jitter: 0.5, expectedErr: true},
+		{periodMs: -1, jitter: 0.5, expectedErr: true},
+		{periodMs: 1000, jitter: -0.1, expectedErr: true},
+	}
+
+	for _, data := range testData {
+		got, err := getWorkerRestart(data.periodMs, data.jitter)
+		if (err != nil) != data.expectedErr {
+			t.Errorf("period %d jitter %v: expected error %v got %v", data.periodMs, data.jitter, data.expectedErr, err)
+			continue
+		}
+		if got != data.expected {
+			t.Errorf("period %d jitter %v: expected %v got %v", data.periodMs, data.jitter, data.expected, got)
+		}
+	}
+}
+
+// TestStartWorkersRestartPeriod runs a worker which returns right away and checks that it is
+// restarted after the configured period, extended by at most the jitter.
+func TestStartWorkersRestartPeriod(t *testing.T) {
+	restart := workerRestart{period: 50 * time.Millisecond, jitter: 0.5}
+	var lock sync.Mutex
+	var starts []time.Time
+	stopCh := make(chan struct{})
+	startWorkers(func() {
+		lock.Lock()
+		defer lock.Unlock()
+		starts = append(starts, time.Now())
+	}, 1, restart, stopCh, new(sync.WaitGroup))
+	time.Sleep(500 * time.Millisecond)
+	close(stopCh)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(starts) < 3 {
+		t.Fatalf("expected the worker to be restarted several times, got %d runs", len(starts))
+	}
+	maxPeriod := time.Duration(float64(restart.period) * (1 + restart.jitter))
+	for i := 1; i < len(starts); i++ {
+		gap := starts[i].Sub(starts[i-1])
+		// Timers may fire late on a loaded machine, they never fire early.
+		if gap < restart.period || gap > maxPeriod+100*time.Millisecond {
+			t.Errorf("expected the worker to be restarted after %v to %v, got %v", restart.period, maxPeriod, gap)
+		}
+	}
+}
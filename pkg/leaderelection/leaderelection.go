@@ -0,0 +1,312 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package leaderelection elects a leader among the poseidon replicas, only the leader watches the cluster, sends the
+// stats and schedules. The lock is the leader annotation of a ConfigMap, with the record of the client-go leader
+// election so that it can be inspected with the same tools.
+package leaderelection
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// LeaderAnnotation is the annotation of the ConfigMap holding the leader election record.
+const LeaderAnnotation = "control-plane.alpha.kubernetes.io/leader"
+
+// Record is the leader election record stored in the LeaderAnnotation of the lock.
+type Record struct {
+	HolderIdentity       string      `json:"holderIdentity"`
+	LeaseDurationSeconds int         `json:"leaseDurationSeconds"`
+	AcquireTime          metav1.Time `json:"acquireTime"`
+	RenewTime            metav1.Time `json:"renewTime"`
+	LeaderTransitions    int         `json:"leaderTransitions"`
+}
+
+// Config is the lock and the timings of the leader election.
+type Config struct {
+	// Namespace and Name of the ConfigMap holding the lock.
+	Namespace string
+	Name      string
+	// Identity of the replica in the record, the name of its pod.
+	Identity string
+	// LeaseDuration is the time the standby replicas wait after the last renewal before taking over the lock.
+	LeaseDuration time.Duration
+	// RenewDeadline is the time the leader renews the lock within before giving up the leadership.
+	RenewDeadline time.Duration
+	// RetryPeriod is the time between two attempts to acquire or renew the lock.
+	RetryPeriod time.Duration
+}
+
+// Validate checks that the lock is named and that the leader gives up the leadership before the lease expires.
+func (c Config) Validate() error {
+	if c.Namespace == "" || c.Name == "" || c.Identity == "" {
+		return fmt.Errorf("the namespace %q, the name %q and the identity %q of the lock must not be empty", c.Namespace, c.Name, c.Identity)
+	}
+	if c.RetryPeriod <= 0 {
+		return fmt.Errorf("retry period %v must be positive", c.RetryPeriod)
+	}
+	if c.RenewDeadline <= c.RetryPeriod {
+		return fmt.Errorf("renew deadline %v must be greater than the retry period %v", c.RenewDeadline, c.RetryPeriod)
+	}
+	if c.LeaseDuration <= c.RenewDeadline {
+		return fmt.Errorf("lease duration %v must be greater than the renew deadline %v", c.LeaseDuration, c.RenewDeadline)
+	}
+	return nil
+}
+
+// Callbacks are called when the replica acquires and loses the leadership.
+type Callbacks struct {
+	// OnStartedLeading runs once the lock is acquired, stopCh is closed when the leadership is lost.
+	OnStartedLeading func(stopCh <-chan struct{})
+	// OnStoppedLeading is called once the lock could not be renewed.
+	OnStoppedLeading func()
+}
+
+// LeaderElector acquires and renews the lock of a replica.
+type LeaderElector struct {
+	client    kubernetes.Interface
+	config    Config
+	callbacks Callbacks
+	// observedRecord is the last record read from the lock, observedTime the local time it changed at. The lease of
+	// another holder expires LeaseDuration after observedTime, the clocks of the replicas are not compared.
+	observedRecord Record
+	observedTime   time.Time
+	now            func() time.Time
+}
+
+// leader is 1 while this replica holds the lock.
+var leader int32
+
+// IsLeader returns whether this replica holds the lock, it is used by the readiness endpoint.
+func IsLeader() bool {
+	return atomic.LoadInt32(&leader) == 1
+}
+
+func setLeader(isLeader bool) {
+	if isLeader {
+		atomic.StoreInt32(&leader, 1)
+		metrics.Leader.Set(1)
+		return
+	}
+	atomic.StoreInt32(&leader, 0)
+	metrics.Leader.Set(0)
+}
+
+// NewLeaderElector returns a LeaderElector of the lock in the config.
+func NewLeaderElector(client kubernetes.Interface, config Config, callbacks Callbacks) (*LeaderElector, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if callbacks.OnStartedLeading == nil || callbacks.OnStoppedLeading == nil {
+		return nil, fmt.Errorf("OnStartedLeading and OnStoppedLeading callbacks must not be nil")
+	}
+	return &LeaderElector{
+		client:    client,
+		config:    config,
+		callbacks: callbacks,
+		now:       time.Now,
+	}, nil
+}
+
+// Run blocks until the lock is acquired, starts OnStartedLeading and renews the lock until it fails or stopCh is
+// closed. OnStoppedLeading is called once the leadership is lost.
+func (le *LeaderElector) Run(stopCh <-chan struct{}) {
+	if !le.acquire(stopCh) {
+		return
+	}
+	leaderCh := make(chan struct{})
+	defer func() {
+		close(leaderCh)
+		setLeader(false)
+		le.callbacks.OnStoppedLeading()
+	}()
+	go le.callbacks.OnStartedLeading(leaderCh)
+	le.renew(stopCh)
+}
+
+// acquire tries to acquire the lock every RetryPeriod, it returns false if stopCh is closed first.
+func (le *LeaderElector) acquire(stopCh <-chan struct{}) bool {
+	glog.Infof("Attempting to acquire the leader lock %s/%s as %s", le.config.Namespace, le.config.Name, le.config.Identity)
+	err := wait.PollImmediateUntil(le.config.RetryPeriod, func() (bool, error) {
+		return le.tryAcquireOrRenew(), nil
+	}, stopCh)
+	if err != nil {
+		return false
+	}
+	glog.Infof("Acquired the leader lock %s/%s as %s", le.config.Namespace, le.config.Name, le.config.Identity)
+	setLeader(true)
+	return true
+}
+
+// renew renews the lock every RetryPeriod, it returns once the lock was not renewed within RenewDeadline or stopCh
+// is closed.
+func (le *LeaderElector) renew(stopCh <-chan struct{}) {
+	for {
+		err := wait.PollImmediate(le.config.RetryPeriod, le.config.RenewDeadline, func() (bool, error) {
+			return le.tryAcquireOrRenew(), nil
+		})
+		if err != nil {
+			glog.Errorf("Failed to renew the leader lock %s/%s within %v", le.config.Namespace, le.config.Name, le.config.RenewDeadline)
+			return
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(le.config.RetryPeriod):
+		}
+	}
+}
+
+// tryAcquireOrRenew creates the lock, renews it when this replica holds it or takes it over once the lease of the
+// holder expired. It returns whether this replica holds the lock.
+func (le *LeaderElector) tryAcquireOrRenew() bool {
+	now := metav1.NewTime(le.now())
+	record := Record{
+		HolderIdentity:       le.config.Identity,
+		LeaseDurationSeconds: int(le.config.LeaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+	configMaps := le.client.CoreV1().ConfigMaps(le.config.Namespace)
+	cm, err := configMaps.Get(le.config.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		data, _ := json.Marshal(record)
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   le.config.Namespace,
+				Name:        le.config.Name,
+				Annotations: map[string]string{LeaderAnnotation: string(data)},
+			},
+		}
+		if _, err := configMaps.Create(cm); err != nil {
+			glog.Errorf("Unable to create the leader lock %s/%s: %v", le.config.Namespace, le.config.Name, err)
+			return false
+		}
+		le.observe(record)
+		return true
+	}
+	if err != nil {
+		glog.Errorf("Unable to get the leader lock %s/%s: %v", le.config.Namespace, le.config.Name, err)
+		return false
+	}
+
+	var observed Record
+	if value, ok := cm.Annotations[LeaderAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &observed); err != nil {
+			glog.Errorf("Unable to parse the leader record %q of %s/%s: %v", value, le.config.Namespace, le.config.Name, err)
+			return false
+		}
+	}
+	if !sameRecord(observed, le.observedRecord) {
+		le.observe(observed)
+	}
+	if observed.HolderIdentity != "" && observed.HolderIdentity != le.config.Identity &&
+		le.observedTime.Add(le.config.LeaseDuration).After(le.now()) {
+		glog.V(4).Infof("The leader lock %s/%s is held by %s", le.config.Namespace, le.config.Name, observed.HolderIdentity)
+		return false
+	}
+
+	if observed.HolderIdentity == le.config.Identity {
+		record.AcquireTime = observed.AcquireTime
+		record.LeaderTransitions = observed.LeaderTransitions
+	} else {
+		record.LeaderTransitions = observed.LeaderTransitions + 1
+	}
+	data, _ := json.Marshal(record)
+	if cm.Annotations == nil {
+		cm.Annotations = make(map[string]string)
+	}
+	cm.Annotations[LeaderAnnotation] = string(data)
+	// The update fails on a conflict when another replica updated the lock since it was read.
+	if _, err := configMaps.Update(cm); err != nil {
+		glog.Errorf("Unable to update the leader lock %s/%s: %v", le.config.Namespace, le.config.Name, err)
+		return false
+	}
+	le.observe(record)
+	return true
+}
+
+// Release gives up the lock held by this replica, e.g. once it drained its work on shutdown, so that a standby
+// replica takes it over at its next retry instead of once the lease expired. The lock held by another replica is
+// left as is.
+func (le *LeaderElector) Release() error {
+	configMaps := le.client.CoreV1().ConfigMaps(le.config.Namespace)
+	cm, err := configMaps.Get(le.config.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	var observed Record
+	if value, ok := cm.Annotations[LeaderAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &observed); err != nil {
+			return fmt.Errorf("unable to parse the leader record %q: %v", value, err)
+		}
+	}
+	if observed.HolderIdentity != le.config.Identity {
+		return nil
+	}
+	now := metav1.NewTime(le.now())
+	data, _ := json.Marshal(Record{
+		LeaseDurationSeconds: 1,
+		AcquireTime:          now,
+		RenewTime:            now,
+		LeaderTransitions:    observed.LeaderTransitions,
+	})
+	cm.Annotations[LeaderAnnotation] = string(data)
+	if _, err := configMaps.Update(cm); err != nil {
+		return err
+	}
+	glog.Infof("Released the leader lock %s/%s", le.config.Namespace, le.config.Name)
+	return nil
+}
+
+// sameRecord returns whether the holder did not renew the lock between the records a and b.
+func sameRecord(a, b Record) bool {
+	return a.HolderIdentity == b.HolderIdentity && a.LeaderTransitions == b.LeaderTransitions && a.RenewTime.Equal(&b.RenewTime)
+}
+
+func (le *LeaderElector) observe(record Record) {
+	le.observedRecord = record
+	le.observedTime = le.now()
+}
+
+// GetLeader returns the holder of the lock, it is empty when the lock does not exist.
+func GetLeader(client kubernetes.Interface, namespace, name string) (string, error) {
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var record Record
+	if value, ok := cm.Annotations[LeaderAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			return "", fmt.Errorf("unable to parse the leader record %q: %v", value, err)
+		}
+	}
+	return record.HolderIdentity, nil
+}
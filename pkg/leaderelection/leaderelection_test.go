@@ -0,0 +1,146 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leaderelection
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestElector(t *testing.T, client *fake.Clientset, identity string, now *time.Time) *LeaderElector {
+	le, err := NewLeaderElector(client, Config{
+		Namespace:     "kube-system",
+		Name:          "poseidon-leader",
+		Identity:      identity,
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+	}, Callbacks{
+		OnStartedLeading: func(<-chan struct{}) {},
+		OnStoppedLeading: func() {},
+	})
+	if err != nil {
+		t.Fatalf("NewLeaderElector() failed: %v", err)
+	}
+	le.now = func() time.Time { return *now }
+	return le
+}
+
+// TestLeaderElector_tryAcquireOrRenew checks that a standby replica takes over the lock only once the lease of the
+// leader expired since it last observed a renewal.
+func TestLeaderElector_tryAcquireOrRenew(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	first := newTestElector(t, client, "poseidon-1", &now)
+	second := newTestElector(t, client, "poseidon-2", &now)
+
+	if !first.tryAcquireOrRenew() {
+		t.Fatalf("poseidon-1 did not create the lock")
+	}
+	if second.tryAcquireOrRenew() {
+		t.Fatalf("poseidon-2 acquired the lock held by poseidon-1")
+	}
+	now = now.Add(10 * time.Second)
+	if !first.tryAcquireOrRenew() {
+		t.Fatalf("poseidon-1 did not renew the lock")
+	}
+	now = now.Add(10 * time.Second)
+	// The lock was renewed 10s ago, before the lease of 15s expires.
+	if second.tryAcquireOrRenew() {
+		t.Fatalf("poseidon-2 acquired the lock renewed by poseidon-1")
+	}
+	now = now.Add(16 * time.Second)
+	if !second.tryAcquireOrRenew() {
+		t.Fatalf("poseidon-2 did not take over the expired lock")
+	}
+	if first.tryAcquireOrRenew() {
+		t.Fatalf("poseidon-1 renewed the lock taken over by poseidon-2")
+	}
+
+	holder, err := GetLeader(client, "kube-system", "poseidon-leader")
+	if err != nil {
+		t.Fatalf("GetLeader() failed: %v", err)
+	}
+	if holder != "poseidon-2" {
+		t.Errorf("GetLeader() = %q, want poseidon-2", holder)
+	}
+	if second.observedRecord.LeaderTransitions != 1 {
+		t.Errorf("LeaderTransitions = %d, want 1", second.observedRecord.LeaderTransitions)
+	}
+}
+
+// TestLeaderElector_Release checks that a standby replica takes over the lock released by the leader right away,
+// and that a replica does not release the lock held by another one.
+func TestLeaderElector_Release(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	first := newTestElector(t, client, "poseidon-1", &now)
+	second := newTestElector(t, client, "poseidon-2", &now)
+
+	if !first.tryAcquireOrRenew() {
+		t.Fatalf("poseidon-1 did not create the lock")
+	}
+	if err := second.Release(); err != nil {
+		t.Fatalf("Release() by poseidon-2 failed: %v", err)
+	}
+	if holder, _ := GetLeader(client, "kube-system", "poseidon-leader"); holder != "poseidon-1" {
+		t.Fatalf("GetLeader() = %q after poseidon-2 released the lock it does not hold, want poseidon-1", holder)
+	}
+	if second.tryAcquireOrRenew() {
+		t.Fatalf("poseidon-2 acquired the lock held by poseidon-1")
+	}
+	if err := first.Release(); err != nil {
+		t.Fatalf("Release() by poseidon-1 failed: %v", err)
+	}
+	if holder, _ := GetLeader(client, "kube-system", "poseidon-leader"); holder != "" {
+		t.Fatalf("GetLeader() = %q after poseidon-1 released the lock, want none", holder)
+	}
+	// The lease of poseidon-1 did not expire yet.
+	if !second.tryAcquireOrRenew() {
+		t.Fatalf("poseidon-2 did not take over the released lock")
+	}
+	if second.observedRecord.LeaderTransitions != 1 {
+		t.Errorf("LeaderTransitions = %d, want 1", second.observedRecord.LeaderTransitions)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := Config{
+		Namespace:     "kube-system",
+		Name:          "poseidon-leader",
+		Identity:      "poseidon-1",
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate() of %+v failed: %v", valid, err)
+	}
+	noIdentity := valid
+	noIdentity.Identity = ""
+	longDeadline := valid
+	longDeadline.RenewDeadline = valid.LeaseDuration
+	longRetry := valid
+	longRetry.RetryPeriod = valid.RenewDeadline
+	for _, config := range []Config{noIdentity, longDeadline, longRetry} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("Validate() of %+v succeeded, want an error", config)
+		}
+	}
+}
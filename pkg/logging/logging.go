@@ -0,0 +1,231 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging writes leveled messages with key/value pairs, e.g.
+// logging.Info("Added node", "hostname", node.Hostname). The messages are written by glog as text lines, the pairs
+// appended as key=value, or as JSON objects once the format is set to json, see SetFormat. The verbosity is the one
+// of glog, set with -v.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Format is the format of the log lines.
+type Format string
+
+const (
+	// FormatText writes the messages with glog, the default.
+	FormatText Format = "text"
+	// FormatJSON writes a JSON object per message on stderr.
+	FormatJSON Format = "json"
+)
+
+// Validate returns an error if the format is neither text nor json.
+func (f Format) Validate() error {
+	switch f {
+	case FormatText, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid log format %q, expected %s or %s", f, FormatText, FormatJSON)
+}
+
+// The keys of the JSON objects set by the logger, the keys of the pairs do not override them.
+const (
+	keyTime   = "time"
+	keyLevel  = "level"
+	keyCaller = "caller"
+	keyMsg    = "msg"
+)
+
+// missingValue is the value of the last key of an odd number of key/value pairs.
+const missingValue = "(MISSING)"
+
+// mu is used to guard access to format and output, and to write the JSON lines one at a time.
+var mu sync.Mutex
+
+var (
+	format           = FormatText
+	output io.Writer = os.Stderr
+	now              = time.Now
+)
+
+// SetFormat sets the format of the log lines.
+func SetFormat(f Format) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	format = f
+	return nil
+}
+
+// SetOutput sets the writer of the JSON lines, stderr by default, and returns the previous one. The text lines are
+// written by glog.
+func SetOutput(w io.Writer) io.Writer {
+	mu.Lock()
+	defer mu.Unlock()
+	previous := output
+	output = w
+	return previous
+}
+
+type severity int
+
+const (
+	severityInfo severity = iota
+	severityWarning
+	severityError
+)
+
+func (s severity) String() string {
+	switch s {
+	case severityWarning:
+		return "warning"
+	case severityError:
+		return "error"
+	}
+	return "info"
+}
+
+// depth is the number of frames between the caller of the logger and log.
+const depth = 2
+
+// Info logs the message with the key/value pairs at the info level.
+func Info(msg string, keysAndValues ...interface{}) {
+	log(severityInfo, msg, keysAndValues)
+}
+
+// Warning logs the message with the key/value pairs at the warning level.
+func Warning(msg string, keysAndValues ...interface{}) {
+	log(severityWarning, msg, keysAndValues)
+}
+
+// Error logs the message with the key/value pairs at the error level.
+func Error(msg string, keysAndValues ...interface{}) {
+	log(severityError, msg, keysAndValues)
+}
+
+// Verbose logs the messages at the info level if the verbosity of glog is enabled, see V.
+type Verbose bool
+
+// V returns whether the verbosity of glog is at least level, e.g. logging.V(2).Info("Added pod", "pod", key).
+func V(level glog.Level) Verbose {
+	return Verbose(glog.V(level))
+}
+
+// Info logs the message with the key/value pairs at the info level if v is set.
+func (v Verbose) Info(msg string, keysAndValues ...interface{}) {
+	if v {
+		log(severityInfo, msg, keysAndValues)
+	}
+}
+
+func log(s severity, msg string, keysAndValues []interface{}) {
+	mu.Lock()
+	f := format
+	mu.Unlock()
+	if f == FormatJSON {
+		writeJSON(s, msg, keysAndValues)
+		return
+	}
+	line := msg + formatText(keysAndValues)
+	switch s {
+	case severityWarning:
+		glog.WarningDepth(depth, line)
+	case severityError:
+		glog.ErrorDepth(depth, line)
+	default:
+		glog.InfoDepth(depth, line)
+	}
+}
+
+// formatText returns the key/value pairs as " key=value", the values holding spaces or quotes are quoted.
+func formatText(keysAndValues []interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(keysAndValues); i += 2 {
+		value := interface{}(missingValue)
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		text := fmt.Sprint(textValue(value))
+		if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+			text = strconv.Quote(text)
+		}
+		fmt.Fprintf(&b, " %v=%s", keysAndValues[i], text)
+	}
+	return b.String()
+}
+
+// textValue returns the message of the errors, the other values are formatted by fmt.
+func textValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+	return value
+}
+
+func writeJSON(s severity, msg string, keysAndValues []interface{}) {
+	object := make(map[string]interface{}, len(keysAndValues)/2+4)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		value := interface{}(missingValue)
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		object[fmt.Sprint(keysAndValues[i])] = jsonValue(value)
+	}
+	object[keyTime] = now().UTC().Format(time.RFC3339Nano)
+	object[keyLevel] = s.String()
+	object[keyMsg] = msg
+	if _, file, line, ok := runtime.Caller(depth + 1); ok {
+		object[keyCaller] = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	data, err := json.Marshal(object)
+	if err != nil {
+		// A value is not encodable, e.g. a channel, the values are written as text then.
+		for key, value := range object {
+			object[key] = fmt.Sprint(value)
+		}
+		data, _ = json.Marshal(object)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	output.Write(append(data, '\n'))
+}
+
+// jsonValue returns the message of the errors and the strings of the stringers, the other values are encoded as
+// JSON.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useJSON writes the JSON lines into the returned buffer at a fixed time, the returned function restores the text
+// output.
+func useJSON(t *testing.T) (*bytes.Buffer, func()) {
+	if err := SetFormat(FormatJSON); err != nil {
+		t.Fatalf("SetFormat() failed: %v", err)
+	}
+	buffer := new(bytes.Buffer)
+	previous := SetOutput(buffer)
+	now = func() time.Time { return time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC) }
+	return buffer, func() {
+		SetFormat(FormatText)
+		SetOutput(previous)
+		now = time.Now
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buffer, restore := useJSON(t)
+	defer restore()
+	Info("Added node", "hostname", "node-a", "cpu", 2000, "err", errors.New("timed out"), "odd")
+	Error("Task not found", "taskID", uint64(7), "time", "overridden")
+
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 JSON lines, got %q", buffer.String())
+	}
+	expected := []map[string]interface{}{
+		{"time": "2018-06-01T12:00:00Z", "level": "info", "msg": "Added node", "hostname": "node-a", "cpu": 2000.0, "err": "timed out", "odd": missingValue},
+		{"time": "2018-06-01T12:00:00Z", "level": "error", "msg": "Task not found", "taskID": 7.0},
+	}
+	for i, line := range lines {
+		var object map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &object); err != nil {
+			t.Fatalf("unable to parse %q: %v", line, err)
+		}
+		if caller, _ := object[keyCaller].(string); !strings.HasPrefix(caller, "logging_test.go:") {
+			t.Errorf("expected the caller of the logger, got %q", caller)
+		}
+		delete(object, keyCaller)
+		if !reflect.DeepEqual(object, expected[i]) {
+			t.Errorf("expected %v, got %v", expected[i], object)
+		}
+	}
+}
+
+func TestJSONUnencodableValue(t *testing.T) {
+	buffer, restore := useJSON(t)
+	defer restore()
+	Warning("Unencodable", "channel", make(chan int), "n", 1)
+	var object map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &object); err != nil {
+		t.Fatalf("unable to parse %q: %v", buffer.String(), err)
+	}
+	if object["level"] != "warning" || object["n"] != "1" || object["channel"] == nil {
+		t.Errorf("expected the values to be written as text, got %v", object)
+	}
+}
+
+func TestFormatText(t *testing.T) {
+	for _, test := range []struct {
+		keysAndValues []interface{}
+		expected      string
+	}{
+		{nil, ""},
+		{[]interface{}{"hostname", "node-a", "cpu", 2000}, " hostname=node-a cpu=2000"},
+		{[]interface{}{"err", errors.New("timed out")}, ` err="timed out"`},
+		{[]interface{}{"empty", "", "selector", "app=web"}, ` empty="" selector="app=web"`},
+		{[]interface{}{"odd"}, " odd=(MISSING)"},
+	} {
+		if text := formatText(test.keysAndValues); text != test.expected {
+			t.Errorf("formatText(%v) = %q, want %q", test.keysAndValues, text, test.expected)
+		}
+	}
+}
+
+func TestSetFormat(t *testing.T) {
+	defer SetFormat(FormatText)
+	if err := SetFormat("yaml"); err == nil {
+		t.Error("expected an invalid format to be an error")
+	}
+	if format != FormatText {
+		t.Errorf("expected the format to be kept, got %q", format)
+	}
+	if err := SetFormat(FormatJSON); err != nil || format != FormatJSON {
+		t.Errorf("expected the format to be json, got %q, %v", format, err)
+	}
+}
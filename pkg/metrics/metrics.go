@@ -17,6 +17,7 @@ limitations under the License.
 package metrics
 
 import (
+	"os"
 	"sync"
 	"time"
 
@@ -43,6 +44,30 @@ var (
 			Buckets:   prometheus.ExponentialBuckets(1000, 2, 15),
 		},
 	)
+	E2eSchedulingLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "e2e_scheduling_latency_microseconds",
+			Help:      "E2e scheduling latency, from the pod creation to the binding of the pod",
+			Buckets:   prometheus.ExponentialBuckets(1000, 2, 15),
+		},
+	)
+	SchedulingLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "scheduling_latency_seconds",
+			Help:      "Scheduling latency, from the pod observed unscheduled by poseidon to the binding of the pod",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+		},
+	)
+	SchedulingAlgorithmLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "scheduling_algorithm_latency_microseconds",
+			Help:      "Duration of the firmament scheduling rounds",
+			Buckets:   prometheus.ExponentialBuckets(1000, 2, 15),
+		},
+	)
 	SchedulingPremptionEvaluationDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Subsystem: schedulerSubsystem,
@@ -57,28 +82,218 @@ var (
 			Name:      "pod_preemption_victims",
 			Help:      "Number of selected preemption victims",
 		})
+	PendingPods = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "pending_pods",
+			Help:      "Number of pods waiting to be bound",
+		})
+	SchedulingAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "scheduling_attempts_total",
+			Help:      "Total scheduling attempts of the pods, by result",
+		}, []string{"result"})
 	PreemptionAttempts = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Subsystem: schedulerSubsystem,
 			Name:      "total_preemption_attempts",
 			Help:      "Total preemption attempts in the cluster till now",
 		})
+	StateInconsistencies = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "state_inconsistencies_total",
+			Help:      "Total inconsistencies found between the node and resource maps",
+		})
+	DuplicateNodes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "duplicate_nodes_total",
+			Help:      "Total additions of nodes skipped because a node of a different UID with the same name is tracked",
+		})
+	WorkQueueDeadLetters = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "work_queue_dead_letters_total",
+			Help:      "Total changes dropped from the work queues once their retries were exhausted, by queue",
+		}, []string{"queue"})
+	WatchErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "watch_errors_total",
+			Help:      "Total list and watch errors of the informers, by resource",
+		}, []string{"resource"})
+	PodStateRecoveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "pod_state_recoveries_total",
+			Help:      "Total inconsistencies recovered between the pods and the tasks of firmament, by kind",
+		}, []string{"kind"})
+	FirmamentRequestTimeouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "firmament_request_timeouts_total",
+			Help:      "Total requests to firmament which timed out and were sent again",
+		})
+	FirmamentRequestRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "firmament_request_retries_total",
+			Help:      "Total retries of the requests to firmament failing with a transient error, by method",
+		}, []string{"method"})
+	FirmamentActiveEndpoint = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "firmament_active_endpoint",
+			Help:      "1 for the firmament endpoint the requests are sent to, 0 for the standby endpoints",
+		}, []string{"address"})
+	FirmamentRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "firmament_requests_total",
+			Help:      "Total requests to firmament, by method and status code",
+		}, []string{"method", "code"})
+	FirmamentRequestLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "firmament_request_latency_microseconds",
+			Help:      "Latency of the requests to firmament, retries included, by method",
+			Buckets:   prometheus.ExponentialBuckets(1000, 2, 15),
+		}, []string{"method"})
+	FirmamentScheduleBreakerState = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "firmament_schedule_breaker_state",
+			Help:      "State of the circuit breaker of the scheduling rounds, 0 closed, 1 open, 2 half-open",
+		})
+	ScheduleStreamReconnects = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "schedule_stream_reconnects_total",
+			Help:      "Total schedule streams of firmament opened again once broken",
+		})
+	Leader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "leader",
+			Help:      "1 when the replica holds the leader election lock and schedules, 0 when it stands by",
+		})
+	InFlightNodeEvents = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: schedulerSubsystem,
+			Name:      "node_events_in_flight",
+			Help:      "Number of node events queued and not processed yet by the node workers",
+		})
 )
 
-var registerMetrics sync.Once
+// Registry holds the poseidon metrics, with the process and the Go runtime collectors. It is served by the
+// metrics endpoint rather than the default registry of the prometheus client, so that the libraries registering
+// their own metrics with the default registry do not leak into it.
+var Registry = prometheus.NewRegistry()
+
+var (
+	registerMetrics sync.Once
+	// lazyMux guards lazyCollectors and registered.
+	lazyMux = new(sync.Mutex)
+	// lazyCollectors are the vectors created by NewCounterVec, NewGaugeVec and NewHistogramVec, they are registered
+	// with the Registry by Register, or when they are created once Register was called.
+	lazyCollectors []prometheus.Collector
+	registered     bool
+)
 
 // Register all metrics.
 func Register() {
 	// Register the metrics.
 	registerMetrics.Do(func() {
-		prometheus.MustRegister(SchedulingSubmitmLatency)
-		prometheus.MustRegister(BindingLatency)
-		prometheus.MustRegister(SchedulingPremptionEvaluationDuration)
-		prometheus.MustRegister(PreemptionVictims)
-		prometheus.MustRegister(PreemptionAttempts)
+		Registry.MustRegister(prometheus.NewProcessCollector(os.Getpid(), ""))
+		Registry.MustRegister(prometheus.NewGoCollector())
+		Registry.MustRegister(SchedulingSubmitmLatency)
+		Registry.MustRegister(BindingLatency)
+		Registry.MustRegister(E2eSchedulingLatency)
+		Registry.MustRegister(SchedulingLatency)
+		Registry.MustRegister(SchedulingAlgorithmLatency)
+		Registry.MustRegister(SchedulingPremptionEvaluationDuration)
+		Registry.MustRegister(PreemptionVictims)
+		Registry.MustRegister(PendingPods)
+		Registry.MustRegister(SchedulingAttempts)
+		Registry.MustRegister(PreemptionAttempts)
+		Registry.MustRegister(StateInconsistencies)
+		Registry.MustRegister(DuplicateNodes)
+		Registry.MustRegister(WorkQueueDeadLetters)
+		Registry.MustRegister(WatchErrors)
+		Registry.MustRegister(PodStateRecoveries)
+		Registry.MustRegister(FirmamentRequestTimeouts)
+		Registry.MustRegister(FirmamentRequestRetries)
+		Registry.MustRegister(FirmamentActiveEndpoint)
+		Registry.MustRegister(FirmamentRequests)
+		Registry.MustRegister(FirmamentRequestLatency)
+		Registry.MustRegister(FirmamentScheduleBreakerState)
+		Registry.MustRegister(ScheduleStreamReconnects)
+		Registry.MustRegister(Leader)
+		Registry.MustRegister(InFlightNodeEvents)
+		lazyMux.Lock()
+		defer lazyMux.Unlock()
+		for _, collector := range lazyCollectors {
+			Registry.MustRegister(collector)
+		}
+		lazyCollectors = nil
+		registered = true
 	})
 }
 
+// registerLazily registers the collector with the Registry, once Register is called if it was not yet.
+func registerLazily(collector prometheus.Collector) {
+	lazyMux.Lock()
+	defer lazyMux.Unlock()
+	if registered {
+		Registry.MustRegister(collector)
+		return
+	}
+	lazyCollectors = append(lazyCollectors, collector)
+}
+
+// NewCounterVec returns a counter of the poseidon subsystem partitioned by the labels, registered with the
+// Registry. It is meant to be assigned to a package variable, e.g.
+//
+//	var bindConflicts = metrics.NewCounterVec("bind_conflicts_total", "Total binding conflicts, by node", "node")
+func NewCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: schedulerSubsystem,
+		Name:      name,
+		Help:      help,
+	}, labels)
+	registerLazily(vec)
+	return vec
+}
+
+// NewGaugeVec returns a gauge of the poseidon subsystem partitioned by the labels, registered with the Registry.
+func NewGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: schedulerSubsystem,
+		Name:      name,
+		Help:      help,
+	}, labels)
+	registerLazily(vec)
+	return vec
+}
+
+// NewHistogramVec returns a histogram of the poseidon subsystem partitioned by the labels, registered with the
+// Registry. The default buckets of the latencies in microseconds are used when buckets is nil.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	if buckets == nil {
+		buckets = prometheus.ExponentialBuckets(1000, 2, 15)
+	}
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: schedulerSubsystem,
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+	}, labels)
+	registerLazily(vec)
+	return vec
+}
+
 // SinceInMicroseconds gets the time since the specified start in microseconds.
 func SinceInMicroseconds(start time.Time) float64 {
 	return float64(time.Since(start).Nanoseconds() / time.Microsecond.Nanoseconds())
@@ -0,0 +1,44 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"testing"
+)
+
+// TestRegisterLazily checks that the vectors created before and after Register are gathered from the Registry.
+func TestRegisterLazily(t *testing.T) {
+	before := NewCounterVec("test_before_total", "Counter created before Register", "kind")
+	Register()
+	after := NewGaugeVec("test_after", "Gauge created after Register", "kind")
+	before.WithLabelValues("a").Inc()
+	after.WithLabelValues("b").Set(2)
+
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() failed: %v", err)
+	}
+	gathered := make(map[string]bool)
+	for _, family := range families {
+		gathered[family.GetName()] = true
+	}
+	for _, name := range []string{"poseidon_test_before_total", "poseidon_test_after", "process_start_time_seconds", "go_goroutines"} {
+		if !gathered[name] {
+			t.Errorf("expected %s to be gathered, got %v", name, gathered)
+		}
+	}
+}
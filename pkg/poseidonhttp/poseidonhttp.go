@@ -19,12 +19,20 @@ package poseidonhttp
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-sigs/poseidon/pkg/config"
 	"github.com/kubernetes-sigs/poseidon/pkg/debugutil"
 	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/k8sclient"
+	"github.com/kubernetes-sigs/poseidon/pkg/leaderelection"
 	"github.com/kubernetes-sigs/poseidon/pkg/metrics"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -32,23 +40,110 @@ import (
 const (
 	pathMetrics = "/metrics"
 	PathHealth  = "/healthz"
+	PathReady   = "/readyz"
+	PathResync  = "/admin/resync"
+	// The debug endpoints dump the state of the scheduler.
+	PathDebugNodes  = "/debug/poseidon/nodes"
+	PathDebugTasks  = "/debug/poseidon/tasks"
+	PathDebugQueues = "/debug/poseidon/queues"
 )
 
 // generateMetricsHandler generates metrics handlers.
 func generateMetricsHandler() map[string]http.Handler {
 	metrics.Register()
 	m := make(map[string]http.Handler)
-	m[pathMetrics] = promhttp.Handler()
+	m[pathMetrics] = promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{})
 	return m
 }
 
+// firmamentClient is a firmament scheduler client tracking the connectivity of its connection and the circuit
+// breaker of its scheduling rounds.
+type firmamentClient interface {
+	firmament.FirmamentSchedulerClient
+	IsHealthy() bool
+	ScheduleBreakerState() firmament.BreakerState
+}
+
+// The states checked by the health endpoints, overridden by the tests.
+var (
+	stalledLoops  = k8sclient.StalledLoops
+	cachesSynced  = k8sclient.CachesSynced
+	watchersReady = k8sclient.WatchersReady
+	leaderElect   = config.GetLeaderElect
+	isLeader      = leaderelection.IsLeader
+)
+
 // generateHealthzHandler generates healthz handlers.
-func generateHealthzHandler(fc firmament.FirmamentSchedulerClient) map[string]http.Handler {
+func generateHealthzHandler(fc firmamentClient) map[string]http.Handler {
+	stallTimeout := time.Duration(config.GetWorkerStallTimeout()) * time.Second
+	m := make(map[string]http.Handler)
+	m[PathHealth] = newHealthzHandler(func() Health { return checkHealth(stallTimeout) })
+	m[PathReady] = newHealthzHandler(func() Health { return checkReady(fc) })
+	return m
+}
+
+// generateAdminHandler generates the admin handlers.
+func generateAdminHandler() map[string]http.Handler {
+	m := make(map[string]http.Handler)
+	m[PathResync] = http.HandlerFunc(resyncNode)
+	return m
+}
+
+// resyncNode handles '/admin/resync?node=<name>' requests, sending the node to firmament again.
+func resyncNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hostname := r.URL.Query().Get("node")
+	if hostname == "" {
+		http.Error(w, "missing node parameter", http.StatusBadRequest)
+		return
+	}
+	err := k8sclient.ResyncNode(hostname)
+	if _, ok := err.(*k8sclient.UnknownNodeError); ok {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		glog.Errorf("resyncNode: resyncing node %s failed, err: %v", hostname, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// generateDebugHandler generates the debug handlers, the label values are redacted from the dumps if redact is set.
+func generateDebugHandler(redact bool) map[string]http.Handler {
 	m := make(map[string]http.Handler)
-	m[PathHealth] = newHealthzHandler(func() Health { return checkHealth(fc) })
+	m[PathDebugNodes] = newDumpHandler(func() interface{} { return k8sclient.DumpNodes(redact) })
+	m[PathDebugTasks] = newDumpHandler(func() interface{} { return k8sclient.DumpTasks(redact) })
+	m[PathDebugQueues] = newDumpHandler(func() interface{} { return k8sclient.DumpQueues() })
 	return m
 }
 
+// newDumpHandler handles the debug requests, replying with the JSON encoding of the state dumped by dump. The state
+// is copied by dump and marshaled once the locks guarding it are released.
+func newDumpHandler(dump func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		d, err := json.MarshalIndent(dump(), "", "  ")
+		if err != nil {
+			glog.Errorf("newDumpHandler: marshaling the dump of %s failed, err: %v", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(d)
+	}
+}
+
 // newHealthHandler handles '/healthz' requests.
 func newHealthzHandler(hfunc func() Health) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -74,20 +169,62 @@ func newHealthzHandler(hfunc func() Health) http.HandlerFunc {
 
 type Health struct {
 	Health string `json:"health"`
+	// Leader is set when the replicas elect a leader, "true" for the replica holding the lock.
+	Leader string `json:"leader,omitempty"`
+	// Checks holds the result of every check, "ok" or the reason of the failure.
+	Checks map[string]string `json:"checks,omitempty"`
 }
 
-// checkHealth checks the status of firmament service and generate the status of poseidon
-func checkHealth(fc firmament.FirmamentSchedulerClient) Health {
-	h := Health{Health: "false"}
-	res, err := fc.Check(context.Background(), &firmament.HealthCheckRequest{})
-	if err != nil {
-		glog.Errorf("checkHealth: health check err: %v", err)
+// check records the result of a check, the health is "true" only if all the checks pass.
+func (h *Health) check(name string, ok bool, reason string) {
+	if h.Checks == nil {
+		h.Health = "true"
+		h.Checks = make(map[string]string)
+	}
+	if ok {
+		h.Checks[name] = checkOK
+		return
+	}
+	h.Health = "false"
+	h.Checks[name] = reason
+}
+
+const checkOK = "ok"
+
+// checkHealth checks that poseidon is live, i.e. that none of its workers is stuck on an item for more than the
+// stall timeout. Firmament being down makes poseidon not ready rather than not live, see checkReady.
+func checkHealth(stallTimeout time.Duration) Health {
+	h := Health{}
+	loops, elapsed := stalledLoops(stallTimeout)
+	if len(loops) == 0 {
+		h.check("workers", true, "")
 		return h
 	}
+	var stalled []string
+	for _, loop := range loops {
+		stalled = append(stalled, fmt.Sprintf("%s for %v", loop, elapsed[loop].Truncate(time.Second)))
+	}
+	h.check("workers", false, "no progress of "+strings.Join(stalled, ", "))
+	return h
+}
 
-	if res.GetStatus() == firmament.ServingStatus_SERVING {
-		h.Health = "true"
+// checkReady checks that poseidon receives the cluster updates, is connected to firmament and that the
+// scheduling rounds are not skipped by the circuit breaker. A standby replica of the leader election does not watch
+// the cluster, it is ready while it is connected to firmament.
+func checkReady(fc firmamentClient) Health {
+	h := Health{}
+	h.check("firmament", fc.IsHealthy(), "not connected")
+	if leaderElect() {
+		if !isLeader() {
+			h.Leader = "false"
+			return h
+		}
+		h.Leader = "true"
 	}
+	h.check("caches", cachesSynced(), "not synced")
+	h.check("watchers", watchersReady(), "list/watch failing")
+	state := fc.ScheduleBreakerState()
+	h.check("scheduleBreaker", state != firmament.BreakerOpen, "scheduling rounds skipped, breaker "+state.String())
 	return h
 }
 
@@ -105,8 +242,25 @@ func buildAddrMap(addr string,
 	}
 }
 
-// Serve starts the http service for metrics/healthz/pprof
-func Serve(fc firmament.FirmamentSchedulerClient) {
+// healthCheckAddress returns the address of the health endpoints, the port of the address is replaced by the health
+// port when it is set.
+func healthCheckAddress(address string, port int) string {
+	if port <= 0 {
+		return address
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// shutdownTimeout is the time the http services wait for the requests in flight once they are stopped.
+const shutdownTimeout = 5 * time.Second
+
+// Serve starts the http service for metrics/healthz/pprof. The services are shut down gracefully once stopCh is
+// closed, Serve returns once they are all stopped.
+func Serve(fc firmamentClient, stopCh <-chan struct{}) {
 	cfg := config.GetConfig()
 	// addrMap is a map to store the port addrs, key is the port name and value is the ip:port
 	addrMap := make(map[string][]map[string]http.Handler)
@@ -118,16 +272,31 @@ func Serve(fc firmament.FirmamentSchedulerClient) {
 		buildAddrMap(cfg.PprofAddress, debugutil.PProfHandlers(), addrMap)
 	}
 	// add healthz handler map to addrMap
-	buildAddrMap(cfg.HealthCheckAddress, generateHealthzHandler(fc), addrMap)
+	healthAddress := healthCheckAddress(cfg.HealthCheckAddress, config.GetHealthPort())
+	buildAddrMap(healthAddress, generateHealthzHandler(fc), addrMap)
+	if cfg.EnableAdmin {
+		glog.Infof("admin endpoints are enabled under %s", healthAddress+PathResync)
+		buildAddrMap(healthAddress, generateAdminHandler(), addrMap)
+	}
+	if cfg.EnableDebug {
+		glog.Infof("debug endpoints are enabled under %s, label values redacted: %v", healthAddress+"/debug/poseidon/", cfg.RedactDebug)
+		buildAddrMap(healthAddress, generateDebugHandler(cfg.RedactDebug), addrMap)
+	}
 
 	// start http services
+	wg := new(sync.WaitGroup)
 	for addr, handlersList := range addrMap {
-		go startHttpServices(addr, handlersList)
+		wg.Add(1)
+		go func(addr string, handlersList []map[string]http.Handler) {
+			defer wg.Done()
+			startHttpServices(addr, handlersList, stopCh)
+		}(addr, handlersList)
 	}
+	wg.Wait()
 }
 
-// startHttpServices register handlers and start port services
-func startHttpServices(addr string, hList []map[string]http.Handler) {
+// startHttpServices register handlers and start port services, until stopCh is closed
+func startHttpServices(addr string, hList []map[string]http.Handler, stopCh <-chan struct{}) {
 	mux := http.NewServeMux()
 	for _, hMap := range hList {
 		for p, h := range hMap {
@@ -138,5 +307,17 @@ func startHttpServices(addr string, hList []map[string]http.Handler) {
 		Addr:    addr,
 		Handler: mux,
 	}
-	glog.Fatal(server.ListenAndServe())
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			glog.Fatal(err)
+		}
+	}()
+	<-stopCh
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		glog.Errorf("Could not shut down the http service on %s gracefully, err: %v", addr, err)
+		return
+	}
+	glog.Infof("Stopped the http service on %s", addr)
 }
@@ -0,0 +1,294 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package poseidonhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/k8sclient"
+)
+
+// fakeFirmament is a firmament client whose connectivity and circuit breaker state are set by the test.
+type fakeFirmament struct {
+	firmament.FirmamentSchedulerClient
+	healthy bool
+	breaker firmament.BreakerState
+}
+
+func (f *fakeFirmament) IsHealthy() bool {
+	return f.healthy
+}
+
+func (f *fakeFirmament) ScheduleBreakerState() firmament.BreakerState {
+	return f.breaker
+}
+
+// fakeStates are the states checked by the health endpoints, the breaker state is reported by the fakeFirmament.
+type fakeStates struct {
+	stalled     map[string]time.Duration
+	synced      bool
+	watching    bool
+	breaker     firmament.BreakerState
+	leaderElect bool
+	leader      bool
+}
+
+// inject replaces the checked states by the fake ones, the returned function restores them.
+func (s fakeStates) inject() func() {
+	savedStalled, savedSynced, savedWatching := stalledLoops, cachesSynced, watchersReady
+	savedElect, savedLeader := leaderElect, isLeader
+	stalledLoops = func(time.Duration) ([]string, map[string]time.Duration) {
+		var loops []string
+		for loop := range s.stalled {
+			loops = append(loops, loop)
+		}
+		return loops, s.stalled
+	}
+	cachesSynced = func() bool { return s.synced }
+	watchersReady = func() bool { return s.watching }
+	leaderElect = func() bool { return s.leaderElect }
+	isLeader = func() bool { return s.leader }
+	return func() {
+		stalledLoops, cachesSynced, watchersReady = savedStalled, savedSynced, savedWatching
+		leaderElect, isLeader = savedElect, savedLeader
+	}
+}
+
+func get(t *testing.T, handlers map[string]http.Handler, path string) (int, Health) {
+	recorder := httptest.NewRecorder()
+	handlers[path].ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	var h Health
+	if err := json.Unmarshal(recorder.Body.Bytes(), &h); err != nil {
+		t.Fatalf("Unable to parse the body %q of %s: %v", recorder.Body.String(), path, err)
+	}
+	return recorder.Code, h
+}
+
+// TestHealthzHandler checks that poseidon is not live once a loop of workers makes no progress.
+func TestHealthzHandler(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		states fakeStates
+		code   int
+		checks map[string]string
+	}{
+		{
+			name:   "live",
+			states: fakeStates{},
+			code:   http.StatusOK,
+			checks: map[string]string{"workers": "ok"},
+		},
+		{
+			name:   "stalled",
+			states: fakeStates{stalled: map[string]time.Duration{"nodes": 301500 * time.Millisecond}},
+			code:   http.StatusServiceUnavailable,
+			checks: map[string]string{"workers": "no progress of nodes for 5m1s"},
+		},
+	} {
+		restore := test.states.inject()
+		code, h := get(t, generateHealthzHandler(&fakeFirmament{}), PathHealth)
+		restore()
+		if code != test.code || !reflect.DeepEqual(h.Checks, test.checks) {
+			t.Errorf("%s: got %d %v, want %d %v", test.name, code, h.Checks, test.code, test.checks)
+		}
+	}
+}
+
+// TestReadyzHandler checks the readiness of poseidon, with the detail of the failing checks.
+func TestReadyzHandler(t *testing.T) {
+	ready := fakeStates{synced: true, watching: true, breaker: firmament.BreakerHalfOpen}
+	notSynced := ready
+	notSynced.synced = false
+	breakerOpen := ready
+	breakerOpen.breaker = firmament.BreakerOpen
+	leader := ready
+	leader.leaderElect, leader.leader = true, true
+	standby := fakeStates{leaderElect: true}
+	for _, test := range []struct {
+		name    string
+		states  fakeStates
+		healthy bool
+		code    int
+		leader  string
+		checks  map[string]string
+	}{
+		{
+			name:    "ready",
+			states:  ready,
+			healthy: true,
+			code:    http.StatusOK,
+			checks:  map[string]string{"firmament": "ok", "caches": "ok", "watchers": "ok", "scheduleBreaker": "ok"},
+		},
+		{
+			name:    "firmament down",
+			states:  ready,
+			healthy: false,
+			code:    http.StatusServiceUnavailable,
+			checks:  map[string]string{"firmament": "not connected", "caches": "ok", "watchers": "ok", "scheduleBreaker": "ok"},
+		},
+		{
+			name:    "caches not synced",
+			states:  notSynced,
+			healthy: true,
+			code:    http.StatusServiceUnavailable,
+			checks:  map[string]string{"firmament": "ok", "caches": "not synced", "watchers": "ok", "scheduleBreaker": "ok"},
+		},
+		{
+			name:    "breaker open",
+			states:  breakerOpen,
+			healthy: true,
+			code:    http.StatusServiceUnavailable,
+			checks: map[string]string{"firmament": "ok", "caches": "ok", "watchers": "ok",
+				"scheduleBreaker": "scheduling rounds skipped, breaker open"},
+		},
+		{
+			name:    "leader",
+			states:  leader,
+			healthy: true,
+			code:    http.StatusOK,
+			leader:  "true",
+			checks:  map[string]string{"firmament": "ok", "caches": "ok", "watchers": "ok", "scheduleBreaker": "ok"},
+		},
+		{
+			// A standby replica does not watch the cluster.
+			name:    "standby",
+			states:  standby,
+			healthy: true,
+			code:    http.StatusOK,
+			leader:  "false",
+			checks:  map[string]string{"firmament": "ok"},
+		},
+	} {
+		restore := test.states.inject()
+		code, h := get(t, generateHealthzHandler(&fakeFirmament{healthy: test.healthy, breaker: test.states.breaker}), PathReady)
+		restore()
+		if code != test.code || h.Leader != test.leader || !reflect.DeepEqual(h.Checks, test.checks) {
+			t.Errorf("%s: got %d %q %v, want %d %q %v", test.name, code, h.Leader, h.Checks, test.code, test.leader, test.checks)
+		}
+	}
+}
+
+func TestHealthCheckAddress(t *testing.T) {
+	for _, test := range []struct {
+		address  string
+		port     int
+		expected string
+	}{
+		{"0.0.0.0:8989", 0, "0.0.0.0:8989"},
+		{"0.0.0.0:8989", 10251, "0.0.0.0:10251"},
+		{":8989", 10251, ":10251"},
+	} {
+		if address := healthCheckAddress(test.address, test.port); address != test.expected {
+			t.Errorf("healthCheckAddress(%q, %d) = %q, want %q", test.address, test.port, address, test.expected)
+		}
+	}
+}
+
+// populateScheduler replaces the nodes and tasks of the scheduler with a node and the task of a pod placed on it, the
+// returned function restores them.
+func populateScheduler() func() {
+	nodes, tasks, resources := k8sclient.NodeToRTND, k8sclient.PodToTD, k8sclient.ResIDToNode
+	k8sclient.PodMux = new(sync.RWMutex)
+	k8sclient.NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node-a": {ResourceDesc: &firmament.ResourceDescriptor{
+			Uuid:             "node-a-uuid",
+			ResourceCapacity: &firmament.ResourceVector{CpuCores: 2000, RamCap: 4096},
+			Labels:           []*firmament.Label{{Key: "owner", Value: "team-a"}},
+		}},
+	}
+	k8sclient.ResIDToNode = map[string]string{"node-a-uuid": "node-a", "node-a-pu-0": "node-a"}
+	k8sclient.PodToTD = map[k8sclient.PodIdentifier]*firmament.TaskDescriptor{
+		{Namespace: "default", Name: "web"}: {
+			Uid:                 1,
+			State:               firmament.TaskDescriptor_RUNNING,
+			ScheduledToResource: "node-a-pu-0",
+			ResourceRequest:     &firmament.ResourceVector{CpuCores: 500},
+			Labels:              []*firmament.Label{{Key: "token", Value: "s3cr3t"}},
+		},
+	}
+	return func() {
+		k8sclient.NodeToRTND, k8sclient.PodToTD, k8sclient.ResIDToNode = nodes, tasks, resources
+	}
+}
+
+func getDump(t *testing.T, handlers map[string]http.Handler, path string, dump interface{}) string {
+	recorder := httptest.NewRecorder()
+	handlers[path].ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("%s: got %d %q, want %d application/json", path, recorder.Code, recorder.Header().Get("Content-Type"), http.StatusOK)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), dump); err != nil {
+		t.Fatalf("Unable to parse the body %q of %s: %v", recorder.Body.String(), path, err)
+	}
+	return recorder.Body.String()
+}
+
+// TestDebugHandler checks the dumps of the nodes, tasks and queues of a populated scheduler, with the label values
+// redacted or not.
+func TestDebugHandler(t *testing.T) {
+	defer populateScheduler()()
+
+	var nodes []k8sclient.NodeDump
+	getDump(t, generateDebugHandler(false), PathDebugNodes, &nodes)
+	expectedNodes := []k8sclient.NodeDump{{
+		Hostname: "node-a",
+		UUID:     "node-a-uuid",
+		Capacity: &firmament.ResourceVector{CpuCores: 2000, RamCap: 4096},
+		Labels:   map[string]string{"owner": "team-a"},
+	}}
+	if !reflect.DeepEqual(nodes, expectedNodes) {
+		t.Errorf("got the nodes %+v, want %+v", nodes, expectedNodes)
+	}
+
+	var tasks []k8sclient.TaskDump
+	body := getDump(t, generateDebugHandler(true), PathDebugTasks, &tasks)
+	expectedTasks := []k8sclient.TaskDump{{
+		Namespace: "default",
+		Pod:       "web",
+		UID:       1,
+		State:     "RUNNING",
+		Request:   &firmament.ResourceVector{CpuCores: 500},
+		Resource:  "node-a-pu-0",
+		Node:      "node-a",
+		Labels:    map[string]string{"token": k8sclient.RedactedValue},
+	}}
+	if !reflect.DeepEqual(tasks, expectedTasks) {
+		t.Errorf("got the tasks %+v, want %+v", tasks, expectedTasks)
+	}
+	if strings.Contains(body, "s3cr3t") {
+		t.Errorf("expected the label values to be redacted, got %s", body)
+	}
+
+	var queues []k8sclient.QueueDump
+	if body := getDump(t, generateDebugHandler(true), PathDebugQueues, &queues); len(queues) != 0 {
+		t.Errorf("expected no queue while the watchers are not started, got %s", body)
+	}
+
+	recorder := httptest.NewRecorder()
+	generateDebugHandler(true)[PathDebugNodes].ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, PathDebugNodes, nil))
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != http.MethodGet {
+		t.Errorf("POST %s: got %d, want %d", PathDebugNodes, recorder.Code, http.StatusMethodNotAllowed)
+	}
+}
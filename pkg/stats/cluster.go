@@ -0,0 +1,304 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/k8sclient"
+	"github.com/kubernetes-sigs/poseidon/pkg/logging"
+	"github.com/kubernetes-sigs/poseidon/pkg/units"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// MinStatsInterval is the shortest interval between the stats sent to firmament.
+const MinStatsInterval = 5 * time.Second
+
+// statsJitterFactor is the maximum fraction of the interval added to the wait between two stats cycles, so that
+// the Poseidon instances of different clusters do not read a shared monitoring stack at the same time.
+const statsJitterFactor = 0.1
+
+// runStats runs the cycles of a stats source every jittered interval until stopCh is closed.
+func runStats(pushStats func(), interval time.Duration, stopCh <-chan struct{}) {
+	wait.JitterUntil(pushStats, interval, statsJitterFactor, true, stopCh)
+}
+
+// clusterState holds the nodes and the pods of the cluster, which complete the usage read by the stats sources
+// with the capacity, the allocatable resources, the requests and the limits.
+type clusterState struct {
+	nodes map[string]*v1.Node
+	pods  map[k8sclient.PodIdentifier]*v1.Pod
+	// cpuRequests and memRequests hold the resources requested by the pods running on the nodes.
+	cpuRequests map[string]int64
+	memRequests map[string]int64
+}
+
+// newClientset creates the client of the API server of the kubeconfig used by the stats sources.
+func newClientset(kubeConfig string) kubernetes.Interface {
+	restConfig, err := k8sclient.GetClientConfig(kubeConfig)
+	if err != nil {
+		glog.Fatalf("Failed to load client config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		glog.Fatalf("Failed to create connection: %v", err)
+	}
+	return clientset
+}
+
+// listClusterState lists the nodes and the pods of the cluster.
+func listClusterState(clientset kubernetes.Interface) (*clusterState, error) {
+	nodeList, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	podList, err := clientset.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	state := &clusterState{
+		nodes:       make(map[string]*v1.Node, len(nodeList.Items)),
+		pods:        make(map[k8sclient.PodIdentifier]*v1.Pod, len(podList.Items)),
+		cpuRequests: make(map[string]int64),
+		memRequests: make(map[string]int64),
+	}
+	for i := range nodeList.Items {
+		state.nodes[nodeList.Items[i].Name] = &nodeList.Items[i]
+	}
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		state.pods[k8sclient.PodIdentifier{Name: pod.Name, Namespace: pod.Namespace}] = pod
+		if pod.Spec.NodeName == "" || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		cpuRequest, _, memRequest, _ := podResources(pod)
+		state.cpuRequests[pod.Spec.NodeName] += cpuRequest
+		state.memRequests[pod.Spec.NodeName] += memRequest
+	}
+	return state, nil
+}
+
+// resourceStats returns the stats of the node without usage, see setUtilization. The reservation of the node is
+// the fraction of its allocatable resources requested by the pods running on it. It returns false if the node
+// is not known by firmament.
+func (c *clusterState) resourceStats(nodeName string, timestamp metav1.Time) (*firmament.ResourceStats, bool) {
+	k8sclient.NodeMux.RLock()
+	rtnd, ok := k8sclient.NodeToRTND[nodeName]
+	k8sclient.NodeMux.RUnlock()
+	node, found := c.nodes[nodeName]
+	if !ok || !found {
+		return nil, false
+	}
+	cpuAllocatable := node.Status.Allocatable.Cpu().MilliValue()
+	memAllocatable := units.BytesToKB(node.Status.Allocatable.Memory().Value())
+	return &firmament.ResourceStats{
+		ResourceId: rtnd.GetResourceDesc().GetUuid(),
+		Timestamp:  statsTimestamp(timestamp),
+		CpusStats: []*firmament.CpuStats{{
+			CpuAllocatable: cpuAllocatable,
+			CpuCapacity:    node.Status.Capacity.Cpu().MilliValue(),
+			CpuReservation: fraction(c.cpuRequests[nodeName], cpuAllocatable),
+		}},
+		MemAllocatable: memAllocatable,
+		MemCapacity:    units.BytesToKB(node.Status.Capacity.Memory().Value()),
+		MemReservation: fraction(c.memRequests[nodeName], memAllocatable),
+	}, true
+}
+
+// setUtilization sets the utilization of the node, the fraction of its allocatable resources used, from its cpu
+// usage in millicores and its memory usage in KB.
+func setUtilization(resourceStats *firmament.ResourceStats, cpuUsage, memUsage int64) {
+	for _, cpuStats := range resourceStats.CpusStats {
+		cpuStats.CpuUtilization = fraction(cpuUsage, cpuStats.CpuAllocatable)
+	}
+	resourceStats.MemUtilization = fraction(memUsage, resourceStats.MemAllocatable)
+}
+
+// nodeResourceTopology reports if the nodes advertise their NUMA zones, in which case a machine may hold several
+// PUs, see puStats.
+var nodeResourceTopology = config.GetNodeResourceTopology
+
+// puStats returns the stats of the node broken down to its PUs, or the stats of the node if it has a single PU or
+// the nodes do not advertise their NUMA zones. The sources do not report the usage of the cpus, the allocatable
+// resources, the capacity and the network bandwidth of the node are divided between its PUs in proportion to their
+// capacity. Every PU gets the utilization and the reservation of the node, so that the usage of the PUs sums to the
+// usage of the node.
+func puStats(nodeName string, resourceStats *firmament.ResourceStats) []*firmament.ResourceStats {
+	if !nodeResourceTopology() {
+		return []*firmament.ResourceStats{resourceStats}
+	}
+	var puIDs []string
+	var cpuWeights, memWeights []float64
+	k8sclient.NodeMux.RLock()
+	if rtnd, ok := k8sclient.NodeToRTND[nodeName]; ok {
+		for _, pu := range getPUs(rtnd, nil) {
+			puIDs = append(puIDs, pu.GetUuid())
+			cpuWeights = append(cpuWeights, float64(pu.GetResourceCapacity().GetCpuCores()))
+			memWeights = append(memWeights, float64(pu.GetResourceCapacity().GetRamCap()))
+		}
+	}
+	k8sclient.NodeMux.RUnlock()
+	if len(puIDs) <= 1 {
+		return []*firmament.ResourceStats{resourceStats}
+	}
+	memAllocatable := divide(resourceStats.MemAllocatable, memWeights)
+	memCapacity := divide(resourceStats.MemCapacity, memWeights)
+	netRxBw := divide(resourceStats.NetRxBw, cpuWeights)
+	netTxBw := divide(resourceStats.NetTxBw, cpuWeights)
+	diskBw := divide(resourceStats.DiskBw, cpuWeights)
+	allStats := make([]*firmament.ResourceStats, len(puIDs))
+	for i, puID := range puIDs {
+		allStats[i] = &firmament.ResourceStats{
+			ResourceId:     puID,
+			Timestamp:      resourceStats.Timestamp,
+			MemAllocatable: memAllocatable[i],
+			MemCapacity:    memCapacity[i],
+			MemReservation: resourceStats.MemReservation,
+			MemUtilization: resourceStats.MemUtilization,
+			DiskBw:         diskBw[i],
+			NetRxBw:        netRxBw[i],
+			NetTxBw:        netTxBw[i],
+		}
+	}
+	for _, cpuStats := range resourceStats.CpusStats {
+		cpuAllocatable := divide(cpuStats.CpuAllocatable, cpuWeights)
+		cpuCapacity := divide(cpuStats.CpuCapacity, cpuWeights)
+		for i := range allStats {
+			allStats[i].CpusStats = append(allStats[i].CpusStats, &firmament.CpuStats{
+				CpuAllocatable: cpuAllocatable[i],
+				CpuCapacity:    cpuCapacity[i],
+				CpuReservation: cpuStats.CpuReservation,
+				CpuUtilization: cpuStats.CpuUtilization,
+			})
+		}
+	}
+	return allStats
+}
+
+// getPUs appends the PUs, the leaves of the topology below the resource, to pus.
+func getPUs(rtnd *firmament.ResourceTopologyNodeDescriptor, pus []*firmament.ResourceDescriptor) []*firmament.ResourceDescriptor {
+	if len(rtnd.GetChildren()) == 0 && rtnd.GetResourceDesc().GetType() == firmament.ResourceDescriptor_RESOURCE_PU {
+		return append(pus, rtnd.GetResourceDesc())
+	}
+	for _, child := range rtnd.GetChildren() {
+		pus = getPUs(child, pus)
+	}
+	return pus
+}
+
+// divide divides the value in proportion to the weights, evenly if the weights are all zero. The last part gets
+// the remainder of the rounding, so that the parts sum to the value.
+func divide(value int64, weights []float64) []int64 {
+	var total float64
+	for _, weight := range weights {
+		total += weight
+	}
+	parts := make([]int64, len(weights))
+	remainder := value
+	for i := range weights[:len(weights)-1] {
+		if total > 0 {
+			parts[i] = int64(float64(value) * weights[i] / total)
+		} else {
+			parts[i] = value / int64(len(weights))
+		}
+		remainder -= parts[i]
+	}
+	parts[len(parts)-1] = remainder
+	return parts
+}
+
+// taskStats returns the stats of the pod without usage, holding the node it runs on, its requests and its limits.
+// It returns false, logging the reason at V(2), if the pod is not known by firmament, e.g. it is scheduled by
+// another scheduler, if it terminated since the metrics were collected, or if its node is not known by firmament.
+func (c *clusterState) taskStats(podIdentifier k8sclient.PodIdentifier, timestamp metav1.Time) (*firmament.TaskStats, bool) {
+	k8sclient.PodMux.RLock()
+	td, ok := k8sclient.PodToTD[podIdentifier]
+	k8sclient.PodMux.RUnlock()
+	if !ok {
+		logging.V(2).Info("Skipping the stats of pod unknown by firmament", "pod", podIdentifier.UniqueName())
+		return nil, false
+	}
+	pod, found := c.pods[podIdentifier]
+	if !found || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		logging.V(2).Info("Skipping the stats of pod which terminated", "pod", podIdentifier.UniqueName(), "taskID", td.GetUid())
+		return nil, false
+	}
+	k8sclient.NodeMux.RLock()
+	_, ok = k8sclient.NodeToRTND[pod.Spec.NodeName]
+	k8sclient.NodeMux.RUnlock()
+	if !ok {
+		logging.V(2).Info("Skipping the stats of pod running on a node unknown by firmament", "pod", podIdentifier.UniqueName(), "taskID", td.GetUid(), "hostname", pod.Spec.NodeName)
+		return nil, false
+	}
+	cpuRequest, cpuLimit, memRequest, memLimit := podResources(pod)
+	return &firmament.TaskStats{
+		TaskId:     td.GetUid(),
+		Hostname:   pod.Spec.NodeName,
+		Timestamp:  statsTimestamp(timestamp),
+		CpuLimit:   cpuLimit,
+		CpuRequest: cpuRequest,
+		MemLimit:   memLimit,
+		MemRequest: memRequest,
+	}, true
+}
+
+// addTaskStats sends the stats of the pod. The failures of the pods deleted while their stats were sent are only
+// logged at V(2), firmament may have removed their task already.
+func addTaskStats(fc firmament.Client, podIdentifier k8sclient.PodIdentifier, taskStats *firmament.TaskStats) {
+	err := fc.AddTaskStats(taskStats)
+	if err == nil {
+		return
+	}
+	k8sclient.PodMux.RLock()
+	_, ok := k8sclient.PodToTD[podIdentifier]
+	k8sclient.PodMux.RUnlock()
+	if !ok {
+		logging.V(2).Info("Unable to send the stats of pod deleted in the meantime", "pod", podIdentifier.UniqueName(), "taskID", taskStats.GetTaskId(), "err", err)
+		return
+	}
+	logging.Error("Unable to send the stats of pod", "pod", podIdentifier.UniqueName(), "taskID", taskStats.GetTaskId(), "err", err)
+}
+
+// podResources returns the cpu requests and limits in millicores, and the memory requests and limits in KB,
+// of the containers of the pod.
+func podResources(pod *v1.Pod) (cpuRequest, cpuLimit, memRequest, memLimit int64) {
+	for _, container := range pod.Spec.Containers {
+		cpuRequest += container.Resources.Requests.Cpu().MilliValue()
+		cpuLimit += container.Resources.Limits.Cpu().MilliValue()
+		memRequest += units.BytesToKB(container.Resources.Requests.Memory().Value())
+		memLimit += units.BytesToKB(container.Resources.Limits.Memory().Value())
+	}
+	return cpuRequest, cpuLimit, memRequest, memLimit
+}
+
+// statsTimestamp converts the time of a sample to the timestamp of the stats, in microseconds.
+func statsTimestamp(timestamp metav1.Time) uint64 {
+	return uint64(timestamp.UnixNano() / int64(time.Microsecond))
+}
+
+func fraction(value, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(value) / float64(total)
+}
@@ -0,0 +1,356 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/k8sclient"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// KubeletSummary is the subset of the kubelet Summary API (stats/v1alpha1) used to build the node and task stats.
+// The filesystem usage is parsed, but firmament's stats have no field to carry it yet.
+type KubeletSummary struct {
+	Node SummaryNodeStats  `json:"node"`
+	Pods []SummaryPodStats `json:"pods"`
+}
+
+// SummaryNodeStats holds the usage of a node.
+type SummaryNodeStats struct {
+	NodeName string              `json:"nodeName"`
+	CPU      SummaryCPUStats     `json:"cpu"`
+	Memory   SummaryMemoryStats  `json:"memory"`
+	Network  SummaryNetworkStats `json:"network"`
+	Fs       SummaryFsStats      `json:"fs"`
+}
+
+// SummaryPodStats holds the usage of a pod. The cpu and memory usage of the pod are only reported by the recent
+// kubelets, the usage of its containers is summed otherwise.
+type SummaryPodStats struct {
+	PodRef           SummaryPodReference     `json:"podRef"`
+	Containers       []SummaryContainerStats `json:"containers"`
+	CPU              *SummaryCPUStats        `json:"cpu,omitempty"`
+	Memory           *SummaryMemoryStats     `json:"memory,omitempty"`
+	Network          SummaryNetworkStats     `json:"network"`
+	EphemeralStorage SummaryFsStats          `json:"ephemeral-storage"`
+}
+
+// SummaryPodReference identifies the pod of SummaryPodStats.
+type SummaryPodReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// SummaryContainerStats holds the usage of a container of a pod.
+type SummaryContainerStats struct {
+	Name   string             `json:"name"`
+	CPU    SummaryCPUStats    `json:"cpu"`
+	Memory SummaryMemoryStats `json:"memory"`
+	Rootfs SummaryFsStats     `json:"rootfs"`
+}
+
+// SummaryCPUStats holds the cpu usage sampled at Time.
+type SummaryCPUStats struct {
+	Time           metav1.Time `json:"time"`
+	UsageNanoCores uint64      `json:"usageNanoCores"`
+}
+
+// SummaryMemoryStats holds the memory usage in bytes, and the cumulative page faults.
+type SummaryMemoryStats struct {
+	Time            metav1.Time `json:"time"`
+	UsageBytes      uint64      `json:"usageBytes"`
+	WorkingSetBytes uint64      `json:"workingSetBytes"`
+	RSSBytes        uint64      `json:"rssBytes"`
+	PageFaults      uint64      `json:"pageFaults"`
+	MajorPageFaults uint64      `json:"majorPageFaults"`
+}
+
+// SummaryNetworkStats holds the cumulative traffic of the default interface and of every interface.
+type SummaryNetworkStats struct {
+	Time metav1.Time `json:"time"`
+	SummaryInterfaceStats
+	Interfaces []SummaryInterfaceStats `json:"interfaces"`
+}
+
+// SummaryInterfaceStats holds the cumulative traffic of a network interface.
+type SummaryInterfaceStats struct {
+	Name     string `json:"name"`
+	RxBytes  uint64 `json:"rxBytes"`
+	RxErrors uint64 `json:"rxErrors"`
+	TxBytes  uint64 `json:"txBytes"`
+	TxErrors uint64 `json:"txErrors"`
+}
+
+// SummaryFsStats holds the usage of a filesystem in bytes.
+type SummaryFsStats struct {
+	AvailableBytes uint64 `json:"availableBytes"`
+	CapacityBytes  uint64 `json:"capacityBytes"`
+	UsedBytes      uint64 `json:"usedBytes"`
+}
+
+// total returns the traffic of every interface, or of the default interface if the interfaces are not reported.
+func (n *SummaryNetworkStats) total() SummaryInterfaceStats {
+	if len(n.Interfaces) == 0 {
+		return n.SummaryInterfaceStats
+	}
+	var total SummaryInterfaceStats
+	for _, iface := range n.Interfaces {
+		total.RxBytes += iface.RxBytes
+		total.RxErrors += iface.RxErrors
+		total.TxBytes += iface.TxBytes
+		total.TxErrors += iface.TxErrors
+	}
+	return total
+}
+
+// usage returns the cpu and memory usage of the pod, summing the usage of its containers if the kubelet does
+// not report the usage of the pod.
+func (p *SummaryPodStats) usage() (SummaryCPUStats, SummaryMemoryStats) {
+	if p.CPU != nil && p.Memory != nil {
+		return *p.CPU, *p.Memory
+	}
+	var cpu SummaryCPUStats
+	var memory SummaryMemoryStats
+	for _, container := range p.Containers {
+		cpu.Time = container.CPU.Time
+		cpu.UsageNanoCores += container.CPU.UsageNanoCores
+		memory.Time = container.Memory.Time
+		memory.UsageBytes += container.Memory.UsageBytes
+		memory.WorkingSetBytes += container.Memory.WorkingSetBytes
+		memory.RSSBytes += container.Memory.RSSBytes
+		memory.PageFaults += container.Memory.PageFaults
+		memory.MajorPageFaults += container.Memory.MajorPageFaults
+	}
+	return cpu, memory
+}
+
+func parseKubeletSummary(data []byte) (*KubeletSummary, error) {
+	summary := &KubeletSummary{}
+	if err := json.Unmarshal(data, summary); err != nil {
+		return nil, fmt.Errorf("unable to parse the kubelet stats summary: %v", err)
+	}
+	return summary, nil
+}
+
+// SummaryFunc reads the Summary API of the kubelet of the node, until the context is done.
+type SummaryFunc func(ctx context.Context, nodeName string) ([]byte, error)
+
+// NewKubeletSummaryFunc returns a SummaryFunc reading the Summary API of the kubelets through the node proxy of
+// the API server.
+func NewKubeletSummaryFunc(client rest.Interface) SummaryFunc {
+	return func(ctx context.Context, nodeName string) ([]byte, error) {
+		return client.Get().AbsPath("/api/v1/nodes", nodeName, "proxy/stats/summary").Context(ctx).DoRaw()
+	}
+}
+
+// counterSample holds the cumulative counters of a node or a pod, the rates are computed from two samples.
+type counterSample struct {
+	time     time.Time
+	counters []uint64
+}
+
+// kubeletSummarySource pushes the usage reported by the kubelets to firmament, completed with the state of the
+// cluster, see clusterState. Unlike metrics-server, the kubelets report the network traffic.
+type kubeletSummarySource struct {
+	clientset   kubernetes.Interface
+	summaryFunc SummaryFunc
+	fc          firmament.Client
+	// workers is the number of summaries read in parallel, each within timeout.
+	workers int
+	timeout time.Duration
+	// samples holds the counters of the previous cycle by node and pod, nextSamples those of the current cycle.
+	samples     map[string]counterSample
+	nextSamples map[string]counterSample
+}
+
+// StartKubeletSummarySource sends the stats of the nodes and the pods known by firmament every interval, until
+// stopCh is closed. The usage is read from the Summary API of the kubelets, through the API server of the
+// kubeconfig, by the given number of workers in parallel. The summaries which are not read within the timeout are
+// skipped until the next cycle.
+func StartKubeletSummarySource(kubeConfig string, fc firmament.Client, interval time.Duration, workers int, timeout time.Duration, stopCh <-chan struct{}) {
+	glog.Info("Starting kubelet summary stats source...")
+	clientset := newClientset(kubeConfig)
+	source := newKubeletSummarySource(clientset, NewKubeletSummaryFunc(clientset.CoreV1().RESTClient()), fc, workers, timeout)
+	runStats(source.pushStats, interval, stopCh)
+}
+
+func newKubeletSummarySource(clientset kubernetes.Interface, summaryFunc SummaryFunc, fc firmament.Client, workers int, timeout time.Duration) *kubeletSummarySource {
+	return &kubeletSummarySource{
+		clientset:   clientset,
+		summaryFunc: summaryFunc,
+		fc:          fc,
+		workers:     workers,
+		timeout:     timeout,
+		samples:     make(map[string]counterSample),
+	}
+}
+
+func (s *kubeletSummarySource) pushStats() {
+	state, err := listClusterState(s.clientset)
+	if err != nil {
+		glog.Errorf("Unable to list the nodes and the pods of the stats: %v", err)
+		return
+	}
+	var nodeNames []string
+	k8sclient.NodeMux.RLock()
+	for nodeName := range state.nodes {
+		if _, ok := k8sclient.NodeToRTND[nodeName]; ok {
+			nodeNames = append(nodeNames, nodeName)
+		}
+	}
+	k8sclient.NodeMux.RUnlock()
+	sort.Strings(nodeNames)
+	s.nextSamples = make(map[string]counterSample)
+	for _, summary := range s.readSummaries(nodeNames) {
+		s.pushNodeStats(state, &summary.Node)
+		for i := range summary.Pods {
+			s.pushTaskStats(state, &summary.Pods[i])
+		}
+	}
+	// The samples of the nodes and the pods which are gone are dropped.
+	s.samples = s.nextSamples
+}
+
+// readSummaries reads the summaries of the nodes with a bounded pool of workers, so that a dead kubelet only
+// delays the cycle by the timeout. The summaries which are read are returned in the order of the nodes.
+func (s *kubeletSummarySource) readSummaries(nodeNames []string) []*KubeletSummary {
+	summaries := make([]*KubeletSummary, len(nodeNames))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers && i < len(nodeNames); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				summaries[index] = s.readSummary(nodeNames[index])
+			}
+		}()
+	}
+	for index := range nodeNames {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	read := summaries[:0]
+	for _, summary := range summaries {
+		if summary != nil {
+			read = append(read, summary)
+		}
+	}
+	return read
+}
+
+func (s *kubeletSummarySource) readSummary(nodeName string) *KubeletSummary {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	data, err := s.summaryFunc(ctx, nodeName)
+	if err != nil {
+		glog.Errorf("Unable to read the stats summary of node %s: %v", nodeName, err)
+		return nil
+	}
+	summary, err := parseKubeletSummary(data)
+	if err != nil {
+		glog.Errorf("Unable to read the stats summary of node %s: %v", nodeName, err)
+		return nil
+	}
+	return summary
+}
+
+// pushNodeStats sends the stats of the node, with its network bandwidth in KB/s since the previous cycle.
+func (s *kubeletSummarySource) pushNodeStats(state *clusterState, node *SummaryNodeStats) {
+	resourceStats, ok := state.resourceStats(node.NodeName, node.CPU.Time)
+	if !ok {
+		glog.V(2).Infof("Skipping the stats summary of node %s unknown by firmament", node.NodeName)
+		return
+	}
+	setUtilization(resourceStats, int64(node.CPU.UsageNanoCores/uint64(time.Millisecond)), int64(node.Memory.WorkingSetBytes/1024))
+	network := node.Network.total()
+	rates := s.rates("node/"+node.NodeName, node.Network.Time, network.RxBytes, network.TxBytes)
+	resourceStats.NetRxBw = int64(rates[0] / 1024)
+	resourceStats.NetTxBw = int64(rates[1] / 1024)
+	for _, resourceStats := range puStats(node.NodeName, resourceStats) {
+		if err := s.fc.AddNodeStats(resourceStats); err != nil {
+			glog.Errorf("Unable to send the stats of resource %s of node %s: %v", resourceStats.ResourceId, node.NodeName, err)
+		}
+	}
+}
+
+// pushTaskStats sends the stats of the pod, with its network traffic in KB and its rates since the previous cycle.
+func (s *kubeletSummarySource) pushTaskStats(state *clusterState, pod *SummaryPodStats) {
+	podIdentifier := k8sclient.PodIdentifier{Name: pod.PodRef.Name, Namespace: pod.PodRef.Namespace}
+	cpu, memory := pod.usage()
+	taskStats, ok := state.taskStats(podIdentifier, cpu.Time)
+	if !ok {
+		return
+	}
+	taskStats.CpuUsage = int64(cpu.UsageNanoCores / uint64(time.Millisecond))
+	taskStats.MemUsage = int64(memory.UsageBytes / 1024)
+	taskStats.MemRss = int64(memory.RSSBytes / 1024)
+	if memory.UsageBytes > memory.WorkingSetBytes {
+		// The usage includes the inactive page cache, which is not part of the working set.
+		taskStats.MemCache = int64((memory.UsageBytes - memory.WorkingSetBytes) / 1024)
+	}
+	taskStats.MemWorkingSet = int64(memory.WorkingSetBytes / 1024)
+	taskStats.MemPageFaults = int64(memory.PageFaults)
+	taskStats.MajorPageFaults = int64(memory.MajorPageFaults)
+	memRates := s.rates("pod-memory/"+podIdentifier.UniqueName(), memory.Time, memory.PageFaults, memory.MajorPageFaults)
+	taskStats.MemPageFaultsRate = memRates[0]
+	taskStats.MajorPageFaultsRate = memRates[1]
+	network := pod.Network.total()
+	taskStats.NetRx = int64(network.RxBytes / 1024)
+	taskStats.NetRxErrors = int64(network.RxErrors)
+	taskStats.NetTx = int64(network.TxBytes / 1024)
+	taskStats.NetTxErrors = int64(network.TxErrors)
+	netRates := s.rates("pod-network/"+podIdentifier.UniqueName(), pod.Network.Time, network.RxBytes, network.RxErrors, network.TxBytes, network.TxErrors)
+	taskStats.NetRxRate = netRates[0] / 1024
+	taskStats.NetRxErrorsRate = netRates[1]
+	taskStats.NetTxRate = netRates[2] / 1024
+	taskStats.NetTxErrorsRate = netRates[3]
+	addTaskStats(s.fc, podIdentifier, taskStats)
+}
+
+// rates returns the per second rates of the counters since the previous sample of the key, and records the
+// sample for the next cycle. The rates are 0 for the first sample of a key, and for the counters which were
+// reset, e.g. by a restarted container.
+func (s *kubeletSummarySource) rates(key string, sampleTime metav1.Time, counters ...uint64) []float64 {
+	rates := make([]float64, len(counters))
+	s.nextSamples[key] = counterSample{time: sampleTime.Time, counters: counters}
+	previous, ok := s.samples[key]
+	if !ok || len(previous.counters) != len(counters) {
+		return rates
+	}
+	elapsed := sampleTime.Sub(previous.time).Seconds()
+	if elapsed <= 0 {
+		return rates
+	}
+	for i, counter := range counters {
+		if counter >= previous.counters[i] {
+			rates[i] = float64(counter-previous.counters[i]) / elapsed
+		}
+	}
+	return rates
+}
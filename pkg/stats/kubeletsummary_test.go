@@ -0,0 +1,324 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament/firmamenttest"
+	"github.com/kubernetes-sigs/poseidon/pkg/k8sclient"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// kubeletSummaryNode0 is the summary of a recent kubelet, reporting the usage of the pods and every interface.
+const kubeletSummaryNode0 = `{
+  "node": {
+    "nodeName": "node0",
+    "startTime": "2018-06-01T08:00:00Z",
+    "cpu": {"time": "2018-06-01T10:00:00Z", "usageNanoCores": 1900000000, "usageCoreNanoSeconds": 52000000000000},
+    "memory": {"time": "2018-06-01T10:00:00Z", "availableBytes": 3758096384, "usageBytes": 4294967296,
+      "workingSetBytes": 3758096384, "rssBytes": 2147483648, "pageFaults": 50000, "majorPageFaults": 200},
+    "network": {"time": "2018-06-01T10:00:00Z", "name": "eth0", "rxBytes": 1048576, "rxErrors": 0,
+      "txBytes": 2097152, "txErrors": 0,
+      "interfaces": [
+        {"name": "eth0", "rxBytes": 1048576, "rxErrors": 0, "txBytes": 2097152, "txErrors": 0},
+        {"name": "eth1", "rxBytes": 1048576, "rxErrors": 0, "txBytes": 0, "txErrors": 0}
+      ]},
+    "fs": {"time": "2018-06-01T10:00:00Z", "availableBytes": 75161927680, "capacityBytes": 107374182400,
+      "usedBytes": 32212254720, "inodesFree": 6000000, "inodes": 6553600, "inodesUsed": 553600}
+  },
+  "pods": [
+    {
+      "podRef": {"name": "pod0", "namespace": "default", "uid": "0b4f0b43-6584-11e8-a6e1-42010a800002"},
+      "startTime": "2018-06-01T09:00:00Z",
+      "containers": [
+        {"name": "app", "cpu": {"time": "2018-06-01T10:00:00Z", "usageNanoCores": 400000000},
+          "memory": {"time": "2018-06-01T10:00:00Z", "usageBytes": 524288000, "workingSetBytes": 471859200}},
+        {"name": "sidecar", "cpu": {"time": "2018-06-01T10:00:00Z", "usageNanoCores": 100000000},
+          "memory": {"time": "2018-06-01T10:00:00Z", "usageBytes": 104857600, "workingSetBytes": 65011712}}
+      ],
+      "cpu": {"time": "2018-06-01T10:00:00Z", "usageNanoCores": 500000000},
+      "memory": {"time": "2018-06-01T10:00:00Z", "usageBytes": 629145600, "workingSetBytes": 536870912,
+        "rssBytes": 419430400, "pageFaults": 1000, "majorPageFaults": 10},
+      "network": {"time": "2018-06-01T10:00:00Z", "name": "eth0", "rxBytes": 1048576, "rxErrors": 1,
+        "txBytes": 524288, "txErrors": 0,
+        "interfaces": [{"name": "eth0", "rxBytes": 1048576, "rxErrors": 1, "txBytes": 524288, "txErrors": 0}]},
+      "volume": [{"time": "2018-06-01T10:00:00Z", "name": "default-token", "usedBytes": 12288}],
+      "ephemeral-storage": {"time": "2018-06-01T10:00:00Z", "availableBytes": 75161927680,
+        "capacityBytes": 107374182400, "usedBytes": 1048576}
+    },
+    {
+      "podRef": {"name": "pod1", "namespace": "default", "uid": "1c5a1c54-6584-11e8-a6e1-42010a800002"},
+      "startTime": "2018-06-01T09:30:00Z",
+      "containers": [
+        {"name": "app", "cpu": {"time": "2018-06-01T10:00:00Z", "usageNanoCores": 100000000},
+          "memory": {"time": "2018-06-01T10:00:00Z", "usageBytes": 134217728, "workingSetBytes": 134217728,
+            "rssBytes": 104857600, "pageFaults": 300, "majorPageFaults": 0}}
+      ],
+      "network": {"time": "2018-06-01T10:00:00Z", "name": "eth0", "rxBytes": 2048, "rxErrors": 0,
+        "txBytes": 1024, "txErrors": 0}
+    },
+    {
+      "podRef": {"name": "kube-proxy-node0", "namespace": "kube-system", "uid": "2d6b2d65-6584-11e8-a6e1-42010a800002"},
+      "containers": [
+        {"name": "kube-proxy", "cpu": {"time": "2018-06-01T10:00:00Z", "usageNanoCores": 2000000},
+          "memory": {"time": "2018-06-01T10:00:00Z", "usageBytes": 20971520, "workingSetBytes": 20971520}}
+      ]
+    }
+  ]
+}`
+
+// kubeletSummaryNode1 is the summary of an older kubelet, reporting only the usage of the containers and the
+// traffic of the default interface.
+const kubeletSummaryNode1 = `{
+  "node": {
+    "nodeName": "node1",
+    "cpu": {"time": "2018-06-01T10:00:00Z", "usageNanoCores": 500000000},
+    "memory": {"time": "2018-06-01T10:00:00Z", "usageBytes": 1610612736, "workingSetBytes": 1073741824},
+    "network": {"time": "2018-06-01T10:00:00Z", "name": "eth0", "rxBytes": 4096, "rxErrors": 0,
+      "txBytes": 8192, "txErrors": 0},
+    "fs": {"time": "2018-06-01T10:00:00Z", "availableBytes": 42949672960, "capacityBytes": 53687091200,
+      "usedBytes": 10737418240}
+  },
+  "pods": [
+    {
+      "podRef": {"name": "pod2", "namespace": "default", "uid": "3e7c3e76-6584-11e8-a6e1-42010a800002"},
+      "containers": [
+        {"name": "app", "cpu": {"time": "2018-06-01T10:00:00Z", "usageNanoCores": 1000000000},
+          "memory": {"time": "2018-06-01T10:00:00Z", "usageBytes": 943718400, "workingSetBytes": 943718400,
+            "rssBytes": 943718400, "pageFaults": 100, "majorPageFaults": 1},
+          "rootfs": {"time": "2018-06-01T10:00:00Z", "usedBytes": 4096}}
+      ],
+      "network": {"time": "2018-06-01T10:00:00Z", "name": "eth0", "rxBytes": 0, "rxErrors": 0,
+        "txBytes": 0, "txErrors": 0}
+    }
+  ]
+}`
+
+func TestParseKubeletSummary(t *testing.T) {
+	summary, err := parseKubeletSummary([]byte(kubeletSummaryNode0))
+	if err != nil {
+		t.Fatal("unexpected error parsing the summary ", err)
+	}
+	if summary.Node.NodeName != "node0" || summary.Node.CPU.UsageNanoCores != 1900000000 ||
+		summary.Node.Memory.WorkingSetBytes != 3758096384 || summary.Node.Fs.UsedBytes != 32212254720 {
+		t.Errorf("unexpected node stats %+v", summary.Node)
+	}
+	expectedNetwork := SummaryInterfaceStats{RxBytes: 2097152, TxBytes: 2097152}
+	if network := summary.Node.Network.total(); network != expectedNetwork {
+		t.Errorf("expected the traffic of every interface %+v, got %+v", expectedNetwork, network)
+	}
+	if len(summary.Pods) != 3 {
+		t.Fatalf("expected 3 pods, got %d", len(summary.Pods))
+	}
+	pod := summary.Pods[0]
+	if pod.PodRef != (SummaryPodReference{Name: "pod0", Namespace: "default"}) || pod.EphemeralStorage.UsedBytes != 1048576 {
+		t.Errorf("unexpected pod stats %+v", pod)
+	}
+	if cpu, memory := pod.usage(); cpu.UsageNanoCores != 500000000 || memory.RSSBytes != 419430400 {
+		t.Errorf("expected the usage of the pod, got %+v and %+v", cpu, memory)
+	}
+
+	summary, err = parseKubeletSummary([]byte(kubeletSummaryNode1))
+	if err != nil {
+		t.Fatal("unexpected error parsing the summary ", err)
+	}
+	pod = summary.Pods[0]
+	if cpu, memory := pod.usage(); cpu.UsageNanoCores != 1000000000 || memory.WorkingSetBytes != 943718400 || memory.PageFaults != 100 {
+		t.Errorf("expected the usage of the containers, got %+v and %+v", cpu, memory)
+	}
+	expectedNetwork = SummaryInterfaceStats{Name: "eth0", RxBytes: 4096, TxBytes: 8192}
+	if network := summary.Node.Network.total(); network != expectedNetwork {
+		t.Errorf("expected the traffic of the default interface %+v, got %+v", expectedNetwork, network)
+	}
+	if pod.Containers[0].Rootfs.UsedBytes != 4096 {
+		t.Errorf("expected the rootfs usage of the container, got %+v", pod.Containers[0].Rootfs)
+	}
+
+	if _, err := parseKubeletSummary([]byte("{")); err == nil {
+		t.Error("expected an error parsing an invalid summary")
+	}
+}
+
+// advanceSummary moves the samples of the summary forward, adding the traffic to the default interface of the
+// node and of its pods, and the page faults to its pods.
+func advanceSummary(summary *KubeletSummary, elapsed time.Duration, rxBytes, txBytes, pageFaults uint64) {
+	advance := func(t *metav1.Time) { *t = metav1.NewTime(t.Add(elapsed)) }
+	addTraffic := func(network *SummaryNetworkStats) {
+		advance(&network.Time)
+		network.RxBytes += rxBytes
+		network.TxBytes += txBytes
+		for i := range network.Interfaces {
+			if network.Interfaces[i].Name == network.Name {
+				network.Interfaces[i].RxBytes += rxBytes
+				network.Interfaces[i].TxBytes += txBytes
+			}
+		}
+	}
+	advance(&summary.Node.CPU.Time)
+	advance(&summary.Node.Memory.Time)
+	addTraffic(&summary.Node.Network)
+	for i := range summary.Pods {
+		pod := &summary.Pods[i]
+		if pod.CPU != nil {
+			advance(&pod.CPU.Time)
+			advance(&pod.Memory.Time)
+			pod.Memory.PageFaults += pageFaults
+		}
+		for j := range pod.Containers {
+			advance(&pod.Containers[j].CPU.Time)
+			advance(&pod.Containers[j].Memory.Time)
+		}
+		addTraffic(&pod.Network)
+	}
+}
+
+// TestKubeletSummarySource_pushStats reads the summaries of a cluster of three nodes, one of them with a dead
+// kubelet, twice, and checks the stats sent to firmament and the rates computed from the two cycles.
+func TestKubeletSummarySource_pushStats(t *testing.T) {
+	k8sclient.NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node0": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node0-uuid"}},
+		"node1": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node1-uuid"}},
+		"node2": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node2-uuid"}},
+	}
+	k8sclient.PodMux = new(sync.RWMutex)
+	k8sclient.PodToTD = map[k8sclient.PodIdentifier]*firmament.TaskDescriptor{
+		{Name: "pod0", Namespace: "default"}: {Uid: 10},
+		{Name: "pod1", Namespace: "default"}: {Uid: 11},
+		{Name: "pod2", Namespace: "default"}: {Uid: 12},
+	}
+	clientset := fake.NewSimpleClientset(
+		buildStatsNode("node0", "4", "8Gi", "3800m", "7Gi"),
+		buildStatsNode("node1", "2", "4Gi", "2", "4Gi"),
+		buildStatsNode("node2", "2", "4Gi", "2", "4Gi"),
+		buildStatsPod("pod0", "node0", resourceList("1", "1Gi"), resourceList("2", "2Gi")),
+		buildStatsPod("pod1", "node0", resourceList("500m", "512Mi"), nil),
+		buildStatsPod("pod2", "node1", resourceList("1", "1Gi"), resourceList("1", "1Gi")),
+	)
+	summaries := make(map[string]*KubeletSummary)
+	for _, fixture := range []string{kubeletSummaryNode0, kubeletSummaryNode1} {
+		summary, err := parseKubeletSummary([]byte(fixture))
+		if err != nil {
+			t.Fatal("unexpected error parsing the summary ", err)
+		}
+		summaries[summary.Node.NodeName] = summary
+	}
+	var mu sync.Mutex
+	summaryFunc := func(ctx context.Context, nodeName string) ([]byte, error) {
+		if nodeName == "node2" {
+			// The kubelet of node2 is dead, its summary is never read.
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return json.Marshal(summaries[nodeName])
+	}
+	fc := firmamenttest.NewFakeClient()
+	source := newKubeletSummarySource(clientset, summaryFunc, fc, 2, 50*time.Millisecond)
+
+	start := time.Now()
+	source.pushStats()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the dead kubelet to be skipped after the timeout, the cycle took %v", elapsed)
+	}
+	micros := uint64(time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC).UnixNano() / int64(time.Microsecond))
+	expectedNodeStats := []interface{}{
+		&firmament.ResourceStats{
+			ResourceId: "node0-uuid",
+			Timestamp:  micros,
+			CpusStats: []*firmament.CpuStats{{
+				CpuAllocatable: 3800,
+				CpuCapacity:    4000,
+				CpuReservation: 1500.0 / 3800,
+				CpuUtilization: 0.5,
+			}},
+			MemAllocatable: 7 * 1024 * 1024,
+			MemCapacity:    8 * 1024 * 1024,
+			MemReservation: 1536.0 / (7 * 1024),
+			MemUtilization: 0.5,
+		},
+		&firmament.ResourceStats{
+			ResourceId: "node1-uuid",
+			Timestamp:  micros,
+			CpusStats: []*firmament.CpuStats{{
+				CpuAllocatable: 2000,
+				CpuCapacity:    2000,
+				CpuReservation: 0.5,
+				CpuUtilization: 0.25,
+			}},
+			MemAllocatable: 4 * 1024 * 1024,
+			MemCapacity:    4 * 1024 * 1024,
+			MemReservation: 0.25,
+			MemUtilization: 0.25,
+		},
+	}
+	if nodeStats := fc.Requests("AddNodeStats"); !reflect.DeepEqual(nodeStats, expectedNodeStats) {
+		t.Errorf("expected the node stats %v, got %v", expectedNodeStats, nodeStats)
+	}
+	expectedTaskStats := []interface{}{
+		&firmament.TaskStats{TaskId: 10, Hostname: "node0", Timestamp: micros,
+			CpuLimit: 2000, CpuRequest: 1000, CpuUsage: 500,
+			MemLimit: 2 * 1024 * 1024, MemRequest: 1024 * 1024, MemUsage: 600 * 1024, MemRss: 400 * 1024,
+			MemCache: 88 * 1024, MemWorkingSet: 512 * 1024, MemPageFaults: 1000, MajorPageFaults: 10,
+			NetRx: 1024, NetRxErrors: 1, NetTx: 512},
+		&firmament.TaskStats{TaskId: 11, Hostname: "node0", Timestamp: micros,
+			CpuRequest: 500, CpuUsage: 100,
+			MemRequest: 512 * 1024, MemUsage: 128 * 1024, MemRss: 100 * 1024, MemWorkingSet: 128 * 1024,
+			MemPageFaults: 300, NetRx: 2, NetTx: 1},
+		&firmament.TaskStats{TaskId: 12, Hostname: "node1", Timestamp: micros,
+			CpuLimit: 1000, CpuRequest: 1000, CpuUsage: 1000,
+			MemLimit: 1024 * 1024, MemRequest: 1024 * 1024, MemUsage: 900 * 1024, MemRss: 900 * 1024,
+			MemWorkingSet: 900 * 1024, MemPageFaults: 100, MajorPageFaults: 1},
+	}
+	if taskStats := fc.Requests("AddTaskStats"); !reflect.DeepEqual(taskStats, expectedTaskStats) {
+		t.Errorf("expected the task stats %v, got %v", expectedTaskStats, taskStats)
+	}
+
+	// 10MB received and 5MB sent by the nodes and the pods, and 100 page faults of the pods, in 10 seconds.
+	mu.Lock()
+	for _, summary := range summaries {
+		advanceSummary(summary, 10*time.Second, 10*1024*1024, 5*1024*1024, 100)
+	}
+	mu.Unlock()
+	source.pushStats()
+	nodeStats := fc.Requests("AddNodeStats")[2:]
+	for _, request := range nodeStats {
+		if stats := request.(*firmament.ResourceStats); stats.GetNetRxBw() != 1024 || stats.GetNetTxBw() != 512 {
+			t.Errorf("expected a bandwidth of 1024KB/s received and 512KB/s sent, got %v", stats)
+		}
+	}
+	taskStats := fc.Requests("AddTaskStats")[3:]
+	if len(nodeStats) != 2 || len(taskStats) != 3 {
+		t.Fatalf("expected the stats of 2 nodes and 3 pods, got %d and %d", len(nodeStats), len(taskStats))
+	}
+	for _, request := range taskStats {
+		if stats := request.(*firmament.TaskStats); stats.GetNetRxRate() != 1024 || stats.GetNetTxRate() != 512 {
+			t.Errorf("expected a traffic of 1024KB/s received and 512KB/s sent, got %v", stats)
+		}
+	}
+	if stats := taskStats[0].(*firmament.TaskStats); stats.GetMemPageFaultsRate() != 10 || stats.GetMajorPageFaultsRate() != 0 {
+		t.Errorf("expected 10 page faults per second, got %v", stats)
+	}
+}
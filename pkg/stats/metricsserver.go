@@ -0,0 +1,207 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/k8sclient"
+	"github.com/kubernetes-sigs/poseidon/pkg/logging"
+	"github.com/kubernetes-sigs/poseidon/pkg/units"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// SourceMetricsServer reads the stats from the metrics.k8s.io API served by metrics-server.
+	SourceMetricsServer = "metrics-server"
+	// SourceKubeletSummary reads the stats from the Summary API of the kubelets, including the network traffic.
+	SourceKubeletSummary = "kubelet-summary"
+	// SourceHeapster receives the stats pushed by the poseidon sink of Heapster on the stats server.
+	SourceHeapster = "heapster"
+)
+
+const (
+	// NodeMetricsPath is the API path of the NodeMetrics objects served by metrics-server.
+	NodeMetricsPath = "/apis/metrics.k8s.io/v1beta1/nodes"
+	// PodMetricsPath is the API path of the PodMetrics objects of all the namespaces served by metrics-server.
+	PodMetricsPath = "/apis/metrics.k8s.io/v1beta1/pods"
+)
+
+// NodeMetrics is the subset of the metrics.k8s.io/v1beta1 NodeMetrics object used to build the node stats.
+type NodeMetrics struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Timestamp         metav1.Time     `json:"timestamp"`
+	Usage             v1.ResourceList `json:"usage"`
+}
+
+// PodMetrics is the subset of the metrics.k8s.io/v1beta1 PodMetrics object used to build the task stats.
+type PodMetrics struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Timestamp         metav1.Time        `json:"timestamp"`
+	Containers        []ContainerMetrics `json:"containers"`
+}
+
+// ContainerMetrics holds the usage of a container of a PodMetrics object.
+type ContainerMetrics struct {
+	Name  string          `json:"name"`
+	Usage v1.ResourceList `json:"usage"`
+}
+
+// MetricsClient lists the usage of the nodes and the pods reported by metrics-server.
+type MetricsClient interface {
+	NodeMetrics() ([]NodeMetrics, error)
+	PodMetrics() ([]PodMetrics, error)
+}
+
+// restMetricsClient reads the metrics.k8s.io API through the REST client.
+type restMetricsClient struct {
+	client rest.Interface
+}
+
+// NewMetricsClient returns a MetricsClient listing the NodeMetrics and PodMetrics objects through the REST client.
+func NewMetricsClient(client rest.Interface) MetricsClient {
+	return &restMetricsClient{client: client}
+}
+
+func (c *restMetricsClient) NodeMetrics() ([]NodeMetrics, error) {
+	data, err := c.client.Get().AbsPath(NodeMetricsPath).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	list := &struct {
+		Items []NodeMetrics `json:"items"`
+	}{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("unable to parse NodeMetricsList: %v", err)
+	}
+	return list.Items, nil
+}
+
+func (c *restMetricsClient) PodMetrics() ([]PodMetrics, error) {
+	data, err := c.client.Get().AbsPath(PodMetricsPath).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	list := &struct {
+		Items []PodMetrics `json:"items"`
+	}{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("unable to parse PodMetricsList: %v", err)
+	}
+	return list.Items, nil
+}
+
+// metricsServerSource pushes the usage reported by metrics-server to firmament, completed with the state of the
+// cluster, see clusterState.
+type metricsServerSource struct {
+	clientset kubernetes.Interface
+	metrics   MetricsClient
+	fc        firmament.Client
+	// advertiseUsage subtracts the usage of the nodes from the resources available on their machines, see
+	// k8sclient.ApplyNodeUsage.
+	advertiseUsage bool
+}
+
+// StartMetricsServerSource sends the stats of the nodes and the pods known by firmament every interval, until stopCh
+// is closed. The usage is read from the metrics.k8s.io API served by metrics-server, through the API server of the
+// kubeconfig.
+func StartMetricsServerSource(kubeConfig string, fc firmament.Client, interval time.Duration, stopCh <-chan struct{}) {
+	glog.Info("Starting metrics-server stats source...")
+	clientset := newClientset(kubeConfig)
+	source := &metricsServerSource{
+		clientset:      clientset,
+		metrics:        NewMetricsClient(clientset.CoreV1().RESTClient()),
+		fc:             fc,
+		advertiseUsage: config.GetAdvertiseNodeUsage(),
+	}
+	runStats(source.pushStats, interval, stopCh)
+}
+
+func (s *metricsServerSource) pushStats() {
+	state, err := listClusterState(s.clientset)
+	if err != nil {
+		glog.Errorf("Unable to list the nodes and the pods of the stats: %v", err)
+		return
+	}
+	s.pushNodeStats(state)
+	s.pushTaskStats(state)
+}
+
+// pushNodeStats sends the stats of the nodes known by firmament. With advertiseUsage, the resources available on
+// the nodes are their allocatable resources minus their usage, or their allocatable resources while metrics-server
+// is unavailable.
+func (s *metricsServerSource) pushNodeStats(state *clusterState) {
+	nodeMetrics, err := s.metrics.NodeMetrics()
+	if err != nil {
+		glog.Errorf("Unable to read the node metrics from metrics-server: %v", err)
+		if s.advertiseUsage {
+			k8sclient.ApplyNodeUsage(s.fc, nil)
+		}
+		return
+	}
+	if s.advertiseUsage {
+		usage := make(map[string]v1.ResourceList, len(nodeMetrics))
+		for _, metrics := range nodeMetrics {
+			usage[metrics.Name] = metrics.Usage
+		}
+		k8sclient.ApplyNodeUsage(s.fc, usage)
+	}
+	for _, metrics := range nodeMetrics {
+		resourceStats, ok := state.resourceStats(metrics.Name, metrics.Timestamp)
+		if !ok {
+			logging.V(2).Info("Skipping the metrics of node unknown by firmament", "hostname", metrics.Name)
+			continue
+		}
+		setUtilization(resourceStats, metrics.Usage.Cpu().MilliValue(), units.BytesToKB(metrics.Usage.Memory().Value()))
+		for _, resourceStats := range puStats(metrics.Name, resourceStats) {
+			if err := s.fc.AddNodeStats(resourceStats); err != nil {
+				logging.Error("Unable to send the stats of node", "hostname", metrics.Name, "resourceUUID", resourceStats.ResourceId, "err", err)
+			}
+		}
+	}
+}
+
+// pushTaskStats sends the stats of the pods known by firmament. metrics-server reports the working set of the
+// containers as their memory usage.
+func (s *metricsServerSource) pushTaskStats(state *clusterState) {
+	podMetrics, err := s.metrics.PodMetrics()
+	if err != nil {
+		glog.Errorf("Unable to read the pod metrics from metrics-server: %v", err)
+		return
+	}
+	for _, metrics := range podMetrics {
+		podIdentifier := k8sclient.PodIdentifier{Name: metrics.Name, Namespace: metrics.Namespace}
+		taskStats, ok := state.taskStats(podIdentifier, metrics.Timestamp)
+		if !ok {
+			continue
+		}
+		for _, container := range metrics.Containers {
+			taskStats.CpuUsage += container.Usage.Cpu().MilliValue()
+			taskStats.MemUsage += units.BytesToKB(container.Usage.Memory().Value())
+		}
+		taskStats.MemWorkingSet = taskStats.MemUsage
+		addTaskStats(s.fc, podIdentifier, taskStats)
+	}
+}
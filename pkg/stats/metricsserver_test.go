@@ -0,0 +1,392 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/config"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament/firmamenttest"
+	"github.com/kubernetes-sigs/poseidon/pkg/k8sclient"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeMetricsClient returns the metrics of the test instead of reading them from metrics-server.
+type fakeMetricsClient struct {
+	nodes []NodeMetrics
+	pods  []PodMetrics
+	// nodesErr is returned instead of the node metrics when set, e.g. when metrics-server is unavailable.
+	nodesErr error
+}
+
+func (c *fakeMetricsClient) NodeMetrics() ([]NodeMetrics, error) {
+	if c.nodesErr != nil {
+		return nil, c.nodesErr
+	}
+	return c.nodes, nil
+}
+
+func (c *fakeMetricsClient) PodMetrics() ([]PodMetrics, error) {
+	return c.pods, nil
+}
+
+func resourceList(cpu, mem string) v1.ResourceList {
+	return v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpu), v1.ResourceMemory: resource.MustParse(mem)}
+}
+
+func buildStatsNode(name, cpuCap, memCap, cpuAlloc, memAlloc string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Capacity:    resourceList(cpuCap, memCap),
+			Allocatable: resourceList(cpuAlloc, memAlloc),
+		},
+	}
+}
+
+func buildStatsPod(name, nodeName string, requests, limits v1.ResourceList) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: v1.PodSpec{
+			NodeName: nodeName,
+			Containers: []v1.Container{{
+				Name:      "app",
+				Resources: v1.ResourceRequirements{Requests: requests, Limits: limits},
+			}},
+		},
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+}
+
+// TestMetricsServerSource_pushStats reads the metrics of a two-node, three-pod cluster, and checks the stats
+// sent to firmament for the nodes and the pods it knows.
+func TestMetricsServerSource_pushStats(t *testing.T) {
+	k8sclient.NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node0": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node0-uuid"}},
+		"node1": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node1-uuid"}},
+	}
+	k8sclient.PodMux = new(sync.RWMutex)
+	k8sclient.PodToTD = map[k8sclient.PodIdentifier]*firmament.TaskDescriptor{
+		{Name: "pod0", Namespace: "default"}: {Uid: 10},
+		{Name: "pod1", Namespace: "default"}: {Uid: 11},
+		{Name: "pod2", Namespace: "default"}: {Uid: 12},
+	}
+	clientset := fake.NewSimpleClientset(
+		buildStatsNode("node0", "4", "8Gi", "3800m", "7Gi"),
+		buildStatsNode("node1", "2", "4Gi", "2", "4Gi"),
+		buildStatsPod("pod0", "node0", resourceList("1", "1Gi"), resourceList("2", "2Gi")),
+		buildStatsPod("pod1", "node0", resourceList("500m", "512Mi"), nil),
+		buildStatsPod("pod2", "node1", resourceList("1", "1Gi"), resourceList("1", "1Gi")),
+	)
+	timestamp := metav1.NewTime(time.Unix(1500000000, 0))
+	fc := firmamenttest.NewFakeClient()
+	source := &metricsServerSource{
+		clientset: clientset,
+		metrics: &fakeMetricsClient{
+			nodes: []NodeMetrics{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node0"}, Timestamp: timestamp, Usage: resourceList("1900m", "3584Mi")},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node1"}, Timestamp: timestamp, Usage: resourceList("500m", "1Gi")},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node2"}, Timestamp: timestamp, Usage: resourceList("1", "1Gi")},
+			},
+			pods: []PodMetrics{
+				{ObjectMeta: metav1.ObjectMeta{Name: "pod0", Namespace: "default"}, Timestamp: timestamp, Containers: []ContainerMetrics{
+					{Name: "app", Usage: resourceList("300m", "256Mi")},
+					{Name: "sidecar", Usage: resourceList("200m", "256Mi")},
+				}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"}, Timestamp: timestamp, Containers: []ContainerMetrics{
+					{Name: "app", Usage: resourceList("100m", "128Mi")},
+				}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Namespace: "default"}, Timestamp: timestamp, Containers: []ContainerMetrics{
+					{Name: "app", Usage: resourceList("1", "900Mi")},
+				}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "pod3", Namespace: "default"}, Timestamp: timestamp, Containers: []ContainerMetrics{
+					{Name: "app", Usage: resourceList("1", "1Gi")},
+				}},
+			},
+		},
+		fc: fc,
+	}
+
+	source.pushStats()
+
+	micros := uint64(1500000000 * 1000000)
+	expectedNodeStats := []interface{}{
+		&firmament.ResourceStats{
+			ResourceId: "node0-uuid",
+			Timestamp:  micros,
+			CpusStats: []*firmament.CpuStats{{
+				CpuAllocatable: 3800,
+				CpuCapacity:    4000,
+				CpuReservation: 1500.0 / 3800,
+				CpuUtilization: 0.5,
+			}},
+			MemAllocatable: 7 * 1024 * 1024,
+			MemCapacity:    8 * 1024 * 1024,
+			MemReservation: 1536.0 / (7 * 1024),
+			MemUtilization: 0.5,
+		},
+		&firmament.ResourceStats{
+			ResourceId: "node1-uuid",
+			Timestamp:  micros,
+			CpusStats: []*firmament.CpuStats{{
+				CpuAllocatable: 2000,
+				CpuCapacity:    2000,
+				CpuReservation: 0.5,
+				CpuUtilization: 0.25,
+			}},
+			MemAllocatable: 4 * 1024 * 1024,
+			MemCapacity:    4 * 1024 * 1024,
+			MemReservation: 0.25,
+			MemUtilization: 0.25,
+		},
+	}
+	if nodeStats := fc.Requests("AddNodeStats"); !reflect.DeepEqual(nodeStats, expectedNodeStats) {
+		t.Errorf("expected the node stats %v, got %v", expectedNodeStats, nodeStats)
+	}
+
+	expectedTaskStats := []interface{}{
+		&firmament.TaskStats{TaskId: 10, Hostname: "node0", Timestamp: micros,
+			CpuLimit: 2000, CpuRequest: 1000, CpuUsage: 500,
+			MemLimit: 2 * 1024 * 1024, MemRequest: 1024 * 1024, MemUsage: 512 * 1024, MemWorkingSet: 512 * 1024},
+		&firmament.TaskStats{TaskId: 11, Hostname: "node0", Timestamp: micros,
+			CpuRequest: 500, CpuUsage: 100,
+			MemRequest: 512 * 1024, MemUsage: 128 * 1024, MemWorkingSet: 128 * 1024},
+		&firmament.TaskStats{TaskId: 12, Hostname: "node1", Timestamp: micros,
+			CpuLimit: 1000, CpuRequest: 1000, CpuUsage: 1000,
+			MemLimit: 1024 * 1024, MemRequest: 1024 * 1024, MemUsage: 900 * 1024, MemWorkingSet: 900 * 1024},
+	}
+	if taskStats := fc.Requests("AddTaskStats"); !reflect.DeepEqual(taskStats, expectedTaskStats) {
+		t.Errorf("expected the task stats %v, got %v", expectedTaskStats, taskStats)
+	}
+}
+
+// TestMetricsServerSource_pushTaskStats reads the metrics of pods scheduled by Poseidon and by another scheduler,
+// and checks that only the stats of the running Poseidon pods on nodes known by firmament are sent.
+func TestMetricsServerSource_pushTaskStats(t *testing.T) {
+	k8sclient.NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node0": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node0-uuid"}},
+	}
+	k8sclient.PodMux = new(sync.RWMutex)
+	k8sclient.PodToTD = map[k8sclient.PodIdentifier]*firmament.TaskDescriptor{
+		{Name: "poseidon0", Namespace: "default"}:    {Uid: 10},
+		{Name: "poseidon1", Namespace: "default"}:    {Uid: 11},
+		{Name: "completed", Namespace: "default"}:    {Uid: 12},
+		{Name: "deleted", Namespace: "default"}:      {Uid: 13},
+		{Name: "unknown-node", Namespace: "default"}: {Uid: 14},
+	}
+	completed := buildStatsPod("completed", "node0", resourceList("1", "1Gi"), nil)
+	completed.Status.Phase = v1.PodSucceeded
+	clientset := fake.NewSimpleClientset(
+		buildStatsNode("node0", "4", "8Gi", "4", "8Gi"),
+		buildStatsPod("poseidon0", "node0", resourceList("1", "1Gi"), nil),
+		buildStatsPod("poseidon1", "node0", resourceList("1", "1Gi"), nil),
+		buildStatsPod("default0", "node0", resourceList("1", "1Gi"), nil),
+		buildStatsPod("unknown-node", "node1", resourceList("1", "1Gi"), nil),
+		completed,
+	)
+	timestamp := metav1.NewTime(time.Unix(1500000000, 0))
+	var podMetrics []PodMetrics
+	for _, name := range []string{"poseidon0", "default0", "completed", "deleted", "unknown-node", "poseidon1"} {
+		podMetrics = append(podMetrics, PodMetrics{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Timestamp:  timestamp,
+			Containers: []ContainerMetrics{{Name: "app", Usage: resourceList("100m", "128Mi")}},
+		})
+	}
+	fc := firmamenttest.NewFakeClient()
+	source := &metricsServerSource{
+		clientset: clientset,
+		metrics:   &fakeMetricsClient{pods: podMetrics},
+		fc:        fc,
+	}
+
+	source.pushStats()
+
+	var taskIDs []uint64
+	for _, request := range fc.Requests("AddTaskStats") {
+		taskIDs = append(taskIDs, request.(*firmament.TaskStats).TaskId)
+	}
+	if expected := []uint64{10, 11}; !reflect.DeepEqual(taskIDs, expected) {
+		t.Errorf("expected the stats of the tasks %v, got %v", expected, taskIDs)
+	}
+}
+
+// TestMetricsServerSource_advertiseUsage checks that the usage of the nodes is subtracted from the resources
+// available on their machines, without dropping below zero, and that the machines fall back to their allocatable
+// resources while metrics-server is unavailable.
+func TestMetricsServerSource_advertiseUsage(t *testing.T) {
+	const gi = 1024 * 1024 * 1024 * 1000 // The milli values of the KB memory unit.
+	available := func(cpu float32, ramCap uint64) *firmament.ResourceVector {
+		return &firmament.ResourceVector{CpuCores: cpu, RamCap: ramCap}
+	}
+	k8sclient.NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node0": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node0-uuid", AvailableResources: available(3800, 7*gi)}},
+		"node1": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node1-uuid", AvailableResources: available(2000, 4*gi)}},
+	}
+	k8sclient.PodMux = new(sync.RWMutex)
+	k8sclient.PodToTD = map[k8sclient.PodIdentifier]*firmament.TaskDescriptor{}
+	timestamp := metav1.NewTime(time.Unix(1500000000, 0))
+	metrics := &fakeMetricsClient{
+		nodes: []NodeMetrics{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node0"}, Timestamp: timestamp, Usage: resourceList("1900m", "3584Mi")},
+			// The usage above the allocatable resources leaves no cpu available.
+			{ObjectMeta: metav1.ObjectMeta{Name: "node1"}, Timestamp: timestamp, Usage: resourceList("3", "1Gi")},
+		},
+	}
+	fc := firmamenttest.NewFakeClient()
+	source := &metricsServerSource{
+		clientset: fake.NewSimpleClientset(
+			buildStatsNode("node0", "4", "8Gi", "3800m", "7Gi"),
+			buildStatsNode("node1", "2", "4Gi", "2", "4Gi"),
+		),
+		metrics:        metrics,
+		fc:             fc,
+		advertiseUsage: true,
+	}
+	checkAvailable := func(step string, updates int, node0, node1 *firmament.ResourceVector) {
+		if got := len(fc.Requests("NodeUpdated")); got != updates {
+			t.Errorf("%s: expected %d machines sent to firmament, got %d", step, updates, got)
+		}
+		for name, expected := range map[string]*firmament.ResourceVector{"node0": node0, "node1": node1} {
+			if got := k8sclient.NodeToRTND[name].GetResourceDesc().GetAvailableResources(); !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: expected %v available on %s, got %v", step, expected, name, got)
+			}
+		}
+	}
+
+	source.pushStats()
+	checkAvailable("usage", 2, available(1900, 7*gi-3.5*gi), available(0, 3*gi))
+	// The usage of the previous cycle is added back before the new usage is subtracted.
+	metrics.nodes[0].Usage = resourceList("800m", "1Gi")
+	source.pushStats()
+	checkAvailable("new usage", 3, available(3000, 6*gi), available(0, 3*gi))
+	metrics.nodesErr = fmt.Errorf("metrics-server unavailable")
+	source.pushStats()
+	checkAvailable("metrics-server unavailable", 5, available(3800, 7*gi), available(2000, 4*gi))
+	source.pushStats()
+	checkAvailable("still unavailable", 5, available(3800, 7*gi), available(2000, 4*gi))
+}
+
+// TestMetricsServerSource_puStats checks that the stats of a node with four PUs, used at 50%, are broken down to
+// four stats summing to the stats of the node once the nodes advertise their NUMA zones, and that a single stats
+// is sent otherwise.
+func TestMetricsServerSource_puStats(t *testing.T) {
+	machine := &firmament.ResourceTopologyNodeDescriptor{
+		ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node0-uuid", Type: firmament.ResourceDescriptor_RESOURCE_MACHINE},
+	}
+	for i := 0; i < 4; i++ {
+		zone := &firmament.ResourceTopologyNodeDescriptor{
+			ResourceDesc: &firmament.ResourceDescriptor{
+				Uuid: fmt.Sprintf("numa%d-uuid", i),
+				Type: firmament.ResourceDescriptor_RESOURCE_NUMA_NODE,
+			},
+			ParentId: "node0-uuid",
+		}
+		zone.Children = []*firmament.ResourceTopologyNodeDescriptor{{
+			ResourceDesc: &firmament.ResourceDescriptor{
+				Uuid:             fmt.Sprintf("pu%d-uuid", i),
+				Type:             firmament.ResourceDescriptor_RESOURCE_PU,
+				ResourceCapacity: &firmament.ResourceVector{CpuCores: 1000, RamCap: 2 * 1024 * 1024},
+			},
+			ParentId: zone.ResourceDesc.Uuid,
+		}}
+		machine.Children = append(machine.Children, zone)
+	}
+	k8sclient.NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{"node0": machine}
+	timestamp := metav1.NewTime(time.Unix(1500000000, 0))
+	newSource := func(fc firmament.Client) *metricsServerSource {
+		return &metricsServerSource{
+			clientset: fake.NewSimpleClientset(buildStatsNode("node0", "4", "8Gi", "4", "8Gi")),
+			metrics: &fakeMetricsClient{nodes: []NodeMetrics{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node0"}, Timestamp: timestamp, Usage: resourceList("2", "4Gi")},
+			}},
+			fc: fc,
+		}
+	}
+	defer func() { nodeResourceTopology = config.GetNodeResourceTopology }()
+
+	nodeResourceTopology = func() bool { return false }
+	fc := firmamenttest.NewFakeClient()
+	newSource(fc).pushStats()
+	if nodeStats := fc.Requests("AddNodeStats"); len(nodeStats) != 1 || nodeStats[0].(*firmament.ResourceStats).ResourceId != "node0-uuid" {
+		t.Errorf("expected the stats of node0-uuid without the node topology, got %v", nodeStats)
+	}
+
+	nodeResourceTopology = func() bool { return true }
+	fc = firmamenttest.NewFakeClient()
+	newSource(fc).pushStats()
+	nodeStats := fc.Requests("AddNodeStats")
+	if len(nodeStats) != 4 {
+		t.Fatalf("expected the stats of %d PUs, got %v", 4, nodeStats)
+	}
+	var cpuAllocatable, cpuUsage, memAllocatable, memUsage float64
+	for i, request := range nodeStats {
+		resourceStats := request.(*firmament.ResourceStats)
+		if resourceID := fmt.Sprintf("pu%d-uuid", i); resourceStats.ResourceId != resourceID {
+			t.Errorf("expected the stats of %s, got %s", resourceID, resourceStats.ResourceId)
+		}
+		cpuStats := resourceStats.CpusStats[0]
+		if cpuStats.CpuUtilization != 0.5 || resourceStats.MemUtilization != 0.5 {
+			t.Errorf("expected the utilization of PU %d to be %v, got cpu %v and memory %v", i, 0.5,
+				cpuStats.CpuUtilization, resourceStats.MemUtilization)
+		}
+		cpuAllocatable += float64(cpuStats.CpuAllocatable)
+		cpuUsage += cpuStats.CpuUtilization * float64(cpuStats.CpuAllocatable)
+		memAllocatable += float64(resourceStats.MemAllocatable)
+		memUsage += resourceStats.MemUtilization * float64(resourceStats.MemAllocatable)
+	}
+	if cpuAllocatable != 4000 || cpuUsage != 2000 {
+		t.Errorf("expected the PUs to sum to %v millicores allocatable and %v used, got %v and %v", 4000, 2000,
+			cpuAllocatable, cpuUsage)
+	}
+	if memAllocatable != 8*1024*1024 || memUsage != 4*1024*1024 {
+		t.Errorf("expected the PUs to sum to %v KB allocatable and %v used, got %v and %v", 8*1024*1024, 4*1024*1024,
+			memAllocatable, memUsage)
+	}
+}
+
+// TestRunStats checks that the stats cycles are run every interval, and that they stop once stopCh is closed.
+func TestRunStats(t *testing.T) {
+	cycles := make(chan struct{}, 10)
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runStats(func() { cycles <- struct{}{} }, 10*time.Millisecond, stopCh)
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-cycles:
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d stats cycles, got %d", 3, i)
+		}
+	}
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the stats cycles to stop once stopCh is closed")
+	}
+}
@@ -0,0 +1,355 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/k8sclient"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// SourcePrometheus reads the stats from the node-exporter and cAdvisor series already scraped by Prometheus.
+const SourcePrometheus = "prometheus"
+
+// PrometheusQueryPath is the path of the instant queries of the Prometheus HTTP API.
+const PrometheusQueryPath = "/api/v1/query"
+
+// minPrometheusWindow is the shortest rate window of the queries, so that the rates span several scrapes.
+const minPrometheusWindow = time.Minute
+
+// PrometheusQueries holds the PromQL templates of the prometheus stats source. The {{.Window}} of a template is
+// replaced by the rate window, the stats interval but at least a minute. The node queries return a series by
+// node, whose name is held by the node label of the source, and the pod queries a series by pod, labelled with
+// its namespace and pod name. The network queries are disabled when empty.
+type PrometheusQueries struct {
+	// NodeCPU is the cpu usage of the nodes, in cores.
+	NodeCPU string
+	// NodeMemory is the memory usage of the nodes, in bytes.
+	NodeMemory string
+	// NodeNetworkRx and NodeNetworkTx are the bytes received and sent per second by the nodes.
+	NodeNetworkRx string
+	NodeNetworkTx string
+	// PodCPU is the cpu usage of the pods, in cores.
+	PodCPU string
+	// PodMemory is the memory working set of the pods, in bytes.
+	PodMemory string
+	// PodNetworkRx and PodNetworkTx are the bytes received and sent per second by the pods.
+	PodNetworkRx string
+	PodNetworkTx string
+}
+
+// prometheusResponse is the subset of the response of the Prometheus HTTP API to an instant query.
+type prometheusResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			// Value is the timestamp in seconds and the value formatted as a string of the sample.
+			Value []interface{} `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// prometheusSample is a sample of a series returned by an instant query.
+type prometheusSample struct {
+	metric    map[string]string
+	value     float64
+	timestamp time.Time
+}
+
+// parsePrometheusVector parses the samples of the instant vector returned by a query. The samples whose value is
+// not a number are dropped, as missing series.
+func parsePrometheusVector(data []byte) ([]prometheusSample, error) {
+	response := &prometheusResponse{}
+	if err := json.Unmarshal(data, response); err != nil {
+		return nil, fmt.Errorf("unable to parse the Prometheus response: %v", err)
+	}
+	if response.Status != "success" {
+		return nil, fmt.Errorf("Prometheus query failed with %s: %s", response.ErrorType, response.Error)
+	}
+	if response.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("unexpected Prometheus result type %s, the queries must return an instant vector", response.Data.ResultType)
+	}
+	var samples []prometheusSample
+	for _, result := range response.Data.Result {
+		if len(result.Value) != 2 {
+			return nil, fmt.Errorf("unparsable Prometheus sample %v", result.Value)
+		}
+		seconds, ok := result.Value[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("unparsable Prometheus sample timestamp %v", result.Value[0])
+		}
+		formatted, ok := result.Value[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("unparsable Prometheus sample value %v", result.Value[1])
+		}
+		value, err := strconv.ParseFloat(formatted, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unparsable Prometheus sample value %s: %v", formatted, err)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		integer, fractional := math.Modf(seconds)
+		samples = append(samples, prometheusSample{
+			metric:    result.Metric,
+			value:     value,
+			timestamp: time.Unix(int64(integer), int64(fractional*1e9)),
+		})
+	}
+	return samples, nil
+}
+
+// prometheusSource pushes the usage read from Prometheus to firmament, completed with the state of the cluster,
+// see clusterState.
+type prometheusSource struct {
+	clientset kubernetes.Interface
+	client    *http.Client
+	address   string
+	// nodeQueries and podQueries are the rendered node and pod queries, in the order of PrometheusQueries.
+	nodeQueries []string
+	podQueries  []string
+	nodeLabel   string
+	fc          firmament.Client
+	now         func() time.Time
+}
+
+// StartPrometheusSource sends the stats of the nodes and the pods known by firmament every interval, until stopCh
+// is closed. The usage is read with the queries from the Prometheus server at the address, the nodes and the pods
+// of the series missing from a query are skipped until the next cycle.
+func StartPrometheusSource(kubeConfig, address string, queries PrometheusQueries, nodeLabel string, fc firmament.Client, interval time.Duration, stopCh <-chan struct{}) {
+	glog.Info("Starting Prometheus stats source...")
+	source, err := newPrometheusSource(newClientset(kubeConfig), address, queries, nodeLabel, fc, interval)
+	if err != nil {
+		glog.Fatalf("Invalid Prometheus queries: %v", err)
+	}
+	runStats(source.pushStats, interval, stopCh)
+}
+
+func newPrometheusSource(clientset kubernetes.Interface, address string, queries PrometheusQueries, nodeLabel string, fc firmament.Client, interval time.Duration) (*prometheusSource, error) {
+	window := interval
+	if window < minPrometheusWindow {
+		window = minPrometheusWindow
+	}
+	var rendered []string
+	for _, query := range []string{
+		queries.NodeCPU, queries.NodeMemory, queries.NodeNetworkRx, queries.NodeNetworkTx,
+		queries.PodCPU, queries.PodMemory, queries.PodNetworkRx, queries.PodNetworkTx,
+	} {
+		query, err := renderPrometheusQuery(query, window)
+		if err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, query)
+	}
+	if rendered[0] == "" || rendered[1] == "" || rendered[4] == "" || rendered[5] == "" {
+		return nil, fmt.Errorf("the cpu and memory queries of the nodes and the pods must not be empty")
+	}
+	return &prometheusSource{
+		clientset:   clientset,
+		client:      &http.Client{Timeout: interval},
+		address:     strings.TrimSuffix(address, "/"),
+		nodeQueries: rendered[:4],
+		podQueries:  rendered[4:],
+		nodeLabel:   nodeLabel,
+		fc:          fc,
+		now:         time.Now,
+	}, nil
+}
+
+// renderPrometheusQuery replaces the {{.Window}} of the template with the rate window, as a PromQL duration.
+func renderPrometheusQuery(query string, window time.Duration) (string, error) {
+	tmpl, err := template.New("query").Parse(query)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse query %q: %v", query, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct{ Window string }{Window: fmt.Sprintf("%ds", int64(window/time.Second))}); err != nil {
+		return "", fmt.Errorf("unable to render query %q: %v", query, err)
+	}
+	return buf.String(), nil
+}
+
+// query runs the instant query at the time of the cycle.
+func (s *prometheusSource) query(query string, now time.Time) ([]prometheusSample, error) {
+	values := url.Values{}
+	values.Set("query", query)
+	values.Set("time", strconv.FormatFloat(float64(now.UnixNano())/1e9, 'f', 3, 64))
+	response, err := s.client.Get(s.address + PrometheusQueryPath + "?" + values.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	// The failed queries are answered with an error status, described in the body.
+	samples, err := parsePrometheusVector(data)
+	if err != nil && response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Prometheus replied %s: %v", response.Status, err)
+	}
+	return samples, err
+}
+
+// querySeries runs the queries and returns their samples keyed by the node name or the pod identifier of their
+// series, nil for the disabled queries. The samples of a node or a pod are summed.
+func (s *prometheusSource) querySeries(queries []string, now time.Time, key func(metric map[string]string) (string, bool)) ([]map[string]prometheusSample, error) {
+	series := make([]map[string]prometheusSample, len(queries))
+	for i, query := range queries {
+		if query == "" {
+			continue
+		}
+		samples, err := s.query(query, now)
+		if err != nil {
+			return nil, fmt.Errorf("query %q: %v", query, err)
+		}
+		series[i] = make(map[string]prometheusSample)
+		for _, sample := range samples {
+			k, ok := key(sample.metric)
+			if !ok {
+				continue
+			}
+			if previous, ok := series[i][k]; ok {
+				sample.value += previous.value
+			}
+			series[i][k] = sample
+		}
+	}
+	return series, nil
+}
+
+// samples returns the samples of the node or the pod, one per query. It returns false if a series is missing
+// from an enabled query, so that no zero usage is pushed for it.
+func samples(series []map[string]prometheusSample, key string) ([]prometheusSample, bool) {
+	found := make([]prometheusSample, len(series))
+	for i, samples := range series {
+		if samples == nil {
+			continue
+		}
+		sample, ok := samples[key]
+		if !ok {
+			return nil, false
+		}
+		found[i] = sample
+	}
+	return found, true
+}
+
+// sortedKeys returns the keys of the samples sorted, so that the stats are pushed in the same order every cycle.
+func sortedKeys(samples map[string]prometheusSample) []string {
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *prometheusSource) pushStats() {
+	state, err := listClusterState(s.clientset)
+	if err != nil {
+		glog.Errorf("Unable to list the nodes and the pods of the stats: %v", err)
+		return
+	}
+	now := s.now()
+	s.pushNodeStats(state, now)
+	s.pushTaskStats(state, now)
+}
+
+// pushNodeStats sends the stats of the nodes known by firmament.
+func (s *prometheusSource) pushNodeStats(state *clusterState, now time.Time) {
+	series, err := s.querySeries(s.nodeQueries, now, func(metric map[string]string) (string, bool) {
+		nodeName, ok := metric[s.nodeLabel]
+		return nodeName, ok
+	})
+	if err != nil {
+		glog.Errorf("Unable to read the node stats from Prometheus: %v", err)
+		return
+	}
+	for _, nodeName := range sortedKeys(series[0]) {
+		nodeSamples, ok := samples(series, nodeName)
+		if !ok {
+			glog.V(2).Infof("Skipping the stats of node %s missing from a Prometheus query", nodeName)
+			continue
+		}
+		resourceStats, ok := state.resourceStats(nodeName, metav1.NewTime(nodeSamples[0].timestamp))
+		if !ok {
+			glog.V(2).Infof("Skipping the stats of node %s unknown by firmament", nodeName)
+			continue
+		}
+		setUtilization(resourceStats, int64(math.Round(nodeSamples[0].value*1000)), int64(nodeSamples[1].value/1024))
+		resourceStats.NetRxBw = int64(nodeSamples[2].value / 1024)
+		resourceStats.NetTxBw = int64(nodeSamples[3].value / 1024)
+		for _, resourceStats := range puStats(nodeName, resourceStats) {
+			if err := s.fc.AddNodeStats(resourceStats); err != nil {
+				glog.Errorf("Unable to send the stats of resource %s of node %s: %v", resourceStats.ResourceId, nodeName, err)
+			}
+		}
+	}
+}
+
+// pushTaskStats sends the stats of the pods known by firmament. The memory working set of the pods is reported as
+// their memory usage, as with metrics-server.
+func (s *prometheusSource) pushTaskStats(state *clusterState, now time.Time) {
+	series, err := s.querySeries(s.podQueries, now, func(metric map[string]string) (string, bool) {
+		namespace, ok := metric["namespace"]
+		name, found := metric["pod"]
+		return namespace + "/" + name, ok && found
+	})
+	if err != nil {
+		glog.Errorf("Unable to read the pod stats from Prometheus: %v", err)
+		return
+	}
+	for _, key := range sortedKeys(series[0]) {
+		podSamples, ok := samples(series, key)
+		metric := series[0][key].metric
+		podIdentifier := k8sclient.PodIdentifier{Name: metric["pod"], Namespace: metric["namespace"]}
+		if !ok {
+			glog.V(2).Infof("Skipping the stats of pod %v missing from a Prometheus query", podIdentifier)
+			continue
+		}
+		taskStats, ok := state.taskStats(podIdentifier, metav1.NewTime(podSamples[0].timestamp))
+		if !ok {
+			continue
+		}
+		taskStats.CpuUsage = int64(math.Round(podSamples[0].value * 1000))
+		taskStats.MemUsage = int64(podSamples[1].value / 1024)
+		taskStats.MemWorkingSet = taskStats.MemUsage
+		taskStats.NetRxRate = podSamples[2].value / 1024
+		taskStats.NetTxRate = podSamples[3].value / 1024
+		addTaskStats(s.fc, podIdentifier, taskStats)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament/firmamenttest"
+	"github.com/kubernetes-sigs/poseidon/pkg/k8sclient"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var testPrometheusQueries = PrometheusQueries{
+	NodeCPU:       `sum by (node) (rate(node_cpu_seconds_total{mode!="idle"}[{{.Window}}]))`,
+	NodeMemory:    `sum by (node) (node_memory_MemTotal_bytes - node_memory_MemAvailable_bytes)`,
+	NodeNetworkRx: `sum by (node) (rate(node_network_receive_bytes_total[{{.Window}}]))`,
+	PodCPU:        `sum by (namespace, pod) (rate(container_cpu_usage_seconds_total[{{.Window}}]))`,
+	PodMemory:     `sum by (namespace, pod) (container_memory_working_set_bytes)`,
+	PodNetworkRx:  `sum by (namespace, pod) (rate(container_network_receive_bytes_total[{{.Window}}]))`,
+	PodNetworkTx:  `sum by (namespace, pod) (rate(container_network_transmit_bytes_total[{{.Window}}]))`,
+}
+
+// prometheusVector formats the response of the Prometheus HTTP API to an instant query returning the series.
+func prometheusVector(series ...string) string {
+	result := ""
+	for i, s := range series {
+		if i > 0 {
+			result += ","
+		}
+		result += s
+	}
+	return `{"status":"success","data":{"resultType":"vector","result":[` + result + `]}}`
+}
+
+// cannedPrometheusResponses are the responses of the stubbed Prometheus to the test queries, rendered with a one
+// minute window. node1 is missing from the network query and pod1 from the memory query, node2 and pod3 are
+// unknown by firmament, and the cpu usage of pod2 is not a number.
+var cannedPrometheusResponses = map[string]string{
+	`sum by (node) (rate(node_cpu_seconds_total{mode!="idle"}[60s]))`: prometheusVector(
+		`{"metric":{"node":"node0"},"value":[1500000000.5,"1.9"]}`,
+		`{"metric":{"node":"node1"},"value":[1500000000.5,"0.5"]}`,
+		`{"metric":{"node":"node2"},"value":[1500000000.5,"1"]}`,
+		`{"metric":{},"value":[1500000000.5,"1"]}`),
+	`sum by (node) (node_memory_MemTotal_bytes - node_memory_MemAvailable_bytes)`: prometheusVector(
+		`{"metric":{"node":"node0"},"value":[1500000000.5,"3758096384"]}`,
+		`{"metric":{"node":"node1"},"value":[1500000000.5,"1073741824"]}`,
+		`{"metric":{"node":"node2"},"value":[1500000000.5,"1073741824"]}`),
+	`sum by (node) (rate(node_network_receive_bytes_total[60s]))`: prometheusVector(
+		`{"metric":{"node":"node0"},"value":[1500000000.5,"2048000"]}`,
+		`{"metric":{"node":"node2"},"value":[1500000000.5,"1024"]}`),
+	`sum by (namespace, pod) (rate(container_cpu_usage_seconds_total[60s]))`: prometheusVector(
+		`{"metric":{"namespace":"default","pod":"pod0"},"value":[1500000000.5,"0.5"]}`,
+		`{"metric":{"namespace":"default","pod":"pod1"},"value":[1500000000.5,"0.1"]}`,
+		`{"metric":{"namespace":"default","pod":"pod2"},"value":[1500000000.5,"NaN"]}`,
+		`{"metric":{"namespace":"default","pod":"pod3"},"value":[1500000000.5,"1"]}`),
+	`sum by (namespace, pod) (container_memory_working_set_bytes)`: prometheusVector(
+		`{"metric":{"namespace":"default","pod":"pod0"},"value":[1500000000.5,"536870912"]}`,
+		`{"metric":{"namespace":"default","pod":"pod2"},"value":[1500000000.5,"943718400"]}`,
+		`{"metric":{"namespace":"default","pod":"pod3"},"value":[1500000000.5,"1073741824"]}`),
+	`sum by (namespace, pod) (rate(container_network_receive_bytes_total[60s]))`: prometheusVector(
+		`{"metric":{"namespace":"default","pod":"pod0"},"value":[1500000000.5,"10240"]}`,
+		`{"metric":{"namespace":"default","pod":"pod1"},"value":[1500000000.5,"1024"]}`,
+		`{"metric":{"namespace":"default","pod":"pod2"},"value":[1500000000.5,"1024"]}`,
+		`{"metric":{"namespace":"default","pod":"pod3"},"value":[1500000000.5,"1024"]}`),
+	`sum by (namespace, pod) (rate(container_network_transmit_bytes_total[60s]))`: prometheusVector(
+		`{"metric":{"namespace":"default","pod":"pod0"},"value":[1500000000.5,"5120"]}`,
+		`{"metric":{"namespace":"default","pod":"pod1"},"value":[1500000000.5,"1024"]}`,
+		`{"metric":{"namespace":"default","pod":"pod2"},"value":[1500000000.5,"1024"]}`,
+		`{"metric":{"namespace":"default","pod":"pod3"},"value":[1500000000.5,"1024"]}`),
+}
+
+// newPrometheusStub returns a Prometheus HTTP API answering the canned responses to the queries, and a bad_data
+// error to the other queries.
+func newPrometheusStub(t *testing.T, responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != PrometheusQueryPath || r.URL.Query().Get("time") == "" {
+			t.Errorf("unexpected Prometheus request %s", r.URL)
+		}
+		response, ok := responses[r.URL.Query().Get("query")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"status":"error","errorType":"bad_data","error":"unexpected query %s"}`, r.URL.Query().Get("query"))
+			return
+		}
+		fmt.Fprint(w, response)
+	}))
+}
+
+// TestPrometheusSource_pushStats queries a stubbed Prometheus for a three-node, four-pod cluster, and checks the
+// stats sent to firmament for the nodes and the pods it knows whose series are all returned.
+func TestPrometheusSource_pushStats(t *testing.T) {
+	k8sclient.NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node0": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node0-uuid"}},
+		"node1": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node1-uuid"}},
+	}
+	k8sclient.PodMux = new(sync.RWMutex)
+	k8sclient.PodToTD = map[k8sclient.PodIdentifier]*firmament.TaskDescriptor{
+		{Name: "pod0", Namespace: "default"}: {Uid: 10},
+		{Name: "pod1", Namespace: "default"}: {Uid: 11},
+		{Name: "pod2", Namespace: "default"}: {Uid: 12},
+	}
+	clientset := fake.NewSimpleClientset(
+		buildStatsNode("node0", "4", "8Gi", "3800m", "7Gi"),
+		buildStatsNode("node1", "2", "4Gi", "2", "4Gi"),
+		buildStatsPod("pod0", "node0", resourceList("1", "1Gi"), resourceList("2", "2Gi")),
+		buildStatsPod("pod1", "node0", resourceList("500m", "512Mi"), nil),
+		buildStatsPod("pod2", "node1", resourceList("1", "1Gi"), resourceList("1", "1Gi")),
+	)
+	server := newPrometheusStub(t, cannedPrometheusResponses)
+	defer server.Close()
+	fc := firmamenttest.NewFakeClient()
+	source, err := newPrometheusSource(clientset, server.URL+"/", testPrometheusQueries, "node", fc, 30*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	source.pushStats()
+
+	micros := uint64(1500000000500000)
+	expectedNodeStats := []interface{}{
+		&firmament.ResourceStats{
+			ResourceId: "node0-uuid",
+			Timestamp:  micros,
+			CpusStats: []*firmament.CpuStats{{
+				CpuAllocatable: 3800,
+				CpuCapacity:    4000,
+				CpuReservation: 1500.0 / 3800,
+				CpuUtilization: 0.5,
+			}},
+			MemAllocatable: 7 * 1024 * 1024,
+			MemCapacity:    8 * 1024 * 1024,
+			MemReservation: 1536.0 / (7 * 1024),
+			MemUtilization: 0.5,
+			NetRxBw:        2000,
+		},
+	}
+	fc.ExpectRequests(t, "AddNodeStats", expectedNodeStats...)
+
+	expectedTaskStats := []interface{}{
+		&firmament.TaskStats{TaskId: 10, Hostname: "node0", Timestamp: micros,
+			CpuLimit: 2000, CpuRequest: 1000, CpuUsage: 500,
+			MemLimit: 2 * 1024 * 1024, MemRequest: 1024 * 1024, MemUsage: 512 * 1024, MemWorkingSet: 512 * 1024,
+			NetRxRate: 10, NetTxRate: 5},
+	}
+	fc.ExpectRequests(t, "AddTaskStats", expectedTaskStats...)
+}
+
+// TestPrometheusSource_queryErrors checks that the stats are not sent when a query fails, and that the templates
+// are validated.
+func TestPrometheusSource_queryErrors(t *testing.T) {
+	k8sclient.NodeToRTND = map[string]*firmament.ResourceTopologyNodeDescriptor{
+		"node0": {ResourceDesc: &firmament.ResourceDescriptor{Uuid: "node0-uuid"}},
+	}
+	server := newPrometheusStub(t, nil)
+	defer server.Close()
+	fc := firmamenttest.NewFakeClient()
+	clientset := fake.NewSimpleClientset(buildStatsNode("node0", "4", "8Gi", "4", "8Gi"))
+	source, err := newPrometheusSource(clientset, server.URL, testPrometheusQueries, "node", fc, 30*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := source.query(testPrometheusQueries.NodeMemory, time.Now()); err == nil {
+		t.Error("expected the error of the failed query")
+	}
+	source.pushStats()
+	fc.ExpectMethods(t)
+
+	invalid := testPrometheusQueries
+	invalid.NodeCPU = "rate(node_cpu_seconds_total[{{.Window]))"
+	if _, err := newPrometheusSource(clientset, server.URL, invalid, "node", fc, 30*time.Second); err == nil {
+		t.Error("expected the error of the unparsable template")
+	}
+	invalid = testPrometheusQueries
+	invalid.PodMemory = ""
+	if _, err := newPrometheusSource(clientset, server.URL, invalid, "node", fc, 30*time.Second); err == nil {
+		t.Error("expected the error of the empty pod memory query")
+	}
+}
+
+func TestParsePrometheusVector(t *testing.T) {
+	samples, err := parsePrometheusVector([]byte(prometheusVector(`{"metric":{"node":"node0"},"value":[1500000000.25,"0.5"]}`)))
+	expected := []prometheusSample{{metric: map[string]string{"node": "node0"}, value: 0.5, timestamp: time.Unix(1500000000, 250000000)}}
+	if err != nil || !reflect.DeepEqual(samples, expected) {
+		t.Errorf("expected the samples %v, got %v %v", expected, samples, err)
+	}
+	for _, data := range []string{
+		`{"status":"error","errorType":"bad_data","error":"parse error"}`,
+		`{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+		prometheusVector(`{"metric":{},"value":[1500000000,0.5]}`),
+		prometheusVector(`{"metric":{},"value":[1500000000]}`),
+		`not json`,
+	} {
+		if samples, err := parsePrometheusVector([]byte(data)); err == nil {
+			t.Errorf("expected an error parsing %s, got %v", data, samples)
+		}
+	}
+}
@@ -27,7 +27,7 @@ import (
 )
 
 type poseidonStatsServer struct {
-	firmamentClient firmament.FirmamentSchedulerClient
+	firmamentClient firmament.Client
 }
 
 func convertPodStatsToTaskStats(podStats *PodStats) *firmament.TaskStats {
@@ -101,7 +101,7 @@ func (s *poseidonStatsServer) ReceiveNodeStats(stream PoseidonStats_ReceiveNodeS
 			continue
 		}
 		resourceStats.ResourceId = rtnd.GetResourceDesc().GetUuid()
-		firmament.AddNodeStats(s.firmamentClient, resourceStats)
+		s.firmamentClient.AddNodeStats(resourceStats)
 		sendErr := stream.Send(&NodeStatsResponse{
 			Type:     NodeStatsResponseType_NODE_STATS_OK,
 			Hostname: nodeStats.GetHostname(),
@@ -145,7 +145,7 @@ func (s *poseidonStatsServer) ReceivePodStats(stream PoseidonStats_ReceivePodSta
 			continue
 		}
 		taskStats.TaskId = td.GetUid()
-		firmament.AddTaskStats(s.firmamentClient, taskStats)
+		s.firmamentClient.AddTaskStats(taskStats)
 		sendErr := stream.Send(&PodStatsResponse{
 			Type:      PodStatsResponseType_POD_STATS_OK,
 			Name:      podStats.GetName(),
@@ -158,21 +158,19 @@ func (s *poseidonStatsServer) ReceivePodStats(stream PoseidonStats_ReceivePodSta
 	}
 }
 
-// StartgRPCStatsServer starts a gRPC server to serve poseidon status.
+// StartgRPCStatsServer starts a gRPC server to serve poseidon status, until stopCh is closed.
 // Currently, it receives node and pod status.
-func StartgRPCStatsServer(statsServerAddress, firmamentAddress string) {
+func StartgRPCStatsServer(statsServerAddress string, fc firmament.FirmamentSchedulerClient, stopCh <-chan struct{}) {
 	glog.Info("Starting stats server...")
 	listen, err := net.Listen("tcp", statsServerAddress)
 	if err != nil {
 		glog.Fatalf("failed to listen: %v", err)
 	}
 	grpcServer := grpc.NewServer()
-	fc, conn, err := firmament.New(firmamentAddress)
-	if err != nil {
-		glog.Fatalln("Unable to initialize Firmament client", err)
-
-	}
-	defer conn.Close()
-	RegisterPoseidonStatsServer(grpcServer, &poseidonStatsServer{firmamentClient: fc})
+	RegisterPoseidonStatsServer(grpcServer, &poseidonStatsServer{firmamentClient: firmament.NewClient(fc)})
+	go func() {
+		<-stopCh
+		grpcServer.GracefulStop()
+	}()
 	grpcServer.Serve(listen)
 }
@@ -0,0 +1,51 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package units converts the Kubernetes resource quantities to the units of the values sent to firmament. The unit
+// of the memory capacities and requests is chosen with --memoryUnit, see k8sclient.MemoryUnit.
+package units
+
+const (
+	// BytesPerKB is the number of bytes of a kilobyte, as used for the hugepages and the stats, 2^10 bytes.
+	BytesPerKB = 1024
+	// BytesPerMB is the number of bytes of a megabyte, 10^6 bytes.
+	BytesPerMB = 1000 * 1000
+	// BytesPerMiB is the number of bytes of a mebibyte, 2^20 bytes.
+	BytesPerMiB = 1024 * 1024
+	// MilliPerCore is the number of millicores of a core.
+	MilliPerCore = 1000
+)
+
+// BytesToKB returns the bytes in kilobytes, rounded toward zero.
+func BytesToKB(bytes int64) int64 {
+	return bytes / BytesPerKB
+}
+
+// BytesToMB returns the bytes in megabytes, rounded toward zero.
+func BytesToMB(bytes int64) int64 {
+	return bytes / BytesPerMB
+}
+
+// BytesToMiB returns the bytes in mebibytes, rounded toward zero.
+func BytesToMiB(bytes int64) int64 {
+	return bytes / BytesPerMiB
+}
+
+// MilliToCores returns the millicores in cores, e.g. 1500 is 1.5. The firmament resource vectors hold the
+// millicores in their CpuCores field, the cores are for the values read by operators.
+func MilliToCores(milli int64) float32 {
+	return float32(float64(milli) / MilliPerCore)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package units
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBytesConversions(t *testing.T) {
+	for _, test := range []struct {
+		bytes int64
+		kb    int64
+		mb    int64
+		mib   int64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 0},
+		{1023, 0, 0, 0},
+		{1024, 1, 0, 0},
+		{1025, 1, 0, 0},
+		{999999, 976, 0, 0},
+		{1000000, 976, 1, 0},
+		{1048575, 1023, 1, 0},
+		{1048576, 1024, 1, 1},
+		{3 * 1024 * 1024 * 1024, 3 * 1024 * 1024, 3221, 3 * 1024},
+		// The negative values are rounded toward zero.
+		{-1, 0, 0, 0},
+		{-1025, -1, 0, 0},
+		{math.MaxInt64, math.MaxInt64 / 1024, math.MaxInt64 / 1000000, math.MaxInt64 / 1048576},
+	} {
+		if kb := BytesToKB(test.bytes); kb != test.kb {
+			t.Errorf("BytesToKB(%d) = %d, want %d", test.bytes, kb, test.kb)
+		}
+		if mb := BytesToMB(test.bytes); mb != test.mb {
+			t.Errorf("BytesToMB(%d) = %d, want %d", test.bytes, mb, test.mb)
+		}
+		if mib := BytesToMiB(test.bytes); mib != test.mib {
+			t.Errorf("BytesToMiB(%d) = %d, want %d", test.bytes, mib, test.mib)
+		}
+	}
+}
+
+func TestMilliToCores(t *testing.T) {
+	for _, test := range []struct {
+		milli int64
+		cores float32
+	}{
+		{0, 0},
+		{1, 0.001},
+		{100, 0.1},
+		{999, 0.999},
+		{1000, 1},
+		{1500, 1.5},
+		{64000, 64},
+		{-500, -0.5},
+		// The cores are rounded to the nearest float32, which holds 24 bits of mantissa.
+		{16777217000, 16777216},
+		{math.MaxInt64, 9.223372e15},
+	} {
+		if cores := MilliToCores(test.milli); cores != test.cores {
+			t.Errorf("MilliToCores(%d) = %v, want %v", test.milli, cores, test.cores)
+		}
+	}
+}
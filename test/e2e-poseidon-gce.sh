@@ -58,5 +58,6 @@ cd test/e2e
 
 
 #Run e2e test
-go test -v . -timeout=60m -ginkgo.v -args -testNamespace=${TEST_NAMESPACE} -poseidonVersion=${BUILD_VERSION} -gcrProject=$project
+go test -v . -timeout=60m -ginkgo.v -args -testNamespace=${TEST_NAMESPACE} -poseidonVersion=${BUILD_VERSION} -gcrProject=$project \
+  -firmamentCostModel="${FIRMAMENT_COST_MODEL}" -firmamentSolver="${FIRMAMENT_SOLVER}"
 
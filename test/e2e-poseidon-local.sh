@@ -47,5 +47,6 @@ cd test/e2e
 
 
 #Run e2e test
-go test -v . -timeout=60m -ginkgo.v -args -poseidonVersion=${BUILD_VERSION} -gcrProject="google_containers"
+go test -v . -timeout=60m -ginkgo.v -args -poseidonVersion=${BUILD_VERSION} -gcrProject="google_containers" \
+  -firmamentCostModel="${FIRMAMENT_COST_MODEL}" -firmamentSolver="${FIRMAMENT_SOLVER}"
 
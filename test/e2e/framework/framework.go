@@ -26,6 +26,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/kubernetes-sigs/poseidon/pkg/clientconfig"
+	"github.com/kubernetes-sigs/poseidon/pkg/firmament"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"k8s.io/api/core/v1"
@@ -34,7 +36,6 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	clientset "k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -44,6 +45,8 @@ var poseidonVersion = flag.String("poseidonVersion", "version", "The poseidon im
 var gcrProject = flag.String("gcrProject", "google_containers", "The gcloud project")
 var testNamespace = flag.String("testNamespace", "poseidon-test", "The namespace to use for test")
 var clusterRole = flag.String("clusterRole", os.Getenv("CLUSTERROLE"), "The cluster role")
+var firmamentCostModel = flag.String("firmamentCostModel", "", "The cost model firmament schedules the test pods with, the one of the firmament config file when empty")
+var firmamentSolver = flag.String("firmamentSolver", "", "The min-cost flow solver of firmament, the one of the firmament config file when empty")
 
 const (
 	poseidonDeploymentName  = "poseidon"
@@ -97,12 +100,12 @@ func NewFramework(baseName string, options FrameworkOptions) *Framework {
 func (f *Framework) BeforeEach() {
 	var err error
 	if f.ClientSet == nil {
-		var config *rest.Config
-		var err error
-		config, err = clientcmd.BuildConfigFromFlags("", *kubeConfig)
+		config, err := clientconfig.Load(*kubeConfig)
 		if err != nil {
 			panic(err)
 		}
+		config.QPS = f.Options.ClientQPS
+		config.Burst = f.Options.ClientBurst
 		cs, err := clientset.NewForConfig(config)
 		if err != nil {
 			panic(err)
@@ -312,7 +315,19 @@ func (f *Framework) createFirmamentService() error {
 	return err
 }
 
+// schedulingPolicy returns the cost model and the solver of the test flags.
+func schedulingPolicy() firmament.SchedulingPolicy {
+	return firmament.SchedulingPolicy{CostModel: *firmamentCostModel, Solver: *firmamentSolver}
+}
+
 func (f *Framework) createFirmamentDeployment() (*v1beta1.Deployment, error) {
+	policy := schedulingPolicy()
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	Logf("Firmament scheduling policy %+v", policy)
+	// The flags following the flag file override it.
+	command := append([]string{"/firmament/build/src/firmament_scheduler", "--flagfile=/firmament/config/firmament_scheduler_cpu_mem.cfg"}, policy.Flags()...)
 	var replicas, revisionHistoryLimit int32
 	replicas = 1
 	revisionHistoryLimit = 10
@@ -333,7 +348,7 @@ func (f *Framework) createFirmamentDeployment() (*v1beta1.Deployment, error) {
 						{
 							Name:    "firmament-scheduler",
 							Image:   "huaweifirmament/firmament:with_ephemeral_avoidpods_maxpods",
-							Command: []string{"/firmament/build/src/firmament_scheduler", "--flagfile=/firmament/config/firmament_scheduler_cpu_mem.cfg"},
+							Command: command,
 							Ports:   []v1.ContainerPort{{ContainerPort: 9090}},
 						},
 					},
@@ -383,9 +398,15 @@ func (f *Framework) createPoseidonClusterRole() error {
 			},
 			{
 				APIGroups: []string{""},
-				Resources: []string{"endpoints"},
+				Resources: []string{"configmaps", "endpoints"},
 				Verbs:     []string{"create"},
 			},
+			{
+				APIGroups:     []string{""},
+				ResourceNames: []string{"poseidon-leader"},
+				Resources:     []string{"configmaps"},
+				Verbs:         []string{"get", "update"},
+			},
 			{
 				APIGroups:     []string{""},
 				ResourceNames: []string{"poseidon"},
@@ -474,6 +495,8 @@ func (f *Framework) createPoseidonDeployment() (*v1beta1.Deployment, error) {
 	revisionHistoryLimit = 10
 	privileged := false
 	poseidonImage := fmt.Sprintf("gcr.io/%s/poseidon-amd64:%s", *gcrProject, *poseidonVersion)
+	command := []string{"/poseidon", "--logtostderr", "--kubeConfig=", "--kubeVersion=1.6", "--firmamentAddress=firmament-service.poseidon-test", "--firmamentPort=9090",
+		"--firmamentCostModel=" + *firmamentCostModel, "--firmamentSolver=" + *firmamentSolver}
 	deployment, err := f.ClientSet.ExtensionsV1beta1().Deployments(f.TestingNS).Create(&v1beta1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Labels: map[string]string{"component": "poseidon", "tier": "control-plane", "poseidonservice": "poseidon"},
@@ -492,7 +515,7 @@ func (f *Framework) createPoseidonDeployment() (*v1beta1.Deployment, error) {
 						{
 							Name:    "poseidon",
 							Image:   poseidonImage,
-							Command: []string{"/poseidon", "--logtostderr", "--kubeConfig=", "--kubeVersion=1.6", "--firmamentAddress=firmament-service.poseidon-test", "--firmamentPort=9090"},
+							Command: command,
 						},
 					},
 					InitContainers: []v1.Container{
@@ -0,0 +1,77 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package framework
+
+import (
+	"bytes"
+	"fmt"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// poseidonMetricsPort is the default port of the poseidon metrics endpoint, see --metricsBindAddress.
+const poseidonMetricsPort = 8989
+
+// GetPoseidonMetrics scrapes the metrics endpoint of the poseidon pod through the API server proxy.
+func (f *Framework) GetPoseidonMetrics() (map[string]*dto.MetricFamily, error) {
+	podList, err := f.ClientSet.CoreV1().Pods(f.TestingNS).List(metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{"component": "poseidon"}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(podList.Items) == 0 {
+		return nil, fmt.Errorf("no poseidon pod found in namespace %s", f.TestingNS)
+	}
+	body, err := f.ClientSet.CoreV1().RESTClient().Get().
+		Namespace(f.TestingNS).
+		Resource("pods").
+		Name(fmt.Sprintf("%s:%d", podList.Items[0].Name, poseidonMetricsPort)).
+		SubResource("proxy").
+		Suffix("metrics").
+		Do().
+		Raw()
+	if err != nil {
+		return nil, err
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(bytes.NewReader(body))
+}
+
+// MetricValue returns the value of a metric summed over all its labels. The value of a counter or
+// a gauge is returned, and the number of observations of a histogram.
+func MetricValue(families map[string]*dto.MetricFamily, name string) float64 {
+	family, ok := families[name]
+	if !ok {
+		return 0
+	}
+	var value float64
+	for _, metric := range family.GetMetric() {
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			value += metric.GetCounter().GetValue()
+		case dto.MetricType_GAUGE:
+			value += metric.GetGauge().GetValue()
+		case dto.MetricType_HISTOGRAM:
+			value += float64(metric.GetHistogram().GetSampleCount())
+		}
+	}
+	return value
+}
@@ -19,6 +19,7 @@ package test
 import (
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/kubernetes-sigs/poseidon/pkg/leaderelection"
 	"github.com/kubernetes-sigs/poseidon/test/e2e/framework"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -28,6 +29,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"math/rand"
 	"os"
@@ -93,6 +95,20 @@ var _ = Describe("Poseidon", func() {
 				glog.Info("pod status =", string(pod.Status.Phase))
 				Expect(string(pod.Status.Phase)).To(Equal("Running"))
 
+				By("Checking the Scheduled event was recorded for the pod")
+				events, err := clientset.CoreV1().Events(ns).List(metav1.ListOptions{
+					FieldSelector: fmt.Sprintf("involvedObject.kind=Pod,involvedObject.name=%s", name),
+				})
+				Expect(err).NotTo(HaveOccurred())
+				scheduled := false
+				for _, event := range events.Items {
+					if event.Reason == "Scheduled" {
+						scheduled = true
+						break
+					}
+				}
+				Expect(scheduled).To(Equal(true))
+
 				By("Pod was in Running state... Time to delete the pod now...")
 				err = clientset.CoreV1().Pods(ns).Delete(name, &metav1.DeleteOptions{})
 				Expect(err).NotTo(HaveOccurred())
@@ -2047,6 +2063,344 @@ var _ = Describe("Poseidon", func() {
 
 		})
 
+		It("a running pod without tolerations is evicted when a NoExecute taint is applied on its node", func() {
+			labelPodName := "nginx-evicted-by-noexecute-taint"
+			testpod := testPodConfig{
+				Name:          labelPodName,
+				SchedulerName: "poseidon",
+			}
+
+			By("Trying to get a schedulable node")
+			schedulableNodes := framework.ListSchedulableNodes(clientset)
+			if len(schedulableNodes) < 2 {
+				Skip(fmt.Sprintf("Skipping this test case as this requires minimum of two node and only %d nodes available", len(schedulableNodes)))
+			}
+
+			By("Trying to launch the pod on a node without taints")
+			createTestPod(f, testpod)
+			framework.ExpectNoError(framework.WaitForPodNotPending(clientset, ns, labelPodName))
+			labelPod, err := clientset.CoreV1().Pods(ns).Get(labelPodName, metav1.GetOptions{})
+			framework.ExpectNoError(err)
+			taintedNodeName := labelPod.Spec.NodeName
+
+			taint := v1.Taint{
+				Key:    "dedicated",
+				Value:  "user1",
+				Effect: "NoExecute",
+			}
+			defer func() {
+				By(fmt.Sprintf("Remove the taint from %s", taintedNodeName))
+				framework.RemoveTaintOffNode(clientset, taintedNodeName, taint)
+				framework.VerifyThatTaintIsGone(clientset, taintedNodeName, &taint)
+			}()
+
+			By(fmt.Sprintf("Trying to apply a NoExecute taint on %s", taintedNodeName))
+			framework.AddOrUpdateTaintOnNode(clientset, taintedNodeName, taint)
+			framework.ExpectNodeHasTaint(clientset, taintedNodeName, &taint)
+
+			By("Validate if the pod is evicted")
+			err = f.WaitForPodNotFound(labelPodName, 2*time.Minute)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Trying to launch the pod again, it should land on the clean node")
+			createTestPod(f, testpod)
+			framework.ExpectNoError(framework.WaitForPodNotPending(clientset, ns, labelPodName))
+			labelPod, err = clientset.CoreV1().Pods(ns).Get(labelPodName, metav1.GetOptions{})
+			framework.ExpectNoError(err)
+			Expect(labelPod.Spec.NodeName).NotTo(Equal(taintedNodeName))
+
+			By("Delete the pod")
+			err = clientset.CoreV1().Pods(ns).Delete(labelPodName, &metav1.DeleteOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			err = f.WaitForPodNotFound(labelPodName, 2*time.Minute)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("Poseidon [Local persistent volume]", func() {
+		// A local volume can only be used on the node it is pinned to by its node affinity, every pod
+		// using the volume has to be placed onto that node.
+		It("validates that pods using a local persistent volume are placed onto the node of the volume", func() {
+			By("Trying to get two schedulable nodes")
+			schedulableNodes := framework.ListSchedulableNodes(clientset)
+			if len(schedulableNodes) < 2 {
+				Skip(fmt.Sprintf("Skipping this test case as this requires minimum of two node and only %d nodes available", len(schedulableNodes)))
+			}
+			// The volume is not pinned to the first node, which is picked when the volume is ignored.
+			node := schedulableNodes[1]
+			hostname := node.Labels["kubernetes.io/hostname"]
+
+			By(fmt.Sprintf("Trying to create a local persistent volume pinned to node %s", node.Name))
+			storageClassName := ""
+			pvName := fmt.Sprintf("local-pv-%d", rand.Uint32())
+			pv, err := clientset.CoreV1().PersistentVolumes().Create(&v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: pvName},
+				Spec: v1.PersistentVolumeSpec{
+					Capacity: v1.ResourceList{
+						v1.ResourceStorage: resource.MustParse("1Gi"),
+					},
+					AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+					PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+					StorageClassName:              storageClassName,
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						Local: &v1.LocalVolumeSource{Path: "/tmp"},
+					},
+					NodeAffinity: &v1.VolumeNodeAffinity{
+						Required: &v1.NodeSelector{
+							NodeSelectorTerms: []v1.NodeSelectorTerm{
+								{
+									MatchExpressions: []v1.NodeSelectorRequirement{
+										{
+											Key:      "kubernetes.io/hostname",
+											Operator: v1.NodeSelectorOpIn,
+											Values:   []string{hostname},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			})
+			framework.ExpectNoError(err)
+			defer func() {
+				framework.Logf("Time to clean up the persistent volume [%s] now...", pv.Name)
+				err := clientset.CoreV1().PersistentVolumes().Delete(pv.Name, &metav1.DeleteOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			By("Trying to create a claim bound to the local persistent volume")
+			pvc, err := clientset.CoreV1().PersistentVolumeClaims(ns).Create(&v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "local-pvc"},
+				Spec: v1.PersistentVolumeClaimSpec{
+					AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+					Resources: v1.ResourceRequirements{
+						Requests: v1.ResourceList{
+							v1.ResourceStorage: resource.MustParse("1Gi"),
+						},
+					},
+					StorageClassName: &storageClassName,
+					VolumeName:       pv.Name,
+				},
+			})
+			framework.ExpectNoError(err)
+			defer func() {
+				framework.Logf("Time to clean up the claim [%s] now...", pvc.Name)
+				err := clientset.CoreV1().PersistentVolumeClaims(ns).Delete(pvc.Name, &metav1.DeleteOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			for i := 0; i < 3; i++ {
+				podName := fmt.Sprintf("with-local-pv-%d", i)
+				By(fmt.Sprintf("Trying to launch the pod %s using the local persistent volume", podName))
+				testPod := createTestPod(f, testPodConfig{
+					Name: podName,
+					Volumes: []v1.Volume{
+						{
+							Name: "local-volume",
+							VolumeSource: v1.VolumeSource{
+								PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: pvc.Name},
+							},
+						},
+					},
+					SchedulerName: "poseidon",
+				})
+				defer func() {
+					framework.Logf("Time to clean up the pod [%s] now...", testPod.Name)
+					err := clientset.CoreV1().Pods(ns).Delete(testPod.Name, &metav1.DeleteOptions{})
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				By(fmt.Sprintf("validate that the pod %s is placed onto node %s", podName, node.Name))
+				framework.ExpectNoError(framework.WaitForPodNotPending(clientset, ns, podName))
+				pod, err := clientset.CoreV1().Pods(ns).Get(podName, metav1.GetOptions{})
+				framework.ExpectNoError(err)
+				Expect(pod.Spec.NodeName).To(Equal(node.Name))
+			}
+		})
+	})
+
+	Describe("Poseidon [Gang scheduling]", func() {
+		// Create a gang of 4 pods on a cluster where a single node is available and fits only 3 of them.
+		// No pod of the gang is bound until another node becomes available, the gang is then bound at once.
+		It("validates that a gang is only scheduled once all of its pods can be placed", func() {
+			gangSize := 4
+			By("Trying to get two schedulable nodes")
+			schedulableNodes := framework.ListSchedulableNodes(clientset)
+			if len(schedulableNodes) < 2 {
+				Skip(fmt.Sprintf("Skipping this test case as this requires minimum of two node and only %d nodes available", len(schedulableNodes)))
+			}
+			nodeOne := schedulableNodes[0]
+			nodeTwo := schedulableNodes[1]
+
+			nodeToAllocatableMap := make(map[string]int64)
+			for _, node := range schedulableNodes[:2] {
+				allocatable, found := node.Status.Allocatable[v1.ResourceCPU]
+				Expect(found).To(Equal(true))
+				nodeToAllocatableMap[node.Name] = allocatable.MilliValue()
+			}
+			pods, err := clientset.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+			framework.ExpectNoError(err)
+			for _, pod := range pods.Items {
+				if _, found := nodeToAllocatableMap[pod.Spec.NodeName]; found && pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed {
+					nodeToAllocatableMap[pod.Spec.NodeName] -= getRequestedCPU(pod)
+				}
+			}
+			// Three pods take 90% of the remaining CPU of the first node, the fourth pod does not fit.
+			requestedCPU := nodeToAllocatableMap[nodeOne.Name] * 3 / 10
+			if requestedCPU > nodeToAllocatableMap[nodeTwo.Name] {
+				Skip(fmt.Sprintf("Skipping this test case as node %s can not run a pod requesting %dm CPU", nodeTwo.Name, requestedCPU))
+			}
+
+			taint := v1.Taint{
+				Key:    "gang",
+				Value:  "unavailable",
+				Effect: "NoSchedule",
+			}
+			taintedNodes := make(map[string]bool)
+			defer func() {
+				for nodeName := range taintedNodes {
+					By(fmt.Sprintf("Remove the taint from %s", nodeName))
+					framework.RemoveTaintOffNode(clientset, nodeName, taint)
+				}
+			}()
+			for _, node := range schedulableNodes[1:] {
+				By(fmt.Sprintf("Trying to apply a taint on %s", node.Name))
+				framework.AddOrUpdateTaintOnNode(clientset, node.Name, taint)
+				framework.ExpectNodeHasTaint(clientset, node.Name, &taint)
+				taintedNodes[node.Name] = true
+			}
+
+			By(fmt.Sprintf("Creating a gang of %d pods requesting %dm CPU each", gangSize, requestedCPU))
+			var gangPods []*v1.Pod
+			defer func() {
+				for _, pod := range gangPods {
+					framework.Logf("Time to clean up the pod [%s] now...", pod.Name)
+					err = clientset.CoreV1().Pods(ns).Delete(pod.Name, &metav1.DeleteOptions{})
+					Expect(err).NotTo(HaveOccurred())
+				}
+			}()
+			for i := 0; i < gangSize; i++ {
+				gangPods = append(gangPods, createTestPod(f, testPodConfig{
+					Name: fmt.Sprintf("gang-pod-%d", i),
+					Annotations: map[string]string{
+						"poseidon.kubernetes.io/gang-name": "gang-test",
+						"poseidon.kubernetes.io/gang-size": fmt.Sprintf("%d", gangSize),
+					},
+					Resources: &v1.ResourceRequirements{
+						Limits: v1.ResourceList{
+							v1.ResourceCPU: *resource.NewMilliQuantity(requestedCPU, resource.DecimalSI),
+						},
+						Requests: v1.ResourceList{
+							v1.ResourceCPU: *resource.NewMilliQuantity(requestedCPU, resource.DecimalSI),
+						},
+					},
+					SchedulerName: "poseidon",
+				}))
+			}
+
+			By("Validate that the entire gang stays pending")
+			// we wait only for 2 minutes here, since the gang can not be placed on a single node
+			err = framework.WaitTimeoutForPodRunningInNamespace(clientset, gangPods[0].Name, ns, time.Minute*2)
+			Expect(err).To(HaveOccurred())
+			for _, pod := range gangPods {
+				gangPod, err := clientset.CoreV1().Pods(ns).Get(pod.Name, metav1.GetOptions{})
+				framework.ExpectNoError(err)
+				Expect(gangPod.Spec.NodeName).To(BeEmpty())
+			}
+
+			By(fmt.Sprintf("Make node %s available by removing its taint", nodeTwo.Name))
+			framework.RemoveTaintOffNode(clientset, nodeTwo.Name, taint)
+			delete(taintedNodes, nodeTwo.Name)
+
+			By("Validate that the entire gang is scheduled")
+			for _, pod := range gangPods {
+				framework.ExpectNoError(framework.WaitForPodRunningInNamespace(clientset, pod))
+			}
+		})
+	})
+
+	Describe("Poseidon [Metrics]", func() {
+		// Schedule a few pods and check the scheduling attempts and latencies reported by poseidon.
+		It("validates that the scheduling attempts and latencies of the pods are recorded", func() {
+			podCount := 3
+			before, err := f.GetPoseidonMetrics()
+			framework.ExpectNoError(err)
+
+			var pods []*v1.Pod
+			defer func() {
+				for _, pod := range pods {
+					framework.Logf("Time to clean up the pod [%s] now...", pod.Name)
+					err = clientset.CoreV1().Pods(ns).Delete(pod.Name, &metav1.DeleteOptions{})
+					Expect(err).NotTo(HaveOccurred())
+				}
+			}()
+			By(fmt.Sprintf("Scheduling %d pods", podCount))
+			for i := 0; i < podCount; i++ {
+				pods = append(pods, runPausePod(f, testPodConfig{Name: fmt.Sprintf("metrics-pod-%d", i), SchedulerName: "poseidon"}))
+			}
+
+			after, err := f.GetPoseidonMetrics()
+			framework.ExpectNoError(err)
+			delta := func(name string) float64 {
+				return framework.MetricValue(after, name) - framework.MetricValue(before, name)
+			}
+			Expect(delta("poseidon_scheduling_attempts_total")).To(Equal(float64(podCount)))
+			Expect(delta("poseidon_e2e_scheduling_latency_microseconds")).To(Equal(float64(podCount)))
+			Expect(delta("poseidon_binding_latency_microseconds")).To(Equal(float64(podCount)))
+			Expect(delta("poseidon_scheduling_algorithm_latency_microseconds")).To(BeNumerically(">", 0))
+			Expect(delta("poseidon_watcher_events_total")).To(BeNumerically(">=", podCount))
+			Expect(after).To(HaveKey("process_start_time_seconds"))
+			Expect(after).To(HaveKey("go_goroutines"))
+		})
+	})
+
+	Describe("Poseidon [Leader election]", func() {
+		// Run two replicas of poseidon, kill the leader and check that the standby replica takes over the scheduling.
+		It("validates that pods are scheduled once the leader replica is killed", func() {
+			var replicas int32 = 2
+			deployments := clientset.ExtensionsV1beta1().Deployments(f.TestingNS)
+			scale := func(replicas int32) {
+				deployment, err := deployments.Get("poseidon", metav1.GetOptions{})
+				framework.ExpectNoError(err)
+				deployment.Spec.Replicas = &replicas
+				deployment, err = deployments.Update(deployment)
+				framework.ExpectNoError(err)
+				framework.ExpectNoError(f.WaitForDeploymentComplete(deployment))
+			}
+			By(fmt.Sprintf("Scaling poseidon to %d replicas", replicas))
+			scale(replicas)
+			defer func() {
+				By("Scaling poseidon back to 1 replica")
+				scale(1)
+			}()
+
+			var leader string
+			err := wait.PollImmediate(2*time.Second, time.Minute, func() (bool, error) {
+				var err error
+				leader, err = leaderelection.GetLeader(clientset, f.TestingNS, "poseidon-leader")
+				return leader != "", err
+			})
+			framework.ExpectNoError(err)
+			By(fmt.Sprintf("Killing the leader replica %s", leader))
+			err = clientset.CoreV1().Pods(f.TestingNS).Delete(leader, metav1.NewDeleteOptions(0))
+			framework.ExpectNoError(err)
+
+			By("Waiting for another replica to acquire the leadership")
+			err = wait.PollImmediate(2*time.Second, 2*time.Minute, func() (bool, error) {
+				holder, err := leaderelection.GetLeader(clientset, f.TestingNS, "poseidon-leader")
+				return holder != "" && holder != leader, err
+			})
+			framework.ExpectNoError(err)
+
+			pod := runPausePod(f, testPodConfig{Name: "leader-election-pod", SchedulerName: "poseidon"})
+			defer func() {
+				framework.Logf("Time to clean up the pod [%s] now...", pod.Name)
+				err = clientset.CoreV1().Pods(ns).Delete(pod.Name, &metav1.DeleteOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}()
+			Expect(pod.Spec.NodeName).NotTo(BeEmpty())
+		})
 	})
 
 	Describe("Poseidon [Max-Pods Test]", func() {
@@ -33,6 +33,7 @@ type testPodConfig struct {
 	OwnerReferences                   []metav1.OwnerReference
 	PriorityClassName                 string
 	SchedulerName                     string
+	Volumes                           []v1.Volume
 }
 
 func getRequestedCPU(pod v1.Pod) int64 {
@@ -79,6 +80,7 @@ func initTestPod(f *framework.Framework, conf testPodConfig) *v1.Pod {
 			NodeName:          conf.NodeName,
 			PriorityClassName: conf.PriorityClassName,
 			SchedulerName:     conf.SchedulerName,
+			Volumes:           conf.Volumes,
 		},
 	}
 	if conf.Resources != nil {